@@ -0,0 +1,75 @@
+package app
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/operations"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+// fakeEC2 is a Client VPN endpoint with mutual certificate authentication
+// that keeps the CRLs imported in it
+type fakeEC2 struct {
+	ec2iface.EC2API
+	endpointID string
+	// block, if set, makes the imports wait until it is closed or their
+	// context is done, signalling in importing that they started
+	block     chan struct{}
+	importing chan struct{}
+
+	sync.Mutex
+	crl     string
+	imports int
+}
+
+// useFakeEC2 makes the operations use a fake endpoint until the test is done
+func useFakeEC2(t *testing.T, endpointID string) *fakeEC2 {
+	f := &fakeEC2{endpointID: endpointID}
+	operations.SetEC2Client(f)
+	t.Cleanup(func() { operations.SetEC2Client(nil) })
+	return f
+}
+
+func (f *fakeEC2) DescribeClientVpnEndpoints(in *ec2.DescribeClientVpnEndpointsInput) (*ec2.DescribeClientVpnEndpointsOutput, error) {
+	return f.DescribeClientVpnEndpointsWithContext(aws.BackgroundContext(), in)
+}
+
+func (f *fakeEC2) DescribeClientVpnEndpointsWithContext(ctx aws.Context, in *ec2.DescribeClientVpnEndpointsInput, opts ...request.Option) (*ec2.DescribeClientVpnEndpointsOutput, error) {
+	return &ec2.DescribeClientVpnEndpointsOutput{ClientVpnEndpoints: []*ec2.ClientVpnEndpoint{{
+		ClientVpnEndpointId: aws.String(f.endpointID),
+		DnsName:             aws.String("*." + f.endpointID + ".prod.clientvpn.us-east-1.amazonaws.com"),
+		AuthenticationOptions: []*ec2.ClientVpnAuthentication{
+			{Type: aws.String(ec2.ClientVpnAuthenticationTypeCertificateAuthentication)},
+		},
+	}}}, nil
+}
+
+func (f *fakeEC2) ExportClientVpnClientCertificateRevocationListWithContext(ctx aws.Context, in *ec2.ExportClientVpnClientCertificateRevocationListInput, opts ...request.Option) (*ec2.ExportClientVpnClientCertificateRevocationListOutput, error) {
+	f.Lock()
+	defer f.Unlock()
+	out := &ec2.ExportClientVpnClientCertificateRevocationListOutput{}
+	if f.crl != "" {
+		out.CertificateRevocationList = aws.String(f.crl)
+	}
+	return out, nil
+}
+
+func (f *fakeEC2) ImportClientVpnClientCertificateRevocationListWithContext(ctx aws.Context, in *ec2.ImportClientVpnClientCertificateRevocationListInput, opts ...request.Option) (*ec2.ImportClientVpnClientCertificateRevocationListOutput, error) {
+	if f.block != nil {
+		f.importing <- struct{}{}
+		select {
+		case <-f.block:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	f.Lock()
+	defer f.Unlock()
+	f.crl = aws.StringValue(in.CertificateRevocationList)
+	f.imports++
+	return &ec2.ImportClientVpnClientCertificateRevocationListOutput{Return: aws.Bool(true)}, nil
+}
@@ -0,0 +1,642 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/operations"
+	"github.com/hashicorp/vault/api"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// Exit codes of the CLI commands, so scripts can tell
+// a failure from a run that had nothing to do
+const (
+	exitError       = 1
+	exitNothingToDo = 2
+)
+
+// cliOutput is the output format of the CLI commands: table or json
+var cliOutput string
+
+var issueCmd = &cobra.Command{
+	Use:     "issue <user>",
+	Short:   "Issues a client certificate for the user and prints the VPN config",
+	Long:    "Issues a client certificate for the user, revoking the previous ones unless --temp is set, stores the VPN config in Vault and prints it. Runs against Vault and AWS directly, without the server.",
+	Example: "aws-cvpn-pki-manager issue john.doe --vault-auth-token s.XXXXXXXXX --client-vpn-endpoint-id cvpn-endpoint-0873f24b07b72b3ee",
+	Args:    cobra.ExactArgs(1),
+	Run:     runIssue,
+}
+
+var revokeCmd = &cobra.Command{
+	Use:     "revoke <user>",
+	Short:   "Revokes all the certificates of the user",
+	Long:    "Revokes all the certificates of the user and updates the CRL of the Client VPN endpoint. Runs against Vault and AWS directly, without the server. Exits with 2 if the user has no certificates.",
+	Example: "aws-cvpn-pki-manager revoke john.doe --reason keyCompromise --vault-auth-token s.XXXXXXXXX --client-vpn-endpoint-id cvpn-endpoint-0873f24b07b72b3ee",
+	Args:    cobra.ExactArgs(1),
+	Run:     runRevoke,
+}
+
+var revokeIssuedBeforeCmd = &cobra.Command{
+	Use:     "revoke-issued-before <cutoff>",
+	Short:   "Revokes all the certificates issued before the cutoff",
+	Long:    "Revokes all the certificates issued before the cutoff, an RFC 3339 timestamp, whichever their user, and updates the CRL of the Client VPN endpoint, e.g. after the CA key may have been exposed. The certificates already revoked or expired are left out. Runs against Vault and AWS directly, without the server. Exits with 2 if there are no certificates to revoke.",
+	Example: "aws-cvpn-pki-manager revoke-issued-before 2020-01-01T00:00:00Z --dry-run --vault-auth-token s.XXXXXXXXX --client-vpn-endpoint-id cvpn-endpoint-0873f24b07b72b3ee",
+	Args:    cobra.ExactArgs(1),
+	Run:     runRevokeIssuedBefore,
+}
+
+var listUsersCmd = &cobra.Command{
+	Use:   "list-users",
+	Short: "Lists the users and their certificates",
+	Long:  "Lists the users and their certificates. Runs against Vault directly, without the server. Exits with 2 if no users are found.",
+	Args:  cobra.NoArgs,
+	Run:   runListUsers,
+}
+
+var crlCmd = &cobra.Command{
+	Use:   "crl",
+	Short: "Manages the CRL without the server",
+}
+
+var crlGetCmd = &cobra.Command{
+	Use:   "get",
+	Short: "Prints the CRL from Vault",
+	Args:  cobra.NoArgs,
+	Run:   runCRLGet,
+}
+
+var crlUpdateCmd = &cobra.Command{
+	Use:   "update",
+	Short: "Updates the CRL and imports it in the Client VPN endpoint",
+	Long:  "Revokes the certificates that are not the latest of their users and imports the CRL in the Client VPN endpoint. Exits with 2 if nothing was revoked and the CRL of the endpoint was already up to date.",
+	Args:  cobra.NoArgs,
+	Run:   runCRLUpdate,
+}
+
+var crlRotateCmd = &cobra.Command{
+	Use:   "rotate",
+	Short: "Rotates the CRL in Vault and imports it in the Client VPN endpoint",
+	Long:  "Rotates the CRL in Vault, unless its next update is not due within --crl-rotation-window, and imports it in the Client VPN endpoint. Exits with 2 if the rotation was skipped and the CRL of the endpoint was already up to date.",
+	Args:  cobra.NoArgs,
+	Run:   runCRLRotate,
+}
+
+var crlRebuildCmd = &cobra.Command{
+	Use:   "rebuild",
+	Short: "Rebuilds the CRL from the certificates revoked in Vault and imports it in the Client VPN endpoint",
+	Long:  "Rotates the CRL in Vault and checks that it lists exactly the certificates with a revocation time in Vault before importing it in the Client VPN endpoint, without revoking any certificate. Meant to recover a lost or corrupted CRL. Exits with 1, without importing it, if the CRL doesn't match, unless --force-import is set.",
+	Args:  cobra.NoArgs,
+	Run:   runCRLRebuild,
+}
+
+var caCmd = &cobra.Command{
+	Use:   "ca",
+	Short: "Manages the CA of the PKI without the server",
+}
+
+var caRotateIntermediateCmd = &cobra.Command{
+	Use:   "rotate-intermediate",
+	Short: "Rotates the intermediate CA of the last PKI path and prints the new CA chain",
+	Long:  "Generates a new key and CSR in the last of --vault-pki-paths, has it signed by --root-pki-path, which defaults to the previous of --vault-pki-paths, and sets the signed certificate as the intermediate of the mount. The certificates issued from then on are signed by the new intermediate, while the existing ones remain valid under the old intermediate until they expire, so keep it in the trust of the endpoint until then. Prints the new CA chain.",
+	Args:  cobra.NoArgs,
+	Run:   runCARotateIntermediate,
+}
+
+var cliOpts struct {
+	temp        bool
+	discardKey  bool
+	role        string
+	ttl         time.Duration
+	reason      string
+	prefix      string
+	activeOnly  bool
+	allPaths    bool
+	format      string
+	forceShrink bool
+	forceImport bool
+	window      time.Duration
+	summary     bool
+	rootPKIPath string
+	commonName  string
+	dryRun      bool
+	outputFile  string
+	altNames    []string
+	ipSANs      []string
+	emailSANs   []string
+}
+
+func init() {
+	for _, cmd := range []*cobra.Command{issueCmd, revokeCmd, revokeIssuedBeforeCmd, listUsersCmd, crlCmd, caCmd} {
+		rootCmd.AddCommand(cmd)
+	}
+	crlCmd.AddCommand(crlGetCmd, crlUpdateCmd, crlRotateCmd, crlRebuildCmd)
+	caCmd.AddCommand(caRotateIntermediateCmd)
+	for _, cmd := range []*cobra.Command{issueCmd, revokeCmd, revokeIssuedBeforeCmd, listUsersCmd, crlGetCmd, crlUpdateCmd, crlRotateCmd, crlRebuildCmd, caRotateIntermediateCmd} {
+		cmd.Flags().StringVarP(&cliOutput, "output", "o", "table", "Output format, one of: table/json")
+	}
+
+	issueCmd.Flags().BoolVar(&cliOpts.temp, "temp", false, "Issue a temporary certificate, which does not revoke the previous ones nor is stored")
+	issueCmd.Flags().BoolVar(&cliOpts.discardKey, "discard-key", false, "Only print the private key, without storing it, as with the server's --discard-private-keys")
+	issueCmd.Flags().StringVar(&cliOpts.role, "role", "", "The Vault role used to issue temporary certificates")
+	issueCmd.Flags().DurationVar(&cliOpts.ttl, "ttl", 0, "Lifetime of the certificate. Defaults to the ttl of the role")
+	issueCmd.Flags().StringSliceVar(&cliOpts.altNames, "alt-names", []string{}, "DNS names added as subject alternative names, allowed by the role")
+	issueCmd.Flags().StringSliceVar(&cliOpts.ipSANs, "ip-sans", []string{}, "IP addresses added as subject alternative names, allowed by the role")
+	issueCmd.Flags().StringSliceVar(&cliOpts.emailSANs, "email-sans", []string{}, "Emails added as subject alternative names, allowed by the role")
+	revokeCmd.Flags().StringVar(&cliOpts.reason, "reason", "", "Reason of the revocation, one of: unspecified/keyCompromise/affiliationChanged/superseded/cessationOfOperation/privilegeWithdrawn, or its CRL reason code")
+	revokeIssuedBeforeCmd.Flags().StringVar(&cliOpts.reason, "reason", string(operations.ReasonKeyCompromise), "Reason of the revocation, one of: unspecified/keyCompromise/affiliationChanged/superseded/cessationOfOperation/privilegeWithdrawn, or its CRL reason code")
+	revokeIssuedBeforeCmd.Flags().BoolVar(&cliOpts.dryRun, "dry-run", false, "Only list the certificates that would be revoked")
+	listUsersCmd.Flags().StringVar(&cliOpts.prefix, "prefix", "", "Only list the users whose username starts with the prefix")
+	listUsersCmd.Flags().BoolVar(&cliOpts.activeOnly, "active-only", false, "Only list the certificates that are not revoked nor expired")
+	listUsersCmd.Flags().BoolVar(&cliOpts.allPaths, "all-paths", false, "List the users of each of the PKI paths, instead of the last one only")
+	crlGetCmd.Flags().StringVar(&cliOpts.format, "format", "pem", "Format of the CRL, one of: pem/der. The DER CRL is written as is, whatever the output")
+	crlGetCmd.Flags().StringVar(&cliOpts.outputFile, "output-file", "", "Write the CRL to this file, instead of stdout, and a summary to stderr")
+	crlUpdateCmd.Flags().BoolVar(&cliOpts.forceShrink, "force-shrink", false, "Import the CRL even if it drops more entries of the active one than crl-max-shrink")
+	crlUpdateCmd.Flags().BoolVar(&cliOpts.forceImport, "force-import", false, "Import the CRL even if it is the same as the active one")
+	crlRebuildCmd.Flags().BoolVar(&cliOpts.forceImport, "force-import", false, "Import the CRL even if it doesn't match the certificates revoked in Vault")
+	crlRotateCmd.Flags().DurationVar(&cliOpts.window, "crl-rotation-window", 0, "Only rotate the CRL if its next update is due within this window. Always rotate if 0")
+	crlRotateCmd.Flags().BoolVar(&cliOpts.summary, "summary", false, "Print a human readable summary of the rotation, e.g. to post it to a chat channel")
+	caRotateIntermediateCmd.Flags().StringVar(&cliOpts.rootPKIPath, "root-pki-path", "", "The Vault PKI path of the CA that signs the new intermediate. Defaults to the previous of vault-pki-paths")
+	caRotateIntermediateCmd.Flags().StringVar(&cliOpts.commonName, "common-name", "", "Common name of the new intermediate. Defaults to the one of the current intermediate")
+	caRotateIntermediateCmd.Flags().DurationVar(&cliOpts.ttl, "ttl", 0, "Lifetime of the new intermediate. Defaults to the max ttl of the root PKI")
+}
+
+// cliClient sets up the operations as the server does and
+// returns the Vault client the CLI commands run with
+func cliClient() *api.Client {
+	if cliOutput != "table" && cliOutput != "json" {
+		log.Fatalf("Unknown output format '%s'", cliOutput)
+	}
+	operations.SetAWSUserAgent(viper.GetString("aws-user-agent"))
+	operations.SetAWSEndpointURL(viper.GetString("aws-endpoint-url"))
+	setupStorage()
+	err := operations.SetUsernameRule(operations.UsernameRule{
+		Regexp:     viper.GetString("username-regexp"),
+		TrimPrefix: viper.GetString("username-trim-prefix"),
+		TrimSuffix: viper.GetString("username-trim-suffix"),
+		Normalize:  viper.GetBool("username-normalize"),
+		Pattern:    viper.GetString("username-pattern"),
+	})
+	if err != nil {
+		log.Fatalf("Invalid username rule: %s", err)
+	}
+	client, err := vaultClient().GetClient()
+	if err != nil {
+		log.Fatalf("Unable to get the Vault client: %s", err)
+	}
+	return client
+}
+
+// cliFail prints the error and exits with exitError
+func cliFail(msg string, err error) {
+	fmt.Fprintf(os.Stderr, "%s: %s\n", msg, err)
+	os.Exit(exitError)
+}
+
+// printJSON prints v indented, for --output json
+func printJSON(v interface{}) {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		cliFail("Unable to encode the output", err)
+	}
+	fmt.Println(string(b))
+}
+
+// printTable prints the rows aligned in columns under the header
+func printTable(header []string, rows [][]string) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, strings.Join(header, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+	w.Flush()
+}
+
+func lastPKIPath() string {
+	paths := viper.GetStringSlice("vault-pki-paths")
+	return paths[len(paths)-1]
+}
+
+func runIssue(cmd *cobra.Command, args []string) {
+	client := cliClient()
+	tpl, err := operations.LoadConfigTemplate(viper.GetString("config-template-path"), viper.GetString("config-template"))
+	if err != nil {
+		log.Fatalf("Invalid OpenVPN config template: %s", err)
+	}
+	dir, err := newUserDirectory()
+	if err != nil {
+		log.Fatalf("Invalid directory config: %s", err)
+	}
+	req := &operations.IssueCertificateRequest{
+		Client:              client,
+		VaultPKIPaths:       viper.GetStringSlice("vault-pki-paths"),
+		VaultPKIRole:        viper.GetString("vault-client-certificate-role"),
+		Username:            args[0],
+		ClientVPNEndpointID: viper.GetString("client-vpn-endpoint-id"),
+		VaultKVPath:         viper.GetString("vault-kv-path"),
+		VaultBundleKVPath:   viper.GetString("vault-bundle-kv-path"),
+		CfgTemplate:         tpl,
+		CfgFromEndpoint:     viper.GetString("config-source") == "endpoint",
+		Temporary:           cliOpts.temp,
+		DiscardPrivateKey:   cliOpts.discardKey || viper.GetBool("discard-private-keys"),
+		TTL:                 cliOpts.ttl,
+		AltNames:            cliOpts.altNames,
+		IPSANs:              cliOpts.ipSANs,
+		EmailSANs:           cliOpts.emailSANs,
+		MaxCertsPerUser:     viper.GetInt("max-certs-per-user"),
+		RevokeOldest:        viper.GetBool("max-certs-revoke-oldest"),
+		DenyListKVPath:      denyListKVPath(),
+		Directory:           dir,
+		ValidateBundle:      viper.GetBool("validate-bundles"),
+		UpdateCRLOptions:    updateCRLOptions(context.Background(), nil, "cli"),
+	}
+	if cliOpts.temp {
+		if cliOpts.role == "" {
+			log.Fatal("A Vault PKI role is required to issue temporary certificates, use --role")
+		}
+		req.VaultPKIRole = cliOpts.role
+	}
+
+	res, err := operations.IssueClientCertificate(req)
+	if err != nil {
+		cliFail("Unable to issue a certificate for user "+args[0], err)
+	}
+	if cliOutput == "json" {
+		printJSON(map[string]string{
+			"serial":      res.SerialNumber,
+			"not-after":   res.NotAfter.Format(time.RFC3339),
+			"config-path": res.ConfigPath,
+			"config":      res.Config,
+		})
+		return
+	}
+	printTable([]string{"SERIAL", "NOT AFTER", "CONFIG PATH"}, [][]string{{res.SerialNumber, res.NotAfter.Format(time.RFC3339), res.ConfigPath}})
+	fmt.Println()
+	fmt.Print(res.Config)
+}
+
+func runRevoke(cmd *cobra.Command, args []string) {
+	client := cliClient()
+	reason, err := operations.ParseRevocationReason(cliOpts.reason)
+	if err != nil {
+		log.Fatal(err)
+	}
+	res, err := operations.RevokeUserWithResult(
+		&operations.RevokeUserRequest{
+			Client:              client,
+			VaultPKIPath:        lastPKIPath(),
+			Username:            args[0],
+			ClientVPNEndpointID: viper.GetString("client-vpn-endpoint-id"),
+			Reason:              reason,
+			VaultKVPath:         viper.GetString("vault-kv-path"),
+			DenyList:            denyListOnRevoke(),
+			UpdateCRLOptions:    updateCRLOptions(context.Background(), nil, "cli"),
+		})
+	if errors.Is(err, operations.ErrUserNotFound) {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitNothingToDo)
+	}
+	if err != nil {
+		cliFail("Unable to revoke user "+args[0], err)
+	}
+	if cliOutput == "json" {
+		printJSON(map[string]interface{}{"username": args[0], "revoked": res.Revoked})
+		return
+	}
+	rows := [][]string{}
+	for _, serial := range res.Revoked {
+		rows = append(rows, []string{args[0], serial})
+	}
+	printTable([]string{"USERNAME", "REVOKED SERIAL"}, rows)
+}
+
+func runRevokeIssuedBefore(cmd *cobra.Command, args []string) {
+	cutoff, err := time.Parse(time.RFC3339, args[0])
+	if err != nil {
+		log.Fatalf("Invalid cutoff, use an RFC 3339 timestamp: %s", err)
+	}
+	reason, err := operations.ParseRevocationReason(cliOpts.reason)
+	if err != nil {
+		log.Fatal(err)
+	}
+	client := cliClient()
+	res, err := operations.RevokeIssuedBefore(
+		&operations.RevokeIssuedBeforeRequest{
+			Client:              client,
+			VaultPKIPath:        lastPKIPath(),
+			ClientVPNEndpointID: viper.GetString("client-vpn-endpoint-id"),
+			Reason:              reason,
+			VaultKVPath:         viper.GetString("vault-kv-path"),
+			DryRun:              cliOpts.dryRun,
+			UpdateCRLOptions:    updateCRLOptions(context.Background(), nil, "cli"),
+		}, cutoff)
+	if res != nil {
+		if cliOutput == "json" {
+			failed := map[string]string{}
+			for user, ferr := range res.Failed {
+				failed[user] = ferr.Error()
+			}
+			printJSON(map[string]interface{}{"revoked": res.Revoked, "failed": failed, "dry-run": res.DryRun})
+		} else {
+			rows := [][]string{}
+			for _, user := range res.Users() {
+				for _, serial := range res.Revoked[user] {
+					rows = append(rows, []string{user, serial})
+				}
+			}
+			printTable([]string{"USERNAME", "SERIAL"}, rows)
+			for user, ferr := range res.Failed {
+				fmt.Fprintf(os.Stderr, "Unable to revoke the certificates of user %s: %s\n", user, ferr)
+			}
+		}
+	}
+	if err != nil {
+		cliFail("Unable to revoke the certificates issued before "+args[0], err)
+	}
+	if len(res.Failed) > 0 {
+		os.Exit(exitError)
+	}
+	if len(res.Revoked) == 0 {
+		os.Exit(exitNothingToDo)
+	}
+}
+
+func runListUsers(cmd *cobra.Command, args []string) {
+	client := cliClient()
+	req := operations.ListUsersRequest{
+		Client:              client,
+		VaultPKIPath:        lastPKIPath(),
+		ClientVPNEndpointID: viper.GetString("client-vpn-endpoint-id"),
+		IssuerRef:           viper.GetString("vault-pki-issuer"),
+		Prefix:              cliOpts.prefix,
+		ActiveOnly:          cliOpts.activeOnly,
+		AdoptedKVPath:       adoptedKVPath(),
+		VaultKVPath:         viper.GetString("vault-kv-path"),
+	}
+	if cliOpts.allPaths {
+		listUsersAllPaths(req)
+		return
+	}
+	users, err := operations.ListUsers(&req)
+	if err != nil {
+		cliFail("Unable to list the users", err)
+	}
+
+	if cliOutput == "json" {
+		printJSON(users)
+	} else {
+		usernames := make([]string, 0, len(users))
+		for username := range users {
+			usernames = append(usernames, username)
+		}
+		sort.Strings(usernames)
+		rows := [][]string{}
+		for _, username := range usernames {
+			for _, crt := range users[username] {
+				rows = append(rows, []string{username, crt.SerialNumber, crt.NotAfter.Format(time.RFC3339), fmt.Sprint(crt.Revoked), string(crt.RevocationReason)})
+			}
+		}
+		printTable([]string{"USERNAME", "SERIAL", "NOT AFTER", "REVOKED", "REASON"}, rows)
+	}
+	if len(users) == 0 {
+		os.Exit(exitNothingToDo)
+	}
+}
+
+// listUsersAllPaths lists the users of each of the PKI paths, reporting
+// the paths that couldn't be listed without stopping at them
+func listUsersAllPaths(req operations.ListUsersRequest) {
+	paths := viper.GetStringSlice("vault-pki-paths")
+	res := operations.ListUsersMultiPath(
+		&operations.ListUsersMultiPathRequest{
+			ListUsersRequest: req,
+			VaultPKIPaths:    paths,
+		})
+
+	found, failed := false, false
+	for _, path := range paths {
+		if res[path].Error != nil {
+			fmt.Fprintf(os.Stderr, "Unable to list the users of PKI path %s: %s\n", path, res[path].Error)
+			failed = true
+		}
+		found = found || len(res[path].Users) > 0
+	}
+	if cliOutput == "json" {
+		printJSON(res)
+	} else {
+		rows := [][]string{}
+		for _, path := range paths {
+			users := res[path].Users
+			usernames := make([]string, 0, len(users))
+			for username := range users {
+				usernames = append(usernames, username)
+			}
+			sort.Strings(usernames)
+			for _, username := range usernames {
+				for _, crt := range users[username] {
+					rows = append(rows, []string{path, username, crt.SerialNumber, crt.NotAfter.Format(time.RFC3339), fmt.Sprint(crt.Revoked), string(crt.RevocationReason)})
+				}
+			}
+		}
+		printTable([]string{"PKI PATH", "USERNAME", "SERIAL", "NOT AFTER", "REVOKED", "REASON"}, rows)
+	}
+	if failed {
+		os.Exit(exitError)
+	}
+	if !found {
+		os.Exit(exitNothingToDo)
+	}
+}
+
+func runCRLGet(cmd *cobra.Command, args []string) {
+	client := cliClient()
+	format := operations.CRLFormat(cliOpts.format)
+	if format != operations.CRLFormatPEM && format != operations.CRLFormatDER {
+		log.Fatalf("Unknown CRL format '%s'", cliOpts.format)
+	}
+	req := &operations.GetCRLRequest{
+		Client:              client,
+		VaultPKIPath:        lastPKIPath(),
+		Format:              format,
+		IssuerRef:           viper.GetString("vault-pki-issuer"),
+		ClientVPNEndpointID: viper.GetString("client-vpn-endpoint-id"),
+	}
+	if format == operations.CRLFormatPEM {
+		req.CRLPath = viper.GetString("vault-crl-path")
+	}
+	crl, err := operations.GetCRL(req)
+	if err != nil {
+		cliFail("Unable to get the CRL", err)
+	}
+	if cliOpts.outputFile != "" {
+		if err := writeCLIFile(cliOpts.outputFile, crl); err != nil {
+			cliFail("Unable to write the CRL", err)
+		}
+		fmt.Fprintf(os.Stderr, "Wrote the %s CRL of %s (%d bytes) to %s\n", format, req.VaultPKIPath, len(crl), cliOpts.outputFile)
+		return
+	}
+	if cliOutput == "json" && format == operations.CRLFormatPEM {
+		printJSON(map[string]string{"crl": string(crl)})
+		return
+	}
+	os.Stdout.Write(crl)
+}
+
+// writeCLIFile writes data to path, only readable by the
+// owner, creating the parent directories if needed
+func writeCLIFile(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	// OpenFile keeps the mode of an existing file
+	if err := f.Chmod(0600); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// printCRLUpdate prints the outcome of an update of the
+// CRL and exits with exitNothingToDo if nothing changed
+func printCRLUpdate(res *operations.UpdateCRLResult, rotated bool) {
+	if cliOutput == "json" {
+		printJSON(map[string]interface{}{
+			"rotated":        rotated,
+			"revoked-count":  res.RevokedCount,
+			"affected-users": res.AffectedUsers,
+			"aws-updated":    res.AWSUpdated,
+			"size":           res.Size,
+			"max-size":       res.MaxSize,
+		})
+	} else {
+		printTable([]string{"ROTATED", "REVOKED", "AFFECTED USERS", "AWS UPDATED", "SIZE", "MAX SIZE"}, [][]string{{
+			fmt.Sprint(rotated), fmt.Sprint(res.RevokedCount), strings.Join(res.AffectedUsers, ","),
+			fmt.Sprint(res.AWSUpdated), fmt.Sprint(res.Size), fmt.Sprint(res.MaxSize),
+		}})
+	}
+	if !rotated && res.RevokedCount == 0 && !res.AWSUpdated {
+		os.Exit(exitNothingToDo)
+	}
+}
+
+func runCRLUpdate(cmd *cobra.Command, args []string) {
+	client := cliClient()
+	opts := updateCRLOptions(context.Background(), nil, "cli")
+	opts.ForceShrink = cliOpts.forceShrink
+	opts.ForceImport = cliOpts.forceImport
+	res, err := operations.UpdateCRL(
+		&operations.UpdateCRLRequest{
+			Client:              client,
+			VaultPKIPath:        lastPKIPath(),
+			ClientVPNEndpointID: viper.GetString("client-vpn-endpoint-id"),
+			UpdateCRLOptions:    opts,
+		})
+	if err != nil {
+		cliFail("Unable to update the CRL", err)
+	}
+	printCRLUpdate(res, false)
+}
+
+func runCRLRotate(cmd *cobra.Command, args []string) {
+	client := cliClient()
+	res, err := operations.RotateCRLWithResult(
+		&operations.RotateCRLRequest{
+			Client:              client,
+			VaultPKIPath:        lastPKIPath(),
+			ClientVPNEndpointID: viper.GetString("client-vpn-endpoint-id"),
+			RotationWindow:      cliOpts.window,
+			UpdateCRLOptions:    updateCRLOptions(context.Background(), nil, "cli"),
+		})
+	if err != nil {
+		cliFail("Unable to rotate the CRL", err)
+	}
+	if cliOpts.summary {
+		fmt.Println(operations.FormatRotateCRLSummary(res))
+		return
+	}
+	printCRLUpdate(res.UpdateCRLResult, res.Rotated)
+}
+
+func runCRLRebuild(cmd *cobra.Command, args []string) {
+	client := cliClient()
+	opts := updateCRLOptions(context.Background(), nil, "cli")
+	opts.ForceImport = cliOpts.forceImport
+	res, err := operations.RebuildCRL(
+		&operations.RebuildCRLRequest{
+			Client:              client,
+			VaultPKIPath:        lastPKIPath(),
+			ClientVPNEndpointID: viper.GetString("client-vpn-endpoint-id"),
+			UpdateCRLOptions:    opts,
+		})
+	if res != nil {
+		if cliOutput == "json" {
+			printJSON(map[string]interface{}{
+				"revoked":     res.Revoked,
+				"missing":     res.Missing,
+				"unexpected":  res.Unexpected,
+				"aws-updated": res.AWSUpdated,
+				"size":        len(res.CRL),
+			})
+		} else {
+			printTable([]string{"REVOKED", "MISSING", "UNEXPECTED", "AWS UPDATED", "SIZE"}, [][]string{{
+				fmt.Sprint(len(res.Revoked)), strings.Join(res.Missing, ","), strings.Join(res.Unexpected, ","),
+				fmt.Sprint(res.AWSUpdated), fmt.Sprint(len(res.CRL)),
+			}})
+		}
+	}
+	if err != nil {
+		cliFail("Unable to rebuild the CRL", err)
+	}
+}
+
+func runCARotateIntermediate(cmd *cobra.Command, args []string) {
+	client := cliClient()
+	root := cliOpts.rootPKIPath
+	if root == "" {
+		paths := viper.GetStringSlice("vault-pki-paths")
+		if len(paths) < 2 {
+			log.Fatal("The root PKI path is required when vault-pki-paths has a single path, use --root-pki-path")
+		}
+		root = paths[len(paths)-2]
+	}
+	res, err := operations.RotateIntermediate(
+		&operations.RotateIntermediateRequest{
+			Client:           client,
+			VaultPKIPath:     lastPKIPath(),
+			VaultRootPKIPath: root,
+			CommonName:       cliOpts.commonName,
+			TTL:              cliOpts.ttl,
+		})
+	if err != nil {
+		cliFail("Unable to rotate the intermediate CA", err)
+	}
+	if cliOutput == "json" {
+		printJSON(map[string]interface{}{
+			"serial":    res.SerialNumber,
+			"not-after": res.NotAfter.Format(time.RFC3339),
+			"ca-chain":  res.CAChain,
+		})
+		return
+	}
+	printTable([]string{"SERIAL", "NOT AFTER"}, [][]string{{res.SerialNumber, res.NotAfter.Format(time.RFC3339)}})
+	fmt.Println()
+	fmt.Println(strings.Join(res.CAChain, "\n"))
+}
@@ -0,0 +1,61 @@
+package app
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/operations"
+)
+
+func TestListUsersMultiPath(t *testing.T) {
+	v := useFakeVault(t)
+	now := time.Now()
+	v.addCertificate("alice", now.Add(-time.Hour), 24*time.Hour)
+	serial := strings.Replace(v.addCertificate("legacy-host", now.Add(-time.Hour), 24*time.Hour), ":", "-", -1)
+	v.secrets["adopted"] = map[string]interface{}{serial: "bob"}
+	client, _ := v.vaultClient().GetClient()
+
+	paths := []string{v.pki, "missing-pki"}
+	res := operations.ListUsersMultiPath(
+		&operations.ListUsersMultiPathRequest{
+			ListUsersRequest: operations.ListUsersRequest{
+				Client:        client,
+				AdoptedKVPath: v.kv,
+			},
+			VaultPKIPaths: paths,
+			Concurrency:   1,
+		})
+	if len(res) != len(paths) {
+		t.Fatalf("got %d paths, want %d", len(res), len(paths))
+	}
+
+	pki := res[v.pki]
+	if pki.Error != nil {
+		t.Fatalf("got error %s listing %s", pki.Error, v.pki)
+	}
+	if len(pki.Users) != 2 || len(pki.Users["alice"]) != 1 || len(pki.Users["bob"]) != 1 || pki.Users["bob"][0].SerialNumber != serial {
+		t.Errorf("got users %v, want alice and the certificate adopted by bob", pki.Users)
+	}
+
+	// The failure of a path is reported in it, and serialized
+	missing := res["missing-pki"]
+	if missing.Error == nil || missing.ErrorMessage != missing.Error.Error() {
+		t.Fatalf("got error %v and message %q listing the missing path", missing.Error, missing.ErrorMessage)
+	}
+	b, err := json.Marshal(res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc map[string]map[string]interface{}
+	if err := json.Unmarshal(b, &doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc["missing-pki"]["error"] != missing.ErrorMessage {
+		t.Errorf("got %s, want the error of the missing path in it", b)
+	}
+	if _, ok := doc[v.pki]["error"]; ok {
+		t.Errorf("got %s, want no error for %s", b, v.pki)
+	}
+}
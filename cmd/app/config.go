@@ -0,0 +1,258 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cast"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// validateCmd checks the config without starting the server
+var validateCmd = &cobra.Command{
+	Use:     "validate",
+	Short:   "Validates the config and the connectivity to Vault and AWS and exits",
+	Long:    "Checks that the config file only sets known options with values of the right type, that the server settings are valid and then runs the same checks as 'server preflight'. Exits with a non zero code if any of the checks fails.",
+	Example: "aws-cvpn-pki-manager validate --config /etc/acpm/config.yaml",
+	Run:     runValidate,
+}
+
+func init() {
+	rootCmd.AddCommand(validateCmd)
+}
+
+func runValidate(cmd *cobra.Command, args []string) {
+	// The config file itself was already checked when loaded
+	passed := true
+	if err := configureServer(); err != nil {
+		fmt.Printf("ko  config: %s\n", err)
+		passed = false
+	} else {
+		fmt.Printf("ok  config\n")
+	}
+	if !preflight() || !passed {
+		os.Exit(1)
+	}
+}
+
+// endpointKeys are the options that can be set for each of the
+// entries of the endpoints section of the config file
+var endpointKeys = []string{"client-vpn-endpoint-id", "vault-pki-paths", "vault-pki-issuer", "vault-client-certificate-role", "vault-kv-path"}
+
+// configEndpoint is an entry of the endpoints section of the config file,
+// mapping a Client VPN endpoint to the PKI it trusts
+type configEndpoint struct {
+	name    string
+	options map[string]interface{}
+}
+
+// readConfigFile loads the options from the config file at path, if
+// set, rejecting the keys that are not the name of any of the options.
+// The values in the file have the lowest precedence, as the flags and
+// the environment variables override them. The options of the entry of
+// the endpoints section selected with --endpoint, or of its only entry,
+// are loaded as if they were at the top level of the file.
+func readConfigFile(path string) error {
+	if path == "" {
+		if viper.GetString("endpoint") != "" {
+			return errors.New("the --endpoint flag requires a config file with an endpoints section")
+		}
+		return nil
+	}
+	// Read it apart first, so only the keys coming from the file are checked
+	file := viper.New()
+	file.SetConfigFile(path)
+	if err := file.ReadInConfig(); err != nil {
+		return err
+	}
+	if err := checkConfigKeys(file); err != nil {
+		return fmt.Errorf("%s: %s", path, err)
+	}
+	endpoints, err := configEndpoints(file)
+	if err != nil {
+		return fmt.Errorf("%s: %s", path, err)
+	}
+	selected, err := selectEndpoint(endpoints, viper.GetString("endpoint"))
+	if err != nil {
+		return fmt.Errorf("%s: %s", path, err)
+	}
+	viper.SetConfigFile(path)
+	if err := viper.ReadInConfig(); err != nil {
+		return err
+	}
+	if selected != nil {
+		// Below the file, which can't set them too, so the
+		// flags and environment variables still override them
+		for k, v := range selected.options {
+			viper.SetDefault(k, v)
+		}
+	}
+	return nil
+}
+
+// configEndpoints parses and checks the endpoints section of the config
+// file. Each entry needs a unique name and a client-vpn-endpoint-id, and
+// can only set the endpointKeys, which then can't be at the top level.
+func configEndpoints(file *viper.Viper) ([]configEndpoint, error) {
+	if !file.IsSet("endpoints") {
+		return nil, nil
+	}
+	// A list of tables in TOML, a []interface{} in YAML
+	list, err := cast.ToSliceE(file.Get("endpoints"))
+	if err != nil || len(list) == 0 {
+		return nil, errors.New("'endpoints' must be a list of endpoint mappings")
+	}
+	allowed := map[string]bool{"name": true}
+	for _, k := range endpointKeys {
+		allowed[k] = true
+	}
+	flags := configFlags()
+
+	var endpoints []configEndpoint
+	names := map[string]bool{}
+	ids := map[string]bool{}
+	for i, item := range list {
+		entry, err := cast.ToStringMapE(item)
+		if err != nil {
+			return nil, fmt.Errorf("endpoints[%d] must be a mapping", i)
+		}
+		var unknown, invalid []string
+		for k, v := range entry {
+			if !allowed[k] {
+				unknown = append(unknown, k)
+			} else if f, ok := flags[k]; ok && !validConfigValue(f.Value.Type(), v) {
+				invalid = append(invalid, fmt.Sprintf("'%s' must be of type %s", k, f.Value.Type()))
+			}
+		}
+		sort.Strings(unknown)
+		sort.Strings(invalid)
+		switch {
+		case len(unknown) > 0:
+			return nil, fmt.Errorf("endpoints[%d]: unknown options: %s", i, strings.Join(unknown, ", "))
+		case len(invalid) > 0:
+			return nil, fmt.Errorf("endpoints[%d]: invalid values: %s", i, strings.Join(invalid, ", "))
+		}
+
+		ep := configEndpoint{name: cast.ToString(entry["name"]), options: map[string]interface{}{}}
+		id := cast.ToString(entry["client-vpn-endpoint-id"])
+		switch {
+		case ep.name == "":
+			return nil, fmt.Errorf("endpoints[%d]: 'name' is required", i)
+		case names[ep.name]:
+			return nil, fmt.Errorf("endpoints[%d]: duplicated name '%s'", i, ep.name)
+		case !strings.HasPrefix(id, "cvpn-endpoint-"):
+			return nil, fmt.Errorf("endpoints[%d]: 'client-vpn-endpoint-id' must be the ID of a Client VPN endpoint, cvpn-endpoint-...", i)
+		case ids[id]:
+			return nil, fmt.Errorf("endpoints[%d]: endpoint '%s' is already mapped", i, id)
+		}
+		names[ep.name], ids[id] = true, true
+		for _, k := range endpointKeys {
+			if v, ok := entry[k]; ok {
+				if file.IsSet(k) {
+					return nil, fmt.Errorf("'%s' is set both at the top level and in the endpoints", k)
+				}
+				ep.options[k] = v
+			}
+		}
+		endpoints = append(endpoints, ep)
+	}
+	return endpoints, nil
+}
+
+// selectEndpoint returns the endpoint with the given name, or
+// the only one if name is empty
+func selectEndpoint(endpoints []configEndpoint, name string) (*configEndpoint, error) {
+	if name == "" {
+		switch len(endpoints) {
+		case 0:
+			return nil, nil
+		case 1:
+			return &endpoints[0], nil
+		}
+		return nil, errors.New("several endpoints are configured, select one with --endpoint")
+	}
+	var names []string
+	for i := range endpoints {
+		if endpoints[i].name == name {
+			return &endpoints[i], nil
+		}
+		names = append(names, endpoints[i].name)
+	}
+	return nil, fmt.Errorf("unknown endpoint '%s', the configured ones are: %s", name, strings.Join(names, ", "))
+}
+
+// checkConfigKeys returns an error if any of the keys of the config
+// is unknown or has a value not matching the type of its flag
+func checkConfigKeys(file *viper.Viper) error {
+	known := map[string]bool{}
+	for _, k := range viper.AllKeys() {
+		known[k] = true
+	}
+	delete(known, "config")
+	flags := configFlags()
+
+	var unknown, invalid []string
+	for _, k := range file.AllKeys() {
+		if k == "endpoints" || strings.HasPrefix(k, "endpoints.") {
+			// Checked apart by configEndpoints
+			continue
+		}
+		if !known[k] {
+			unknown = append(unknown, k)
+			continue
+		}
+		if f, ok := flags[k]; ok && !validConfigValue(f.Value.Type(), file.Get(k)) {
+			invalid = append(invalid, fmt.Sprintf("'%s' must be of type %s", k, f.Value.Type()))
+		}
+	}
+	sort.Strings(unknown)
+	sort.Strings(invalid)
+
+	switch {
+	case len(unknown) > 0:
+		return fmt.Errorf("unknown options: %s", strings.Join(unknown, ", "))
+	case len(invalid) > 0:
+		return fmt.Errorf("invalid values: %s", strings.Join(invalid, ", "))
+	}
+	return nil
+}
+
+// configFlags returns the flags of all the commands by name
+func configFlags() map[string]*pflag.Flag {
+	flags := map[string]*pflag.Flag{}
+	var visit func(cmd *cobra.Command)
+	visit = func(cmd *cobra.Command) {
+		add := func(f *pflag.Flag) { flags[f.Name] = f }
+		cmd.PersistentFlags().VisitAll(add)
+		cmd.Flags().VisitAll(add)
+		for _, c := range cmd.Commands() {
+			visit(c)
+		}
+	}
+	visit(rootCmd)
+	return flags
+}
+
+// validConfigValue returns whether the value can be converted
+// to the type of the flag, as viper does when reading it
+func validConfigValue(flagType string, v interface{}) bool {
+	var err error
+	switch flagType {
+	case "string":
+		_, err = cast.ToStringE(v)
+	case "bool":
+		_, err = cast.ToBoolE(v)
+	case "int":
+		_, err = cast.ToIntE(v)
+	case "duration":
+		_, err = cast.ToDurationE(v)
+	case "stringSlice":
+		_, err = cast.ToStringSliceE(v)
+	}
+	return err == nil
+}
@@ -0,0 +1,179 @@
+package app
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// loadConfig writes the config file and loads it into the global config,
+// which is emptied again once the test is done
+func loadConfig(t *testing.T, content string) error {
+	t.Helper()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yaml")
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		empty := filepath.Join(dir, "empty.yaml")
+		ioutil.WriteFile(empty, nil, 0600)
+		viper.SetConfigFile(empty)
+		viper.ReadInConfig()
+	})
+	return readConfigFile(path)
+}
+
+// setFlag sets the flag as if it was passed in the command line
+func setFlag(t *testing.T, flags *pflag.FlagSet, name, value string) {
+	t.Helper()
+	f := flags.Lookup(name)
+	old := f.Value.String()
+	if err := flags.Set(name, value); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		f.Value.Set(old)
+		f.Changed = false
+	})
+}
+
+// keepDefaults restores the defaults of the keys, which the
+// endpoints of the config file are loaded as
+func keepDefaults(t *testing.T, keys ...string) {
+	defaults := map[string]interface{}{}
+	for _, k := range keys {
+		defaults[k] = viper.Get(k)
+	}
+	t.Cleanup(func() {
+		for k, v := range defaults {
+			viper.SetDefault(k, v)
+		}
+	})
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	setFlag(t, rootCmd.PersistentFlags(), "vault-addr", "http://flag:8200")
+	t.Setenv("ACPM_VAULT_ADDR", "http://env:8200")
+	t.Setenv("ACPM_VAULT_CLIENT_CERTIFICATE_ROLE", "env-role")
+	err := loadConfig(t, `
+vault-addr: http://file:8200
+vault-client-certificate-role: file-role
+vault-kv-path: file-kv
+auto-renew: true
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for k, want := range map[string]interface{}{
+		"vault-addr":                    "http://flag:8200",
+		"vault-client-certificate-role": "env-role",
+		"vault-kv-path":                 "file-kv",
+		"port":                          "8080",
+	} {
+		if got := viper.GetString(k); got != want {
+			t.Errorf("got %s %q, want %q", k, got, want)
+		}
+	}
+	if !viper.GetBool("auto-renew") {
+		t.Error("auto-renew from the file not loaded")
+	}
+}
+
+func TestConfigEndpoints(t *testing.T) {
+	keepDefaults(t, endpointKeys...)
+	setFlag(t, rootCmd.PersistentFlags(), "endpoint", "staging")
+	t.Setenv("ACPM_VAULT_KV_PATH", "env-kv")
+	err := loadConfig(t, `
+endpoints:
+  - name: production
+    client-vpn-endpoint-id: cvpn-endpoint-0873f24b07b72b3ee
+    vault-pki-paths: [root-pki, cvpn-pki]
+  - name: staging
+    client-vpn-endpoint-id: cvpn-endpoint-0a1b2c3d4e5f60718
+    vault-pki-paths: [root-pki, staging-pki]
+    vault-kv-path: staging-kv
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := viper.GetString("client-vpn-endpoint-id"); got != "cvpn-endpoint-0a1b2c3d4e5f60718" {
+		t.Errorf("got endpoint %q, want the one of staging", got)
+	}
+	if got := viper.GetStringSlice("vault-pki-paths"); !reflect.DeepEqual(got, []string{"root-pki", "staging-pki"}) {
+		t.Errorf("got pki paths %v, want the ones of staging", got)
+	}
+	// The environment overrides the endpoint too
+	if got := viper.GetString("vault-kv-path"); got != "env-kv" {
+		t.Errorf("got kv path %q, want the one of the environment", got)
+	}
+}
+
+func TestConfigSingleEndpoint(t *testing.T) {
+	keepDefaults(t, endpointKeys...)
+	err := loadConfig(t, `
+endpoints:
+  - name: production
+    client-vpn-endpoint-id: cvpn-endpoint-0873f24b07b72b3ee
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := viper.GetString("client-vpn-endpoint-id"); got != "cvpn-endpoint-0873f24b07b72b3ee" {
+		t.Errorf("got endpoint %q, want the only one", got)
+	}
+}
+
+func TestConfigRejected(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"unknown key", "vault-adr: http://vault:8200\nport: \"8080\"", "unknown options: vault-adr"},
+		{"unknown nested key", "vault:\n  addr: http://vault:8200", "unknown options: vault.addr"},
+		{"mistyped bool", "auto-renew: sometimes", "'auto-renew' must be of type bool"},
+		{"mistyped int", "retry-max-attempts: many", "'retry-max-attempts' must be of type int"},
+		{"mistyped duration", "shutdown-delay: forever", "'shutdown-delay' must be of type duration"},
+		{"endpoints not a list", "endpoints:\n  name: production", "'endpoints' must be a list"},
+		{"endpoint without name", "endpoints:\n  - client-vpn-endpoint-id: cvpn-endpoint-1", "endpoints[0]: 'name' is required"},
+		{"endpoint without id", "endpoints:\n  - name: production", "endpoints[0]: 'client-vpn-endpoint-id' must be the ID"},
+		{"endpoint unknown key", "endpoints:\n  - name: production\n    client-vpn-endpoint-id: cvpn-endpoint-1\n    port: \"8080\"",
+			"endpoints[0]: unknown options: port"},
+		{"endpoint mistyped key", "endpoints:\n  - name: production\n    client-vpn-endpoint-id: cvpn-endpoint-1\n    vault-pki-paths: {root: pki}",
+			"endpoints[0]: invalid values: 'vault-pki-paths' must be of type stringSlice"},
+		{"duplicated name", "endpoints:\n  - name: production\n    client-vpn-endpoint-id: cvpn-endpoint-1\n  - name: production\n    client-vpn-endpoint-id: cvpn-endpoint-2",
+			"endpoints[1]: duplicated name 'production'"},
+		{"duplicated endpoint", "endpoints:\n  - name: production\n    client-vpn-endpoint-id: cvpn-endpoint-1\n  - name: staging\n    client-vpn-endpoint-id: cvpn-endpoint-1",
+			"endpoints[1]: endpoint 'cvpn-endpoint-1' is already mapped"},
+		{"set at the top level too", "vault-kv-path: kv\nendpoints:\n  - name: production\n    client-vpn-endpoint-id: cvpn-endpoint-1\n    vault-kv-path: other",
+			"'vault-kv-path' is set both at the top level and in the endpoints"},
+		{"no endpoint selected", "endpoints:\n  - name: production\n    client-vpn-endpoint-id: cvpn-endpoint-1\n  - name: staging\n    client-vpn-endpoint-id: cvpn-endpoint-2",
+			"select one with --endpoint"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := loadConfig(t, tt.content)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got error %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfigUnknownEndpoint(t *testing.T) {
+	setFlag(t, rootCmd.PersistentFlags(), "endpoint", "qa")
+	err := loadConfig(t, "endpoints:\n  - name: production\n    client-vpn-endpoint-id: cvpn-endpoint-1")
+	if err == nil || !strings.Contains(err.Error(), "unknown endpoint 'qa', the configured ones are: production") {
+		t.Errorf("got error %v", err)
+	}
+	if err := readConfigFile(""); err == nil {
+		t.Error("--endpoint accepted without a config file")
+	}
+}
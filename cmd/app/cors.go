@@ -0,0 +1,97 @@
+package app
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// corsPolicy holds the CORS settings of the API, so it can be
+// called from browser based frontends served from other origins
+type corsPolicy struct {
+	// origins are the allowed origins. An origin of the form
+	// 'https://*.example.com' allows any subdomain of example.com,
+	// and '*' allows any origin.
+	origins     []string
+	methods     []string
+	headers     []string
+	credentials bool
+}
+
+// newCORSPolicy validates the CORS settings. A nil policy is
+// returned if no origins are allowed, which disables CORS.
+func newCORSPolicy(origins, methods, headers []string, credentials bool) (*corsPolicy, error) {
+	if len(origins) == 0 {
+		return nil, nil
+	}
+	for _, o := range origins {
+		if o == "*" && credentials {
+			return nil, errors.New("the '*' origin can't be allowed along with credentials, list the origins instead")
+		}
+		if strings.Contains(o, "*") && o != "*" && !strings.Contains(o, "://*.") {
+			return nil, errors.New("invalid origin '" + o + "', wildcards are only allowed as the leftmost label of the host, as in 'https://*.example.com'")
+		}
+	}
+	return &corsPolicy{origins: origins, methods: methods, headers: headers, credentials: credentials}, nil
+}
+
+// allowed returns whether the origin is one of the allowed ones
+func (p *corsPolicy) allowed(origin string) bool {
+	for _, o := range p.origins {
+		if o == "*" || o == origin {
+			return true
+		}
+		if i := strings.Index(o, "://*."); i >= 0 {
+			// The scheme has to match and the host has to be a subdomain,
+			// so 'https://*.example.com' doesn't allow 'https://example.com'
+			prefix, suffix := o[:i+3], o[i+4:]
+			if strings.HasPrefix(origin, prefix) && strings.HasSuffix(origin, suffix) && len(origin) > len(prefix)+len(suffix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// corsMiddleware adds the CORS headers to the responses to the allowed
+// origins. Preflight requests are answered here, before authenticating
+// them, as browsers don't send the credentials along with them.
+func corsMiddleware(p *corsPolicy, next http.Handler) http.Handler {
+	if p == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		w.Header().Add("Vary", "Origin")
+
+		if origin == "" || !p.allowed(origin) {
+			if preflight {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if len(p.origins) == 1 && p.origins[0] == "*" {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		} else {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+		if p.credentials {
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		if !preflight {
+			w.Header().Set("Access-Control-Expose-Headers", requestIDHeader)
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Access-Control-Request-Method")
+		w.Header().Add("Vary", "Access-Control-Request-Headers")
+		w.Header().Set("Access-Control-Allow-Methods", strings.Join(p.methods, ", "))
+		w.Header().Set("Access-Control-Allow-Headers", strings.Join(p.headers, ", "))
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
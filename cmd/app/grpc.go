@@ -0,0 +1,445 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/audit"
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/logging"
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/notify"
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/operations"
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/rpc"
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/vault"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/hashicorp/vault/api"
+	"github.com/spf13/viper"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// rpcServer implements the gRPC API on top of the
+// same operations the HTTP handlers use
+type rpcServer struct {
+	vc vault.AuthenticatedClient
+}
+
+// newRPCServer returns the gRPC server of the API. It is served over
+// TLS, with the same certificates as the HTTP server, unless --insecure
+// is set, and authenticates the calls as the HTTP middleware does, with
+// the bearer token passed in the 'authorization' metadata.
+func newRPCServer(vc vault.AuthenticatedClient) (*grpc.Server, error) {
+	opts := []grpc.ServerOption{
+		grpc.UnaryInterceptor(rpcUnaryInterceptor),
+		grpc.StreamInterceptor(rpcStreamInterceptor),
+	}
+	if !viper.GetBool("insecure") {
+		tlsConfig, err := serverTLSConfig(viper.GetString("tls-cert-file"), viper.GetString("tls-key-file"), viper.GetString("tls-client-ca-file"))
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	s := grpc.NewServer(opts...)
+	rpc.RegisterPKIManagerServer(s, &rpcServer{vc: vc})
+	return s, nil
+}
+
+// rpcContext authenticates the call and adds the caller and the request
+// ID to its context, as authMiddleware and requestIDMiddleware do
+func rpcContext(ctx context.Context) (context.Context, string, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	first := func(key string) string {
+		if v := md.Get(key); len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}
+
+	id := first(strings.ToLower(requestIDHeader))
+	if !validRequestID.MatchString(id) {
+		id = newRequestID()
+	}
+	ctx = context.WithValue(ctx, requestIDContextKey, id)
+
+	if p, ok := peer.FromContext(ctx); ok {
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok && len(info.State.VerifiedChains) > 0 && len(info.State.VerifiedChains[0]) > 0 {
+			ctx = context.WithValue(ctx, callerContextKey, info.State.VerifiedChains[0][0].Subject.CommonName)
+		}
+	}
+
+	if !authEnabled() {
+		return ctx, id, nil
+	}
+	// Metadata should be: "authorization: Bearer <token>"
+	h := strings.Split(first("authorization"), " ")
+	if len(h) != 2 || h[0] != "Bearer" || h[1] == "" {
+		return ctx, id, status.Error(codes.Unauthenticated, "unauthenticated: missing or malformed bearer token")
+	}
+	caller, err := authenticate(h[1])
+	if errors.Is(err, errInvalidToken) {
+		return ctx, id, status.Error(codes.Unauthenticated, "unauthenticated: "+err.Error())
+	}
+	if err != nil {
+		return ctx, id, status.Error(codes.Internal, "unauthenticated: "+err.Error())
+	}
+	return context.WithValue(ctx, callerContextKey, caller), id, nil
+}
+
+func rpcUnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, id, err := rpcContext(ctx)
+	grpc.SetHeader(ctx, metadata.Pairs(strings.ToLower(requestIDHeader), id))
+	if err != nil {
+		return nil, err
+	}
+	rsp, err := handler(ctx, req)
+	logging.Default().Info("grpc call", "method", info.FullMethod, "caller", contextCaller(ctx), "request_id", id, "code", status.Code(err).String())
+	return rsp, err
+}
+
+func rpcStreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, id, err := rpcContext(ss.Context())
+	ss.SetHeader(metadata.Pairs(strings.ToLower(requestIDHeader), id))
+	if err != nil {
+		return err
+	}
+	err = handler(srv, &rpcServerStream{ServerStream: ss, ctx: ctx})
+	logging.Default().Info("grpc call", "method", info.FullMethod, "caller", contextCaller(ctx), "request_id", id, "code", status.Code(err).String())
+	return err
+}
+
+// rpcServerStream overrides the context of a stream
+// with the one returned by rpcContext
+type rpcServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *rpcServerStream) Context() context.Context {
+	return s.ctx
+}
+
+// rpcError maps the errors of the operations to gRPC status codes
+func rpcError(msg string, err error) error {
+	code := codes.Internal
+	switch {
+	case errors.Is(err, operations.ErrUserNotFound), errors.Is(err, operations.ErrEndpointNotFound):
+		code = codes.NotFound
+	case errors.Is(err, operations.ErrInvalidUsername):
+		code = codes.InvalidArgument
+	case errors.Is(err, operations.ErrUserDenied), errors.Is(err, operations.ErrNotInDirectory), errors.Is(err, operations.ErrUserSuspended):
+		code = codes.PermissionDenied
+	case errors.Is(err, operations.ErrRateLimited):
+		code = codes.ResourceExhausted
+	case errors.Is(err, operations.ErrCertLimitReached), errors.Is(err, operations.ErrSuspiciousCRLShrink), errors.Is(err, operations.ErrCRLTooLarge),
+		errors.Is(err, operations.ErrCRLSignatureInvalid), errors.Is(err, operations.ErrPermissionDenied),
+		errors.Is(err, operations.ErrNotCertificateAuth):
+		code = codes.FailedPrecondition
+	case errors.Is(err, operations.ErrLocked):
+		code = codes.Aborted
+	case errors.Is(err, operations.ErrTimeout):
+		code = codes.DeadlineExceeded
+	case errors.Is(err, operations.ErrVaultUnavailable), errors.Is(err, operations.ErrDirectoryUnavailable):
+		code = codes.Unavailable
+	}
+	if code == codes.Internal {
+		log.Println(err)
+	}
+	return status.Error(code, msg+": "+err.Error())
+}
+
+func (s *rpcServer) client() (*api.Client, error) {
+	client, err := s.vc.GetClient()
+	if err != nil {
+		log.Println(err)
+		return nil, status.Error(codes.Unavailable, "error getting vault client: "+err.Error())
+	}
+	return client, nil
+}
+
+func (s *rpcServer) IssueCertificate(ctx context.Context, in *rpc.IssueCertificateRequest) (*rpc.IssueCertificateResponse, error) {
+	if in.Username == "" {
+		return nil, status.Error(codes.InvalidArgument, "a username is required")
+	}
+	if in.Temporary && in.Role == "" {
+		return nil, status.Error(codes.InvalidArgument, "a Vault PKI role is required for temporary certificates")
+	}
+	client, err := s.client()
+	if err != nil {
+		return nil, err
+	}
+
+	req := &operations.IssueCertificateRequest{
+		Client:              client,
+		VaultPKIPaths:       viper.GetStringSlice("vault-pki-paths"),
+		VaultPKIRole:        viper.GetString("vault-client-certificate-role"),
+		Username:            in.Username,
+		ClientVPNEndpointID: viper.GetString("client-vpn-endpoint-id"),
+		VaultKVPath:         viper.GetString("vault-kv-path"),
+		VaultBundleKVPath:   viper.GetString("vault-bundle-kv-path"),
+		CfgTemplate:         cfgTemplate,
+		CfgFromEndpoint:     viper.GetString("config-source") == "endpoint",
+		CfgCache:            endpointConfigCache,
+		Temporary:           in.Temporary,
+		DiscardPrivateKey:   viper.GetBool("discard-private-keys"),
+		Mailer:              mailer,
+		MailFrom:            viper.GetString("mail-from"),
+		Email:               in.Email,
+		IdempotencyKey:      in.IdempotencyKey,
+		Idempotency:         issueIdempotency,
+		MaxCertsPerUser:     viper.GetInt("max-certs-per-user"),
+		RevokeOldest:        viper.GetBool("max-certs-revoke-oldest"),
+		DenyListKVPath:      denyListKVPath(),
+		Directory:           userDirectory,
+		RateLimiter:         rateLimiter,
+		Caller:              contextCaller(ctx),
+		ValidateBundle:      viper.GetBool("validate-bundles"),
+		UpdateCRLOptions:    updateCRLOptions(ctx, contextLogger(ctx), contextCaller(ctx)),
+	}
+	if in.Temporary {
+		req.VaultPKIRole = in.Role
+	}
+
+	cfg, err := operations.IssueClientCertificate(req)
+	if cfg == nil || !cfg.Replayed {
+		entry := audit.Entry{Operation: audit.OperationIssue, Actor: contextCaller(ctx), RequestID: contextRequestID(ctx), Username: in.Username}
+		if cfg != nil {
+			entry.SerialNumbers = []string{cfg.SerialNumber}
+		}
+		auditLog(entry, err)
+	}
+	if err != nil {
+		return nil, rpcError("couldn't issue client certificate for user "+in.Username, err)
+	}
+	if !cfg.Replayed {
+		notifyEvent(notify.Event{
+			Type:         notify.EventIssued,
+			Username:     in.Username,
+			SerialNumber: cfg.SerialNumber,
+			EndpointID:   viper.GetString("client-vpn-endpoint-id"),
+			Caller:       contextCaller(ctx),
+			RequestID:    contextRequestID(ctx),
+		})
+	}
+
+	rsp := &rpc.IssueCertificateResponse{
+		SerialNumber: cfg.SerialNumber,
+		Config:       cfg.Config,
+		NotAfter:     rpcTimestamp(cfg.NotAfter),
+		ConfigPath:   cfg.ConfigPath,
+		EmailedTo:    cfg.EmailedTo,
+		Replayed:     cfg.Replayed,
+	}
+	if cfg.EmailError != nil {
+		rsp.EmailError = cfg.EmailError.Error()
+	}
+	return rsp, nil
+}
+
+func (s *rpcServer) RevokeUser(ctx context.Context, in *rpc.RevokeUserRequest) (*rpc.RevokeUserResponse, error) {
+	reason, err := operations.ParseRevocationReason(in.Reason)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "incorrect value for 'reason'. Use one of: unspecified/keyCompromise/affiliationChanged/superseded/cessationOfOperation/privilegeWithdrawn, or their CRL reason code")
+	}
+	client, err := s.client()
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := operations.RevokeUserWithResult(
+		&operations.RevokeUserRequest{
+			Reason:              reason,
+			VaultKVPath:         viper.GetString("vault-kv-path"),
+			Client:              client,
+			VaultPKIPath:        viper.GetStringSlice("vault-pki-paths")[len(viper.GetStringSlice("vault-pki-paths"))-1],
+			Username:            in.Username,
+			ClientVPNEndpointID: viper.GetString("client-vpn-endpoint-id"),
+			DenyList:            denyListOnRevoke(),
+			RateLimiter:         rateLimiter,
+			Caller:              contextCaller(ctx),
+			UpdateCRLOptions:    updateCRLOptions(ctx, contextLogger(ctx), contextCaller(ctx)),
+		})
+	entry := audit.Entry{Operation: audit.OperationRevoke, Actor: contextCaller(ctx), RequestID: contextRequestID(ctx), Username: in.Username, Reason: string(reason)}
+	if res != nil {
+		entry.SerialNumbers = res.Revoked
+	}
+	auditLog(entry, err)
+	if res != nil {
+		for _, serial := range res.Revoked {
+			notifyEvent(notify.Event{
+				Type:         notify.EventRevoked,
+				Username:     in.Username,
+				SerialNumber: serial,
+				Reason:       string(reason),
+				EndpointID:   viper.GetString("client-vpn-endpoint-id"),
+				Caller:       contextCaller(ctx),
+				RequestID:    contextRequestID(ctx),
+			})
+		}
+		notifyCRLUpdate(res.UpdateCRLResult, err, contextCaller(ctx), contextRequestID(ctx))
+	}
+	if err != nil {
+		return nil, rpcError("couldn't revoke user "+in.Username, err)
+	}
+	notifyEvent(notify.Event{
+		Type:       notify.EventOffboarded,
+		Username:   in.Username,
+		EndpointID: viper.GetString("client-vpn-endpoint-id"),
+		Caller:     contextCaller(ctx),
+		RequestID:  contextRequestID(ctx),
+	})
+	return &rpc.RevokeUserResponse{Revoked: res.Revoked}, nil
+}
+
+// ListUsers sends a message per user, so the size of the
+// messages does not grow with the number of users
+func (s *rpcServer) ListUsers(in *rpc.ListUsersRequest, stream rpc.PKIManager_ListUsersServer) error {
+	client, err := s.client()
+	if err != nil {
+		return err
+	}
+	users, err := operations.ListUsers(
+		&operations.ListUsersRequest{
+			Client:        client,
+			VaultPKIPath:  viper.GetStringSlice("vault-pki-paths")[len(viper.GetStringSlice("vault-pki-paths"))-1],
+			IssuerRef:     viper.GetString("vault-pki-issuer"),
+			Prefix:        in.Prefix,
+			ActiveOnly:    in.ActiveOnly,
+			AdoptedKVPath: adoptedKVPath(),
+			VaultKVPath:   viper.GetString("vault-kv-path"),
+		})
+	if err != nil {
+		return rpcError("could not retrieve the user list", err)
+	}
+
+	usernames := make([]string, 0, len(users))
+	for username := range users {
+		usernames = append(usernames, username)
+	}
+	sort.Strings(usernames)
+	for _, username := range usernames {
+		user := &rpc.User{Username: username}
+		for _, crt := range users[username] {
+			user.Certificates = append(user.Certificates, &rpc.Certificate{
+				SerialNumber:     crt.SerialNumber,
+				IssuerCn:         crt.IssuerCN,
+				SubjectCn:        crt.SubjectCN,
+				NotBefore:        rpcTimestamp(crt.NotBefore),
+				NotAfter:         rpcTimestamp(crt.NotAfter),
+				Revoked:          crt.Revoked,
+				CertificatePem:   crt.CertificatePEM,
+				VaultPkiPath:     crt.VaultPKIPath,
+				RevocationReason: string(crt.RevocationReason),
+			})
+		}
+		if err := stream.Send(user); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *rpcServer) GetCRL(ctx context.Context, in *rpc.GetCRLRequest) (*rpc.GetCRLResponse, error) {
+	client, err := s.client()
+	if err != nil {
+		return nil, err
+	}
+	req := &operations.GetCRLRequest{
+		Client:              client,
+		VaultPKIPath:        viper.GetStringSlice("vault-pki-paths")[len(viper.GetStringSlice("vault-pki-paths"))-1],
+		IssuerRef:           viper.GetString("vault-pki-issuer"),
+		ClientVPNEndpointID: viper.GetString("client-vpn-endpoint-id"),
+	}
+	if in.Der {
+		req.Format = operations.CRLFormatDER
+	} else {
+		req.CRLPath = viper.GetString("vault-crl-path")
+	}
+	crl, err := operations.GetCRL(req)
+	if err != nil {
+		return nil, rpcError("couldn't retrieve the CRL", err)
+	}
+	return &rpc.GetCRLResponse{Crl: crl}, nil
+}
+
+func (s *rpcServer) UpdateCRL(ctx context.Context, in *rpc.UpdateCRLRequest) (*rpc.UpdateCRLResponse, error) {
+	client, err := s.client()
+	if err != nil {
+		return nil, err
+	}
+	if err := rateLimiter.Allow(contextCaller(ctx), ""); err != nil {
+		return nil, rpcError("CRL could not be updated", err)
+	}
+	opts := updateCRLOptions(ctx, contextLogger(ctx), contextCaller(ctx))
+	opts.ForceShrink = in.ForceShrink
+	opts.ForceImport = in.ForceImport
+	res, err := operations.UpdateCRL(
+		&operations.UpdateCRLRequest{
+			Client:              client,
+			VaultPKIPath:        viper.GetStringSlice("vault-pki-paths")[len(viper.GetStringSlice("vault-pki-paths"))-1],
+			ClientVPNEndpointID: viper.GetString("client-vpn-endpoint-id"),
+			UpdateCRLOptions:    opts,
+		})
+	auditLog(audit.Entry{Operation: audit.OperationCRLImport, Actor: contextCaller(ctx), RequestID: contextRequestID(ctx)}, err)
+	notifyCRLUpdate(res, err, contextCaller(ctx), contextRequestID(ctx))
+	if err != nil {
+		return nil, rpcError("CRL could not be updated", err)
+	}
+	return rpcUpdateCRLResponse(res), nil
+}
+
+func (s *rpcServer) RotateCRL(ctx context.Context, in *rpc.RotateCRLRequest) (*rpc.RotateCRLResponse, error) {
+	client, err := s.client()
+	if err != nil {
+		return nil, err
+	}
+	if err := rateLimiter.Allow(contextCaller(ctx), ""); err != nil {
+		return nil, rpcError("CRL could not be rotated", err)
+	}
+	res, err := operations.RotateCRLWithResult(
+		&operations.RotateCRLRequest{
+			Client:              client,
+			VaultPKIPath:        viper.GetStringSlice("vault-pki-paths")[len(viper.GetStringSlice("vault-pki-paths"))-1],
+			ClientVPNEndpointID: viper.GetString("client-vpn-endpoint-id"),
+			RotationWindow:      viper.GetDuration("crl-rotation-window"),
+			UpdateCRLOptions:    updateCRLOptions(ctx, contextLogger(ctx), contextCaller(ctx)),
+		})
+	auditLog(audit.Entry{Operation: audit.OperationCRLRotate, Actor: contextCaller(ctx), RequestID: contextRequestID(ctx)}, err)
+	var crlRes *operations.UpdateCRLResult
+	if res != nil {
+		crlRes = res.UpdateCRLResult
+	}
+	notifyCRLUpdate(crlRes, err, contextCaller(ctx), contextRequestID(ctx))
+	if err != nil {
+		return nil, rpcError("CRL could not be rotated", err)
+	}
+	rsp := &rpc.RotateCRLResponse{Rotated: res.Rotated}
+	if res.UpdateCRLResult != nil {
+		rsp.Update = rpcUpdateCRLResponse(res.UpdateCRLResult)
+	}
+	return rsp, nil
+}
+
+func rpcUpdateCRLResponse(res *operations.UpdateCRLResult) *rpc.UpdateCRLResponse {
+	return &rpc.UpdateCRLResponse{
+		Crl:           res.CRL,
+		Size:          int32(res.Size),
+		MaxSize:       int32(res.MaxSize),
+		RevokedCount:  int32(res.RevokedCount),
+		AffectedUsers: res.AffectedUsers,
+		AwsUpdated:    res.AWSUpdated,
+	}
+}
+
+func rpcTimestamp(t time.Time) *timestamp.Timestamp {
+	ts, _ := ptypes.TimestampProto(t)
+	return ts
+}
@@ -0,0 +1,1373 @@
+package app
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"html"
+	"net/http"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// defaultDocsAssetsURL is where the Swagger UI of GET /docs is loaded
+// from, pinned to a release so a new one can't change what is run
+const defaultDocsAssetsURL = "https://unpkg.com/swagger-ui-dist@3.52.5"
+
+// openAPIHandler serves the OpenAPI document of the API
+func openAPIHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, openAPISpec)
+	}
+}
+
+// docsHandler serves a Swagger UI page that renders the OpenAPI document.
+// The assets are loaded from docs-assets-url, and its Content-Security-Policy
+// only allows them and the inline script that starts the UI.
+func docsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		assets := strings.TrimSuffix(viper.GetString("docs-assets-url"), "/")
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Content-Security-Policy", fmt.Sprintf("default-src 'none'; script-src %[1]s/ '%[2]s'; "+
+			"style-src %[1]s/ 'unsafe-inline'; img-src %[1]s/ data:; connect-src 'self'", assets, swaggerUIScriptHash))
+		fmt.Fprintf(w, swaggerUIPage, html.EscapeString(assets), swaggerUIScript)
+	}
+}
+
+const swaggerUIScript = `SwaggerUIBundle({ url: "openapi.json", dom_id: "#swagger-ui" });`
+
+// swaggerUIScriptHash is the CSP hash source of swaggerUIScript
+var swaggerUIScriptHash = func() string {
+	sum := sha256.Sum256([]byte(swaggerUIScript))
+	return "sha256-" + base64.StdEncoding.EncodeToString(sum[:])
+}()
+
+const swaggerUIPage = `<!DOCTYPE html>
+<html>
+<head>
+  <meta charset="utf-8">
+  <title>ACPM API</title>
+  <link rel="stylesheet" href="%[1]s/swagger-ui.css">
+</head>
+<body>
+  <div id="swagger-ui"></div>
+  <script src="%[1]s/swagger-ui-bundle.js"></script>
+  <script>%[2]s</script>
+</body>
+</html>
+`
+
+// openAPISpec describes the API. Keep it in sync with the
+// routes registered in start and the responses of the handlers.
+const openAPISpec = `{
+  "openapi": "3.0.3",
+  "info": {
+    "title": "AWS Client VPN PKI Manager",
+    "description": "Manages the client certificates of an AWS Client VPN endpoint backed by a Vault PKI",
+    "version": "1"
+  },
+  "security": [
+    { "bearerAuth": [] }
+  ],
+  "paths": {
+    "/issue/{user}": {
+      "post": {
+        "summary": "Issue a new certificate for the user",
+        "description": "The other certificates of the user are revoked, unless temp is set.",
+        "parameters": [
+          { "$ref": "#/components/parameters/user" },
+          { "name": "temp", "in": "query", "description": "Issue a temporary certificate with the given role. The config is not stored and the other certificates are not revoked.", "schema": { "type": "boolean" } },
+          { "name": "role", "in": "query", "description": "Vault PKI role of the temporary certificate. Required if temp is set.", "schema": { "type": "string" } },
+          { "name": "email", "in": "query", "description": "Address the VPN config is emailed to", "schema": { "type": "string" } },
+          { "name": "discard-key", "in": "query", "description": "Only return the private key in this response, storing and emailing the config without it. Always set with discard-private-keys", "schema": { "type": "boolean" } },
+          { "name": "idempotency-key", "in": "query", "schema": { "type": "string" } },
+          { "name": "Idempotency-Key", "in": "header", "description": "Retries with the same key get the original certificate back, without the private key if discarded", "schema": { "type": "string" } },
+          { "name": "alt_names", "in": "query", "description": "Comma separated DNS names added as subject alternative names. A 400 is returned for the ones not allowed by the role", "schema": { "type": "string" } },
+          { "name": "ip_sans", "in": "query", "description": "Comma separated IP addresses added as subject alternative names", "schema": { "type": "string" } },
+          { "name": "email_sans", "in": "query", "description": "Comma separated emails added as subject alternative names", "schema": { "type": "string" } }
+        ],
+        "responses": {
+          "200": {
+            "description": "The VPN config of the issued certificate",
+            "headers": {
+              "Idempotent-Replayed": { "description": "Set to true if this is the response to a previous request with the same key", "schema": { "type": "string" } }
+            },
+            "content": { "application/json": { "schema": { "$ref": "#/components/schemas/IssueResult" } } }
+          },
+          "400": { "$ref": "#/components/responses/Error" },
+          "403": { "$ref": "#/components/responses/Denied" },
+          "409": {
+            "description": "The user already has the maximum number of certificates",
+            "content": { "application/json": { "schema": { "$ref": "#/components/schemas/CertLimitError" } } }
+          },
+          "429": { "$ref": "#/components/responses/RateLimited" },
+          "500": { "$ref": "#/components/responses/Error" },
+          "503": { "$ref": "#/components/responses/Unavailable" },
+          "504": { "$ref": "#/components/responses/Timeout" }
+        }
+      }
+    },
+    "/issue-batch": {
+      "post": {
+        "summary": "Issue certificates for several users, updating the CRL once",
+        "description": "The certificates are issued concurrently. A failure issuing the certificate of one of the users does not stop the rest of the batch. The VPN configs are stored in the kv store, and emailed if configured, as with /issue/{user}. A 400 is returned with discard-private-keys, as the private keys would be lost.",
+        "requestBody": {
+          "required": true,
+          "content": {
+            "application/json": {
+              "schema": {
+                "type": "array",
+                "minItems": 1,
+                "items": {
+                  "type": "object",
+                  "required": ["username"],
+                  "properties": {
+                    "username": { "type": "string" },
+                    "ttl": { "type": "string", "description": "Lifetime of the certificate as a Go duration, e.g. 720h" },
+                    "metadata": { "$ref": "#/components/schemas/UserMetadata" }
+                  }
+                }
+              }
+            }
+          }
+        },
+        "responses": {
+          "200": { "$ref": "#/components/responses/IssueBatch" },
+          "400": { "$ref": "#/components/responses/Error" },
+          "429": { "$ref": "#/components/responses/RateLimited" },
+          "500": { "$ref": "#/components/responses/IssueBatch" }
+        }
+      }
+    },
+    "/sign/{user}": {
+      "post": {
+        "summary": "Sign a CSR of the user",
+        "description": "The CN of the CSR must be the username. The other certificates of the user are revoked.",
+        "parameters": [
+          { "$ref": "#/components/parameters/user" }
+        ],
+        "requestBody": {
+          "required": true,
+          "content": { "application/x-pem-file": { "schema": { "type": "string" } } }
+        },
+        "responses": {
+          "200": {
+            "description": "The signed certificate",
+            "content": { "application/json": { "schema": { "$ref": "#/components/schemas/SignResult" } } }
+          },
+          "400": { "$ref": "#/components/responses/Error" },
+          "403": { "$ref": "#/components/responses/Denied" },
+          "409": {
+            "description": "The user already has the maximum number of certificates",
+            "content": { "application/json": { "schema": { "$ref": "#/components/schemas/CertLimitError" } } }
+          },
+          "429": { "$ref": "#/components/responses/RateLimited" },
+          "500": { "$ref": "#/components/responses/Error" },
+          "503": { "$ref": "#/components/responses/Error" }
+        }
+      }
+    },
+    "/revoke/{user}": {
+      "post": {
+        "summary": "Revoke all the certificates of the user",
+        "parameters": [
+          { "$ref": "#/components/parameters/user" },
+          { "name": "reason", "in": "query", "schema": { "$ref": "#/components/schemas/RevocationReason" } }
+        ],
+        "responses": {
+          "200": { "$ref": "#/components/responses/Success" },
+          "400": { "$ref": "#/components/responses/Error" },
+          "404": { "$ref": "#/components/responses/Error" },
+          "429": { "$ref": "#/components/responses/RateLimited" },
+          "500": { "$ref": "#/components/responses/Error" },
+          "503": { "$ref": "#/components/responses/Unavailable" },
+          "504": { "$ref": "#/components/responses/Timeout" }
+        }
+      }
+    },
+    "/revoke-batch": {
+      "post": {
+        "summary": "Revoke all the certificates of several users, updating the CRL once",
+        "description": "A failure revoking one of the users does not stop the rest of the batch.",
+        "parameters": [
+          { "name": "reason", "in": "query", "schema": { "$ref": "#/components/schemas/RevocationReason" } }
+        ],
+        "requestBody": {
+          "required": true,
+          "content": { "application/json": { "schema": { "type": "array", "minItems": 1, "items": { "type": "string" } } } }
+        },
+        "responses": {
+          "200": { "$ref": "#/components/responses/RevokeBatch" },
+          "400": { "$ref": "#/components/responses/Error" },
+          "429": { "$ref": "#/components/responses/RateLimited" },
+          "500": { "$ref": "#/components/responses/RevokeBatch" }
+        }
+      }
+    },
+    "/deprovision": {
+      "post": {
+        "summary": "Revoke the certificates of all the users not in the allowlist",
+        "parameters": [
+          { "name": "dry-run", "in": "query", "description": "Only list the users that would be deprovisioned", "schema": { "type": "boolean" } },
+          { "name": "force", "in": "query", "description": "Deprovision even if there are more users than max-deprovisions", "schema": { "type": "boolean" } }
+        ],
+        "requestBody": {
+          "required": true,
+          "content": {
+            "application/json": {
+              "schema": {
+                "type": "object",
+                "required": ["allowlist"],
+                "properties": { "allowlist": { "type": "array", "items": { "type": "string" } } }
+              }
+            }
+          }
+        },
+        "responses": {
+          "200": { "$ref": "#/components/responses/Deprovision" },
+          "400": { "$ref": "#/components/responses/Error" },
+          "409": {
+            "description": "More users than max-deprovisions would be deprovisioned",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "type": "object",
+                  "properties": { "error": { "type": "string" }, "users": { "type": "string", "description": "Comma separated list of the users" } }
+                }
+              }
+            }
+          },
+          "429": { "$ref": "#/components/responses/RateLimited" },
+          "500": { "$ref": "#/components/responses/Deprovision" }
+        }
+      }
+    },
+    "/revoke-issued-before": {
+      "post": {
+        "summary": "Revoke all the certificates issued before the cutoff",
+        "description": "Meant to respond to the exposure of the CA key during a time window. The certificates already revoked or expired are left out. A failure revoking the certificates of one of the users doesn't stop the rest, and the CRL is updated once at the end.",
+        "parameters": [
+          { "name": "cutoff", "in": "query", "required": true, "description": "RFC 3339 timestamp. The certificates issued before it are revoked", "schema": { "type": "string", "format": "date-time" } },
+          { "name": "reason", "in": "query", "description": "Defaults to keyCompromise", "schema": { "$ref": "#/components/schemas/RevocationReason" } },
+          { "name": "dry-run", "in": "query", "description": "Only list the certificates that would be revoked", "schema": { "type": "boolean" } }
+        ],
+        "responses": {
+          "200": {
+            "description": "The revoked certificates",
+            "content": { "application/json": { "schema": { "$ref": "#/components/schemas/RevokeIssuedBeforeResult" } } }
+          },
+          "400": { "$ref": "#/components/responses/Error" },
+          "429": { "$ref": "#/components/responses/RateLimited" },
+          "500": {
+            "description": "The CRL update failed after the revocations",
+            "content": { "application/json": { "schema": { "$ref": "#/components/schemas/RevokeIssuedBeforeResult" } } }
+          }
+        }
+      }
+    },
+    "/adopt": {
+      "post": {
+        "summary": "Track the certificates issued outside of ACPM under the users they belong to",
+        "description": "Requires --adopted-certificates. The adopted certificates are subject to the keep-latest policy on the next CRL update.",
+        "requestBody": {
+          "required": true,
+          "content": {
+            "application/json": {
+              "schema": {
+                "type": "object",
+                "required": ["cn-pattern"],
+                "properties": {
+                  "cn-pattern": { "type": "string", "description": "Regexp selecting the certificates to adopt by their CN" },
+                  "username-regexp": { "type": "string", "description": "Regexp whose first capture group, or the one named 'username', is the user a certificate is adopted by. Defaults to cn-pattern." },
+                  "dry-run": { "type": "boolean", "description": "Only report the certificates that would be adopted and revoked" }
+                }
+              }
+            }
+          }
+        },
+        "responses": {
+          "200": {
+            "description": "The adopted certificates",
+            "content": { "application/json": { "schema": { "$ref": "#/components/schemas/AdoptResult" } } }
+          },
+          "400": { "$ref": "#/components/responses/Error" },
+          "429": { "$ref": "#/components/responses/RateLimited" },
+          "500": { "$ref": "#/components/responses/Error" }
+        }
+      }
+    },
+    "/users": {
+      "get": {
+        "summary": "List the users and their certificates",
+        "description": "Returns the map of all the matching users unless any of limit, offset, sort or username is given, in which case a page of the users is returned instead.",
+        "parameters": [
+          { "name": "prefix", "in": "query", "description": "Only list the users whose username starts with it", "schema": { "type": "string" } },
+          { "name": "username", "in": "query", "description": "Only list the users whose username contains it, ignoring the case", "schema": { "type": "string" } },
+          { "name": "active-only", "in": "query", "description": "Drop the users with all their certificates revoked or expired", "schema": { "type": "boolean" } },
+          { "name": "include-expired", "in": "query", "description": "With --certificate-index, list the expired certificates too", "schema": { "type": "boolean" } },
+          { "name": "refresh", "in": "query", "description": "List the users from Vault instead of the cache of --users-cache-ttl", "schema": { "type": "boolean" } },
+          { "name": "sort", "in": "query", "description": "Order of the users in the page. last-issued is most recent first.", "schema": { "type": "string", "enum": ["username", "last-issued"], "default": "username" } },
+          { "name": "limit", "in": "query", "description": "Maximum number of users in the page, all if 0", "schema": { "type": "integer", "minimum": 0 } },
+          { "name": "offset", "in": "query", "description": "Number of users to skip", "schema": { "type": "integer", "minimum": 0 } }
+        ],
+        "responses": {
+          "200": {
+            "description": "The certificates of each user, oldest first",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "oneOf": [
+                    { "type": "object", "additionalProperties": { "type": "array", "items": { "$ref": "#/components/schemas/Certificate" } } },
+                    { "$ref": "#/components/schemas/UsersPage" }
+                  ]
+                }
+              }
+            }
+          },
+          "400": { "$ref": "#/components/responses/Error" },
+          "500": { "$ref": "#/components/responses/Error" }
+        }
+      }
+    },
+    "/certificates": {
+      "get": {
+        "summary": "List all the client certificates",
+        "responses": {
+          "200": {
+            "description": "The certificates, oldest first",
+            "content": { "application/json": { "schema": { "type": "array", "nullable": true, "items": { "$ref": "#/components/schemas/Certificate" } } } }
+          },
+          "500": { "$ref": "#/components/responses/Error" }
+        }
+      }
+    },
+    "/certificates/rebuild-index": {
+      "post": {
+        "summary": "Read all the certificates of the PKI from Vault again into the index of --certificate-index",
+        "responses": {
+          "200": {
+            "description": "The index was rebuilt",
+            "content": { "application/json": { "schema": { "type": "object", "properties": {
+              "result": { "type": "string", "enum": ["success"] },
+              "indexed": { "type": "string", "description": "Number of certificates indexed, the CA and server ones included" }
+            } } } }
+          },
+          "400": { "$ref": "#/components/responses/Error" },
+          "500": { "$ref": "#/components/responses/Error" }
+        }
+      }
+    },
+    "/certificates/revoke-by-fingerprint": {
+      "post": {
+        "summary": "Revoke the certificate with the SHA-256 fingerprint and update the CRL",
+        "description": "The other certificates of its user are left as is. Nothing is done if the certificate is already revoked.",
+        "parameters": [
+          { "name": "fingerprint", "in": "query", "required": true, "description": "SHA-256 fingerprint of the certificate, colon separated or plain hex, or at least its first 16 hex digits", "schema": { "type": "string" }, "example": "3d:7f:1c:8e:54:a2:90:b1" },
+          { "name": "reason", "in": "query", "description": "Defaults to unspecified", "schema": { "$ref": "#/components/schemas/RevocationReason" } }
+        ],
+        "responses": {
+          "200": {
+            "description": "The certificate was revoked, or already was",
+            "content": { "application/json": { "schema": { "type": "object", "properties": {
+              "fingerprint": { "type": "string", "description": "The full fingerprint of the certificate" },
+              "serial": { "type": "string" },
+              "username": { "type": "string" },
+              "already-revoked": { "type": "string", "enum": ["true", "false"] }
+            } } } }
+          },
+          "400": { "$ref": "#/components/responses/Error" },
+          "404": { "$ref": "#/components/responses/Error" },
+          "409": { "description": "The abbreviated fingerprint matches several certificates, none was revoked", "content": { "application/json": { "schema": { "$ref": "#/components/schemas/Error" } } } },
+          "429": { "$ref": "#/components/responses/RateLimited" },
+          "500": { "$ref": "#/components/responses/Error" },
+          "503": { "$ref": "#/components/responses/Unavailable" },
+          "504": { "$ref": "#/components/responses/Timeout" }
+        }
+      }
+    },
+    "/certificates/{serial}": {
+      "get": {
+        "summary": "Look up a certificate by its serial number",
+        "description": "Returns the certificate, whose revocation status is checked against the current CRL, along with its user and the metadata of the user",
+        "parameters": [
+          { "name": "serial", "in": "path", "required": true, "description": "The serial number, colon or dash separated or plain hex", "schema": { "type": "string" }, "example": "39:dd:2e:90:b7:23:1f:8d" }
+        ],
+        "responses": {
+          "200": {
+            "description": "The certificate",
+            "content": { "application/json": { "schema": { "$ref": "#/components/schemas/CertificateDetails" } } }
+          },
+          "400": { "$ref": "#/components/responses/Error" },
+          "404": { "$ref": "#/components/responses/Error" },
+          "500": { "$ref": "#/components/responses/Error" }
+        }
+      }
+    },
+    "/users/{user}": {
+      "get": {
+        "summary": "Describe the user",
+        "description": "Returns all the certificates of the user, active and revoked, along with the active connections of the user to the endpoint",
+        "parameters": [
+          { "$ref": "#/components/parameters/user" }
+        ],
+        "responses": {
+          "200": {
+            "description": "The user",
+            "content": { "application/json": { "schema": { "$ref": "#/components/schemas/UserDescription" } } }
+          },
+          "404": { "$ref": "#/components/responses/Error" },
+          "500": { "$ref": "#/components/responses/Error" }
+        }
+      }
+    },
+    "/users/{user}/config": {
+      "get": {
+        "summary": "Get the VPN config of the user",
+        "parameters": [
+          { "$ref": "#/components/parameters/user" }
+        ],
+        "responses": {
+          "200": {
+            "description": "The OpenVPN config",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "type": "object",
+                  "properties": {
+                    "config": { "type": "string" },
+                    "key-retained": { "type": "string", "enum": ["true", "false"], "description": "false if the private key was discarded on issuance, in which case the config has a line to replace with it" }
+                  }
+                }
+              }
+            }
+          },
+          "404": { "$ref": "#/components/responses/Error" },
+          "500": { "$ref": "#/components/responses/Error" }
+        }
+      }
+    },
+    "/users/{user}/config/url": {
+      "get": {
+        "summary": "Get a pre-signed link to download the VPN config of the user stored last in S3",
+        "parameters": [
+          { "$ref": "#/components/parameters/user" },
+          { "name": "expiry", "in": "query", "description": "How long the link is valid, e.g. 15m. Defaults to config-url-expiry, up to 168h", "schema": { "type": "string" } }
+        ],
+        "responses": {
+          "200": {
+            "description": "The link to the config",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "type": "object",
+                  "properties": {
+                    "url": { "type": "string" },
+                    "serial": { "type": "string" },
+                    "expires-at": { "type": "string", "format": "date-time" }
+                  }
+                }
+              }
+            }
+          },
+          "400": { "$ref": "#/components/responses/Error" },
+          "404": { "$ref": "#/components/responses/Error" },
+          "500": { "$ref": "#/components/responses/Error" }
+        }
+      }
+    },
+    "/users/{user}/certificates/{serial}/bundle": {
+      "get": {
+        "summary": "Get a certificate of the user along with its private key, if stored on issuance",
+        "parameters": [
+          { "$ref": "#/components/parameters/user" },
+          { "name": "serial", "in": "path", "required": true, "description": "Serial number of the certificate", "schema": { "type": "string" } },
+          { "name": "version", "in": "query", "description": "Version of the stored secret to return instead of the latest one", "schema": { "type": "integer", "minimum": 1 } }
+        ],
+        "responses": {
+          "200": {
+            "description": "The certificate bundle",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "type": "object",
+                  "properties": {
+                    "serial": { "type": "string" },
+                    "certificate": { "type": "string" },
+                    "private-key": { "type": "string" },
+                    "ca-chain": { "type": "string" },
+                    "not-after": { "type": "string", "format": "date-time" },
+                    "version": { "type": "string" },
+                    "key-retained": { "type": "string", "enum": ["true", "false"], "description": "false, with an empty private-key, if the private key was discarded on issuance" }
+                  }
+                }
+              }
+            }
+          },
+          "400": { "$ref": "#/components/responses/Error" },
+          "404": { "$ref": "#/components/responses/Error" },
+          "500": { "$ref": "#/components/responses/Error" }
+        }
+      }
+    },
+    "/users/{user}/metadata": {
+      "get": {
+        "summary": "Get the metadata of the user",
+        "parameters": [
+          { "$ref": "#/components/parameters/user" }
+        ],
+        "responses": {
+          "200": {
+            "description": "The metadata, empty if not set",
+            "content": { "application/json": { "schema": { "$ref": "#/components/schemas/UserMetadata" } } }
+          },
+          "500": { "$ref": "#/components/responses/Error" }
+        }
+      },
+      "put": {
+        "summary": "Set the metadata of the user",
+        "parameters": [
+          { "$ref": "#/components/parameters/user" }
+        ],
+        "requestBody": {
+          "required": true,
+          "content": { "application/json": { "schema": { "$ref": "#/components/schemas/UserMetadata" } } }
+        },
+        "responses": {
+          "200": { "$ref": "#/components/responses/Success" },
+          "400": { "$ref": "#/components/responses/Error" },
+          "429": { "$ref": "#/components/responses/RateLimited" },
+          "500": { "$ref": "#/components/responses/Error" }
+        }
+      }
+    },
+    "/users/{user}/suspend": {
+      "post": {
+        "summary": "Suspend the user",
+        "description": "Revokes all the current certificates of the user, with privilegeWithdrawn, and marks the user as suspended in its metadata. No certificates are issued to a suspended user and the CRL updates keep all of its certificates revoked. The caller is recorded as the author of the suspension.",
+        "parameters": [
+          { "$ref": "#/components/parameters/user" }
+        ],
+        "requestBody": {
+          "content": { "application/json": { "schema": { "type": "object", "properties": { "reason": { "type": "string" } } } } }
+        },
+        "responses": {
+          "200": {
+            "description": "The suspension and the serial numbers of the revoked certificates",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "type": "object",
+                  "properties": {
+                    "result": { "type": "string", "enum": ["success"] },
+                    "suspension": { "$ref": "#/components/schemas/Suspension" },
+                    "revoked": { "type": "array", "items": { "type": "string" } }
+                  }
+                }
+              }
+            }
+          },
+          "400": { "$ref": "#/components/responses/Error" },
+          "429": { "$ref": "#/components/responses/RateLimited" },
+          "500": { "$ref": "#/components/responses/Error" }
+        }
+      }
+    },
+    "/users/{user}/reinstate": {
+      "post": {
+        "summary": "Lift the suspension of the user",
+        "description": "The certificates revoked on suspension stay revoked. With issue=true a fresh certificate is issued and its VPN config returned, as in /issue/{user}. The user remains reinstated if the issuance fails.",
+        "parameters": [
+          { "$ref": "#/components/parameters/user" },
+          { "name": "issue", "in": "query", "description": "Issue a fresh certificate to the user", "schema": { "type": "boolean" } },
+          { "name": "email", "in": "query", "description": "With issue=true, email the VPN config to this address instead of the one in the user's metadata", "schema": { "type": "string" } }
+        ],
+        "responses": {
+          "200": {
+            "description": "The user was reinstated and, with issue=true, the VPN config",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "type": "object",
+                  "properties": {
+                    "result": { "type": "string", "enum": ["success"] },
+                    "config": { "type": "string" },
+                    "emailed-to": { "type": "string" },
+                    "email-error": { "type": "string" }
+                  }
+                }
+              }
+            }
+          },
+          "400": { "$ref": "#/components/responses/Error" },
+          "403": { "$ref": "#/components/responses/Denied" },
+          "409": {
+            "description": "The user is not suspended",
+            "content": { "application/json": { "schema": { "$ref": "#/components/schemas/Error" } } }
+          },
+          "429": { "$ref": "#/components/responses/RateLimited" },
+          "500": { "$ref": "#/components/responses/Error" },
+          "503": { "$ref": "#/components/responses/Error" }
+        }
+      }
+    },
+    "/deny-list": {
+      "get": {
+        "summary": "List the users that can't be issued certificates",
+        "description": "Requires --deny-list.",
+        "responses": {
+          "200": {
+            "description": "The entries of the deny-list",
+            "content": { "application/json": { "schema": { "type": "array", "items": { "$ref": "#/components/schemas/DenyListEntry" } } } }
+          },
+          "400": { "$ref": "#/components/responses/Error" },
+          "500": { "$ref": "#/components/responses/Error" }
+        }
+      }
+    },
+    "/deny-list/{user}": {
+      "put": {
+        "summary": "Add the user to the deny-list",
+        "description": "Requires --deny-list. The caller is recorded as the author of the entry.",
+        "parameters": [
+          { "$ref": "#/components/parameters/user" }
+        ],
+        "requestBody": {
+          "content": { "application/json": { "schema": { "type": "object", "properties": { "reason": { "type": "string" } } } } }
+        },
+        "responses": {
+          "200": {
+            "description": "The new entry of the deny-list",
+            "content": { "application/json": { "schema": { "$ref": "#/components/schemas/DenyListEntry" } } }
+          },
+          "400": { "$ref": "#/components/responses/Error" },
+          "429": { "$ref": "#/components/responses/RateLimited" },
+          "500": { "$ref": "#/components/responses/Error" }
+        }
+      },
+      "delete": {
+        "summary": "Remove the user from the deny-list",
+        "description": "Requires --deny-list.",
+        "parameters": [
+          { "$ref": "#/components/parameters/user" }
+        ],
+        "responses": {
+          "200": { "$ref": "#/components/responses/Success" },
+          "400": { "$ref": "#/components/responses/Error" },
+          "404": { "$ref": "#/components/responses/Error" },
+          "429": { "$ref": "#/components/responses/RateLimited" },
+          "500": { "$ref": "#/components/responses/Error" }
+        }
+      }
+    },
+    "/crl": {
+      "get": {
+        "summary": "Get the CRL",
+        "description": "The PEM CRL is returned in a JSON object unless the Accept header asks for application/x-pem-file. The responses carry an ETag derived from the CRL, so polling clients can send If-None-Match and get a 304 while the CRL doesn't change.",
+        "parameters": [
+          { "name": "format", "in": "query", "schema": { "type": "string", "enum": ["pem", "der"], "default": "pem" } },
+          { "name": "If-None-Match", "in": "header", "description": "The ETag of the CRL the client already has", "schema": { "type": "string" } }
+        ],
+        "responses": {
+          "200": {
+            "description": "The PEM encoded CRL, in a JSON object or as is, or with format=der the DER encoded CRL",
+            "headers": {
+              "ETag": { "schema": { "type": "string" } }
+            },
+            "content": {
+              "application/json": {
+                "schema": { "type": "object", "properties": { "crl": { "type": "string" } } }
+              },
+              "application/x-pem-file": { "schema": { "type": "string" } },
+              "application/pkix-crl": { "schema": { "type": "string", "format": "binary" } }
+            }
+          },
+          "304": { "description": "The CRL matches the If-None-Match ETag" },
+          "400": { "$ref": "#/components/responses/Error" },
+          "500": { "$ref": "#/components/responses/Error" }
+        }
+      },
+      "post": {
+        "summary": "Revoke the superseded certificates and import the CRL in the endpoint",
+        "parameters": [
+          { "name": "force-shrink", "in": "query", "description": "Import the CRL even if it drops more entries of the active one than crl-max-shrink", "schema": { "type": "boolean" } },
+          { "name": "force-import", "in": "query", "description": "Import the CRL even if it is the same as the active one, to refresh the copy cached by AWS", "schema": { "type": "boolean" } }
+        ],
+        "responses": {
+          "200": {
+            "description": "The imported CRL",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "type": "object",
+                  "properties": {
+                    "crl": { "type": "string" },
+                    "size": { "type": "string", "description": "Size of the CRL in bytes" },
+                    "max-size": { "type": "string", "description": "Maximum size of the CRL in bytes" }
+                  }
+                }
+              }
+            }
+          },
+          "400": { "$ref": "#/components/responses/Error" },
+          "409": {
+            "description": "The new CRL drops more entries of the active one than crl-max-shrink",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "type": "object",
+                  "properties": {
+                    "error": { "type": "string" },
+                    "before": { "type": "string", "description": "Entries of the active CRL" },
+                    "after": { "type": "string", "description": "Entries of the new CRL" }
+                  }
+                }
+              }
+            }
+          },
+          "429": { "$ref": "#/components/responses/RateLimited" },
+          "500": {
+            "description": "The CRL could not be updated. With crl-continue-on-revocation-error, the CRL is still updated if only some of the users failed, which are listed in failed-users",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "type": "object",
+                  "properties": {
+                    "error": { "type": "string" },
+                    "failed-users": { "type": "string", "description": "Comma separated list of the users whose certificates couldn't be revoked" },
+                    "crl": { "type": "string" },
+                    "size": { "type": "string" },
+                    "max-size": { "type": "string" }
+                  }
+                }
+              }
+            }
+          },
+          "503": { "$ref": "#/components/responses/Unavailable" },
+          "504": { "$ref": "#/components/responses/Timeout" }
+        }
+      }
+    },
+    "/crl/diff": {
+      "get": {
+        "summary": "Compare the current CRL in Vault with the one imported in the endpoint",
+        "description": "The added entries are in the Vault CRL but not yet in the endpoint, the removed ones are only in the endpoint",
+        "responses": {
+          "200": {
+            "description": "The entries that changed",
+            "content": { "application/json": { "schema": { "$ref": "#/components/schemas/CRLDiff" } } }
+          },
+          "500": { "$ref": "#/components/responses/Error" }
+        }
+      }
+    },
+    "/crl/history": {
+      "get": {
+        "summary": "List the CRLs imported in the endpoint, newest first",
+        "description": "Requires --crl-history. The CRLs themselves are left out, get them by version",
+        "responses": {
+          "200": {
+            "description": "The CRL history",
+            "content": { "application/json": { "schema": { "type": "array", "items": { "$ref": "#/components/schemas/CRLHistoryEntry" } } } }
+          },
+          "404": { "$ref": "#/components/responses/Error" },
+          "500": { "$ref": "#/components/responses/Error" }
+        }
+      }
+    },
+    "/crl/history/{version}": {
+      "get": {
+        "summary": "Get a CRL of the history",
+        "parameters": [
+          { "name": "version", "in": "path", "required": true, "schema": { "type": "integer" } }
+        ],
+        "responses": {
+          "200": {
+            "description": "The CRL, along with when and by whom it was imported",
+            "content": { "application/json": { "schema": { "$ref": "#/components/schemas/CRLHistoryEntry" } } }
+          },
+          "400": { "$ref": "#/components/responses/Error" },
+          "404": { "$ref": "#/components/responses/Error" },
+          "500": { "$ref": "#/components/responses/Error" }
+        }
+      }
+    },
+    "/crl/rollback": {
+      "post": {
+        "summary": "Import a previously backed up CRL, or a version of the CRL history, in the endpoint",
+        "parameters": [
+          { "name": "version", "in": "query", "description": "Version of the CRL history to restore, instead of the CRL in the body", "schema": { "type": "integer" } }
+        ],
+        "requestBody": {
+          "content": { "application/x-pem-file": { "schema": { "type": "string" } } }
+        },
+        "responses": {
+          "200": { "$ref": "#/components/responses/Success" },
+          "400": { "$ref": "#/components/responses/Error" },
+          "404": { "$ref": "#/components/responses/Error" },
+          "429": { "$ref": "#/components/responses/RateLimited" },
+          "500": { "$ref": "#/components/responses/Error" }
+        }
+      }
+    },
+    "/crl/prune": {
+      "post": {
+        "summary": "Remove the expired certificates from the CRL, tidying the PKI backend, and import it in the endpoint",
+        "parameters": [
+          { "name": "safety-buffer", "in": "query", "description": "How long a certificate has to be expired for to be removed, e.g. 24h. Defaults to 1h", "schema": { "type": "string" } }
+        ],
+        "responses": {
+          "200": {
+            "description": "The certificates removed from the CRL",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "type": "object",
+                  "properties": {
+                    "count": { "type": "integer" },
+                    "serials": { "type": "array", "items": { "type": "string" } },
+                    "size": { "type": "integer", "description": "Size of the new CRL, if it was imported" }
+                  }
+                }
+              }
+            }
+          },
+          "400": { "$ref": "#/components/responses/Error" },
+          "429": { "$ref": "#/components/responses/RateLimited" },
+          "500": { "$ref": "#/components/responses/Error" }
+        }
+      }
+    },
+    "/crl/rebuild": {
+      "post": {
+        "summary": "Rebuild the CRL from the certificates revoked in Vault and import it in the endpoint",
+        "description": "Rotates the CRL in Vault and only imports it if it lists exactly the certificates with a revocation time in Vault. No certificates are revoked",
+        "parameters": [
+          { "name": "force-import", "in": "query", "description": "Import the CRL even if it doesn't match the certificates revoked in Vault", "schema": { "type": "boolean" } }
+        ],
+        "responses": {
+          "200": {
+            "description": "The result of the rebuild",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "type": "object",
+                  "properties": {
+                    "revoked": { "type": "array", "items": { "type": "string" }, "description": "Serial numbers of the certificates revoked in Vault" },
+                    "missing": { "type": "array", "items": { "type": "string" }, "description": "Revoked in Vault but missing from the CRL" },
+                    "unexpected": { "type": "array", "items": { "type": "string" }, "description": "Listed in the CRL but not revoked in Vault" },
+                    "size": { "type": "integer" },
+                    "aws-updated": { "type": "boolean" }
+                  }
+                }
+              }
+            }
+          },
+          "400": { "$ref": "#/components/responses/Error" },
+          "409": {
+            "description": "The regenerated CRL doesn't match the certificates revoked in Vault and was not imported",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "type": "object",
+                  "properties": {
+                    "error": { "type": "string" },
+                    "missing": { "type": "string", "description": "Comma separated serial numbers" },
+                    "unexpected": { "type": "string", "description": "Comma separated serial numbers" }
+                  }
+                }
+              }
+            }
+          },
+          "429": { "$ref": "#/components/responses/RateLimited" },
+          "500": { "$ref": "#/components/responses/Error" }
+        }
+      }
+    },
+    "/report": {
+      "get": {
+        "summary": "Export all the users and their certificates",
+        "parameters": [
+          { "name": "format", "in": "query", "description": "Can also be selected with the Accept header", "schema": { "type": "string", "enum": ["json", "csv"], "default": "json" } }
+        ],
+        "responses": {
+          "200": {
+            "description": "The report",
+            "content": {
+              "application/json": { "schema": { "type": "array", "items": { "$ref": "#/components/schemas/ReportRecord" } } },
+              "text/csv": { "schema": { "type": "string" } }
+            }
+          },
+          "400": { "$ref": "#/components/responses/Error" }
+        }
+      }
+    },
+    "/expiring": {
+      "get": {
+        "summary": "List the active certificates about to expire",
+        "parameters": [
+          { "name": "window", "in": "query", "description": "Go duration, e.g. 720h. Defaults to expiry-warning-window.", "schema": { "type": "string" } }
+        ],
+        "responses": {
+          "200": {
+            "description": "The expiring certificates of each user",
+            "content": {
+              "application/json": {
+                "schema": { "type": "object", "additionalProperties": { "type": "array", "items": { "$ref": "#/components/schemas/Certificate" } } }
+              }
+            }
+          },
+          "400": { "$ref": "#/components/responses/Error" },
+          "500": { "$ref": "#/components/responses/Error" }
+        }
+      }
+    },
+    "/endpoints": {
+      "get": {
+        "summary": "List the CRL status of the Client VPN endpoints of the region",
+        "responses": {
+          "200": {
+            "description": "The status of each endpoint with certificate authentication",
+            "content": { "application/json": { "schema": { "type": "array", "nullable": true, "items": { "$ref": "#/components/schemas/EndpointCRLStatus" } } } }
+          },
+          "500": { "$ref": "#/components/responses/Error" }
+        }
+      }
+    },
+    "/endpoints/config-cache": {
+      "delete": {
+        "summary": "Drop the cached config exported from the endpoints, so the next issuance exports it again",
+        "parameters": [
+          { "name": "endpoint-id", "in": "query", "description": "Only drop the config of this endpoint", "schema": { "type": "string" } }
+        ],
+        "responses": {
+          "200": { "$ref": "#/components/responses/Success" }
+        }
+      }
+    },
+    "/healthz": {
+      "get": {
+        "summary": "Liveness probe",
+        "security": [],
+        "responses": {
+          "200": {
+            "description": "The server is up. The status of the reconciler is included when it is enabled",
+            "content": { "application/json": { "schema": { "type": "object", "properties": {
+              "status": { "type": "string", "enum": ["ok"] },
+              "reconciler": { "$ref": "#/components/schemas/ReconcilerStatus" }
+            } } } }
+          }
+        }
+      }
+    },
+    "/readyz": {
+      "get": {
+        "summary": "Readiness probe",
+        "security": [],
+        "responses": {
+          "200": { "$ref": "#/components/responses/Readiness" },
+          "503": { "$ref": "#/components/responses/Readiness" }
+        }
+      }
+    },
+    "/metrics": {
+      "get": {
+        "summary": "Prometheus metrics",
+        "responses": {
+          "200": { "description": "The metrics", "content": { "text/plain": { "schema": { "type": "string" } } } }
+        }
+      }
+    },
+    "/openapi.json": {
+      "get": {
+        "summary": "This document",
+        "responses": {
+          "200": { "description": "The OpenAPI document", "content": { "application/json": { "schema": { "type": "object" } } } }
+        }
+      }
+    },
+    "/docs": {
+      "get": {
+        "summary": "Swagger UI page rendering this document",
+        "responses": {
+          "200": { "description": "The page", "content": { "text/html": { "schema": { "type": "string" } } } }
+        }
+      }
+    }
+  },
+  "components": {
+    "securitySchemes": {
+      "bearerAuth": {
+        "type": "http",
+        "scheme": "bearer",
+        "description": "A static token or a GitHub personal access token, if authentication is enabled"
+      }
+    },
+    "parameters": {
+      "user": { "name": "user", "in": "path", "required": true, "schema": { "type": "string" } }
+    },
+    "responses": {
+      "Success": {
+        "description": "The operation succeeded",
+        "content": { "application/json": { "schema": { "type": "object", "properties": { "result": { "type": "string", "enum": ["success"] } } } } }
+      },
+      "Error": {
+        "description": "The operation failed",
+        "content": { "application/json": { "schema": { "$ref": "#/components/schemas/Error" } } }
+      },
+      "Denied": {
+        "description": "The user is in the deny-list, is suspended, or is not found or not active in the directory",
+        "content": {
+          "application/json": {
+            "schema": {
+              "type": "object",
+              "properties": {
+                "error": { "type": "string" },
+                "reason": { "type": "string" },
+                "created-by": { "type": "string", "description": "Only for the users in the deny-list" },
+                "created-at": { "type": "string", "format": "date-time", "description": "Only for the users in the deny-list" },
+                "suspended-by": { "type": "string", "description": "Only for the suspended users" },
+                "suspended-at": { "type": "string", "format": "date-time", "description": "Only for the suspended users" }
+              }
+            }
+          }
+        }
+      },
+      "RateLimited": {
+        "description": "The rate limit of the caller or of the user has been reached",
+        "headers": {
+          "Retry-After": { "description": "Seconds until the request will be allowed", "schema": { "type": "integer" } }
+        },
+        "content": { "application/json": { "schema": { "$ref": "#/components/schemas/Error" } } }
+      },
+      "Unavailable": {
+        "description": "Vault, or the directory, is unavailable. Retry-After is set while the circuit breaker of the Vault calls is open.",
+        "headers": {
+          "Retry-After": { "description": "Seconds until Vault will be probed again", "schema": { "type": "integer" } }
+        },
+        "content": { "application/json": { "schema": { "$ref": "#/components/schemas/Error" } } }
+      },
+      "Timeout": {
+        "description": "A Vault or AWS call, or the whole operation, didn't complete in time",
+        "content": {
+          "application/json": {
+            "schema": {
+              "type": "object",
+              "properties": {
+                "error": { "type": "string" },
+                "stage": { "type": "string", "description": "The call that was running, e.g. vault_revoke or import_crl" },
+                "timeout": { "type": "string", "description": "The timeout reached, as a Go duration" },
+                "operation": { "type": "string", "description": "Set if the timeout reached was the one of the whole operation, e.g. update_crl" }
+              }
+            }
+          }
+        }
+      },
+      "IssueBatch": {
+        "description": "The outcome of each user. The error is set if the CRL could not be updated, in which case the previous certificates of the users are not revoked yet.",
+        "content": {
+          "application/json": {
+            "schema": {
+              "type": "object",
+              "properties": {
+                "users": {
+                  "type": "array",
+                  "items": {
+                    "type": "object",
+                    "properties": {
+                      "username": { "type": "string" },
+                      "result": { "type": "string", "enum": ["issued", "error"] },
+                      "serial": { "type": "string" },
+                      "config-path": { "type": "string", "description": "Where the VPN config was stored in the kv store" },
+                      "emailed-to": { "type": "string" },
+                      "email-error": { "type": "string" },
+                      "error": { "type": "string" }
+                    }
+                  }
+                },
+                "error": { "type": "string" }
+              }
+            }
+          }
+        }
+      },
+      "RevokeBatch": {
+        "description": "The outcome of each user. The error is set if the CRL could not be updated, in which case the revocations are not effective yet.",
+        "content": {
+          "application/json": {
+            "schema": {
+              "type": "object",
+              "properties": {
+                "users": {
+                  "type": "array",
+                  "items": {
+                    "type": "object",
+                    "properties": {
+                      "username": { "type": "string" },
+                      "result": { "type": "string", "enum": ["revoked", "not-found", "error"] },
+                      "revoked": { "type": "array", "items": { "type": "string" } },
+                      "error": { "type": "string" }
+                    }
+                  }
+                },
+                "error": { "type": "string" }
+              }
+            }
+          }
+        }
+      },
+      "Deprovision": {
+        "description": "The deprovisioned users. The error is set if the CRL could not be updated, in which case the revocations are not effective yet.",
+        "content": {
+          "application/json": {
+            "schema": {
+              "type": "object",
+              "properties": {
+                "deprovisioned": { "type": "array", "nullable": true, "items": { "type": "string" } },
+                "dry-run": { "type": "boolean" },
+                "failed": { "type": "object", "description": "The error of each of the users that couldn't be deprovisioned, or added to the deny-list", "additionalProperties": { "type": "string" } },
+                "error": { "type": "string" }
+              }
+            }
+          }
+        }
+      },
+      "Readiness": {
+        "description": "The result of each of the readiness checks",
+        "content": {
+          "application/json": {
+            "schema": {
+              "type": "object",
+              "properties": {
+                "status": { "type": "string", "enum": ["ok", "ko"] },
+                "checks": { "type": "object", "additionalProperties": { "$ref": "#/components/schemas/HealthCheck" } },
+                "error": { "type": "string" }
+              }
+            }
+          }
+        }
+      }
+    },
+    "schemas": {
+      "Error": {
+        "type": "object",
+        "properties": { "error": { "type": "string" } }
+      },
+      "CertLimitError": {
+        "type": "object",
+        "properties": {
+          "error": { "type": "string" },
+          "count": { "type": "string" },
+          "limit": { "type": "string" }
+        }
+      },
+      "IssueResult": {
+        "type": "object",
+        "properties": {
+          "config": { "type": "string", "description": "The OpenVPN config, with the certificate and private key" },
+          "result": { "type": "string", "enum": ["success"], "description": "Not set for temporary certificates" },
+          "emailed-to": { "type": "string" },
+          "email-error": { "type": "string" },
+          "key-retained": { "type": "string", "enum": ["false"], "description": "Set if the private key was discarded, so this is the only response with it" }
+        }
+      },
+      "SignResult": {
+        "type": "object",
+        "properties": {
+          "serial": { "type": "string" },
+          "certificate": { "type": "string" },
+          "ca-chain": { "type": "string" },
+          "not-after": { "type": "string", "format": "date-time" }
+        }
+      },
+      "RevocationReason": {
+        "type": "string",
+        "description": "The reason of the revocation, named after the CRL reason codes of RFC 5280. The query parameters also accept the reason code, e.g. 1 for keyCompromise.",
+        "enum": ["unspecified", "keyCompromise", "affiliationChanged", "superseded", "cessationOfOperation", "privilegeWithdrawn"]
+      },
+      "Certificate": {
+        "type": "object",
+        "properties": {
+          "serial": { "type": "string" },
+          "issuer-cn": { "type": "string" },
+          "subject-cn": { "type": "string" },
+          "notBefore": { "type": "string", "format": "date-time" },
+          "notAfter": { "type": "string", "format": "date-time" },
+          "revoked": { "type": "boolean" },
+          "certificate-pem": { "type": "string" },
+          "vault-pki-path": { "type": "string" },
+          "revocation-time": { "type": "string", "format": "date-time" },
+          "revocation-reason": { "$ref": "#/components/schemas/RevocationReason" },
+          "key-not-retained": { "type": "boolean", "description": "Set if the private key was discarded on issuance. Only in the details of a user or certificate" }
+        }
+      },
+      "CertificateDetails": {
+        "allOf": [
+          { "$ref": "#/components/schemas/Certificate" },
+          {
+            "type": "object",
+            "properties": {
+              "username": { "type": "string" },
+              "metadata": { "$ref": "#/components/schemas/UserMetadata" }
+            }
+          }
+        ]
+      },
+      "UserDescription": {
+        "type": "object",
+        "properties": {
+          "username": { "type": "string" },
+          "certificates": { "type": "array", "items": { "$ref": "#/components/schemas/Certificate" } },
+          "active": { "type": "integer" },
+          "suspension": { "$ref": "#/components/schemas/Suspension" },
+          "connections": { "type": "array", "items": { "$ref": "#/components/schemas/ClientConnection" } }
+        }
+      },
+      "ClientConnection": {
+        "type": "object",
+        "properties": {
+          "connection-id": { "type": "string" },
+          "status": { "type": "string" },
+          "common-name": { "type": "string" },
+          "client-ip": { "type": "string" },
+          "established-at": { "type": "string", "format": "date-time" },
+          "ingress-bytes": { "type": "string" },
+          "egress-bytes": { "type": "string" }
+        }
+      },
+      "UsersPage": {
+        "type": "object",
+        "properties": {
+          "users": {
+            "type": "array",
+            "items": {
+              "type": "object",
+              "properties": {
+                "username": { "type": "string" },
+                "certificates": { "type": "array", "items": { "$ref": "#/components/schemas/Certificate" } },
+                "suspension": { "$ref": "#/components/schemas/Suspension" }
+              }
+            }
+          },
+          "total": { "type": "integer", "description": "Number of users matching the filters, in all the pages" },
+          "next-offset": { "type": "integer", "description": "Offset of the next page. Not set in the last one." }
+        }
+      },
+      "UserMetadata": {
+        "type": "object",
+        "properties": {
+          "auto_renew": { "type": "boolean" },
+          "email": { "type": "string" },
+          "suspension": { "$ref": "#/components/schemas/Suspension", "readOnly": true, "description": "Set while the user is suspended. Ignored by PUT." },
+          "key_not_retained": { "type": "array", "items": { "type": "string" }, "readOnly": true, "description": "Serial numbers of the certificates whose private key was discarded on issuance. Ignored by PUT." }
+        }
+      },
+      "ReportRecord": {
+        "type": "object",
+        "properties": {
+          "username": { "type": "string" },
+          "serial": { "type": "string" },
+          "issued_at": { "type": "string", "format": "date-time" },
+          "expires_at": { "type": "string", "format": "date-time" },
+          "revoked": { "type": "boolean" },
+          "active": { "type": "boolean" },
+          "vpn_endpoint": { "type": "string" }
+        }
+      },
+      "EndpointCRLStatus": {
+        "type": "object",
+        "properties": {
+          "endpoint-id": { "type": "string" },
+          "status": { "type": "string" },
+          "status-message": { "type": "string" },
+          "crl-present": { "type": "boolean" },
+          "entries": { "type": "integer" },
+          "last-modified": { "type": "string", "format": "date-time" },
+          "next-update": { "type": "string", "format": "date-time" },
+          "error": { "type": "string" }
+        }
+      },
+      "HealthCheck": {
+        "type": "object",
+        "properties": {
+          "status": { "type": "string", "enum": ["ok", "ko"] },
+          "error": { "type": "string" }
+        }
+      },
+      "ReconcilerStatus": {
+        "type": "object",
+        "properties": {
+          "last-run": { "type": "string", "format": "date-time" },
+          "last-duration": { "type": "string", "example": "1.2s" },
+          "last-result": { "type": "string", "enum": ["succeeded", "skipped", "failed"] },
+          "last-error": { "type": "string" },
+          "last-trigger": { "type": "string", "enum": ["scheduler", "manual"] },
+          "consecutive-failures": { "type": "integer", "description": "Runs failed since the last successful one, which delay the next run" },
+          "next-run": { "type": "string", "format": "date-time" }
+        }
+      },
+      "AdoptResult": {
+        "type": "object",
+        "properties": {
+          "adopted": { "type": "object", "description": "Serial numbers of the adopted certificates by username", "additionalProperties": { "type": "array", "items": { "type": "string" } } },
+          "to-revoke": { "type": "object", "description": "Serial numbers of the certificates the next CRL update revokes by username", "additionalProperties": { "type": "array", "items": { "type": "string" } } },
+          "dry-run": { "type": "boolean" }
+        }
+      },
+      "DenyListEntry": {
+        "type": "object",
+        "properties": {
+          "username": { "type": "string" },
+          "reason": { "type": "string" },
+          "created-by": { "type": "string" },
+          "created-at": { "type": "string", "format": "date-time" }
+        }
+      },
+      "RevokeIssuedBeforeResult": {
+        "type": "object",
+        "properties": {
+          "revoked": { "type": "object", "description": "The serial numbers of the revoked certificates, keyed by username", "additionalProperties": { "type": "array", "items": { "type": "string" } } },
+          "failed": { "type": "object", "description": "The errors revoking the certificates of the users, keyed by username", "additionalProperties": { "type": "string" } },
+          "dry-run": { "type": "boolean" },
+          "error": { "type": "string" }
+        }
+      },
+      "Suspension": {
+        "type": "object",
+        "properties": {
+          "reason": { "type": "string" },
+          "suspended_by": { "type": "string" },
+          "suspended_at": { "type": "string", "format": "date-time" }
+        }
+      },
+      "CRLDiff": {
+        "type": "object",
+        "properties": {
+          "added": { "type": "array", "items": { "$ref": "#/components/schemas/CRLDiffEntry" } },
+          "removed": { "type": "array", "items": { "$ref": "#/components/schemas/CRLDiffEntry" } }
+        }
+      },
+      "CRLHistoryEntry": {
+        "type": "object",
+        "properties": {
+          "version": { "type": "integer" },
+          "imported_at": { "type": "string", "format": "date-time" },
+          "endpoint_id": { "type": "string" },
+          "revoked_count": { "type": "integer", "description": "Number of entries of the CRL" },
+          "actor": { "type": "string" },
+          "crl": { "type": "string", "description": "PEM encoded, left out of the listing" }
+        }
+      },
+      "CRLDiffEntry": {
+        "type": "object",
+        "properties": {
+          "serial_number": { "type": "string" },
+          "revocation_time": { "type": "string", "format": "date-time" },
+          "username": { "type": "string", "description": "Empty if the certificate can't be found in Vault" }
+        }
+      }
+    }
+  }
+}
+`
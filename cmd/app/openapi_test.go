@@ -0,0 +1,323 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/spf13/viper"
+)
+
+// setDefault sets the config key for the test
+func setDefault(t *testing.T, key string, value interface{}) {
+	t.Helper()
+	keepDefaults(t, key)
+	viper.SetDefault(key, value)
+}
+
+// useFakeVault configures the server against a new fake Vault
+func useFakeVault(t *testing.T) *fakeVault {
+	t.Helper()
+	v := newFakeVault(t)
+	setDefault(t, "vault-pki-paths", []string{v.pki})
+	setDefault(t, "vault-kv-path", v.kv)
+	setDefault(t, "vault-client-certificate-role", "client")
+	setDefault(t, "client-vpn-endpoint-id", "cvpn-endpoint-0873f24b07b72b3ee")
+	return v
+}
+
+func loadSpec(t *testing.T) map[string]interface{} {
+	t.Helper()
+	var spec map[string]interface{}
+	if err := json.Unmarshal([]byte(openAPISpec), &spec); err != nil {
+		t.Fatalf("invalid spec: %s", err)
+	}
+	return spec
+}
+
+func TestOpenAPISpecCoversRoutes(t *testing.T) {
+	paths := loadSpec(t)["paths"].(map[string]interface{})
+
+	routes := map[string]bool{}
+	err := newRouter(nil).Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		path, err := route.GetPathTemplate()
+		if err != nil {
+			return err
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return err
+		}
+		for _, m := range methods {
+			op := strings.ToLower(m) + " " + path
+			routes[op] = true
+			item, ok := paths[path].(map[string]interface{})
+			if !ok {
+				t.Errorf("route %s is not in the spec", path)
+				continue
+			}
+			if _, ok := item[strings.ToLower(m)]; !ok {
+				t.Errorf("route %s is not in the spec", op)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, item := range paths {
+		for m := range item.(map[string]interface{}) {
+			if op := m + " " + path; !routes[op] {
+				t.Errorf("%s is in the spec but not routed", op)
+			}
+		}
+	}
+}
+
+// schemaValidator checks the JSON documents against the
+// subset of the OpenAPI schemas used by the spec
+type schemaValidator struct {
+	spec map[string]interface{}
+}
+
+func (v *schemaValidator) resolve(schema map[string]interface{}) map[string]interface{} {
+	for {
+		ref, ok := schema["$ref"].(string)
+		if !ok {
+			return schema
+		}
+		node := interface{}(v.spec)
+		for _, p := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+			node = node.(map[string]interface{})[p]
+		}
+		schema = node.(map[string]interface{})
+	}
+}
+
+func (v *schemaValidator) validate(path string, schema map[string]interface{}, doc interface{}) []string {
+	schema = v.resolve(schema)
+	if doc == nil {
+		if nullable, _ := schema["nullable"].(bool); nullable || schema["type"] == "array" || schema["type"] == "object" {
+			return nil
+		}
+		if schema["type"] != nil {
+			return []string{path + ": null, want " + schema["type"].(string)}
+		}
+	}
+	for _, key := range []string{"oneOf", "anyOf"} {
+		alternatives, ok := schema[key].([]interface{})
+		if !ok {
+			continue
+		}
+		var errs []string
+		for _, alt := range alternatives {
+			altErrs := v.validate(path, alt.(map[string]interface{}), doc)
+			if len(altErrs) == 0 {
+				return nil
+			}
+			errs = append(errs, altErrs...)
+		}
+		return append([]string{path + ": no alternative of " + key + " matches"}, errs...)
+	}
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, e := range enum {
+			found = found || e == doc
+		}
+		if !found {
+			return []string{fmt.Sprintf("%s: %v not in %v", path, doc, enum)}
+		}
+	}
+
+	switch schema["type"] {
+	case "object":
+		obj, ok := doc.(map[string]interface{})
+		if !ok {
+			return []string{fmt.Sprintf("%s: %T, want an object", path, doc)}
+		}
+		var errs []string
+		for _, r := range asSlice(schema["required"]) {
+			if _, ok := obj[r.(string)]; !ok {
+				errs = append(errs, path+": missing required "+r.(string))
+			}
+		}
+		props, _ := schema["properties"].(map[string]interface{})
+		if props == nil && schema["additionalProperties"] == nil {
+			// Free-form object
+			return errs
+		}
+		for k, val := range obj {
+			if p, ok := props[k]; ok {
+				errs = append(errs, v.validate(path+"."+k, p.(map[string]interface{}), val)...)
+				continue
+			}
+			switch extra := schema["additionalProperties"].(type) {
+			case map[string]interface{}:
+				errs = append(errs, v.validate(path+"."+k, extra, val)...)
+			case bool:
+				if !extra {
+					errs = append(errs, path+": undocumented field "+k)
+				}
+			default:
+				errs = append(errs, path+": undocumented field "+k)
+			}
+		}
+		return errs
+	case "array":
+		arr, ok := doc.([]interface{})
+		if !ok {
+			return []string{fmt.Sprintf("%s: %T, want an array", path, doc)}
+		}
+		var errs []string
+		items, _ := schema["items"].(map[string]interface{})
+		for i, val := range arr {
+			if items != nil {
+				errs = append(errs, v.validate(path+"["+strconv.Itoa(i)+"]", items, val)...)
+			}
+		}
+		return errs
+	case "string":
+		if _, ok := doc.(string); !ok {
+			return []string{fmt.Sprintf("%s: %T, want a string", path, doc)}
+		}
+	case "integer":
+		if n, ok := doc.(float64); !ok || n != float64(int64(n)) {
+			return []string{fmt.Sprintf("%s: %v, want an integer", path, doc)}
+		}
+	case "number":
+		if _, ok := doc.(float64); !ok {
+			return []string{fmt.Sprintf("%s: %T, want a number", path, doc)}
+		}
+	case "boolean":
+		if _, ok := doc.(bool); !ok {
+			return []string{fmt.Sprintf("%s: %T, want a boolean", path, doc)}
+		}
+	}
+	return nil
+}
+
+func asSlice(v interface{}) []interface{} {
+	s, _ := v.([]interface{})
+	return s
+}
+
+// responseSchema returns the schema of the JSON response of the
+// operation for the status code, or nil if it isn't JSON
+func (v *schemaValidator) responseSchema(t *testing.T, method, path string, code int) map[string]interface{} {
+	t.Helper()
+	item, _ := v.spec["paths"].(map[string]interface{})[path].(map[string]interface{})
+	op, _ := item[strings.ToLower(method)].(map[string]interface{})
+	rsp, ok := op["responses"].(map[string]interface{})[strconv.Itoa(code)].(map[string]interface{})
+	if !ok {
+		t.Errorf("%s %s: status %d is not documented", method, path, code)
+		return nil
+	}
+	rsp = v.resolve(rsp)
+	content, _ := rsp["content"].(map[string]interface{})
+	media, ok := content["application/json"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	return media["schema"].(map[string]interface{})
+}
+
+func TestOpenAPISpecMatchesResponses(t *testing.T) {
+	v := useFakeVault(t)
+	now := time.Now()
+	serial := v.addCertificate("alice", now.Add(-48*time.Hour), 24*time.Hour)
+	v.revoke(serial)
+	serial = v.addCertificate("alice", now.Add(-time.Hour), 240*time.Hour)
+	v.addCertificate("bob", now.Add(-time.Hour), 24*time.Hour)
+	v.secrets["users/alice/metadata"] = map[string]interface{}{"team": "eng"}
+	v.secrets["denylist/mallory"] = map[string]interface{}{"reason": "left", "created_by": "admin", "created_at": now.Format(time.RFC3339)}
+	setDefault(t, "deny-list", true)
+
+	validator := &schemaValidator{spec: loadSpec(t)}
+	router := newRouter(v.vaultClient())
+	tests := []struct {
+		method string
+		path   string
+		route  string
+		body   string
+		code   int
+	}{
+		{http.MethodGet, "/users", "/users", "", http.StatusOK},
+		{http.MethodGet, "/users?limit=1&sort=last-issued", "/users", "", http.StatusOK},
+		{http.MethodGet, "/users?limit=-1", "/users", "", http.StatusBadRequest},
+		{http.MethodGet, "/certificates", "/certificates", "", http.StatusOK},
+		{http.MethodGet, "/certificates/" + serial, "/certificates/{serial}", "", http.StatusOK},
+		{http.MethodGet, "/certificates/00:01:02", "/certificates/{serial}", "", http.StatusNotFound},
+		{http.MethodGet, "/certificates/zz", "/certificates/{serial}", "", http.StatusBadRequest},
+		{http.MethodGet, "/deny-list", "/deny-list", "", http.StatusOK},
+		{http.MethodGet, "/users/alice/metadata", "/users/{user}/metadata", "", http.StatusOK},
+		{http.MethodGet, "/expiring?window=720h", "/expiring", "", http.StatusOK},
+		{http.MethodGet, "/expiring?window=soon", "/expiring", "", http.StatusBadRequest},
+		{http.MethodGet, "/healthz", "/healthz", "", http.StatusOK},
+		{http.MethodGet, "/openapi.json", "/openapi.json", "", http.StatusOK},
+		{http.MethodPut, "/users/bob/metadata", "/users/{user}/metadata", `{"team":"ops"}`, http.StatusOK},
+		{http.MethodPut, "/deny-list/eve", "/deny-list/{user}", `{"reason":"left"}`, http.StatusOK},
+		{http.MethodDelete, "/deny-list/mallory", "/deny-list/{user}", "", http.StatusOK},
+		{http.MethodDelete, "/deny-list/nobody", "/deny-list/{user}", "", http.StatusNotFound},
+		{http.MethodDelete, "/endpoints/config-cache", "/endpoints/config-cache", "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body)))
+			if w.Code != tt.code {
+				t.Fatalf("got status %d, want %d: %s", w.Code, tt.code, w.Body)
+			}
+			schema := validator.responseSchema(t, tt.method, tt.route, w.Code)
+			if schema == nil {
+				return
+			}
+			var doc interface{}
+			if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil {
+				t.Fatalf("invalid JSON response: %s\n%s", err, w.Body)
+			}
+			errs := validator.validate("$", schema, doc)
+			sort.Strings(errs)
+			for _, err := range errs {
+				t.Error(err)
+			}
+			if len(errs) > 0 {
+				t.Logf("response: %s", w.Body)
+			}
+		})
+	}
+}
+
+func TestDocsPage(t *testing.T) {
+	get := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		docsHandler()(w, httptest.NewRequest(http.MethodGet, "/docs", nil))
+		return w
+	}
+
+	w := get()
+	body, csp := w.Body.String(), w.Header().Get("Content-Security-Policy")
+	if !strings.Contains(body, `src="`+defaultDocsAssetsURL+`/swagger-ui-bundle.js"`) || strings.Contains(body, "swagger-ui-dist@3/") {
+		t.Errorf("got page %s, want the assets of the pinned release", body)
+	}
+	if !strings.Contains(csp, "script-src "+defaultDocsAssetsURL+"/ '"+swaggerUIScriptHash+"';") {
+		t.Errorf("got Content-Security-Policy %q, want only the assets and the inline script allowed", csp)
+	}
+	// The hash is the one of the inline script of the page
+	if !strings.Contains(body, "<script>"+swaggerUIScript+"</script>") {
+		t.Errorf("got page %s, want the script matching the hash", body)
+	}
+
+	setDefault(t, "docs-assets-url", "https://assets.example.com/swagger-ui/")
+	w = get()
+	if !strings.Contains(w.Body.String(), `href="https://assets.example.com/swagger-ui/swagger-ui.css"`) ||
+		!strings.Contains(w.Header().Get("Content-Security-Policy"), "style-src https://assets.example.com/swagger-ui/ ") {
+		t.Errorf("got page %s with Content-Security-Policy %q, want the assets of docs-assets-url", w.Body, w.Header().Get("Content-Security-Policy"))
+	}
+}
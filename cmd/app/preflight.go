@@ -0,0 +1,65 @@
+package app
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/operations"
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/vault"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// preflightCmd checks the setup the server would run with
+var preflightCmd = &cobra.Command{
+	Use:     "preflight",
+	Short:   "Checks the connectivity to Vault and AWS and exits",
+	Long:    "Checks that Vault is reachable, that the token is valid, that the PKI path exists, that the AWS credentials work and that the Client VPN endpoint exists. Exits with a non zero code if any of the checks fails.",
+	Example: "aws-cvpn-pki-manager server preflight --vault-addr http://localhost:8200 --vault-auth-token s.XXXXXXXXX --client-vpn-endpoint-id cvpn-endpoint-0873f24b07b72b3ee",
+	Run:     runPreflight,
+}
+
+func init() {
+	serverCmd.AddCommand(preflightCmd)
+}
+
+func runPreflight(cmd *cobra.Command, args []string) {
+	if !preflight() {
+		os.Exit(1)
+	}
+}
+
+// preflight runs the checks and prints their results,
+// returning whether all of them passed
+func preflight() bool {
+	operations.SetAWSUserAgent(viper.GetString("aws-user-agent"))
+	operations.SetAWSEndpointURL(viper.GetString("aws-endpoint-url"))
+
+	client, loginErr := vaultClient().GetClient()
+	if loginErr != nil {
+		// Use an unauthenticated client to still run the rest of the checks
+		var err error
+		client, err = vault.NewClient(viper.GetString("vault-addr"), nil, vaultTLSOptions())
+		if err != nil {
+			log.Fatalf("Unable to create the Vault client: %s", err)
+		}
+	}
+	report := operations.Preflight(
+		&operations.PreflightRequest{
+			Client:              client,
+			LoginError:          loginErr,
+			VaultPKIPath:        viper.GetStringSlice("vault-pki-paths")[len(viper.GetStringSlice("vault-pki-paths"))-1],
+			ClientVPNEndpointID: viper.GetString("client-vpn-endpoint-id"),
+			Timeout:             viper.GetDuration("readiness-check-timeout"),
+		})
+
+	for _, check := range report.Checks {
+		if check.Error != "" {
+			fmt.Printf("%s  %s: %s\n", check.Status, check.Name, check.Error)
+		} else {
+			fmt.Printf("%s  %s\n", check.Status, check.Name)
+		}
+	}
+	return report.Passed
+}
@@ -0,0 +1,285 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/audit"
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/logging"
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/metrics"
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/operations"
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/vault"
+	"github.com/robfig/cron"
+	"github.com/spf13/viper"
+)
+
+// Results of the runs of the reconciler
+const (
+	reconcileSucceeded = "succeeded"
+	reconcileSkipped   = "skipped"
+	reconcileFailed    = "failed"
+)
+
+// reconcileMaxBackoff is the longest wait between two runs of the
+// reconciler after consecutive failures
+const reconcileMaxBackoff = 30 * time.Minute
+
+// reconcile periodically updates the CRL of the endpoint, replacing
+// an external job calling POST /crl. Nil if not enabled.
+var reconcile *reconciler
+
+// reconcileStatus is the outcome of the last run of the reconciler,
+// as reported in /healthz
+type reconcileStatus struct {
+	LastRun      *time.Time `json:"last-run,omitempty"`
+	LastDuration string     `json:"last-duration,omitempty"`
+	LastResult   string     `json:"last-result,omitempty"`
+	LastError    string     `json:"last-error,omitempty"`
+	LastTrigger  string     `json:"last-trigger,omitempty"`
+	// ConsecutiveFailures is the number of runs
+	// that failed since the last successful one
+	ConsecutiveFailures int       `json:"consecutive-failures,omitempty"`
+	NextRun             time.Time `json:"next-run"`
+}
+
+// reconciler runs a function at an interval, or following a cron
+// schedule, plus a random jitter so the replicas of the server don't
+// run it all at once. Runs don't overlap, as the next one is only
+// scheduled once the previous has finished. After a failure, the wait
+// until the next run doubles on each consecutive one, up to
+// reconcileMaxBackoff, and goes back to normal on the first success.
+type reconciler struct {
+	schedule cron.Schedule
+	jitter   time.Duration
+	run      func() (string, error)
+	rand     *rand.Rand
+	reset    chan struct{}
+	stop     chan struct{}
+	stopOnce sync.Once
+	status   reconcileStatus
+	sync.Mutex
+}
+
+// newReconciler returns a reconciler running fn every interval, or
+// following the cron spec if set. Only one of them can be set.
+func newReconciler(interval time.Duration, spec string, jitter time.Duration, fn func() (string, error)) (*reconciler, error) {
+	var schedule cron.Schedule
+	switch {
+	case interval > 0 && spec != "":
+		return nil, errors.New("only one of reconcile-interval and reconcile-schedule can be set")
+	case interval > 0:
+		schedule = cron.Every(interval)
+	case spec != "":
+		var err error
+		schedule, err = cron.Parse(spec)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, nil
+	}
+	if jitter < 0 {
+		return nil, fmt.Errorf("invalid reconcile-jitter %s", jitter)
+	}
+	return &reconciler{
+		schedule: schedule,
+		jitter:   jitter,
+		run:      fn,
+		rand:     rand.New(rand.NewSource(time.Now().UnixNano())),
+		reset:    make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+	}, nil
+}
+
+// Start runs the reconciler in the background until stopped
+func (rc *reconciler) Start() {
+	go func() {
+		for {
+			next := rc.next(time.Now())
+			timer := time.NewTimer(time.Until(next))
+			select {
+			case <-rc.stop:
+				timer.Stop()
+				return
+			case <-rc.reset:
+				timer.Stop()
+			case <-timer.C:
+				rc.runOnce()
+			}
+		}
+	}()
+}
+
+// Stop stops scheduling runs. A run in progress is not interrupted.
+func (rc *reconciler) Stop() {
+	if rc == nil {
+		return
+	}
+	rc.stopOnce.Do(func() { close(rc.stop) })
+}
+
+// Triggered records a run done outside of the schedule, e.g. a
+// manual update of the CRL, and restarts the timer from now on
+func (rc *reconciler) Triggered(start time.Time, err error) {
+	if rc == nil {
+		return
+	}
+	result := reconcileSucceeded
+	if err != nil {
+		result = reconcileFailed
+	}
+	rc.record("manual", start, result, err)
+	select {
+	case rc.reset <- struct{}{}:
+	default:
+	}
+}
+
+// Status returns the outcome of the last run and the time of the next one
+func (rc *reconciler) Status() reconcileStatus {
+	rc.Lock()
+	defer rc.Unlock()
+	return rc.status
+}
+
+func (rc *reconciler) next(now time.Time) time.Time {
+	next := rc.schedule.Next(now)
+	rc.Lock()
+	failures := rc.status.ConsecutiveFailures
+	rc.Unlock()
+	next = now.Add(reconcileBackoff(next.Sub(now), failures))
+	if rc.jitter > 0 {
+		next = next.Add(time.Duration(rc.rand.Int63n(int64(rc.jitter))))
+	}
+	rc.Lock()
+	rc.status.NextRun = next
+	rc.Unlock()
+	metrics.SetReconcileNextRun(next)
+	return next
+}
+
+func (rc *reconciler) runOnce() {
+	if atomic.LoadInt32(&shuttingDown) == 1 {
+		return
+	}
+	scheduledJobs.Add(1)
+	defer scheduledJobs.Done()
+
+	start := time.Now()
+	result, err := rc.run()
+	rc.record("scheduler", start, result, err)
+}
+
+func (rc *reconciler) record(trigger string, start time.Time, result string, err error) {
+	d := time.Since(start)
+	metrics.ReconcileRun(result, start, d)
+	rc.Lock()
+	defer rc.Unlock()
+	failures := rc.status.ConsecutiveFailures
+	rc.status.LastRun = &start
+	rc.status.LastDuration = d.String()
+	rc.status.LastResult = result
+	rc.status.LastTrigger = trigger
+	rc.status.LastError = ""
+	rc.status.ConsecutiveFailures = 0
+	if err != nil {
+		rc.status.LastError = err.Error()
+		rc.status.ConsecutiveFailures = failures + 1
+	}
+}
+
+// reconcileBackoff returns the wait until the next run, doubling
+// the one of the schedule on each consecutive failure
+func reconcileBackoff(wait time.Duration, failures int) time.Duration {
+	max := reconcileMaxBackoff
+	if max < wait {
+		max = wait
+	}
+	for i := 0; i < failures && wait < max; i++ {
+		wait *= 2
+	}
+	if wait > max {
+		wait = max
+	}
+	return wait
+}
+
+// reconcileCRL updates the CRL of the endpoint, skipping the run
+// if another update of the CRL is already in progress. The update
+// is stopped once ctx is done.
+func reconcileCRL(ctx context.Context, vc vault.AuthenticatedClient) (string, error) {
+	client, err := vc.GetClient()
+	if err != nil {
+		log.Printf("Reconciler failed to get the Vault client: %s", err)
+		return reconcileFailed, err
+	}
+	opts := updateCRLOptions(ctx, logging.Default().With("trigger", "reconciler"), "reconciler")
+	opts.LockFailFast = true
+	if viper.GetBool("reconcile-on-drift") {
+		status, err := operations.CheckCRLSync(
+			&operations.CheckCRLSyncRequest{
+				Client:              client,
+				VaultPKIPath:        viper.GetStringSlice("vault-pki-paths")[len(viper.GetStringSlice("vault-pki-paths"))-1],
+				ClientVPNEndpointID: viper.GetString("client-vpn-endpoint-id"),
+				UpdateCRLOptions:    opts,
+			})
+		if err != nil {
+			log.Printf("Reconciler failed to check the CRL of the endpoint, will retry on next run: %s", err)
+			return reconcileFailed, err
+		}
+		if status.InSync {
+			log.Print("Reconciler skipped the CRL update: the endpoint is in sync")
+			return reconcileSkipped, nil
+		}
+		log.Printf("Reconciler found the CRL out of sync (added: %d, removed: %d, users with superseded certificates: %d)",
+			len(status.Diff.Added), len(status.Diff.Removed), len(status.Pending))
+	}
+	res, err := operations.UpdateCRL(
+		&operations.UpdateCRLRequest{
+			Client:              client,
+			VaultPKIPath:        viper.GetStringSlice("vault-pki-paths")[len(viper.GetStringSlice("vault-pki-paths"))-1],
+			ClientVPNEndpointID: viper.GetString("client-vpn-endpoint-id"),
+			UpdateCRLOptions:    opts,
+		})
+	if errors.Is(err, operations.ErrLocked) {
+		log.Printf("Reconciler skipped the CRL update: %s", err)
+		return reconcileSkipped, nil
+	}
+	auditLog(audit.Entry{Operation: audit.OperationCRLImport, Actor: "reconciler"}, err)
+	notifyCRLUpdate(res, err, "reconciler", "")
+	if err != nil {
+		log.Printf("Reconciler failed to update the CRL, will retry on next run: %s", err)
+		return reconcileFailed, err
+	}
+	log.Printf("CRL updated by the reconciler (revoked certificates: %d, affected users: %v, AWS updated: %t)",
+		res.RevokedCount, res.AffectedUsers, res.AWSUpdated)
+	if res.Diff != nil && !res.Diff.Empty() {
+		log.Printf("CRL entries changed by the reconciler (added: %s, removed: %s)",
+			describeCRLEntries(res.Diff.Added), describeCRLEntries(res.Diff.Removed))
+	}
+	return reconcileSucceeded, nil
+}
+
+// describeCRLEntries lists the serial numbers of the
+// entries, along with their users when known
+func describeCRLEntries(entries []operations.CRLDiffEntry) string {
+	if len(entries) == 0 {
+		return "none"
+	}
+	list := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if e.Username != "" {
+			list = append(list, e.SerialNumber+" ("+e.Username+")")
+		} else {
+			list = append(list, e.SerialNumber)
+		}
+	}
+	return strings.Join(list, ", ")
+}
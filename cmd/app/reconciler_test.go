@@ -0,0 +1,97 @@
+package app
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReconcileBackoff(t *testing.T) {
+	tests := []struct {
+		name     string
+		wait     time.Duration
+		failures int
+		want     time.Duration
+	}{
+		{"no failures", time.Minute, 0, time.Minute},
+		{"one failure", time.Minute, 1, 2 * time.Minute},
+		{"three failures", time.Minute, 3, 8 * time.Minute},
+		{"capped", time.Minute, 10, reconcileMaxBackoff},
+		{"schedule longer than the cap", time.Hour, 2, time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := reconcileBackoff(tt.wait, tt.failures); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// tickSchedule runs exactly every duration, unlike cron.Every
+// that rounds it to the second
+type tickSchedule time.Duration
+
+func (s tickSchedule) Next(t time.Time) time.Time { return t.Add(time.Duration(s)) }
+
+func TestReconcilerBacksOffAfterFailures(t *testing.T) {
+	var fail int32 = 1
+	rc, err := newReconciler(time.Minute, "", 0, func() (string, error) {
+		if atomic.LoadInt32(&fail) == 1 {
+			return reconcileFailed, errors.New("vault is sealed")
+		}
+		return reconcileSucceeded, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc.schedule = tickSchedule(time.Minute)
+
+	now := time.Now()
+	for i, want := range []time.Duration{2 * time.Minute, 4 * time.Minute, 8 * time.Minute} {
+		rc.runOnce()
+		if got := rc.next(now).Sub(now); got != want {
+			t.Errorf("got next run in %s after %d failures, want %s", got, i+1, want)
+		}
+	}
+	if got := rc.Status().ConsecutiveFailures; got != 3 {
+		t.Errorf("got %d consecutive failures, want 3", got)
+	}
+
+	atomic.StoreInt32(&fail, 0)
+	rc.runOnce()
+	if got := rc.next(now).Sub(now); got != time.Minute || rc.Status().ConsecutiveFailures != 0 {
+		t.Errorf("got next run in %s with %d failures after a success, want the interval", got, rc.Status().ConsecutiveFailures)
+	}
+}
+
+func TestReconcilerStop(t *testing.T) {
+	var runs int32
+	rc, err := newReconciler(time.Minute, "", 0, func() (string, error) {
+		atomic.AddInt32(&runs, 1)
+		return reconcileSucceeded, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc.schedule = tickSchedule(10 * time.Millisecond)
+	rc.Start()
+
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt32(&runs) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("the reconciler didn't run")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	rc.Stop()
+	// Stop can be called more than once
+	rc.Stop()
+	time.Sleep(20 * time.Millisecond)
+	stopped := atomic.LoadInt32(&runs)
+	time.Sleep(50 * time.Millisecond)
+	if got := atomic.LoadInt32(&runs); got != stopped {
+		t.Errorf("got %d runs after the reconciler was stopped", got-stopped)
+	}
+}
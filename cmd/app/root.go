@@ -14,8 +14,19 @@ var (
 	rootCmd = &cobra.Command{
 		Use:   "aws-cvpn-pki-manager",
 		Short: "AWS Client VPN PKI Manager",
+		Long: `AWS Client VPN PKI Manager
+
+Options are taken from the flags, the ACPM_* environment variables (e.g.
+ACPM_VAULT_ADDR for --vault-addr) and the --config file, in that order of
+precedence: flags override environment variables, which override the file.`,
 	}
-	vaultAddr string
+	configFile         string
+	endpointName       string
+	vaultAddr          string
+	vaultFailoverAddrs []string
+	vaultCACert        string
+	vaultCACertPEM     string
+	vaultTLSSkipVerify bool
 )
 
 // Execute runs the app
@@ -27,10 +38,28 @@ func Execute() {
 }
 
 func init() {
+	rootCmd.PersistentFlags().StringVar(&configFile, "config", "", "YAML or TOML file with the options, keyed by their flag names. Unknown keys are rejected. Flags and environment variables take precedence over it")
+	viper.BindPFlag("config", rootCmd.PersistentFlags().Lookup("config"))
+
+	rootCmd.PersistentFlags().StringVar(&endpointName, "endpoint", "", "Name of the entry of the endpoints section of the config file to use. Not needed if it has a single one")
+	viper.BindPFlag("endpoint", rootCmd.PersistentFlags().Lookup("endpoint"))
+
 	rootCmd.PersistentFlags().StringVar(&vaultAddr, "vault-addr", "", "Full URL of the vault server")
 	viper.BindPFlag("vault-addr", rootCmd.PersistentFlags().Lookup("vault-addr"))
 	viper.SetDefault("vault-addr", "http://127.0.0.1:8200")
 
+	rootCmd.PersistentFlags().StringSliceVar(&vaultFailoverAddrs, "vault-failover-addrs", []string{}, "Full URLs of standby vault servers, tried in order when vault-addr is unreachable")
+	viper.BindPFlag("vault-failover-addrs", rootCmd.PersistentFlags().Lookup("vault-failover-addrs"))
+
+	rootCmd.PersistentFlags().StringVar(&vaultCACert, "vault-ca-cert", "", "Path to a PEM bundle with the CAs the vault server certificate is verified with, instead of the system ones")
+	viper.BindPFlag("vault-ca-cert", rootCmd.PersistentFlags().Lookup("vault-ca-cert"))
+
+	rootCmd.PersistentFlags().StringVar(&vaultCACertPEM, "vault-ca-cert-pem", "", "PEM bundle with the CAs the vault server certificate is verified with, in addition to the ones of vault-ca-cert")
+	viper.BindPFlag("vault-ca-cert-pem", rootCmd.PersistentFlags().Lookup("vault-ca-cert-pem"))
+
+	rootCmd.PersistentFlags().BoolVar(&vaultTLSSkipVerify, "vault-tls-skip-verify", false, "Don't verify the vault server certificate. Only for local testing, requires a build with the vault_insecure_tls tag")
+	viper.BindPFlag("vault-tls-skip-verify", rootCmd.PersistentFlags().Lookup("vault-tls-skip-verify"))
+
 	viper.SetEnvPrefix("ACPM")
 	viper.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
 	viper.AutomaticEnv()
@@ -2,19 +2,43 @@ package app
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"math"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/template"
+	"time"
 
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/audit"
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/directory"
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/logging"
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/mail"
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/metrics"
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/notify"
 	"github.com/3scale/aws-cvpn-pki-manager/pkg/operations"
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/tracing"
 	"github.com/3scale/aws-cvpn-pki-manager/pkg/vault"
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
 	"github.com/google/go-github/github"
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
@@ -22,16 +46,33 @@ import (
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"golang.org/x/oauth2"
+	"google.golang.org/grpc"
 )
 
 // serverOptions is the options for the command
 type serverOptions struct {
 	port                        string
+	grpcPort                    string
+	tlsCertFile                 string
+	tlsKeyFile                  string
+	tlsClientCAFile             string
+	insecure                    bool
 	clientVPNEndpointID         string
 	vaultPKIPaths               []string
 	vaultClientCrtRole          string
 	vaultKVPath                 string
+	vaultBundleKVPath           string
 	CfgTplPath                  string
+	cfgTemplate                 string
+	cfgSource                   string
+	endpointConfigCacheTTL      time.Duration
+	usersCacheTTL               time.Duration
+	certificateIndex            bool
+	configStoreS3Bucket         string
+	configStoreS3Prefix         string
+	configStoreKMSKeyID         string
+	configURLExpiry             time.Duration
+	privateKeyKMSKeyID          string
 	vaultAuthToken              string
 	vaultAuthApproleRoleID      string
 	vaultAuthApproleSecretID    string
@@ -39,10 +80,179 @@ type serverOptions struct {
 	AuthGithubOrg               string
 	AuthGithubUsers             []string
 	AuthGithubTeams             []string
+	authTokens                  []string
+	authTokensFile              string
+	authExemptPaths             []string
+	corsAllowedOrigins          []string
+	corsAllowedMethods          []string
+	corsAllowedHeaders          []string
+	corsAllowCredentials        bool
+	crlRotationSchedule         string
+	crlRotationWindow           time.Duration
+	reconcileInterval           time.Duration
+	reconcileSchedule           string
+	reconcileJitter             time.Duration
+	reconcileOnDrift            bool
+	crlSizeWarnThreshold        int
+	crlSizeWarnPercent          float64
+	crlMaxSize                  int
+	vaultCRLPath                string
+	vaultPKIIssuer              string
+	crlMaxShrink                float64
+	verifyEndpointCA            bool
+	verifyCRLSignature          bool
+	expiryWarningWindow         time.Duration
+	autoRenew                   bool
+	autoRenewBefore             time.Duration
+	revocationGracePeriod       time.Duration
+	mailProvider                string
+	mailFrom                    string
+	smtpHost                    string
+	smtpPort                    int
+	smtpUsername                string
+	smtpPassword                string
+	smtpSecurity                string
+	directoryProvider           string
+	directoryTimeout            time.Duration
+	directoryBypassUsers        []string
+	directoryLDAPURL            string
+	directoryLDAPStartTLS       bool
+	directoryLDAPBindDN         string
+	directoryLDAPBindPassword   string
+	directoryLDAPBaseDN         string
+	directoryLDAPFilter         string
+	directoryLDAPActiveAttr     string
+	directoryLDAPActiveValues   []string
+	directoryLDAPGroup          string
+	directoryHTTPURL            string
+	directoryHTTPToken          string
+	crlBackupFile               string
+	crlBackupFailOnError        bool
+	snsTopicARN                 string
+	snsFailOnError              bool
+	slackWebhookURL             string
+	slackEvents                 []string
+	slackInterval               time.Duration
+	webhookURLs                 []string
+	webhookSecrets              []string
+	webhookTimeout              time.Duration
+	webhookRetries              int
+	crlLockVault                bool
+	crlHistory                  bool
+	crlHistoryVersions          int
+	adoptedCertificates         bool
+	denyList                    bool
+	denyListOnRevoke            bool
+	crlContinueOnError          bool
+	skipCapabilitiesCheck       bool
+	auditLog                    string
+	auditCloudWatchLogGroup     string
+	auditCloudWatchLogStream    string
+	auditVault                  bool
+	idempotencyWindow           time.Duration
+	maxCertsPerUser             int
+	maxCertsRevokeOldest        bool
+	discardPrivateKeys          bool
+	validateBundles             bool
+	issueBatchConcurrency       int
+	readinessCacheTTL           time.Duration
+	readinessCheckTimeout       time.Duration
+	shutdownDelay               time.Duration
+	shutdownDrainPeriod         time.Duration
+	docsAssetsURL               string
+	awsUserAgent                string
+	awsEndpointURL              string
+	awsRegion                   string
+	awsMaxRetries               int
+	retryMaxAttempts            int
+	retryInitialBackoff         time.Duration
+	retryMaxBackoff             time.Duration
+	retryDeadline               time.Duration
+	vaultTimeout                time.Duration
+	awsTimeout                  time.Duration
+	operationTimeout            time.Duration
+	vaultCircuitThreshold       int
+	vaultCircuitCoolDown        time.Duration
+	vaultRateLimit              float64
+	vaultRateLimitBurst         int
+	usernameRegexp              string
+	usernameTrimPrefix          string
+	usernameTrimSuffix          string
+	usernameNormalize           bool
+	usernamePattern             string
+	logFormat                   string
+	maxDeprovisions             int
+	rateLimitPerCaller          int
+	rateLimitPerCallerPeriod    time.Duration
+	rateLimitPerUser            int
+	rateLimitPerUserPeriod      time.Duration
+	csrAllowedDNSDomains        []string
+	csrAllowedEmailDomains      []string
+	csrMinRSAKeySize            int
+	csrMinECKeySize             int
+	logLevel                    string
+	traceSpans                  bool
 }
 
 var serverOpts serverOptions
 
+// cfgTemplate is the OpenVPN config template, parsed at startup
+var cfgTemplate *template.Template
+
+// mailer is used to email the VPN configs on issuance, if configured
+var mailer mail.Mailer
+
+// userDirectory is checked for the users to exist in the
+// identity provider before issuing them certificates, if configured
+var userDirectory directory.Checker
+
+// notifier sends notifications of the issuance and revocation events, if configured
+var notifier notify.Notifier
+
+// authTokens are the static bearer tokens accepted by the API, if configured
+var authTokens []authToken
+
+// cors is the CORS policy of the API, nil if CORS is disabled
+var cors *corsPolicy
+
+// issueIdempotency holds the results of the issuances made with an idempotency key
+var issueIdempotency = &operations.IdempotencyCache{}
+
+// endpointConfigCache holds the config exported from the Client VPN
+// endpoint, nil if disabled
+var endpointConfigCache = &operations.ClientConfigCache{}
+
+// usersCache holds the users listed by GET /users, nil if disabled
+var usersCache *operations.UsersCache
+
+// certificateIndex holds the certificates read from Vault, nil if disabled
+var certificateIndex *operations.CertificateIndex
+
+// configStore keeps the VPN configs in S3, nil if disabled
+var configStore *operations.ConfigStore
+
+// envelope encrypts the private keys stored in Vault, nil if disabled
+var envelope *operations.KMSEnvelope
+
+// rateLimiter limits how often the mutating operations run per caller and per user
+var rateLimiter = &operations.RateLimiter{}
+
+// shuttingDown is set to 1 once the server starts shutting down
+var shuttingDown int32
+
+// scheduledJobs tracks the runs of the cron task, so the shutdown waits for them
+var scheduledJobs sync.WaitGroup
+
+// shutdownCancelWait is how long the shutdown waits for the operations
+// to stop once they are cancelled at the end of the drain period
+var shutdownCancelWait = 5 * time.Second
+
+// auditor records the mutating operations, if enabled
+var auditor *audit.Logger
+
+// crlBackup receives a copy of each CRL replaced in the endpoint, if configured
+var crlBackup io.Writer
+
 // serverCmd runs a server that exposes an API to manage the PKI
 var serverCmd = &cobra.Command{
 	Use:     "server",
@@ -60,37 +270,477 @@ func init() {
 	viper.BindPFlag("port", serverCmd.Flags().Lookup("port"))
 	viper.SetDefault("port", "8080")
 
-	serverCmd.Flags().StringVar(&serverOpts.clientVPNEndpointID, "client-vpn-endpoint-id", "", "The AWS Client VPN endpoint ID")
-	viper.BindPFlag("client-vpn-endpoint-id", serverCmd.Flags().Lookup("client-vpn-endpoint-id"))
+	serverCmd.Flags().StringVar(&serverOpts.grpcPort, "grpc-port", "", "Port to serve the gRPC API at. Not served if empty")
+	viper.BindPFlag("grpc-port", serverCmd.Flags().Lookup("grpc-port"))
+
+	serverCmd.Flags().StringVar(&serverOpts.tlsCertFile, "tls-cert-file", "", "The certificate the server is served with. Reloaded when the file changes")
+	viper.BindPFlag("tls-cert-file", serverCmd.Flags().Lookup("tls-cert-file"))
+
+	serverCmd.Flags().StringVar(&serverOpts.tlsKeyFile, "tls-key-file", "", "The private key of the server certificate. Reloaded when the file changes")
+	viper.BindPFlag("tls-key-file", serverCmd.Flags().Lookup("tls-key-file"))
 
-	serverCmd.Flags().StringSliceVar(&serverOpts.vaultPKIPaths, "vault-pki-paths", []string{}, "The paths where the root CA and any intermediate CAs live in Vault. Must be sorted, the rootCA PKI path has to be the first one")
-	viper.BindPFlag("vault-pki-paths", serverCmd.Flags().Lookup("vault-pki-paths"))
+	serverCmd.Flags().StringVar(&serverOpts.tlsClientCAFile, "tls-client-ca-file", "", "CA bundle used to verify the client certificates. Clients are required to present one if set")
+	viper.BindPFlag("tls-client-ca-file", serverCmd.Flags().Lookup("tls-client-ca-file"))
+
+	serverCmd.Flags().BoolVar(&serverOpts.insecure, "insecure", false, "Serve plain HTTP instead of TLS. Only meant for local development")
+	viper.BindPFlag("insecure", serverCmd.Flags().Lookup("insecure"))
+
+	rootCmd.PersistentFlags().StringVar(&serverOpts.clientVPNEndpointID, "client-vpn-endpoint-id", "", "The AWS Client VPN endpoint ID")
+	viper.BindPFlag("client-vpn-endpoint-id", rootCmd.PersistentFlags().Lookup("client-vpn-endpoint-id"))
+
+	rootCmd.PersistentFlags().StringSliceVar(&serverOpts.vaultPKIPaths, "vault-pki-paths", []string{}, "The paths where the root CA and any intermediate CAs live in Vault. Must be sorted, the rootCA PKI path has to be the first one")
+	viper.BindPFlag("vault-pki-paths", rootCmd.PersistentFlags().Lookup("vault-pki-paths"))
 	viper.SetDefault("vault-pki-paths", []string{"root-pki", "cvpn-pki"})
 
-	serverCmd.Flags().StringVar(&serverOpts.vaultClientCrtRole, "vault-client-certificate-role", "", "The Vault role used to issue VPN client certificates")
-	viper.BindPFlag("vault-client-certificate-role", serverCmd.Flags().Lookup("vault-client-certificate-role"))
+	rootCmd.PersistentFlags().StringVar(&serverOpts.vaultClientCrtRole, "vault-client-certificate-role", "", "The Vault role used to issue VPN client certificates")
+	viper.BindPFlag("vault-client-certificate-role", rootCmd.PersistentFlags().Lookup("vault-client-certificate-role"))
 	viper.SetDefault("vault-client-certificate-role", "client")
 
-	serverCmd.Flags().StringVar(&serverOpts.vaultKVPath, "vault-kv-path", "", "The Vault path for the kv (v2) storage engine where VPN configs will be stored")
-	viper.BindPFlag("vault-kv-path", serverCmd.Flags().Lookup("vault-kv-path"))
+	rootCmd.PersistentFlags().StringVar(&serverOpts.vaultKVPath, "vault-kv-path", "", "The Vault path for the kv (v2) storage engine where VPN configs will be stored")
+	viper.BindPFlag("vault-kv-path", rootCmd.PersistentFlags().Lookup("vault-kv-path"))
 	viper.SetDefault("vault-kv-path", "secret")
 
-	serverCmd.Flags().StringVar(&serverOpts.CfgTplPath, "config-template-path", "", "The OpenVPN config template")
+	serverCmd.Flags().StringVar(&serverOpts.vaultBundleKVPath, "vault-bundle-kv-path", "", "The Vault path for the kv (v2) storage engine where the issued certificates and their private keys will be stored. Not stored if empty")
+	viper.BindPFlag("vault-bundle-kv-path", serverCmd.Flags().Lookup("vault-bundle-kv-path"))
+
+	serverCmd.Flags().StringVar(&serverOpts.CfgTplPath, "config-template-path", "", "The OpenVPN config template. The built-in template is used if unset")
 	viper.BindPFlag("config-template-path", serverCmd.Flags().Lookup("config-template-path"))
-	viper.SetDefault("config-template-path", "./config.ovpn.tpl")
+
+	serverCmd.Flags().StringVar(&serverOpts.cfgTemplate, "config-template", "", "The OpenVPN config template text. Takes precedence over --config-template-path")
+	viper.BindPFlag("config-template", serverCmd.Flags().Lookup("config-template"))
+
+	serverCmd.Flags().StringVar(&serverOpts.cfgSource, "config-source", "", "How to generate the OpenVPN configs. One of: template/endpoint")
+	viper.BindPFlag("config-source", serverCmd.Flags().Lookup("config-source"))
+	viper.SetDefault("config-source", "template")
+
+	serverCmd.Flags().DurationVar(&serverOpts.endpointConfigCacheTTL, "endpoint-config-cache-ttl", operations.DefaultClientConfigCacheTTL, "How long the config exported from the Client VPN endpoint is reused with --config-source endpoint. 0 disables the cache.")
+	viper.BindPFlag("endpoint-config-cache-ttl", serverCmd.Flags().Lookup("endpoint-config-cache-ttl"))
+	viper.SetDefault("endpoint-config-cache-ttl", operations.DefaultClientConfigCacheTTL)
+
+	serverCmd.Flags().DurationVar(&serverOpts.usersCacheTTL, "users-cache-ttl", 0, "How long the users listed by GET /users are reused. Any issuance, revocation or CRL update invalidates them. 0 disables the cache.")
+	viper.BindPFlag("users-cache-ttl", serverCmd.Flags().Lookup("users-cache-ttl"))
+	viper.SetDefault("users-cache-ttl", 0)
+
+	serverCmd.Flags().BoolVar(&serverOpts.certificateIndex, "certificate-index", false, "Keep an in-memory index of the certificates read from Vault, so listing the users only reads the ones issued since. GET /users then leaves out the expired certificates unless include-expired=true")
+	viper.BindPFlag("certificate-index", serverCmd.Flags().Lookup("certificate-index"))
+	viper.SetDefault("certificate-index", false)
+
+	serverCmd.Flags().StringVar(&serverOpts.configStoreS3Bucket, "config-store-s3-bucket", "", "S3 bucket where the VPN config of each issued certificate is stored, so GET /users/{user}/config/url can return a link to download it. Disabled if empty")
+	viper.BindPFlag("config-store-s3-bucket", serverCmd.Flags().Lookup("config-store-s3-bucket"))
+
+	serverCmd.Flags().StringVar(&serverOpts.configStoreS3Prefix, "config-store-s3-prefix", "", "Prefix of the keys of the VPN configs stored in config-store-s3-bucket, e.g. 'vpn/'")
+	viper.BindPFlag("config-store-s3-prefix", serverCmd.Flags().Lookup("config-store-s3-prefix"))
+
+	serverCmd.Flags().StringVar(&serverOpts.configStoreKMSKeyID, "config-store-kms-key-id", "", "KMS key the VPN configs stored in config-store-s3-bucket are encrypted with (SSE-KMS). Defaults to the default encryption of the bucket")
+	viper.BindPFlag("config-store-kms-key-id", serverCmd.Flags().Lookup("config-store-kms-key-id"))
+
+	serverCmd.Flags().DurationVar(&serverOpts.configURLExpiry, "config-url-expiry", operations.DefaultConfigURLExpiry, "Default validity of the links returned by GET /users/{user}/config/url")
+	viper.BindPFlag("config-url-expiry", serverCmd.Flags().Lookup("config-url-expiry"))
+	viper.SetDefault("config-url-expiry", operations.DefaultConfigURLExpiry)
+
+	serverCmd.Flags().StringVar(&serverOpts.privateKeyKMSKeyID, "private-key-kms-key-id", "", "KMS key the private keys, and the VPN configs embedding them, are encrypted with before being stored in Vault. Also the default of config-store-kms-key-id. Disabled if empty")
+	viper.BindPFlag("private-key-kms-key-id", serverCmd.Flags().Lookup("private-key-kms-key-id"))
+
+	serverCmd.Flags().StringVar(&serverOpts.crlRotationSchedule, "crl-rotation-schedule", "", "The cron spec used to schedule the CRL rotation")
+	viper.BindPFlag("crl-rotation-schedule", serverCmd.Flags().Lookup("crl-rotation-schedule"))
+	viper.SetDefault("crl-rotation-schedule", "@hourly")
+
+	serverCmd.Flags().DurationVar(&serverOpts.crlRotationWindow, "crl-rotation-window", 0, "Only rotate the CRL if its next update is due within this window. Always rotate if 0")
+	viper.BindPFlag("crl-rotation-window", serverCmd.Flags().Lookup("crl-rotation-window"))
+	viper.SetDefault("crl-rotation-window", 0)
+
+	serverCmd.Flags().DurationVar(&serverOpts.reconcileInterval, "reconcile-interval", 0, "Interval at which the CRL of the endpoint is updated. Disabled if 0")
+	viper.BindPFlag("reconcile-interval", serverCmd.Flags().Lookup("reconcile-interval"))
+	viper.SetDefault("reconcile-interval", 0)
+
+	serverCmd.Flags().StringVar(&serverOpts.reconcileSchedule, "reconcile-schedule", "", "The cron spec used to schedule the updates of the CRL of the endpoint, instead of reconcile-interval")
+	viper.BindPFlag("reconcile-schedule", serverCmd.Flags().Lookup("reconcile-schedule"))
+
+	serverCmd.Flags().DurationVar(&serverOpts.reconcileJitter, "reconcile-jitter", 0, "Maximum random delay added to each scheduled update of the CRL, so the replicas don't run them at once")
+	viper.BindPFlag("reconcile-jitter", serverCmd.Flags().Lookup("reconcile-jitter"))
+	viper.SetDefault("reconcile-jitter", 30*time.Second)
+
+	serverCmd.Flags().BoolVar(&serverOpts.reconcileOnDrift, "reconcile-on-drift", false, "Only update the CRL on the scheduled runs if the endpoint is out of sync with Vault")
+	viper.BindPFlag("reconcile-on-drift", serverCmd.Flags().Lookup("reconcile-on-drift"))
+	viper.SetDefault("reconcile-on-drift", false)
+
+	serverCmd.Flags().IntVar(&serverOpts.crlSizeWarnThreshold, "crl-size-warn-threshold", 0, "CRL size in bytes above which a warning is logged. Disabled if 0")
+	viper.BindPFlag("crl-size-warn-threshold", serverCmd.Flags().Lookup("crl-size-warn-threshold"))
+	viper.SetDefault("crl-size-warn-threshold", 0)
+
+	serverCmd.Flags().Float64Var(&serverOpts.crlSizeWarnPercent, "crl-size-warn-percent", 80, "Percentage of crl-max-size above which a warning is logged. Disabled if 0")
+	viper.BindPFlag("crl-size-warn-percent", serverCmd.Flags().Lookup("crl-size-warn-percent"))
+	viper.SetDefault("crl-size-warn-percent", 80)
+
+	serverCmd.Flags().IntVar(&serverOpts.crlMaxSize, "crl-max-size", 0, "Maximum CRL size in bytes that will be imported into the Client VPN endpoint")
+	viper.BindPFlag("crl-max-size", serverCmd.Flags().Lookup("crl-max-size"))
+	viper.SetDefault("crl-max-size", operations.DefaultCRLMaxSize)
+
+	serverCmd.Flags().Float64Var(&serverOpts.crlMaxShrink, "crl-max-shrink", 0.5, "Maximum fraction, greater than 0 and at most 1, of the entries of the CRL active in the Client VPN endpoint the new CRL can drop before refusing to import it. 1 disables the check")
+	viper.BindPFlag("crl-max-shrink", serverCmd.Flags().Lookup("crl-max-shrink"))
+	viper.SetDefault("crl-max-shrink", 0.5)
+
+	serverCmd.Flags().StringVar(&serverOpts.vaultCRLPath, "vault-crl-path", "", "Path, under the last of vault-pki-paths, of the PEM encoded CRL, e.g. unified-crl/pem")
+	viper.BindPFlag("vault-crl-path", serverCmd.Flags().Lookup("vault-crl-path"))
+	viper.SetDefault("vault-crl-path", "")
+
+	rootCmd.PersistentFlags().StringVar(&serverOpts.vaultPKIIssuer, "vault-pki-issuer", "", "Issuer, of the last of vault-pki-paths, trusted by the Client VPN endpoint. Defaults to the default issuer of the mount")
+	viper.BindPFlag("vault-pki-issuer", rootCmd.PersistentFlags().Lookup("vault-pki-issuer"))
+	viper.SetDefault("vault-pki-issuer", "")
+
+	serverCmd.Flags().BoolVar(&serverOpts.verifyEndpointCA, "verify-endpoint-ca", false, "Check that the Client VPN endpoint server certificate was issued by the Vault PKI before updating the CRL")
+	viper.BindPFlag("verify-endpoint-ca", serverCmd.Flags().Lookup("verify-endpoint-ca"))
+	viper.SetDefault("verify-endpoint-ca", false)
+
+	serverCmd.Flags().BoolVar(&serverOpts.verifyCRLSignature, "verify-crl-signature", false, "Check the signature of the CRL against the CA of the Vault PKI before importing it in the Client VPN endpoint")
+	viper.BindPFlag("verify-crl-signature", serverCmd.Flags().Lookup("verify-crl-signature"))
+	viper.SetDefault("verify-crl-signature", false)
+
+	serverCmd.Flags().DurationVar(&serverOpts.expiryWarningWindow, "expiry-warning-window", 0, "Certificates expiring within this window are reported as about to expire")
+	viper.BindPFlag("expiry-warning-window", serverCmd.Flags().Lookup("expiry-warning-window"))
+	viper.SetDefault("expiry-warning-window", operations.DefaultExpiryWindow)
+
+	serverCmd.Flags().BoolVar(&serverOpts.autoRenew, "auto-renew", false, "Automatically renew the certificates of users flagged with auto_renew in their metadata")
+	viper.BindPFlag("auto-renew", serverCmd.Flags().Lookup("auto-renew"))
+	viper.SetDefault("auto-renew", false)
+
+	serverCmd.Flags().DurationVar(&serverOpts.autoRenewBefore, "auto-renew-before", 0, "How long before expiry certificates are automatically renewed")
+	viper.BindPFlag("auto-renew-before", serverCmd.Flags().Lookup("auto-renew-before"))
+	viper.SetDefault("auto-renew-before", operations.DefaultRenewBefore)
+
+	serverCmd.Flags().DurationVar(&serverOpts.revocationGracePeriod, "revocation-grace-period", 0, "How long superseded certificates remain valid after a new one is issued for the user")
+	viper.BindPFlag("revocation-grace-period", serverCmd.Flags().Lookup("revocation-grace-period"))
+	viper.SetDefault("revocation-grace-period", 0)
+
+	serverCmd.Flags().StringVar(&serverOpts.crlBackupFile, "crl-backup-file", "", "Append a timestamped copy of the endpoint's CRL to this file before replacing it")
+	viper.BindPFlag("crl-backup-file", serverCmd.Flags().Lookup("crl-backup-file"))
+
+	serverCmd.Flags().BoolVar(&serverOpts.crlBackupFailOnError, "crl-backup-fail-on-error", false, "Do not import a new CRL if the backup of the current one fails")
+	viper.BindPFlag("crl-backup-fail-on-error", serverCmd.Flags().Lookup("crl-backup-fail-on-error"))
+	viper.SetDefault("crl-backup-fail-on-error", false)
+
+	serverCmd.Flags().StringVar(&serverOpts.snsTopicARN, "sns-topic-arn", "", "SNS topic a message is published to after each successful update of the CRL")
+	viper.BindPFlag("sns-topic-arn", serverCmd.Flags().Lookup("sns-topic-arn"))
+
+	serverCmd.Flags().BoolVar(&serverOpts.snsFailOnError, "sns-fail-on-error", false, "Fail the CRL update if the message can't be published to sns-topic-arn, instead of just logging the error")
+	viper.BindPFlag("sns-fail-on-error", serverCmd.Flags().Lookup("sns-fail-on-error"))
+	viper.SetDefault("sns-fail-on-error", false)
+
+	serverCmd.Flags().BoolVar(&serverOpts.crlLockVault, "crl-lock-vault", false, "Lock the CRL updates with a key in the Vault kv store, so instances sharing the endpoint don't run them concurrently")
+	viper.BindPFlag("crl-lock-vault", serverCmd.Flags().Lookup("crl-lock-vault"))
+	viper.SetDefault("crl-lock-vault", false)
+
+	serverCmd.Flags().BoolVar(&serverOpts.crlHistory, "crl-history", false, "Keep a copy of each CRL imported in the endpoint in the Vault kv store")
+	viper.BindPFlag("crl-history", serverCmd.Flags().Lookup("crl-history"))
+	viper.SetDefault("crl-history", false)
+
+	serverCmd.Flags().IntVar(&serverOpts.crlHistoryVersions, "crl-history-versions", operations.DefaultCRLHistoryVersions, "The number of CRLs kept in the history")
+	viper.BindPFlag("crl-history-versions", serverCmd.Flags().Lookup("crl-history-versions"))
+	viper.SetDefault("crl-history-versions", operations.DefaultCRLHistoryVersions)
+
+	serverCmd.Flags().BoolVar(&serverOpts.crlContinueOnError, "crl-continue-on-revocation-error", false, "Go on with the rest of the users when the certificates of one can't be revoked during a CRL update, and still import the CRL")
+	viper.BindPFlag("crl-continue-on-revocation-error", serverCmd.Flags().Lookup("crl-continue-on-revocation-error"))
+	viper.SetDefault("crl-continue-on-revocation-error", false)
+	serverCmd.Flags().BoolVar(&serverOpts.skipCapabilitiesCheck, "skip-capabilities-check", false, "Don't check the capabilities of the Vault token with sys/capabilities-self before revoking certificates or rotating the CRL")
+	viper.BindPFlag("skip-capabilities-check", serverCmd.Flags().Lookup("skip-capabilities-check"))
+	viper.SetDefault("skip-capabilities-check", false)
+
+	serverCmd.Flags().BoolVar(&serverOpts.denyList, "deny-list", false, "Refuse to issue certificates for the users in the deny-list, stored in the Vault kv store and managed with /deny-list")
+	viper.BindPFlag("deny-list", serverCmd.Flags().Lookup("deny-list"))
+	viper.SetDefault("deny-list", false)
+
+	serverCmd.Flags().BoolVar(&serverOpts.denyListOnRevoke, "deny-list-on-revoke", false, "Add the users revoked with POST /revoke/{user} or deprovisioned to the deny-list. Requires --deny-list")
+	viper.BindPFlag("deny-list-on-revoke", serverCmd.Flags().Lookup("deny-list-on-revoke"))
+	viper.SetDefault("deny-list-on-revoke", false)
+
+	serverCmd.Flags().BoolVar(&serverOpts.adoptedCertificates, "adopted-certificates", false, "Track the certificates adopted with POST /adopt under their users, using the Vault kv store")
+	viper.BindPFlag("adopted-certificates", serverCmd.Flags().Lookup("adopted-certificates"))
+	viper.SetDefault("adopted-certificates", false)
+
+	serverCmd.Flags().DurationVar(&serverOpts.idempotencyWindow, "idempotency-window", 0, "How long an issuance made with an Idempotency-Key is returned, instead of issuing again, for requests with the same key and user")
+	viper.BindPFlag("idempotency-window", serverCmd.Flags().Lookup("idempotency-window"))
+	viper.SetDefault("idempotency-window", operations.DefaultIdempotencyWindow)
+
+	serverCmd.Flags().IntVar(&serverOpts.maxCertsPerUser, "max-certs-per-user", 0, "Maximum number of active certificates a user can have. Unlimited if 0")
+	viper.BindPFlag("max-certs-per-user", serverCmd.Flags().Lookup("max-certs-per-user"))
+	viper.SetDefault("max-certs-per-user", 0)
+
+	serverCmd.Flags().BoolVar(&serverOpts.maxCertsRevokeOldest, "max-certs-revoke-oldest", false, "Revoke the oldest certificates of the user, instead of refusing to issue, when max-certs-per-user is reached")
+	viper.BindPFlag("max-certs-revoke-oldest", serverCmd.Flags().Lookup("max-certs-revoke-oldest"))
+	viper.SetDefault("max-certs-revoke-oldest", false)
+
+	serverCmd.Flags().BoolVar(&serverOpts.discardPrivateKeys, "discard-private-keys", false, "Never store the private keys of the issued certificates, only return them on issuance")
+	viper.BindPFlag("discard-private-keys", serverCmd.Flags().Lookup("discard-private-keys"))
+	viper.SetDefault("discard-private-keys", false)
+
+	serverCmd.Flags().BoolVar(&serverOpts.validateBundles, "validate-bundles", false, "Validate each issued certificate, with its private key, CA chain and CRL status, before returning it, revoking it if invalid")
+	viper.BindPFlag("validate-bundles", serverCmd.Flags().Lookup("validate-bundles"))
+	viper.SetDefault("validate-bundles", false)
+
+	serverCmd.Flags().IntVar(&serverOpts.issueBatchConcurrency, "issue-batch-concurrency", 0, "Number of certificates issued at the same time by POST /issue-batch")
+	viper.BindPFlag("issue-batch-concurrency", serverCmd.Flags().Lookup("issue-batch-concurrency"))
+	viper.SetDefault("issue-batch-concurrency", operations.DefaultIssueConcurrency)
+
+	// Rate limiting related options
+	serverCmd.Flags().IntVar(&serverOpts.rateLimitPerCaller, "rate-limit-per-caller", 0, "Maximum number of mutating requests per rate-limit-per-caller-period of each caller. Disabled if 0")
+	viper.BindPFlag("rate-limit-per-caller", serverCmd.Flags().Lookup("rate-limit-per-caller"))
+
+	serverCmd.Flags().DurationVar(&serverOpts.rateLimitPerCallerPeriod, "rate-limit-per-caller-period", 0, "The period of rate-limit-per-caller")
+	viper.BindPFlag("rate-limit-per-caller-period", serverCmd.Flags().Lookup("rate-limit-per-caller-period"))
+	viper.SetDefault("rate-limit-per-caller-period", time.Hour)
+
+	serverCmd.Flags().IntVar(&serverOpts.rateLimitPerUser, "rate-limit-per-user", 0, "Maximum number of issuances and revocations per rate-limit-per-user-period of each user. Disabled if 0")
+	viper.BindPFlag("rate-limit-per-user", serverCmd.Flags().Lookup("rate-limit-per-user"))
+
+	serverCmd.Flags().DurationVar(&serverOpts.rateLimitPerUserPeriod, "rate-limit-per-user-period", 0, "The period of rate-limit-per-user")
+	viper.BindPFlag("rate-limit-per-user-period", serverCmd.Flags().Lookup("rate-limit-per-user-period"))
+	viper.SetDefault("rate-limit-per-user-period", time.Hour)
+
+	// CSR signing related options
+	serverCmd.Flags().StringSliceVar(&serverOpts.csrAllowedDNSDomains, "csr-allowed-dns-domains", []string{}, "Domains, and their subdomains, allowed in the DNS SANs of the CSRs signed in /sign/{user}")
+	viper.BindPFlag("csr-allowed-dns-domains", serverCmd.Flags().Lookup("csr-allowed-dns-domains"))
+
+	serverCmd.Flags().StringSliceVar(&serverOpts.csrAllowedEmailDomains, "csr-allowed-email-domains", []string{}, "Domains allowed in the email SANs of the CSRs signed in /sign/{user}")
+	viper.BindPFlag("csr-allowed-email-domains", serverCmd.Flags().Lookup("csr-allowed-email-domains"))
+
+	serverCmd.Flags().IntVar(&serverOpts.csrMinRSAKeySize, "csr-min-rsa-key-size", 0, "Minimum size, in bits, of the RSA keys of the CSRs signed in /sign/{user}")
+	viper.BindPFlag("csr-min-rsa-key-size", serverCmd.Flags().Lookup("csr-min-rsa-key-size"))
+	viper.SetDefault("csr-min-rsa-key-size", operations.DefaultMinRSAKeySize)
+
+	serverCmd.Flags().IntVar(&serverOpts.csrMinECKeySize, "csr-min-ec-key-size", 0, "Minimum size, in bits, of the ECDSA keys of the CSRs signed in /sign/{user}")
+	viper.BindPFlag("csr-min-ec-key-size", serverCmd.Flags().Lookup("csr-min-ec-key-size"))
+	viper.SetDefault("csr-min-ec-key-size", operations.DefaultMinECKeySize)
+
+	serverCmd.Flags().DurationVar(&serverOpts.readinessCacheTTL, "readiness-cache-ttl", 0, "How long the result of the readiness checks in /readyz is cached")
+	viper.BindPFlag("readiness-cache-ttl", serverCmd.Flags().Lookup("readiness-cache-ttl"))
+	viper.SetDefault("readiness-cache-ttl", 10*time.Second)
+
+	serverCmd.Flags().DurationVar(&serverOpts.readinessCheckTimeout, "readiness-check-timeout", 0, "Timeout of each of the readiness checks in /readyz")
+	viper.BindPFlag("readiness-check-timeout", serverCmd.Flags().Lookup("readiness-check-timeout"))
+	viper.SetDefault("readiness-check-timeout", operations.DefaultHealthCheckTimeout)
+
+	serverCmd.Flags().DurationVar(&serverOpts.shutdownDelay, "shutdown-delay", 0, "Time during which /readyz fails before the server stops accepting requests on shutdown")
+	viper.BindPFlag("shutdown-delay", serverCmd.Flags().Lookup("shutdown-delay"))
+	viper.SetDefault("shutdown-delay", 5*time.Second)
+
+	serverCmd.Flags().DurationVar(&serverOpts.shutdownDrainPeriod, "shutdown-drain-period", 0, "Maximum time the in-flight requests and scheduled jobs are waited for on shutdown")
+	viper.BindPFlag("shutdown-drain-period", serverCmd.Flags().Lookup("shutdown-drain-period"))
+	viper.SetDefault("shutdown-drain-period", 20*time.Second)
+
+	serverCmd.Flags().StringVar(&serverOpts.awsUserAgent, "aws-user-agent", "", "Added to the User-Agent of the AWS API calls, so they can be attributed in CloudTrail")
+	viper.BindPFlag("aws-user-agent", serverCmd.Flags().Lookup("aws-user-agent"))
+	viper.SetDefault("aws-user-agent", operations.DefaultAWSUserAgent)
+
+	serverCmd.Flags().StringVar(&serverOpts.awsEndpointURL, "aws-endpoint-url", "", "URL the AWS API calls are sent to instead of AWS, e.g. LocalStack's")
+	viper.BindPFlag("aws-endpoint-url", serverCmd.Flags().Lookup("aws-endpoint-url"))
+
+	serverCmd.Flags().StringVar(&serverOpts.awsRegion, "aws-region", "", "Region of the Client VPN endpoint. Defaults to the one of the environment, e.g. AWS_REGION")
+	viper.BindPFlag("aws-region", serverCmd.Flags().Lookup("aws-region"))
+
+	serverCmd.Flags().IntVar(&serverOpts.awsMaxRetries, "aws-max-retries", -1, "Number of times the AWS SDK retries the Client VPN API calls, on top of retry-max-attempts. Defaults to the one of the SDK if negative")
+	viper.BindPFlag("aws-max-retries", serverCmd.Flags().Lookup("aws-max-retries"))
+	viper.SetDefault("aws-max-retries", -1)
+
+	serverCmd.Flags().IntVar(&serverOpts.retryMaxAttempts, "retry-max-attempts", operations.DefaultRetryMaxAttempts, "Number of times the Vault and AWS calls are tried when they fail with a transient error. 1 to fail fast")
+	viper.BindPFlag("retry-max-attempts", serverCmd.Flags().Lookup("retry-max-attempts"))
+	viper.SetDefault("retry-max-attempts", operations.DefaultRetryMaxAttempts)
+
+	serverCmd.Flags().DurationVar(&serverOpts.retryInitialBackoff, "retry-initial-backoff", operations.DefaultRetryInitialBackoff, "Wait before the first retry of a Vault or AWS call, doubled on each retry")
+	viper.BindPFlag("retry-initial-backoff", serverCmd.Flags().Lookup("retry-initial-backoff"))
+	viper.SetDefault("retry-initial-backoff", operations.DefaultRetryInitialBackoff)
+
+	serverCmd.Flags().DurationVar(&serverOpts.retryMaxBackoff, "retry-max-backoff", operations.DefaultRetryMaxBackoff, "Longest wait between two attempts of a Vault or AWS call")
+	viper.BindPFlag("retry-max-backoff", serverCmd.Flags().Lookup("retry-max-backoff"))
+	viper.SetDefault("retry-max-backoff", operations.DefaultRetryMaxBackoff)
+
+	serverCmd.Flags().DurationVar(&serverOpts.retryDeadline, "retry-deadline", operations.DefaultRetryDeadline, "Longest time spent on a Vault or AWS call, retries included")
+	viper.BindPFlag("retry-deadline", serverCmd.Flags().Lookup("retry-deadline"))
+	viper.SetDefault("retry-deadline", operations.DefaultRetryDeadline)
+
+	serverCmd.Flags().DurationVar(&serverOpts.vaultTimeout, "vault-timeout", operations.DefaultVaultTimeout, "Timeout of each Vault call of the operations")
+	viper.BindPFlag("vault-timeout", serverCmd.Flags().Lookup("vault-timeout"))
+	viper.SetDefault("vault-timeout", operations.DefaultVaultTimeout)
+
+	serverCmd.Flags().DurationVar(&serverOpts.awsTimeout, "aws-timeout", operations.DefaultAWSTimeout, "Timeout of each AWS call of the operations")
+	viper.BindPFlag("aws-timeout", serverCmd.Flags().Lookup("aws-timeout"))
+	viper.SetDefault("aws-timeout", operations.DefaultAWSTimeout)
+
+	serverCmd.Flags().DurationVar(&serverOpts.operationTimeout, "operation-timeout", operations.DefaultOperationTimeout, "Timeout of each CRL update, CRL rotation, issuance or revocation as a whole")
+	viper.BindPFlag("operation-timeout", serverCmd.Flags().Lookup("operation-timeout"))
+	viper.SetDefault("operation-timeout", operations.DefaultOperationTimeout)
+
+	serverCmd.Flags().IntVar(&serverOpts.vaultCircuitThreshold, "vault-circuit-threshold", 0, "Consecutive failures of the Vault calls, due to Vault being unavailable, that open the circuit breaker so they fail fast. 0 disables it.")
+	viper.BindPFlag("vault-circuit-threshold", serverCmd.Flags().Lookup("vault-circuit-threshold"))
+	viper.SetDefault("vault-circuit-threshold", 0)
+
+	serverCmd.Flags().DurationVar(&serverOpts.vaultCircuitCoolDown, "vault-circuit-cool-down", operations.DefaultVaultCircuitCoolDown, "How long the circuit breaker of the Vault calls stays open before probing Vault again")
+	viper.BindPFlag("vault-circuit-cool-down", serverCmd.Flags().Lookup("vault-circuit-cool-down"))
+	viper.SetDefault("vault-circuit-cool-down", operations.DefaultVaultCircuitCoolDown)
+
+	serverCmd.Flags().Float64Var(&serverOpts.vaultRateLimit, "vault-rate-limit", 0, "Maximum number of Vault calls per second, shared by all the operations. 0 disables the limit.")
+	viper.BindPFlag("vault-rate-limit", serverCmd.Flags().Lookup("vault-rate-limit"))
+	viper.SetDefault("vault-rate-limit", 0)
+
+	serverCmd.Flags().IntVar(&serverOpts.vaultRateLimitBurst, "vault-rate-limit-burst", 0, "Number of Vault calls that can be made back to back before vault-rate-limit applies. Defaults to vault-rate-limit rounded up")
+	viper.BindPFlag("vault-rate-limit-burst", serverCmd.Flags().Lookup("vault-rate-limit-burst"))
+	viper.SetDefault("vault-rate-limit-burst", 0)
+
+	serverCmd.Flags().StringVar(&serverOpts.usernameRegexp, "username-regexp", "", "Regexp matched against the CN of the certificates to extract the username, from its first capture group or the one named 'username'")
+	viper.BindPFlag("username-regexp", serverCmd.Flags().Lookup("username-regexp"))
+
+	serverCmd.Flags().StringVar(&serverOpts.usernameTrimPrefix, "username-trim-prefix", "", "Prefix removed from the CN of the certificates to get the username")
+	viper.BindPFlag("username-trim-prefix", serverCmd.Flags().Lookup("username-trim-prefix"))
+
+	serverCmd.Flags().StringVar(&serverOpts.usernameTrimSuffix, "username-trim-suffix", "", "Suffix removed from the CN of the certificates to get the username")
+	viper.BindPFlag("username-trim-suffix", serverCmd.Flags().Lookup("username-trim-suffix"))
+
+	serverCmd.Flags().BoolVar(&serverOpts.usernameNormalize, "username-normalize", true, "Trim the spaces around the usernames and lowercase them, both when issuing certificates and when grouping the existing ones by user")
+	viper.BindPFlag("username-normalize", serverCmd.Flags().Lookup("username-normalize"))
+	viper.SetDefault("username-normalize", true)
+
+	serverCmd.Flags().StringVar(&serverOpts.usernamePattern, "username-pattern", "", "Regexp the usernames have to match, once normalized, to be issued certificates for")
+	viper.BindPFlag("username-pattern", serverCmd.Flags().Lookup("username-pattern"))
+
+	serverCmd.Flags().IntVar(&serverOpts.maxDeprovisions, "max-deprovisions", 0, "Maximum number of users POST /deprovision revokes at once, unless forced")
+	viper.BindPFlag("max-deprovisions", serverCmd.Flags().Lookup("max-deprovisions"))
+	viper.SetDefault("max-deprovisions", operations.DefaultMaxDeprovisions)
+
+	// Logging related options
+	serverCmd.Flags().StringVar(&serverOpts.logFormat, "log-format", "", "The format of the logs. One of: text/json")
+	viper.BindPFlag("log-format", serverCmd.Flags().Lookup("log-format"))
+	viper.SetDefault("log-format", "text")
+
+	serverCmd.Flags().StringVar(&serverOpts.logLevel, "log-level", "", "The minimum level of the logs. One of: debug/info/warn/error")
+	viper.BindPFlag("log-level", serverCmd.Flags().Lookup("log-level"))
+	viper.SetDefault("log-level", "info")
+
+	serverCmd.Flags().BoolVar(&serverOpts.traceSpans, "trace-spans", false, "Log the duration of the steps of the CRL updates and revocations, e.g. the reads of the CRL, the revocations in Vault and the export and import of the CRL in the endpoint")
+	viper.BindPFlag("trace-spans", serverCmd.Flags().Lookup("trace-spans"))
+	viper.SetDefault("trace-spans", false)
+
+	// Audit related options
+	serverCmd.Flags().StringVar(&serverOpts.auditLog, "audit-log", "", "Append the audit log of the mutating operations to this file, or to stdout if '-'")
+	viper.BindPFlag("audit-log", serverCmd.Flags().Lookup("audit-log"))
+
+	serverCmd.Flags().BoolVar(&serverOpts.auditVault, "audit-vault", false, "Store the audit log of the mutating operations in the Vault kv store too")
+	viper.BindPFlag("audit-vault", serverCmd.Flags().Lookup("audit-vault"))
+	viper.SetDefault("audit-vault", false)
+
+	serverCmd.Flags().StringVar(&serverOpts.auditCloudWatchLogGroup, "audit-cloudwatch-log-group", "", "Send the audit log of the mutating operations to this CloudWatch Logs group too")
+	viper.BindPFlag("audit-cloudwatch-log-group", serverCmd.Flags().Lookup("audit-cloudwatch-log-group"))
+
+	serverCmd.Flags().StringVar(&serverOpts.auditCloudWatchLogStream, "audit-cloudwatch-log-stream", "", "Stream of audit-cloudwatch-log-group the audit log is sent to, created if missing. Defaults to the hostname")
+	viper.BindPFlag("audit-cloudwatch-log-stream", serverCmd.Flags().Lookup("audit-cloudwatch-log-stream"))
+
+	// Notification related options
+	serverCmd.Flags().StringVar(&serverOpts.slackWebhookURL, "slack-webhook-url", "", "Send notifications of the issuance and revocation events to this Slack incoming webhook")
+	viper.BindPFlag("slack-webhook-url", serverCmd.Flags().Lookup("slack-webhook-url"))
+
+	serverCmd.Flags().StringSliceVar(&serverOpts.slackEvents, "slack-events", []string{}, "The events to notify to Slack. Any of: issued/revoked/crl-uploaded/crl-upload-failed/offboarded/renew-failed")
+	viper.BindPFlag("slack-events", serverCmd.Flags().Lookup("slack-events"))
+	viper.SetDefault("slack-events", []string{"issued", "revoked", "crl-uploaded", "crl-upload-failed", "offboarded", "renew-failed"})
+
+	serverCmd.Flags().DurationVar(&serverOpts.slackInterval, "slack-interval", 0, "Minimum time between Slack messages. Events within the interval are sent together")
+	viper.BindPFlag("slack-interval", serverCmd.Flags().Lookup("slack-interval"))
+	viper.SetDefault("slack-interval", notify.DefaultSlackInterval)
+
+	serverCmd.Flags().StringSliceVar(&serverOpts.webhookURLs, "webhook-urls", []string{}, "URLs the lifecycle events are posted to as JSON")
+	viper.BindPFlag("webhook-urls", serverCmd.Flags().Lookup("webhook-urls"))
+
+	serverCmd.Flags().StringSliceVar(&serverOpts.webhookSecrets, "webhook-secrets", []string{}, "The secrets used to sign the payloads posted to each of the webhook-urls, in the same order")
+	viper.BindPFlag("webhook-secrets", serverCmd.Flags().Lookup("webhook-secrets"))
+
+	serverCmd.Flags().DurationVar(&serverOpts.webhookTimeout, "webhook-timeout", 0, "Timeout of each webhook delivery attempt")
+	viper.BindPFlag("webhook-timeout", serverCmd.Flags().Lookup("webhook-timeout"))
+	viper.SetDefault("webhook-timeout", notify.DefaultWebhookTimeout)
+
+	serverCmd.Flags().IntVar(&serverOpts.webhookRetries, "webhook-retries", 0, "Number of retries of the webhook deliveries that fail with a 5xx or connection error")
+	viper.BindPFlag("webhook-retries", serverCmd.Flags().Lookup("webhook-retries"))
+	viper.SetDefault("webhook-retries", notify.DefaultWebhookRetries)
+
+	// Mail related options
+	serverCmd.Flags().StringVar(&serverOpts.mailProvider, "mail-provider", "", "Email the VPN config to the user on issuance using this provider. One of: smtp/ses")
+	viper.BindPFlag("mail-provider", serverCmd.Flags().Lookup("mail-provider"))
+
+	serverCmd.Flags().StringVar(&serverOpts.mailFrom, "mail-from", "", "The From address of the emails")
+	viper.BindPFlag("mail-from", serverCmd.Flags().Lookup("mail-from"))
+
+	serverCmd.Flags().StringVar(&serverOpts.smtpHost, "smtp-host", "", "The SMTP server host")
+	viper.BindPFlag("smtp-host", serverCmd.Flags().Lookup("smtp-host"))
+
+	serverCmd.Flags().IntVar(&serverOpts.smtpPort, "smtp-port", 0, "The SMTP server port")
+	viper.BindPFlag("smtp-port", serverCmd.Flags().Lookup("smtp-port"))
+	viper.SetDefault("smtp-port", 587)
+
+	serverCmd.Flags().StringVar(&serverOpts.smtpUsername, "smtp-username", "", "The username to authenticate to the SMTP server")
+	viper.BindPFlag("smtp-username", serverCmd.Flags().Lookup("smtp-username"))
+
+	serverCmd.Flags().StringVar(&serverOpts.smtpPassword, "smtp-password", "", "The password to authenticate to the SMTP server")
+	viper.BindPFlag("smtp-password", serverCmd.Flags().Lookup("smtp-password"))
+
+	serverCmd.Flags().StringVar(&serverOpts.smtpSecurity, "smtp-security", "", "How to secure the connection to the SMTP server. One of: none/starttls/tls")
+	viper.BindPFlag("smtp-security", serverCmd.Flags().Lookup("smtp-security"))
+	viper.SetDefault("smtp-security", "starttls")
+
+	// Directory related options
+	serverCmd.Flags().StringVar(&serverOpts.directoryProvider, "directory-provider", "", "Check that the users exist and are active in this directory before issuing them certificates. One of: ldap/http")
+	viper.BindPFlag("directory-provider", serverCmd.Flags().Lookup("directory-provider"))
+
+	serverCmd.Flags().DurationVar(&serverOpts.directoryTimeout, "directory-timeout", 0, "Timeout of the requests to the directory")
+	viper.BindPFlag("directory-timeout", serverCmd.Flags().Lookup("directory-timeout"))
+	viper.SetDefault("directory-timeout", 10*time.Second)
+
+	serverCmd.Flags().StringSliceVar(&serverOpts.directoryBypassUsers, "directory-bypass-users", []string{}, "The users that are not checked against the directory, e.g. service accounts")
+	viper.BindPFlag("directory-bypass-users", serverCmd.Flags().Lookup("directory-bypass-users"))
+
+	serverCmd.Flags().StringVar(&serverOpts.directoryLDAPURL, "directory-ldap-url", "", "The URL of the LDAP server, either ldap:// or ldaps://")
+	viper.BindPFlag("directory-ldap-url", serverCmd.Flags().Lookup("directory-ldap-url"))
+
+	serverCmd.Flags().BoolVar(&serverOpts.directoryLDAPStartTLS, "directory-ldap-start-tls", false, "Upgrade the ldap:// connections with StartTLS")
+	viper.BindPFlag("directory-ldap-start-tls", serverCmd.Flags().Lookup("directory-ldap-start-tls"))
+	viper.SetDefault("directory-ldap-start-tls", false)
+
+	serverCmd.Flags().StringVar(&serverOpts.directoryLDAPBindDN, "directory-ldap-bind-dn", "", "The DN to bind to the LDAP server with. The search is anonymous if not set")
+	viper.BindPFlag("directory-ldap-bind-dn", serverCmd.Flags().Lookup("directory-ldap-bind-dn"))
+
+	serverCmd.Flags().StringVar(&serverOpts.directoryLDAPBindPassword, "directory-ldap-bind-password", "", "The password of the bind DN")
+	viper.BindPFlag("directory-ldap-bind-password", serverCmd.Flags().Lookup("directory-ldap-bind-password"))
+
+	serverCmd.Flags().StringVar(&serverOpts.directoryLDAPBaseDN, "directory-ldap-base-dn", "", "The base DN of the search of the users")
+	viper.BindPFlag("directory-ldap-base-dn", serverCmd.Flags().Lookup("directory-ldap-base-dn"))
+
+	serverCmd.Flags().StringVar(&serverOpts.directoryLDAPFilter, "directory-ldap-filter", "", "The filter of the search of the users, where {username} is replaced by the username")
+	viper.BindPFlag("directory-ldap-filter", serverCmd.Flags().Lookup("directory-ldap-filter"))
+	viper.SetDefault("directory-ldap-filter", directory.DefaultLDAPFilter)
+
+	serverCmd.Flags().StringVar(&serverOpts.directoryLDAPActiveAttr, "directory-ldap-active-attribute", "", "The attribute of the user that must have one of directory-ldap-active-values for the user to be active")
+	viper.BindPFlag("directory-ldap-active-attribute", serverCmd.Flags().Lookup("directory-ldap-active-attribute"))
+
+	serverCmd.Flags().StringSliceVar(&serverOpts.directoryLDAPActiveValues, "directory-ldap-active-values", []string{}, "The values of directory-ldap-active-attribute of the active users")
+	viper.BindPFlag("directory-ldap-active-values", serverCmd.Flags().Lookup("directory-ldap-active-values"))
+	viper.SetDefault("directory-ldap-active-values", []string{"true"})
+
+	serverCmd.Flags().StringVar(&serverOpts.directoryLDAPGroup, "directory-ldap-group", "", "The DN of the group the users must be members of, as listed in their memberOf attribute")
+	viper.BindPFlag("directory-ldap-group", serverCmd.Flags().Lookup("directory-ldap-group"))
+
+	serverCmd.Flags().StringVar(&serverOpts.directoryHTTPURL, "directory-http-url", "", "The URL to GET to check the users, where {username} is replaced by the username. A 200 allows the user")
+	viper.BindPFlag("directory-http-url", serverCmd.Flags().Lookup("directory-http-url"))
+
+	serverCmd.Flags().StringVar(&serverOpts.directoryHTTPToken, "directory-http-token", "", "The bearer token sent to directory-http-url")
+	viper.BindPFlag("directory-http-token", serverCmd.Flags().Lookup("directory-http-token"))
 
 	// Vault auth related options
-	serverCmd.PersistentFlags().StringVar(&serverOpts.vaultAuthToken, "vault-auth-token", "", "The token to authenticate to the vault server")
-	viper.BindPFlag("vault-auth-token", serverCmd.PersistentFlags().Lookup("vault-auth-token"))
+	rootCmd.PersistentFlags().StringVar(&serverOpts.vaultAuthToken, "vault-auth-token", "", "The token to authenticate to the vault server")
+	viper.BindPFlag("vault-auth-token", rootCmd.PersistentFlags().Lookup("vault-auth-token"))
 
-	serverCmd.PersistentFlags().StringVar(&serverOpts.vaultAuthApproleRoleID, "vault-auth-approle-role-id", "", "The role id in Vault's approle backend to authenticate with")
-	viper.BindPFlag("vault-auth-approle-role-id", serverCmd.PersistentFlags().Lookup("vault-auth-approle-role-id"))
+	rootCmd.PersistentFlags().StringVar(&serverOpts.vaultAuthApproleRoleID, "vault-auth-approle-role-id", "", "The role id in Vault's approle backend to authenticate with")
+	viper.BindPFlag("vault-auth-approle-role-id", rootCmd.PersistentFlags().Lookup("vault-auth-approle-role-id"))
 
-	serverCmd.PersistentFlags().StringVar(&serverOpts.vaultAuthApproleSecretID, "vault-auth-approle-secret-id", "", "The secret id in Vault's approle backend to authenticate with")
-	viper.BindPFlag("vault-auth-approle-secret-id", serverCmd.PersistentFlags().Lookup("vault-auth-approle-secret-id"))
+	rootCmd.PersistentFlags().StringVar(&serverOpts.vaultAuthApproleSecretID, "vault-auth-approle-secret-id", "", "The secret id in Vault's approle backend to authenticate with")
+	viper.BindPFlag("vault-auth-approle-secret-id", rootCmd.PersistentFlags().Lookup("vault-auth-approle-secret-id"))
 
-	serverCmd.PersistentFlags().StringVar(&serverOpts.vaultAuthApproleBackendPath, "vault-auth-approle-backend-path", "", "The path where the approle auth backend is located")
-	viper.BindPFlag("vault-auth-approle-backend-path", serverCmd.PersistentFlags().Lookup("vault-auth-approle-backend-path"))
+	rootCmd.PersistentFlags().StringVar(&serverOpts.vaultAuthApproleBackendPath, "vault-auth-approle-backend-path", "", "The path where the approle auth backend is located")
+	viper.BindPFlag("vault-auth-approle-backend-path", rootCmd.PersistentFlags().Lookup("vault-auth-approle-backend-path"))
 	viper.SetDefault("vault-auth-approle-backend-path", "approle")
 
 	// GitHub auth related options
@@ -102,9 +752,59 @@ func init() {
 
 	serverCmd.Flags().StringSliceVar(&serverOpts.AuthGithubUsers, "auth-github-users", []string{}, "The GitHub users allowed to access the server")
 	viper.BindPFlag("auth-github-users", serverCmd.Flags().Lookup("auth-github-users"))
+
+	// Static token auth related options
+	serverCmd.Flags().StringSliceVar(&serverOpts.authTokens, "auth-tokens", []string{}, "Static bearer tokens granted access to the server, as 'name:token' entries")
+	viper.BindPFlag("auth-tokens", serverCmd.Flags().Lookup("auth-tokens"))
+
+	serverCmd.Flags().StringVar(&serverOpts.authTokensFile, "auth-tokens-file", "", "File with the static bearer tokens granted access to the server, one 'name:token' entry per line")
+	viper.BindPFlag("auth-tokens-file", serverCmd.Flags().Lookup("auth-tokens-file"))
+
+	serverCmd.Flags().StringSliceVar(&serverOpts.authExemptPaths, "auth-exempt-paths", []string{}, "Paths that can be accessed without authentication")
+	viper.BindPFlag("auth-exempt-paths", serverCmd.Flags().Lookup("auth-exempt-paths"))
+	viper.SetDefault("auth-exempt-paths", []string{"/healthz", "/readyz"})
+
+	serverCmd.Flags().StringVar(&serverOpts.docsAssetsURL, "docs-assets-url", defaultDocsAssetsURL, "Base URL the Swagger UI assets of GET /docs are loaded from, e.g. to serve a vendored copy of swagger-ui-dist")
+	viper.BindPFlag("docs-assets-url", serverCmd.Flags().Lookup("docs-assets-url"))
+	viper.SetDefault("docs-assets-url", defaultDocsAssetsURL)
+
+	// CORS related options
+	serverCmd.Flags().StringSliceVar(&serverOpts.corsAllowedOrigins, "cors-allowed-origins", []string{}, "Origins allowed to call the API from a browser, as 'https://ui.example.com', 'https://*.example.com' or '*'. CORS is disabled if empty")
+	viper.BindPFlag("cors-allowed-origins", serverCmd.Flags().Lookup("cors-allowed-origins"))
+
+	serverCmd.Flags().StringSliceVar(&serverOpts.corsAllowedMethods, "cors-allowed-methods", []string{}, "Methods allowed in the CORS requests")
+	viper.BindPFlag("cors-allowed-methods", serverCmd.Flags().Lookup("cors-allowed-methods"))
+	viper.SetDefault("cors-allowed-methods", []string{http.MethodGet, http.MethodPost, http.MethodPut})
+
+	serverCmd.Flags().StringSliceVar(&serverOpts.corsAllowedHeaders, "cors-allowed-headers", []string{}, "Headers allowed in the CORS requests")
+	viper.BindPFlag("cors-allowed-headers", serverCmd.Flags().Lookup("cors-allowed-headers"))
+	viper.SetDefault("cors-allowed-headers", []string{"Authorization", "Content-Type", requestIDHeader})
+
+	serverCmd.Flags().BoolVar(&serverOpts.corsAllowCredentials, "cors-allow-credentials", false, "Allow the CORS requests to include credentials, such as cookies or client certificates")
+	viper.BindPFlag("cors-allow-credentials", serverCmd.Flags().Lookup("cors-allow-credentials"))
 }
 
 func initConfig() {
+	if err := readConfigFile(viper.GetString("config")); err != nil {
+		log.Fatalf("Invalid config file: %s", err)
+	}
+
+	level, err := logging.ParseLevel(viper.GetString("log-level"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	logFormat := logging.Format(viper.GetString("log-format"))
+	if logFormat != logging.FormatText && logFormat != logging.FormatJSON {
+		log.Fatalf("Unknown log format '%s'", logFormat)
+	}
+	logging.SetDefault(logging.New(os.Stderr, logFormat, level))
+	// Send the output of the standard logger through the structured one too
+	log.SetFlags(0)
+	log.SetOutput(logging.Writer(logging.Default()))
+	if viper.GetBool("trace-spans") {
+		tracing.SetTracer(tracing.NewLogTracer(logging.Default()))
+	}
+
 	keys := []string{
 		"port",
 		"vault-addr",
@@ -112,7 +812,6 @@ func initConfig() {
 		"vault-pki-paths",
 		"vault-client-certificate-role",
 		"vault-kv-path",
-		"config-template-path",
 	}
 
 	for _, k := range keys {
@@ -121,86 +820,561 @@ func initConfig() {
 		}
 	}
 
-	format := `Loaded config:
-			vault-addr: %s
-			vault-token: ****************
-			client-vpn-endpoint-id: %s
-			vault-pki-paths: %s
-			vault-client-certificate-role: %s
-			vault-kv-store-path: %s
-			config-template-path: %s
-	`
-
-	log.Printf(format, viper.GetString("vault-addr"), viper.GetString("client-vpn-endpoint-id"),
-		viper.GetStringSlice("vault-pki-paths"), viper.GetString("vault-client-certificate-role"),
-		viper.GetString("vault-kv-path"), viper.GetString("config-template-path"))
+	logging.Default().Info("loaded config",
+		"vault_addr", viper.GetString("vault-addr"),
+		"endpoint_id", viper.GetString("client-vpn-endpoint-id"),
+		"vault_pki_paths", viper.GetStringSlice("vault-pki-paths"),
+		"vault_client_certificate_role", viper.GetString("vault-client-certificate-role"),
+		"vault_kv_path", viper.GetString("vault-kv-path"),
+		"config_template_path", viper.GetString("config-template-path"))
 
 }
 
 func runServer(cmd *cobra.Command, args []string) {
 
+	if err := configureServer(); err != nil {
+		log.Fatal(err)
+	}
+
+	issueIdempotency.Window = viper.GetDuration("idempotency-window")
+	if ttl := viper.GetDuration("endpoint-config-cache-ttl"); ttl > 0 {
+		endpointConfigCache.TTL = ttl
+	} else {
+		endpointConfigCache = nil
+	}
+	if ttl := viper.GetDuration("users-cache-ttl"); ttl > 0 {
+		usersCache = &operations.UsersCache{TTL: ttl}
+	}
+	if viper.GetBool("certificate-index") {
+		certificateIndex = &operations.CertificateIndex{}
+	}
+	setupStorage()
+	rateLimiter.PerCaller = operations.RateLimit{Limit: viper.GetInt("rate-limit-per-caller"), Period: viper.GetDuration("rate-limit-per-caller-period")}
+	rateLimiter.PerUser = operations.RateLimit{Limit: viper.GetInt("rate-limit-per-user"), Period: viper.GetDuration("rate-limit-per-user-period")}
+	operations.SetAWSUserAgent(viper.GetString("aws-user-agent"))
+	operations.SetAWSEndpointURL(viper.GetString("aws-endpoint-url"))
+	operations.SetMetrics(metrics.Recorder{})
+	operations.SetVaultCircuitBreaker(viper.GetInt("vault-circuit-threshold"), viper.GetDuration("vault-circuit-cool-down"))
+	operations.SetVaultRateLimit(viper.GetFloat64("vault-rate-limit"), viper.GetInt("vault-rate-limit-burst"))
+
+	if viper.GetString("crl-backup-file") != "" {
+		f, err := os.OpenFile(viper.GetString("crl-backup-file"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			log.Fatalf("Unable to open the CRL backup file: %s", err)
+		}
+		defer f.Close()
+		crlBackup = f
+	}
+
+	var notifiers notify.Multi
+	if viper.GetString("slack-webhook-url") != "" {
+		var events []notify.EventType
+		for _, e := range viper.GetStringSlice("slack-events") {
+			events = append(events, notify.EventType(e))
+		}
+		slack := &notify.SlackNotifier{
+			WebhookURL: viper.GetString("slack-webhook-url"),
+			Events:     events,
+			Interval:   viper.GetDuration("slack-interval"),
+		}
+		defer slack.Close()
+		notifiers = append(notifiers, slack)
+	}
+
+	if len(viper.GetStringSlice("webhook-urls")) > 0 {
+		urls := viper.GetStringSlice("webhook-urls")
+		secrets := viper.GetStringSlice("webhook-secrets")
+		wh := &notify.WebhookNotifier{
+			Timeout: viper.GetDuration("webhook-timeout"),
+			Retries: viper.GetInt("webhook-retries"),
+		}
+		for i := range urls {
+			wh.Targets = append(wh.Targets, notify.WebhookTarget{URL: urls[i], Secret: secrets[i]})
+		}
+		defer wh.Close()
+		notifiers = append(notifiers, wh)
+	}
+	if len(notifiers) > 0 {
+		notifier = notifiers
+	}
+
+	start(vaultClient())
+}
+
+// configureServer validates the settings the server runs with, setting
+// up the parts of it that can't be started with an invalid config
+func configureServer() error {
+	if viper.GetBool("insecure") && viper.GetString("tls-cert-file") != "" {
+		return errors.New("The --insecure flag can't be used along with --tls-cert-file")
+	}
+	if !viper.GetBool("insecure") && (viper.GetString("tls-cert-file") == "" || viper.GetString("tls-key-file") == "") {
+		return errors.New("The --tls-cert-file and --tls-key-file flags are required, use --insecure to serve plain HTTP")
+	}
+	if viper.GetString("config-store-s3-bucket") != "" && viper.GetString("private-key-kms-key-id") != "" && !viper.GetBool("discard-private-keys") {
+		return errors.New("The --config-store-s3-bucket flag can't be used along with --private-key-kms-key-id unless --discard-private-keys is set, the configs in S3 would have the private keys unencrypted")
+	}
+	if viper.GetBool("discard-private-keys") && viper.GetBool("auto-renew") {
+		return errors.New("The --auto-renew flag can't be used along with --discard-private-keys, the users would never get the renewed private keys")
+	}
+	if shrink := viper.GetFloat64("crl-max-shrink"); shrink <= 0 || shrink > 1 {
+		return fmt.Errorf("Invalid crl-max-shrink %v, it must be greater than 0 and at most 1", shrink)
+	}
+
+	if _, err := vault.NewClient(viper.GetString("vault-addr"), nil, vaultTLSOptions()); err != nil {
+		return fmt.Errorf("Invalid Vault TLS config: %s", err)
+	}
+
+	// Fail fast if the config template is not valid
+	var err error
+	cfgTemplate, err = operations.LoadConfigTemplate(viper.GetString("config-template-path"), viper.GetString("config-template"))
+	if err != nil {
+		return fmt.Errorf("Invalid OpenVPN config template: %s", err)
+	}
+
+	entries := viper.GetStringSlice("auth-tokens")
+	if viper.GetString("auth-tokens-file") != "" {
+		b, err := ioutil.ReadFile(viper.GetString("auth-tokens-file"))
+		if err != nil {
+			return fmt.Errorf("Unable to read the auth tokens file: %s", err)
+		}
+		entries = append(entries, strings.Split(string(b), "\n")...)
+	}
+	authTokens, err = loadAuthTokens(entries)
+	if err != nil {
+		return fmt.Errorf("Invalid auth tokens: %s", err)
+	}
+
+	err = operations.SetUsernameRule(operations.UsernameRule{
+		Regexp:     viper.GetString("username-regexp"),
+		TrimPrefix: viper.GetString("username-trim-prefix"),
+		TrimSuffix: viper.GetString("username-trim-suffix"),
+		Normalize:  viper.GetBool("username-normalize"),
+		Pattern:    viper.GetString("username-pattern"),
+	})
+	if err != nil {
+		return fmt.Errorf("Invalid username rule: %s", err)
+	}
+	cors, err = newCORSPolicy(
+		viper.GetStringSlice("cors-allowed-origins"),
+		viper.GetStringSlice("cors-allowed-methods"),
+		viper.GetStringSlice("cors-allowed-headers"),
+		viper.GetBool("cors-allow-credentials"))
+	if err != nil {
+		return fmt.Errorf("Invalid CORS config: %s", err)
+	}
+	if _, err := cron.Parse(viper.GetString("crl-rotation-schedule")); err != nil {
+		return fmt.Errorf("Invalid crl-rotation-schedule: %s", err)
+	}
+
+	if _, err := newReconciler(viper.GetDuration("reconcile-interval"), viper.GetString("reconcile-schedule"), viper.GetDuration("reconcile-jitter"), nil); err != nil {
+		return fmt.Errorf("Invalid reconciler config: %s", err)
+	}
+
+	urls := viper.GetStringSlice("webhook-urls")
+	secrets := viper.GetStringSlice("webhook-secrets")
+	if len(urls) > 0 && len(secrets) != len(urls) {
+		return fmt.Errorf("A secret is required for each of the webhook-urls (got %d urls and %d secrets)", len(urls), len(secrets))
+	}
+
+	switch viper.GetString("mail-provider") {
+	case "":
+	case "smtp":
+		mailer = &mail.SMTPMailer{
+			Host:     viper.GetString("smtp-host"),
+			Port:     viper.GetInt("smtp-port"),
+			Username: viper.GetString("smtp-username"),
+			Password: viper.GetString("smtp-password"),
+			Security: mail.SMTPSecurity(viper.GetString("smtp-security")),
+		}
+	case "ses":
+		mailer = &mail.SESMailer{}
+	default:
+		return fmt.Errorf("Unknown mail provider '%s'", viper.GetString("mail-provider"))
+	}
+
+	userDirectory, err = newUserDirectory()
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// vaultTLSOptions returns how the certificate of the Vault server is verified
+func vaultTLSOptions() *vault.TLSOptions {
+	return &vault.TLSOptions{
+		CACertFile:         viper.GetString("vault-ca-cert"),
+		CACertPEM:          []byte(viper.GetString("vault-ca-cert-pem")),
+		InsecureSkipVerify: viper.GetBool("vault-tls-skip-verify"),
+	}
+}
+
+// vaultClient returns the Vault client for the configured auth method
+func vaultClient() vault.AuthenticatedClient {
 	if viper.IsSet("vault-auth-token") {
-		vc := &vault.TokenAuthenticatedClient{
-			Address: viper.GetString("vault-addr"),
-			Token:   viper.GetString("vault-auth-token"),
+		return &vault.TokenAuthenticatedClient{
+			Address:           viper.GetString("vault-addr"),
+			FailoverAddresses: viper.GetStringSlice("vault-failover-addrs"),
+			TLS:               vaultTLSOptions(),
+			Token:             viper.GetString("vault-auth-token"),
 		}
-		start(vc)
 	} else if viper.IsSet("vault-auth-approle-role-id") &&
 		viper.IsSet("vault-auth-approle-secret-id") &&
 		viper.IsSet("vault-auth-approle-backend-path") {
 
-		vc := &vault.ApproleAuthenticatedClient{
-			Address:     viper.GetString("vault-addr"),
-			RoleID:      viper.GetString("vault-auth-approle-role-id"),
-			SecretID:    viper.GetString("vault-auth-approle-secret-id"),
-			BackendPath: viper.GetString("vault-auth-approle-backend-path"),
+		return &vault.ApproleAuthenticatedClient{
+			Address:           viper.GetString("vault-addr"),
+			FailoverAddresses: viper.GetStringSlice("vault-failover-addrs"),
+			TLS:               vaultTLSOptions(),
+			RoleID:            viper.GetString("vault-auth-approle-role-id"),
+			SecretID:          viper.GetString("vault-auth-approle-secret-id"),
+			BackendPath:       viper.GetString("vault-auth-approle-backend-path"),
 		}
-		start(vc)
-	} else {
-		panic("Vault auth config options missing")
 	}
+	panic("Vault auth config options missing")
 }
 
 func start(vc vault.AuthenticatedClient) {
 
+	// Set up the audit log, kept apart from the application log
+	var sinks []audit.Sink
+	switch viper.GetString("audit-log") {
+	case "":
+	case "-":
+		sinks = append(sinks, &audit.WriterSink{W: os.Stdout})
+	default:
+		f, err := audit.NewFileSink(viper.GetString("audit-log"))
+		if err != nil {
+			log.Fatalf("Unable to open the audit log: %s", err)
+		}
+		defer f.Close()
+		sinks = append(sinks, f)
+	}
+	if viper.GetBool("audit-vault") {
+		sinks = append(sinks, &audit.VaultKVSink{Client: vc, VaultKVPath: viper.GetString("vault-kv-path")})
+	}
+	if group := viper.GetString("audit-cloudwatch-log-group"); group != "" {
+		stream := viper.GetString("audit-cloudwatch-log-stream")
+		if stream == "" {
+			stream, _ = os.Hostname()
+		}
+		sinks = append(sinks, &audit.CloudWatchLogsSink{
+			Client:    cloudwatchlogs.New(operations.AWSSession()),
+			LogGroup:  group,
+			LogStream: stream,
+		})
+	}
+	if len(sinks) > 0 {
+		auditor = &audit.Logger{Sinks: sinks, Vault: vc}
+	}
+
+	// The context of the requests and of the scheduled jobs, cancelled
+	// on shutdown if they are still running after the drain period
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
 	// Start RotateCRL cron like task
 	c := cron.New()
-	c.AddFunc("@hourly", func() {
+	err := c.AddFunc(viper.GetString("crl-rotation-schedule"), func() {
+		if atomic.LoadInt32(&shuttingDown) == 1 {
+			return
+		}
+		scheduledJobs.Add(1)
+		defer scheduledJobs.Done()
+
 		client, err := vc.GetClient()
 		if err != nil {
 			panic("Failed while creating Vault client")
 		}
-		err = operations.RotateCRL(
+		// Skip this run if the previous one, or any other
+		// update of the CRL, is still running
+		opts := updateCRLOptions(ctx, logging.Default(), "scheduler")
+		opts.LockFailFast = true
+		res, err := operations.RotateCRLWithResult(
 			&operations.RotateCRLRequest{
 				Client:              client,
 				VaultPKIPath:        viper.GetStringSlice("vault-pki-paths")[len(viper.GetStringSlice("vault-pki-paths"))-1],
 				ClientVPNEndpointID: viper.GetString("client-vpn-endpoint-id"),
+				RotationWindow:      viper.GetDuration("crl-rotation-window"),
+				UpdateCRLOptions:    opts,
 			})
+		if errors.Is(err, operations.ErrLocked) {
+			log.Printf("Cron processor skipped the CRL rotation: %s", err)
+			return
+		}
+		auditLog(audit.Entry{Operation: audit.OperationCRLRotate, Actor: "scheduler"}, err)
+		var crlRes *operations.UpdateCRLResult
+		if res != nil {
+			crlRes = res.UpdateCRLResult
+		}
+		notifyCRLUpdate(crlRes, err, "scheduler", "")
+		if err != nil && ctx.Err() != nil {
+			log.Printf("Cron processor stopped by the shutdown while rotating the CRL: %s", err)
+			return
+		}
 		if err != nil {
 			log.Println("Cron procesor failed trying to rotate the CRL")
 			log.Fatal(err)
 		} else {
-			log.Println("Vault CRL rotated by cron processor")
+			log.Printf("Vault CRL rotated by cron processor (rotated: %t, revoked certificates: %d, affected users: %v, AWS updated: %t)",
+				res.Rotated, res.RevokedCount, res.AffectedUsers, res.AWSUpdated)
 		}
-	})
-	c.Start()
 
-	// Start the server
-	mux := mux.NewRouter()
-	mux.HandleFunc("/crl", getCRLHandler(vc)).Methods(http.MethodGet)
-	mux.HandleFunc("/crl", updateCRLHandler(vc)).Methods(http.MethodPost)
-	mux.HandleFunc("/issue/{user}", issueClientCertificateHandler(vc)).Methods(http.MethodPost)
-	mux.HandleFunc("/revoke/{user}", revokeUserHandler(vc)).Methods(http.MethodPost)
-	mux.HandleFunc("/users", listUsersHandler(vc)).Methods(http.MethodGet)
-	mux.HandleFunc("/healthz", healthzHandler(vc)).Methods(http.MethodGet)
-	mux.HandleFunc("/readyz", healthzHandler(vc)).Methods(http.MethodGet)
-	// Add a logging middleware
-	loggedRouter := handlers.CombinedLoggingHandler(os.Stdout, mux)
+		if viper.GetBool("auto-renew") {
+			renewed, err := operations.AutoRenew(
+				&operations.AutoRenewRequest{
+					Client:              client,
+					VaultPKIPaths:       viper.GetStringSlice("vault-pki-paths"),
+					VaultPKIRole:        viper.GetString("vault-client-certificate-role"),
+					ClientVPNEndpointID: viper.GetString("client-vpn-endpoint-id"),
+					VaultKVPath:         viper.GetString("vault-kv-path"),
+					VaultBundleKVPath:   viper.GetString("vault-bundle-kv-path"),
+					CfgTemplate:         cfgTemplate,
+					CfgFromEndpoint:     viper.GetString("config-source") == "endpoint",
+					CfgCache:            endpointConfigCache,
+					RenewBefore:         viper.GetDuration("auto-renew-before"),
+					DenyListKVPath:      denyListKVPath(),
+					Directory:           userDirectory,
+					RateLimiter:         rateLimiter,
+					ValidateBundle:      viper.GetBool("validate-bundles"),
+					UpdateCRLOptions:    updateCRLOptions(ctx, logging.Default(), "scheduler"),
+				})
+			if renewed != nil {
+				endpoint := viper.GetString("client-vpn-endpoint-id")
+				for _, user := range renewed.Renewed {
+					auditLog(audit.Entry{Operation: audit.OperationAutoRenew, Actor: "scheduler", Username: user}, nil)
+					notifyEvent(notify.Event{Type: notify.EventIssued, Username: user, SerialNumber: renewed.Serials[user], EndpointID: endpoint, Caller: "scheduler"})
+				}
+				for user, err := range renewed.Failed {
+					auditLog(audit.Entry{Operation: audit.OperationAutoRenew, Actor: "scheduler", Username: user}, err)
+					notifyEvent(notify.Event{Type: notify.EventRenewFailed, Username: user, EndpointID: endpoint, Caller: "scheduler", Error: err.Error()})
+				}
+			}
+			if err != nil {
+				log.Printf("Cron processor failed to auto renew some certificates, will retry on next run: %s", err)
+			}
+			if renewed != nil && len(renewed.Renewed) > 0 {
+				log.Printf("Cron processor auto renewed the certificates of: %s", strings.Join(renewed.Renewed, ", "))
+			}
+		}
 
-	// Start the server
+		if ctx.Err() != nil {
+			return
+		}
+		report, err := operations.ListExpiringCertificates(
+			&operations.ListExpiringCertificatesRequest{
+				Client:        client,
+				VaultPKIPath:  viper.GetStringSlice("vault-pki-paths")[len(viper.GetStringSlice("vault-pki-paths"))-1],
+				Window:        viper.GetDuration("expiry-warning-window"),
+				IssuerRef:     viper.GetString("vault-pki-issuer"),
+				AdoptedKVPath: adoptedKVPath(),
+			})
+		if err != nil {
+			log.Printf("Cron processor failed to check for expiring certificates: %s", err)
+			return
+		}
+		metrics.SetCertificateExpiry(report.SoonestExpiry)
+		if len(report.Expiring) > 0 {
+			var users []string
+			for user := range report.Expiring {
+				users = append(users, user)
+			}
+			sort.Strings(users)
+			log.Printf("WARNING: %d users have certificates expiring within %s: %s",
+				len(users), viper.GetDuration("expiry-warning-window"), strings.Join(users, ", "))
+		}
+	})
+	if err != nil {
+		log.Fatalf("Invalid CRL rotation schedule: %s", err)
+	}
+	c.Start()
+
+	// Start the reconciler, which updates the CRL in between rotations
+	reconcile, err = newReconciler(viper.GetDuration("reconcile-interval"), viper.GetString("reconcile-schedule"), viper.GetDuration("reconcile-jitter"),
+		func() (string, error) { return reconcileCRL(ctx, vc) })
+	if err != nil {
+		log.Fatalf("Invalid reconciler config: %s", err)
+	}
+	if reconcile != nil {
+		reconcile.Start()
+	}
+
+	// Add a logging middleware
+	loggedRouter := handlers.CombinedLoggingHandler(os.Stdout, newRouter(vc))
+
+	// Start the server
+	srv := &http.Server{
+		Addr:    ":" + viper.GetString("port"),
+		Handler: requestIDMiddleware(corsMiddleware(cors, authMiddleware(loggedRouter))),
+	}
+	var gs *grpc.Server
+	if viper.GetString("grpc-port") != "" {
+		gs, err = newRPCServer(vc)
+		if err != nil {
+			log.Fatalf("Invalid TLS config: %s", err)
+		}
+		lis, err := net.Listen("tcp", ":"+viper.GetString("grpc-port"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func() {
+			if err := gs.Serve(lis); err != nil {
+				log.Fatal(err)
+			}
+		}()
+		log.Printf("Serving the gRPC API on port :%v", viper.GetString("grpc-port"))
+	}
+	if viper.GetBool("insecure") {
+		log.Print("WARNING: serving plain HTTP, the API is not protected by TLS")
+		log.Print("Started server")
+		log.Printf("Listening on port :%v", viper.GetString("port"))
+		serve(ctx, cancel, srv, gs, c, srv.ListenAndServe, shutdownSignals(), viper.GetDuration("shutdown-delay"), viper.GetDuration("shutdown-drain-period"))
+		return
+	}
+	tlsConfig, err := serverTLSConfig(viper.GetString("tls-cert-file"), viper.GetString("tls-key-file"), viper.GetString("tls-client-ca-file"))
+	if err != nil {
+		log.Fatalf("Invalid TLS config: %s", err)
+	}
+	srv.TLSConfig = tlsConfig
 	log.Print("Started server")
-	log.Printf("Listening on port :%v", viper.GetString("port"))
-	log.Fatal(http.ListenAndServe(":"+viper.GetString("port"), authMiddleware(loggedRouter)))
+	log.Printf("Listening on port :%v (TLS, client certificates required: %t)", viper.GetString("port"), tlsConfig.ClientCAs != nil)
+	serve(ctx, cancel, srv, gs, c, func() error { return srv.ListenAndServeTLS("", "") }, shutdownSignals(), viper.GetDuration("shutdown-delay"), viper.GetDuration("shutdown-drain-period"))
+}
+
+// newRouter returns the router with the handlers of all the routes of the API
+func newRouter(vc vault.AuthenticatedClient) *mux.Router {
+	mux := mux.NewRouter()
+	mux.HandleFunc("/crl", getCRLHandler(vc)).Methods(http.MethodGet)
+	mux.HandleFunc("/crl", updateCRLHandler(vc)).Methods(http.MethodPost)
+	mux.HandleFunc("/crl/diff", diffCRLHandler(vc)).Methods(http.MethodGet)
+	mux.HandleFunc("/crl/history", listCRLHistoryHandler(vc)).Methods(http.MethodGet)
+	mux.HandleFunc("/crl/history/{version}", getCRLHistoryHandler(vc)).Methods(http.MethodGet)
+	mux.HandleFunc("/crl/rollback", rollbackCRLHandler(vc)).Methods(http.MethodPost)
+	mux.HandleFunc("/crl/prune", pruneCRLHandler(vc)).Methods(http.MethodPost)
+	mux.HandleFunc("/crl/rebuild", rebuildCRLHandler(vc)).Methods(http.MethodPost)
+	mux.HandleFunc("/issue/{user}", issueClientCertificateHandler(vc)).Methods(http.MethodPost)
+	mux.HandleFunc("/issue-batch", issueBatchHandler(vc)).Methods(http.MethodPost)
+	mux.HandleFunc("/sign/{user}", signCSRHandler(vc)).Methods(http.MethodPost)
+	mux.HandleFunc("/revoke/{user}", revokeUserHandler(vc)).Methods(http.MethodPost)
+	mux.HandleFunc("/revoke-batch", revokeBatchHandler(vc)).Methods(http.MethodPost)
+	mux.HandleFunc("/deprovision", deprovisionHandler(vc)).Methods(http.MethodPost)
+	mux.HandleFunc("/revoke-issued-before", revokeIssuedBeforeHandler(vc)).Methods(http.MethodPost)
+	mux.HandleFunc("/adopt", adoptHandler(vc)).Methods(http.MethodPost)
+	mux.HandleFunc("/deny-list", listDenyListHandler(vc)).Methods(http.MethodGet)
+	mux.HandleFunc("/deny-list/{user}", addToDenyListHandler(vc)).Methods(http.MethodPut)
+	mux.HandleFunc("/deny-list/{user}", removeFromDenyListHandler(vc)).Methods(http.MethodDelete)
+	mux.HandleFunc("/users", listUsersHandler(vc)).Methods(http.MethodGet)
+	mux.HandleFunc("/certificates", listCertificatesHandler(vc)).Methods(http.MethodGet)
+	mux.HandleFunc("/certificates/rebuild-index", rebuildCertificateIndexHandler(vc)).Methods(http.MethodPost)
+	mux.HandleFunc("/certificates/revoke-by-fingerprint", revokeByFingerprintHandler(vc)).Methods(http.MethodPost)
+	mux.HandleFunc("/certificates/{serial}", getCertificateHandler(vc)).Methods(http.MethodGet)
+	mux.HandleFunc("/users/{user}", describeUserHandler(vc)).Methods(http.MethodGet)
+	mux.HandleFunc("/users/{user}/config", getUserConfigHandler(vc)).Methods(http.MethodGet)
+	mux.HandleFunc("/users/{user}/config/url", presignConfigURLHandler()).Methods(http.MethodGet)
+	mux.HandleFunc("/users/{user}/certificates/{serial}/bundle", getCertificateBundleHandler(vc)).Methods(http.MethodGet)
+	mux.HandleFunc("/users/{user}/metadata", getUserMetadataHandler(vc)).Methods(http.MethodGet)
+	mux.HandleFunc("/users/{user}/metadata", setUserMetadataHandler(vc)).Methods(http.MethodPut)
+	mux.HandleFunc("/users/{user}/suspend", suspendUserHandler(vc)).Methods(http.MethodPost)
+	mux.HandleFunc("/users/{user}/reinstate", reinstateUserHandler(vc)).Methods(http.MethodPost)
+	mux.HandleFunc("/report", reportHandler(vc)).Methods(http.MethodGet)
+	mux.HandleFunc("/expiring", listExpiringHandler(vc)).Methods(http.MethodGet)
+	mux.HandleFunc("/endpoints", listEndpointsHandler()).Methods(http.MethodGet)
+	mux.HandleFunc("/endpoints/config-cache", invalidateEndpointConfigHandler()).Methods(http.MethodDelete)
+	mux.Handle("/metrics", metrics.Handler()).Methods(http.MethodGet)
+	mux.HandleFunc("/openapi.json", openAPIHandler()).Methods(http.MethodGet)
+	mux.HandleFunc("/docs", docsHandler()).Methods(http.MethodGet)
+	mux.HandleFunc("/healthz", healthzHandler()).Methods(http.MethodGet)
+	mux.HandleFunc("/readyz", readyzHandler(vc)).Methods(http.MethodGet)
+	return mux
+}
+
+// shutdownSignals returns a channel that receives the SIGTERM and SIGINT
+func shutdownSignals() chan os.Signal {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
+	return sig
+}
+
+// serve runs the server, and the gRPC server gs if not nil, until a
+// signal is received in sig. The readiness probe then starts failing
+// and, after the delay, the servers stop accepting requests and wait
+// for the in-flight ones and for the scheduled jobs to finish, up to
+// the drain period. ctx, the context of the requests and of the jobs,
+// is then cancelled through cancel, and the operations still running
+// are waited for until they stop.
+func serve(ctx context.Context, cancel context.CancelFunc, srv *http.Server, gs *grpc.Server, c *cron.Cron, listen func() error, sig chan os.Signal, delay, drainPeriod time.Duration) {
+	defer cancel()
+	srv.BaseContext = func(net.Listener) context.Context { return ctx }
+	// Track the handlers, which keep running after srv.Close
+	var inFlight sync.WaitGroup
+	handler := srv.Handler
+	if handler == nil {
+		handler = http.DefaultServeMux
+	}
+	srv.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inFlight.Add(1)
+		defer inFlight.Done()
+		handler.ServeHTTP(w, r)
+	})
+
+	errs := make(chan error, 1)
+	go func() { errs <- listen() }()
+
+	select {
+	case err := <-errs:
+		log.Fatal(err)
+	case s := <-sig:
+		log.Printf("Received %s, shutting down", s)
+	}
+	// A second signal terminates the process right away
+	signal.Stop(sig)
+
+	atomic.StoreInt32(&shuttingDown, 1)
+	c.Stop()
+	reconcile.Stop()
+	time.Sleep(delay)
+
+	drain, cancelDrain := context.WithTimeout(context.Background(), drainPeriod)
+	defer cancelDrain()
+	var grpcStopped sync.WaitGroup
+	if gs != nil {
+		grpcStopped.Add(1)
+		go func() {
+			defer grpcStopped.Done()
+			gs.GracefulStop()
+		}()
+	}
+	if err := srv.Shutdown(drain); err != nil {
+		log.Printf("WARNING: in-flight requests still running after the drain period, cancelling them: %s", err)
+		cancel()
+		srv.Close()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		inFlight.Wait()
+		grpcStopped.Wait()
+		scheduledJobs.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-drain.Done():
+		select {
+		case <-done:
+		default:
+			log.Print("WARNING: operations still running after the drain period, cancelling them")
+			cancel()
+			if gs != nil {
+				gs.Stop()
+			}
+			select {
+			case <-done:
+			case <-time.After(shutdownCancelWait):
+				log.Print("WARNING: operations still running after being cancelled")
+			}
+		}
+	}
+	log.Print("Server stopped")
 }
 
 func issueClientCertificateHandler(vc vault.AuthenticatedClient) http.HandlerFunc {
@@ -213,6 +1387,11 @@ func issueClientCertificateHandler(vc vault.AuthenticatedClient) http.HandlerFun
 		}
 
 		vars := mux.Vars(r)
+		username, err := operations.NormalizeUsername(vars["user"])
+		if err != nil {
+			http.Error(w, jsonOutput(map[string]string{"error": err.Error()}), http.StatusBadRequest)
+			return
+		}
 
 		var temp bool
 		if _, ok := r.URL.Query()["temp"]; ok {
@@ -226,54 +1405,1971 @@ func issueClientCertificateHandler(vc vault.AuthenticatedClient) http.HandlerFun
 			temp = false
 		}
 
+		discardKey := viper.GetBool("discard-private-keys")
+		if v := r.URL.Query().Get("discard-key"); v != "" && !discardKey {
+			discardKey, err = strconv.ParseBool(v)
+			if err != nil {
+				http.Error(w, jsonOutput(map[string]string{"error": "incorrect value for parameter 'discard-key'. Use one of: true/false"}), http.StatusBadRequest)
+				return
+			}
+		}
+
+		req := &operations.IssueCertificateRequest{
+			Client:              client,
+			VaultPKIPaths:       viper.GetStringSlice("vault-pki-paths"),
+			VaultPKIRole:        viper.GetString("vault-client-certificate-role"),
+			Username:            username,
+			ClientVPNEndpointID: viper.GetString("client-vpn-endpoint-id"),
+			VaultKVPath:         viper.GetString("vault-kv-path"),
+			VaultBundleKVPath:   viper.GetString("vault-bundle-kv-path"),
+			CfgTemplate:         cfgTemplate,
+			CfgFromEndpoint:     viper.GetString("config-source") == "endpoint",
+			CfgCache:            endpointConfigCache,
+			Temporary:           temp,
+			DiscardPrivateKey:   discardKey,
+			Mailer:              mailer,
+			MailFrom:            viper.GetString("mail-from"),
+			Email:               r.URL.Query().Get("email"),
+			IdempotencyKey:      r.Header.Get("Idempotency-Key"),
+			Idempotency:         issueIdempotency,
+			MaxCertsPerUser:     viper.GetInt("max-certs-per-user"),
+			RevokeOldest:        viper.GetBool("max-certs-revoke-oldest"),
+			DenyListKVPath:      denyListKVPath(),
+			Directory:           userDirectory,
+			RateLimiter:         rateLimiter,
+			Caller:              requestCaller(r),
+			ValidateBundle:      viper.GetBool("validate-bundles"),
+			UpdateCRLOptions:    updateCRLOptions(r.Context(), requestLogger(r), requestCaller(r)),
+		}
+
 		if temp {
-			if role, ok := r.URL.Query()["role"]; ok {
-				//do something here
-				cfg, err := operations.IssueClientCertificate(
-					&operations.IssueCertificateRequest{
-						Client:              client,
-						VaultPKIPaths:       viper.GetStringSlice("vault-pki-paths"),
-						VaultPKIRole:        role[0],
-						Username:            vars["user"],
-						ClientVPNEndpointID: viper.GetString("client-vpn-endpoint-id"),
-						VaultKVPath:         viper.GetString("vault-kv-path"),
-						CfgTplPath:          viper.GetString("config-template-path"),
-						Temporary:           true,
-					})
-				if err != nil {
-					http.Error(w, jsonOutput(map[string]string{"error": "couldn't issue temporary client certificate for user " + vars["user"] + ":\n" + err.Error()}), http.StatusInternalServerError)
-					log.Println(err)
-					return
-				}
-				fmt.Fprintln(w, jsonOutput(map[string]string{"config": cfg}))
-			} else {
+			role, ok := r.URL.Query()["role"]
+			if !ok {
 				http.Error(w, jsonOutput(map[string]string{"error": "couldn't issue temporary client certificate, yuo need to specify a Vault PKI role"}), http.StatusBadRequest)
 				return
 			}
+			req.VaultPKIRole = role[0]
+		}
+
+		if key := r.URL.Query().Get("idempotency-key"); key != "" {
+			req.IdempotencyKey = key
+		}
+		for param, sans := range map[string]*[]string{"alt_names": &req.AltNames, "ip_sans": &req.IPSANs, "email_sans": &req.EmailSANs} {
+			if v := r.URL.Query().Get(param); v != "" {
+				*sans = strings.Split(v, ",")
+			}
+		}
 
+		cfg, err := operations.IssueClientCertificate(req)
+		if cfg != nil && cfg.Replayed {
+			// Nothing was issued, this is the response to a retried request
+			w.Header().Set("Idempotent-Replayed", "true")
 		} else {
-			_, err = operations.IssueClientCertificate(
-				&operations.IssueCertificateRequest{
+			entry := audit.Entry{Operation: audit.OperationIssue, Actor: requestCaller(r), RequestID: requestID(r), Username: username}
+			if cfg != nil {
+				entry.SerialNumbers = []string{cfg.SerialNumber}
+			}
+			auditLog(entry, err)
+		}
+		if rateLimitResponse(w, err) || deniedUserResponse(w, err) || suspendedUserResponse(w, err) || directoryResponse(w, err) || timeoutResponse(w, err) || circuitOpenResponse(w, err) {
+			return
+		}
+		var limitErr *operations.CertLimitError
+		if errors.As(err, &limitErr) {
+			http.Error(w, jsonOutput(map[string]string{
+				"error": "couldn't issue client certificate for user " + username + ":\n" + err.Error(),
+				"count": strconv.Itoa(limitErr.Count),
+				"limit": strconv.Itoa(limitErr.Limit),
+			}), http.StatusConflict)
+			return
+		}
+		if errors.Is(err, operations.ErrSANNotAllowed) || errors.Is(err, operations.ErrInvalidEmail) {
+			http.Error(w, jsonOutput(map[string]string{"error": "couldn't issue client certificate for user " + username + ":\n" + err.Error()}), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			msg := "couldn't issue client certificate for user "
+			if temp {
+				msg = "couldn't issue temporary client certificate for user "
+			}
+			http.Error(w, jsonOutput(map[string]string{"error": msg + username + ":\n" + err.Error()}), http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+
+		if !cfg.Replayed {
+			notifyEvent(notify.Event{
+				Type:         notify.EventIssued,
+				Username:     username,
+				SerialNumber: cfg.SerialNumber,
+				EndpointID:   viper.GetString("client-vpn-endpoint-id"),
+				Caller:       requestCaller(r),
+				RequestID:    requestID(r),
+			})
+		}
+
+		rsp := map[string]string{"config": cfg.Config}
+		if !temp {
+			rsp["result"] = "success"
+		}
+		if cfg.EmailedTo != "" {
+			rsp["emailed-to"] = cfg.EmailedTo
+		}
+		if cfg.EmailError != nil {
+			rsp["email-error"] = cfg.EmailError.Error()
+		}
+		if cfg.KeyDiscarded {
+			rsp["key-retained"] = "false"
+		}
+		fmt.Fprintln(w, jsonOutput(rsp))
+	}
+}
+
+// issueBatchUser is each of the users in the body of POST /issue-batch
+type issueBatchUser struct {
+	Username string `json:"username"`
+	// TTL is a duration, e.g. 720h
+	TTL      string                   `json:"ttl,omitempty"`
+	Metadata *operations.UserMetadata `json:"metadata,omitempty"`
+}
+
+// issueBatchResult is the outcome of each of the users in the response of POST /issue-batch
+type issueBatchResult struct {
+	Username string `json:"username"`
+	// Result is one of: issued/error
+	Result     string `json:"result"`
+	Serial     string `json:"serial,omitempty"`
+	ConfigPath string `json:"config-path,omitempty"`
+	EmailedTo  string `json:"emailed-to,omitempty"`
+	EmailError string `json:"email-error,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+func issueBatchHandler(vc vault.AuthenticatedClient) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		client, err := vc.GetClient()
+		if err != nil {
+			http.Error(w, jsonOutput(map[string]string{"error": "error getting vault client:\n" + err.Error()}), http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+
+		if viper.GetBool("discard-private-keys") {
+			// The response of the batch doesn't include the private keys
+			http.Error(w, jsonOutput(map[string]string{"error": "the private keys are not retained, see --discard-private-keys, issue the certificates one by one instead"}), http.StatusBadRequest)
+			return
+		}
+
+		var body []issueBatchUser
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, jsonOutput(map[string]string{"error": "the body must be a json array of users:\n" + err.Error()}), http.StatusBadRequest)
+			return
+		}
+		if len(body) == 0 {
+			http.Error(w, jsonOutput(map[string]string{"error": "no users to issue certificates for"}), http.StatusBadRequest)
+			return
+		}
+		var users []operations.BatchUser
+		for _, u := range body {
+			if u.Username == "" {
+				http.Error(w, jsonOutput(map[string]string{"error": "all the users need a username"}), http.StatusBadRequest)
+				return
+			}
+			bu := operations.BatchUser{Username: u.Username, Metadata: u.Metadata}
+			if u.TTL != "" {
+				bu.TTL, err = time.ParseDuration(u.TTL)
+				if err != nil || bu.TTL <= 0 {
+					http.Error(w, jsonOutput(map[string]string{"error": "incorrect ttl for user " + u.Username + ". Use a duration, e.g. 720h"}), http.StatusBadRequest)
+					return
+				}
+			}
+			users = append(users, bu)
+		}
+
+		res, err := operations.IssueBatch(
+			&operations.IssueBatchRequest{
+				IssueCertificateRequest: operations.IssueCertificateRequest{
 					Client:              client,
 					VaultPKIPaths:       viper.GetStringSlice("vault-pki-paths"),
 					VaultPKIRole:        viper.GetString("vault-client-certificate-role"),
-					Username:            vars["user"],
 					ClientVPNEndpointID: viper.GetString("client-vpn-endpoint-id"),
 					VaultKVPath:         viper.GetString("vault-kv-path"),
-					CfgTplPath:          viper.GetString("config-template-path"),
-					Temporary:           false,
-				})
-			if err != nil {
-				http.Error(w, jsonOutput(map[string]string{"error": "couldn't issue client certificate for user " + vars["user"] + ":\n" + err.Error()}), http.StatusInternalServerError)
-				log.Println(err)
+					VaultBundleKVPath:   viper.GetString("vault-bundle-kv-path"),
+					CfgTemplate:         cfgTemplate,
+					CfgFromEndpoint:     viper.GetString("config-source") == "endpoint",
+					CfgCache:            endpointConfigCache,
+					Mailer:              mailer,
+					MailFrom:            viper.GetString("mail-from"),
+					MaxCertsPerUser:     viper.GetInt("max-certs-per-user"),
+					RevokeOldest:        viper.GetBool("max-certs-revoke-oldest"),
+					DenyListKVPath:      denyListKVPath(),
+					Directory:           userDirectory,
+					RateLimiter:         rateLimiter,
+					Caller:              requestCaller(r),
+					ValidateBundle:      viper.GetBool("validate-bundles"),
+					UpdateCRLOptions:    updateCRLOptions(r.Context(), requestLogger(r), requestCaller(r)),
+				},
+				Users:       users,
+				Concurrency: viper.GetInt("issue-batch-concurrency"),
+			})
+		if rateLimitResponse(w, err) {
+			return
+		}
+		if res == nil {
+			http.Error(w, jsonOutput(map[string]string{"error": "couldn't issue the client certificates:\n" + err.Error()}), http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+
+		results := []issueBatchResult{}
+		for _, ui := range res.Users {
+			entry := audit.Entry{Operation: audit.OperationIssue, Actor: requestCaller(r), RequestID: requestID(r), Username: ui.Username}
+			if ui.Err != nil {
+				auditLog(entry, ui.Err)
+				results = append(results, issueBatchResult{Username: ui.Username, Result: "error", Error: ui.Err.Error()})
+				continue
+			}
+			entry.SerialNumbers = []string{ui.Result.SerialNumber}
+			auditLog(entry, err)
+			notifyEvent(notify.Event{
+				Type:         notify.EventIssued,
+				Username:     ui.Username,
+				SerialNumber: ui.Result.SerialNumber,
+				EndpointID:   viper.GetString("client-vpn-endpoint-id"),
+				Caller:       requestCaller(r),
+				RequestID:    requestID(r),
+			})
+			result := issueBatchResult{
+				Username:   ui.Username,
+				Result:     "issued",
+				Serial:     ui.Result.SerialNumber,
+				ConfigPath: ui.Result.ConfigPath,
+				EmailedTo:  ui.Result.EmailedTo,
+			}
+			if ui.Result.EmailError != nil {
+				result.EmailError = ui.Result.EmailError.Error()
+			}
+			results = append(results, result)
+		}
+		notifyCRLUpdate(res.UpdateCRLResult, err, requestCaller(r), requestID(r))
+
+		code := http.StatusOK
+		rsp := map[string]interface{}{"users": results}
+		if err != nil {
+			log.Println(err)
+			code = http.StatusInternalServerError
+			rsp["error"] = "couldn't update the CRL:\n" + err.Error()
+		}
+		b, _ := json.MarshalIndent(rsp, "", "  ")
+		w.WriteHeader(code)
+		fmt.Fprintln(w, string(b))
+	}
+}
+
+func signCSRHandler(vc vault.AuthenticatedClient) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		client, err := vc.GetClient()
+		if err != nil {
+			http.Error(w, jsonOutput(map[string]string{"error": "error getting vault client:\n" + err.Error()}), http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+
+		vars := mux.Vars(r)
+		username, err := operations.NormalizeUsername(vars["user"])
+		if err != nil {
+			http.Error(w, jsonOutput(map[string]string{"error": err.Error()}), http.StatusBadRequest)
+			return
+		}
+		csr, err := ioutil.ReadAll(io.LimitReader(r.Body, 64*1024))
+		if err != nil {
+			http.Error(w, jsonOutput(map[string]string{"error": "couldn't read the CSR:\n" + err.Error()}), http.StatusBadRequest)
+			return
+		}
+
+		crt, err := operations.SignCSR(
+			&operations.SignCSRRequest{
+				Client:              client,
+				VaultPKIPaths:       viper.GetStringSlice("vault-pki-paths"),
+				VaultPKIRole:        viper.GetString("vault-client-certificate-role"),
+				Username:            username,
+				ClientVPNEndpointID: viper.GetString("client-vpn-endpoint-id"),
+				Policy: operations.CSRPolicy{
+					AllowedDNSDomains:   viper.GetStringSlice("csr-allowed-dns-domains"),
+					AllowedEmailDomains: viper.GetStringSlice("csr-allowed-email-domains"),
+					MinRSAKeySize:       viper.GetInt("csr-min-rsa-key-size"),
+					MinECKeySize:        viper.GetInt("csr-min-ec-key-size"),
+				},
+				MaxCertsPerUser:  viper.GetInt("max-certs-per-user"),
+				RevokeOldest:     viper.GetBool("max-certs-revoke-oldest"),
+				DenyListKVPath:   denyListKVPath(),
+				Directory:        userDirectory,
+				RateLimiter:      rateLimiter,
+				Caller:           requestCaller(r),
+				UpdateCRLOptions: updateCRLOptions(r.Context(), requestLogger(r), requestCaller(r)),
+			}, csr)
+		if !errors.Is(err, operations.ErrCSRRejected) {
+			entry := audit.Entry{Operation: audit.OperationIssue, Actor: requestCaller(r), RequestID: requestID(r), Username: username}
+			if crt != nil {
+				entry.SerialNumbers = []string{crt.SerialNumber}
+			}
+			auditLog(entry, err)
+		}
+		if rateLimitResponse(w, err) || deniedUserResponse(w, err) || suspendedUserResponse(w, err) || directoryResponse(w, err) {
+			return
+		}
+		var limitErr *operations.CertLimitError
+		if errors.As(err, &limitErr) {
+			http.Error(w, jsonOutput(map[string]string{
+				"error": "couldn't sign the CSR of user " + username + ":\n" + err.Error(),
+				"count": strconv.Itoa(limitErr.Count),
+				"limit": strconv.Itoa(limitErr.Limit),
+			}), http.StatusConflict)
+			return
+		}
+		if errors.Is(err, operations.ErrCSRRejected) {
+			http.Error(w, jsonOutput(map[string]string{"error": "couldn't sign the CSR of user " + username + ":\n" + err.Error()}), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, jsonOutput(map[string]string{"error": "couldn't sign the CSR of user " + username + ":\n" + err.Error()}), http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+
+		notifyEvent(notify.Event{
+			Type:         notify.EventIssued,
+			Username:     username,
+			SerialNumber: crt.SerialNumber,
+			EndpointID:   viper.GetString("client-vpn-endpoint-id"),
+			Caller:       requestCaller(r),
+			RequestID:    requestID(r),
+		})
+
+		fmt.Fprintln(w, jsonOutput(map[string]string{
+			"serial":      crt.SerialNumber,
+			"certificate": crt.Certificate,
+			"ca-chain":    strings.Join(crt.CAChain, "\n"),
+			"not-after":   crt.NotAfter.Format(time.RFC3339),
+		}))
+	}
+}
+
+func getUserConfigHandler(vc vault.AuthenticatedClient) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		client, err := vc.GetClient()
+		if err != nil {
+			http.Error(w, jsonOutput(map[string]string{"error": "error getting vault client:\n" + err.Error()}), http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+		vars := mux.Vars(r)
+		cfg, err := operations.GetUserConfig(
+			&operations.GetUserConfigRequest{
+				Client:      client,
+				VaultKVPath: viper.GetString("vault-kv-path"),
+				Username:    vars["user"],
+				Envelope:    envelope,
+			})
+		if errors.Is(err, operations.ErrUserNotFound) {
+			http.Error(w, jsonOutput(map[string]string{"error": err.Error()}), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, jsonOutput(map[string]string{"error": "could not retrieve the config of user " + vars["user"] + ":\n" + err.Error()}), http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+		fmt.Fprintln(w, jsonOutput(map[string]string{"config": cfg, "key-retained": strconv.FormatBool(operations.ConfigKeyRetained(cfg))}))
+	}
+}
+
+func presignConfigURLHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if configStore == nil {
+			http.Error(w, jsonOutput(map[string]string{"error": "the config store is not enabled, enable it with --config-store-s3-bucket"}), http.StatusBadRequest)
+			return
+		}
+		expiry := viper.GetDuration("config-url-expiry")
+		if v := r.URL.Query().Get("expiry"); v != "" {
+			var err error
+			expiry, err = time.ParseDuration(v)
+			if err != nil || expiry <= 0 || expiry > operations.MaxConfigURLExpiry {
+				http.Error(w, jsonOutput(map[string]string{"error": "incorrect value for parameter 'expiry'. Use a duration like '15m', up to " + operations.MaxConfigURLExpiry.String()}), http.StatusBadRequest)
 				return
 			}
-			fmt.Fprintln(w, jsonOutput(map[string]string{"result": "success"}))
 		}
+		vars := mux.Vars(r)
+		u, err := operations.PresignConfigURL(
+			&operations.PresignConfigURLRequest{
+				Store:    configStore,
+				Username: vars["user"],
+				Expiry:   expiry,
+				Context:  r.Context(),
+			})
+		if errors.Is(err, operations.ErrUserNotFound) {
+			http.Error(w, jsonOutput(map[string]string{"error": err.Error()}), http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, operations.ErrInvalidUsername) {
+			http.Error(w, jsonOutput(map[string]string{"error": err.Error()}), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, jsonOutput(map[string]string{"error": "could not get a link to the config of user " + vars["user"] + ":\n" + err.Error()}), http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+		fmt.Fprintln(w, jsonOutput(map[string]string{
+			"url":        u.URL,
+			"serial":     u.SerialNumber,
+			"expires-at": u.ExpiresAt.Format(time.RFC3339),
+		}))
+	}
+}
+
+func getCertificateBundleHandler(vc vault.AuthenticatedClient) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if viper.GetString("vault-bundle-kv-path") == "" {
+			http.Error(w, jsonOutput(map[string]string{"error": "the certificates are not stored, see --vault-bundle-kv-path"}), http.StatusNotFound)
+			return
+		}
+		client, err := vc.GetClient()
+		if err != nil {
+			http.Error(w, jsonOutput(map[string]string{"error": "error getting vault client:\n" + err.Error()}), http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+		vars := mux.Vars(r)
+		version := 0
+		if v := r.URL.Query().Get("version"); v != "" {
+			version, err = strconv.Atoi(v)
+			if err != nil || version < 1 {
+				http.Error(w, jsonOutput(map[string]string{"error": "incorrect value for parameter 'version'. Use a positive integer"}), http.StatusBadRequest)
+				return
+			}
+		}
+		bundle, err := operations.GetCertificateBundle(
+			&operations.GetCertificateBundleRequest{
+				Client:       client,
+				VaultKVPath:  viper.GetString("vault-bundle-kv-path"),
+				Username:     vars["user"],
+				SerialNumber: vars["serial"],
+				Version:      version,
+				Envelope:     envelope,
+			})
+		if errors.Is(err, operations.ErrUserNotFound) {
+			http.Error(w, jsonOutput(map[string]string{"error": err.Error()}), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, jsonOutput(map[string]string{"error": "could not retrieve the certificate " + vars["serial"] + " of user " + vars["user"] + ":\n" + err.Error()}), http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+		fmt.Fprintln(w, jsonOutput(map[string]string{
+			"serial":       bundle.SerialNumber,
+			"certificate":  bundle.Certificate,
+			"private-key":  bundle.PrivateKey,
+			"ca-chain":     strings.Join(bundle.CAChain, "\n"),
+			"not-after":    bundle.NotAfter.Format(time.RFC3339),
+			"version":      strconv.Itoa(bundle.Version),
+			"key-retained": strconv.FormatBool(!bundle.KeyNotRetained),
+		}))
+	}
+}
+
+func revokeUserHandler(vc vault.AuthenticatedClient) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		client, err := vc.GetClient()
+		if err != nil {
+			http.Error(w, jsonOutput(map[string]string{"error": "error getting vault client:\n" + err.Error()}), http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+		vars := mux.Vars(r)
+
+		reason := operations.ReasonUnspecified
+		if _, ok := r.URL.Query()["reason"]; ok {
+			reason, err = operations.ParseRevocationReason(r.URL.Query()["reason"][0])
+			if err != nil {
+				http.Error(w, jsonOutput(map[string]string{"error": "incorrect value for parameter 'reason'. Use one of: unspecified/keyCompromise/affiliationChanged/superseded/cessationOfOperation/privilegeWithdrawn, or their CRL reason code"}), http.StatusBadRequest)
+				return
+			}
+		}
+
+		res, err := operations.RevokeUserWithResult(
+			&operations.RevokeUserRequest{
+				Reason:              reason,
+				VaultKVPath:         viper.GetString("vault-kv-path"),
+				Client:              client,
+				VaultPKIPath:        viper.GetStringSlice("vault-pki-paths")[len(viper.GetStringSlice("vault-pki-paths"))-1],
+				Username:            vars["user"],
+				ClientVPNEndpointID: viper.GetString("client-vpn-endpoint-id"),
+				DenyList:            denyListOnRevoke(),
+				RateLimiter:         rateLimiter,
+				Caller:              requestCaller(r),
+				UpdateCRLOptions:    updateCRLOptions(r.Context(), requestLogger(r), requestCaller(r)),
+			})
+		entry := audit.Entry{Operation: audit.OperationRevoke, Actor: requestCaller(r), RequestID: requestID(r), Username: vars["user"], Reason: string(reason)}
+		if res != nil {
+			entry.SerialNumbers = res.Revoked
+		}
+		auditLog(entry, err)
+		if res != nil {
+			for _, serial := range res.Revoked {
+				notifyEvent(notify.Event{
+					Type:         notify.EventRevoked,
+					Username:     vars["user"],
+					SerialNumber: serial,
+					Reason:       string(reason),
+					EndpointID:   viper.GetString("client-vpn-endpoint-id"),
+					Caller:       requestCaller(r),
+					RequestID:    requestID(r),
+				})
+			}
+			notifyCRLUpdate(res.UpdateCRLResult, err, requestCaller(r), requestID(r))
+		}
+		if rateLimitResponse(w, err) || timeoutResponse(w, err) || circuitOpenResponse(w, err) {
+			return
+		}
+		if errors.Is(err, operations.ErrUserNotFound) {
+			http.Error(w, jsonOutput(map[string]string{"error": "couldn't revoke user " + vars["user"] + ":\n" + err.Error()}), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Println(err.Error())
+			http.Error(w, jsonOutput(map[string]string{"error": "couldn't revoke user " + vars["user"] + ":\n" + err.Error()}), http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+		notifyEvent(notify.Event{
+			Type:       notify.EventOffboarded,
+			Username:   vars["user"],
+			EndpointID: viper.GetString("client-vpn-endpoint-id"),
+			Caller:     requestCaller(r),
+			RequestID:  requestID(r),
+		})
+		fmt.Fprintln(w, jsonOutput(map[string]string{"result": "success"}))
+	}
+}
+
+// revokeBatchUser is the outcome of each of the users in the response of POST /revoke-batch
+type revokeBatchUser struct {
+	Username string `json:"username"`
+	// Result is one of: revoked/not-found/error
+	Result  string   `json:"result"`
+	Revoked []string `json:"revoked,omitempty"`
+	Error   string   `json:"error,omitempty"`
+}
+
+func revokeBatchHandler(vc vault.AuthenticatedClient) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		client, err := vc.GetClient()
+		if err != nil {
+			http.Error(w, jsonOutput(map[string]string{"error": "error getting vault client:\n" + err.Error()}), http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+
+		var usernames []string
+		if err := json.NewDecoder(r.Body).Decode(&usernames); err != nil {
+			http.Error(w, jsonOutput(map[string]string{"error": "the body must be a json array of usernames:\n" + err.Error()}), http.StatusBadRequest)
+			return
+		}
+		if len(usernames) == 0 {
+			http.Error(w, jsonOutput(map[string]string{"error": "no users to revoke"}), http.StatusBadRequest)
+			return
+		}
+
+		reason := operations.ReasonUnspecified
+		if _, ok := r.URL.Query()["reason"]; ok {
+			reason, err = operations.ParseRevocationReason(r.URL.Query()["reason"][0])
+			if err != nil {
+				http.Error(w, jsonOutput(map[string]string{"error": "incorrect value for parameter 'reason'. Use one of: unspecified/keyCompromise/affiliationChanged/superseded/cessationOfOperation/privilegeWithdrawn, or their CRL reason code"}), http.StatusBadRequest)
+				return
+			}
+		}
+
+		res, err := operations.RevokeUsers(
+			&operations.RevokeUsersRequest{
+				Reason:              reason,
+				VaultKVPath:         viper.GetString("vault-kv-path"),
+				Client:              client,
+				VaultPKIPath:        viper.GetStringSlice("vault-pki-paths")[len(viper.GetStringSlice("vault-pki-paths"))-1],
+				Usernames:           usernames,
+				ClientVPNEndpointID: viper.GetString("client-vpn-endpoint-id"),
+				RateLimiter:         rateLimiter,
+				Caller:              requestCaller(r),
+				UpdateCRLOptions:    updateCRLOptions(r.Context(), requestLogger(r), requestCaller(r)),
+			})
+		if rateLimitResponse(w, err) {
+			return
+		}
+		if res == nil {
+			http.Error(w, jsonOutput(map[string]string{"error": "couldn't revoke the users:\n" + err.Error()}), http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+
+		users := []revokeBatchUser{}
+		for _, ur := range res.Users {
+			user := revokeBatchUser{Username: ur.Username, Result: "revoked", Revoked: ur.Revoked}
+			if ur.Err != nil {
+				user.Result, user.Error = "error", ur.Err.Error()
+				if errors.Is(ur.Err, operations.ErrUserNotFound) {
+					user.Result = "not-found"
+				}
+			}
+			users = append(users, user)
+
+			// The revocations in Vault are only effective if the CRL update succeeds
+			entryErr := ur.Err
+			if entryErr == nil {
+				entryErr = err
+			}
+			auditLog(audit.Entry{Operation: audit.OperationRevoke, Actor: requestCaller(r), RequestID: requestID(r), Username: ur.Username, SerialNumbers: ur.Revoked, Reason: string(reason)}, entryErr)
+			for _, serial := range ur.Revoked {
+				notifyEvent(notify.Event{
+					Type:         notify.EventRevoked,
+					Username:     ur.Username,
+					SerialNumber: serial,
+					Reason:       string(reason),
+					EndpointID:   viper.GetString("client-vpn-endpoint-id"),
+					Caller:       requestCaller(r),
+					RequestID:    requestID(r),
+				})
+			}
+			if entryErr == nil {
+				notifyEvent(notify.Event{
+					Type:       notify.EventOffboarded,
+					Username:   ur.Username,
+					EndpointID: viper.GetString("client-vpn-endpoint-id"),
+					Caller:     requestCaller(r),
+					RequestID:  requestID(r),
+				})
+			}
+		}
+		notifyCRLUpdate(res.UpdateCRLResult, err, requestCaller(r), requestID(r))
+
+		code := http.StatusOK
+		body := map[string]interface{}{"users": users}
+		if err != nil {
+			log.Println(err)
+			code = http.StatusInternalServerError
+			body["error"] = "couldn't update the CRL:\n" + err.Error()
+		}
+		b, _ := json.MarshalIndent(body, "", "  ")
+		w.WriteHeader(code)
+		fmt.Fprintln(w, string(b))
+	}
+}
+
+func deprovisionHandler(vc vault.AuthenticatedClient) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		client, err := vc.GetClient()
+		if err != nil {
+			http.Error(w, jsonOutput(map[string]string{"error": "error getting vault client:\n" + err.Error()}), http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+
+		var body struct {
+			Allowlist []string `json:"allowlist"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, jsonOutput(map[string]string{"error": "invalid allowlist:\n" + err.Error()}), http.StatusBadRequest)
+			return
+		}
+		if rateLimitResponse(w, rateLimiter.Allow(requestCaller(r), "")) {
+			return
+		}
+		if len(body.Allowlist) == 0 {
+			http.Error(w, jsonOutput(map[string]string{"error": "refusing to deprovision with an empty allowlist"}), http.StatusBadRequest)
+			return
+		}
+
+		flags := map[string]bool{}
+		for _, param := range []string{"dry-run", "force"} {
+			if _, ok := r.URL.Query()[param]; ok {
+				flags[param], err = strconv.ParseBool(r.URL.Query()[param][0])
+				if err != nil {
+					http.Error(w, jsonOutput(map[string]string{"error": "incorrect value for parameter '" + param + "'. Use one of: true/false"}), http.StatusBadRequest)
+					return
+				}
+			}
+		}
+
+		res, err := operations.DeprovisionUsers(
+			&operations.DeprovisionUsersRequest{
+				Client:              client,
+				VaultPKIPath:        viper.GetStringSlice("vault-pki-paths")[len(viper.GetStringSlice("vault-pki-paths"))-1],
+				ClientVPNEndpointID: viper.GetString("client-vpn-endpoint-id"),
+				VaultKVPath:         viper.GetString("vault-kv-path"),
+				Allowlist:           body.Allowlist,
+				DryRun:              flags["dry-run"],
+				MaxDeprovisions:     viper.GetInt("max-deprovisions"),
+				Force:               flags["force"],
+				DenyList:            denyListOnRevoke(),
+				Caller:              requestCaller(r),
+				UpdateCRLOptions:    updateCRLOptions(r.Context(), requestLogger(r), requestCaller(r)),
+			})
+		failed := map[string]string{}
+		if res != nil && !res.DryRun && !errors.Is(err, operations.ErrTooManyDeprovisions) {
+			deprovisioned := map[string]bool{}
+			for _, user := range res.Deprovisioned {
+				deprovisioned[user] = true
+				// The revocations in Vault are only effective if the CRL update succeeds
+				entryErr := res.Failed[user]
+				if entryErr == nil {
+					entryErr = err
+				}
+				auditLog(audit.Entry{Operation: audit.OperationRevoke, Actor: requestCaller(r), RequestID: requestID(r), Username: user,
+					Reason: string(operations.ReasonCessationOfOperation)}, entryErr)
+				if entryErr == nil {
+					notifyEvent(notify.Event{
+						Type:       notify.EventOffboarded,
+						Username:   user,
+						EndpointID: viper.GetString("client-vpn-endpoint-id"),
+						Caller:     requestCaller(r),
+						RequestID:  requestID(r),
+					})
+				}
+			}
+			for user, ferr := range res.Failed {
+				failed[user] = ferr.Error()
+				if !deprovisioned[user] {
+					auditLog(audit.Entry{Operation: audit.OperationRevoke, Actor: requestCaller(r), RequestID: requestID(r), Username: user,
+						Reason: string(operations.ReasonCessationOfOperation)}, ferr)
+				}
+			}
+			notifyCRLUpdate(res.UpdateCRLResult, err, requestCaller(r), requestID(r))
+		}
+		var limitErr *operations.DeprovisionLimitError
+		if errors.As(err, &limitErr) {
+			http.Error(w, jsonOutput(map[string]string{
+				"error": "users not deprovisioned:\n" + err.Error() + ". Use force=true to override",
+				"users": strings.Join(res.Deprovisioned, ","),
+			}), http.StatusConflict)
+			return
+		}
+		if res == nil {
+			http.Error(w, jsonOutput(map[string]string{"error": "couldn't deprovision users:\n" + err.Error()}), http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+
+		code := http.StatusOK
+		rsp := map[string]interface{}{
+			"deprovisioned": res.Deprovisioned,
+			"dry-run":       res.DryRun,
+		}
+		if len(failed) > 0 {
+			rsp["failed"] = failed
+		}
+		if err != nil {
+			log.Println(err)
+			code = http.StatusInternalServerError
+			rsp["error"] = "couldn't update the CRL:\n" + err.Error()
+		}
+		b, _ := json.MarshalIndent(rsp, "", "  ")
+		w.WriteHeader(code)
+		fmt.Fprintln(w, string(b))
+	}
+}
+
+func revokeIssuedBeforeHandler(vc vault.AuthenticatedClient) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		client, err := vc.GetClient()
+		if err != nil {
+			http.Error(w, jsonOutput(map[string]string{"error": "error getting vault client:\n" + err.Error()}), http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+
+		cutoff, err := time.Parse(time.RFC3339, r.URL.Query().Get("cutoff"))
+		if err != nil {
+			http.Error(w, jsonOutput(map[string]string{"error": "incorrect value for parameter 'cutoff'. Use an RFC 3339 timestamp, e.g. 2020-01-01T00:00:00Z"}), http.StatusBadRequest)
+			return
+		}
+		reason := operations.ReasonKeyCompromise
+		if _, ok := r.URL.Query()["reason"]; ok {
+			reason, err = operations.ParseRevocationReason(r.URL.Query()["reason"][0])
+			if err != nil {
+				http.Error(w, jsonOutput(map[string]string{"error": "incorrect value for parameter 'reason'. Use one of: unspecified/keyCompromise/affiliationChanged/superseded/cessationOfOperation/privilegeWithdrawn, or their CRL reason code"}), http.StatusBadRequest)
+				return
+			}
+		}
+		var dryRun bool
+		if _, ok := r.URL.Query()["dry-run"]; ok {
+			dryRun, err = strconv.ParseBool(r.URL.Query()["dry-run"][0])
+			if err != nil {
+				http.Error(w, jsonOutput(map[string]string{"error": "incorrect value for parameter 'dry-run'. Use one of: true/false"}), http.StatusBadRequest)
+				return
+			}
+		}
+		if rateLimitResponse(w, rateLimiter.Allow(requestCaller(r), "")) {
+			return
+		}
+
+		res, err := operations.RevokeIssuedBefore(
+			&operations.RevokeIssuedBeforeRequest{
+				Client:              client,
+				VaultPKIPath:        viper.GetStringSlice("vault-pki-paths")[len(viper.GetStringSlice("vault-pki-paths"))-1],
+				ClientVPNEndpointID: viper.GetString("client-vpn-endpoint-id"),
+				Reason:              reason,
+				VaultKVPath:         viper.GetString("vault-kv-path"),
+				DryRun:              dryRun,
+				UpdateCRLOptions:    updateCRLOptions(r.Context(), requestLogger(r), requestCaller(r)),
+			}, cutoff)
+		if res != nil && !res.DryRun {
+			for _, user := range res.Users() {
+				// The revocations in Vault are only effective if the CRL update succeeds
+				entryErr := res.Failed[user]
+				if entryErr == nil {
+					entryErr = err
+				}
+				auditLog(audit.Entry{Operation: audit.OperationRevoke, Actor: requestCaller(r), RequestID: requestID(r), Username: user,
+					SerialNumbers: res.Revoked[user], Reason: string(reason)}, entryErr)
+				for _, serial := range res.Revoked[user] {
+					notifyEvent(notify.Event{
+						Type:         notify.EventRevoked,
+						Username:     user,
+						SerialNumber: serial,
+						Reason:       string(reason),
+						EndpointID:   viper.GetString("client-vpn-endpoint-id"),
+						Caller:       requestCaller(r),
+						RequestID:    requestID(r),
+					})
+				}
+			}
+			notifyCRLUpdate(res.UpdateCRLResult, err, requestCaller(r), requestID(r))
+		}
+		if res == nil {
+			http.Error(w, jsonOutput(map[string]string{"error": "couldn't revoke the certificates issued before " + cutoff.Format(time.RFC3339) + ":\n" + err.Error()}), http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+
+		failed := map[string]string{}
+		for user, ferr := range res.Failed {
+			failed[user] = ferr.Error()
+		}
+		code := http.StatusOK
+		body := map[string]interface{}{
+			"revoked": res.Revoked,
+			"failed":  failed,
+			"dry-run": res.DryRun,
+		}
+		if err != nil {
+			log.Println(err)
+			code = http.StatusInternalServerError
+			body["error"] = "couldn't update the CRL:\n" + err.Error()
+		}
+		b, _ := json.MarshalIndent(body, "", "  ")
+		w.WriteHeader(code)
+		fmt.Fprintln(w, string(b))
+	}
+}
+
+func revokeByFingerprintHandler(vc vault.AuthenticatedClient) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		client, err := vc.GetClient()
+		if err != nil {
+			http.Error(w, jsonOutput(map[string]string{"error": "error getting vault client:\n" + err.Error()}), http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+
+		fingerprint, err := operations.ParseFingerprint(r.URL.Query().Get("fingerprint"))
+		if err != nil {
+			http.Error(w, jsonOutput(map[string]string{"error": "incorrect value for parameter 'fingerprint': " + err.Error()}), http.StatusBadRequest)
+			return
+		}
+		reason := operations.ReasonUnspecified
+		if _, ok := r.URL.Query()["reason"]; ok {
+			reason, err = operations.ParseRevocationReason(r.URL.Query()["reason"][0])
+			if err != nil {
+				http.Error(w, jsonOutput(map[string]string{"error": "incorrect value for parameter 'reason'. Use one of: unspecified/keyCompromise/affiliationChanged/superseded/cessationOfOperation/privilegeWithdrawn, or their CRL reason code"}), http.StatusBadRequest)
+				return
+			}
+		}
+		if rateLimitResponse(w, rateLimiter.Allow(requestCaller(r), "")) {
+			return
+		}
+
+		res, err := operations.RevokeByFingerprint(
+			&operations.RevokeByFingerprintRequest{
+				Client:              client,
+				VaultPKIPath:        viper.GetStringSlice("vault-pki-paths")[len(viper.GetStringSlice("vault-pki-paths"))-1],
+				ClientVPNEndpointID: viper.GetString("client-vpn-endpoint-id"),
+				Reason:              reason,
+				VaultKVPath:         viper.GetString("vault-kv-path"),
+				UpdateCRLOptions:    updateCRLOptions(r.Context(), requestLogger(r), requestCaller(r)),
+			}, fingerprint)
+		if res != nil && !res.AlreadyRevoked {
+			// The revocation in Vault is only effective if the CRL update succeeds
+			auditLog(audit.Entry{Operation: audit.OperationRevoke, Actor: requestCaller(r), RequestID: requestID(r), Username: res.Username,
+				SerialNumbers: []string{res.SerialNumber}, Reason: string(reason)}, err)
+			notifyEvent(notify.Event{
+				Type:         notify.EventRevoked,
+				Username:     res.Username,
+				SerialNumber: res.SerialNumber,
+				Reason:       string(reason),
+				EndpointID:   viper.GetString("client-vpn-endpoint-id"),
+				Caller:       requestCaller(r),
+				RequestID:    requestID(r),
+			})
+			notifyCRLUpdate(res.UpdateCRLResult, err, requestCaller(r), requestID(r))
+		}
+		if errors.Is(err, operations.ErrCertificateNotFound) {
+			http.Error(w, jsonOutput(map[string]string{"error": err.Error()}), http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, operations.ErrAmbiguousFingerprint) {
+			http.Error(w, jsonOutput(map[string]string{"error": err.Error()}), http.StatusConflict)
+			return
+		}
+		if circuitOpenResponse(w, err) || timeoutResponse(w, err) {
+			return
+		}
+		if err != nil {
+			http.Error(w, jsonOutput(map[string]string{"error": "couldn't revoke the certificate with fingerprint " + fingerprint + ":\n" + err.Error()}), http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+		fmt.Fprintln(w, jsonOutput(map[string]string{
+			"fingerprint":     res.Fingerprint,
+			"serial":          res.SerialNumber,
+			"username":        res.Username,
+			"already-revoked": strconv.FormatBool(res.AlreadyRevoked),
+		}))
+	}
+}
+
+func getCRLHandler(vc vault.AuthenticatedClient) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		client, err := vc.GetClient()
+		if err != nil {
+			http.Error(w, jsonOutput(map[string]string{"error": "error getting vault client:\n" + err.Error()}), http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+		format := operations.CRLFormat(r.URL.Query().Get("format"))
+		if format != "" && format != operations.CRLFormatPEM && format != operations.CRLFormatDER {
+			http.Error(w, jsonOutput(map[string]string{"error": "incorrect value for parameter 'format'. Use one of: pem/der"}), http.StatusBadRequest)
+			return
+		}
+		req := &operations.GetCRLRequest{
+			Client:              client,
+			VaultPKIPath:        viper.GetStringSlice("vault-pki-paths")[len(viper.GetStringSlice("vault-pki-paths"))-1],
+			Format:              format,
+			IssuerRef:           viper.GetString("vault-pki-issuer"),
+			ClientVPNEndpointID: viper.GetString("client-vpn-endpoint-id"),
+		}
+		if format != operations.CRLFormatDER {
+			req.CRLPath = viper.GetString("vault-crl-path")
+		}
+		// The whole CRL is read, instead of streamed, to compute its ETag
+		crl, err := operations.GetCRL(req)
+		if err != nil {
+			log.Println(err.Error())
+			http.Error(w, jsonOutput(map[string]string{"error": "couldn't retrieve the CRL:\n" + err.Error()}), http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+
+		// The DER CRL is binary, so it can't be embedded in the json and
+		// is sent as is. So is the PEM one to the clients that ask for it.
+		switch {
+		case format == operations.CRLFormatDER:
+			writeCRL(w, r, "application/pkix-crl", crl, crl)
+		case strings.Contains(r.Header.Get("Accept"), "application/x-pem-file"):
+			writeCRL(w, r, "application/x-pem-file", crl, crl)
+		default:
+			writeCRL(w, r, "application/json", crl, []byte(jsonOutput(map[string]string{"crl": string(crl)})+"\n"))
+		}
+	}
+}
+
+// writeCRL writes the body with an ETag derived from the CRL and the
+// content type, or a 304 if the client already has it per If-None-Match
+func writeCRL(w http.ResponseWriter, r *http.Request, contentType string, crl, body []byte) {
+	sum := sha256.Sum256(append([]byte(contentType+"\n"), crl...))
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Vary", "Accept")
+	for _, tag := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == etag || tag == "*" {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", contentType)
+	if _, err := w.Write(body); err != nil {
+		log.Println(err)
+	}
+}
+
+func diffCRLHandler(vc vault.AuthenticatedClient) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		client, err := vc.GetClient()
+		if err != nil {
+			http.Error(w, jsonOutput(map[string]string{"error": "error getting vault client:\n" + err.Error()}), http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+		diff, err := operations.DiffEndpointCRL(
+			&operations.DiffEndpointCRLRequest{
+				Client:              client,
+				VaultPKIPath:        viper.GetStringSlice("vault-pki-paths")[len(viper.GetStringSlice("vault-pki-paths"))-1],
+				ClientVPNEndpointID: viper.GetString("client-vpn-endpoint-id"),
+				CRLPath:             viper.GetString("vault-crl-path"),
+				IssuerRef:           viper.GetString("vault-pki-issuer"),
+				Logger:              requestLogger(r),
+				AWSConfig:           awsConfig(),
+			})
+		if err != nil {
+			http.Error(w, jsonOutput(map[string]string{"error": "couldn't compare the CRLs:\n" + err.Error()}), http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+		b, _ := json.MarshalIndent(diff, "", "  ")
+		fmt.Fprintln(w, string(b))
+	}
+}
+
+func updateCRLHandler(vc vault.AuthenticatedClient) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		client, err := vc.GetClient()
+		if err != nil {
+			http.Error(w, jsonOutput(map[string]string{"error": "error gettings vault client:\n" + err.Error()}), http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+		opts := updateCRLOptions(r.Context(), requestLogger(r), requestCaller(r))
+		for param, flag := range map[string]*bool{"force-shrink": &opts.ForceShrink, "force-import": &opts.ForceImport} {
+			if _, ok := r.URL.Query()[param]; ok {
+				*flag, err = strconv.ParseBool(r.URL.Query()[param][0])
+				if err != nil {
+					http.Error(w, jsonOutput(map[string]string{"error": "incorrect value for parameter '" + param + "'. Use one of: true/false"}), http.StatusBadRequest)
+					return
+				}
+			}
+		}
+		if rateLimitResponse(w, rateLimiter.Allow(requestCaller(r), "")) {
+			return
+		}
+		start := time.Now()
+		res, err := operations.UpdateCRL(
+			&operations.UpdateCRLRequest{
+				Client:              client,
+				VaultPKIPath:        viper.GetStringSlice("vault-pki-paths")[len(viper.GetStringSlice("vault-pki-paths"))-1],
+				ClientVPNEndpointID: viper.GetString("client-vpn-endpoint-id"),
+				UpdateCRLOptions:    opts,
+			})
+		// The next scheduled update is due a full interval from now
+		reconcile.Triggered(start, err)
+		auditLog(audit.Entry{Operation: audit.OperationCRLImport, Actor: requestCaller(r), RequestID: requestID(r)}, err)
+		notifyCRLUpdate(res, err, requestCaller(r), requestID(r))
+		if err != nil {
+			if timeoutResponse(w, err) || circuitOpenResponse(w, err) {
+				return
+			}
+			var tooLarge *operations.CRLTooLargeError
+			if errors.As(err, &tooLarge) {
+				http.Error(w, jsonOutput(map[string]string{
+					"error":    "CRL could not be updated:\n" + err.Error(),
+					"size":     strconv.Itoa(tooLarge.Size),
+					"max-size": strconv.Itoa(tooLarge.MaxSize),
+				}), http.StatusInternalServerError)
+				log.Println(err)
+				return
+			}
+			var shrink *operations.CRLShrinkError
+			if errors.As(err, &shrink) {
+				http.Error(w, jsonOutput(map[string]string{
+					"error":  "CRL could not be updated:\n" + err.Error(),
+					"before": strconv.Itoa(shrink.Before),
+					"after":  strconv.Itoa(shrink.After),
+				}), http.StatusConflict)
+				log.Println(err)
+				return
+			}
+			var failures *operations.RevocationFailuresError
+			if errors.As(err, &failures) {
+				http.Error(w, jsonOutput(map[string]string{
+					"error":        "CRL was updated but some users failed:\n" + err.Error(),
+					"failed-users": strings.Join(failures.Users(), ","),
+					"crl":          string(res.CRL),
+					"size":         strconv.Itoa(res.Size),
+					"max-size":     strconv.Itoa(res.MaxSize),
+				}), http.StatusInternalServerError)
+				log.Println(err)
+				return
+			}
+			var aerr awserr.Error
+			if errors.As(err, &aerr) {
+				log.Println(aerr.Code())
+			}
+			http.Error(w, jsonOutput(map[string]string{"error": "CRL could not be updated:\n" + err.Error()}), http.StatusInternalServerError)
+			return
+		}
+
+		fmt.Fprintln(w, jsonOutput(map[string]string{
+			"crl":      string(res.CRL),
+			"size":     strconv.Itoa(res.Size),
+			"max-size": strconv.Itoa(res.MaxSize),
+		}))
+	}
+}
+
+// rebuildCRLResult is the response of POST /crl/rebuild
+type rebuildCRLResult struct {
+	Revoked    []string `json:"revoked"`
+	Missing    []string `json:"missing"`
+	Unexpected []string `json:"unexpected"`
+	Size       int      `json:"size"`
+	AWSUpdated bool     `json:"aws-updated"`
+}
+
+func rebuildCRLHandler(vc vault.AuthenticatedClient) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		client, err := vc.GetClient()
+		if err != nil {
+			http.Error(w, jsonOutput(map[string]string{"error": "error getting vault client:\n" + err.Error()}), http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+		opts := updateCRLOptions(r.Context(), requestLogger(r), requestCaller(r))
+		if v := r.URL.Query().Get("force-import"); v != "" {
+			opts.ForceImport, err = strconv.ParseBool(v)
+			if err != nil {
+				http.Error(w, jsonOutput(map[string]string{"error": "incorrect value for parameter 'force-import'. Use one of: true/false"}), http.StatusBadRequest)
+				return
+			}
+		}
+		if rateLimitResponse(w, rateLimiter.Allow(requestCaller(r), "")) {
+			return
+		}
+		res, err := operations.RebuildCRL(
+			&operations.RebuildCRLRequest{
+				Client:              client,
+				VaultPKIPath:        viper.GetStringSlice("vault-pki-paths")[len(viper.GetStringSlice("vault-pki-paths"))-1],
+				ClientVPNEndpointID: viper.GetString("client-vpn-endpoint-id"),
+				UpdateCRLOptions:    opts,
+			})
+		auditLog(audit.Entry{Operation: audit.OperationCRLRebuild, Actor: requestCaller(r), RequestID: requestID(r)}, err)
+		if res != nil {
+			notifyCRLUpdate(&operations.UpdateCRLResult{CRL: res.CRL, Size: len(res.CRL), AWSUpdated: res.AWSUpdated}, err, requestCaller(r), requestID(r))
+		}
+		var mismatch *operations.CRLMismatchError
+		if errors.As(err, &mismatch) {
+			http.Error(w, jsonOutput(map[string]string{
+				"error":      "CRL was not imported:\n" + err.Error(),
+				"missing":    strings.Join(mismatch.Missing, ","),
+				"unexpected": strings.Join(mismatch.Unexpected, ","),
+			}), http.StatusConflict)
+			log.Println(err)
+			return
+		}
+		if err != nil {
+			http.Error(w, jsonOutput(map[string]string{"error": "CRL could not be rebuilt:\n" + err.Error()}), http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+
+		rsp := rebuildCRLResult{Revoked: res.Revoked, Missing: res.Missing, Unexpected: res.Unexpected, Size: len(res.CRL), AWSUpdated: res.AWSUpdated}
+		for _, l := range []*[]string{&rsp.Revoked, &rsp.Missing, &rsp.Unexpected} {
+			if *l == nil {
+				*l = []string{}
+			}
+		}
+		b, err := json.MarshalIndent(rsp, "", "  ")
+		fmt.Fprintln(w, string(b))
+	}
+}
+
+// adoptRequest is the body of POST /adopt
+type adoptRequest struct {
+	CNPattern      string `json:"cn-pattern"`
+	UsernameRegexp string `json:"username-regexp"`
+	DryRun         bool   `json:"dry-run"`
+}
+
+// adoptResult is the response of POST /adopt
+type adoptResult struct {
+	Adopted  map[string][]string `json:"adopted"`
+	ToRevoke map[string][]string `json:"to-revoke"`
+	DryRun   bool                `json:"dry-run"`
+}
+
+func adoptHandler(vc vault.AuthenticatedClient) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		client, err := vc.GetClient()
+		if err != nil {
+			http.Error(w, jsonOutput(map[string]string{"error": "error getting vault client:\n" + err.Error()}), http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+		if adoptedKVPath() == "" {
+			http.Error(w, jsonOutput(map[string]string{"error": "the adopted certificates are not tracked, enable them with --adopted-certificates"}), http.StatusBadRequest)
+			return
+		}
+		req := &adoptRequest{}
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			http.Error(w, jsonOutput(map[string]string{"error": "invalid request:\n" + err.Error()}), http.StatusBadRequest)
+			return
+		}
+		for param, expr := range map[string]string{"cn-pattern": req.CNPattern, "username-regexp": req.UsernameRegexp} {
+			if _, err := regexp.Compile(expr); err != nil {
+				http.Error(w, jsonOutput(map[string]string{"error": "incorrect value for '" + param + "':\n" + err.Error()}), http.StatusBadRequest)
+				return
+			}
+		}
+		if req.CNPattern == "" {
+			http.Error(w, jsonOutput(map[string]string{"error": "'cn-pattern' is required"}), http.StatusBadRequest)
+			return
+		}
+
+		if rateLimitResponse(w, rateLimiter.Allow(requestCaller(r), "")) {
+			return
+		}
+		res, err := operations.Adopt(
+			&operations.AdoptRequest{
+				Client:                client,
+				VaultPKIPath:          viper.GetStringSlice("vault-pki-paths")[len(viper.GetStringSlice("vault-pki-paths"))-1],
+				VaultKVPath:           adoptedKVPath(),
+				CNPattern:             req.CNPattern,
+				UsernameRegexp:        req.UsernameRegexp,
+				IssuerRef:             viper.GetString("vault-pki-issuer"),
+				RevocationGracePeriod: viper.GetDuration("revocation-grace-period"),
+				DryRun:                req.DryRun,
+				UsersCache:            usersCache,
+				Retry:                 retryPolicy(),
+				Logger:                requestLogger(r),
+			})
+		if !req.DryRun {
+			var serials []string
+			if res != nil {
+				for _, s := range res.Adopted {
+					serials = append(serials, s...)
+				}
+			}
+			auditLog(audit.Entry{Operation: audit.OperationAdopt, Actor: requestCaller(r), RequestID: requestID(r), SerialNumbers: serials}, err)
+		}
+		if err != nil {
+			http.Error(w, jsonOutput(map[string]string{"error": "certificates could not be adopted:\n" + err.Error()}), http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+
+		b, err := json.MarshalIndent(adoptResult{Adopted: res.Adopted, ToRevoke: res.ToRevoke, DryRun: req.DryRun}, "", "  ")
+		if err != nil {
+			log.Panic("Error marhsalling the response json")
+		}
+		fmt.Fprintln(w, string(b))
+	}
+}
+
+type pruneCRLResult struct {
+	Count   int      `json:"count"`
+	Serials []string `json:"serials"`
+	Size    int      `json:"size,omitempty"`
+}
+
+func pruneCRLHandler(vc vault.AuthenticatedClient) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		client, err := vc.GetClient()
+		if err != nil {
+			http.Error(w, jsonOutput(map[string]string{"error": "error getting vault client:\n" + err.Error()}), http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+		var buffer time.Duration
+		if v := r.URL.Query().Get("safety-buffer"); v != "" {
+			buffer, err = time.ParseDuration(v)
+			if err != nil || buffer <= 0 {
+				http.Error(w, jsonOutput(map[string]string{"error": "incorrect value for parameter 'safety-buffer'. Use a positive duration, e.g. 24h"}), http.StatusBadRequest)
+				return
+			}
+		}
+		if rateLimitResponse(w, rateLimiter.Allow(requestCaller(r), "")) {
+			return
+		}
+		res, err := operations.PruneExpiredFromCRL(
+			&operations.PruneExpiredFromCRLRequest{
+				Client:              client,
+				VaultPKIPath:        viper.GetStringSlice("vault-pki-paths")[len(viper.GetStringSlice("vault-pki-paths"))-1],
+				ClientVPNEndpointID: viper.GetString("client-vpn-endpoint-id"),
+				SafetyBuffer:        buffer,
+				UpdateCRLOptions:    updateCRLOptions(r.Context(), requestLogger(r), requestCaller(r)),
+			})
+		entry := audit.Entry{Operation: audit.OperationCRLPrune, Actor: requestCaller(r), RequestID: requestID(r)}
+		if res != nil {
+			entry.SerialNumbers = res.Serials
+		}
+		auditLog(entry, err)
+		if res != nil && res.UpdateCRLResult != nil {
+			notifyCRLUpdate(res.UpdateCRLResult, err, requestCaller(r), requestID(r))
+		}
+		if err != nil {
+			http.Error(w, jsonOutput(map[string]string{"error": "CRL could not be pruned:\n" + err.Error()}), http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+
+		rsp := pruneCRLResult{Count: res.Count, Serials: res.Serials}
+		if rsp.Serials == nil {
+			rsp.Serials = []string{}
+		}
+		if res.UpdateCRLResult != nil {
+			rsp.Size = res.Size
+		}
+		b, err := json.MarshalIndent(rsp, "", "  ")
+		fmt.Fprintln(w, string(b))
+	}
+}
+
+func rollbackCRLHandler(vc vault.AuthenticatedClient) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		req := &operations.RollbackCRLRequest{
+			ClientVPNEndpointID: viper.GetString("client-vpn-endpoint-id"),
+			Logger:              requestLogger(r),
+			CRLHistoryKVPath:    crlHistoryKVPath(),
+			CRLHistoryVersions:  viper.GetInt("crl-history-versions"),
+			Actor:               requestCaller(r),
+			AWSConfig:           awsConfig(),
+		}
+		if v := r.URL.Query().Get("version"); v != "" {
+			version, err := strconv.Atoi(v)
+			if err != nil || version <= 0 {
+				http.Error(w, jsonOutput(map[string]string{"error": "incorrect value for parameter 'version', use a version of the CRL history"}), http.StatusBadRequest)
+				return
+			}
+			req.HistoryVersion = version
+		}
+		if req.HistoryVersion > 0 && req.CRLHistoryKVPath == "" {
+			http.Error(w, jsonOutput(map[string]string{"error": "the CRL history is not enabled, see --crl-history"}), http.StatusBadRequest)
+			return
+		}
+
+		var crl []byte
+		var err error
+		if req.HistoryVersion == 0 {
+			// Read one byte over the limit to detect larger bodies
+			crl, err = ioutil.ReadAll(io.LimitReader(r.Body, operations.DefaultCRLMaxSize+1))
+			if err != nil {
+				http.Error(w, jsonOutput(map[string]string{"error": "couldn't read the CRL:\n" + err.Error()}), http.StatusBadRequest)
+				return
+			}
+			if len(crl) > operations.DefaultCRLMaxSize {
+				http.Error(w, jsonOutput(map[string]string{"error": "the CRL exceeds the maximum size allowed"}), http.StatusBadRequest)
+				return
+			}
+		}
+		// The CRL is recorded in the history, if enabled, or read from it
+		if req.CRLHistoryKVPath != "" {
+			req.Client, err = vc.GetClient()
+			if err != nil {
+				http.Error(w, jsonOutput(map[string]string{"error": "error getting vault client:\n" + err.Error()}), http.StatusInternalServerError)
+				log.Println(err)
+				return
+			}
+		}
+
+		if rateLimitResponse(w, rateLimiter.Allow(requestCaller(r), "")) {
+			return
+		}
+		err = operations.RollbackCRL(req, crl)
+		auditLog(audit.Entry{Operation: audit.OperationCRLRollback, Actor: requestCaller(r), RequestID: requestID(r)}, err)
+		if errors.Is(err, operations.ErrCRLHistoryNotFound) {
+			http.Error(w, jsonOutput(map[string]string{"error": "CRL could not be rolled back:\n" + err.Error()}), http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, operations.ErrInvalidCRL) {
+			http.Error(w, jsonOutput(map[string]string{"error": "CRL could not be rolled back:\n" + err.Error()}), http.StatusBadRequest)
+			return
+		}
+		notifyCRLUpdate(&operations.UpdateCRLResult{AWSUpdated: err == nil}, err, requestCaller(r), requestID(r))
+		if err != nil {
+			http.Error(w, jsonOutput(map[string]string{"error": "CRL could not be rolled back:\n" + err.Error()}), http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+		log.Printf("CRL rolled back by %s", requestCaller(r))
+		fmt.Fprintln(w, jsonOutput(map[string]string{"result": "success"}))
+	}
+}
+
+func listCRLHistoryHandler(vc vault.AuthenticatedClient) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if crlHistoryKVPath() == "" {
+			http.Error(w, jsonOutput(map[string]string{"error": "the CRL history is not enabled, see --crl-history"}), http.StatusNotFound)
+			return
+		}
+		client, err := vc.GetClient()
+		if err != nil {
+			http.Error(w, jsonOutput(map[string]string{"error": "error getting vault client:\n" + err.Error()}), http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+		list, err := operations.ListCRLHistory(
+			&operations.CRLHistoryRequest{
+				Client:              client,
+				VaultKVPath:         crlHistoryKVPath(),
+				ClientVPNEndpointID: viper.GetString("client-vpn-endpoint-id"),
+			})
+		if err != nil {
+			http.Error(w, jsonOutput(map[string]string{"error": "couldn't list the CRL history:\n" + err.Error()}), http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+		b, _ := json.MarshalIndent(list, "", "  ")
+		fmt.Fprintln(w, string(b))
+	}
+}
+
+func getCRLHistoryHandler(vc vault.AuthenticatedClient) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if crlHistoryKVPath() == "" {
+			http.Error(w, jsonOutput(map[string]string{"error": "the CRL history is not enabled, see --crl-history"}), http.StatusNotFound)
+			return
+		}
+		version, err := strconv.Atoi(mux.Vars(r)["version"])
+		if err != nil || version <= 0 {
+			http.Error(w, jsonOutput(map[string]string{"error": "incorrect version, use a version of the CRL history"}), http.StatusBadRequest)
+			return
+		}
+		client, err := vc.GetClient()
+		if err != nil {
+			http.Error(w, jsonOutput(map[string]string{"error": "error getting vault client:\n" + err.Error()}), http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+		entry, err := operations.GetCRLHistory(
+			&operations.CRLHistoryRequest{
+				Client:              client,
+				VaultKVPath:         crlHistoryKVPath(),
+				ClientVPNEndpointID: viper.GetString("client-vpn-endpoint-id"),
+			}, version)
+		if errors.Is(err, operations.ErrCRLHistoryNotFound) {
+			http.Error(w, jsonOutput(map[string]string{"error": err.Error()}), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, jsonOutput(map[string]string{"error": "couldn't read the CRL history:\n" + err.Error()}), http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+		b, _ := json.MarshalIndent(entry, "", "  ")
+		fmt.Fprintln(w, string(b))
+	}
+}
+
+func listUsersHandler(vc vault.AuthenticatedClient) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		client, err := vc.GetClient()
+		if err != nil {
+			http.Error(w, jsonOutput(map[string]string{"error": "error gettings vault client:\n" + err.Error()}), http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+		req := operations.ListUsersRequest{
+			Client:        client,
+			VaultPKIPath:  viper.GetStringSlice("vault-pki-paths")[len(viper.GetStringSlice("vault-pki-paths"))-1],
+			IssuerRef:     viper.GetString("vault-pki-issuer"),
+			Prefix:        r.URL.Query().Get("prefix"),
+			Search:        r.URL.Query().Get("username"),
+			AdoptedKVPath: adoptedKVPath(),
+			VaultKVPath:   viper.GetString("vault-kv-path"),
+			Cache:         usersCache,
+			Index:         certificateIndex,
+			SkipExpired:   certificateIndex != nil,
+			Context:       r.Context(),
+		}
+		if _, ok := r.URL.Query()["active-only"]; ok {
+			req.ActiveOnly, err = strconv.ParseBool(r.URL.Query()["active-only"][0])
+			if err != nil {
+				http.Error(w, jsonOutput(map[string]string{"error": "incorrect value for parameter 'active-only'. Use one of: true/false"}), http.StatusBadRequest)
+				return
+			}
+		}
+		if _, ok := r.URL.Query()["include-expired"]; ok {
+			includeExpired, err := strconv.ParseBool(r.URL.Query()["include-expired"][0])
+			if err != nil {
+				http.Error(w, jsonOutput(map[string]string{"error": "incorrect value for parameter 'include-expired'. Use one of: true/false"}), http.StatusBadRequest)
+				return
+			}
+			req.SkipExpired = certificateIndex != nil && !includeExpired
+		}
+		if _, ok := r.URL.Query()["refresh"]; ok {
+			req.Refresh, err = strconv.ParseBool(r.URL.Query()["refresh"][0])
+			if err != nil {
+				http.Error(w, jsonOutput(map[string]string{"error": "incorrect value for parameter 'refresh'. Use one of: true/false"}), http.StatusBadRequest)
+				return
+			}
+		}
+
+		// Without any of the pagination parameters keep
+		// returning the whole map of users, as before
+		q := r.URL.Query()
+		if q.Get("limit") == "" && q.Get("offset") == "" && q.Get("sort") == "" && q.Get("username") == "" {
+			users, err := operations.ListUsers(&req)
+			if err != nil {
+				http.Error(w, jsonOutput(map[string]string{"error": "could not retrieve the user list:\n" + err.Error()}), http.StatusInternalServerError)
+				log.Println(err)
+				return
+			}
+			b, err := json.MarshalIndent(users, "", "  ")
+			fmt.Fprintln(w, string(b))
+			return
+		}
+
+		pageReq := &operations.ListUsersPageRequest{
+			ListUsersRequest: req,
+			Sort:             operations.UserSort(q.Get("sort")),
+		}
+		if q.Get("sort") != "" && pageReq.Sort != operations.UserSortUsername && pageReq.Sort != operations.UserSortLastIssued {
+			http.Error(w, jsonOutput(map[string]string{"error": "incorrect value for parameter 'sort'. Use one of: username/last-issued"}), http.StatusBadRequest)
+			return
+		}
+		for param, dst := range map[string]*int{"limit": &pageReq.Limit, "offset": &pageReq.Offset} {
+			if q.Get(param) == "" {
+				continue
+			}
+			*dst, err = strconv.Atoi(q.Get(param))
+			if err != nil || *dst < 0 {
+				http.Error(w, jsonOutput(map[string]string{"error": "incorrect value for parameter '" + param + "'. Use a non negative integer"}), http.StatusBadRequest)
+				return
+			}
+		}
+		page, err := operations.ListUsersPage(pageReq)
+		if err != nil {
+			http.Error(w, jsonOutput(map[string]string{"error": "could not retrieve the user list:\n" + err.Error()}), http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+		b, err := json.MarshalIndent(page, "", "  ")
+		fmt.Fprintln(w, string(b))
+	}
+}
+
+// rebuildCertificateIndexHandler reads all the certificates
+// of the PKI from Vault again into the certificate index
+func rebuildCertificateIndexHandler(vc vault.AuthenticatedClient) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if certificateIndex == nil {
+			http.Error(w, jsonOutput(map[string]string{"error": "the certificate index is not enabled, enable it with --certificate-index"}), http.StatusBadRequest)
+			return
+		}
+		client, err := vc.GetClient()
+		if err != nil {
+			http.Error(w, jsonOutput(map[string]string{"error": "error getting vault client:\n" + err.Error()}), http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+		n, err := operations.RebuildCertificateIndex(
+			&operations.RebuildCertificateIndexRequest{
+				Client:       client,
+				VaultPKIPath: viper.GetStringSlice("vault-pki-paths")[len(viper.GetStringSlice("vault-pki-paths"))-1],
+				Index:        certificateIndex,
+			})
+		if err != nil {
+			http.Error(w, jsonOutput(map[string]string{"error": "could not rebuild the certificate index:\n" + err.Error()}), http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+		usersCache.Invalidate()
+		fmt.Fprintln(w, jsonOutput(map[string]string{"result": "success", "indexed": strconv.Itoa(n)}))
+	}
+}
+
+func listCertificatesHandler(vc vault.AuthenticatedClient) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		client, err := vc.GetClient()
+		if err != nil {
+			http.Error(w, jsonOutput(map[string]string{"error": "error getting vault client:\n" + err.Error()}), http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+		crts, err := operations.ListCertificates(
+			&operations.ListCertificatesRequest{
+				Client:       client,
+				VaultPKIPath: viper.GetStringSlice("vault-pki-paths")[len(viper.GetStringSlice("vault-pki-paths"))-1],
+				VaultKVPath:  viper.GetString("vault-kv-path"),
+				IssuerRef:    viper.GetString("vault-pki-issuer"),
+			})
+		if err != nil {
+			http.Error(w, jsonOutput(map[string]string{"error": "could not retrieve the certificate list:\n" + err.Error()}), http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+		b, err := json.MarshalIndent(crts, "", "  ")
+		fmt.Fprintln(w, string(b))
+	}
+}
+
+func getCertificateHandler(vc vault.AuthenticatedClient) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		client, err := vc.GetClient()
+		if err != nil {
+			http.Error(w, jsonOutput(map[string]string{"error": "error getting vault client:\n" + err.Error()}), http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+		vars := mux.Vars(r)
+		if _, err := operations.ParseSerialNumber(vars["serial"]); err != nil {
+			http.Error(w, jsonOutput(map[string]string{"error": err.Error()}), http.StatusBadRequest)
+			return
+		}
+		crt, err := operations.GetCertificate(
+			&operations.GetCertificateRequest{
+				Client:       client,
+				VaultPKIPath: viper.GetStringSlice("vault-pki-paths")[len(viper.GetStringSlice("vault-pki-paths"))-1],
+				SerialNumber: vars["serial"],
+				VaultKVPath:  viper.GetString("vault-kv-path"),
+				IssuerRef:    viper.GetString("vault-pki-issuer"),
+			})
+		if errors.Is(err, operations.ErrCertificateNotFound) {
+			http.Error(w, jsonOutput(map[string]string{"error": err.Error()}), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, jsonOutput(map[string]string{"error": "could not get certificate " + vars["serial"] + ":\n" + err.Error()}), http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+		b, err := json.MarshalIndent(crt, "", "  ")
+		if err != nil {
+			log.Panic("Error marhsalling the response json")
+		}
+		fmt.Fprintln(w, string(b))
+	}
+}
+
+func describeUserHandler(vc vault.AuthenticatedClient) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		client, err := vc.GetClient()
+		if err != nil {
+			http.Error(w, jsonOutput(map[string]string{"error": "error getting vault client:\n" + err.Error()}), http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+		vars := mux.Vars(r)
+		desc, err := operations.DescribeUser(
+			&operations.DescribeUserRequest{
+				Client:              client,
+				VaultPKIPath:        viper.GetStringSlice("vault-pki-paths")[len(viper.GetStringSlice("vault-pki-paths"))-1],
+				ClientVPNEndpointID: viper.GetString("client-vpn-endpoint-id"),
+				Username:            vars["user"],
+				VaultKVPath:         viper.GetString("vault-kv-path"),
+				IssuerRef:           viper.GetString("vault-pki-issuer"),
+				AdoptedKVPath:       adoptedKVPath(),
+				AWSConfig:           awsConfig(),
+			})
+		if errors.Is(err, operations.ErrUserNotFound) {
+			http.Error(w, jsonOutput(map[string]string{"error": err.Error()}), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, jsonOutput(map[string]string{"error": "could not describe user " + vars["user"] + ":\n" + err.Error()}), http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+		b, err := json.MarshalIndent(desc, "", "  ")
+		if err != nil {
+			log.Panic("Error marhsalling the response json")
+		}
+		fmt.Fprintln(w, string(b))
+	}
+}
+
+func getUserMetadataHandler(vc vault.AuthenticatedClient) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		client, err := vc.GetClient()
+		if err != nil {
+			http.Error(w, jsonOutput(map[string]string{"error": "error getting vault client:\n" + err.Error()}), http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+		vars := mux.Vars(r)
+		md, err := operations.GetUserMetadata(
+			&operations.UserMetadataRequest{
+				Client:      client,
+				VaultKVPath: viper.GetString("vault-kv-path"),
+				Username:    vars["user"],
+				Retry:       retryPolicy(),
+			})
+		if err != nil {
+			http.Error(w, jsonOutput(map[string]string{"error": "could not retrieve the metadata of user " + vars["user"] + ":\n" + err.Error()}), http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+		b, err := json.MarshalIndent(md, "", "  ")
+		fmt.Fprintln(w, string(b))
+	}
+}
+
+func setUserMetadataHandler(vc vault.AuthenticatedClient) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		client, err := vc.GetClient()
+		if err != nil {
+			http.Error(w, jsonOutput(map[string]string{"error": "error getting vault client:\n" + err.Error()}), http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+		vars := mux.Vars(r)
+		md := &operations.UserMetadata{}
+		if err := json.NewDecoder(r.Body).Decode(md); err != nil {
+			http.Error(w, jsonOutput(map[string]string{"error": "invalid metadata:\n" + err.Error()}), http.StatusBadRequest)
+			return
+		}
+		if rateLimitResponse(w, rateLimiter.Allow(requestCaller(r), "")) {
+			return
+		}
+		err = operations.SetUserMetadata(
+			&operations.UserMetadataRequest{
+				Client:      client,
+				VaultKVPath: viper.GetString("vault-kv-path"),
+				Username:    vars["user"],
+				Retry:       retryPolicy(),
+			}, md)
+		auditLog(audit.Entry{Operation: audit.OperationSetMetadata, Actor: requestCaller(r), RequestID: requestID(r), Username: vars["user"]}, err)
+		if errors.Is(err, operations.ErrInvalidEmail) {
+			http.Error(w, jsonOutput(map[string]string{"error": "invalid metadata:\n" + err.Error()}), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, jsonOutput(map[string]string{"error": "could not update the metadata of user " + vars["user"] + ":\n" + err.Error()}), http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+		fmt.Fprintln(w, jsonOutput(map[string]string{"result": "success"}))
+	}
+}
+
+func suspendUserHandler(vc vault.AuthenticatedClient) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		client, err := vc.GetClient()
+		if err != nil {
+			http.Error(w, jsonOutput(map[string]string{"error": "error getting vault client:\n" + err.Error()}), http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+		vars := mux.Vars(r)
+		body := struct {
+			Reason string `json:"reason"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil && err != io.EOF {
+			http.Error(w, jsonOutput(map[string]string{"error": "invalid request:\n" + err.Error()}), http.StatusBadRequest)
+			return
+		}
+		if rateLimitResponse(w, rateLimiter.Allow(requestCaller(r), "")) {
+			return
+		}
+
+		res, err := operations.SuspendUser(
+			&operations.SuspendUserRequest{
+				Client:              client,
+				VaultPKIPath:        viper.GetStringSlice("vault-pki-paths")[len(viper.GetStringSlice("vault-pki-paths"))-1],
+				ClientVPNEndpointID: viper.GetString("client-vpn-endpoint-id"),
+				Username:            vars["user"],
+				VaultKVPath:         viper.GetString("vault-kv-path"),
+				Reason:              body.Reason,
+				UpdateCRLOptions:    updateCRLOptions(r.Context(), requestLogger(r), requestCaller(r)),
+			}, requestCaller(r))
+		entry := audit.Entry{Operation: audit.OperationSuspend, Actor: requestCaller(r), RequestID: requestID(r), Username: vars["user"],
+			Reason: string(operations.ReasonPrivilegeWithdrawn)}
+		if res != nil {
+			entry.SerialNumbers = res.Revoked
+		}
+		auditLog(entry, err)
+		if res != nil {
+			for _, serial := range res.Revoked {
+				notifyEvent(notify.Event{
+					Type:         notify.EventRevoked,
+					Username:     vars["user"],
+					SerialNumber: serial,
+					Reason:       string(operations.ReasonPrivilegeWithdrawn),
+					EndpointID:   viper.GetString("client-vpn-endpoint-id"),
+					Caller:       requestCaller(r),
+					RequestID:    requestID(r),
+				})
+			}
+			if len(res.Revoked) > 0 {
+				notifyCRLUpdate(res.UpdateCRLResult, err, requestCaller(r), requestID(r))
+			}
+		}
+		if err != nil {
+			http.Error(w, jsonOutput(map[string]string{"error": "couldn't suspend user " + vars["user"] + ":\n" + err.Error()}), http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+
+		b, err := json.MarshalIndent(map[string]interface{}{
+			"result":     "success",
+			"suspension": res.Suspension,
+			"revoked":    res.Revoked,
+		}, "", "  ")
+		if err != nil {
+			log.Panic("Error marhsalling the response json")
+		}
+		fmt.Fprintln(w, string(b))
+	}
+}
+
+func reinstateUserHandler(vc vault.AuthenticatedClient) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		client, err := vc.GetClient()
+		if err != nil {
+			http.Error(w, jsonOutput(map[string]string{"error": "error getting vault client:\n" + err.Error()}), http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+		vars := mux.Vars(r)
+		var issue bool
+		if _, ok := r.URL.Query()["issue"]; ok {
+			issue, err = strconv.ParseBool(r.URL.Query()["issue"][0])
+			if err != nil {
+				http.Error(w, jsonOutput(map[string]string{"error": "incorrect value for parameter 'issue'. Use one of: true/false"}), http.StatusBadRequest)
+				return
+			}
+		}
+		// Checked before the user is reinstated, as the issuance would fail
+		if email := r.URL.Query().Get("email"); issue && email != "" {
+			if _, err := mail.ParseAddress(email); err != nil {
+				http.Error(w, jsonOutput(map[string]string{"error": "incorrect value for parameter 'email':\n" + err.Error()}), http.StatusBadRequest)
+				return
+			}
+		}
+		if rateLimitResponse(w, rateLimiter.Allow(requestCaller(r), "")) {
+			return
+		}
+
+		req := &operations.ReinstateUserRequest{
+			Client:      client,
+			VaultKVPath: viper.GetString("vault-kv-path"),
+			Username:    vars["user"],
+			Logger:      requestLogger(r),
+		}
+		if issue {
+			req.Issue = &operations.IssueCertificateRequest{
+				Client:              client,
+				VaultPKIPaths:       viper.GetStringSlice("vault-pki-paths"),
+				VaultPKIRole:        viper.GetString("vault-client-certificate-role"),
+				ClientVPNEndpointID: viper.GetString("client-vpn-endpoint-id"),
+				VaultKVPath:         viper.GetString("vault-kv-path"),
+				VaultBundleKVPath:   viper.GetString("vault-bundle-kv-path"),
+				CfgTemplate:         cfgTemplate,
+				CfgFromEndpoint:     viper.GetString("config-source") == "endpoint",
+				CfgCache:            endpointConfigCache,
+				DiscardPrivateKey:   viper.GetBool("discard-private-keys"),
+				Mailer:              mailer,
+				MailFrom:            viper.GetString("mail-from"),
+				Email:               r.URL.Query().Get("email"),
+				MaxCertsPerUser:     viper.GetInt("max-certs-per-user"),
+				RevokeOldest:        viper.GetBool("max-certs-revoke-oldest"),
+				DenyListKVPath:      denyListKVPath(),
+				Directory:           userDirectory,
+				Caller:              requestCaller(r),
+				ValidateBundle:      viper.GetBool("validate-bundles"),
+				UpdateCRLOptions:    updateCRLOptions(r.Context(), requestLogger(r), requestCaller(r)),
+			}
+		}
+		res, err := operations.ReinstateUser(req)
+		if errors.Is(err, operations.ErrUserNotSuspended) {
+			http.Error(w, jsonOutput(map[string]string{"error": err.Error()}), http.StatusConflict)
+			return
+		}
+		var reinstateErr error
+		if res == nil {
+			reinstateErr = err
+		}
+		auditLog(audit.Entry{Operation: audit.OperationReinstate, Actor: requestCaller(r), RequestID: requestID(r), Username: vars["user"]}, reinstateErr)
+		if res == nil {
+			http.Error(w, jsonOutput(map[string]string{"error": "couldn't reinstate user " + vars["user"] + ":\n" + err.Error()}), http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+		if !issue {
+			fmt.Fprintln(w, jsonOutput(map[string]string{"result": "success"}))
+			return
+		}
+
+		entry := audit.Entry{Operation: audit.OperationIssue, Actor: requestCaller(r), RequestID: requestID(r), Username: vars["user"]}
+		if res.Issued != nil {
+			entry.SerialNumbers = []string{res.Issued.SerialNumber}
+		}
+		auditLog(entry, err)
+		// The user is reinstated even if the issuance failed
+		if rateLimitResponse(w, err) || deniedUserResponse(w, err) || directoryResponse(w, err) {
+			return
+		}
+		if err != nil {
+			http.Error(w, jsonOutput(map[string]string{"error": "reinstated user " + vars["user"] + " but couldn't issue a client certificate:\n" + err.Error()}), http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+		notifyEvent(notify.Event{
+			Type:         notify.EventIssued,
+			Username:     vars["user"],
+			SerialNumber: res.Issued.SerialNumber,
+			EndpointID:   viper.GetString("client-vpn-endpoint-id"),
+			Caller:       requestCaller(r),
+			RequestID:    requestID(r),
+		})
+		rsp := map[string]string{"result": "success", "config": res.Issued.Config}
+		if res.Issued.EmailedTo != "" {
+			rsp["emailed-to"] = res.Issued.EmailedTo
+		}
+		if res.Issued.EmailError != nil {
+			rsp["email-error"] = res.Issued.EmailError.Error()
+		}
+		if res.Issued.KeyDiscarded {
+			rsp["key-retained"] = "false"
+		}
+		fmt.Fprintln(w, jsonOutput(rsp))
 	}
 }
 
-func revokeUserHandler(vc vault.AuthenticatedClient) http.HandlerFunc {
+// denyListEnabled responds with a 400, and returns false,
+// if the deny-list is not enabled
+func denyListEnabled(w http.ResponseWriter) bool {
+	if denyListKVPath() == "" {
+		http.Error(w, jsonOutput(map[string]string{"error": "the deny-list is not enabled, enable it with --deny-list"}), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func listDenyListHandler(vc vault.AuthenticatedClient) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		client, err := vc.GetClient()
+		if err != nil {
+			http.Error(w, jsonOutput(map[string]string{"error": "error getting vault client:\n" + err.Error()}), http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+		if !denyListEnabled(w) {
+			return
+		}
+		entries, err := operations.ListDenyList(client, denyListKVPath())
+		if err != nil {
+			http.Error(w, jsonOutput(map[string]string{"error": "could not list the deny-list:\n" + err.Error()}), http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+		b, err := json.MarshalIndent(entries, "", "  ")
+		if err != nil {
+			log.Panic("Error marhsalling the response json")
+		}
+		fmt.Fprintln(w, string(b))
+	}
+}
+
+func addToDenyListHandler(vc vault.AuthenticatedClient) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		client, err := vc.GetClient()
 		if err != nil {
@@ -281,25 +3377,42 @@ func revokeUserHandler(vc vault.AuthenticatedClient) http.HandlerFunc {
 			log.Println(err)
 			return
 		}
+		if !denyListEnabled(w) {
+			return
+		}
 		vars := mux.Vars(r)
-		err = operations.RevokeUser(
-			&operations.RevokeUserRequest{
-				Client:              client,
-				VaultPKIPath:        viper.GetStringSlice("vault-pki-paths")[len(viper.GetStringSlice("vault-pki-paths"))-1],
-				Username:            vars["user"],
-				ClientVPNEndpointID: viper.GetString("client-vpn-endpoint-id"),
-			})
+		body := struct {
+			Reason string `json:"reason"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil && err != io.EOF {
+			http.Error(w, jsonOutput(map[string]string{"error": "invalid request:\n" + err.Error()}), http.StatusBadRequest)
+			return
+		}
+		if rateLimitResponse(w, rateLimiter.Allow(requestCaller(r), "")) {
+			return
+		}
+		entry, err := operations.AddToDenyList(
+			&operations.DenyListRequest{
+				Client:      client,
+				VaultKVPath: denyListKVPath(),
+				Username:    vars["user"],
+				Retry:       retryPolicy(),
+			}, body.Reason, requestCaller(r))
+		auditLog(audit.Entry{Operation: audit.OperationDenyListAdd, Actor: requestCaller(r), RequestID: requestID(r), Username: vars["user"]}, err)
 		if err != nil {
-			log.Println(err.Error())
-			http.Error(w, jsonOutput(map[string]string{"error": "couldn't revoke user " + vars["user"] + ":\n" + err.Error()}), http.StatusInternalServerError)
+			http.Error(w, jsonOutput(map[string]string{"error": "could not add user " + vars["user"] + " to the deny-list:\n" + err.Error()}), http.StatusInternalServerError)
 			log.Println(err)
 			return
 		}
-		fmt.Fprintln(w, jsonOutput(map[string]string{"result": "success"}))
+		b, err := json.MarshalIndent(entry, "", "  ")
+		if err != nil {
+			log.Panic("Error marhsalling the response json")
+		}
+		fmt.Fprintln(w, string(b))
 	}
 }
 
-func getCRLHandler(vc vault.AuthenticatedClient) http.HandlerFunc {
+func removeFromDenyListHandler(vc vault.AuthenticatedClient) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		client, err := vc.GetClient()
 		if err != nil {
@@ -307,97 +3420,501 @@ func getCRLHandler(vc vault.AuthenticatedClient) http.HandlerFunc {
 			log.Println(err)
 			return
 		}
-		crl, err := operations.GetCRL(
-			&operations.GetCRLRequest{
-				Client:       client,
-				VaultPKIPath: viper.GetStringSlice("vault-pki-paths")[len(viper.GetStringSlice("vault-pki-paths"))-1],
+		if !denyListEnabled(w) {
+			return
+		}
+		vars := mux.Vars(r)
+		if rateLimitResponse(w, rateLimiter.Allow(requestCaller(r), "")) {
+			return
+		}
+		_, err = operations.RemoveFromDenyList(
+			&operations.DenyListRequest{
+				Client:      client,
+				VaultKVPath: denyListKVPath(),
+				Username:    vars["user"],
+				Retry:       retryPolicy(),
 			})
+		if errors.Is(err, operations.ErrUserNotFound) {
+			http.Error(w, jsonOutput(map[string]string{"error": err.Error()}), http.StatusNotFound)
+			return
+		}
+		auditLog(audit.Entry{Operation: audit.OperationDenyListRemove, Actor: requestCaller(r), RequestID: requestID(r), Username: vars["user"]}, err)
 		if err != nil {
-			log.Println(err.Error())
-			http.Error(w, jsonOutput(map[string]string{"error": "couldn't retrieve the CRL:\n" + err.Error()}), http.StatusInternalServerError)
+			http.Error(w, jsonOutput(map[string]string{"error": "could not remove user " + vars["user"] + " from the deny-list:\n" + err.Error()}), http.StatusInternalServerError)
 			log.Println(err)
 			return
 		}
-		fmt.Fprintln(w, jsonOutput(map[string]string{"crl": string(crl)}))
+		fmt.Fprintln(w, jsonOutput(map[string]string{"result": "success"}))
 	}
 }
 
-func updateCRLHandler(vc vault.AuthenticatedClient) http.HandlerFunc {
+func reportHandler(vc vault.AuthenticatedClient) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		client, err := vc.GetClient()
 		if err != nil {
-			http.Error(w, jsonOutput(map[string]string{"error": "error gettings vault client:\n" + err.Error()}), http.StatusInternalServerError)
+			http.Error(w, jsonOutput(map[string]string{"error": "error getting vault client:\n" + err.Error()}), http.StatusInternalServerError)
 			log.Println(err)
 			return
 		}
-		crl, err := operations.UpdateCRL(
-			&operations.UpdateCRLRequest{
+
+		// The format can be selected with the 'format' query
+		// parameter or with the Accept header
+		format := operations.ExportFormatJSON
+		if f, ok := r.URL.Query()["format"]; ok {
+			format = operations.ExportFormat(f[0])
+		} else if strings.Contains(r.Header.Get("Accept"), "text/csv") {
+			format = operations.ExportFormatCSV
+		}
+		switch format {
+		case operations.ExportFormatJSON:
+			w.Header().Set("Content-Type", "application/json")
+		case operations.ExportFormatCSV:
+			w.Header().Set("Content-Type", "text/csv")
+			w.Header().Set("Content-Disposition", "attachment; filename=\"report.csv\"")
+		default:
+			http.Error(w, jsonOutput(map[string]string{"error": "incorrect value for parameter 'format'. Use one of: json/csv"}), http.StatusBadRequest)
+			return
+		}
+
+		// The report is streamed, so errors after the first
+		// write can't be reflected in the status code
+		err = operations.ExportUsers(
+			&operations.ExportUsersRequest{
 				Client:              client,
 				VaultPKIPath:        viper.GetStringSlice("vault-pki-paths")[len(viper.GetStringSlice("vault-pki-paths"))-1],
 				ClientVPNEndpointID: viper.GetString("client-vpn-endpoint-id"),
+				Format:              format,
+				Writer:              w,
+				IssuerRef:           viper.GetString("vault-pki-issuer"),
+				AdoptedKVPath:       adoptedKVPath(),
 			})
 		if err != nil {
-			log.Println(err.(awserr.Error).Code())
-			http.Error(w, jsonOutput(map[string]string{"error": "CRL could not be updated:\n" + err.Error()}), http.StatusInternalServerError)
-			return
+			log.Println(err)
 		}
-
-		fmt.Fprintln(w, jsonOutput(map[string]string{"crl": string(crl)}))
 	}
 }
 
-func listUsersHandler(vc vault.AuthenticatedClient) http.HandlerFunc {
+func listExpiringHandler(vc vault.AuthenticatedClient) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		client, err := vc.GetClient()
 		if err != nil {
-			http.Error(w, jsonOutput(map[string]string{"error": "error gettings vault client:\n" + err.Error()}), http.StatusInternalServerError)
+			http.Error(w, jsonOutput(map[string]string{"error": "error getting vault client:\n" + err.Error()}), http.StatusInternalServerError)
 			log.Println(err)
 			return
 		}
-		users, err := operations.ListUsers(
-			&operations.ListUsersRequest{
-				Client:       client,
-				VaultPKIPath: viper.GetStringSlice("vault-pki-paths")[len(viper.GetStringSlice("vault-pki-paths"))-1],
+
+		window := viper.GetDuration("expiry-warning-window")
+		if _, ok := r.URL.Query()["window"]; ok {
+			window, err = time.ParseDuration(r.URL.Query()["window"][0])
+			if err != nil {
+				http.Error(w, jsonOutput(map[string]string{"error": "incorrect value for parameter 'window'. Use a duration like '720h'"}), http.StatusBadRequest)
+				return
+			}
+		}
+
+		report, err := operations.ListExpiringCertificates(
+			&operations.ListExpiringCertificatesRequest{
+				Client:        client,
+				VaultPKIPath:  viper.GetStringSlice("vault-pki-paths")[len(viper.GetStringSlice("vault-pki-paths"))-1],
+				Window:        window,
+				IssuerRef:     viper.GetString("vault-pki-issuer"),
+				AdoptedKVPath: adoptedKVPath(),
 			})
 		if err != nil {
-			http.Error(w, jsonOutput(map[string]string{"error": "could not retrieve the user list:\n" + err.Error()}), http.StatusInternalServerError)
+			http.Error(w, jsonOutput(map[string]string{"error": "could not retrieve the expiring certificates:\n" + err.Error()}), http.StatusInternalServerError)
 			log.Println(err)
 			return
 		}
-		b, err := json.MarshalIndent(users, "", "  ")
+		metrics.SetCertificateExpiry(report.SoonestExpiry)
+		b, err := json.MarshalIndent(report.Expiring, "", "  ")
 		fmt.Fprintln(w, string(b))
 	}
 }
 
-func healthzHandler(vc vault.AuthenticatedClient) http.HandlerFunc {
+func listEndpointsHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		client, err := vc.GetClient()
+		statuses, err := operations.ListEndpointsCRLStatus()
 		if err != nil {
+			http.Error(w, jsonOutput(map[string]string{"error": "could not list the Client VPN endpoints:\n" + err.Error()}), http.StatusInternalServerError)
 			log.Println(err)
 			return
 		}
-		// Try to do a ListUsers to check health
-		_, err = operations.ListUsers(
-			&operations.ListUsersRequest{
-				Client:       client,
-				VaultPKIPath: viper.GetStringSlice("vault-pki-paths")[len(viper.GetStringSlice("vault-pki-paths"))-1],
-			})
-		if err != nil {
-			http.Error(w, jsonOutput(map[string]string{
-				"status": "ko",
-				"error":  err.Error()}),
-				http.StatusInternalServerError)
+		b, err := json.MarshalIndent(statuses, "", "  ")
+		fmt.Fprintln(w, string(b))
+	}
+}
+
+// invalidateEndpointConfigHandler drops the cached configs of the
+// endpoints, so the next issuance exports the config again
+func invalidateEndpointConfigHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		endpointConfigCache.Invalidate(r.URL.Query().Get("endpoint-id"))
+		fmt.Fprintln(w, jsonOutput(map[string]string{"result": "success"}))
+	}
+}
+
+// healthzHandler is the liveness probe, it only checks that the server
+// is up. It also reports the status of the reconciler, if enabled.
+func healthzHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if reconcile == nil {
+			fmt.Fprintln(w, jsonOutput(map[string]string{"status": "ok"}))
 			return
 		}
-
-		fmt.Fprintln(w, jsonOutput(map[string]string{"status": "ok"}))
+		b, err := json.MarshalIndent(map[string]interface{}{"status": "ok", "reconciler": reconcile.Status()}, "", "  ")
+		if err != nil {
+			log.Panic("Error marhsalling the response json")
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintln(w, string(b))
 	}
 }
 
+// readiness caches the result of the readiness checks, so
+// the probes don't hammer Vault and the AWS API
+type readiness struct {
+	sync.Mutex
+	checkedAt time.Time
+	checks    map[string]operations.HealthCheck
+	ready     bool
+}
+
+// readyzHandler is the readiness probe, it checks that Vault
+// and the AWS Client VPN endpoint are usable
 func readyzHandler(vc vault.AuthenticatedClient) http.HandlerFunc {
+	cache := &readiness{}
 	return func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprintln(w, "OK")
+		// Fail right away on shutdown so no new requests are routed here
+		if atomic.LoadInt32(&shuttingDown) == 1 {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintln(w, jsonOutput(map[string]string{"status": "ko", "error": "shutting down"}))
+			return
+		}
+		cache.Lock()
+		if time.Since(cache.checkedAt) > viper.GetDuration("readiness-cache-ttl") {
+			client, err := vc.GetClient()
+			if err != nil {
+				cache.checks = map[string]operations.HealthCheck{"vault-token": {Status: "ko", Error: err.Error()}}
+				cache.ready = false
+			} else {
+				cache.checks, cache.ready = operations.CheckReadiness(
+					&operations.ReadinessRequest{
+						Client:              client,
+						VaultPKIPath:        viper.GetStringSlice("vault-pki-paths")[len(viper.GetStringSlice("vault-pki-paths"))-1],
+						ClientVPNEndpointID: viper.GetString("client-vpn-endpoint-id"),
+						Timeout:             viper.GetDuration("readiness-check-timeout"),
+					})
+			}
+			cache.checkedAt = time.Now()
+		}
+		status, code := "ok", http.StatusOK
+		if !cache.ready {
+			status, code = "ko", http.StatusServiceUnavailable
+		}
+		b, err := json.MarshalIndent(map[string]interface{}{"status": status, "checks": cache.checks}, "", "  ")
+		cache.Unlock()
+		if err != nil {
+			log.Panic("Error marhsalling the response json")
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		fmt.Fprintln(w, string(b))
+	}
+}
+
+// setupStorage sets up the encryption of the private
+// keys and the storage of the VPN configs in S3
+func setupStorage() {
+	if keyID := viper.GetString("private-key-kms-key-id"); keyID != "" {
+		envelope = &operations.KMSEnvelope{KeyID: keyID}
+	}
+	if bucket := viper.GetString("config-store-s3-bucket"); bucket != "" {
+		configStore = &operations.ConfigStore{
+			Bucket:   bucket,
+			Prefix:   viper.GetString("config-store-s3-prefix"),
+			KMSKeyID: viper.GetString("config-store-kms-key-id"),
+		}
+		if configStore.KMSKeyID == "" {
+			configStore.KMSKeyID = viper.GetString("private-key-kms-key-id")
+		}
+	}
+}
+
+// awsConfig returns the config of the EC2 clients of the operations,
+// nil to only use the one of the environment
+func awsConfig() *aws.Config {
+	region, maxRetries := viper.GetString("aws-region"), viper.GetInt("aws-max-retries")
+	if region == "" && maxRetries < 0 {
+		return nil
 	}
+	cfg := aws.NewConfig()
+	if region != "" {
+		cfg = cfg.WithRegion(region)
+	}
+	if maxRetries >= 0 {
+		cfg = cfg.WithMaxRetries(maxRetries)
+	}
+	return cfg
+}
+
+// updateCRLOptions returns the CRL update settings from the config
+func updateCRLOptions(ctx context.Context, logger logging.Logger, actor string) operations.UpdateCRLOptions {
+	opts := operations.UpdateCRLOptions{
+		Context:                   ctx,
+		Logger:                    logger,
+		Actor:                     actor,
+		CRLSizeWarnThreshold:      viper.GetInt("crl-size-warn-threshold"),
+		CRLSizeWarnPercent:        viper.GetFloat64("crl-size-warn-percent"),
+		CRLMaxSize:                viper.GetInt("crl-max-size"),
+		VerifyEndpointCA:          viper.GetBool("verify-endpoint-ca"),
+		VerifyCRLSignature:        viper.GetBool("verify-crl-signature"),
+		RevocationGracePeriod:     viper.GetDuration("revocation-grace-period"),
+		BackupWriter:              crlBackup,
+		FailOnBackupError:         viper.GetBool("crl-backup-fail-on-error"),
+		CRLPath:                   viper.GetString("vault-crl-path"),
+		IssuerRef:                 viper.GetString("vault-pki-issuer"),
+		MaxCRLShrink:              viper.GetFloat64("crl-max-shrink"),
+		SNSTopicARN:               viper.GetString("sns-topic-arn"),
+		FailOnSNSError:            viper.GetBool("sns-fail-on-error"),
+		ContinueOnRevocationError: viper.GetBool("crl-continue-on-revocation-error"),
+		CheckCapabilities:         !viper.GetBool("skip-capabilities-check"),
+		RevocationKVPath:          viper.GetString("vault-kv-path"),
+		SuspensionKVPath:          viper.GetString("vault-kv-path"),
+	}
+	if viper.GetBool("crl-lock-vault") {
+		opts.VaultLockKVPath = viper.GetString("vault-kv-path")
+	}
+	opts.AdoptedKVPath = adoptedKVPath()
+	opts.CRLHistoryKVPath = crlHistoryKVPath()
+	opts.CRLHistoryVersions = viper.GetInt("crl-history-versions")
+	opts.Audit = auditor
+	opts.VaultTimeout = viper.GetDuration("vault-timeout")
+	opts.AWSTimeout = viper.GetDuration("aws-timeout")
+	opts.OperationTimeout = viper.GetDuration("operation-timeout")
+	opts.UsersCache = usersCache
+	opts.CertificateIndex = certificateIndex
+	opts.ConfigStore = configStore
+	opts.Envelope = envelope
+	opts.AWSConfig = awsConfig()
+	opts.Retry = retryPolicy()
+	return opts
+}
+
+// retryPolicy returns the policy the Vault and AWS calls are retried with
+func retryPolicy() *operations.RetryPolicy {
+	return &operations.RetryPolicy{
+		MaxAttempts:    viper.GetInt("retry-max-attempts"),
+		InitialBackoff: viper.GetDuration("retry-initial-backoff"),
+		MaxBackoff:     viper.GetDuration("retry-max-backoff"),
+		Deadline:       viper.GetDuration("retry-deadline"),
+	}
+}
+
+// crlHistoryKVPath returns the kv store of the
+// CRL history, or "" if it is not enabled
+func crlHistoryKVPath() string {
+	if viper.GetBool("crl-history") {
+		return viper.GetString("vault-kv-path")
+	}
+	return ""
+}
+
+// denyListKVPath returns the kv store of the
+// deny-list, or "" if it is not enabled
+func denyListKVPath() string {
+	if viper.GetBool("deny-list") {
+		return viper.GetString("vault-kv-path")
+	}
+	return ""
+}
+
+// denyListOnRevoke returns whether the revoked
+// users are added to the deny-list
+func denyListOnRevoke() bool {
+	return viper.GetBool("deny-list") && viper.GetBool("deny-list-on-revoke")
+}
+
+// newUserDirectory returns the directory checked before issuing
+// the certificates, or nil if directory-provider is not set
+func newUserDirectory() (directory.Checker, error) {
+	var checker directory.Checker
+	switch viper.GetString("directory-provider") {
+	case "":
+		return nil, nil
+	case "ldap":
+		if viper.GetString("directory-ldap-url") == "" || viper.GetString("directory-ldap-base-dn") == "" {
+			return nil, errors.New("directory-ldap-url and directory-ldap-base-dn are required by the ldap directory provider")
+		}
+		if !strings.Contains(viper.GetString("directory-ldap-filter"), "{username}") {
+			return nil, errors.New("directory-ldap-filter must contain {username}")
+		}
+		checker = &directory.LDAPChecker{
+			URL:             viper.GetString("directory-ldap-url"),
+			StartTLS:        viper.GetBool("directory-ldap-start-tls"),
+			BindDN:          viper.GetString("directory-ldap-bind-dn"),
+			BindPassword:    viper.GetString("directory-ldap-bind-password"),
+			BaseDN:          viper.GetString("directory-ldap-base-dn"),
+			Filter:          viper.GetString("directory-ldap-filter"),
+			ActiveAttribute: viper.GetString("directory-ldap-active-attribute"),
+			ActiveValues:    viper.GetStringSlice("directory-ldap-active-values"),
+			Group:           viper.GetString("directory-ldap-group"),
+			Timeout:         viper.GetDuration("directory-timeout"),
+		}
+	case "http":
+		if !strings.Contains(viper.GetString("directory-http-url"), "{username}") {
+			return nil, errors.New("directory-http-url must be set and contain {username}")
+		}
+		checker = &directory.HTTPChecker{
+			URL:     viper.GetString("directory-http-url"),
+			Token:   viper.GetString("directory-http-token"),
+			Timeout: viper.GetDuration("directory-timeout"),
+		}
+	default:
+		return nil, fmt.Errorf("Unknown directory provider '%s'", viper.GetString("directory-provider"))
+	}
+	return directory.WithBypass(checker, viper.GetStringSlice("directory-bypass-users")), nil
+}
+
+// adoptedKVPath returns the kv store of the adopted
+// certificates, or "" if they are not tracked
+func adoptedKVPath() string {
+	if viper.GetBool("adopted-certificates") {
+		return viper.GetString("vault-kv-path")
+	}
+	return ""
+}
+
+// auditLog records the outcome of a mutating operation
+// in the audit log, if enabled
+func auditLog(e audit.Entry, err error) {
+	if auditor == nil {
+		return
+	}
+	e.EndpointID = viper.GetString("client-vpn-endpoint-id")
+	auditor.Log(e, err)
+}
+
+// notifyEvent sends the event to the configured notifier, if any
+func notifyEvent(e notify.Event) {
+	if notifier != nil {
+		notifier.Notify(e)
+	}
+}
+
+// notifyCRLUpdate sends the events for the outcome of an UpdateCRL:
+// the certificates it revoked and the upload, or failure, of the CRL
+func notifyCRLUpdate(res *operations.UpdateCRLResult, err error, caller, requestID string) {
+	endpoint := viper.GetString("client-vpn-endpoint-id")
+	if res != nil {
+		for user, serials := range res.RevokedSerials {
+			for _, serial := range serials {
+				notifyEvent(notify.Event{Type: notify.EventRevoked, Username: user, SerialNumber: serial, EndpointID: endpoint, Caller: caller, RequestID: requestID,
+					Reason: string(operations.ReasonSuperseded)})
+			}
+		}
+	}
+	// The CRL is still uploaded when only some of the revocations failed
+	if err != nil && !errors.Is(err, operations.ErrPartialRevocation) {
+		notifyEvent(notify.Event{Type: notify.EventCRLUploadFailed, EndpointID: endpoint, Caller: caller, RequestID: requestID, Error: err.Error()})
+	} else if res != nil && res.AWSUpdated {
+		notifyEvent(notify.Event{Type: notify.EventCRLUploaded, EndpointID: endpoint, Caller: caller, RequestID: requestID})
+	}
+}
+
+// rateLimitResponse responds with a 429 if err is a *RateLimitError,
+// and returns whether it did
+func rateLimitResponse(w http.ResponseWriter, err error) bool {
+	var limitErr *operations.RateLimitError
+	if !errors.As(err, &limitErr) {
+		return false
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(limitErr.RetryAfter.Seconds()))))
+	http.Error(w, jsonOutput(map[string]string{"error": err.Error()}), http.StatusTooManyRequests)
+	return true
+}
+
+// deniedUserResponse responds with a 403 if err is a *DeniedUserError,
+// along with the deny-list entry, and returns whether it did
+func deniedUserResponse(w http.ResponseWriter, err error) bool {
+	var denied *operations.DeniedUserError
+	if !errors.As(err, &denied) {
+		return false
+	}
+	http.Error(w, jsonOutput(map[string]string{
+		"error":      err.Error(),
+		"reason":     denied.Entry.Reason,
+		"created-by": denied.Entry.CreatedBy,
+		"created-at": denied.Entry.CreatedAt.Format(time.RFC3339),
+	}), http.StatusForbidden)
+	return true
+}
+
+// suspendedUserResponse responds with a 403 if err is a
+// *UserSuspendedError, along with the suspension, and returns whether it did
+func suspendedUserResponse(w http.ResponseWriter, err error) bool {
+	var suspended *operations.UserSuspendedError
+	if !errors.As(err, &suspended) {
+		return false
+	}
+	http.Error(w, jsonOutput(map[string]string{
+		"error":        err.Error(),
+		"reason":       suspended.Suspension.Reason,
+		"suspended-by": suspended.Suspension.SuspendedBy,
+		"suspended-at": suspended.Suspension.SuspendedAt.Format(time.RFC3339),
+	}), http.StatusForbidden)
+	return true
+}
+
+// directoryResponse responds with a 403 if the user is not in the
+// directory, or with a 503 if the directory failed to check it, and
+// returns whether it did
+func directoryResponse(w http.ResponseWriter, err error) bool {
+	switch {
+	case errors.Is(err, operations.ErrNotInDirectory):
+		http.Error(w, jsonOutput(map[string]string{"error": err.Error()}), http.StatusForbidden)
+	case errors.Is(err, operations.ErrDirectoryUnavailable):
+		http.Error(w, jsonOutput(map[string]string{"error": err.Error()}), http.StatusServiceUnavailable)
+		log.Println(err)
+	default:
+		return false
+	}
+	return true
+}
+
+// timeoutResponse responds with a 504, along with the stage that
+// didn't complete in time, if the operation timed out, and returns
+// whether it did
+func timeoutResponse(w http.ResponseWriter, err error) bool {
+	var timeout *operations.TimeoutError
+	if !errors.As(err, &timeout) {
+		return false
+	}
+	rsp := map[string]string{
+		"error":   err.Error(),
+		"stage":   timeout.Stage,
+		"timeout": timeout.Timeout.String(),
+	}
+	if timeout.Operation != "" {
+		rsp["operation"] = timeout.Operation
+	}
+	http.Error(w, jsonOutput(rsp), http.StatusGatewayTimeout)
+	log.Println(err)
+	return true
+}
+
+// circuitOpenResponse responds with a 503 if err is a *CircuitOpenError,
+// with Retry-After set to when Vault will be probed again, and returns
+// whether it did
+func circuitOpenResponse(w http.ResponseWriter, err error) bool {
+	var circuitErr *operations.CircuitOpenError
+	if !errors.As(err, &circuitErr) {
+		return false
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(time.Until(circuitErr.Until).Seconds()))))
+	http.Error(w, jsonOutput(map[string]string{"error": err.Error()}), http.StatusServiceUnavailable)
+	return true
 }
 
 func jsonOutput(rsp map[string]string) string {
@@ -410,19 +3927,26 @@ func jsonOutput(rsp map[string]string) string {
 
 func authMiddleware(next http.Handler) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		var err error
 		var token string
 
-		// Check if this is a z endpoint (ie /healthz) in which case
-		// auth should be not enforced
-		zEndpoint, err := regexp.MatchString("(.*)z$", r.URL.Path)
-
-		// GitHub auth enabled
-		if !zEndpoint && viper.IsSet("auth-github-org") {
+		// The CN of the client certificate identifies the caller,
+		// unless it also authenticates with a token
+		if cn := clientCertCN(r); cn != "" {
+			r = r.WithContext(context.WithValue(r.Context(), callerContextKey, cn))
+		}
 
-			gh := GithubAuthOpts{
-				Organization: viper.GetString("auth-github-org"),
+		// Check if this is an exempted endpoint (ie /healthz)
+		// in which case auth should be not enforced
+		exempt := false
+		for _, path := range viper.GetStringSlice("auth-exempt-paths") {
+			if r.URL.Path == path {
+				exempt = true
+				break
 			}
+		}
+
+		// Static token or GitHub auth enabled
+		if !exempt && authEnabled() {
 
 			if r.Header.Get("Authorization") != "" {
 
@@ -431,36 +3955,190 @@ func authMiddleware(next http.Handler) http.HandlerFunc {
 				if len(h) == 2 && h[0] == "Bearer" {
 					token = h[1]
 				} else {
-					err = errors.New("malformed 'Authentication' header")
-					http.Error(w, jsonOutput(map[string]string{"error": "unauthenticated: " + err.Error()}), http.StatusInternalServerError)
+					http.Error(w, jsonOutput(map[string]string{"error": "unauthenticated: malformed 'Authorization' header"}), http.StatusUnauthorized)
 					return
 				}
 			}
-
-			gh.Token = token
-			if viper.IsSet("auth-github-users") {
-				gh.AllowedUsers = viper.GetStringSlice("auth-github-users")
-			} else {
-				gh.AllowedUsers = []string{}
-			}
-			if viper.IsSet("auth-github-teams") {
-				gh.AllowedTeams = viper.GetStringSlice("auth-github-teams")
-			} else {
-				gh.AllowedTeams = []string{}
+			if token == "" {
+				http.Error(w, jsonOutput(map[string]string{"error": "unauthenticated: missing bearer token"}), http.StatusUnauthorized)
+				return
 			}
 
-			err = GithubAuth(&gh)
-
+			caller, err := authenticate(token)
 			if err != nil {
-				http.Error(w, jsonOutput(map[string]string{"error": "unauthenticated: " + err.Error()}), http.StatusInternalServerError)
+				code := http.StatusInternalServerError
+				if errors.Is(err, errInvalidToken) {
+					code = http.StatusUnauthorized
+				}
+				http.Error(w, jsonOutput(map[string]string{"error": "unauthenticated: " + err.Error()}), code)
 				return
 			}
+			r = r.WithContext(context.WithValue(r.Context(), callerContextKey, caller))
 		}
 		// Hanle request to the next handler in the chain
 		next.ServeHTTP(w, r)
 	}
 }
 
+// errInvalidToken is returned by authenticate when the token is not
+// one of the static tokens and GitHub auth is not enabled
+var errInvalidToken = errors.New("invalid bearer token")
+
+// authEnabled returns whether the API requires a bearer token
+func authEnabled() bool {
+	return len(authTokens) > 0 || viper.IsSet("auth-github-org")
+}
+
+// authenticate returns the name of the caller the bearer token belongs
+// to, checking it first against the static tokens and then, if enabled,
+// against GitHub
+func authenticate(token string) (string, error) {
+	if name, ok := staticTokenAuth(authTokens, token); ok {
+		return name, nil
+	}
+	if !viper.IsSet("auth-github-org") {
+		return "", errInvalidToken
+	}
+
+	gh := GithubAuthOpts{
+		Organization: viper.GetString("auth-github-org"),
+		Token:        token,
+	}
+	if viper.IsSet("auth-github-users") {
+		gh.AllowedUsers = viper.GetStringSlice("auth-github-users")
+	} else {
+		gh.AllowedUsers = []string{}
+	}
+	if viper.IsSet("auth-github-teams") {
+		gh.AllowedTeams = viper.GetStringSlice("auth-github-teams")
+	} else {
+		gh.AllowedTeams = []string{}
+	}
+	return GithubAuth(&gh)
+}
+
+type contextKey string
+
+// callerContextKey holds the login of the authenticated API caller
+const callerContextKey contextKey = "caller"
+
+// requestIDContextKey holds the ID of the request
+const requestIDContextKey contextKey = "request-id"
+
+// requestIDHeader is the header used to pass the request ID
+const requestIDHeader = "X-Request-ID"
+
+// validRequestID limits the IDs accepted from the clients, as they
+// end up in the logs
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,128}$`)
+
+// requestIDMiddleware assigns an ID to each request, or keeps the one
+// passed by the client in the X-Request-ID header, and returns it in
+// the response headers. The ID is added to the logs of the operations
+// run for the request, to the audit log and to the notifications.
+func requestIDMiddleware(next http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDContextKey, id)))
+	}
+}
+
+// newRequestID generates a random request ID
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		log.Panic("Error generating a request ID")
+	}
+	return hex.EncodeToString(b)
+}
+
+// requestID returns the ID of the request
+func requestID(r *http.Request) string {
+	return contextRequestID(r.Context())
+}
+
+// requestLogger returns the logger to pass to the operations
+// run for the request, which adds the request ID to every entry
+func requestLogger(r *http.Request) logging.Logger {
+	return contextLogger(r.Context())
+}
+
+// requestCaller returns who made the request, for the notifications
+func requestCaller(r *http.Request) string {
+	return contextCaller(r.Context())
+}
+
+// contextRequestID, contextLogger and contextCaller behave as their
+// request counterparts for the context of an HTTP request or gRPC call
+func contextRequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDContextKey).(string)
+	return id
+}
+
+func contextLogger(ctx context.Context) logging.Logger {
+	return logging.Default().With("request_id", contextRequestID(ctx))
+}
+
+func contextCaller(ctx context.Context) string {
+	if login, ok := ctx.Value(callerContextKey).(string); ok {
+		return login
+	}
+	return "anonymous"
+}
+
+// authToken is a static bearer token accepted by the API. Only the
+// hash of the token is kept, so all compare in the same time whatever
+// their length.
+type authToken struct {
+	name string
+	hash [sha256.Size]byte
+}
+
+// loadAuthTokens parses the static tokens from "name:token" entries.
+// The name is recorded as the caller of the requests made with the
+// token. Empty entries and entries starting with '#' are skipped.
+func loadAuthTokens(entries []string) ([]authToken, error) {
+	var tokens []authToken
+	names := map[string]bool{}
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		i := strings.Index(entry, ":")
+		if i <= 0 || i == len(entry)-1 {
+			return nil, errors.New("malformed entry, expected 'name:token'")
+		}
+		name := entry[:i]
+		if names[name] {
+			return nil, fmt.Errorf("duplicated token name '%s'", name)
+		}
+		names[name] = true
+		tokens = append(tokens, authToken{name: name, hash: sha256.Sum256([]byte(entry[i+1:]))})
+	}
+	return tokens, nil
+}
+
+// staticTokenAuth returns the name of the static token that matches the
+// given one. The token is compared against all of them in constant time,
+// so the time taken doesn't tell which one matched, if any.
+func staticTokenAuth(tokens []authToken, token string) (string, bool) {
+	hash := sha256.Sum256([]byte(token))
+	name := ""
+	match := 0
+	for _, t := range tokens {
+		if subtle.ConstantTimeCompare(hash[:], t.hash[:]) == 1 {
+			name = t.name
+			match = 1
+		}
+	}
+	return name, match == 1
+}
+
 // GithubAuthOpts configured this auth backend
 type GithubAuthOpts struct {
 	Token        string
@@ -470,8 +4148,9 @@ type GithubAuthOpts struct {
 }
 
 // GithubAuth validates if the provided Github personal token
-// has access to the server by talking to the Github API.
-func GithubAuth(gh *GithubAuthOpts) error {
+// has access to the server by talking to the Github API. The
+// login of the token's user is returned on success.
+func GithubAuth(gh *GithubAuthOpts) (string, error) {
 
 	allowedUser := false
 	allowedTeam := false
@@ -487,7 +4166,7 @@ func GithubAuth(gh *GithubAuthOpts) error {
 	// Get the user
 	user, _, err := client.Users.Get(ctx, "")
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	// Verify that the user is part of the organization
@@ -500,7 +4179,7 @@ func GithubAuth(gh *GithubAuthOpts) error {
 	for {
 		orgs, resp, err := client.Organizations.List(ctx, "", orgOpt)
 		if err != nil {
-			return err
+			return "", err
 		}
 		allOrgs = append(allOrgs, orgs...)
 		if resp.NextPage == 0 {
@@ -516,7 +4195,7 @@ func GithubAuth(gh *GithubAuthOpts) error {
 		}
 	}
 	if org == nil {
-		return errors.New("user is not part of required org")
+		return "", errors.New("user is not part of required org")
 	}
 
 	if len(gh.AllowedTeams) != 0 {
@@ -529,7 +4208,7 @@ func GithubAuth(gh *GithubAuthOpts) error {
 		for {
 			teams, resp, err := client.Teams.ListUserTeams(ctx, teamOpt)
 			if err != nil {
-				return err
+				return "", err
 			}
 			allTeams = append(allTeams, teams...)
 			if resp.NextPage == 0 {
@@ -576,12 +4255,12 @@ func GithubAuth(gh *GithubAuthOpts) error {
 	// If neither AllowedTeams not AllowedUsers is set, any user
 	// that belongs to the organization is allowed
 	if len(gh.AllowedTeams) == 0 && len(gh.AllowedUsers) == 0 && org != nil {
-		return nil
+		return *user.Login, nil
 	} else if len(gh.AllowedUsers) > 0 && allowedUser && org != nil {
-		return nil
+		return *user.Login, nil
 	} else if len(gh.AllowedTeams) > 0 && allowedTeam && org != nil {
-		return nil
+		return *user.Login, nil
 	}
 
-	return errors.New("The user does not match any of the allowed users/teams")
+	return "", errors.New("The user does not match any of the allowed users/teams")
 }
@@ -0,0 +1,1003 @@
+package app
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/audit"
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/logging"
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/mail"
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/notify"
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/operations"
+	"github.com/robfig/cron"
+	"github.com/spf13/viper"
+)
+
+// startServe runs serve on a random port with the given handler and
+// returns the address, the signal channel, a channel closed when
+// serve returns and the context cancelled by serve on shutdown
+func startServe(t *testing.T, h http.Handler, delay, drainPeriod time.Duration) (string, chan os.Signal, chan struct{}, context.Context) {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: h}
+	sig := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		serve(ctx, cancel, srv, nil, cron.New(), func() error { return srv.Serve(lis) }, sig, delay, drainPeriod)
+		close(done)
+	}()
+	return "http://" + lis.Addr().String(), sig, done, ctx
+}
+
+func get(url string) (*http.Response, error) {
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	return client.Get(url)
+}
+
+func TestServeDrainsInFlightRequests(t *testing.T) {
+	started := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/readyz", readyzHandler(nil))
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(600 * time.Millisecond)
+		w.Write([]byte("done"))
+	})
+	defer atomic.StoreInt32(&shuttingDown, 0)
+	addr, sig, done, _ := startServe(t, mux, 200*time.Millisecond, 5*time.Second)
+
+	type result struct {
+		body string
+		err  error
+	}
+	slow := make(chan result, 1)
+	go func() {
+		resp, err := get(addr + "/slow")
+		if err != nil {
+			slow <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+		slow <- result{string(b), err}
+	}()
+	<-started
+	sig <- syscall.SIGTERM
+
+	// The probe fails during the shutdown delay, while still accepting requests
+	time.Sleep(50 * time.Millisecond)
+	resp, err := get(addr + "/readyz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("got %d from /readyz on shutdown, want 503", resp.StatusCode)
+	}
+
+	// After the delay no new connections are accepted, even if the slow request is running
+	time.Sleep(250 * time.Millisecond)
+	if _, err := get(addr + "/readyz"); err == nil {
+		t.Error("a new request was accepted after the shutdown delay")
+	}
+	select {
+	case <-done:
+		t.Fatal("serve returned before the in-flight request finished")
+	default:
+	}
+
+	r := <-slow
+	if r.err != nil || r.body != "done" {
+		t.Errorf("got %q, %v from the in-flight request", r.body, r.err)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("serve didn't return after draining the requests")
+	}
+}
+
+func TestServeCancelsRequestsAfterDrainPeriod(t *testing.T) {
+	started := make(chan struct{})
+	cancelled := make(chan error, 1)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stuck", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		select {
+		case <-r.Context().Done():
+			cancelled <- r.Context().Err()
+		case <-time.After(5 * time.Second):
+			cancelled <- nil
+		}
+	})
+	defer atomic.StoreInt32(&shuttingDown, 0)
+	addr, sig, done, _ := startServe(t, mux, 0, 200*time.Millisecond)
+
+	go get(addr + "/stuck")
+	<-started
+	sig <- syscall.SIGTERM
+
+	select {
+	case err := <-cancelled:
+		if err == nil {
+			t.Error("the context of the request wasn't cancelled")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the request was not cancelled after the drain period")
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("serve didn't return after the drain period")
+	}
+	if _, err := get(addr + "/stuck"); err == nil {
+		t.Error("a new request was accepted after the shutdown")
+	}
+}
+
+// useBlockedEC2 returns a fake endpoint whose imports of the CRL
+// block, with a first revoked certificate so there is one to import
+func useBlockedEC2(t *testing.T, v *fakeVault) *fakeEC2 {
+	ec2 := useFakeEC2(t, viper.GetString("client-vpn-endpoint-id"))
+	ec2.block = make(chan struct{})
+	ec2.importing = make(chan struct{}, 1)
+	t.Cleanup(func() { close(ec2.block) })
+	v.revoke(v.addCertificate("alice", time.Now().Add(-time.Hour), 24*time.Hour))
+	return ec2
+}
+
+func TestServeCancelsOperationsAfterDrainPeriod(t *testing.T) {
+	v := useFakeVault(t)
+	ec2 := useBlockedEC2(t, v)
+
+	// The response is recorded, as the connection is closed once the drain period is over
+	recorded := make(chan *httptest.ResponseRecorder, 1)
+	router := newRouter(v.vaultClient())
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, r)
+		// serve must wait for the handler to return
+		time.Sleep(100 * time.Millisecond)
+		recorded <- rec
+	})
+	defer atomic.StoreInt32(&shuttingDown, 0)
+	addr, sig, done, _ := startServe(t, h, 0, 200*time.Millisecond)
+
+	go func() {
+		client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+		if resp, err := client.Post(addr+"/crl", "application/json", nil); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	<-ec2.importing
+	sig <- syscall.SIGTERM
+
+	select {
+	case <-done:
+		t.Fatal("serve returned before the cancelled update of the CRL stopped")
+	case rec := <-recorded:
+		if rec.Code != http.StatusInternalServerError || !strings.Contains(rec.Body.String(), context.Canceled.Error()) {
+			t.Errorf("got status %d: %s, want the update of the CRL cancelled", rec.Code, rec.Body)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the update of the CRL was not cancelled after the drain period")
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("serve didn't return after the update of the CRL was cancelled")
+	}
+}
+
+func TestServeCancelsScheduledJobsAfterDrainPeriod(t *testing.T) {
+	v := useFakeVault(t)
+	ec2 := useBlockedEC2(t, v)
+	defer atomic.StoreInt32(&shuttingDown, 0)
+	_, sig, done, ctx := startServe(t, http.NotFoundHandler(), 0, 200*time.Millisecond)
+
+	job := make(chan error, 1)
+	scheduledJobs.Add(1)
+	go func() {
+		defer scheduledJobs.Done()
+		_, err := reconcileCRL(ctx, v.vaultClient())
+		// serve must wait for the job to return
+		time.Sleep(100 * time.Millisecond)
+		job <- err
+	}()
+	<-ec2.importing
+	sig <- syscall.SIGTERM
+
+	select {
+	case <-done:
+		t.Fatal("serve returned before the cancelled job stopped")
+	case err := <-job:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("got error %v from the scheduled job, want it cancelled", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the scheduled job was not cancelled after the drain period")
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("serve didn't return after the scheduled job was cancelled")
+	}
+}
+
+func TestConfigureServerRejectsBrokenTemplate(t *testing.T) {
+	setDefault(t, "insecure", true)
+	tests := []struct {
+		name string
+		key  string
+		want string
+	}{
+		{"template text", "config-template", "Invalid OpenVPN config template: template: config.ovpn:2: unexpected EOF"},
+		{"template file", "config-template-path", "Invalid OpenVPN config template: template: broken.ovpn.tpl:2: unexpected EOF"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			value := "{{if .Cert}}\n<cert>{{.Cert}}</cert>"
+			if tt.key == "config-template-path" {
+				value = filepath.Join(t.TempDir(), "broken.ovpn.tpl")
+				if err := ioutil.WriteFile(value, []byte("{{if .Cert}}\n<cert>{{.Cert}}</cert>"), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			setDefault(t, tt.key, value)
+			err := configureServer()
+			if err == nil || err.Error() != tt.want {
+				t.Errorf("got error %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfigureServerValidatesCRLMaxShrink(t *testing.T) {
+	setDefault(t, "insecure", true)
+	for _, shrink := range []float64{0, -0.5, 1.5} {
+		setDefault(t, "crl-max-shrink", shrink)
+		err := configureServer()
+		if err == nil || !strings.Contains(err.Error(), "Invalid crl-max-shrink") {
+			t.Errorf("got error %v with crl-max-shrink %v, want it rejected", err, shrink)
+		}
+	}
+	for _, shrink := range []float64{0.5, 1} {
+		setDefault(t, "crl-max-shrink", shrink)
+		if err := configureServer(); err != nil && strings.Contains(err.Error(), "crl-max-shrink") {
+			t.Errorf("got error %s with crl-max-shrink %v, want it accepted", err, shrink)
+		}
+	}
+}
+
+// logEntry is an entry written to a captureLogger
+type logEntry struct {
+	level  string
+	msg    string
+	fields map[string]interface{}
+}
+
+// captureLogger keeps the entries written to it and to the loggers
+// derived from it with With
+type captureLogger struct {
+	mu      *sync.Mutex
+	entries *[]logEntry
+	keyvals []interface{}
+}
+
+// useCaptureLogger makes the capturing logger the default one until the test is done
+func useCaptureLogger(t *testing.T) *captureLogger {
+	l := &captureLogger{mu: &sync.Mutex{}, entries: &[]logEntry{}}
+	old := logging.Default()
+	logging.SetDefault(l)
+	t.Cleanup(func() { logging.SetDefault(old) })
+	return l
+}
+
+func (l *captureLogger) log(level, msg string, keyvals []interface{}) {
+	e := logEntry{level: level, msg: msg, fields: map[string]interface{}{}}
+	kv := append(append([]interface{}{}, l.keyvals...), keyvals...)
+	for i := 0; i+1 < len(kv); i += 2 {
+		e.fields[fmt.Sprint(kv[i])] = kv[i+1]
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	*l.entries = append(*l.entries, e)
+}
+
+func (l *captureLogger) Debug(msg string, keyvals ...interface{}) { l.log("debug", msg, keyvals) }
+func (l *captureLogger) Info(msg string, keyvals ...interface{})  { l.log("info", msg, keyvals) }
+func (l *captureLogger) Warn(msg string, keyvals ...interface{})  { l.log("warn", msg, keyvals) }
+func (l *captureLogger) Error(msg string, keyvals ...interface{}) { l.log("error", msg, keyvals) }
+
+func (l *captureLogger) With(keyvals ...interface{}) logging.Logger {
+	return &captureLogger{mu: l.mu, entries: l.entries, keyvals: append(append([]interface{}{}, l.keyvals...), keyvals...)}
+}
+
+// find returns the entries with the message
+func (l *captureLogger) find(msg string) []logEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var found []logEntry
+	for _, e := range *l.entries {
+		if e.msg == msg {
+			found = append(found, e)
+		}
+	}
+	return found
+}
+
+func TestRequestIDInUpdateCRLLogs(t *testing.T) {
+	v := useFakeVault(t)
+	useFakeEC2(t, viper.GetString("client-vpn-endpoint-id"))
+	logs := useCaptureLogger(t)
+	v.addCertificate("alice", time.Now().Add(-2*time.Hour), 24*time.Hour)
+	v.addCertificate("alice", time.Now().Add(-time.Hour), 24*time.Hour)
+	h := requestIDMiddleware(newRouter(v.vaultClient()))
+
+	tests := []struct {
+		name   string
+		header string
+		want   string
+	}{
+		{"passed by the client", "req-42", "req-42"},
+		{"generated", "", ""},
+		{"invalid one replaced", "req 42\n", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// So there is a new CRL to import
+			v.revoke(v.addCertificate("bob", time.Now().Add(-time.Hour), 24*time.Hour))
+			*logs.entries = nil
+			r := httptest.NewRequest(http.MethodPost, "/crl", nil)
+			if tt.header != "" {
+				r.Header.Set(requestIDHeader, tt.header)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != http.StatusOK {
+				t.Fatalf("got status %d: %s", w.Code, w.Body)
+			}
+
+			id := w.Header().Get(requestIDHeader)
+			if tt.want != "" && id != tt.want {
+				t.Errorf("got request ID %q, want %q", id, tt.want)
+			}
+			if !validRequestID.MatchString(id) || id == tt.header && tt.want == "" {
+				t.Errorf("got request ID %q, want a generated one", id)
+			}
+			// The entries logged by UpdateCRL, nested in the ones of the request
+			entries := logs.find("CRL entries changed")
+			if len(entries) != 1 {
+				t.Fatalf("got %d CRL update log entries, want 1: %v", len(entries), *logs.entries)
+			}
+			if got := entries[0].fields["request_id"]; got != id {
+				t.Errorf("got request_id %v in the log entry, want %q", got, id)
+			}
+			if got := entries[0].fields["endpoint_id"]; got != viper.GetString("client-vpn-endpoint-id") {
+				t.Errorf("got endpoint_id %v in the log entry", got)
+			}
+			for _, e := range *logs.entries {
+				if e.fields["request_id"] != id {
+					t.Errorf("got request_id %v in the log entry %q, want %q", e.fields["request_id"], e.msg, id)
+				}
+			}
+		})
+	}
+}
+
+func TestGetCRLFormats(t *testing.T) {
+	v := useFakeVault(t)
+	serial := v.addCertificate("alice", time.Now().Add(-time.Hour), 24*time.Hour)
+	v.revoke(serial)
+	router := newRouter(v.vaultClient())
+	request := func(query, accept, ifNoneMatch string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/crl"+query, nil)
+		if accept != "" {
+			r.Header.Set("Accept", accept)
+		}
+		if ifNoneMatch != "" {
+			r.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	tests := []struct {
+		name        string
+		query       string
+		accept      string
+		contentType string
+		der         func(t *testing.T, body []byte) []byte
+	}{
+		{"json", "", "", "application/json", func(t *testing.T, body []byte) []byte {
+			var rsp map[string]string
+			if err := json.Unmarshal(body, &rsp); err != nil {
+				t.Fatal(err)
+			}
+			return pemCRL(t, rsp["crl"])
+		}},
+		{"pem", "", "application/x-pem-file", "application/x-pem-file", func(t *testing.T, body []byte) []byte {
+			return pemCRL(t, string(body))
+		}},
+		{"der", "?format=der", "", "application/pkix-crl", func(t *testing.T, body []byte) []byte {
+			return body
+		}},
+	}
+	etags := map[string]bool{}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := request(tt.query, tt.accept, "")
+			if w.Code != http.StatusOK {
+				t.Fatalf("got status %d: %s", w.Code, w.Body)
+			}
+			if got := w.Header().Get("Content-Type"); got != tt.contentType {
+				t.Errorf("got Content-Type %q, want %q", got, tt.contentType)
+			}
+			crl, err := x509.ParseCRL(tt.der(t, w.Body.Bytes()))
+			if err != nil {
+				t.Fatalf("invalid CRL: %s", err)
+			}
+			if err := v.ca.CheckCRLSignature(crl); err != nil {
+				t.Errorf("invalid CRL signature: %s", err)
+			}
+			revoked := crl.TBSCertList.RevokedCertificates
+			if len(revoked) != 1 || vaultSerial(revoked[0].SerialNumber, ":") != serial {
+				t.Errorf("got revoked certificates %v, want %s", revoked, serial)
+			}
+
+			etag := w.Header().Get("ETag")
+			if etag == "" || etags[etag] {
+				t.Errorf("got ETag %q, want one for each format", etag)
+			}
+			etags[etag] = true
+			for _, tag := range []string{etag, `W/` + etag, `"other", ` + etag} {
+				w = request(tt.query, tt.accept, tag)
+				if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+					t.Errorf("got status %d and %d bytes with If-None-Match %s, want a 304", w.Code, w.Body.Len(), tag)
+				}
+			}
+			if w = request(tt.query, tt.accept, `"other"`); w.Code != http.StatusOK {
+				t.Errorf("got status %d with another ETag, want 200", w.Code)
+			}
+		})
+	}
+
+	// A new revocation changes the CRL and its ETag
+	w := request("?format=der", "", "")
+	v.revoke(v.addCertificate("bob", time.Now().Add(-time.Hour), 24*time.Hour))
+	if w = request("?format=der", "", w.Header().Get("ETag")); w.Code != http.StatusOK {
+		t.Errorf("got status %d after a revocation, want 200", w.Code)
+	}
+	if w = request("?format=pkcs7", "", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("got status %d with an unknown format, want 400", w.Code)
+	}
+}
+
+// pemCRL returns the DER of the PEM encoded CRL
+func pemCRL(t *testing.T, s string) []byte {
+	t.Helper()
+	block, rest := pem.Decode([]byte(s))
+	if block == nil || block.Type != "X509 CRL" || len(strings.TrimSpace(string(rest))) > 0 {
+		t.Fatalf("invalid PEM CRL: %q", s)
+	}
+	return block.Bytes
+}
+
+func TestIssueWithSANs(t *testing.T) {
+	v := useFakeVault(t)
+	useFakeEC2(t, viper.GetString("client-vpn-endpoint-id"))
+	router := newRouter(v.vaultClient())
+	issue := func(query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/issue/alice?"+query, nil))
+		return w
+	}
+
+	w := issue("alt_names=alice.corp.com,alice.eng.corp.com&ip_sans=10.0.0.1&email_sans=alice@corp.com")
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+	payloads := v.writes["pki/issue/client"]
+	if len(payloads) != 1 {
+		t.Fatalf("got %d issue requests, want 1", len(payloads))
+	}
+	for k, want := range map[string]interface{}{
+		"common_name": "alice",
+		"alt_names":   "alice.corp.com,alice.eng.corp.com,alice@corp.com",
+		"ip_sans":     "10.0.0.1",
+	} {
+		if got := payloads[0][k]; got != want {
+			t.Errorf("got %s %v in the payload, want %q", k, got, want)
+		}
+	}
+	if _, ok := payloads[0]["email_sans"]; ok {
+		t.Error("got email_sans in the payload, Vault takes the emails in alt_names")
+	}
+
+	var rsp map[string]string
+	if err := json.Unmarshal(w.Body.Bytes(), &rsp); err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode([]byte(rsp["config"][strings.Index(rsp["config"], "<cert>")+len("<cert>\n"):]))
+	if block == nil {
+		t.Fatalf("no certificate in the config:\n%s", rsp["config"])
+	}
+	crt, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(crt.DNSNames, crt.IPAddresses, crt.EmailAddresses) != "[alice.corp.com alice.eng.corp.com] [10.0.0.1] [alice@corp.com]" {
+		t.Errorf("got SANs %v %v %v in the certificate", crt.DNSNames, crt.IPAddresses, crt.EmailAddresses)
+	}
+}
+
+func TestIssueWithSANsRejected(t *testing.T) {
+	tests := []struct {
+		name   string
+		role   map[string]interface{}
+		query  string
+		want   string
+		issued int
+	}{
+		{"rejected by vault", nil, "alt_names=alice.other.com",
+			"san not allowed: vault rejected the certificate request: subject alternative name alice.other.com not allowed by this role", 1},
+		{"not in the allowed domains", map[string]interface{}{"allowed_domains": []string{"corp.com"}, "allow_subdomains": true}, "alt_names=alice.other.com",
+			"subject alternative name 'alice.other.com' is not allowed by role 'client': not in allowed_domains: corp.com", 0},
+		{"email not in the allowed domains", map[string]interface{}{"allowed_domains": "corp.com", "allow_bare_domains": true}, "email_sans=alice@other.com",
+			"subject alternative name 'alice@other.com' is not allowed by role 'client': domain not in allowed_domains: corp.com", 0},
+		{"ip sans not allowed", map[string]interface{}{"allow_any_name": true, "allow_ip_sans": false}, "ip_sans=10.0.0.1",
+			"subject alternative name '10.0.0.1' is not allowed by role 'client': allow_ip_sans is false", 0},
+		{"invalid ip", nil, "ip_sans=10.0.0", "san not allowed: invalid IP SAN '10.0.0'", 0},
+		{"invalid email", nil, "email_sans=alice", "san not allowed: invalid email SAN 'alice'", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := useFakeVault(t)
+			useFakeEC2(t, viper.GetString("client-vpn-endpoint-id"))
+			v.rejectSANs = "subject alternative name alice.other.com not allowed by this role"
+			if tt.role != nil {
+				v.roles["client"] = tt.role
+			}
+
+			w := httptest.NewRecorder()
+			newRouter(v.vaultClient()).ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/issue/alice?"+tt.query, nil))
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("got status %d, want 400: %s", w.Code, w.Body)
+			}
+			var rsp map[string]string
+			if err := json.Unmarshal(w.Body.Bytes(), &rsp); err != nil {
+				t.Fatal(err)
+			}
+			if want := "couldn't issue client certificate for user alice:\n" + tt.want; rsp["error"] != want {
+				t.Errorf("got error %q, want %q", rsp["error"], want)
+			}
+			// The names rejected by the role are not sent to Vault
+			if n := len(v.writes["pki/issue/client"]); n != tt.issued {
+				t.Errorf("got %d issue requests, want %d", n, tt.issued)
+			}
+		})
+	}
+}
+
+func TestIssueWithValidateBundles(t *testing.T) {
+	v := useFakeVault(t)
+	useFakeEC2(t, viper.GetString("client-vpn-endpoint-id"))
+	setDefault(t, "validate-bundles", true)
+	router := newRouter(v.vaultClient())
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/issue/alice", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+	if n := len(v.writes["pki/revoke"]); n != 0 {
+		t.Errorf("got %d revocations of the valid certificate", n)
+	}
+
+	v.wrongKeys = true
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/issue/bob", nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("got status %d, want 500: %s", w.Code, w.Body)
+	}
+	var rsp map[string]string
+	if err := json.Unmarshal(w.Body.Bytes(), &rsp); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(rsp["error"], "failed the validation: key_pair: ") {
+		t.Errorf("got error %q, want the key pair check to fail", rsp["error"])
+	}
+	// The invalid certificate is revoked, and not stored
+	revoked := v.writes["pki/revoke"]
+	if len(revoked) != 1 {
+		t.Fatalf("got %d revocations, want 1", len(revoked))
+	}
+	serial := strings.Replace(revoked[0]["serial_number"].(string), ":", "-", -1)
+	if !strings.Contains(rsp["error"], serial) {
+		t.Errorf("got error %q, want it to name %s", rsp["error"], serial)
+	}
+	if _, ok := v.revoked[serial]; !ok {
+		t.Errorf("certificate %s not revoked", serial)
+	}
+	if _, ok := v.secrets["users/alice/config.ovpn"]; !ok {
+		t.Error("config of the valid certificate not stored")
+	}
+	if _, ok := v.secrets["users/bob/config.ovpn"]; ok {
+		t.Error("config of the invalid certificate stored")
+	}
+}
+
+// newCSR returns the PEM of a CSR for the CN
+func newCSR(t *testing.T, cn string) string {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: pkix.Name{CommonName: cn}}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}))
+}
+
+func TestSignCSRCertLimit(t *testing.T) {
+	v := useFakeVault(t)
+	useFakeEC2(t, viper.GetString("client-vpn-endpoint-id"))
+	setDefault(t, "max-certs-per-user", 2)
+	v.addCertificate("alice", time.Now().Add(-2*time.Hour), 24*time.Hour)
+	second := v.addCertificate("alice", time.Now().Add(-time.Hour), 24*time.Hour)
+	router := newRouter(v.vaultClient())
+	sign := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/sign/alice", strings.NewReader(newCSR(t, "alice"))))
+		return w
+	}
+
+	w := sign()
+	if w.Code != http.StatusConflict {
+		t.Fatalf("got status %d, want 409: %s", w.Code, w.Body)
+	}
+	var rsp map[string]string
+	if err := json.Unmarshal(w.Body.Bytes(), &rsp); err != nil {
+		t.Fatal(err)
+	}
+	if rsp["count"] != "2" || rsp["limit"] != "2" {
+		t.Errorf("got %v, want the count and the limit", rsp)
+	}
+	if len(v.certs) != 3 {
+		t.Errorf("got %d certificates, want none signed over the limit", len(v.certs)-1)
+	}
+
+	// The oldest are revoked to make room for the new one instead
+	setDefault(t, "max-certs-revoke-oldest", true)
+	if w := sign(); w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+	if len(v.revoked) != 2 || v.revoked[strings.Replace(second, ":", "-", -1)].IsZero() {
+		t.Errorf("got revoked %v, want the previous certificates of alice revoked", v.revoked)
+	}
+}
+
+func TestAdoptedCertificatesUnderTheirUsers(t *testing.T) {
+	v := useFakeVault(t)
+	useFakeEC2(t, viper.GetString("client-vpn-endpoint-id"))
+	setDefault(t, "adopted-certificates", true)
+	serial := strings.Replace(v.addCertificate("legacy-host", time.Now().Add(-time.Hour), 24*time.Hour), ":", "-", -1)
+	v.secrets["adopted"] = map[string]interface{}{serial: "alice"}
+	router := newRouter(v.vaultClient())
+	get := func(path string, rsp interface{}) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: got status %d: %s", path, w.Code, w.Body)
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), rsp); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var records []map[string]interface{}
+	get("/report", &records)
+	if len(records) != 1 || records[0]["serial"] != serial || records[0]["username"] != "alice" {
+		t.Errorf("got report %v, want %s under alice", records, serial)
+	}
+
+	var expiring map[string][]map[string]interface{}
+	get("/expiring?window=720h", &expiring)
+	if crts := expiring["alice"]; len(crts) != 1 || crts[0]["serial"] != serial || len(expiring) != 1 {
+		t.Errorf("got expiring %v, want %s under alice", expiring, serial)
+	}
+
+	// The adopted certificate counts towards the limit of the user
+	setDefault(t, "max-certs-per-user", 1)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/issue/alice", nil))
+	if w.Code != http.StatusConflict {
+		t.Errorf("got status %d, want 409: %s", w.Code, w.Body)
+	}
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/issue/legacy-host", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("got status %d for the CN of the adopted certificate: %s", w.Code, w.Body)
+	}
+}
+
+// fakeMailer records the messages sent
+type fakeMailer struct {
+	sync.Mutex
+	sent []*mail.Message
+}
+
+func (m *fakeMailer) Send(from string, msg *mail.Message) error {
+	if _, err := msg.Bytes(from); err != nil {
+		return err
+	}
+	m.Lock()
+	defer m.Unlock()
+	m.sent = append(m.sent, msg)
+	return nil
+}
+
+func useFakeMailer(t *testing.T) *fakeMailer {
+	m := &fakeMailer{}
+	old := mailer
+	mailer = m
+	t.Cleanup(func() { mailer = old })
+	return m
+}
+
+func TestIssueEmailHeaderInjection(t *testing.T) {
+	v := useFakeVault(t)
+	useFakeEC2(t, viper.GetString("client-vpn-endpoint-id"))
+	m := useFakeMailer(t)
+	setDefault(t, "mail-from", "vpn@corp.com")
+	router := newRouter(v.vaultClient())
+
+	for _, email := range []string{"alice@corp.com\r\nBcc: eve@evil.com", "alice@corp.com\nBcc: eve@evil.com", "alice@corp.com, eve@evil.com", "alice"} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/issue/alice?email="+url.QueryEscape(email), nil))
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "invalid email") {
+			t.Errorf("%q: got status %d, want 400: %s", email, w.Code, w.Body)
+		}
+	}
+	if n := len(v.writes["pki/issue/client"]); n != 0 {
+		t.Errorf("got %d issue requests for the invalid addresses, want none", n)
+	}
+
+	// Nor can it be stored in the metadata
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/users/alice/metadata", strings.NewReader(`{"email":"alice@corp.com\r\nBcc: eve@evil.com"}`)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("got status %d setting the metadata, want 400: %s", w.Code, w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/issue/alice?email="+url.QueryEscape("Alice <alice@corp.com>"), nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+	if len(m.sent) != 1 || m.sent[0].To != "alice@corp.com" {
+		t.Fatalf("got messages %v, want one to alice@corp.com", m.sent)
+	}
+	raw, _ := m.sent[0].Bytes("vpn@corp.com")
+	if strings.Contains(string(raw), "Bcc") {
+		t.Errorf("got a Bcc header in the message:\n%s", raw)
+	}
+}
+
+// fakeNotifier records the events sent
+type fakeNotifier struct {
+	sync.Mutex
+	events []notify.Event
+}
+
+func (n *fakeNotifier) Notify(e notify.Event) {
+	n.Lock()
+	defer n.Unlock()
+	n.events = append(n.events, e)
+}
+
+func useFakeNotifier(t *testing.T) *fakeNotifier {
+	n := &fakeNotifier{}
+	old := notifier
+	notifier = n
+	t.Cleanup(func() { notifier = old })
+	return n
+}
+
+// fakeAuditSink records the audit entries
+type fakeAuditSink struct {
+	sync.Mutex
+	entries []audit.Entry
+}
+
+func (s *fakeAuditSink) Write(e *audit.Entry) error {
+	s.Lock()
+	defer s.Unlock()
+	s.entries = append(s.entries, *e)
+	return nil
+}
+
+func useFakeAuditSink(t *testing.T) *fakeAuditSink {
+	s := &fakeAuditSink{}
+	old := auditor
+	auditor = &audit.Logger{Sinks: []audit.Sink{s}}
+	t.Cleanup(func() { auditor = old })
+	return s
+}
+
+func TestDeprovisionPartialFailure(t *testing.T) {
+	v := useFakeVault(t)
+	ec2 := useFakeEC2(t, viper.GetString("client-vpn-endpoint-id"))
+	n := useFakeNotifier(t)
+	sink := useFakeAuditSink(t)
+	now := time.Now()
+	v.addCertificate("alice", now.Add(-time.Hour), 24*time.Hour)
+	bob := v.addCertificate("bob", now.Add(-time.Hour), 24*time.Hour)
+	v.failRevoke[v.addCertificate("carol", now.Add(-time.Hour), 24*time.Hour)] = true
+	dave := v.addCertificate("dave", now.Add(-time.Hour), 24*time.Hour)
+
+	w := httptest.NewRecorder()
+	newRouter(v.vaultClient()).ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/deprovision", strings.NewReader(`{"allowlist":["alice"]}`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+	var rsp struct {
+		Deprovisioned []string          `json:"deprovisioned"`
+		Failed        map[string]string `json:"failed"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &rsp); err != nil {
+		t.Fatal(err)
+	}
+	// The failure with carol doesn't stop dave from being deprovisioned
+	if fmt.Sprint(rsp.Deprovisioned) != "[bob dave]" || len(rsp.Failed) != 1 || !strings.Contains(rsp.Failed["carol"], "failed to revoke") {
+		t.Fatalf("got %s, want bob and dave deprovisioned and carol failed", w.Body)
+	}
+
+	// The CRL with the revoked certificates is still uploaded
+	if ec2.imports == 0 {
+		t.Fatal("CRL not uploaded after the partial failure")
+	}
+	crl, err := x509.ParseCRL([]byte(ec2.crl))
+	if err != nil {
+		t.Fatal(err)
+	}
+	revoked := map[string]bool{}
+	for _, c := range crl.TBSCertList.RevokedCertificates {
+		revoked[vaultSerial(c.SerialNumber, ":")] = true
+	}
+	if !revoked[bob] || !revoked[dave] || len(revoked) != 2 {
+		t.Errorf("got revoked %v in the CRL, want %s and %s", revoked, bob, dave)
+	}
+
+	var offboarded []string
+	for _, e := range n.events {
+		if e.Type == notify.EventOffboarded {
+			offboarded = append(offboarded, e.Username)
+		}
+	}
+	sort.Strings(offboarded)
+	if fmt.Sprint(offboarded) != "[bob dave]" {
+		t.Errorf("got offboarded events for %v, want bob and dave only", offboarded)
+	}
+	outcomes := map[string]string{}
+	for _, e := range sink.entries {
+		if e.Operation == audit.OperationRevoke {
+			outcomes[e.Username] = e.Outcome
+		}
+	}
+	want := map[string]string{"bob": audit.OutcomeSuccess, "dave": audit.OutcomeSuccess, "carol": audit.OutcomeFailure}
+	if fmt.Sprint(outcomes) != fmt.Sprint(want) {
+		t.Errorf("got audit outcomes %v, want %v", outcomes, want)
+	}
+}
+
+func TestAutoRenewUpdatesCRLOnce(t *testing.T) {
+	v := useFakeVault(t)
+	ec2 := useFakeEC2(t, viper.GetString("client-vpn-endpoint-id"))
+	now := time.Now()
+	old := map[string]bool{}
+	for _, user := range []string{"alice", "bob", "carol"} {
+		old[v.addCertificate(user, now.Add(-23*time.Hour), 24*time.Hour)] = true
+		v.secrets["users/"+user+"/metadata"] = map[string]interface{}{"auto_renew": true}
+	}
+	client, _ := v.vaultClient().GetClient()
+
+	renewed, err := operations.AutoRenew(
+		&operations.AutoRenewRequest{
+			Client:              client,
+			VaultPKIPaths:       viper.GetStringSlice("vault-pki-paths"),
+			VaultPKIRole:        viper.GetString("vault-client-certificate-role"),
+			ClientVPNEndpointID: viper.GetString("client-vpn-endpoint-id"),
+			VaultKVPath:         viper.GetString("vault-kv-path"),
+			UpdateCRLOptions:    updateCRLOptions(context.Background(), logging.Default(), "scheduler"),
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(renewed.Renewed) != "[alice bob carol]" {
+		t.Fatalf("got renewed %v, want alice, bob and carol", renewed.Renewed)
+	}
+
+	// The renewals share a single update of the CRL, that
+	// revokes the previous certificates of all of them
+	if ec2.imports != 1 {
+		t.Errorf("got %d imports of the CRL, want 1", ec2.imports)
+	}
+	crl, err := x509.ParseCRL([]byte(ec2.crl))
+	if err != nil {
+		t.Fatal(err)
+	}
+	revoked := map[string]bool{}
+	for _, c := range crl.TBSCertList.RevokedCertificates {
+		revoked[vaultSerial(c.SerialNumber, ":")] = true
+	}
+	if fmt.Sprint(revoked) != fmt.Sprint(old) {
+		t.Errorf("got revoked %v in the CRL, want the renewed certificates %v", revoked, old)
+	}
+}
+
+func TestIssueUsers(t *testing.T) {
+	v := useFakeVault(t)
+	ec2 := useFakeEC2(t, viper.GetString("client-vpn-endpoint-id"))
+	client, _ := v.vaultClient().GetClient()
+
+	users, err := operations.IssueUsers(
+		&operations.IssueBatchRequest{
+			IssueCertificateRequest: operations.IssueCertificateRequest{
+				Client:              client,
+				VaultPKIPaths:       viper.GetStringSlice("vault-pki-paths"),
+				VaultPKIRole:        viper.GetString("vault-client-certificate-role"),
+				ClientVPNEndpointID: viper.GetString("client-vpn-endpoint-id"),
+				VaultKVPath:         viper.GetString("vault-kv-path"),
+				UpdateCRLOptions:    updateCRLOptions(context.Background(), logging.Default(), "test"),
+			},
+		}, []string{"alice", "bob", "alice", ""})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 3 {
+		t.Fatalf("got %d users, want alice, bob and the empty one: %v", len(users), users)
+	}
+	for _, user := range []string{"alice", "bob"} {
+		if ui := users[user]; ui.Err != nil || ui.Result == nil || ui.Result.SerialNumber == "" {
+			t.Errorf("got %+v for %s, want its certificate issued", ui, user)
+		}
+	}
+	// The invalid username doesn't fail the others
+	if ui := users[""]; ui.Err == nil {
+		t.Errorf("got %+v for the invalid username, want an error", ui)
+	}
+	if ec2.imports != 1 {
+		t.Errorf("got %d imports of the CRL, want 1", ec2.imports)
+	}
+}
@@ -0,0 +1,110 @@
+package app
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// certReloader serves the server certificate, loading it again
+// from disk whenever the certificate or key files change, so it
+// can be renewed without restarting the server
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+// GetCertificate implements tls.Config.GetCertificate. If the files
+// changed but can't be loaded, for example because only one of them
+// has been written yet, the current certificate keeps being served.
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	modTime, err := latestModTime(c.certFile, c.keyFile)
+	if err == nil && c.cert != nil && !modTime.After(c.modTime) {
+		return c.cert, nil
+	}
+	if err == nil {
+		var cert tls.Certificate
+		cert, err = tls.LoadX509KeyPair(c.certFile, c.keyFile)
+		if err == nil {
+			if c.cert != nil {
+				log.Printf("Reloaded the TLS certificate from %s", c.certFile)
+			}
+			c.cert = &cert
+			c.modTime = modTime
+			return c.cert, nil
+		}
+	}
+
+	if c.cert == nil {
+		return nil, err
+	}
+	log.Printf("Unable to reload the TLS certificate, serving the current one: %s", err)
+	return c.cert, nil
+}
+
+func latestModTime(files ...string) (time.Time, error) {
+	var latest time.Time
+	for _, f := range files {
+		info, err := os.Stat(f)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// serverTLSConfig returns the TLS config of the API server. If a
+// client CA bundle is given, clients are required to present a
+// certificate issued by one of its CAs.
+func serverTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	reloader := &certReloader{certFile: certFile, keyFile: keyFile}
+	// Fail on startup rather than on the first handshake
+	if _, err := reloader.GetCertificate(nil); err != nil {
+		return nil, err
+	}
+
+	cfg := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}
+
+	if clientCAFile != "" {
+		pem, err := ioutil.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in the client CA bundle")
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return cfg, nil
+}
+
+// clientCertCN returns the common name of the verified
+// client certificate of the request, if there is one
+func clientCertCN(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return r.TLS.VerifiedChains[0][0].Subject.CommonName
+}
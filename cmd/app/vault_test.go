@@ -0,0 +1,380 @@
+package app
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// fakeVault serves the parts of the Vault API used by ACPM: a PKI mount
+// with a CA that issues client certificates, and a kv v2 mount
+type fakeVault struct {
+	*httptest.Server
+	t     *testing.T
+	pki   string
+	kv    string
+	ca    *x509.Certificate
+	caKey *ecdsa.PrivateKey
+	caPEM string
+
+	sync.Mutex
+	serial  int64
+	certs   map[string]string
+	revoked map[string]time.Time
+	crlDER  []byte
+	secrets map[string]map[string]interface{}
+	// roles are the PKI roles, which are not found if missing
+	roles map[string]map[string]interface{}
+	// rejectSANs, if set, is the error returned to the requests
+	// to issue certificates with subject alternative names
+	rejectSANs string
+	// wrongKeys, if set, returns the issued certificates
+	// along with a private key that isn't theirs
+	wrongKeys bool
+	// failRevoke are the serial numbers, as returned by issue,
+	// whose revocation fails with a 400
+	failRevoke map[string]bool
+	// writes are the bodies of the requests writing to each path
+	writes map[string][]map[string]interface{}
+}
+
+// newFakeVault starts a fake Vault with a "pki" and a "secret" mount
+func newFakeVault(t *testing.T) *fakeVault {
+	t.Helper()
+	v := &fakeVault{t: t, pki: "pki", kv: "secret", serial: 1, certs: map[string]string{}, revoked: map[string]time.Time{},
+		secrets: map[string]map[string]interface{}{}, roles: map[string]map[string]interface{}{}, writes: map[string][]map[string]interface{}{},
+		failRevoke: map[string]bool{}}
+	var err error
+	v.caKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(v.serial),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &v.caKey.PublicKey, v.caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.ca, _ = x509.ParseCertificate(der)
+	v.caPEM = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	v.certs[vaultSerial(v.ca.SerialNumber, "-")] = v.caPEM
+
+	v.Server = httptest.NewServer(http.HandlerFunc(v.serve))
+	t.Cleanup(v.Close)
+	return v
+}
+
+// vaultClient returns an authenticated client of the fake Vault
+func (v *fakeVault) vaultClient() *fakeVaultClient {
+	cfg := api.DefaultConfig()
+	cfg.Address = v.URL
+	client, err := api.NewClient(cfg)
+	if err != nil {
+		v.t.Fatal(err)
+	}
+	client.SetToken("test")
+	return &fakeVaultClient{client}
+}
+
+type fakeVaultClient struct{ client *api.Client }
+
+func (c *fakeVaultClient) GetClient() (*api.Client, error) { return c.client, nil }
+
+func vaultSerial(n *big.Int, sep string) string {
+	var parts []string
+	for _, b := range n.Bytes() {
+		parts = append(parts, fmt.Sprintf("%02x", b))
+	}
+	return strings.Join(parts, sep)
+}
+
+// issue creates a client certificate for the CN, valid for ttl from
+// notBefore, with the changes of the options to the template
+func (v *fakeVault) issue(cn string, notBefore time.Time, ttl time.Duration, options ...func(*x509.Certificate)) (serial, certPEM, keyPEM string) {
+	v.t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		v.t.Fatal(err)
+	}
+	v.serial++
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(v.serial<<16 + 0x1234),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    notBefore,
+		NotAfter:     notBefore.Add(ttl),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	for _, option := range options {
+		option(tmpl)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, v.ca, &key.PublicKey, v.caKey)
+	if err != nil {
+		v.t.Fatal(err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	certPEM = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	keyPEM = string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+	v.certs[vaultSerial(tmpl.SerialNumber, "-")] = certPEM
+	return vaultSerial(tmpl.SerialNumber, ":"), certPEM, keyPEM
+}
+
+// addCertificate issues a certificate for the CN out of band, as the
+// certificates issued before the test
+func (v *fakeVault) addCertificate(cn string, notBefore time.Time, ttl time.Duration) string {
+	v.Lock()
+	defer v.Unlock()
+	serial, _, _ := v.issue(cn, notBefore, ttl)
+	return serial
+}
+
+// revoke marks the certificate as revoked
+func (v *fakeVault) revoke(serial string) {
+	v.Lock()
+	defer v.Unlock()
+	v.revoked[strings.Replace(serial, ":", "-", -1)] = time.Now().Add(-time.Minute).Truncate(time.Second)
+	v.crlDER = nil
+}
+
+// crl returns the DER of the current CRL, which is signed
+// again only after a certificate is revoked
+func (v *fakeVault) crl() []byte {
+	if v.crlDER != nil {
+		return v.crlDER
+	}
+	var entries []pkix.RevokedCertificate
+	var keys []string
+	for k := range v.revoked {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		n, _ := new(big.Int).SetString(strings.Replace(k, "-", "", -1), 16)
+		entries = append(entries, pkix.RevokedCertificate{SerialNumber: n, RevocationTime: v.revoked[k]})
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		RevokedCertificates: entries,
+		Number:              big.NewInt(1),
+		ThisUpdate:          time.Now().Add(-time.Minute),
+		NextUpdate:          time.Now().Add(72 * time.Hour),
+	}, v.ca, v.caKey)
+	if err != nil {
+		v.t.Fatal(err)
+	}
+	v.crlDER = der
+	return der
+}
+
+func (v *fakeVault) respond(w http.ResponseWriter, code int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(body)
+}
+
+func (v *fakeVault) notFound(w http.ResponseWriter) {
+	v.respond(w, http.StatusNotFound, map[string]interface{}{"errors": []string{}})
+}
+
+func (v *fakeVault) serve(w http.ResponseWriter, r *http.Request) {
+	v.Lock()
+	defer v.Unlock()
+
+	path := strings.TrimPrefix(r.URL.Path, "/v1/")
+	list := r.Method == "LIST" || r.URL.Query().Get("list") == "true"
+	var body map[string]interface{}
+	if b, _ := ioutil.ReadAll(r.Body); len(b) > 0 {
+		json.Unmarshal(b, &body)
+	}
+	if r.Method == http.MethodPost || r.Method == http.MethodPut {
+		v.writes[path] = append(v.writes[path], body)
+	}
+
+	switch {
+	case path == "sys/capabilities-self":
+		data := map[string]interface{}{"capabilities": []string{"root"}}
+		for _, p := range asSlice(body["paths"]) {
+			data[p.(string)] = []string{"root"}
+		}
+		v.respond(w, http.StatusOK, map[string]interface{}{"data": data, "capabilities": []string{"root"}})
+	case path == "sys/internal/ui/mounts/"+v.kv:
+		v.respond(w, http.StatusOK, map[string]interface{}{"data": map[string]interface{}{
+			"type": "kv", "path": v.kv + "/", "options": map[string]string{"version": "2"}}})
+	case strings.HasPrefix(path, v.pki+"/"):
+		v.servePKI(w, r, strings.TrimPrefix(path, v.pki+"/"), list, body)
+	case strings.HasPrefix(path, v.kv+"/"):
+		v.serveKV(w, r, strings.TrimPrefix(path, v.kv+"/"), list, body)
+	default:
+		v.t.Logf("fake vault: unhandled %s %s", r.Method, r.URL.Path)
+		v.notFound(w)
+	}
+}
+
+func (v *fakeVault) servePKI(w http.ResponseWriter, r *http.Request, path string, list bool, body map[string]interface{}) {
+	switch {
+	case path == "ca/pem":
+		w.Write([]byte(v.caPEM))
+	case path == "crl":
+		w.Header().Set("Content-Type", "application/pkix-crl")
+		w.Write(v.crl())
+	case path == "crl/pem":
+		w.Write(pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: v.crl()}))
+	case path == "crl/rotate":
+		v.respond(w, http.StatusOK, map[string]interface{}{"data": map[string]interface{}{"success": true}})
+	case path == "certs" && list:
+		keys := []string{}
+		for k := range v.certs {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		v.respond(w, http.StatusOK, map[string]interface{}{"data": map[string]interface{}{"keys": keys}})
+	case strings.HasPrefix(path, "cert/"):
+		key := strings.Replace(strings.TrimPrefix(path, "cert/"), ":", "-", -1)
+		crt, ok := v.certs[key]
+		if !ok {
+			v.notFound(w)
+			return
+		}
+		var rt int64
+		if t, ok := v.revoked[key]; ok {
+			rt = t.Unix()
+		}
+		v.respond(w, http.StatusOK, map[string]interface{}{"data": map[string]interface{}{"certificate": crt, "revocation_time": rt}})
+	case strings.HasPrefix(path, "roles/"):
+		role, ok := v.roles[strings.TrimPrefix(path, "roles/")]
+		if !ok {
+			v.notFound(w)
+			return
+		}
+		v.respond(w, http.StatusOK, map[string]interface{}{"data": role})
+	case strings.HasPrefix(path, "issue/"):
+		altNames, _ := body["alt_names"].(string)
+		ipSANs, _ := body["ip_sans"].(string)
+		if v.rejectSANs != "" && (altNames != "" || ipSANs != "") {
+			v.respond(w, http.StatusBadRequest, map[string]interface{}{"errors": []string{v.rejectSANs}})
+			return
+		}
+		cn, _ := body["common_name"].(string)
+		ttl := 30 * 24 * time.Hour
+		if s, ok := body["ttl"].(string); ok {
+			ttl, _ = time.ParseDuration(s)
+		}
+		serial, crt, key := v.issue(cn, time.Now().Add(-time.Second), ttl, func(tmpl *x509.Certificate) {
+			for _, name := range strings.Split(altNames, ",") {
+				switch {
+				case strings.Contains(name, "@"):
+					tmpl.EmailAddresses = append(tmpl.EmailAddresses, name)
+				case name != "":
+					tmpl.DNSNames = append(tmpl.DNSNames, name)
+				}
+			}
+			for _, ip := range strings.Split(ipSANs, ",") {
+				if ip != "" {
+					tmpl.IPAddresses = append(tmpl.IPAddresses, net.ParseIP(ip))
+				}
+			}
+		})
+		if v.wrongKeys {
+			other, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			keyDER, _ := x509.MarshalECPrivateKey(other)
+			key = string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+		}
+		v.respond(w, http.StatusOK, map[string]interface{}{"data": map[string]interface{}{
+			"serial_number": serial, "certificate": crt, "private_key": key, "private_key_type": "ec",
+			"issuing_ca": v.caPEM, "ca_chain": []string{v.caPEM}}})
+	case strings.HasPrefix(path, "sign/"):
+		// The certificate has a key of its own, not the one of the CSR,
+		// as ACPM doesn't look at it
+		cn, _ := body["common_name"].(string)
+		serial, crt, _ := v.issue(cn, time.Now().Add(-time.Second), 30*24*time.Hour)
+		v.respond(w, http.StatusOK, map[string]interface{}{"data": map[string]interface{}{
+			"serial_number": serial, "certificate": crt, "issuing_ca": v.caPEM, "ca_chain": []string{v.caPEM}}})
+	case path == "revoke":
+		serial, _ := body["serial_number"].(string)
+		if v.failRevoke[strings.Replace(serial, "-", ":", -1)] {
+			v.respond(w, http.StatusBadRequest, map[string]interface{}{"errors": []string{"failed to revoke " + serial}})
+			return
+		}
+		v.revoked[strings.Replace(serial, ":", "-", -1)] = time.Now().Truncate(time.Second)
+		v.crlDER = nil
+		v.respond(w, http.StatusOK, map[string]interface{}{"data": map[string]interface{}{"revocation_time": time.Now().Unix()}})
+	default:
+		v.t.Logf("fake vault: unhandled %s %s", r.Method, r.URL.Path)
+		v.notFound(w)
+	}
+}
+
+func (v *fakeVault) serveKV(w http.ResponseWriter, r *http.Request, path string, list bool, body map[string]interface{}) {
+	switch {
+	case list && strings.HasPrefix(path, "metadata/"):
+		prefix := strings.TrimSuffix(strings.TrimPrefix(path, "metadata/"), "/") + "/"
+		seen := map[string]bool{}
+		keys := []string{}
+		for p := range v.secrets {
+			if !strings.HasPrefix(p, prefix) {
+				continue
+			}
+			k := strings.TrimPrefix(p, prefix)
+			if i := strings.Index(k, "/"); i >= 0 {
+				k = k[:i+1]
+			}
+			if !seen[k] {
+				seen[k] = true
+				keys = append(keys, k)
+			}
+		}
+		if len(keys) == 0 {
+			v.notFound(w)
+			return
+		}
+		sort.Strings(keys)
+		v.respond(w, http.StatusOK, map[string]interface{}{"data": map[string]interface{}{"keys": keys}})
+	case strings.HasPrefix(path, "metadata/") && r.Method == http.MethodDelete:
+		delete(v.secrets, strings.TrimPrefix(path, "metadata/"))
+		w.WriteHeader(http.StatusNoContent)
+	case strings.HasPrefix(path, "data/"):
+		key := strings.TrimPrefix(path, "data/")
+		switch r.Method {
+		case http.MethodGet:
+			data, ok := v.secrets[key]
+			if !ok {
+				v.notFound(w)
+				return
+			}
+			v.respond(w, http.StatusOK, map[string]interface{}{"data": map[string]interface{}{"data": data, "metadata": map[string]interface{}{"version": 1}}})
+		case http.MethodPost, http.MethodPut:
+			data, _ := body["data"].(map[string]interface{})
+			v.secrets[key] = data
+			v.respond(w, http.StatusOK, map[string]interface{}{"data": map[string]interface{}{"version": 1}})
+		case http.MethodDelete:
+			delete(v.secrets, key)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	default:
+		v.t.Logf("fake vault: unhandled %s %s", r.Method, r.URL.Path)
+		v.notFound(w)
+	}
+}
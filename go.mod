@@ -5,15 +5,21 @@ go 1.13
 require (
 	github.com/aws/aws-sdk-go v1.27.3
 	github.com/davecgh/go-spew v1.1.1
+	github.com/go-ldap/ldap/v3 v3.1.10
+	github.com/golang/protobuf v1.3.2
 	github.com/google/go-github v17.0.0+incompatible
 	github.com/google/go-github/v29 v29.0.2
 	github.com/gorilla/handlers v1.4.2
 	github.com/gorilla/mux v1.7.3
 	github.com/hashicorp/vault/api v1.0.4
 	github.com/hashicorp/vault/sdk v0.1.13
-	github.com/pkg/errors v0.8.0
+	github.com/pkg/errors v0.8.1
+	github.com/prometheus/client_golang v1.4.1
 	github.com/robfig/cron v1.2.0
+	github.com/spf13/cast v1.3.0
 	github.com/spf13/cobra v0.0.5
+	github.com/spf13/pflag v1.0.3
 	github.com/spf13/viper v1.6.1
 	golang.org/x/oauth2 v0.0.0-20180821212333-d2e6202438be
+	google.golang.org/grpc v1.22.0
 )
@@ -0,0 +1,236 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/vault"
+)
+
+// Operation is the kind of mutating operation being audited
+type Operation string
+
+const (
+	// OperationIssue is the issuance of a client certificate
+	OperationIssue Operation = "issue"
+	// OperationRevoke is the revocation of all the certificates of a user
+	OperationRevoke Operation = "revoke"
+	// OperationAutoRenew is the renewal of a certificate by the scheduler
+	OperationAutoRenew Operation = "auto-renew"
+	// OperationCRLImport is an update of the CRL of the endpoint
+	OperationCRLImport Operation = "crl-import"
+	// OperationCRLRotate is a rotation of the CRL by the scheduler
+	OperationCRLRotate Operation = "crl-rotate"
+	// OperationCRLPrune is the removal of the expired certificates from the CRL
+	OperationCRLPrune Operation = "crl-prune"
+	// OperationCRLRollback is the import of a previously backed up CRL
+	OperationCRLRollback Operation = "crl-rollback"
+	// OperationCRLRebuild is the reconstruction of the CRL from the certificates in Vault
+	OperationCRLRebuild Operation = "crl-rebuild"
+	// OperationAdopt is the adoption of certificates issued outside of ACPM
+	OperationAdopt Operation = "adopt"
+	// OperationDenyListAdd is the addition of a user to the deny-list
+	OperationDenyListAdd Operation = "deny-list-add"
+	// OperationDenyListRemove is the removal of a user from the deny-list
+	OperationDenyListRemove Operation = "deny-list-remove"
+	// OperationSetMetadata is an update of the metadata of a user
+	OperationSetMetadata Operation = "set-metadata"
+	// OperationSuspend is the suspension of a user
+	OperationSuspend Operation = "suspend"
+	// OperationReinstate is the lifting of the suspension of a user
+	OperationReinstate Operation = "reinstate"
+	// OperationRevokeCertificate is the revocation of a single certificate
+	// in Vault, recorded by the operations right after Vault revokes it,
+	// whichever operation it is part of
+	OperationRevokeCertificate Operation = "revoke-certificate"
+)
+
+const (
+	// OutcomeSuccess is recorded for the operations that succeeded
+	OutcomeSuccess = "success"
+	// OutcomeFailure is recorded for the operations that failed
+	OutcomeFailure = "failure"
+)
+
+// Entry is a record of the audit log
+type Entry struct {
+	Timestamp time.Time `json:"timestamp"`
+	Operation Operation `json:"operation"`
+	// Actor is the authenticated API caller, or the
+	// scheduler for the periodic tasks
+	Actor string `json:"actor"`
+	// RequestID is the ID of the API request that triggered the operation
+	RequestID     string   `json:"request_id,omitempty"`
+	Username      string   `json:"username,omitempty"`
+	SerialNumbers []string `json:"serial_numbers,omitempty"`
+	EndpointID    string   `json:"endpoint_id"`
+	Outcome       string   `json:"outcome"`
+	Error         string   `json:"error,omitempty"`
+	// Reason is the revocation reason of the revoke operations
+	Reason string `json:"reason,omitempty"`
+	// VaultDisplayName and VaultEntityID identify the Vault token
+	// ACPM used for the operation, see Logger.Vault
+	VaultDisplayName string `json:"vault_display_name,omitempty"`
+	VaultEntityID    string `json:"vault_entity_id,omitempty"`
+}
+
+// Sink stores the audit entries
+type Sink interface {
+	Write(e *Entry) error
+}
+
+// Logger records the entries in each of its sinks
+type Logger struct {
+	Sinks []Sink
+	// Vault, if set, is the client whose token is looked up, once per
+	// token, to add its display name and entity to the entries
+	Vault vault.AuthenticatedClient
+
+	identities sync.Map
+}
+
+// identity is the display name and entity of a Vault token
+type identity struct {
+	displayName string
+	entityID    string
+}
+
+// Log fills in the timestamp and outcome of the entry from err and
+// records it. Failures to write the entry are logged, not returned,
+// as the operation being audited has already happened. The entry is
+// written before Log returns, so it is not lost if the process
+// crashes right after the operation.
+func (l *Logger) Log(e Entry, err error) {
+	e.Timestamp = time.Now().UTC()
+	e.Outcome = OutcomeSuccess
+	if err != nil {
+		e.Outcome = OutcomeFailure
+		e.Error = err.Error()
+	}
+	if id, err := l.identity(); err != nil {
+		log.Printf("WARNING: unable to look up the Vault token of the audit entry of the %s operation: %s", e.Operation, err)
+	} else {
+		e.VaultDisplayName, e.VaultEntityID = id.displayName, id.entityID
+	}
+	for _, s := range l.Sinks {
+		if err := s.Write(&e); err != nil {
+			log.Printf("WARNING: unable to write the audit entry of the %s operation: %s", e.Operation, err)
+		}
+	}
+}
+
+// identity returns the display name and entity of the current token
+// of the Vault client, as returned by auth/token/lookup-self
+func (l *Logger) identity() (identity, error) {
+	if l.Vault == nil {
+		return identity{}, nil
+	}
+	client, err := l.Vault.GetClient()
+	if err != nil {
+		return identity{}, err
+	}
+	token := client.Token()
+	if id, ok := l.identities.Load(token); ok {
+		return id.(identity), nil
+	}
+	secret, err := client.Auth().Token().LookupSelf()
+	if err != nil {
+		return identity{}, err
+	}
+	id := identity{}
+	if secret != nil {
+		id.displayName, _ = secret.Data["display_name"].(string)
+		id.entityID, _ = secret.Data["entity_id"].(string)
+	}
+	l.identities.Store(token, id)
+	return id, nil
+}
+
+// WriterSink writes the entries as JSON lines
+type WriterSink struct {
+	W  io.Writer
+	mu sync.Mutex
+}
+
+// Write appends the entry as a single JSON line
+func (s *WriterSink) Write(e *Entry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.W.Write(append(b, '\n'))
+	return err
+}
+
+// FileSink appends the entries as JSON lines to a file, flushing
+// each one to disk before returning
+type FileSink struct {
+	f  *os.File
+	mu sync.Mutex
+}
+
+// NewFileSink opens the file for appending, creating it if missing
+func NewFileSink(path string) (*FileSink, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &FileSink{f: f}, nil
+}
+
+// Write appends the entry as a single JSON line and syncs the file
+func (s *FileSink) Write(e *Entry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.f.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	return s.f.Sync()
+}
+
+// Close closes the file
+func (s *FileSink) Close() error {
+	return s.f.Close()
+}
+
+// VaultKVSink stores each entry as a new secret in the kv (v2) store,
+// under {VaultKVPath}/data/audit/{date}/{timestamp}, so the audit log
+// survives restarts of the server
+type VaultKVSink struct {
+	Client      vault.AuthenticatedClient
+	VaultKVPath string
+}
+
+// Write stores the entry in the kv store
+func (s *VaultKVSink) Write(e *Entry) error {
+	client, err := s.Client.GetClient()
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	data := map[string]interface{}{}
+	if err := json.Unmarshal(b, &data); err != nil {
+		return err
+	}
+	path := fmt.Sprintf("%s/data/audit/%s/%d", s.VaultKVPath, e.Timestamp.Format("2006-01-02"), e.Timestamp.UnixNano())
+	_, err = client.Logical().Write(path, map[string]interface{}{
+		// Never overwrite an existing entry
+		"options": map[string]interface{}{"cas": 0},
+		"data":    data,
+	})
+	return err
+}
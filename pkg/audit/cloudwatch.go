@@ -0,0 +1,98 @@
+package audit
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs/cloudwatchlogsiface"
+)
+
+// CloudWatchLogsSink sends each entry, as a JSON event, to a stream of a
+// CloudWatch Logs group. The stream is created if missing, the group
+// must exist already.
+type CloudWatchLogsSink struct {
+	Client    cloudwatchlogsiface.CloudWatchLogsAPI
+	LogGroup  string
+	LogStream string
+
+	mu      sync.Mutex
+	created bool
+	token   *string
+}
+
+// Write puts the entry in the log stream
+func (s *CloudWatchLogsSink) Write(e *Entry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.created {
+		_, err := s.Client.CreateLogStream(&cloudwatchlogs.CreateLogStreamInput{
+			LogGroupName:  aws.String(s.LogGroup),
+			LogStreamName: aws.String(s.LogStream),
+		})
+		if err != nil && !isAWSError(err, cloudwatchlogs.ErrCodeResourceAlreadyExistsException) {
+			return err
+		}
+		s.created = true
+		// The token of an existing stream is looked up on the first
+		// rejection of the events, see below
+	}
+
+	event := &cloudwatchlogs.InputLogEvent{
+		Message:   aws.String(string(b)),
+		Timestamp: aws.Int64(e.Timestamp.UnixNano() / int64(time.Millisecond)),
+	}
+	// The stream may have been written by another instance since the last
+	// put, so the sequence token is refreshed once if rejected
+	for attempt := 0; ; attempt++ {
+		rsp, err := s.Client.PutLogEvents(&cloudwatchlogs.PutLogEventsInput{
+			LogGroupName:  aws.String(s.LogGroup),
+			LogStreamName: aws.String(s.LogStream),
+			LogEvents:     []*cloudwatchlogs.InputLogEvent{event},
+			SequenceToken: s.token,
+		})
+		if err == nil {
+			s.token = rsp.NextSequenceToken
+			return nil
+		}
+		if isAWSError(err, cloudwatchlogs.ErrCodeDataAlreadyAcceptedException) {
+			return nil
+		}
+		if attempt > 0 || !isAWSError(err, cloudwatchlogs.ErrCodeInvalidSequenceTokenException) {
+			return err
+		}
+		if s.token, err = s.uploadToken(); err != nil {
+			return err
+		}
+	}
+}
+
+// uploadToken returns the sequence token expected by the log stream
+func (s *CloudWatchLogsSink) uploadToken() (*string, error) {
+	rsp, err := s.Client.DescribeLogStreams(&cloudwatchlogs.DescribeLogStreamsInput{
+		LogGroupName:        aws.String(s.LogGroup),
+		LogStreamNamePrefix: aws.String(s.LogStream),
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, stream := range rsp.LogStreams {
+		if aws.StringValue(stream.LogStreamName) == s.LogStream {
+			return stream.UploadSequenceToken, nil
+		}
+	}
+	return nil, nil
+}
+
+func isAWSError(err error, code string) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && aerr.Code() == code
+}
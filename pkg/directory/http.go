@@ -0,0 +1,60 @@
+package directory
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// HTTPChecker asks an HTTP service whether the user is allowed, with a
+// GET to URL where {username} is replaced by the escaped username. A 200
+// allows the user, a 404 is reported as ErrUserNotFound and any other
+// 4xx as ErrUserInactive. The rest of the responses are failures of the
+// service.
+type HTTPChecker struct {
+	URL string
+	// Token, if set, is sent as a bearer token
+	Token string
+	// Timeout of the request. Defaults to 10s.
+	Timeout time.Duration
+	Client  *http.Client
+}
+
+// Check asks the service about the user
+func (c *HTTPChecker) Check(username string) error {
+	client := c.Client
+	if client == nil {
+		timeout := c.Timeout
+		if timeout == 0 {
+			timeout = 10 * time.Second
+		}
+		client = &http.Client{Timeout: timeout}
+	}
+	req, err := http.NewRequest("GET", strings.Replace(c.URL, "{username}", url.PathEscape(username), -1), nil)
+	if err != nil {
+		return err
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	rsp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("unable to reach the directory service: %s", err)
+	}
+	defer rsp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(rsp.Body, 1<<16))
+
+	switch {
+	case rsp.StatusCode == http.StatusOK:
+		return nil
+	case rsp.StatusCode == http.StatusNotFound:
+		return fmt.Errorf("%w: '%s'", ErrUserNotFound, username)
+	case rsp.StatusCode >= 400 && rsp.StatusCode < 500:
+		return fmt.Errorf("%w: '%s' (%s)", ErrUserInactive, username, rsp.Status)
+	}
+	return fmt.Errorf("unexpected response of the directory service: %s", rsp.Status)
+}
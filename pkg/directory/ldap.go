@@ -0,0 +1,125 @@
+package directory
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// DefaultLDAPFilter looks up the user by uid or mail
+const DefaultLDAPFilter = "(|(uid={username})(mail={username}))"
+
+// LDAPChecker looks up the users in an LDAP directory. The user needs
+// to match Filter under BaseDN and, if set, to have one of ActiveValues
+// in ActiveAttribute and to be a member of Group.
+type LDAPChecker struct {
+	// URL of the server, either ldap:// or ldaps://
+	URL string
+	// StartTLS upgrades the ldap:// connections with StartTLS
+	StartTLS bool
+	// TLSConfig of the TLS connections. Defaults to verifying
+	// the certificate of the server against the system roots.
+	TLSConfig *tls.Config
+	// BindDN and BindPassword are the credentials of the search. The
+	// search is anonymous if BindDN is empty.
+	BindDN       string
+	BindPassword string
+	BaseDN       string
+	// Filter of the search, where {username} is replaced by the escaped
+	// username. Defaults to DefaultLDAPFilter.
+	Filter string
+	// ActiveAttribute, if set, is the attribute of the entry that must
+	// have one of ActiveValues, compared case insensitively
+	ActiveAttribute string
+	ActiveValues    []string
+	// Group, if set, is the DN of the group the user must be a member
+	// of, as listed in the memberOf attribute of the entry
+	Group string
+	// Timeout of the connection and of each request. Defaults to 10s.
+	Timeout time.Duration
+}
+
+// Check looks up the user in the directory
+func (c *LDAPChecker) Check(username string) error {
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+	tlsConfig := c.TLSConfig
+	if tlsConfig == nil {
+		u, err := url.Parse(c.URL)
+		if err != nil {
+			return fmt.Errorf("invalid LDAP URL: %s", err)
+		}
+		tlsConfig = &tls.Config{ServerName: u.Hostname()}
+	}
+	conn, err := ldap.DialURL(c.URL,
+		ldap.DialWithDialer(&net.Dialer{Timeout: timeout}), ldap.DialWithTLSConfig(tlsConfig))
+	if err != nil {
+		return fmt.Errorf("unable to connect to the LDAP server: %s", err)
+	}
+	defer conn.Close()
+	conn.SetTimeout(timeout)
+
+	if c.StartTLS {
+		if err := conn.StartTLS(tlsConfig); err != nil {
+			return fmt.Errorf("unable to start TLS with the LDAP server: %s", err)
+		}
+	}
+	if c.BindDN != "" {
+		if err := conn.Bind(c.BindDN, c.BindPassword); err != nil {
+			return fmt.Errorf("unable to bind to the LDAP server: %s", err)
+		}
+	}
+
+	filter := c.Filter
+	if filter == "" {
+		filter = DefaultLDAPFilter
+	}
+	attrs := []string{"dn"}
+	if c.ActiveAttribute != "" {
+		attrs = append(attrs, c.ActiveAttribute)
+	}
+	if c.Group != "" {
+		attrs = append(attrs, "memberOf")
+	}
+	rsp, err := conn.Search(ldap.NewSearchRequest(
+		c.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, int(timeout.Seconds()), false,
+		strings.Replace(filter, "{username}", ldap.EscapeFilter(username), -1), attrs, nil))
+	if err != nil {
+		return fmt.Errorf("unable to search the LDAP server: %s", err)
+	}
+	switch len(rsp.Entries) {
+	case 0:
+		return fmt.Errorf("%w: '%s'", ErrUserNotFound, username)
+	case 1:
+	default:
+		return fmt.Errorf("the LDAP filter matches more than one entry for user '%s'", username)
+	}
+	entry := rsp.Entries[0]
+
+	if c.ActiveAttribute != "" && !containsFold(entry.GetAttributeValues(c.ActiveAttribute), c.ActiveValues) {
+		return fmt.Errorf("%w: '%s' has not the expected %s", ErrUserInactive, entry.DN, c.ActiveAttribute)
+	}
+	if c.Group != "" && !containsFold(entry.GetAttributeValues("memberOf"), []string{c.Group}) {
+		return fmt.Errorf("%w: '%s' is not a member of '%s'", ErrUserInactive, entry.DN, c.Group)
+	}
+	return nil
+}
+
+// containsFold returns whether any of values is one of wanted
+func containsFold(values, wanted []string) bool {
+	for _, v := range values {
+		for _, w := range wanted {
+			if strings.EqualFold(v, w) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,225 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a log entry
+type Level int
+
+const (
+	// LevelDebug is for messages only useful while troubleshooting
+	LevelDebug Level = iota
+	// LevelInfo is for the normal operation messages
+	LevelInfo
+	// LevelWarn is for unexpected conditions that don't cause a failure
+	LevelWarn
+	// LevelError is for failures
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	}
+	return fmt.Sprintf("level(%d)", int(l))
+}
+
+// ParseLevel parses one of debug, info, warn or error
+func ParseLevel(level string) (Level, error) {
+	for _, l := range []Level{LevelDebug, LevelInfo, LevelWarn, LevelError} {
+		if strings.EqualFold(level, l.String()) {
+			return l, nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("unknown log level '%s'", level)
+}
+
+// Format is the output format of the logs
+type Format string
+
+const (
+	// FormatText writes each entry as a line of key=value pairs
+	FormatText Format = "text"
+	// FormatJSON writes each entry as a JSON object in its own line
+	FormatJSON Format = "json"
+)
+
+// Logger writes leveled log entries with key-value fields. The
+// keyvals are alternating keys and values, as in
+// logger.Info("issued certificate", "user", u, "serial", s).
+type Logger interface {
+	Debug(msg string, keyvals ...interface{})
+	Info(msg string, keyvals ...interface{})
+	Warn(msg string, keyvals ...interface{})
+	Error(msg string, keyvals ...interface{})
+	// With returns a Logger that adds the keyvals to every entry
+	With(keyvals ...interface{}) Logger
+}
+
+// redactedKeys are the fields whose values are never written
+var redactedKeys = map[string]bool{
+	"token":       true,
+	"vault_token": true,
+	"private_key": true,
+	"secret_id":   true,
+	"password":    true,
+	"secret":      true,
+}
+
+type logger struct {
+	out    *output
+	fields []interface{}
+}
+
+// output is shared by a logger and the ones derived from it with With
+type output struct {
+	mu     sync.Mutex
+	w      io.Writer
+	format Format
+	level  Level
+}
+
+// New returns a Logger writing the entries of the given level or above to w
+func New(w io.Writer, format Format, level Level) Logger {
+	return &logger{out: &output{w: w, format: format, level: level}}
+}
+
+var defaultLogger = New(os.Stderr, FormatText, LevelInfo)
+
+// Default returns the logger used when none is provided
+func Default() Logger {
+	return defaultLogger
+}
+
+// SetDefault changes the logger returned by Default
+func SetDefault(l Logger) {
+	defaultLogger = l
+}
+
+// OrDefault returns l, or the default logger if l is nil
+func OrDefault(l Logger) Logger {
+	if l == nil {
+		return defaultLogger
+	}
+	return l
+}
+
+func (l *logger) Debug(msg string, keyvals ...interface{}) { l.log(LevelDebug, msg, keyvals) }
+func (l *logger) Info(msg string, keyvals ...interface{})  { l.log(LevelInfo, msg, keyvals) }
+func (l *logger) Warn(msg string, keyvals ...interface{})  { l.log(LevelWarn, msg, keyvals) }
+func (l *logger) Error(msg string, keyvals ...interface{}) { l.log(LevelError, msg, keyvals) }
+
+func (l *logger) With(keyvals ...interface{}) Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(keyvals))
+	fields = append(fields, l.fields...)
+	fields = append(fields, keyvals...)
+	return &logger{out: l.out, fields: fields}
+}
+
+func (l *logger) log(level Level, msg string, keyvals []interface{}) {
+	if level < l.out.level {
+		return
+	}
+
+	entry := map[string]interface{}{}
+	var keys []string
+	all := append(append([]interface{}{}, l.fields...), keyvals...)
+	for i := 0; i < len(all); i += 2 {
+		key := fmt.Sprint(all[i])
+		var value interface{} = "MISSING"
+		if i+1 < len(all) {
+			value = sanitize(key, all[i+1])
+		}
+		if _, ok := entry[key]; !ok {
+			keys = append(keys, key)
+		}
+		entry[key] = value
+	}
+	sort.Strings(keys)
+
+	var buf bytes.Buffer
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	switch l.out.format {
+	case FormatJSON:
+		entry["time"] = now
+		entry["level"] = level.String()
+		entry["msg"] = msg
+		b, err := json.Marshal(entry)
+		if err != nil {
+			b = []byte(fmt.Sprintf(`{"level":"error","msg":"unable to encode log entry: %s"}`, err))
+		}
+		buf.Write(b)
+	default:
+		fmt.Fprintf(&buf, "time=%s level=%s msg=%q", now, level, msg)
+		for _, k := range keys {
+			fmt.Fprintf(&buf, " %s=%s", k, textValue(entry[k]))
+		}
+	}
+	buf.WriteByte('\n')
+
+	l.out.mu.Lock()
+	defer l.out.mu.Unlock()
+	l.out.w.Write(buf.Bytes())
+}
+
+// sanitize redacts secrets and prepares the value to be encoded
+func sanitize(key string, value interface{}) interface{} {
+	if redactedKeys[strings.ToLower(key)] {
+		return "[REDACTED]"
+	}
+	switch v := value.(type) {
+	case error:
+		return v.Error()
+	case time.Duration:
+		return v.String()
+	case fmt.Stringer:
+		return v.String()
+	case string:
+		if strings.Contains(v, "PRIVATE KEY-----") {
+			return "[REDACTED]"
+		}
+	}
+	return value
+}
+
+func textValue(v interface{}) string {
+	s := fmt.Sprint(v)
+	if strings.ContainsAny(s, " \"=\n\t") || s == "" {
+		return fmt.Sprintf("%q", s)
+	}
+	return s
+}
+
+// Writer returns an io.Writer that logs each line written to it as an
+// info entry, so the output of the standard library logger can be sent
+// through l with log.SetOutput
+func Writer(l Logger) io.Writer {
+	return writerFunc(func(p []byte) (int, error) {
+		for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+			l.Info(line)
+		}
+		return len(p), nil
+	})
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
@@ -0,0 +1,93 @@
+package mail
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"mime/multipart"
+	netmail "net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// Mailer sends email messages
+type Mailer interface {
+	Send(from string, m *Message) error
+}
+
+// Message is an email message with an optional attachment
+type Message struct {
+	To             string
+	Subject        string
+	Body           string
+	AttachmentName string
+	Attachment     []byte
+}
+
+// ParseAddress returns the email address of a single recipient, without
+// its display name. Line breaks are rejected, as the address is written
+// as is in the headers of the message.
+func ParseAddress(address string) (string, error) {
+	if strings.ContainsAny(address, "\r\n") {
+		return "", fmt.Errorf("invalid email address %q: line breaks are not allowed", address)
+	}
+	addr, err := netmail.ParseAddress(address)
+	if err != nil {
+		return "", fmt.Errorf("invalid email address %q: %s", address, err)
+	}
+	return addr.Address, nil
+}
+
+// Bytes returns the message encoded as a MIME multipart email
+func (m *Message) Bytes(from string) ([]byte, error) {
+	for _, value := range []string{from, m.To, m.Subject} {
+		if strings.ContainsAny(value, "\r\n") {
+			return nil, fmt.Errorf("line break in the header value %q", value)
+		}
+	}
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+
+	fmt.Fprintf(&buf, "From: %s\r\n", from)
+	fmt.Fprintf(&buf, "To: %s\r\n", m.To)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", m.Subject)
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&buf, "Content-Type: multipart/mixed; boundary=%s\r\n\r\n", mw.Boundary())
+
+	part, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {"text/plain; charset=utf-8"},
+		"Content-Transfer-Encoding": {"8bit"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := part.Write([]byte(strings.Replace(m.Body, "\n", "\r\n", -1))); err != nil {
+		return nil, err
+	}
+
+	if m.Attachment != nil {
+		part, err = mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {"application/octet-stream"},
+			"Content-Transfer-Encoding": {"base64"},
+			"Content-Disposition":       {fmt.Sprintf("attachment; filename=\"%s\"", m.AttachmentName)},
+		})
+		if err != nil {
+			return nil, err
+		}
+		// Split the base64 encoded attachment in lines of 76 chars as per RFC 2045
+		enc := base64.StdEncoding.EncodeToString(m.Attachment)
+		for len(enc) > 76 {
+			part.Write([]byte(enc[:76] + "\r\n"))
+			enc = enc[76:]
+		}
+		part.Write([]byte(enc + "\r\n"))
+	}
+
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
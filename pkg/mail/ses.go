@@ -0,0 +1,23 @@
+package mail
+
+import (
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ses"
+)
+
+// SESMailer sends emails using AWS SES
+type SESMailer struct{}
+
+// Send sends the message using the SES SendRawEmail API
+func (s *SESMailer) Send(from string, m *Message) error {
+	raw, err := m.Bytes(from)
+	if err != nil {
+		return err
+	}
+
+	svc := ses.New(session.New())
+	_, err = svc.SendRawEmail(&ses.SendRawEmailInput{
+		RawMessage: &ses.RawMessage{Data: raw},
+	})
+	return err
+}
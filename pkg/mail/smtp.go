@@ -0,0 +1,91 @@
+package mail
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strconv"
+)
+
+// SMTPSecurity is the kind of TLS used to talk to the SMTP server
+type SMTPSecurity string
+
+const (
+	// SMTPSecurityNone uses a plain text connection
+	SMTPSecurityNone SMTPSecurity = "none"
+	// SMTPSecurityStartTLS upgrades the connection with STARTTLS
+	SMTPSecurityStartTLS SMTPSecurity = "starttls"
+	// SMTPSecurityTLS uses an implicit TLS connection
+	SMTPSecurityTLS SMTPSecurity = "tls"
+)
+
+// SMTPMailer sends emails through an SMTP server
+type SMTPMailer struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	Security SMTPSecurity
+}
+
+// Send sends the message using the SMTP server
+func (s *SMTPMailer) Send(from string, m *Message) error {
+	raw, err := m.Bytes(from)
+	if err != nil {
+		return err
+	}
+
+	addr := net.JoinHostPort(s.Host, strconv.Itoa(s.Port))
+	tlsConfig := &tls.Config{ServerName: s.Host}
+
+	var c *smtp.Client
+	switch s.Security {
+	case SMTPSecurityTLS:
+		conn, err := tls.Dial("tcp", addr, tlsConfig)
+		if err != nil {
+			return err
+		}
+		c, err = smtp.NewClient(conn, s.Host)
+		if err != nil {
+			return err
+		}
+	case SMTPSecurityStartTLS, SMTPSecurityNone, "":
+		c, err = smtp.Dial(addr)
+		if err != nil {
+			return err
+		}
+		if s.Security == SMTPSecurityStartTLS {
+			if err := c.StartTLS(tlsConfig); err != nil {
+				c.Close()
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("unknown SMTP security mode '%s'", s.Security)
+	}
+	defer c.Close()
+
+	if s.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", s.Username, s.Password, s.Host)); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(from); err != nil {
+		return err
+	}
+	if err := c.Rcpt(m.To); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(raw); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
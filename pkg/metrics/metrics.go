@@ -0,0 +1,354 @@
+package metrics
+
+import (
+	"math"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "cvpn_pki"
+
+var (
+	registry = prometheus.NewRegistry()
+
+	certificateExpirySeconds = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "certificate_expiry_seconds",
+			Help:      "Seconds until the soonest expiry of the active certificates of each user",
+		},
+		[]string{"user"},
+	)
+
+	certificatesIssued = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "certificates_issued_total",
+			Help:      "Number of client certificates issued",
+		},
+	)
+
+	certificatesRevoked = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "certificates_revoked_total",
+			Help:      "Number of client certificates revoked",
+		},
+	)
+
+	crlUploads = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "crl_uploads_total",
+			Help:      "Number of CRL uploads to the Client VPN endpoint by result: attempted, succeeded, skipped or failed",
+		},
+		[]string{"result"},
+	)
+
+	apiErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "api_errors_total",
+			Help:      "Number of operations failed due to errors of the Vault or AWS APIs",
+		},
+		[]string{"service", "operation"},
+	)
+
+	operationDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "operation_duration_seconds",
+			Help:      "Time taken by the operations",
+			Buckets:   []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60},
+		},
+		[]string{"operation"},
+	)
+
+	activeUsers = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "active_users",
+			Help:      "Number of users with at least one valid certificate",
+		},
+	)
+
+	activeCertificates = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "active_certificates",
+			Help:      "Number of valid client certificates",
+		},
+	)
+
+	rateLimited = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "rate_limited_total",
+			Help:      "Number of operations refused due to the rate limits, by the scope of the limit: caller or user",
+		},
+		[]string{"scope"},
+	)
+
+	reconcileRuns = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "reconcile_runs_total",
+			Help:      "Number of scheduled CRL reconciliations by result: succeeded, skipped or failed",
+		},
+		[]string{"result"},
+	)
+
+	reconcileDuration = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "reconcile_last_duration_seconds",
+			Help:      "Time taken by the last CRL reconciliation",
+		},
+	)
+
+	reconcileLastRun = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "reconcile_last_run_timestamp_seconds",
+			Help:      "Unix time of the last CRL reconciliation",
+		},
+	)
+
+	reconcileNextRun = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "reconcile_next_run_timestamp_seconds",
+			Help:      "Unix time of the next scheduled CRL reconciliation",
+		},
+	)
+
+	crlSize = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "crl_size_bytes",
+			Help:      "Size of the last PEM encoded CRL read for the endpoint",
+		},
+		[]string{"pki_path", "endpoint_id"},
+	)
+
+	crlEntries = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "crl_entries",
+			Help:      "Number of revoked certificates in the last CRL read for the endpoint",
+		},
+		[]string{"pki_path", "endpoint_id"},
+	)
+
+	usersCacheLookups = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "users_cache_lookups_total",
+			Help:      "Number of listings of the users looked up in the cache, by result: hit or miss",
+		},
+		[]string{"result"},
+	)
+
+	vaultCircuitState = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "vault_circuit_state",
+			Help:      "State of the circuit breaker of the Vault calls, 1 for the current one",
+		},
+		[]string{"state"},
+	)
+
+	crlNextUpdateDays = &nextUpdateCollector{
+		desc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "crl_next_update_days"),
+			"Days until the NextUpdate of the last CRL read for the endpoint",
+			[]string{"pki_path", "endpoint_id"}, nil,
+		),
+		nextUpdates: map[[2]string]time.Time{},
+	}
+
+	// crlNextUpdate and lastSync hold unix timestamps, so the
+	// gauges can report the time remaining at scrape time
+	crlNextUpdate int64
+	lastSync      int64
+)
+
+func init() {
+	registry.MustRegister(
+		certificateExpirySeconds,
+		certificatesIssued,
+		certificatesRevoked,
+		crlUploads,
+		apiErrors,
+		operationDuration,
+		activeUsers,
+		activeCertificates,
+		rateLimited,
+		reconcileRuns,
+		reconcileDuration,
+		reconcileLastRun,
+		reconcileNextRun,
+		crlSize,
+		crlEntries,
+		crlNextUpdateDays,
+		vaultCircuitState,
+		usersCacheLookups,
+		prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "crl_next_update_seconds",
+				Help:      "Seconds until the NextUpdate of the last CRL uploaded to the endpoint",
+			},
+			func() float64 { return secondsUntil(atomic.LoadInt64(&crlNextUpdate)) },
+		),
+		prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "last_successful_sync_timestamp_seconds",
+				Help:      "Unix time of the last successful sync of the CRL to the endpoint",
+			},
+			func() float64 { return float64(atomic.LoadInt64(&lastSync)) },
+		),
+	)
+}
+
+// nextUpdateCollector reports the days until the NextUpdate of the
+// CRLs at scrape time, as the time remaining decreases between reads
+type nextUpdateCollector struct {
+	desc        *prometheus.Desc
+	nextUpdates map[[2]string]time.Time
+	sync.Mutex
+}
+
+func (c *nextUpdateCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *nextUpdateCollector) Collect(ch chan<- prometheus.Metric) {
+	c.Lock()
+	defer c.Unlock()
+	for labels, t := range c.nextUpdates {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, time.Until(t).Hours()/24, labels[0], labels[1])
+	}
+}
+
+func (c *nextUpdateCollector) set(pkiPath, endpointID string, t time.Time) {
+	c.Lock()
+	defer c.Unlock()
+	c.nextUpdates[[2]string{pkiPath, endpointID}] = t
+}
+
+func secondsUntil(ts int64) float64 {
+	if ts == 0 {
+		return math.NaN()
+	}
+	return time.Until(time.Unix(ts, 0)).Seconds()
+}
+
+// Handler returns the http handler that exposes the metrics
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+// SetCertificateExpiry updates the certificate expiry gauges with
+// the soonest expiry date of each user. Users not present in the
+// map are removed from the gauges.
+func SetCertificateExpiry(soonest map[string]time.Time) {
+	certificateExpirySeconds.Reset()
+	for user, t := range soonest {
+		certificateExpirySeconds.WithLabelValues(user).Set(time.Until(t).Seconds())
+	}
+}
+
+// ReconcileRun records a run of the CRL reconciliation
+// started at start, with its result
+func ReconcileRun(result string, start time.Time, d time.Duration) {
+	reconcileRuns.WithLabelValues(result).Inc()
+	reconcileDuration.Set(d.Seconds())
+	reconcileLastRun.Set(float64(start.Unix()))
+}
+
+// SetReconcileNextRun sets the time of the next scheduled CRL reconciliation
+func SetReconcileNextRun(t time.Time) {
+	reconcileNextRun.Set(float64(t.Unix()))
+}
+
+// Recorder records the metrics of the operations in the registry.
+// It implements operations.Metrics.
+type Recorder struct{}
+
+// CertificateIssued increments the issued certificates counter
+func (Recorder) CertificateIssued() {
+	certificatesIssued.Inc()
+}
+
+// CertificatesRevoked increments the revoked certificates counter
+func (Recorder) CertificatesRevoked(n int) {
+	certificatesRevoked.Add(float64(n))
+}
+
+// CRLUpload increments the CRL uploads counter for the outcome
+func (Recorder) CRLUpload(outcome string) {
+	crlUploads.WithLabelValues(outcome).Inc()
+}
+
+// APIError increments the API errors counter
+func (Recorder) APIError(service, operation string) {
+	apiErrors.WithLabelValues(service, operation).Inc()
+}
+
+// ObserveDuration records the duration of an operation
+func (Recorder) ObserveDuration(operation string, d time.Duration) {
+	operationDuration.WithLabelValues(operation).Observe(d.Seconds())
+}
+
+// SetActive sets the active users and certificates gauges
+func (Recorder) SetActive(users, certificates int) {
+	activeUsers.Set(float64(users))
+	activeCertificates.Set(float64(certificates))
+}
+
+// SetCRLNextUpdate sets the NextUpdate of the last uploaded CRL
+func (Recorder) SetCRLNextUpdate(t time.Time) {
+	atomic.StoreInt64(&crlNextUpdate, t.Unix())
+}
+
+// SetCRLStats sets the size, entries and NextUpdate of the last
+// CRL read for the endpoint from the PKI
+func (Recorder) SetCRLStats(pkiPath, endpointID string, size, entries int, nextUpdate time.Time) {
+	crlSize.WithLabelValues(pkiPath, endpointID).Set(float64(size))
+	crlEntries.WithLabelValues(pkiPath, endpointID).Set(float64(entries))
+	crlNextUpdateDays.set(pkiPath, endpointID, nextUpdate)
+}
+
+// SetLastSync sets the time of the last successful sync
+func (Recorder) SetLastSync(t time.Time) {
+	atomic.StoreInt64(&lastSync, t.Unix())
+}
+
+// RateLimited increments the rate limited operations counter
+func (Recorder) RateLimited(scope string) {
+	rateLimited.WithLabelValues(scope).Inc()
+}
+
+// SetVaultCircuitState sets the gauge of the current state of
+// the circuit breaker of the Vault calls to 1, and the rest to 0
+func (Recorder) SetVaultCircuitState(state string) {
+	for _, s := range []string{"closed", "open", "half-open"} {
+		v := 0.0
+		if s == state {
+			v = 1
+		}
+		vaultCircuitState.WithLabelValues(s).Set(v)
+	}
+}
+
+// UsersCacheLookup increments the users cache lookups counter
+func (Recorder) UsersCacheLookup(result string) {
+	usersCacheLookups.WithLabelValues(result).Inc()
+}
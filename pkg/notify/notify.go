@@ -0,0 +1,56 @@
+package notify
+
+// EventType is the kind of event a notification is sent for
+type EventType string
+
+const (
+	// EventIssued is sent when a client certificate is issued
+	EventIssued EventType = "issued"
+	// EventRevoked is sent for each revoked client certificate
+	EventRevoked EventType = "revoked"
+	// EventCRLUploaded is sent when a new CRL is imported in the endpoint
+	EventCRLUploaded EventType = "crl-uploaded"
+	// EventCRLUploadFailed is sent when a CRL update fails
+	EventCRLUploadFailed EventType = "crl-upload-failed"
+	// EventOffboarded is sent when all the certificates of a user are revoked
+	EventOffboarded EventType = "offboarded"
+	// EventRenewFailed is sent when the automatic renewal of the
+	// certificate of a user fails
+	EventRenewFailed EventType = "renew-failed"
+)
+
+// EventTypes are all the supported event types
+var EventTypes = []EventType{EventIssued, EventRevoked, EventCRLUploaded, EventCRLUploadFailed, EventOffboarded, EventRenewFailed}
+
+// Event describes something that happened to the PKI or the endpoint
+type Event struct {
+	Type         EventType
+	Username     string
+	SerialNumber string
+	EndpointID   string
+	// Caller is who triggered the action, usually
+	// the authenticated user of the API
+	Caller string
+	// RequestID is the ID of the API request that triggered the event
+	RequestID string
+	// Error is set for the failure events
+	Error string
+	// Reason is the revocation reason of the revoked events
+	Reason string
+}
+
+// Notifier delivers event notifications. Notify must not block
+// the caller, so implementations usually queue the events.
+type Notifier interface {
+	Notify(e Event)
+}
+
+// Multi sends the events to several notifiers
+type Multi []Notifier
+
+// Notify sends the event to each of the notifiers
+func (m Multi) Notify(e Event) {
+	for _, n := range m {
+		n.Notify(e)
+	}
+}
@@ -0,0 +1,207 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultSlackInterval is the default minimum time between two messages
+const DefaultSlackInterval = 10 * time.Second
+
+// slackSummaryThreshold is the number of events of the same type within
+// one interval above which they are summarized in a single line
+const slackSummaryThreshold = 5
+
+// SlackNotifier posts the events to a Slack incoming webhook. Events are
+// queued and sent at most once per Interval, in a single message, so bulk
+// operations produce a summary rather than one message per certificate.
+type SlackNotifier struct {
+	// WebhookURL is a secret and must not be logged
+	WebhookURL string
+	// Events are the event types to notify. All if empty.
+	Events []EventType
+	// Interval is the minimum time between messages. Defaults to DefaultSlackInterval.
+	Interval time.Duration
+	Client   *http.Client
+
+	once  sync.Once
+	mu    sync.Mutex
+	queue []Event
+	done  chan struct{}
+	wg    sync.WaitGroup
+}
+
+// Notify queues the event to be sent with the next message
+func (s *SlackNotifier) Notify(e Event) {
+	if !s.enabled(e.Type) {
+		return
+	}
+	s.once.Do(s.start)
+	s.mu.Lock()
+	s.queue = append(s.queue, e)
+	s.mu.Unlock()
+}
+
+// Close sends any queued events and stops the notifier
+func (s *SlackNotifier) Close() {
+	s.once.Do(func() {})
+	if s.done != nil {
+		close(s.done)
+		s.wg.Wait()
+	}
+}
+
+func (s *SlackNotifier) enabled(t EventType) bool {
+	if len(s.Events) == 0 {
+		return true
+	}
+	for _, et := range s.Events {
+		if et == t {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *SlackNotifier) start() {
+	interval := s.Interval
+	if interval == 0 {
+		interval = DefaultSlackInterval
+	}
+	s.done = make(chan struct{})
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.flush()
+			case <-s.done:
+				s.flush()
+				return
+			}
+		}
+	}()
+}
+
+func (s *SlackNotifier) flush() {
+	s.mu.Lock()
+	events := s.queue
+	s.queue = nil
+	s.mu.Unlock()
+
+	if len(events) == 0 {
+		return
+	}
+	if err := s.post(formatSlackMessage(events)); err != nil {
+		log.Printf("Failed to send %d events to Slack: %s", len(events), err)
+	}
+}
+
+func (s *SlackNotifier) post(text string) error {
+	body, err := json.Marshal(map[string]string{"text": text})
+	if err != nil {
+		return err
+	}
+	client := s.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	rsp, err := client.Post(s.WebhookURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		// The url.Error message includes the webhook URL
+		if uerr, ok := err.(*url.Error); ok {
+			return uerr.Err
+		}
+		return err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code %d", rsp.StatusCode)
+	}
+	return nil
+}
+
+// formatSlackMessage renders the events grouped by type. Types with
+// more than slackSummaryThreshold events are summarized in one line.
+func formatSlackMessage(events []Event) string {
+	byType := map[EventType][]Event{}
+	for _, e := range events {
+		byType[e.Type] = append(byType[e.Type], e)
+	}
+
+	var lines []string
+	for _, t := range EventTypes {
+		evs := byType[t]
+		if len(evs) == 0 {
+			continue
+		}
+		if len(evs) > slackSummaryThreshold {
+			lines = append(lines, summaryLine(t, evs))
+			continue
+		}
+		for _, e := range evs {
+			lines = append(lines, eventLine(e))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func eventLine(e Event) string {
+	switch e.Type {
+	case EventIssued:
+		return fmt.Sprintf(":key: Certificate `%s` issued for *%s* in endpoint `%s` by %s", e.SerialNumber, e.Username, e.EndpointID, e.Caller)
+	case EventRevoked:
+		line := fmt.Sprintf(":no_entry: Certificate `%s` of *%s* revoked in endpoint `%s` by %s", e.SerialNumber, e.Username, e.EndpointID, e.Caller)
+		if e.Reason != "" {
+			line += " (" + e.Reason + ")"
+		}
+		return line
+	case EventCRLUploaded:
+		return fmt.Sprintf(":page_facing_up: CRL uploaded to endpoint `%s` by %s", e.EndpointID, e.Caller)
+	case EventCRLUploadFailed:
+		return fmt.Sprintf(":warning: CRL upload to endpoint `%s` by %s failed: %s", e.EndpointID, e.Caller, e.Error)
+	case EventOffboarded:
+		return fmt.Sprintf(":wave: User *%s* offboarded from endpoint `%s` by %s", e.Username, e.EndpointID, e.Caller)
+	case EventRenewFailed:
+		return fmt.Sprintf(":warning: Renewal of the certificate of *%s* in endpoint `%s` by %s failed: %s", e.Username, e.EndpointID, e.Caller, e.Error)
+	}
+	return string(e.Type)
+}
+
+func summaryLine(t EventType, evs []Event) string {
+	users := map[string]bool{}
+	callers := map[string]bool{}
+	endpoints := map[string]bool{}
+	for _, e := range evs {
+		if e.Username != "" {
+			users[e.Username] = true
+		}
+		callers[e.Caller] = true
+		endpoints[e.EndpointID] = true
+	}
+	line := fmt.Sprintf("%d %s events in endpoint %s by %s", len(evs), t, joinKeys(endpoints), joinKeys(callers))
+	if len(users) > 0 {
+		line += fmt.Sprintf(", affecting %d users: %s", len(users), joinKeys(users))
+	}
+	return line
+}
+
+func joinKeys(m map[string]bool) string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, "`"+k+"`")
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, ", ")
+}
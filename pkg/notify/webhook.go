@@ -0,0 +1,238 @@
+package notify
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultWebhookTimeout is the default timeout of each webhook delivery attempt
+	DefaultWebhookTimeout = 5 * time.Second
+	// DefaultWebhookRetries is the default number of retries of a delivery
+	// that failed with a server side or connection error
+	DefaultWebhookRetries = 3
+	// SignatureHeader holds the HMAC-SHA256 signature of the body, hex
+	// encoded and prefixed with "sha256=", see VerifySignature
+	SignatureHeader = "X-ACPM-Signature"
+	// EventHeader holds the name of the event, same as WebhookPayload.Event
+	EventHeader = "X-ACPM-Event"
+
+	webhookQueueSize = 1000
+)
+
+// webhookBackoff is the wait before the first retry of a delivery
+var webhookBackoff = 500 * time.Millisecond
+
+// webhookEvents maps the event types to the names used in the payloads.
+// Events not in this map are not sent to the webhooks.
+var webhookEvents = map[EventType]string{
+	EventIssued:      "certificate.issued",
+	EventRevoked:     "certificate.revoked",
+	EventCRLUploaded: "crl.updated",
+	EventOffboarded:  "user.offboarded",
+}
+
+// WebhookPayload is the JSON body posted to the webhooks
+type WebhookPayload struct {
+	// Event is one of certificate.issued, certificate.revoked,
+	// crl.updated or user.offboarded
+	Event        string    `json:"event"`
+	Timestamp    time.Time `json:"timestamp"`
+	Username     string    `json:"username,omitempty"`
+	SerialNumber string    `json:"serial_number,omitempty"`
+	Reason       string    `json:"reason,omitempty"`
+	EndpointID   string    `json:"endpoint_id"`
+	Caller       string    `json:"caller"`
+	RequestID    string    `json:"request_id,omitempty"`
+}
+
+// WebhookTarget is an URL the events are posted to
+type WebhookTarget struct {
+	URL string
+	// Secret is the key of the HMAC signature of the payloads
+	Secret string
+}
+
+// WebhookNotifier posts the events as JSON to each of the targets,
+// signed with the target's secret. Deliveries happen in the background,
+// in the same order as the events.
+type WebhookNotifier struct {
+	Targets []WebhookTarget
+	// Timeout of each delivery attempt. Defaults to DefaultWebhookTimeout.
+	Timeout time.Duration
+	// Retries is the number of retries, with exponential backoff, on
+	// 5xx responses or connection errors. Zero disables the retries,
+	// negative values use DefaultWebhookRetries.
+	Retries int
+
+	once   sync.Once
+	mu     sync.Mutex
+	closed bool
+	queue  chan WebhookPayload
+	wg     sync.WaitGroup
+	client *http.Client
+}
+
+// Notify queues the event for delivery. Events are dropped if
+// the queue is full or the notifier is already closed.
+func (n *WebhookNotifier) Notify(e Event) {
+	name, ok := webhookEvents[e.Type]
+	if !ok {
+		return
+	}
+	n.once.Do(n.start)
+	payload := WebhookPayload{
+		Event:        name,
+		Timestamp:    time.Now().UTC(),
+		Username:     e.Username,
+		SerialNumber: e.SerialNumber,
+		Reason:       e.Reason,
+		EndpointID:   e.EndpointID,
+		Caller:       e.Caller,
+		RequestID:    e.RequestID,
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.closed {
+		log.Printf("Webhook notifier closed, dropping %s event", name)
+		return
+	}
+	select {
+	case n.queue <- payload:
+	default:
+		log.Printf("Webhook queue full, dropping %s event", name)
+	}
+}
+
+// Close delivers the queued events and stops the notifier
+func (n *WebhookNotifier) Close() {
+	n.once.Do(func() {})
+	n.mu.Lock()
+	if n.closed || n.queue == nil {
+		n.closed = true
+		n.mu.Unlock()
+		return
+	}
+	n.closed = true
+	close(n.queue)
+	n.mu.Unlock()
+	n.wg.Wait()
+}
+
+func (n *WebhookNotifier) start() {
+	timeout := n.Timeout
+	if timeout == 0 {
+		timeout = DefaultWebhookTimeout
+	}
+	n.client = &http.Client{Timeout: timeout}
+	n.queue = make(chan WebhookPayload, webhookQueueSize)
+	n.wg.Add(1)
+	go func() {
+		defer n.wg.Done()
+		for payload := range n.queue {
+			body, err := json.Marshal(payload)
+			if err != nil {
+				log.Printf("Unable to encode webhook payload: %s", err)
+				continue
+			}
+			for _, t := range n.Targets {
+				if err := n.deliver(t, payload.Event, body); err != nil {
+					log.Printf("Failed to deliver %s event to webhook %s: %s", payload.Event, redactURL(t.URL), err)
+				}
+			}
+		}
+	}()
+}
+
+// deliver posts the body to the target, retrying on 5xx and connection errors
+func (n *WebhookNotifier) deliver(t WebhookTarget, event string, body []byte) error {
+	retries := n.Retries
+	if retries < 0 {
+		retries = DefaultWebhookRetries
+	}
+	backoff := webhookBackoff
+
+	var err error
+	for attempt := 0; attempt <= retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		var retry bool
+		retry, err = n.post(t, event, body)
+		if err == nil || !retry {
+			return err
+		}
+	}
+	return err
+}
+
+func (n *WebhookNotifier) post(t WebhookTarget, event string, body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, t.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, event)
+	req.Header.Set(SignatureHeader, Sign(body, t.Secret))
+
+	rsp, err := n.client.Do(req)
+	if err != nil {
+		// The url.Error message includes the full URL, which
+		// might hold credentials in the query string
+		if uerr, ok := err.(*url.Error); ok {
+			return true, uerr.Err
+		}
+		return true, err
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode >= 500 {
+		return true, fmt.Errorf("unexpected status code %d", rsp.StatusCode)
+	}
+	if rsp.StatusCode >= 300 {
+		return false, fmt.Errorf("unexpected status code %d", rsp.StatusCode)
+	}
+	return false, nil
+}
+
+// Sign returns the value of the SignatureHeader for the given body
+func Sign(body []byte, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifySignature checks the SignatureHeader of a webhook delivery. The
+// consumers of the webhooks can use it, or a copy of it, to validate
+// that the request was sent by ACPM and the body was not modified.
+func VerifySignature(body []byte, secret, signature string) bool {
+	if !strings.HasPrefix(signature, "sha256=") {
+		return false
+	}
+	got, err := hex.DecodeString(strings.TrimPrefix(signature, "sha256="))
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(got, mac.Sum(nil))
+}
+
+// redactURL returns the scheme and host of the URL, to be used in logs
+func redactURL(u string) string {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return "<invalid url>"
+	}
+	return parsed.Scheme + "://" + parsed.Host
+}
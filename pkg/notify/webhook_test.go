@@ -0,0 +1,186 @@
+package notify
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookServer records the deliveries and answers with the given status codes,
+// the last one being repeated
+type webhookServer struct {
+	*httptest.Server
+	sync.Mutex
+	codes      []int
+	deliveries []*http.Request
+	bodies     [][]byte
+}
+
+func newWebhookServer(codes ...int) *webhookServer {
+	s := &webhookServer{codes: codes}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		s.Lock()
+		defer s.Unlock()
+		code := s.codes[len(s.codes)-1]
+		if len(s.deliveries) < len(s.codes) {
+			code = s.codes[len(s.deliveries)]
+		}
+		s.deliveries = append(s.deliveries, r)
+		s.bodies = append(s.bodies, b)
+		w.WriteHeader(code)
+	}))
+	return s
+}
+
+func init() {
+	webhookBackoff = time.Millisecond
+}
+
+func TestWebhookNotifierSignsPayloads(t *testing.T) {
+	srv := newWebhookServer(http.StatusOK)
+	defer srv.Close()
+	n := &WebhookNotifier{Targets: []WebhookTarget{{URL: srv.URL, Secret: "s3cr3t"}}}
+
+	events := []struct {
+		event Event
+		want  map[string]string
+	}{
+		{
+			Event{Type: EventIssued, Username: "alice", SerialNumber: "01-02", EndpointID: "cvpn-endpoint-1", Caller: "admin", RequestID: "req-1"},
+			map[string]string{"event": "certificate.issued", "username": "alice", "serial_number": "01-02", "endpoint_id": "cvpn-endpoint-1", "caller": "admin", "request_id": "req-1"},
+		},
+		{
+			Event{Type: EventRevoked, Username: "alice", SerialNumber: "01-02", Reason: "key_compromise", EndpointID: "cvpn-endpoint-1", Caller: "admin"},
+			map[string]string{"event": "certificate.revoked", "username": "alice", "serial_number": "01-02", "reason": "key_compromise", "endpoint_id": "cvpn-endpoint-1", "caller": "admin"},
+		},
+		{
+			Event{Type: EventCRLUploaded, EndpointID: "cvpn-endpoint-1", Caller: "cron"},
+			map[string]string{"event": "crl.updated", "endpoint_id": "cvpn-endpoint-1", "caller": "cron"},
+		},
+		{
+			Event{Type: EventOffboarded, Username: "bob", EndpointID: "cvpn-endpoint-1", Caller: "admin"},
+			map[string]string{"event": "user.offboarded", "username": "bob", "endpoint_id": "cvpn-endpoint-1", "caller": "admin"},
+		},
+	}
+	for _, e := range events {
+		n.Notify(e.event)
+	}
+	// Not sent to the webhooks
+	n.Notify(Event{Type: EventCRLUploadFailed, Error: "boom"})
+	n.Close()
+
+	if len(srv.deliveries) != len(events) {
+		t.Fatalf("got %d deliveries, want %d", len(srv.deliveries), len(events))
+	}
+	for i, e := range events {
+		req, body := srv.deliveries[i], srv.bodies[i]
+		sig := req.Header.Get(SignatureHeader)
+		if sig != Sign(body, "s3cr3t") || !VerifySignature(body, "s3cr3t", sig) {
+			t.Errorf("invalid signature %q for %s", sig, body)
+		}
+		if VerifySignature(body, "other", sig) || VerifySignature(append(body, ' '), "s3cr3t", sig) {
+			t.Errorf("signature %q verified with the wrong secret or body", sig)
+		}
+		if got := req.Header.Get(EventHeader); got != e.want["event"] {
+			t.Errorf("got %s header %q, want %q", EventHeader, got, e.want["event"])
+		}
+		if got := req.Header.Get("Content-Type"); got != "application/json" {
+			t.Errorf("got Content-Type %q", got)
+		}
+
+		var got map[string]interface{}
+		if err := json.Unmarshal(body, &got); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := time.Parse(time.RFC3339, got["timestamp"].(string)); err != nil {
+			t.Errorf("invalid timestamp: %s", err)
+		}
+		delete(got, "timestamp")
+		if len(got) != len(e.want) {
+			t.Errorf("got fields %v, want %v", got, e.want)
+		}
+		for k, v := range e.want {
+			if got[k] != v {
+				t.Errorf("got %s %v, want %q", k, got[k], v)
+			}
+		}
+	}
+}
+
+func TestVerifySignature(t *testing.T) {
+	body := []byte(`{"event":"crl.updated"}`)
+	for _, sig := range []string{"", "sha256=", "sha256=zz", Sign(body, "s3cr3t")[len("sha256="):], "sha1=" + Sign(body, "s3cr3t")[len("sha256="):]} {
+		if VerifySignature(body, "s3cr3t", sig) {
+			t.Errorf("signature %q verified", sig)
+		}
+	}
+}
+
+func TestWebhookNotifierRetries(t *testing.T) {
+	tests := []struct {
+		name    string
+		retries int
+		codes   []int
+		want    int
+	}{
+		{"success", 3, []int{http.StatusOK}, 1},
+		{"retried on 5xx", 3, []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusOK}, 3},
+		{"gives up after the retries", 3, []int{http.StatusInternalServerError}, 4},
+		{"not retried on 4xx", 3, []int{http.StatusBadRequest}, 1},
+		{"retries disabled", 0, []int{http.StatusInternalServerError}, 1},
+		{"default retries", -1, []int{http.StatusInternalServerError}, DefaultWebhookRetries + 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newWebhookServer(tt.codes...)
+			defer srv.Close()
+			n := &WebhookNotifier{Targets: []WebhookTarget{{URL: srv.URL}}, Retries: tt.retries}
+			n.Notify(Event{Type: EventCRLUploaded})
+			n.Close()
+			if len(srv.deliveries) != tt.want {
+				t.Errorf("got %d attempts, want %d", len(srv.deliveries), tt.want)
+			}
+		})
+	}
+}
+
+func TestWebhookNotifierTimeout(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	n := &WebhookNotifier{Targets: []WebhookTarget{{URL: srv.URL}}, Timeout: 50 * time.Millisecond, Retries: 0}
+	start := time.Now()
+	n.Notify(Event{Type: EventCRLUploaded})
+	n.Close()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("the delivery took %s, want it to time out after %s", elapsed, n.Timeout)
+	}
+}
+
+func TestWebhookNotifierNotifyAfterClose(t *testing.T) {
+	srv := newWebhookServer(http.StatusOK)
+	defer srv.Close()
+	n := &WebhookNotifier{Targets: []WebhookTarget{{URL: srv.URL}}}
+	n.Notify(Event{Type: EventCRLUploaded})
+	n.Close()
+	n.Notify(Event{Type: EventCRLUploaded})
+	n.Close()
+
+	// Or never started
+	idle := &WebhookNotifier{Targets: []WebhookTarget{{URL: srv.URL}}}
+	idle.Close()
+	idle.Notify(Event{Type: EventCRLUploaded})
+
+	if len(srv.deliveries) != 1 {
+		t.Errorf("got %d deliveries, want 1", len(srv.deliveries))
+	}
+}
@@ -0,0 +1,224 @@
+package operations
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/logging"
+	"github.com/hashicorp/vault/api"
+)
+
+// adoptedPath is where the certificates adopted into the user tracking are
+// stored in the kv store, as a map of serial numbers to usernames
+func adoptedPath(kv string) string {
+	return fmt.Sprintf("%s/data/adopted", kv)
+}
+
+// loadAdopted returns the usernames of the adopted certificates by serial number
+func loadAdopted(client *api.Client, kv string) (map[string]string, error) {
+	adopted := map[string]string{}
+	secret, err := client.Logical().Read(adoptedPath(kv))
+	if err != nil {
+		return nil, vaultError(err)
+	}
+	if secret == nil || secret.Data["data"] == nil {
+		return adopted, nil
+	}
+	data, ok := secret.Data["data"].(map[string]interface{})
+	if !ok {
+		return nil, errors.New("unexpected format of the adopted certificates")
+	}
+	for serial, username := range data {
+		if s, ok := username.(string); ok {
+			adopted[serial] = s
+		}
+	}
+	return adopted, nil
+}
+
+// certificateUsername returns the username the certificate was
+// adopted by, if any, or the one of its CN otherwise
+func certificateUsername(adopted map[string]string, crt Certificate) string {
+	if username, ok := adopted[crt.SerialNumber]; ok {
+		return username
+	}
+	return usernameFromCN(crt.SubjectCN)
+}
+
+// AdoptRequest is the structure containing the required data to adopt
+// certificates issued outside of ACPM into the user tracking
+type AdoptRequest struct {
+	Client       *api.Client
+	VaultPKIPath string
+	VaultKVPath  string
+	// CNPattern selects the certificates to adopt by their CN
+	CNPattern string
+	// UsernameRegexp is matched against the CN of the selected certificates
+	// and its first capture group, or the one named 'username', is the
+	// username they are adopted by. Defaults to CNPattern.
+	UsernameRegexp string
+	// IssuerRef, if set, restricts the adoption to the
+	// certificates issued by this issuer of the mount
+	IssuerRef string
+	// RevocationGracePeriod is the one the next UpdateCRL runs with,
+	// to preview the certificates it would revoke
+	RevocationGracePeriod time.Duration
+	// DryRun only reports the changes without storing the adoptions
+	DryRun bool
+	// UsersCache, if set, is invalidated once the adoptions are stored
+	UsersCache *UsersCache
+	// Retry is the policy the Vault calls are retried with, see UpdateCRLOptions
+	Retry  *RetryPolicy
+	Logger logging.Logger
+}
+
+// AdoptResult holds the outcome of an Adopt operation
+type AdoptResult struct {
+	// Adopted are the serial numbers of the adopted certificates, keyed by username
+	Adopted map[string][]string
+	// ToRevoke are the serial numbers of the certificates that the next
+	// UpdateCRL will revoke, as they are no longer the latest of their
+	// users once adopted, keyed by username
+	ToRevoke map[string][]string
+}
+
+// Adopt maps the certificates issued directly through Vault, whose CN
+// doesn't follow the username rule, to the users they belong to. The
+// mapping is stored in the kv store and used by ListUsers and UpdateCRL
+// when their AdoptedKVPath is set, so the adopted certificates are
+// subject to the keep-latest policy on the next UpdateCRL. Certificates
+// already listed under the right user are left as they are.
+func Adopt(r *AdoptRequest) (*AdoptResult, error) {
+	start := time.Now()
+	res, err := adopt(r)
+	observe("adopt", start, err)
+	return res, err
+}
+
+func adopt(r *AdoptRequest) (*AdoptResult, error) {
+	logger := logging.OrDefault(r.Logger).With("pki_path", r.VaultPKIPath)
+	selector, err := regexp.Compile(r.CNPattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CN pattern: %s", err)
+	}
+	mapper := selector
+	if r.UsernameRegexp != "" {
+		mapper, err = regexp.Compile(r.UsernameRegexp)
+		if err != nil {
+			return nil, fmt.Errorf("invalid username regexp: %s", err)
+		}
+	}
+	if mapper.NumSubexp() == 0 {
+		return nil, fmt.Errorf("the username regexp '%s' has no capture group", mapper.String())
+	}
+
+	users, err := ListUsers(
+		&ListUsersRequest{
+			Client:        r.Client,
+			VaultPKIPath:  r.VaultPKIPath,
+			IssuerRef:     r.IssuerRef,
+			AdoptedKVPath: r.VaultKVPath,
+			Retry:         r.Retry,
+			Logger:        r.Logger,
+		})
+	if err != nil {
+		return nil, err
+	}
+	var adopted map[string]string
+	err = retry(context.Background(), r.Retry, r.Logger, "load_adopted", vaultCall, func(context.Context) (err error) {
+		adopted, err = loadAdopted(r.Client, r.VaultKVPath)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result := &AdoptResult{Adopted: map[string][]string{}, ToRevoke: map[string][]string{}}
+	// Look up the certificates to move first, then move them, as the
+	// users are iterated over
+	type move struct {
+		from, to string
+		crt      Certificate
+	}
+	var moves []move
+	for current, crts := range users {
+		for _, crt := range crts {
+			if !selector.MatchString(crt.SubjectCN) {
+				continue
+			}
+			m := mapper.FindStringSubmatch(crt.SubjectCN)
+			if m == nil {
+				continue
+			}
+			if username := usernameFromMatch(mapper, m); username != "" && username != current {
+				moves = append(moves, move{from: current, to: username, crt: crt})
+			}
+		}
+	}
+	for _, m := range moves {
+		adopted[m.crt.SerialNumber] = m.to
+		users[m.from] = removeCertificate(users[m.from], m.crt.SerialNumber)
+		users[m.to] = append(users[m.to], m.crt)
+		result.Adopted[m.to] = append(result.Adopted[m.to], m.crt.SerialNumber)
+	}
+	for username := range result.Adopted {
+		crts := users[username]
+		sort.Slice(crts, func(i, j int) bool {
+			return crts[i].NotBefore.Before(crts[j].NotBefore)
+		})
+		if serials := supersededSerials(crts, r.RevocationGracePeriod); len(serials) > 0 {
+			result.ToRevoke[username] = serials
+		}
+	}
+
+	if r.DryRun || len(moves) == 0 {
+		logger.Info("certificates to adopt", "users", len(result.Adopted), "dry_run", r.DryRun)
+		return result, nil
+	}
+	data := map[string]interface{}{}
+	for serial, username := range adopted {
+		data[serial] = username
+	}
+	err = retry(context.Background(), r.Retry, r.Logger, "store_adopted", vaultCall, func(context.Context) error {
+		_, err := r.Client.Logical().Write(adoptedPath(r.VaultKVPath), map[string]interface{}{"data": data})
+		return vaultError(err)
+	})
+	if err != nil {
+		return nil, err
+	}
+	r.UsersCache.Invalidate()
+	b, _ := json.Marshal(result.Adopted)
+	logger.Info("adopted certificates", "users", len(result.Adopted), "adopted", string(b))
+	return result, nil
+}
+
+func removeCertificate(crts []Certificate, serial string) []Certificate {
+	var kept []Certificate
+	for _, crt := range crts {
+		if crt.SerialNumber != serial {
+			kept = append(kept, crt)
+		}
+	}
+	return kept
+}
+
+// supersededSerials returns the serial numbers of the certificates
+// that UpdateCRL revokes, mirroring revokeUserCertificates
+func supersededSerials(crts []Certificate, grace time.Duration) []string {
+	keep := supersededKept(crts, grace)
+	if len(crts) <= keep {
+		return nil
+	}
+	var serials []string
+	for _, crt := range crts[:len(crts)-keep] {
+		if !crt.Revoked {
+			serials = append(serials, crt.SerialNumber)
+		}
+	}
+	return serials
+}
@@ -0,0 +1,127 @@
+package operations
+
+import (
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+// DefaultAWSUserAgent is added to the User-Agent of the AWS API calls
+const DefaultAWSUserAgent = "aws-cvpn-pki-manager"
+
+var (
+	awsUserAgent   = DefaultAWSUserAgent
+	awsEndpointURL string
+
+	ec2ClientMu sync.Mutex
+	// injectedEC2Client is the client set with SetEC2Client
+	injectedEC2Client ec2iface.EC2API
+	// defaultAWSSession and defaultEC2Client are built on first use
+	// and dropped when the User-Agent or the endpoint URL change
+	defaultAWSSession *session.Session
+	defaultEC2Client  ec2iface.EC2API
+)
+
+// SetAWSUserAgent changes the string added to the User-Agent of the AWS
+// API calls. CloudTrail records the User-Agent of each call, which makes
+// the CRL imports attributable to ACPM: the Client VPN APIs used here
+// accept neither resource tags nor a ClientToken.
+func SetAWSUserAgent(ua string) {
+	ec2ClientMu.Lock()
+	defer ec2ClientMu.Unlock()
+	awsUserAgent = ua
+	defaultAWSSession, defaultEC2Client = nil, nil
+}
+
+// SetAWSEndpointURL points all the AWS API calls to the given URL instead
+// of the endpoints of AWS, e.g. to LocalStack to test the CRL imports
+// end to end. They go to AWS if empty, which is the default.
+func SetAWSEndpointURL(url string) {
+	ec2ClientMu.Lock()
+	defer ec2ClientMu.Unlock()
+	awsEndpointURL = url
+	defaultAWSSession, defaultEC2Client = nil, nil
+}
+
+// SetEC2Client makes all the operations use the given client for the
+// Client VPN API calls, e.g. one shared with the rest of the application
+// or a mock. The clients of the AWS SDK are safe for concurrent use, so a
+// single one serves all the operations for the lifetime of the process.
+// The client is used as is: the endpoint URL, the User-Agent and the
+// credentials, assumed roles included, are the ones it was built with,
+// see NewEC2Client, and neither SetAWSEndpointURL, SetAWSUserAgent nor the
+// AWSConfig of the requests apply to it. A nil client restores the default one, which is built on
+// first use with the User-Agent and endpoint URL set then, and rebuilt
+// once either of them changes.
+func SetEC2Client(client ec2iface.EC2API) {
+	ec2ClientMu.Lock()
+	defer ec2ClientMu.Unlock()
+	injectedEC2Client = client
+}
+
+// NewEC2Client returns an EC2 client built from a session with the
+// User-Agent and endpoint URL of the operations, with the given configs
+// applied on top, e.g. the credentials of a role to assume:
+//
+//	sess := operations.AWSSession()
+//	creds := stscreds.NewCredentials(sess, roleARN)
+//	operations.SetEC2Client(operations.NewEC2Client(aws.NewConfig().WithCredentials(creds)))
+//
+// A config setting its own endpoint overrides the endpoint URL.
+func NewEC2Client(cfgs ...*aws.Config) *ec2.EC2 {
+	return ec2.New(newAWSSession(), cfgs...)
+}
+
+// ec2Client returns the client of the Client VPN API calls, which is the
+// one set with SetEC2Client, if any, or the default one otherwise. The
+// default one is built with the given config on top, if not nil, see
+// UpdateCRLOptions.AWSConfig, the session and its credentials being
+// shared with the other requests.
+func ec2Client(cfg *aws.Config) ec2iface.EC2API {
+	ec2ClientMu.Lock()
+	defer ec2ClientMu.Unlock()
+	if injectedEC2Client != nil {
+		return injectedEC2Client
+	}
+	if defaultAWSSession == nil {
+		defaultAWSSession = buildAWSSession()
+	}
+	if cfg != nil {
+		return ec2.New(defaultAWSSession, cfg)
+	}
+	if defaultEC2Client == nil {
+		defaultEC2Client = ec2.New(defaultAWSSession)
+	}
+	return defaultEC2Client
+}
+
+// AWSSession returns a session for the AWS API calls made outside of the
+// operations, e.g. by the audit log, with the same User-Agent and
+// endpoint URL as the ones made by the operations
+func AWSSession() *session.Session {
+	return newAWSSession()
+}
+
+// newAWSSession returns the session used for all the AWS API calls
+func newAWSSession() *session.Session {
+	ec2ClientMu.Lock()
+	defer ec2ClientMu.Unlock()
+	return buildAWSSession()
+}
+
+// buildAWSSession is newAWSSession with ec2ClientMu held
+func buildAWSSession() *session.Session {
+	cfg := aws.NewConfig()
+	if awsEndpointURL != "" {
+		cfg = cfg.WithEndpoint(awsEndpointURL)
+	}
+	sess := session.New(cfg)
+	if awsUserAgent != "" {
+		sess.Handlers.Build.PushBack(request.MakeAddToUserAgentFreeFormHandler(awsUserAgent))
+	}
+	return sess
+}
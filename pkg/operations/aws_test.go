@@ -0,0 +1,30 @@
+package operations
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+// fakeEC2 answers the Client VPN API calls with a single endpoint
+type fakeEC2 struct {
+	ec2iface.EC2API
+	endpointID string
+	dnsName    string
+}
+
+// useFakeEC2 makes the operations use a fake EC2 client until the test is done
+func useFakeEC2(t *testing.T, endpointID, dnsName string) *fakeEC2 {
+	f := &fakeEC2{endpointID: endpointID, dnsName: dnsName}
+	SetEC2Client(f)
+	t.Cleanup(func() { SetEC2Client(nil) })
+	return f
+}
+
+func (f *fakeEC2) DescribeClientVpnEndpoints(in *ec2.DescribeClientVpnEndpointsInput) (*ec2.DescribeClientVpnEndpointsOutput, error) {
+	return &ec2.DescribeClientVpnEndpointsOutput{ClientVpnEndpoints: []*ec2.ClientVpnEndpoint{
+		{ClientVpnEndpointId: aws.String(f.endpointID), DnsName: aws.String(f.dnsName)},
+	}}, nil
+}
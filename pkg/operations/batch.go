@@ -0,0 +1,330 @@
+package operations
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/logging"
+	"github.com/hashicorp/vault/api"
+)
+
+// RevokeUsersRequest is the structure containing the
+// required data to revoke several users at once
+type RevokeUsersRequest struct {
+	Client              *api.Client
+	VaultPKIPath        string
+	ClientVPNEndpointID string
+	Usernames           []string
+	// Reason, if set, is recorded for each revoked
+	// certificate in the kv store under VaultKVPath
+	Reason      RevocationReason
+	VaultKVPath string
+	// RateLimiter, if set, limits how often this runs for the Caller,
+	// once per batch, and for each of the users. A *RateLimitError is
+	// returned if the Caller's limit is reached, and recorded as the
+	// error of each user whose limit is.
+	RateLimiter *RateLimiter
+	Caller      string
+	UpdateCRLOptions
+}
+
+// UserRevocation is the outcome of the revocation of one of the
+// users of a RevokeUsers batch
+type UserRevocation struct {
+	Username string
+	// Revoked are the serial numbers of the user's certificates
+	// that were revoked, even if Err is set
+	Revoked []string
+	// Err is set if the user could not be revoked. It
+	// matches ErrUserNotFound if the user has no certificates.
+	Err error
+}
+
+// RevokeUsersResult holds the outcome of a RevokeUsers operation
+type RevokeUsersResult struct {
+	// Users holds the outcome of each user, in the order requested
+	Users []UserRevocation
+	// UpdateCRLResult is the outcome of the CRL update that follows
+	// the revocations. Nil if nothing was revoked or the update
+	// failed before producing one.
+	*UpdateCRLResult
+}
+
+// RevokeUsers revokes all the issued certificates of each of the users
+// and then updates the CRL once for the whole batch. A failure revoking
+// one of the users is recorded in its UserRevocation and does not stop
+// the rest of the batch. The returned error is that of the CRL update,
+// along with the result.
+func RevokeUsers(r *RevokeUsersRequest) (*RevokeUsersResult, error) {
+
+	if err := r.RateLimiter.Allow(r.Caller, ""); err != nil {
+		return nil, err
+	}
+	logger := logging.OrDefault(r.Logger).With("endpoint_id", r.ClientVPNEndpointID, "pki_path", r.VaultPKIPath)
+	if err := checkCapabilities(r.Client, r.UpdateCRLOptions, revokeCapabilities(r.VaultPKIPath)...); err != nil {
+		return nil, err
+	}
+
+	users, err := ListUsers(
+		&ListUsersRequest{
+			Client:              r.Client,
+			VaultPKIPath:        r.VaultPKIPath,
+			ClientVPNEndpointID: r.ClientVPNEndpointID,
+			IssuerRef:           r.IssuerRef,
+			AdoptedKVPath:       r.AdoptedKVPath,
+			Retry:               r.Retry,
+			Logger:              r.Logger,
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	result := &RevokeUsersResult{}
+	seen := map[string]bool{}
+	revokedAny := false
+	for _, username := range r.Usernames {
+		username = normalizeUsername(username)
+		if seen[username] {
+			continue
+		}
+		seen[username] = true
+
+		ur := UserRevocation{Username: username}
+		if err := r.RateLimiter.Allow("", username); err != nil {
+			ur.Err = err
+		} else if len(users[username]) == 0 {
+			ur.Err = &Error{Kind: ErrUserNotFound, Err: fmt.Errorf("no certificates found for user '%s'", username)}
+		} else {
+			ur.Revoked, ur.Err = revokeUserCertificates(r.Client, r.VaultPKIPath, users[username],
+				revocationOptions{revokeAll: true, reason: r.Reason, kvPath: r.VaultKVPath, logger: r.Logger,
+					retry: r.Retry, ctx: r.Context, audit: r.Audit, usersCache: r.UsersCache, configStore: r.ConfigStore, actor: r.Actor, endpointID: r.ClientVPNEndpointID})
+		}
+		if len(ur.Revoked) > 0 {
+			revokedAny = true
+		}
+		if ur.Err != nil {
+			logger.Warn("couldn't revoke user in batch", "user", username, "error", ur.Err)
+		}
+		result.Users = append(result.Users, ur)
+	}
+
+	if !revokedAny {
+		return result, nil
+	}
+
+	result.UpdateCRLResult, err = UpdateCRL(
+		&UpdateCRLRequest{
+			Client:              r.Client,
+			VaultPKIPath:        r.VaultPKIPath,
+			ClientVPNEndpointID: r.ClientVPNEndpointID,
+			UpdateCRLOptions:    r.UpdateCRLOptions,
+		})
+	if err != nil {
+		return result, err
+	}
+
+	return result, nil
+}
+
+// DefaultIssueConcurrency is the default number of
+// certificates IssueBatch issues at the same time
+const DefaultIssueConcurrency = 4
+
+// IssueBatchRequest is the structure containing the
+// required data to issue certificates for several users
+type IssueBatchRequest struct {
+	// IssueCertificateRequest holds the settings shared by all the
+	// issuances. Its Username, TTL, Email and IdempotencyKey are ignored.
+	IssueCertificateRequest
+	Users []BatchUser
+	// Concurrency is the number of certificates issued at the
+	// same time. Defaults to DefaultIssueConcurrency.
+	Concurrency int
+}
+
+// BatchUser is each of the users of an IssueBatchRequest
+type BatchUser struct {
+	Username string
+	// TTL, if set, is the lifetime of the user's certificate
+	TTL time.Duration
+	// Metadata, if set, is stored as the user's metadata before
+	// issuing, so its Email is where the VPN config is sent to
+	Metadata *UserMetadata
+}
+
+// UserIssuance is the outcome of the issuance of one of the
+// users of an IssueBatch
+type UserIssuance struct {
+	Username string
+	// Result is nil if Err is set
+	Result *IssueCertificateResult
+	Err    error
+}
+
+// IssueBatchResult holds the outcome of an IssueBatch operation
+type IssueBatchResult struct {
+	// Users holds the outcome of each user, in the order requested
+	Users []UserIssuance
+	// UpdateCRLResult is the outcome of the CRL update that follows
+	// the issuances. Nil if nothing was issued, the certificates are
+	// temporary or the update failed before producing one.
+	*UpdateCRLResult
+}
+
+// IssueBatch issues a certificate, and stores its VPN config, for each of
+// the users, using a bounded pool of workers. As with RevokeUsers, the
+// failure of one of the users does not stop the batch and the CRL, which
+// revokes the previous certificates of the users, is updated once at the
+// end. The limits of MaxCertsPerUser are enforced for each of the users.
+func IssueBatch(r *IssueBatchRequest) (*IssueBatchResult, error) {
+
+	if err := r.RateLimiter.Allow(r.Caller, ""); err != nil {
+		return nil, err
+	}
+
+	batch := &issueBatch{}
+	if r.MaxCertsPerUser > 0 {
+		// List the users once for the whole batch
+		var err error
+		batch.users, err = ListUsers(
+			&ListUsersRequest{
+				Client:              r.Client,
+				VaultPKIPath:        r.VaultPKIPaths[len(r.VaultPKIPaths)-1],
+				ClientVPNEndpointID: r.ClientVPNEndpointID,
+				IssuerRef:           r.IssuerRef,
+				AdoptedKVPath:       r.AdoptedKVPath,
+				Retry:               r.Retry,
+				Logger:              r.Logger,
+			})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var users []BatchUser
+	seen := map[string]bool{}
+	for _, u := range r.Users {
+		u.Username = normalizeUsername(u.Username)
+		if !seen[u.Username] {
+			seen[u.Username] = true
+			users = append(users, u)
+		}
+	}
+
+	concurrency := r.Concurrency
+	if concurrency <= 0 {
+		concurrency = DefaultIssueConcurrency
+	}
+	result := &IssueBatchResult{Users: make([]UserIssuance, len(users))}
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := range jobs {
+				result.Users[n] = issueBatchUser(r, batch, users[n])
+			}
+		}()
+	}
+	for n := range users {
+		jobs <- n
+	}
+	close(jobs)
+	wg.Wait()
+
+	issued := false
+	for _, ui := range result.Users {
+		if ui.Err == nil {
+			issued = true
+			break
+		}
+	}
+	if !issued || r.Temporary {
+		return result, nil
+	}
+
+	var err error
+	result.UpdateCRLResult, err = UpdateCRL(
+		&UpdateCRLRequest{
+			Client:              r.Client,
+			VaultPKIPath:        r.VaultPKIPaths[len(r.VaultPKIPaths)-1],
+			ClientVPNEndpointID: r.ClientVPNEndpointID,
+			UpdateCRLOptions:    r.UpdateCRLOptions,
+		})
+	if err != nil {
+		return result, err
+	}
+
+	return result, nil
+}
+
+// IssueUsers issues a certificate, and stores its VPN config, for each of
+// the usernames with the settings of r, as IssueBatch does, and returns
+// the outcome of each of them by its normalized username. The Users of r
+// are ignored. The error is that of the whole batch: failing to list the
+// users, the caller's rate limit or the update of the CRL.
+func IssueUsers(r *IssueBatchRequest, usernames []string) (map[string]UserIssuance, error) {
+
+	req := *r
+	req.Users = make([]BatchUser, len(usernames))
+	for n, username := range usernames {
+		req.Users[n] = BatchUser{Username: username}
+	}
+	result, err := IssueBatch(&req)
+	if result == nil {
+		return nil, err
+	}
+	users := make(map[string]UserIssuance, len(result.Users))
+	for _, ui := range result.Users {
+		users[ui.Username] = ui
+	}
+	return users, err
+}
+
+// issueBatch holds the state shared by the issuances of an IssueBatch
+type issueBatch struct {
+	// users are the users listed before the batch started,
+	// if needed to enforce the MaxCertsPerUser
+	users map[string][]Certificate
+}
+
+func issueBatchUser(r *IssueBatchRequest, batch *issueBatch, u BatchUser) UserIssuance {
+	ui := UserIssuance{Username: u.Username}
+	logger := logging.OrDefault(r.Logger).With("user", u.Username, "endpoint_id", r.ClientVPNEndpointID)
+
+	if _, err := NormalizeUsername(u.Username); err != nil {
+		ui.Err = err
+		logger.Warn("invalid username in batch", "error", err)
+		return ui
+	}
+	if u.Metadata != nil {
+		err := SetUserMetadata(
+			&UserMetadataRequest{
+				Client:      r.Client,
+				VaultKVPath: r.VaultKVPath,
+				Username:    u.Username,
+			}, u.Metadata)
+		if err != nil {
+			ui.Err = vaultError(err)
+			logger.Warn("couldn't store the metadata of user in batch", "error", ui.Err)
+			return ui
+		}
+	}
+
+	req := r.IssueCertificateRequest
+	req.Username = u.Username
+	req.TTL = u.TTL
+	req.Email = ""
+	req.IdempotencyKey = ""
+	// The caller's limit has already been checked for the whole batch
+	req.Caller = ""
+	req.batch = batch
+
+	ui.Result, ui.Err = IssueClientCertificate(&req)
+	if ui.Err != nil {
+		logger.Warn("couldn't issue certificate of user in batch", "error", ui.Err)
+	}
+	return ui
+}
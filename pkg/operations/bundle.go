@@ -0,0 +1,139 @@
+package operations
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// CertificateBundle is an issued certificate along with its private
+// key, as stored in the kv (v2) engine when IssueCertificateRequest's
+// VaultBundleKVPath is set
+type CertificateBundle struct {
+	SerialNumber string    `json:"serial_number"`
+	Certificate  string    `json:"certificate"`
+	PrivateKey   string    `json:"private_key"`
+	CAChain      []string  `json:"ca_chain"`
+	NotAfter     time.Time `json:"not_after"`
+	// KeyNotRetained is set, and PrivateKey empty, if the private
+	// key was not stored, see IssueCertificateRequest.DiscardPrivateKey
+	KeyNotRetained bool `json:"key_not_retained,omitempty"`
+	// Version is the version of the secret the bundle was read from
+	Version int `json:"version,omitempty"`
+}
+
+func bundlePath(kv, username, serial string) string {
+	return fmt.Sprintf("%s/data/bundles/%s/%s", kv, username, serial)
+}
+
+// kvV2Mounts caches the kv mounts already checked to be v2
+var kvV2Mounts sync.Map
+
+// checkKVv2 returns an error if the kv mount is not a kv v2 one, as the
+// bundles rely on its versioning to keep the previous ones if rewritten
+func checkKVv2(client *api.Client, kv string) error {
+	if _, ok := kvV2Mounts.Load(kv); ok {
+		return nil
+	}
+	secret, err := client.Logical().Read("sys/internal/ui/mounts/" + kv)
+	if err != nil {
+		return vaultError(err)
+	}
+	if secret == nil || secret.Data == nil {
+		return fmt.Errorf("'%s' is not a kv v2 mount", kv)
+	}
+	path, _ := secret.Data["path"].(string)
+	options, _ := secret.Data["options"].(map[string]interface{})
+	version, _ := options["version"].(string)
+	if secret.Data["type"] != "kv" || version != "2" || strings.TrimSuffix(path, "/") != strings.Trim(kv, "/") {
+		return fmt.Errorf("'%s' is not a kv v2 mount", kv)
+	}
+	kvV2Mounts.Store(kv, true)
+	return nil
+}
+
+// storeCertificateBundle writes the bundle as a new version of the
+// secret of the user's certificate in the kv store
+func storeCertificateBundle(client *api.Client, kv, username string, b *CertificateBundle) error {
+	if err := checkKVv2(client, kv); err != nil {
+		return err
+	}
+	data := map[string]interface{}{
+		"serial_number": b.SerialNumber,
+		"certificate":   b.Certificate,
+		"private_key":   b.PrivateKey,
+		"ca_chain":      b.CAChain,
+		"not_after":     b.NotAfter.Format(time.RFC3339),
+	}
+	if b.KeyNotRetained {
+		data["key_not_retained"] = true
+	}
+	_, err := client.Logical().Write(bundlePath(kv, username, b.SerialNumber), map[string]interface{}{"data": data})
+	return vaultError(err)
+}
+
+// GetCertificateBundleRequest is the structure containing the
+// required data to retrieve a stored certificate bundle
+type GetCertificateBundleRequest struct {
+	Client      *api.Client
+	VaultKVPath string
+	Username    string
+	// SerialNumber is the serial number of the certificate, as
+	// returned by IssueClientCertificate
+	SerialNumber string
+	// Version, if set, is the version of the secret to read
+	// instead of the latest one
+	Version int
+	// Envelope decrypts the private key if it was stored
+	// encrypted, see UpdateCRLOptions.Envelope
+	Envelope *KMSEnvelope
+}
+
+// GetCertificateBundle returns a certificate bundle stored on issuance, so
+// the VPN config can be generated again. Returns ErrUserNotFound if there
+// is no bundle stored for the user and serial number. The bundles of the
+// certificates whose private key was not retained have no PrivateKey.
+func GetCertificateBundle(r *GetCertificateBundleRequest) (*CertificateBundle, error) {
+	if err := checkKVv2(r.Client, r.VaultKVPath); err != nil {
+		return nil, err
+	}
+	var params map[string][]string
+	if r.Version > 0 {
+		params = map[string][]string{"version": {strconv.Itoa(r.Version)}}
+	}
+	secret, err := r.Client.Logical().ReadWithData(bundlePath(r.VaultKVPath, r.Username, r.SerialNumber), params)
+	if err != nil {
+		return nil, vaultError(err)
+	}
+	if secret == nil || secret.Data["data"] == nil {
+		return nil, &Error{Kind: ErrUserNotFound, Err: fmt.Errorf("no bundle stored for certificate '%s' of user '%s'", r.SerialNumber, r.Username)}
+	}
+
+	// Round trip through json to decode the generic map
+	// returned by Vault into the bundle struct
+	raw, err := json.Marshal(secret.Data["data"])
+	if err != nil {
+		return nil, err
+	}
+	b := &CertificateBundle{}
+	if err := json.Unmarshal(raw, b); err != nil {
+		return nil, fmt.Errorf("unexpected format of the bundle stored for certificate '%s' of user '%s'", r.SerialNumber, r.Username)
+	}
+	if md, ok := secret.Data["metadata"].(map[string]interface{}); ok {
+		if v, ok := md["version"].(json.Number); ok {
+			version, _ := v.Int64()
+			b.Version = int(version)
+		}
+	}
+	b.PrivateKey, err = r.Envelope.open(context.Background(), b.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the private key of certificate '%s' of user '%s': %w", r.SerialNumber, r.Username, err)
+	}
+	return b, nil
+}
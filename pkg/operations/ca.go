@@ -0,0 +1,162 @@
+package operations
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/acm"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/hashicorp/vault/api"
+)
+
+// GetCAChainRequest is the structure containing
+// the required data to retrieve the CA chain
+type GetCAChainRequest struct {
+	Client        *api.Client
+	VaultPKIPaths []string
+}
+
+// GetCAChain returns the PEM encoded CA certificates of each
+// of the given PKI paths, in the same order as the paths
+func GetCAChain(r *GetCAChainRequest) ([]string, error) {
+	var caCerts []string
+	for _, path := range r.VaultPKIPaths {
+		req := r.Client.NewRequest("GET", fmt.Sprintf("/v1/%s/ca/pem", path))
+		raw, err := r.Client.RawRequest(req)
+		if err != nil {
+			return nil, err
+		}
+		ca, err := ioutil.ReadAll(raw.Body)
+		raw.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		caCerts = append(caCerts, string(ca))
+	}
+	return caCerts, nil
+}
+
+// VerifyEndpointCARequest is the structure containing the
+// required data to verify the CA of a Client VPN endpoint
+type VerifyEndpointCARequest struct {
+	Client              *api.Client
+	VaultPKIPaths       []string
+	ClientVPNEndpointID string
+	// AWSConfig, if set, is applied to the EC2 and ACM
+	// clients, see UpdateCRLOptions.AWSConfig
+	AWSConfig *aws.Config
+}
+
+// VerifyEndpointCA checks that the server certificate of the Client VPN
+// endpoint, as stored in ACM, has been issued by one of the CAs of the
+// given Vault PKI paths. An error is returned otherwise, as a CRL from
+// these PKI paths would not correspond to the endpoint's trust chain.
+func VerifyEndpointCA(r *VerifyEndpointCARequest) error {
+
+	sess := newAWSSession()
+	rsp, err := ec2Client(r.AWSConfig).DescribeClientVpnEndpoints(
+		&ec2.DescribeClientVpnEndpointsInput{ClientVpnEndpointIds: aws.StringSlice([]string{r.ClientVPNEndpointID})})
+	if err != nil {
+		return err
+	}
+	if len(rsp.ClientVpnEndpoints) == 0 || rsp.ClientVpnEndpoints[0].ServerCertificateArn == nil {
+		return fmt.Errorf("unable to get the server certificate of endpoint %s", r.ClientVPNEndpointID)
+	}
+
+	crt, err := acm.New(sess, r.AWSConfig).GetCertificate(
+		&acm.GetCertificateInput{CertificateArn: rsp.ClientVpnEndpoints[0].ServerCertificateArn})
+	if err != nil {
+		return err
+	}
+	serverCert, err := parseCertificatePEM(aws.StringValue(crt.Certificate))
+	if err != nil {
+		return err
+	}
+	intermediates := x509.NewCertPool()
+	intermediates.AppendCertsFromPEM([]byte(aws.StringValue(crt.CertificateChain)))
+
+	chain, err := GetCAChain(
+		&GetCAChainRequest{
+			Client:        r.Client,
+			VaultPKIPaths: r.VaultPKIPaths,
+		})
+	if err != nil {
+		return err
+	}
+	roots := x509.NewCertPool()
+	for _, ca := range chain {
+		cert, err := parseCertificatePEM(ca)
+		if err != nil {
+			return err
+		}
+		roots.AddCert(cert)
+	}
+
+	_, err = serverCert.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return fmt.Errorf("the server certificate of endpoint %s was not issued by the Vault PKI: %s", r.ClientVPNEndpointID, err)
+	}
+
+	return nil
+}
+
+// verifyCRLSignature checks that the CRL was signed by the CA of the PKI
+// path, or by the given issuer of the mount if set. Otherwise an error
+// matching ErrCRLSignatureInvalid is returned, as the endpoint would
+// not trust it.
+func verifyCRLSignature(client *api.Client, pki, issuerRef string, crl []byte) error {
+	path := fmt.Sprintf("/v1/%s/ca/pem", pki)
+	if issuerRef != "" {
+		path = fmt.Sprintf("/v1/%s/issuer/%s/pem", pki, issuerRef)
+	}
+	raw, err := client.RawRequest(client.NewRequest("GET", path))
+	if err != nil {
+		return vaultRawError(raw, err)
+	}
+	ca, err := ioutil.ReadAll(raw.Body)
+	raw.Body.Close()
+	if err != nil {
+		return err
+	}
+	caCert, err := parseCertificatePEM(string(ca))
+	if err != nil {
+		return err
+	}
+
+	parsed, err := parseCRL(crl)
+	if err != nil {
+		return &Error{Kind: ErrCRLSignatureInvalid, Err: err}
+	}
+	if err := caCert.CheckCRLSignature(parsed); err != nil {
+		return &Error{Kind: ErrCRLSignatureInvalid,
+			Err: fmt.Errorf("the CRL was not signed by the CA of %s (%s): %s", pki, caCert.Subject, err)}
+	}
+	return nil
+}
+
+// parseCertificatePEM parses a single PEM encoded certificate
+func parseCertificatePEM(crt string) (*x509.Certificate, error) {
+	block, _ := pem.Decode([]byte(crt))
+	if block == nil {
+		return nil, errors.New("failed to parse certificate PEM")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// issuerPath returns the path of a role endpoint of the PKI, like
+// issue or sign, going through the given issuer if set so it is used
+// instead of the default issuer of the mount
+func issuerPath(pki, issuerRef, endpoint, role string) string {
+	if issuerRef == "" {
+		return fmt.Sprintf("%s/%s/%s", pki, endpoint, role)
+	}
+	return fmt.Sprintf("%s/issuer/%s/%s/%s", pki, issuerRef, endpoint, role)
+}
@@ -0,0 +1,71 @@
+package operations
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// CapabilitiesError is returned when the Vault token lacks a capability
+// an operation requires, before the operation changes anything. It
+// matches ErrPermissionDenied.
+type CapabilitiesError struct {
+	Path     string
+	Required string
+	// Granted are the capabilities of the token on Path
+	Granted []string
+}
+
+// Unwrap returns ErrPermissionDenied
+func (e *CapabilitiesError) Unwrap() error {
+	return ErrPermissionDenied
+}
+
+func (e *CapabilitiesError) Error() string {
+	return fmt.Sprintf("the vault token lacks the '%s' capability on %s, it has: %s", e.Required, e.Path, strings.Join(e.Granted, ", "))
+}
+
+// capability is a capability the token needs on a path
+type capability struct {
+	path string
+	name string
+}
+
+// checkCapabilities looks up, with sys/capabilities-self, the capabilities
+// of the token on each of the paths and returns a *CapabilitiesError for
+// the first one missing. Nothing is checked unless opts.CheckCapabilities.
+func checkCapabilities(client *api.Client, opts UpdateCRLOptions, required ...capability) error {
+	if !opts.CheckCapabilities {
+		return nil
+	}
+	for _, c := range required {
+		granted, err := client.Sys().CapabilitiesSelf(c.path)
+		if err != nil {
+			return fmt.Errorf("unable to look up the capabilities of the vault token on %s, skip the check if the lookup is not allowed: %w", c.path, vaultError(err))
+		}
+		if !hasCapability(granted, c.name) {
+			return &CapabilitiesError{Path: c.path, Required: c.name, Granted: granted}
+		}
+	}
+	return nil
+}
+
+func hasCapability(granted []string, name string) bool {
+	for _, g := range granted {
+		if g == name || g == "root" {
+			return true
+		}
+	}
+	return false
+}
+
+// revokeCapabilities are required to revoke certificates of the PKI
+func revokeCapabilities(pki string) []capability {
+	return []capability{{path: pki + "/revoke", name: "update"}}
+}
+
+// rotateCapabilities are required to rotate the CRL of the PKI
+func rotateCapabilities(pki string) []capability {
+	return []capability{{path: pki + "/crl/rotate", name: "read"}}
+}
@@ -2,17 +2,20 @@ package operations
 
 import (
 	"bytes"
+	"context"
 	"fmt"
-	"io/ioutil"
-	"log"
-	"path"
 	"strings"
 	"text/template"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
 
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/audit"
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/directory"
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/logging"
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/mail"
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/tracing"
 	"github.com/hashicorp/vault/api"
 )
 
@@ -25,118 +28,489 @@ type IssueCertificateRequest struct {
 	VaultPKIRole        string
 	ClientVPNEndpointID string
 	VaultKVPath         string
-	CfgTplPath          string
-	Temporary           bool
+	// VaultBundleKVPath, if set, is the kv (v2) mount where the
+	// certificate and its private key are stored, see GetCertificateBundle
+	VaultBundleKVPath string
+	// CfgTemplate is the OpenVPN config template. If nil, the
+	// template at CfgTplPath or the DefaultConfigTemplate is used.
+	CfgTemplate *template.Template
+	CfgTplPath  string
+	// CfgFromEndpoint generates the VPN config from the one exported
+	// from the Client VPN endpoint instead of using the template.
+	// CfgCache, if set, caches the exported config between issuances.
+	CfgFromEndpoint bool
+	CfgCache        *ClientConfigCache
+	Temporary       bool
+	// DiscardPrivateKey, if set, returns the private key only in the
+	// result: the bundle and the VPN configs stored, or emailed, have the
+	// certificate without its key, see KeyNotRetainedNotice, and the
+	// certificate is recorded in the KeyNotRetained of the user's metadata
+	DiscardPrivateKey bool
+	// TTL, if set, is requested to Vault as the lifetime of the
+	// certificate. It can't exceed the max_ttl of the role.
+	TTL time.Duration
+	// ValidateBundle runs the checks of ValidateBundle on the issued
+	// certificate before storing or returning anything. The certificate
+	// is revoked and an *InvalidBundleError returned if any fails.
+	ValidateBundle bool
+	// AltNames, IPSANs and EmailSANs are the DNS names, IP addresses and
+	// emails added as subject alternative names of the certificate. They
+	// must be allowed by the role, see checkSANs.
+	AltNames  []string
+	IPSANs    []string
+	EmailSANs []string
+	// Mailer, if set, is used to email the VPN config, from MailFrom, to
+	// the Email address or the one found in the user's metadata
+	Mailer   mail.Mailer
+	MailFrom string
+	Email    string
+	// IdempotencyKey, if set along with Idempotency, makes the retries
+	// of the same issuance for the same user return the original result
+	IdempotencyKey string
+	Idempotency    *IdempotencyCache
+	// MaxCertsPerUser, if set, is the maximum number of active certificates
+	// a user can have. The issuance fails with a *CertLimitError when the
+	// limit is reached, unless RevokeOldest is set, in which case the oldest
+	// certificates of the user are revoked to make room for the new one.
+	MaxCertsPerUser int
+	RevokeOldest    bool
+	// DenyListKVPath, if set, is the kv store of the deny-list. The
+	// issuance fails with a *DeniedUserError for the users in it.
+	DenyListKVPath string
+	// Directory, if set, is checked for the user to exist and be active
+	// in the identity provider, see checkDirectory
+	Directory directory.Checker
+	// RateLimiter, if set, limits how often this runs for the Caller
+	// and for the user. A *RateLimitError is returned when reached.
+	RateLimiter *RateLimiter
+	Caller      string
+	UpdateCRLOptions
+
+	// batch is set when issuing as part of IssueBatch or AutoRenew
+	batch *issueBatch
+}
+
+// IssueCertificateResult holds the issued certificate
+// and the VPN config generated for it
+type IssueCertificateResult struct {
+	SerialNumber string
+	Certificate  string
+	PrivateKey   string
+	CAChain      []string
+	NotAfter     time.Time
+	Config       string
+	// ConfigPath is where the config was stored in the kv store, as
+	// used by 'vault kv get'. Empty for temporary certificates.
+	ConfigPath string
+	// EmailedTo is the address the config was sent to, if any
+	EmailedTo string
+	// EmailError holds the error if the config could not be sent. It
+	// does not cause the issuance to fail.
+	EmailError error
+	// Replayed is true if this is the result of a previous
+	// issuance with the same IdempotencyKey
+	Replayed bool
+	// KeyDiscarded is true if the private key was not stored, see
+	// DiscardPrivateKey. The replays of the issuance don't return it
+	// then, only the stored config.
+	KeyDiscarded bool
+
+	// storedConfig is the config without the private key
+	// stored when it is discarded
+	storedConfig string
 }
 
 // IssueClientCertificate generates a new certificate for a given users, causing
-// the revocation of other certificates emitted for that same user
-func IssueClientCertificate(r *IssueCertificateRequest) (string, error) {
-
-	// Init the struct to pass to the config.ovpn.tpl template
-	data := struct {
-		DNSName     string
-		Username    string
-		CA          string
-		Certificate string
-		PrivateKey  string
-	}{
-		Username: r.Username,
+// the revocation of other certificates emitted for that same user. The
+// Username is normalized first, see NormalizeUsername.
+func IssueClientCertificate(r *IssueCertificateRequest) (*IssueCertificateResult, error) {
+	username, err := NormalizeUsername(r.Username)
+	if err != nil {
+		return nil, err
+	}
+	r.Username = username
+
+	issue := func() (*IssueCertificateResult, error) {
+		// Retries replayed from the idempotency cache are not limited
+		if err := r.RateLimiter.Allow(r.Caller, r.Username); err != nil {
+			return nil, err
+		}
+		start := time.Now()
+		result, err := issueClientCertificate(r)
+		observe("issue", start, err)
+		if err == nil {
+			metrics.CertificateIssued()
+		}
+		return result, err
+	}
+	if r.IdempotencyKey == "" || r.Idempotency == nil {
+		return issue()
+	}
+	var issued *IssueCertificateResult
+	result, err := r.Idempotency.do(r.Username+"/"+r.IdempotencyKey, func() (*IssueCertificateResult, error) {
+		result, err := issue()
+		if err != nil || !result.KeyDiscarded {
+			return result, err
+		}
+		// Keep the private key out of the cache, so only
+		// this call returns it
+		issued = result
+		keyless := *result
+		keyless.PrivateKey, keyless.Config = "", result.storedConfig
+		return &keyless, nil
+	})
+	if issued != nil {
+		return issued, nil
+	}
+	return result, err
+}
+
+func issueClientCertificate(r *IssueCertificateRequest) (*IssueCertificateResult, error) {
+	ctx, cancel := startOperation(r.UpdateCRLOptions, "issue_certificate")
+	defer cancel()
+	opts := r.UpdateCRLOptions
+	opts.Context = ctx
+	defer r.UsersCache.Invalidate()
+
+	if err := checkDenyList(r.Client, r.DenyListKVPath, r.Username); err != nil {
+		return nil, err
+	}
+	if err := checkDirectory(r.Directory, r.Username); err != nil {
+		return nil, err
+	}
+	if err := checkSuspended(r.Client, r.SuspensionKVPath, r.Username); err != nil {
+		return nil, err
+	}
+	if err := checkSANs(r); err != nil {
+		return nil, err
+	}
+	if r.Mailer != nil && r.Email != "" {
+		if _, err := mail.ParseAddress(r.Email); err != nil {
+			return nil, &Error{Kind: ErrInvalidEmail, Err: err}
+		}
+	}
+	if r.ConfigStore != nil && r.Envelope != nil && !r.DiscardPrivateKey && !r.Temporary {
+		// The pre-signed URLs have to return the configs ready to import,
+		// so they can't be encrypted with the envelope before the upload
+		return nil, fmt.Errorf("the VPN configs can't be stored in S3 with their private key when the private keys are encrypted with KMS, discard the private keys or disable the config store")
+	}
+
+	if r.MaxCertsPerUser > 0 {
+		var users map[string][]Certificate
+		if r.batch != nil {
+			users = r.batch.users
+		}
+		err := enforceCertLimit(r.Client, r.VaultPKIPaths[len(r.VaultPKIPaths)-1], r.IssuerRef, r.ClientVPNEndpointID,
+			r.Username, users, r.MaxCertsPerUser, r.RevokeOldest, r.VaultKVPath, opts)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	// Issue a new certificate
 	payload := make(map[string]interface{})
 	payload["common_name"] = r.Username
-	crt, err := r.Client.Logical().Write(fmt.Sprintf("%s/issue/%s", r.VaultPKIPaths[len(r.VaultPKIPaths)-1], r.VaultPKIRole), payload)
+	if r.TTL > 0 {
+		payload["ttl"] = r.TTL.String()
+	}
+	addSANs(r, payload)
+	var crt *api.Secret
+	err := retry(ctx, r.Retry, r.Logger, "issue", vaultCall, func(context.Context) (err error) {
+		crt, err = r.Client.Logical().Write(issuerPath(r.VaultPKIPaths[len(r.VaultPKIPaths)-1], r.IssuerRef, "issue", r.VaultPKIRole), payload)
+		return vaultError(err)
+	})
 	if err != nil {
-		return "", err
+		if hasSANs(r) {
+			return nil, sanRejected(err)
+		}
+		return nil, err
 	}
-	data.Certificate = crt.Data["certificate"].(string)
-	data.PrivateKey = crt.Data["private_key"].(string)
-	log.Printf("Issued certificate %s", crt.Data["serial_number"])
+	result := &IssueCertificateResult{
+		SerialNumber: crt.Data["serial_number"].(string),
+		Certificate:  crt.Data["certificate"].(string),
+		PrivateKey:   crt.Data["private_key"].(string),
+	}
+	logger := logging.OrDefault(r.Logger).With("user", r.Username, "endpoint_id", r.ClientVPNEndpointID)
+	logger.Info("issued certificate", "serial", result.SerialNumber, "temporary", r.Temporary)
+
+	parsed, err := parseCertificatePEM(result.Certificate)
+	if err != nil {
+		return nil, err
+	}
+	result.NotAfter = parsed.NotAfter
 
 	// Get the full CA chain of certificates from Vault
 	// (the VPN config needs the full CA chain to the root CA in it)
-	var caCerts []string
-	for _, path := range r.VaultPKIPaths {
-		req := r.Client.NewRequest("GET", fmt.Sprintf("/v1/%s/ca/pem", path))
-		raw, err := r.Client.RawRequest(req)
-		if err != nil {
-			return "", err
+	result.CAChain, err = GetCAChain(
+		&GetCAChainRequest{
+			Client:        r.Client,
+			VaultPKIPaths: r.VaultPKIPaths,
+		})
+	if err != nil {
+		return nil, err
+	}
+	if r.ValidateBundle {
+		if err := validateIssuedBundle(ctx, r, result); err != nil {
+			return nil, err
+		}
+	}
+
+	result.KeyDiscarded = r.DiscardPrivateKey
+	if r.VaultBundleKVPath != "" && !r.Temporary {
+		var key string
+		if !r.DiscardPrivateKey {
+			err = retry(ctx, r.Retry, r.Logger, "kms_encrypt", awsCall, func(ctx context.Context) (err error) {
+				key, err = r.Envelope.seal(ctx, result.PrivateKey)
+				return err
+			})
+			if err != nil {
+				return nil, err
+			}
 		}
-		defer raw.Body.Close()
-		ca, err := ioutil.ReadAll(raw.Body)
+		err = retry(ctx, r.Retry, r.Logger, "store_bundle", vaultCall, func(context.Context) error {
+			return storeCertificateBundle(r.Client, r.VaultBundleKVPath, r.Username,
+				&CertificateBundle{
+					SerialNumber:   result.SerialNumber,
+					Certificate:    result.Certificate,
+					PrivateKey:     key,
+					CAChain:        result.CAChain,
+					NotAfter:       result.NotAfter,
+					KeyNotRetained: r.DiscardPrivateKey,
+				})
+		})
 		if err != nil {
-			return "", err
+			return nil, err
 		}
-		caCerts = append(caCerts, string(ca))
+		logger.Info("stored certificate bundle", "serial", result.SerialNumber, "kv_path", r.VaultBundleKVPath)
 	}
-	data.CA = strings.Join(caCerts, "\n")
 
-	// Get the VPN's DNS name from EC2 API
-	svc := ec2.New(session.New())
-	rsp, err := svc.DescribeClientVpnEndpoints(
-		&ec2.DescribeClientVpnEndpointsInput{ClientVpnEndpointIds: aws.StringSlice([]string{r.ClientVPNEndpointID})})
+	result.Config, err = generateConfig(r, result, result.PrivateKey)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	// AWS returns the DNSName with an asterisk at the beginning, meaning that any subdomain
-	// of the VPN's endpoint domain is valid. We need to strip this from the dns to use it
-	// in the config
-	data.DNSName = strings.SplitN(*rsp.ClientVpnEndpoints[0].DnsName, ".", 2)[1]
-
-	// Resolve the config.ovpn.tpl template
-	tpl, err := template.New(path.Base(r.CfgTplPath)).ParseFiles(r.CfgTplPath)
-	if err != nil {
-		return "", err
-	}
-	var config bytes.Buffer
-	if err := tpl.Execute(&config, data); err != nil {
-		return "", err
+	result.storedConfig = result.Config
+	if r.DiscardPrivateKey {
+		result.storedConfig, err = generateConfig(r, result, KeyNotRetainedNotice)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	if !r.Temporary {
 		// create/update the vpn config in the kv store
+		var content string
+		err = retry(ctx, r.Retry, r.Logger, "kms_encrypt", awsCall, func(ctx context.Context) (err error) {
+			content, err = r.Envelope.seal(ctx, result.storedConfig)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
 		payload["data"] = map[string]string{
-			"content": config.String(),
+			"content": content,
 		}
-		_, err = r.Client.Logical().Write(fmt.Sprintf("%s/data/users/%s/config.ovpn", r.VaultKVPath, r.Username), payload)
+		err = retry(ctx, r.Retry, r.Logger, "write_config", vaultCall, func(context.Context) error {
+			_, err := r.Client.Logical().Write(fmt.Sprintf("%s/data/users/%s/config.ovpn", r.VaultKVPath, r.Username), payload)
+			return vaultError(err)
+		})
 		if err != nil {
-			return "", err
+			return nil, err
+		}
+		result.ConfigPath = fmt.Sprintf("%s/users/%s/config.ovpn", r.VaultKVPath, r.Username)
+		if r.ConfigStore != nil {
+			err = retry(ctx, r.Retry, r.Logger, "store_config", awsCall, func(ctx context.Context) error {
+				return r.ConfigStore.put(ctx, r.Username, result.SerialNumber, result.storedConfig)
+			})
+			if err != nil {
+				return nil, err
+			}
+			logger.Info("stored the VPN config in S3", "serial", result.SerialNumber, "bucket", r.ConfigStore.Bucket)
+		}
+		if r.DiscardPrivateKey {
+			err = recordKeyNotRetained(&UserMetadataRequest{Client: r.Client, VaultKVPath: r.VaultKVPath, Username: r.Username, Retry: r.Retry}, result.SerialNumber)
+			if err != nil {
+				return nil, err
+			}
+			logger.Info("discarded the private key", "serial", result.SerialNumber)
 		}
 
-		// Call UpdateCRL to revoke all other certificates
-		_, err = UpdateCRL(
-			&UpdateCRLRequest{
-				Client:              r.Client,
-				VaultPKIPath:        r.VaultPKIPaths[len(r.VaultPKIPaths)-1],
+		// Call UpdateCRL to revoke all other certificates. A batch
+		// updates it once after all the issuances instead.
+		if r.batch == nil {
+			_, err = UpdateCRL(
+				&UpdateCRLRequest{
+					Client:              r.Client,
+					VaultPKIPath:        r.VaultPKIPaths[len(r.VaultPKIPaths)-1],
+					ClientVPNEndpointID: r.ClientVPNEndpointID,
+					UpdateCRLOptions:    opts,
+				})
+
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if r.Mailer != nil {
+		result.EmailedTo, result.EmailError = emailConfig(r, result)
+		if result.EmailError != nil {
+			logger.Warn("failed to email the VPN config", "error", result.EmailError)
+		} else if result.EmailedTo != "" {
+			logger.Info("emailed the VPN config", "email", result.EmailedTo)
+		}
+	}
+
+	return result, nil
+}
+
+// generateConfig returns the VPN config of the issued
+// certificate with the given private key in it
+func generateConfig(r *IssueCertificateRequest, crt *IssueCertificateResult, key string) (string, error) {
+	if r.CfgFromEndpoint {
+		return GenerateConfig(
+			&GenerateConfigRequest{
 				ClientVPNEndpointID: r.ClientVPNEndpointID,
+				Certificate:         crt.Certificate,
+				PrivateKey:          key,
+				CAChain:             crt.CAChain,
+				Cache:               r.CfgCache,
+				AWSConfig:           r.AWSConfig,
 			})
+	}
+	withKey := *crt
+	withKey.PrivateKey = key
+	return renderConfigTemplate(r, &withKey)
+}
+
+// renderConfigTemplate resolves the OpenVPN config
+// template for the issued certificate
+func renderConfigTemplate(r *IssueCertificateRequest, crt *IssueCertificateResult) (string, error) {
+
+	data := ConfigTemplateData{
+		Username: r.Username,
+		CAChain:  strings.Join(crt.CAChain, "\n"),
+		Cert:     crt.Certificate,
+		Key:      crt.PrivateKey,
+	}
+
+	// Get the VPN's DNS name from EC2 API
+	svc := ec2Client(r.AWSConfig)
+	rsp, err := svc.DescribeClientVpnEndpoints(
+		&ec2.DescribeClientVpnEndpointsInput{ClientVpnEndpointIds: aws.StringSlice([]string{r.ClientVPNEndpointID})})
+	if err != nil {
+		return "", err
+	}
+	// AWS returns the DNSName with an asterisk at the beginning, meaning that any subdomain
+	// of the VPN's endpoint domain is valid. We need to strip this from the dns to use it
+	// in the config
+	data.EndpointDNS = strings.SplitN(*rsp.ClientVpnEndpoints[0].DnsName, ".", 2)[1]
+
+	// Aliases used by older templates
+	data.DNSName = data.EndpointDNS
+	data.CA = data.CAChain
+	data.Certificate = data.Cert
+	data.PrivateKey = data.Key
 
+	tpl := r.CfgTemplate
+	if tpl == nil {
+		tpl, err = LoadConfigTemplate(r.CfgTplPath, "")
 		if err != nil {
 			return "", err
 		}
 	}
+	var config bytes.Buffer
+	if err := tpl.Execute(&config, data); err != nil {
+		return "", err
+	}
 
 	return config.String(), nil
 }
 
+// supersededKept returns how many of the certificates, sorted from oldest to
+// newest, are kept valid when revoking the superseded ones: the latest, and
+// the previous one too while the latest is not older than grace
+func supersededKept(crts []Certificate, grace time.Duration) int {
+	if grace > 0 && len(crts) > 0 && time.Since(crts[len(crts)-1].NotBefore) < grace {
+		return 2
+	}
+	return 1
+}
+
 // revokeUserCertificates receives a list of certificates, sorted from oldest to newest, and revokes
 // all but the latest if "revokeAll" is false and all of them if "revokeAll" is true.
-func revokeUserCertificates(client *api.Client, pki string, crts []Certificate, revokeAll bool) error {
+// When not revoking all, the certificate previous to the latest is kept valid until
+// the latest one is older than "grace", so users have time to switch to the new
+// certificate. The serial numbers of the revoked certificates are returned.
+func revokeUserCertificates(client *api.Client, pki string, crts []Certificate, opts revocationOptions) ([]string, error) {
 
+	keep := 0
+	if !opts.revokeAll {
+		keep = supersededKept(crts, opts.grace)
+	}
+	defer opts.usersCache.Invalidate()
+
+	reason := opts.reason
+	if reason == "" {
+		reason = ReasonSuperseded
+		if opts.revokeAll {
+			reason = ReasonUnspecified
+		}
+	}
+
+	var revoked []string
 	for n, crt := range crts {
-		// Do not revoke the last certificate
-		if n == len(crts)-1 && revokeAll == false {
+		// Do not revoke the last certificates
+		if n >= len(crts)-keep {
 			break
 		}
 		if crt.Revoked == false {
 			payload := make(map[string]interface{})
 			payload["serial_number"] = crt.SerialNumber
-			log.Printf("Revoked cert %s\n", crt.SerialNumber)
-			client.Logical().Write(fmt.Sprintf("%s/revoke", pki), payload)
+			err := retry(opts.ctx, opts.retry, opts.logger, "vault_revoke", vaultCall, func(context.Context) error {
+				span := tracing.Start("vault_revoke", "pki_path", pki, "serial", crt.SerialNumber, "reason", reason)
+				_, err := client.Logical().Write(fmt.Sprintf("%s/revoke", pki), payload)
+				span.RecordError(err)
+				span.End()
+				return vaultError(err)
+			})
+			if opts.audit != nil {
+				opts.audit.Log(audit.Entry{Operation: audit.OperationRevokeCertificate, Actor: opts.actor, EndpointID: opts.endpointID,
+					Username: usernameFromCN(crt.SubjectCN), SerialNumbers: []string{crt.SerialNumber}, Reason: string(reason)}, err)
+			}
+			if err != nil {
+				return revoked, err
+			}
+			logger := logging.OrDefault(opts.logger)
+			if opts.revokeAll {
+				logger.Info("revoked certificate", "user", usernameFromCN(crt.SubjectCN), "serial", crt.SerialNumber, "reason", reason, "pki_path", pki)
+			} else {
+				// Superseded certificates are revoked on every UpdateCRL, so
+				// they are only logged one by one when debugging
+				logger.Debug("revoked superseded certificate", "user", usernameFromCN(crt.SubjectCN), "serial", crt.SerialNumber,
+					"not_before", crt.NotBefore, "not_after", crt.NotAfter, "superseded_by", crts[len(crts)-1].SerialNumber, "pki_path", pki)
+			}
+			revoked = append(revoked, crt.SerialNumber)
+			metrics.CertificatesRevoked(1)
+			if opts.configStore != nil {
+				// The revocation is done, so failing to delete the config
+				// doesn't fail it: the config is useless anyway
+				err := retry(opts.ctx, opts.retry, opts.logger, "delete_config", awsCall, func(ctx context.Context) error {
+					return opts.configStore.delete(ctx, crt.SubjectCN, crt.SerialNumber)
+				})
+				if err != nil {
+					logger.Warn("unable to delete the stored VPN config", "user", usernameFromCN(crt.SubjectCN), "serial", crt.SerialNumber, "error", err)
+				}
+			}
+			// Keep the caller's view of the certificates up to date
+			crts[n].Revoked = true
+			crts[n].RevocationReason = reason
+			if opts.kvPath != "" {
+				if err := storeRevocationReason(client, opts.kvPath, crt.SerialNumber, reason); err != nil {
+					return revoked, err
+				}
+			}
 		}
 	}
 
-	return nil
+	return revoked, nil
 }
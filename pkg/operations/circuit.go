@@ -0,0 +1,178 @@
+package operations
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/logging"
+	"github.com/hashicorp/vault/api"
+)
+
+// States of the circuit breaker of the Vault calls
+const (
+	CircuitClosed   = "closed"
+	CircuitOpen     = "open"
+	CircuitHalfOpen = "half-open"
+)
+
+const (
+	// DefaultVaultCircuitThreshold is the number of consecutive
+	// failures that open the circuit breaker of the Vault calls
+	DefaultVaultCircuitThreshold = 5
+	// DefaultVaultCircuitCoolDown is how long the circuit breaker
+	// of the Vault calls stays open before probing Vault again
+	DefaultVaultCircuitCoolDown = 30 * time.Second
+)
+
+// CircuitOpenError is returned right away, without calling Vault, while
+// the circuit breaker of the Vault calls is open, see
+// SetVaultCircuitBreaker. It matches both ErrVaultCircuitOpen and
+// ErrVaultUnavailable.
+type CircuitOpenError struct {
+	// Failures is the number of consecutive failures that opened it
+	Failures int
+	// Until is when Vault will be probed again
+	Until time.Time
+}
+
+// Unwrap returns ErrVaultCircuitOpen
+func (e *CircuitOpenError) Unwrap() error {
+	return ErrVaultCircuitOpen
+}
+
+// Is reports whether the target is ErrVaultUnavailable, as Vault
+// can't be used while the circuit is open
+func (e *CircuitOpenError) Is(target error) bool {
+	return target == ErrVaultUnavailable
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("vault circuit open after %d consecutive failures until %s", e.Failures, e.Until.Format(time.RFC3339))
+}
+
+// CircuitStatus is the state of the circuit breaker of the Vault calls
+type CircuitStatus struct {
+	// Enabled is false if SetVaultCircuitBreaker wasn't
+	// called with a positive threshold
+	Enabled             bool      `json:"enabled"`
+	State               string    `json:"state"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	OpenUntil           time.Time `json:"open_until,omitempty"`
+}
+
+// circuitBreaker fails the calls fast after threshold consecutive failures,
+// for coolDown, and then lets a single call through to probe the service
+type circuitBreaker struct {
+	threshold int
+	coolDown  time.Duration
+	state     string
+	failures  int
+	openedAt  time.Time
+	probing   bool
+	sync.Mutex
+}
+
+var vaultCircuit = &circuitBreaker{state: CircuitClosed}
+
+// SetVaultCircuitBreaker makes the Vault calls of the operations fail fast
+// with a *CircuitOpenError, for coolDown, after threshold consecutive
+// failures due to Vault being unavailable. A single call then probes Vault,
+// which closes the circuit if it succeeds or opens it again otherwise.
+// A threshold of 0 disables the circuit breaker, which is the default.
+func SetVaultCircuitBreaker(threshold int, coolDown time.Duration) {
+	if coolDown <= 0 {
+		coolDown = DefaultVaultCircuitCoolDown
+	}
+	vaultCircuit.Lock()
+	defer vaultCircuit.Unlock()
+	vaultCircuit.threshold, vaultCircuit.coolDown = threshold, coolDown
+	vaultCircuit.setState(CircuitClosed)
+	vaultCircuit.failures, vaultCircuit.probing = 0, false
+}
+
+// VaultCircuit returns the state of the circuit
+// breaker of the Vault calls, see SetVaultCircuitBreaker
+func VaultCircuit() CircuitStatus {
+	vaultCircuit.Lock()
+	defer vaultCircuit.Unlock()
+	status := CircuitStatus{Enabled: vaultCircuit.threshold > 0, State: vaultCircuit.state, ConsecutiveFailures: vaultCircuit.failures}
+	if vaultCircuit.state == CircuitOpen {
+		status.OpenUntil = vaultCircuit.openedAt.Add(vaultCircuit.coolDown)
+	}
+	return status
+}
+
+// allow returns a *CircuitOpenError if the call must fail fast
+func (c *circuitBreaker) allow() error {
+	c.Lock()
+	defer c.Unlock()
+	if c.threshold <= 0 {
+		return nil
+	}
+	switch c.state {
+	case CircuitOpen:
+		if time.Since(c.openedAt) < c.coolDown {
+			return &CircuitOpenError{Failures: c.failures, Until: c.openedAt.Add(c.coolDown)}
+		}
+		c.setState(CircuitHalfOpen)
+		c.probing = true
+	case CircuitHalfOpen:
+		// Only one call probes the service at a time
+		if c.probing {
+			return &CircuitOpenError{Failures: c.failures, Until: c.openedAt.Add(c.coolDown)}
+		}
+		c.probing = true
+	}
+	return nil
+}
+
+// record updates the breaker with the outcome of an allowed call
+func (c *circuitBreaker) record(err error) {
+	c.Lock()
+	defer c.Unlock()
+	if c.threshold <= 0 {
+		return
+	}
+	c.probing = false
+	if !vaultDown(err) {
+		c.failures = 0
+		if c.state != CircuitClosed {
+			logging.Default().Info("vault circuit closed")
+			c.setState(CircuitClosed)
+		}
+		return
+	}
+	c.failures++
+	if c.state == CircuitHalfOpen || c.failures >= c.threshold {
+		if c.state != CircuitOpen {
+			logging.Default().Warn("vault circuit opened", "failures", c.failures, "cool_down", c.coolDown, "error", err)
+		}
+		c.openedAt = time.Now()
+		c.setState(CircuitOpen)
+	}
+}
+
+func (c *circuitBreaker) setState(state string) {
+	c.state = state
+	metrics.SetVaultCircuitState(state)
+}
+
+// vaultDown returns true if the error of a Vault call means that Vault
+// is unavailable, as opposed to Vault rejecting the call. The timeouts
+// of the whole operation are not the fault of the call.
+func vaultDown(err error) bool {
+	if err == nil || errors.Is(err, ErrVaultCircuitOpen) {
+		return false
+	}
+	var timeout *TimeoutError
+	if errors.As(err, &timeout) {
+		return timeout.Operation == ""
+	}
+	var respErr *api.ResponseError
+	if errors.As(err, &respErr) {
+		return respErr.StatusCode >= 500
+	}
+	return errors.Is(err, ErrVaultUnavailable)
+}
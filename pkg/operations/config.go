@@ -0,0 +1,245 @@
+package operations
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/hashicorp/vault/api"
+)
+
+// GenerateConfigRequest is the structure containing the required
+// data to generate a VPN config from the Client VPN endpoint's one
+type GenerateConfigRequest struct {
+	ClientVPNEndpointID string
+	Certificate         string
+	PrivateKey          string
+	CAChain             []string
+	// Cache, if set, is used to get the config of the endpoint
+	Cache *ClientConfigCache
+	// AWSConfig, if set, is applied to the EC2 client exporting
+	// the config, see UpdateCRLOptions.AWSConfig
+	AWSConfig *aws.Config
+}
+
+// inlineBlocks are the inline files of the exported config
+// that are replaced with the issued certificate
+var inlineBlocks = []string{"ca", "cert", "key"}
+
+// requiredDirectives are added to the exported config if missing
+var requiredDirectives = []string{"remote-cert-tls server", "remote-random-hostname"}
+
+// GenerateConfig downloads the config of the Client VPN endpoint and inlines
+// the certificate, private key and CA chain in it, returning a ready to
+// import OpenVPN config. Any other directive of the exported config, like
+// the ones required for federated authentication, is preserved verbatim.
+func GenerateConfig(r *GenerateConfigRequest) (string, error) {
+
+	base, err := r.Cache.get(r.ClientVPNEndpointID, r.AWSConfig)
+	if err != nil {
+		return "", err
+	}
+
+	return inlineConfig(base, r.Certificate, r.PrivateKey, r.CAChain), nil
+}
+
+// DefaultClientConfigCacheTTL is the default time during which
+// the config exported from an endpoint is reused
+const DefaultClientConfigCacheTTL = 5 * time.Minute
+
+// ClientConfigCache keeps, in memory, the config exported from each Client
+// VPN endpoint, the base of the configs generated by GenerateConfig, so
+// issuing many certificates doesn't export the same config each time. The
+// zero value is ready to use. A nil cache exports the config on each Get.
+type ClientConfigCache struct {
+	// TTL is how long a config is kept. Defaults to DefaultClientConfigCacheTTL.
+	TTL time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*clientConfigEntry
+}
+
+type clientConfigEntry struct {
+	// done is closed once the config is exported
+	done    chan struct{}
+	config  string
+	err     error
+	expires time.Time
+}
+
+// Get returns the config exported from the endpoint, exporting it if not
+// cached or expired. Concurrent calls for the same endpoint wait for the
+// first one to export it. Failed exports are not cached.
+func (c *ClientConfigCache) Get(endpointID string) (string, error) {
+	return c.get(endpointID, nil)
+}
+
+// get is Get exporting the config with the EC2 client built with cfg
+func (c *ClientConfigCache) get(endpointID string, cfg *aws.Config) (string, error) {
+	if c == nil {
+		return exportClientConfig(endpointID, cfg)
+	}
+	ttl := c.TTL
+	if ttl == 0 {
+		ttl = DefaultClientConfigCacheTTL
+	}
+
+	c.mu.Lock()
+	if c.entries == nil {
+		c.entries = map[string]*clientConfigEntry{}
+	}
+	if e, ok := c.entries[endpointID]; ok && (e.expires.IsZero() || time.Now().Before(e.expires)) {
+		c.mu.Unlock()
+		<-e.done
+		if e.err != nil {
+			return "", e.err
+		}
+		return e.config, nil
+	}
+	e := &clientConfigEntry{done: make(chan struct{})}
+	c.entries[endpointID] = e
+	c.mu.Unlock()
+
+	config, err := exportClientConfig(endpointID, cfg)
+
+	c.mu.Lock()
+	if err != nil {
+		e.err = err
+		if c.entries[endpointID] == e {
+			delete(c.entries, endpointID)
+		}
+	} else {
+		e.config = config
+		e.expires = time.Now().Add(ttl)
+	}
+	c.mu.Unlock()
+	close(e.done)
+
+	return config, err
+}
+
+// Invalidate drops the cached config of the endpoint, so the next Get
+// exports it again, as when the config of the endpoint changes. An
+// empty endpointID drops the configs of all the endpoints.
+func (c *ClientConfigCache) Invalidate(endpointID string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if endpointID == "" {
+		c.entries = nil
+		return
+	}
+	delete(c.entries, endpointID)
+}
+
+// exportClientConfig returns the config exported from the endpoint
+func exportClientConfig(endpointID string, cfg *aws.Config) (string, error) {
+	svc := ec2Client(cfg)
+	rsp, err := svc.ExportClientVpnClientConfiguration(
+		&ec2.ExportClientVpnClientConfigurationInput{
+			ClientVpnEndpointId: aws.String(endpointID),
+		})
+	if err != nil {
+		return "", awsError(err)
+	}
+	return aws.StringValue(rsp.ClientConfiguration), nil
+}
+
+// inlineConfig removes any <ca>, <cert> and <key> blocks from the
+// config and appends them with the given values
+func inlineConfig(base, certificate, key string, caChain []string) string {
+	var lines []string
+	present := map[string]bool{}
+	skip := ""
+
+	scanner := bufio.NewScanner(strings.NewReader(base))
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		trimmed := strings.TrimSpace(line)
+		if skip != "" {
+			if trimmed == "</"+skip+">" {
+				skip = ""
+			}
+			continue
+		}
+		for _, b := range inlineBlocks {
+			if trimmed == "<"+b+">" {
+				skip = b
+			}
+		}
+		if skip != "" {
+			continue
+		}
+		present[strings.Join(strings.Fields(trimmed), " ")] = true
+		lines = append(lines, line)
+	}
+
+	var config strings.Builder
+	for _, line := range lines {
+		config.WriteString(line + "\n")
+	}
+	for _, d := range requiredDirectives {
+		if !present[d] {
+			config.WriteString(d + "\n")
+		}
+	}
+	fmt.Fprintf(&config, "\n<ca>\n%s\n</ca>\n", strings.TrimSpace(strings.Join(caChain, "\n")))
+	fmt.Fprintf(&config, "\n<cert>\n%s\n</cert>\n", strings.TrimSpace(certificate))
+	fmt.Fprintf(&config, "\n<key>\n%s\n</key>\n", strings.TrimSpace(key))
+
+	return config.String()
+}
+
+// KeyNotRetainedNotice takes the place of the private key in the VPN
+// configs stored for the certificates issued with DiscardPrivateKey, so
+// the holder of the certificate knows to put the key, which was only
+// returned on issuance, back in it before importing it
+const KeyNotRetainedNotice = "The private key of this certificate was not retained on issuance, replace this line with it"
+
+// ConfigKeyRetained returns false for the VPN configs stored without
+// the private key of their certificate, see KeyNotRetainedNotice
+func ConfigKeyRetained(config string) bool {
+	return !strings.Contains(config, KeyNotRetainedNotice)
+}
+
+// GetUserConfigRequest is the structure containing the
+// required data to retrieve a user's stored VPN config
+type GetUserConfigRequest struct {
+	Client      *api.Client
+	VaultKVPath string
+	Username    string
+	// Envelope decrypts the config if it was stored
+	// encrypted, see UpdateCRLOptions.Envelope
+	Envelope *KMSEnvelope
+}
+
+// GetUserConfig returns the VPN config stored in the kv store for
+// the user. Returns ErrUserNotFound if the user has no config stored.
+// The config of a certificate whose private key was not retained has
+// the KeyNotRetainedNotice instead of the key, see ConfigKeyRetained.
+func GetUserConfig(r *GetUserConfigRequest) (string, error) {
+	secret, err := r.Client.Logical().Read(fmt.Sprintf("%s/data/users/%s/config.ovpn", r.VaultKVPath, r.Username))
+	if err != nil {
+		return "", vaultError(err)
+	}
+	if secret == nil || secret.Data["data"] == nil {
+		return "", &Error{Kind: ErrUserNotFound, Err: fmt.Errorf("no config stored for user '%s'", r.Username)}
+	}
+	data, ok := secret.Data["data"].(map[string]interface{})
+	if !ok {
+		return "", fmt.Errorf("unexpected format of the config stored for user '%s'", r.Username)
+	}
+	content, _ := data["content"].(string)
+	content, err = r.Envelope.open(context.Background(), content)
+	if err != nil {
+		return "", fmt.Errorf("unable to read the config stored for user '%s': %w", r.Username, err)
+	}
+	return content, nil
+}
@@ -0,0 +1,163 @@
+package operations
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+const (
+	// DefaultConfigURLExpiry is how long the pre-signed URLs
+	// returned by PresignConfigURL are valid
+	DefaultConfigURLExpiry = 15 * time.Minute
+	// MaxConfigURLExpiry is the longest validity S3 allows
+	// for the URLs pre-signed with the credentials of a user
+	MaxConfigURLExpiry = 7 * 24 * time.Hour
+	// configContentType is the Content-Type of the stored configs,
+	// which the OpenVPN clients recognize when downloaded
+	configContentType = "application/x-openvpn-profile"
+)
+
+// ConfigStore keeps a copy of the VPN config generated for each issued
+// certificate in an S3 bucket, under <Prefix><username>/<serial>.ovpn, so
+// the users can be handed a short-lived link to download it instead of
+// the file, see PresignConfigURL. The config of a certificate is deleted
+// once it is revoked, see UpdateCRLOptions.ConfigStore. The configs are
+// uploaded as is, as the links have to return them ready to import, so
+// the issuances with a KMSEnvelope fail, as S3 would get the private keys
+// unencrypted, unless the private keys are discarded.
+type ConfigStore struct {
+	// Client defaults to an S3 client with the User-Agent
+	// and endpoint URL of the operations
+	Client s3iface.S3API
+	Bucket string
+	// Prefix is prepended to the keys of the objects, e.g. "vpn/"
+	Prefix string
+	// KMSKeyID, if set, encrypts the objects with SSE-KMS and this key.
+	// The default encryption of the bucket applies otherwise.
+	KMSKeyID string
+}
+
+func (s *ConfigStore) client() s3iface.S3API {
+	if s.Client != nil {
+		return s.Client
+	}
+	return s3.New(newAWSSession())
+}
+
+// userPrefix returns the prefix of the keys of the configs of the user
+func (s *ConfigStore) userPrefix(username string) string {
+	return fmt.Sprintf("%s%s/", s.Prefix, username)
+}
+
+func (s *ConfigStore) key(username, serial string) string {
+	return fmt.Sprintf("%s%s.ovpn", s.userPrefix(username), serial)
+}
+
+// put stores the config of the certificate of the user
+func (s *ConfigStore) put(ctx context.Context, username, serial, config string) error {
+	input := &s3.PutObjectInput{
+		Bucket:      aws.String(s.Bucket),
+		Key:         aws.String(s.key(username, serial)),
+		Body:        strings.NewReader(config),
+		ContentType: aws.String(configContentType),
+	}
+	if s.KMSKeyID != "" {
+		input.ServerSideEncryption = aws.String(s3.ServerSideEncryptionAwsKms)
+		input.SSEKMSKeyId = aws.String(s.KMSKeyID)
+	}
+	_, err := s.client().PutObjectWithContext(ctx, input)
+	return err
+}
+
+// delete removes the config of the certificate of the user, if stored
+func (s *ConfigStore) delete(ctx context.Context, username, serial string) error {
+	_, err := s.client().DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(s.key(username, serial)),
+	})
+	return err
+}
+
+// latest returns the key of the config of the user stored last,
+// or an empty key if none is stored
+func (s *ConfigStore) latest(ctx context.Context, username string) (string, error) {
+	var key string
+	var modified time.Time
+	err := s.client().ListObjectsV2PagesWithContext(ctx,
+		&s3.ListObjectsV2Input{Bucket: aws.String(s.Bucket), Prefix: aws.String(s.userPrefix(username))},
+		func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+			for _, obj := range page.Contents {
+				if t := aws.TimeValue(obj.LastModified); key == "" || t.After(modified) {
+					key, modified = aws.StringValue(obj.Key), t
+				}
+			}
+			return true
+		})
+	return key, err
+}
+
+// PresignConfigURLRequest is the structure containing the required
+// data to get a download link of the VPN config of a user
+type PresignConfigURLRequest struct {
+	Store    *ConfigStore
+	Username string
+	// Expiry is how long the URL is valid. Defaults to
+	// DefaultConfigURLExpiry, up to MaxConfigURLExpiry.
+	Expiry time.Duration
+	// Context, if set, stops the S3 calls once done
+	Context context.Context
+}
+
+// PresignedConfigURL is a link to download the VPN config of a user
+type PresignedConfigURL struct {
+	URL string
+	// SerialNumber is the one of the certificate of the config
+	SerialNumber string
+	ExpiresAt    time.Time
+}
+
+// PresignConfigURL returns a pre-signed URL to download, without any
+// credentials, the VPN config stored last for the user, see ConfigStore.
+// ErrUserNotFound is returned if there is none, e.g. because all the
+// certificates of the user have been revoked since.
+func PresignConfigURL(r *PresignConfigURLRequest) (*PresignedConfigURL, error) {
+	ctx := r.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	expiry := r.Expiry
+	if expiry <= 0 {
+		expiry = DefaultConfigURLExpiry
+	}
+	if expiry > MaxConfigURLExpiry {
+		return nil, fmt.Errorf("expiry of the config URL can't be over %s", MaxConfigURLExpiry)
+	}
+	username, err := NormalizeUsername(r.Username)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := r.Store.latest(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	if key == "" {
+		return nil, &Error{Kind: ErrUserNotFound, Err: fmt.Errorf("no config stored for user '%s'", username)}
+	}
+	req, _ := r.Store.client().GetObjectRequest(&s3.GetObjectInput{Bucket: aws.String(r.Store.Bucket), Key: aws.String(key)})
+	url, err := req.Presign(expiry)
+	if err != nil {
+		return nil, err
+	}
+	return &PresignedConfigURL{
+		URL:          url,
+		SerialNumber: strings.TrimSuffix(strings.TrimPrefix(key, r.Store.userPrefix(username)), ".ovpn"),
+		ExpiresAt:    time.Now().Add(expiry),
+	}, nil
+}
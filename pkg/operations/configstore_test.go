@@ -0,0 +1,221 @@
+package operations
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/hashicorp/vault/api"
+)
+
+// fakeS3 keeps the objects in memory, listing them one per page
+type fakeS3 struct {
+	s3iface.S3API
+	sync.Mutex
+	puts    []*s3.PutObjectInput
+	bodies  map[string]string
+	objects map[string]time.Time
+	deleted []string
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{bodies: map[string]string{}, objects: map[string]time.Time{}}
+}
+
+func (f *fakeS3) PutObjectWithContext(ctx aws.Context, in *s3.PutObjectInput, opts ...request.Option) (*s3.PutObjectOutput, error) {
+	f.Lock()
+	defer f.Unlock()
+	b, _ := ioutil.ReadAll(in.Body)
+	key := aws.StringValue(in.Bucket) + "/" + aws.StringValue(in.Key)
+	f.puts = append(f.puts, in)
+	f.bodies[key] = string(b)
+	f.objects[key] = time.Now()
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (f *fakeS3) DeleteObjectWithContext(ctx aws.Context, in *s3.DeleteObjectInput, opts ...request.Option) (*s3.DeleteObjectOutput, error) {
+	f.Lock()
+	defer f.Unlock()
+	key := aws.StringValue(in.Bucket) + "/" + aws.StringValue(in.Key)
+	f.deleted = append(f.deleted, key)
+	delete(f.objects, key)
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+func (f *fakeS3) ListObjectsV2PagesWithContext(ctx aws.Context, in *s3.ListObjectsV2Input, fn func(*s3.ListObjectsV2Output, bool) bool, opts ...request.Option) error {
+	f.Lock()
+	prefix := aws.StringValue(in.Bucket) + "/" + aws.StringValue(in.Prefix)
+	var keys []string
+	for key := range f.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	var pages []*s3.ListObjectsV2Output
+	for _, key := range keys {
+		pages = append(pages, &s3.ListObjectsV2Output{Contents: []*s3.Object{{
+			Key:          aws.String(strings.TrimPrefix(key, aws.StringValue(in.Bucket)+"/")),
+			LastModified: aws.Time(f.objects[key]),
+		}}})
+	}
+	f.Unlock()
+	if len(pages) == 0 {
+		pages = append(pages, &s3.ListObjectsV2Output{})
+	}
+	for i, page := range pages {
+		if !fn(page, i == len(pages)-1) {
+			break
+		}
+	}
+	return nil
+}
+
+// GetObjectRequest builds the request with a real client, as
+// the URLs are pre-signed without calling S3
+func (f *fakeS3) GetObjectRequest(in *s3.GetObjectInput) (*request.Request, *s3.GetObjectOutput) {
+	sess := session.Must(session.NewSession(aws.NewConfig().
+		WithRegion("us-east-1").
+		WithCredentials(credentials.NewStaticCredentials("AKIDEXAMPLE", "secret", ""))))
+	return s3.New(sess).GetObjectRequest(in)
+}
+
+func TestConfigStorePut(t *testing.T) {
+	tests := []struct {
+		name  string
+		store ConfigStore
+		key   string
+		kms   bool
+	}{
+		{"bucket encryption", ConfigStore{Bucket: "configs"}, "alice/01-02.ovpn", false},
+		{"prefix and KMS", ConfigStore{Bucket: "configs", Prefix: "vpn/", KMSKeyID: "alias/vpn"}, "vpn/alice/01-02.ovpn", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s3 := newFakeS3()
+			tt.store.Client = s3
+			if err := tt.store.put(context.Background(), "alice", "01-02", "client\n"); err != nil {
+				t.Fatal(err)
+			}
+			if len(s3.puts) != 1 {
+				t.Fatalf("got %d uploads, want 1", len(s3.puts))
+			}
+			in := s3.puts[0]
+			if aws.StringValue(in.Bucket) != "configs" || aws.StringValue(in.Key) != tt.key {
+				t.Errorf("got object %s/%s, want configs/%s", aws.StringValue(in.Bucket), aws.StringValue(in.Key), tt.key)
+			}
+			if got := aws.StringValue(in.ContentType); got != "application/x-openvpn-profile" {
+				t.Errorf("got ContentType %q", got)
+			}
+			if got := s3.bodies["configs/"+tt.key]; got != "client\n" {
+				t.Errorf("got body %q", got)
+			}
+			sse, keyID := aws.StringValue(in.ServerSideEncryption), aws.StringValue(in.SSEKMSKeyId)
+			if tt.kms && (sse != "aws:kms" || keyID != "alias/vpn") || !tt.kms && (in.ServerSideEncryption != nil || in.SSEKMSKeyId != nil) {
+				t.Errorf("got ServerSideEncryption %q and SSEKMSKeyId %q", sse, keyID)
+			}
+		})
+	}
+}
+
+func TestConfigStoreLatest(t *testing.T) {
+	s3 := newFakeS3()
+	store := &ConfigStore{Client: s3, Bucket: "configs", Prefix: "vpn/"}
+	ctx := context.Background()
+
+	if key, err := store.latest(ctx, "alice"); err != nil || key != "" {
+		t.Errorf("got %q, %v without configs, want no key", key, err)
+	}
+	// The newest is not the last one listed, each listed in its own page
+	for _, serial := range []string{"03", "01", "02"} {
+		if err := store.put(ctx, "alice", serial, serial); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	store.put(ctx, "alice2", "99", "99")
+	store.put(ctx, "bob", "04", "04")
+	s3.objects["configs/vpn/alice/00.ovpn"] = time.Now().Add(-time.Hour)
+
+	if key, err := store.latest(ctx, "alice"); err != nil || key != "vpn/alice/02.ovpn" {
+		t.Errorf("got %q, %v, want vpn/alice/02.ovpn", key, err)
+	}
+
+	u, err := PresignConfigURL(&PresignConfigURLRequest{Store: store, Username: "alice", Expiry: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := url.Parse(u.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Path != "/vpn/alice/02.ovpn" || parsed.Query().Get("X-Amz-Expires") != "3600" || u.SerialNumber != "02" {
+		t.Errorf("got URL %s for serial %s", u.URL, u.SerialNumber)
+	}
+	if _, err := PresignConfigURL(&PresignConfigURLRequest{Store: store, Username: "carol"}); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("got %v for a user without configs, want ErrUserNotFound", err)
+	}
+	if _, err := PresignConfigURL(&PresignConfigURLRequest{Store: store, Username: "alice", Expiry: 8 * 24 * time.Hour}); err == nil {
+		t.Error("expiry over the maximum accepted")
+	}
+}
+
+func TestRevokeDeletesStoredConfigs(t *testing.T) {
+	var revoked []string
+	var mu sync.Mutex
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		revoked = append(revoked, r.URL.Path+" "+string(b))
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"data":{"revocation_time":1}}`))
+	}))
+	defer srv.Close()
+	cfg := api.DefaultConfig()
+	cfg.Address = srv.URL
+	client, err := api.NewClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s3 := newFakeS3()
+	store := &ConfigStore{Client: s3, Bucket: "configs", Prefix: "vpn/"}
+	ctx := context.Background()
+	crts := []Certificate{
+		{SerialNumber: "01", SubjectCN: "alice", NotBefore: time.Now().Add(-3 * time.Hour)},
+		{SerialNumber: "02", SubjectCN: "alice", NotBefore: time.Now().Add(-2 * time.Hour), Revoked: true},
+		{SerialNumber: "03", SubjectCN: "alice", NotBefore: time.Now().Add(-time.Hour)},
+	}
+	for _, crt := range crts {
+		store.put(ctx, "alice", crt.SerialNumber, "config")
+	}
+
+	got, err := revokeUserCertificates(client, "pki", crts, revocationOptions{ctx: ctx, configStore: store})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0] != "01" || len(revoked) != 1 || revoked[0] != `/v1/pki/revoke {"serial_number":"01"}` {
+		t.Errorf("got revoked %v with requests %v, want 01", got, revoked)
+	}
+	if len(s3.deleted) != 1 || s3.deleted[0] != "configs/vpn/alice/01.ovpn" {
+		t.Errorf("got deleted %v, want the config of 01", s3.deleted)
+	}
+	if key, _ := store.latest(ctx, "alice"); key != "vpn/alice/03.ovpn" {
+		t.Errorf("got latest %q, want the config of the certificate kept", key)
+	}
+}
@@ -0,0 +1,59 @@
+package operations
+
+import (
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// ClientConnection is a connection of a client to the Client VPN endpoint
+type ClientConnection struct {
+	ConnectionID string `json:"connection-id"`
+	// Status is the state of the connection reported by AWS:
+	// active, failed-to-terminate, terminating or terminated
+	Status        string    `json:"status"`
+	CommonName    string    `json:"common-name"`
+	ClientIP      string    `json:"client-ip,omitempty"`
+	EstablishedAt time.Time `json:"established-at,omitempty"`
+	IngressBytes  string    `json:"ingress-bytes,omitempty"`
+	EgressBytes   string    `json:"egress-bytes,omitempty"`
+}
+
+// listUserConnections returns the active connections to the endpoint
+// made with the certificates of the user
+func listUserConnections(endpointID, username string, cfg *aws.Config) ([]ClientConnection, error) {
+	svc := ec2Client(cfg)
+
+	conns := []ClientConnection{}
+	err := svc.DescribeClientVpnConnectionsPages(
+		&ec2.DescribeClientVpnConnectionsInput{ClientVpnEndpointId: aws.String(endpointID)},
+		func(page *ec2.DescribeClientVpnConnectionsOutput, last bool) bool {
+			for _, c := range page.Connections {
+				if usernameFromCN(aws.StringValue(c.CommonName)) != username {
+					continue
+				}
+				if c.Status == nil || aws.StringValue(c.Status.Code) != ec2.ClientVpnConnectionStatusCodeActive {
+					continue
+				}
+				conn := ClientConnection{
+					ConnectionID: aws.StringValue(c.ConnectionId),
+					Status:       aws.StringValue(c.Status.Code),
+					CommonName:   aws.StringValue(c.CommonName),
+					ClientIP:     aws.StringValue(c.ClientIp),
+					IngressBytes: aws.StringValue(c.IngressBytes),
+					EgressBytes:  aws.StringValue(c.EgressBytes),
+				}
+				// AWS reports it as "2006-01-02 15:04:05" in UTC
+				if t, err := time.Parse("2006-01-02 15:04:05", aws.StringValue(c.ConnectionEstablishedTime)); err == nil {
+					conn.EstablishedAt = t
+				}
+				conns = append(conns, conn)
+			}
+			return true
+		})
+	if err != nil {
+		return nil, awsError(err)
+	}
+	return conns, nil
+}
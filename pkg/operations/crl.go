@@ -1,119 +1,687 @@
 package operations
 
 import (
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
 	"reflect"
+	"sort"
+	"strings"
+	"time"
 
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/audit"
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/logging"
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/tracing"
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
 	"github.com/hashicorp/vault/api"
 )
 
+// CRLFormat is the encoding of the CRL returned by GetCRL
+type CRLFormat string
+
+const (
+	// CRLFormatPEM is the PEM encoded CRL. This is the default.
+	CRLFormatPEM CRLFormat = "pem"
+	// CRLFormatDER is the DER encoded CRL
+	CRLFormatDER CRLFormat = "der"
+)
+
+// DefaultCRLPath is the path, under the PKI path,
+// of the PEM encoded CRL of the default issuer
+const DefaultCRLPath = "crl/pem"
+
 // GetCRLRequest is the structure containing
 // the required data to issue a new certificate
 type GetCRLRequest struct {
 	Client       *api.Client
 	VaultPKIPath string
+	// Format of the returned CRL. Defaults to CRLFormatPEM.
+	Format CRLFormat
+	// CRLPath is the path of the CRL under VaultPKIPath, for example
+	// "unified-crl/pem" or "issuer/<issuer>/crl/pem". Defaults to
+	// DefaultCRLPath, or "crl" for CRLFormatDER. It must point to a
+	// CRL in the requested Format. Takes precedence over IssuerRef.
+	CRLPath string
+	// IssuerRef, if set, is the name or ID of the issuer of the mount
+	// whose CRL is returned. Defaults to the default issuer of the mount.
+	IssuerRef string
+	// ClientVPNEndpointID, if set, is the endpoint the CRL is read for.
+	// The size and entries of the PEM encoded CRL are then recorded in
+	// the metrics, by PKI path and endpoint, see Metrics.SetCRLStats.
+	ClientVPNEndpointID string
 }
 
-// GetCRL return the Client Revocation List PEM as a []byte
+// GetCRL return the Client Revocation List as a []byte, PEM encoded
+// unless other Format is requested. Returns ErrVaultUnavailable if the
+// CRL can't be read from Vault.
 func GetCRL(r *GetCRLRequest) ([]byte, error) {
-	req := r.Client.NewRequest("GET", fmt.Sprintf("/v1/%s/crl/pem", r.VaultPKIPath))
-	rsp, err := r.Client.RawRequest(req)
+	span := tracing.Start("get_crl", "pki_path", r.VaultPKIPath, "format", r.Format)
+	defer span.End()
+	rc, err := GetCRLStream(r)
 	if err != nil {
+		span.RecordError(err)
 		return nil, err
 	}
-	defer rsp.Body.Close()
-	data, err := ioutil.ReadAll(rsp.Body)
+	defer rc.Close()
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		span.RecordError(err)
+		return nil, vaultError(err)
+	}
+	span.SetAttributes("size", len(data))
+	if r.ClientVPNEndpointID != "" && (r.Format == "" || r.Format == CRLFormatPEM) {
+		recordCRLStats(r.VaultPKIPath, r.ClientVPNEndpointID, data)
+	}
 	return data, nil
 }
 
+// recordCRLStats records the size, entries and NextUpdate of the CRL.
+// A CRL that can't be parsed is left to the callers to report.
+func recordCRLStats(pki, endpointID string, crl []byte) {
+	parsed, err := parseCRL(crl)
+	if err != nil {
+		return
+	}
+	metrics.SetCRLStats(pki, endpointID, len(crl), len(parsed.TBSCertList.RevokedCertificates), parsed.TBSCertList.NextUpdate)
+}
+
+// GetCRLStream behaves as GetCRL but returns the body of the Vault
+// response instead of reading it into memory, so large CRLs can be
+// written to a file or forwarded to a client as they are received.
+// The status of the response is checked before returning. The caller
+// must close the returned ReadCloser.
+func GetCRLStream(r *GetCRLRequest) (io.ReadCloser, error) {
+	crlPath := DefaultCRLPath
+	switch r.Format {
+	case "", CRLFormatPEM:
+	case CRLFormatDER:
+		crlPath = "crl"
+	default:
+		return nil, fmt.Errorf("unknown CRL format '%s'", r.Format)
+	}
+	if r.CRLPath != "" {
+		crlPath = strings.Trim(r.CRLPath, "/")
+	} else if r.IssuerRef != "" {
+		format := CRLFormatPEM
+		if r.Format == CRLFormatDER {
+			format = CRLFormatDER
+		}
+		crlPath = fmt.Sprintf("issuer/%s/crl/%s", r.IssuerRef, format)
+	}
+	path := fmt.Sprintf("/v1/%s/%s", r.VaultPKIPath, crlPath)
+	req := r.Client.NewRequest("GET", path)
+	rsp, err := r.Client.RawRequest(req)
+	if err != nil {
+		if rsp != nil {
+			defer rsp.Body.Close()
+		}
+		return nil, vaultRawError(rsp, err)
+	}
+	// RawRequest already fails on the error status codes,
+	// make sure the body is not something else than the CRL
+	if rsp.StatusCode < 200 || rsp.StatusCode > 299 {
+		rsp.Body.Close()
+		return nil, vaultRawError(rsp, fmt.Errorf("unexpected status code %d reading the CRL", rsp.StatusCode))
+	}
+	return rsp.Body, nil
+}
+
 // UpdateCRLRequest is the structure containing
 // the required data to issue a new certificate
 type UpdateCRLRequest struct {
 	Client              *api.Client
 	VaultPKIPath        string
 	ClientVPNEndpointID string
+	UpdateCRLOptions
+}
+
+// UpdateCRLOptions holds the settings that control how the CRL
+// is imported in the AWS Client VPN endpoint. It is embedded in
+// the requests of all the operations that end up calling UpdateCRL.
+type UpdateCRLOptions struct {
+	// CRLSizeWarnThreshold is the CRL size, in bytes, above
+	// which a warning is logged. Disabled if 0.
+	CRLSizeWarnThreshold int
+	// CRLSizeWarnPercent is the percentage of CRLMaxSize above which
+	// a warning is logged, to act before AWS rejects the CRL, e.g. by
+	// pruning it. Disabled if 0.
+	CRLSizeWarnPercent float64
+	// CRLMaxSize is the maximum CRL size, in bytes, that will be
+	// imported in the AWS Client VPN endpoint. Defaults to DefaultCRLMaxSize.
+	CRLMaxSize int
+	// VerifyEndpointCA checks that the server certificate of the
+	// endpoint has been issued by the Vault PKI before updating the CRL
+	VerifyEndpointCA bool
+	// VerifyCRLSignature checks the signature of the CRL against the CA
+	// of the PKI, or of the IssuerRef if set, before importing it in the
+	// endpoint, aborting the import with ErrCRLSignatureInvalid if it
+	// doesn't match
+	VerifyCRLSignature bool
+	// RevocationGracePeriod delays the revocation of the certificates
+	// superseded by a newer one until the newer one is older than this
+	RevocationGracePeriod time.Duration
+	// BackupWriter, if set, receives a timestamped copy of the CRL
+	// active in the endpoint before it is overwritten by a new one
+	BackupWriter io.Writer
+	// FailOnBackupError aborts the import of the new CRL if
+	// the backup of the previous one fails
+	FailOnBackupError bool
+	// LockFailFast makes UpdateCRL return ErrLocked right away, instead of
+	// waiting, if an update of the same endpoint is already running
+	LockFailFast bool
+	// AdoptedKVPath, if set, is where the certificates adopted with
+	// Adopt are looked up, so they are revoked unless they are the latest
+	// of the users they were adopted by
+	AdoptedKVPath string
+	// RevocationKVPath, if set, is the kv store where the superseded
+	// certificates revoked are recorded with ReasonSuperseded
+	RevocationKVPath string
+	// SuspensionKVPath, if set, is the kv store of the users' metadata,
+	// checked for suspended users: they are not issued certificates and
+	// UpdateCRL revokes all of their certificates, instead of keeping
+	// the latest one active
+	SuspensionKVPath string
+	// VaultLockKVPath, if set, extends the lock on the endpoint's CRL to
+	// all the instances sharing this Vault kv store
+	VaultLockKVPath string
+	// SNSTopicARN, if set, is the SNS topic a CRLUpdateMessage is
+	// published to after each successful update of the CRL
+	SNSTopicARN string
+	// FailOnSNSError makes UpdateCRL return the error, along with the
+	// result, if the message can't be published. It is only logged
+	// otherwise. The CRL has already been imported in either case.
+	FailOnSNSError bool
+	// CRLPath is the path, under the PKI path, of the PEM encoded CRL
+	// imported in the endpoint. Defaults to DefaultCRLPath, or to the
+	// CRL of the IssuerRef if set.
+	CRLPath string
+	// IssuerRef, if set, is the issuer of the PKI mount trusted by the
+	// endpoint. Certificates are issued by it, and only the ones it
+	// issued are listed and revoked, so they end up in its CRL.
+	IssuerRef string
+	// MaxCRLShrink, if set, is the maximum fraction, between 0 and 1, of
+	// the entries of the CRL active in the endpoint that can be dropped
+	// by the new one. A larger drop, which could un-revoke certificates
+	// due to a bug or a wrong PKI path, aborts the import with a
+	// *CRLShrinkError unless ForceShrink is set.
+	MaxCRLShrink float64
+	ForceShrink  bool
+	// ForceImport imports the CRL in the endpoint even if it is the same
+	// as the active one, which clears the occasional bad state of the
+	// copy cached by AWS. Unchanged CRLs are skipped otherwise.
+	ForceImport bool
+	// ContinueOnRevocationError makes UpdateCRL go on with the rest of the
+	// users when the certificates of one can't be revoked, instead of
+	// aborting, so a single problematic user doesn't block the revocation
+	// of the others. The CRL is still updated and a
+	// *RevocationFailuresError is returned along with the result.
+	ContinueOnRevocationError bool
+	// CRLHistoryKVPath, if set, is the kv (v2) mount where a copy of each
+	// CRL imported in the endpoint is kept, along with when and by whom,
+	// see ListCRLHistory. Only the last CRLHistoryVersions are kept,
+	// DefaultCRLHistoryVersions by default.
+	CRLHistoryKVPath   string
+	CRLHistoryVersions int
+	// Actor is who triggered the operation, as recorded in the CRL history
+	Actor string
+	// CheckCapabilities makes the operations that revoke certificates or
+	// rotate the CRL check first that the Vault token is allowed to, so
+	// they fail with a *CapabilitiesError before doing any work
+	CheckCapabilities bool
+	// Audit, if set, records each certificate revoked in Vault, or that
+	// failed to be, before going on with the operation
+	Audit *audit.Logger
+	// Retry is the policy of the retries of the Vault and AWS calls that
+	// fail with a transient error. The default policy is used if nil.
+	Retry *RetryPolicy
+	// Context, if set, stops the operation and its retries once done.
+	// The Vault calls in flight are left to complete in the background.
+	Context context.Context
+	// VaultTimeout and AWSTimeout bound each Vault and AWS call, and
+	// OperationTimeout the whole operation, see TimeoutError. They
+	// default to DefaultVaultTimeout, DefaultAWSTimeout and
+	// DefaultOperationTimeout.
+	VaultTimeout     time.Duration
+	AWSTimeout       time.Duration
+	OperationTimeout time.Duration
+	// UsersCache, if set, is invalidated by the operations that issue
+	// or revoke certificates, and by each UpdateCRL
+	UsersCache *UsersCache
+	// CertificateIndex, if set, is used to list the users, so only the
+	// certificates issued since the previous listing are read from Vault
+	CertificateIndex *CertificateIndex
+	// ConfigStore, if set, stores the VPN config of each certificate
+	// issued, which is deleted once the certificate is revoked
+	ConfigStore *ConfigStore
+	// Envelope, if set, encrypts the private keys, and the VPN configs
+	// embedding them, before storing them in the kv store
+	Envelope *KMSEnvelope
+	// AWSConfig, if set, is applied to the EC2 client of the operation,
+	// e.g. with the Region of the endpoint and MaxRetries, so a process
+	// can manage endpoints in several regions. Its settings take precedence
+	// over the environment, e.g. AWS_REGION, and the shared config files,
+	// which still apply to the ones it leaves unset. It doesn't apply to the
+	// client set with SetEC2Client.
+	AWSConfig *aws.Config
+	// Logger receives the log entries of the operation. Defaults to logging.Default().
+	Logger logging.Logger
+}
+
+// UpdateCRLResult holds the outcome of an UpdateCRL operation
+type UpdateCRLResult struct {
+	CRL     []byte
+	Size    int
+	MaxSize int
+	// TotalUsers is the number of users whose certificates were checked
+	TotalUsers int
+	// RevokedCount is the number of certificates revoked
+	RevokedCount int
+	// SkippedCount is the number of superseded certificates left active,
+	// for now, as the RevocationGracePeriod of their user hasn't elapsed
+	// or revoking them failed
+	SkippedCount int
+	// AffectedUsers are the users that got certificates revoked
+	AffectedUsers []string
+	// RevokedSerials are the serial numbers of the revoked
+	// certificates, keyed by username
+	RevokedSerials map[string][]string
+	// AWSUpdated is true if the CRL was imported in the AWS Client VPN endpoint
+	AWSUpdated bool
+	// Diff holds the entries that changed from the CRL previously
+	// active in the endpoint. Only set when AWSUpdated.
+	Diff *CRLDiff
 }
 
 // UpdateCRL maintains the CRL to keep just one active certificte per
 // VPN user. This will always be the one emitted at a later date. Users
 // can also have all their certificates revoked.
-func UpdateCRL(r *UpdateCRLRequest) ([]byte, error) {
+// A *CRLTooLargeError, matching ErrCRLTooLarge, is returned along with
+// the result if the CRL exceeds the maximum size allowed. Errors talking
+// to Vault match ErrVaultUnavailable and a missing Client VPN endpoint
+// is reported as ErrEndpointNotFound, and one without mutual certificate
+// authentication as ErrNotCertificateAuth. Only one UpdateCRL runs at a time
+// for a given endpoint, see ErrLocked. With ContinueOnRevocationError,
+// the failures revoking the certificates of some users are reported
+// as a *RevocationFailuresError, matching ErrPartialRevocation.
+func UpdateCRL(r *UpdateCRLRequest) (*UpdateCRLResult, error) {
+	start := time.Now()
+	res, err := updateCRL(r)
+	observe("update_crl", start, err)
+	return res, err
+}
+
+func updateCRL(r *UpdateCRLRequest) (*UpdateCRLResult, error) {
+	logger := logging.OrDefault(r.Logger).With("endpoint_id", r.ClientVPNEndpointID, "pki_path", r.VaultPKIPath)
+	start := time.Now()
+	ctx, cancel := startOperation(r.UpdateCRLOptions, "update_crl")
+	defer cancel()
+	updateOpts := r.UpdateCRLOptions
+	updateOpts.Context = ctx
+	defer r.UsersCache.Invalidate()
+
+	if err := checkCapabilities(r.Client, r.UpdateCRLOptions, revokeCapabilities(r.VaultPKIPath)...); err != nil {
+		return nil, err
+	}
+	// Fail before any work in Vault if the endpoint can't take the CRL
+	var ep *ec2.ClientVpnEndpoint
+	err := retry(ctx, r.Retry, logger, "describe_endpoint", awsCall, func(ctx context.Context) (err error) {
+		ep, err = describeEndpoint(ctx, r.ClientVPNEndpointID, r.AWSConfig)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := checkCertificateAuth(ep); err != nil {
+		return nil, err
+	}
+	unlock, err := lockEndpoint(r.Client, r.ClientVPNEndpointID, r.UpdateCRLOptions)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	if ctx.Err() != nil {
+		return nil, contextError(ctx, "lock")
+	}
+
+	if r.VerifyEndpointCA {
+		err := VerifyEndpointCA(
+			&VerifyEndpointCARequest{
+				Client:              r.Client,
+				VaultPKIPaths:       []string{r.VaultPKIPath},
+				ClientVPNEndpointID: r.ClientVPNEndpointID,
+				AWSConfig:           r.AWSConfig,
+			})
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	// Get the list of users
 	users, err := ListUsers(
 		&ListUsersRequest{
+			Context:             ctx,
 			Client:              r.Client,
 			VaultPKIPath:        r.VaultPKIPath,
 			ClientVPNEndpointID: r.ClientVPNEndpointID,
+			IssuerRef:           r.IssuerRef,
+			AdoptedKVPath:       r.AdoptedKVPath,
+			Index:               r.CertificateIndex,
+			Retry:               r.Retry,
+			Logger:              logger,
 		})
 	if err != nil {
 		return nil, err
 	}
 
+	result := &UpdateCRLResult{TotalUsers: len(users), RevokedSerials: map[string][]string{}}
+
 	//For each user, get the list of certificates, and revoke all of them but the latest
-	for _, crts := range users {
-		err := revokeUserCertificates(r.Client, r.VaultPKIPath, crts, false)
+	span := tracing.Start("revoke_superseded", "endpoint_id", r.ClientVPNEndpointID, "pki_path", r.VaultPKIPath, "users", len(users))
+	failures := map[string]error{}
+	for username, crts := range users {
+		if ctx.Err() != nil {
+			span.RecordError(ctx.Err())
+			span.End()
+			return nil, contextError(ctx, "revoke_superseded")
+		}
+		opts := revocationOptions{grace: r.RevocationGracePeriod, reason: ReasonSuperseded, kvPath: r.RevocationKVPath, logger: logger,
+			retry: r.Retry, ctx: ctx, audit: r.Audit, usersCache: r.UsersCache, configStore: r.ConfigStore, actor: r.Actor, endpointID: r.ClientVPNEndpointID}
+		// The metadata is only read for the users with certificates to revoke
+		if r.SuspensionKVPath != "" && len(activeCertificates(crts)) > 0 {
+			err := checkSuspended(r.Client, r.SuspensionKVPath, username)
+			var suspended *UserSuspendedError
+			switch {
+			case errors.As(err, &suspended):
+				opts.revokeAll = true
+				opts.reason = ReasonPrivilegeWithdrawn
+			case err != nil:
+				if !r.ContinueOnRevocationError {
+					span.RecordError(err)
+					span.End()
+					return nil, err
+				}
+				logger.Error("unable to check the suspension of the user", "user", username, "error", err)
+				failures[username] = err
+				continue
+			}
+		}
+		revoked, err := revokeUserCertificates(r.Client, r.VaultPKIPath, crts, opts)
 		if err != nil {
-			return nil, err
+			if !r.ContinueOnRevocationError {
+				span.RecordError(err)
+				span.End()
+				return nil, err
+			}
+			logger.Error("unable to revoke the certificates of the user", "user", username, "error", err)
+			failures[username] = err
+		}
+		if len(revoked) > 0 {
+			result.RevokedCount += len(revoked)
+			result.AffectedUsers = append(result.AffectedUsers, username)
+			result.RevokedSerials[username] = revoked
 		}
 	}
+	for _, crts := range users {
+		result.SkippedCount += countSuperseded(crts)
+	}
+	span.SetAttributes("revoked_count", result.RevokedCount, "failed", len(failures))
+	span.End()
+	sort.Strings(result.AffectedUsers)
+	metrics.SetActive(countActive(users))
 
-	// Get the updated CRL
-	crl, err := GetCRL(
-		&GetCRLRequest{
-			Client:       r.Client,
-			VaultPKIPath: r.VaultPKIPath,
-		})
+	// Get the updated CRL, AWS only accepts it PEM encoded
+	var crl []byte
+	err = retry(ctx, r.Retry, logger, "get_crl", vaultCall, func(context.Context) (err error) {
+		crl, err = GetCRL(
+			&GetCRLRequest{
+				Client:              r.Client,
+				VaultPKIPath:        r.VaultPKIPath,
+				Format:              CRLFormatPEM,
+				CRLPath:             r.CRLPath,
+				IssuerRef:           r.IssuerRef,
+				ClientVPNEndpointID: r.ClientVPNEndpointID,
+			})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
 
-	// Upload new CRL to AWS Client VPN endpoint
-	svc := ec2.New(session.New())
+	if nextUpdate, err := getCRLNextUpdate(crl); err == nil {
+		metrics.SetCRLNextUpdate(nextUpdate)
+	}
+	if r.VerifyCRLSignature {
+		if err := verifyCRLSignature(r.Client, r.VaultPKIPath, r.IssuerRef, crl); err != nil {
+			return result, err
+		}
+	}
 
-	cvpnCRL, err := svc.ExportClientVpnClientCertificateRevocationList(
-		&ec2.ExportClientVpnClientCertificateRevocationListInput{
-			ClientVpnEndpointId: aws.String(r.ClientVPNEndpointID),
-		})
+	// Check the CRL size before trying to import it
+	result.CRL = crl
+	result.Size = len(crl)
+	result.MaxSize = r.CRLMaxSize
+	if result.MaxSize == 0 {
+		result.MaxSize = DefaultCRLMaxSize
+	}
+	if result.Size > result.MaxSize {
+		return result, &CRLTooLargeError{Size: result.Size, MaxSize: result.MaxSize}
+	}
+	if r.CRLSizeWarnThreshold > 0 && result.Size > r.CRLSizeWarnThreshold {
+		logger.Warn("CRL size is over the warning threshold",
+			"size", result.Size, "threshold", r.CRLSizeWarnThreshold, "max_size", result.MaxSize)
+	}
+	if percent := 100 * float64(result.Size) / float64(result.MaxSize); r.CRLSizeWarnPercent > 0 && percent > r.CRLSizeWarnPercent {
+		logger.Warn("CRL size is approaching the maximum size",
+			"size", result.Size, "max_size", result.MaxSize, "percent", fmt.Sprintf("%.1f", percent), "warn_percent", r.CRLSizeWarnPercent)
+	}
+
+	// Upload new CRL to AWS Client VPN endpoint
+	var previous []byte
+	result.AWSUpdated, previous, err = importCRL(r.Client, r.ClientVPNEndpointID, crl, updateOpts, logger, start)
 	if err != nil {
+		var shrink *CRLShrinkError
+		if errors.As(err, &shrink) {
+			return result, err
+		}
 		return nil, err
 	}
+	if result.AWSUpdated {
+		// The users are known already, so no need to look them up in Vault
+		owners := map[string]string{}
+		for username, crts := range users {
+			for _, crt := range crts {
+				owners[crt.SerialNumber] = username
+			}
+		}
+		result.Diff, err = diffCRL(previous, crl, func(serial string) string { return owners[serial] })
+		if err != nil {
+			logger.Warn("unable to compare the imported CRL with the previous one", "error", err)
+		} else {
+			logger.Info("CRL entries changed", "added", len(result.Diff.Added), "removed", len(result.Diff.Removed))
+		}
+	}
+
+	if r.SNSTopicARN != "" {
+		if err := publishCRLUpdate(r.SNSTopicARN, r.ClientVPNEndpointID, result); err != nil {
+			if r.FailOnSNSError {
+				return result, fmt.Errorf("unable to publish the CRL update to SNS: %s", err)
+			}
+			logger.Warn("unable to publish the CRL update to SNS", "topic", r.SNSTopicARN, "error", err)
+		}
+	}
+
+	if len(failures) > 0 {
+		return result, &RevocationFailuresError{Errors: failures}
+	}
+	return result, nil
+}
+
+// RevocationFailuresError is returned, along with the result, by
+// UpdateCRL with ContinueOnRevocationError when the certificates of
+// some of the users couldn't be revoked. The CRL was updated with the
+// certificates revoked for the rest of the users.
+type RevocationFailuresError struct {
+	// Errors are the errors found revoking the certificates, by username
+	Errors map[string]error
+}
+
+// Unwrap returns ErrPartialRevocation
+func (e *RevocationFailuresError) Unwrap() error {
+	return ErrPartialRevocation
+}
+
+// Users returns the users whose certificates couldn't be revoked, sorted
+func (e *RevocationFailuresError) Users() []string {
+	users := make([]string, 0, len(e.Errors))
+	for username := range e.Errors {
+		users = append(users, username)
+	}
+	sort.Strings(users)
+	return users
+}
+
+func (e *RevocationFailuresError) Error() string {
+	var failures []string
+	for _, username := range e.Users() {
+		failures = append(failures, fmt.Sprintf("%s: %s", username, e.Errors[username]))
+	}
+	return fmt.Sprintf("unable to revoke the certificates of %d users: %s", len(e.Errors), strings.Join(failures, "; "))
+}
+
+// importCRL imports the PEM encoded CRL in the AWS Client VPN endpoint,
+// unless it is the same as the active one. Returns whether it was
+// imported, along with the CRL that was active, if any. The imported
+// CRLs are recorded in the history if opts.CRLHistoryKVPath is set.
+func importCRL(client *api.Client, endpointID string, crl []byte, opts UpdateCRLOptions, logger logging.Logger, start time.Time) (bool, []byte, error) {
+	updated := false
+	var active []byte
+	svc := ec2Client(opts.AWSConfig)
+
+	var cvpnCRL *ec2.ExportClientVpnClientCertificateRevocationListOutput
+	err := retry(opts.Context, opts.Retry, logger, "export_crl", awsCall, func(ctx context.Context) (err error) {
+		span := tracing.Start("export_crl", "endpoint_id", endpointID)
+		cvpnCRL, err = svc.ExportClientVpnClientCertificateRevocationListWithContext(ctx,
+			&ec2.ExportClientVpnClientCertificateRevocationListInput{
+				ClientVpnEndpointId: aws.String(endpointID),
+			})
+		span.RecordError(err)
+		span.End()
+		return err
+	})
+	if err != nil {
+		return false, nil, awsError(err)
+	}
 
 	// Handle the case that no CRL has been uploaded yet. The API
 	// will return a struct without the 'CertificateRevocationList'
 	// property causing an invalid memory address error if not
 	// checked beforehand.
 	if reflect.ValueOf(*cvpnCRL).FieldByName("CertificateRevocationList").Elem().IsValid() {
-		if *cvpnCRL.CertificateRevocationList != string(crl) {
-			// CRL needs update
-			_, err = svc.ImportClientVpnClientCertificateRevocationList(
-				&ec2.ImportClientVpnClientCertificateRevocationListInput{
-					CertificateRevocationList: aws.String(string(crl)),
-					ClientVpnEndpointId:       aws.String(r.ClientVPNEndpointID),
-				})
+		active = []byte(*cvpnCRL.CertificateRevocationList)
+		unchanged := *cvpnCRL.CertificateRevocationList == string(crl)
+		if !unchanged || opts.ForceImport {
+			if opts.MaxCRLShrink > 0 && !opts.ForceShrink {
+				if err := checkCRLShrink([]byte(*cvpnCRL.CertificateRevocationList), crl, opts.MaxCRLShrink); err != nil {
+					return false, nil, err
+				}
+			}
+			// CRL needs update, keep a copy of the current one first
+			if opts.BackupWriter != nil && !unchanged {
+				if err := backupCRL(opts.BackupWriter, endpointID, *cvpnCRL.CertificateRevocationList); err != nil {
+					if opts.FailOnBackupError {
+						return false, nil, fmt.Errorf("aborting CRL import, unable to backup the current CRL: %s", err)
+					}
+					logger.Warn("unable to backup the current CRL", "error", err)
+				}
+			}
+			metrics.CRLUpload(CRLUploadAttempted)
+			err = retry(opts.Context, opts.Retry, logger, "import_crl", awsCall, func(ctx context.Context) error { return importEndpointCRL(ctx, svc, endpointID, crl) })
 			if err != nil {
-				return nil, err
+				metrics.CRLUpload(CRLUploadFailed)
+				return false, nil, awsError(err)
+			}
+			metrics.CRLUpload(CRLUploadSucceeded)
+			updated = true
+			if unchanged {
+				logger.Info("forced refresh of the unchanged CRL in AWS Client VPN endpoint", "duration", time.Since(start))
+			} else {
+				logger.Info("updated CRL in AWS Client VPN endpoint", "duration", time.Since(start))
 			}
-			log.Println("Updated CRL in AWS Client VPN endpoint")
 		} else {
-			log.Println("CRL does not need to be updated")
+			metrics.CRLUpload(CRLUploadSkipped)
+			logger.Info("CRL does not need to be updated", "duration", time.Since(start))
 		}
 	} else {
 		// CRL first time import
-		_, err = svc.ImportClientVpnClientCertificateRevocationList(
-			&ec2.ImportClientVpnClientCertificateRevocationListInput{
-				CertificateRevocationList: aws.String(string(crl)),
-				ClientVpnEndpointId:       aws.String(r.ClientVPNEndpointID),
-			})
-		log.Println("First upload of CRL to the CPN endpoint")
+		metrics.CRLUpload(CRLUploadAttempted)
+		err = retry(opts.Context, opts.Retry, logger, "import_crl", awsCall, func(ctx context.Context) error { return importEndpointCRL(ctx, svc, endpointID, crl) })
 		if err != nil {
-			return nil, err
+			metrics.CRLUpload(CRLUploadFailed)
+			return false, nil, awsError(err)
+		}
+		metrics.CRLUpload(CRLUploadSucceeded)
+		updated = true
+		logger.Info("first upload of CRL to the AWS Client VPN endpoint", "duration", time.Since(start))
+	}
+	metrics.SetLastSync(time.Now())
+	if updated {
+		// The CRL is already in the endpoint, so a failure is just logged
+		if err := recordCRLHistory(client, opts, endpointID, crl); err != nil {
+			logger.Warn("unable to record the CRL in the history", "kv_path", opts.CRLHistoryKVPath, "error", err)
 		}
 	}
+	return updated, active, nil
+}
+
+// importEndpointCRL imports the PEM encoded CRL in the endpoint
+func importEndpointCRL(ctx context.Context, svc ec2iface.EC2API, endpointID string, crl []byte) error {
+	span := tracing.Start("import_crl", "endpoint_id", endpointID, "size", len(crl))
+	defer span.End()
+	_, err := svc.ImportClientVpnClientCertificateRevocationListWithContext(ctx,
+		&ec2.ImportClientVpnClientCertificateRevocationListInput{
+			CertificateRevocationList: aws.String(string(crl)),
+			ClientVpnEndpointId:       aws.String(endpointID),
+		})
+	span.RecordError(err)
+	return err
+}
+
+// backupCRL writes the given CRL to w, preceded by a header with the
+// time of the backup and the endpoint it was exported from. The header
+// sits outside the PEM block so the output is still valid PEM.
+func backupCRL(w io.Writer, endpointID, crl string) error {
+	_, err := fmt.Fprintf(w, "# CRL of endpoint %s backed up at %s\n%s\n",
+		endpointID, time.Now().UTC().Format(time.RFC3339), strings.TrimSpace(crl))
+	return err
+}
 
-	return crl, nil
+// DefaultCRLMaxSize is the default maximum size, in bytes, of a CRL
+// that will be imported into an AWS Client VPN endpoint
+const DefaultCRLMaxSize = 1024 * 1024
+
+// CRLTooLargeError is returned when the CRL exceeds the
+// maximum size that can be imported in AWS Client VPN
+type CRLTooLargeError struct {
+	Size    int
+	MaxSize int
+}
+
+// Unwrap allows matching the error with errors.Is(err, ErrCRLTooLarge)
+func (e *CRLTooLargeError) Unwrap() error {
+	return ErrCRLTooLarge
+}
+
+func (e *CRLTooLargeError) Error() string {
+	return fmt.Sprintf("CRL size (%d bytes) exceeds the maximum allowed (%d bytes). "+
+		"Try tidying the PKI backend to remove expired certificates from the CRL, "+
+		"issuing client certificates with shorter TTLs or using a delta CRL", e.Size, e.MaxSize)
 }
 
 // RotateCRLRequest is the structure containing the
@@ -122,25 +690,174 @@ type RotateCRLRequest struct {
 	Client              *api.Client
 	VaultPKIPath        string
 	ClientVPNEndpointID string
+	// RotationWindow, if set, causes the rotation to be skipped
+	// unless the NextUpdate of the current CRL falls within the window
+	RotationWindow time.Duration
+	UpdateCRLOptions
 }
 
+// RotateCRLResult holds the outcome of a RotateCRL operation
+type RotateCRLResult struct {
+	ClientVPNEndpointID string
+	// Rotated is false if the rotation was skipped due to the RotationWindow
+	Rotated bool
+	// Duration is how long the rotation took, the UpdateCRL included
+	Duration time.Duration
+	*UpdateCRLResult
+}
+
+// RotateCRL forces Vault to regenerate the CRL and then updates the
+// AWS Client VPN endpoint with it. It returns the same errors as UpdateCRL.
 func RotateCRL(r *RotateCRLRequest) error {
+	_, err := RotateCRLWithResult(r)
+	return err
+}
 
-	req := r.Client.NewRequest("GET", fmt.Sprintf("/v1/%s/crl/rotate", r.VaultPKIPath))
-	_, err := r.Client.RawRequest(req)
-	if err != nil {
-		return err
+// RotateCRLWithResult behaves as RotateCRL but also returns a summary of
+// the changes made by the embedded UpdateCRL
+func RotateCRLWithResult(r *RotateCRLRequest) (*RotateCRLResult, error) {
+	start := time.Now()
+	ctx, cancel := startOperation(r.UpdateCRLOptions, "rotate_crl")
+	defer cancel()
+	opts := r.UpdateCRLOptions
+	opts.Context = ctx
+
+	required := append(rotateCapabilities(r.VaultPKIPath), revokeCapabilities(r.VaultPKIPath)...)
+	if err := checkCapabilities(r.Client, r.UpdateCRLOptions, required...); err != nil {
+		return nil, err
+	}
+
+	rotate := true
+	if r.RotationWindow > 0 {
+		var crl []byte
+		err := retry(ctx, r.Retry, r.Logger, "get_crl", vaultCall, func(context.Context) (err error) {
+			crl, err = GetCRL(
+				&GetCRLRequest{
+					Client:              r.Client,
+					VaultPKIPath:        r.VaultPKIPath,
+					CRLPath:             r.CRLPath,
+					IssuerRef:           r.IssuerRef,
+					ClientVPNEndpointID: r.ClientVPNEndpointID,
+				})
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		nextUpdate, err := getCRLNextUpdate(crl)
+		if err != nil {
+			return nil, err
+		}
+		if time.Now().Add(r.RotationWindow).Before(nextUpdate) {
+			logging.OrDefault(r.Logger).Info("skipping CRL rotation, next update is not due yet",
+				"endpoint_id", r.ClientVPNEndpointID, "pki_path", r.VaultPKIPath, "next_update", nextUpdate.Local())
+			rotate = false
+		}
+	}
+
+	if rotate {
+		err := retry(ctx, r.Retry, r.Logger, "rotate_crl", vaultCall, func(context.Context) error { return rotateVaultCRL(r.Client, r.VaultPKIPath) })
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	_, err = UpdateCRL(
+	res, err := UpdateCRL(
 		&UpdateCRLRequest{
 			Client:              r.Client,
 			VaultPKIPath:        r.VaultPKIPath,
 			ClientVPNEndpointID: r.ClientVPNEndpointID,
+			UpdateCRLOptions:    opts,
 		})
 	if err != nil {
-		return err
+		if res != nil {
+			return &RotateCRLResult{ClientVPNEndpointID: r.ClientVPNEndpointID, Rotated: rotate, Duration: time.Since(start), UpdateCRLResult: res}, err
+		}
+		return nil, err
+	}
+
+	return &RotateCRLResult{ClientVPNEndpointID: r.ClientVPNEndpointID, Rotated: rotate, Duration: time.Since(start), UpdateCRLResult: res}, nil
+}
+
+// countSuperseded returns the number of certificates of the
+// user, all but the latest, that haven't been revoked
+func countSuperseded(crts []Certificate) int {
+	n := 0
+	for i, crt := range crts {
+		if i < len(crts)-1 && !crt.Revoked {
+			n++
+		}
+	}
+	return n
+}
+
+// rotateVaultCRL forces Vault to regenerate the CRL of the PKI
+func rotateVaultCRL(client *api.Client, pki string) error {
+	req := client.NewRequest("GET", fmt.Sprintf("/v1/%s/crl/rotate", pki))
+	rsp, err := client.RawRequest(req)
+	if rsp != nil {
+		defer rsp.Body.Close()
 	}
+	if err != nil {
+		return vaultRawError(rsp, err)
+	}
+	return nil
+}
+
+// CRLShrinkError is returned when the new CRL drops more of
+// the entries of the active one than UpdateCRLOptions.MaxCRLShrink
+type CRLShrinkError struct {
+	// Before is the number of entries of the CRL active in the endpoint
+	Before int
+	// After is the number of entries of the new CRL
+	After int
+}
 
+// Unwrap allows matching the error with errors.Is(err, ErrSuspiciousCRLShrink)
+func (e *CRLShrinkError) Unwrap() error {
+	return ErrSuspiciousCRLShrink
+}
+
+func (e *CRLShrinkError) Error() string {
+	return fmt.Sprintf("the new CRL has %d entries, down from %d in the active one. "+
+		"Check the PKI path and force the import if the drop is expected, "+
+		"e.g. after tidying the PKI backend", e.After, e.Before)
+}
+
+// checkCRLShrink returns a *CRLShrinkError if the new CRL
+// drops more than maxShrink of the entries of the active one
+func checkCRLShrink(active, crl []byte, maxShrink float64) error {
+	before, err := parseCRL(active)
+	if err != nil {
+		// Nothing to compare with, the active CRL can't be trusted anyway
+		return nil
+	}
+	after, err := parseCRL(crl)
+	if err != nil {
+		return err
+	}
+	b, a := len(before.TBSCertList.RevokedCertificates), len(after.TBSCertList.RevokedCertificates)
+	if b > 0 && float64(b-a)/float64(b) > maxShrink {
+		return &CRLShrinkError{Before: b, After: a}
+	}
 	return nil
 }
+
+// parseCRL parses a CRL, either DER or PEM encoded. Unlike x509.ParseCRL,
+// the PEM block can be preceded by other text, as in the backups.
+func parseCRL(crl []byte) (*pkix.CertificateList, error) {
+	if block, _ := pem.Decode(crl); block != nil {
+		crl = block.Bytes
+	}
+	return x509.ParseDERCRL(crl)
+}
+
+// getCRLNextUpdate returns the time at which the given
+// PEM encoded CRL is due to be regenerated
+func getCRLNextUpdate(crl []byte) (time.Time, error) {
+	parsed, err := parseCRL(crl)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return parsed.TBSCertList.NextUpdate, nil
+}
@@ -0,0 +1,66 @@
+package operations
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// newTestCRL returns a CRL of the CA with n entries
+func newTestCRL(t *testing.T, ca *testCert, n int) []byte {
+	t.Helper()
+	var entries []pkix.RevokedCertificate
+	for i := 0; i < n; i++ {
+		entries = append(entries, pkix.RevokedCertificate{SerialNumber: big.NewInt(int64(i + 1)), RevocationTime: time.Now()})
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		RevokedCertificates: entries,
+		Number:              big.NewInt(1),
+		ThisUpdate:          time.Now().Add(-time.Minute),
+		NextUpdate:          time.Now().Add(time.Hour),
+	}, ca.cert, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+func TestCheckCRLShrink(t *testing.T) {
+	ca := newTestCert(t, "ca", nil, true)
+	tests := []struct {
+		name          string
+		before, after int
+		maxShrink     float64
+		refused       bool
+	}{
+		{"grown", 4, 6, 0.5, false},
+		{"dropped the maximum", 4, 2, 0.5, false},
+		{"dropped over the maximum", 4, 1, 0.5, true},
+		{"emptied", 4, 0, 0.5, true},
+		{"emptied with the check disabled", 4, 0, 1, false},
+		{"no active entries", 0, 0, 0.5, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkCRLShrink(newTestCRL(t, ca, tt.before), newTestCRL(t, ca, tt.after), tt.maxShrink)
+			var shrinkErr *CRLShrinkError
+			switch {
+			case tt.refused && !errors.As(err, &shrinkErr):
+				t.Errorf("got error %v, want a *CRLShrinkError", err)
+			case tt.refused && (shrinkErr.Before != tt.before || shrinkErr.After != tt.after || !errors.Is(err, ErrSuspiciousCRLShrink)):
+				t.Errorf("got %#v, want %d entries before and %d after", shrinkErr, tt.before, tt.after)
+			case !tt.refused && err != nil:
+				t.Errorf("got error %s, want the CRL accepted", err)
+			}
+		})
+	}
+
+	// An active CRL that can't be parsed is not compared with
+	if err := checkCRLShrink([]byte("garbage"), newTestCRL(t, ca, 0), 0.5); err != nil {
+		t.Errorf("got error %s with an invalid active CRL", err)
+	}
+}
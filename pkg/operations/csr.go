@@ -0,0 +1,243 @@
+package operations
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/directory"
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/logging"
+	"github.com/hashicorp/vault/api"
+)
+
+const (
+	// DefaultMinRSAKeySize is the default minimum size, in bits,
+	// of the RSA keys in the CSRs accepted by SignCSR
+	DefaultMinRSAKeySize = 2048
+	// DefaultMinECKeySize is the default minimum size, in bits,
+	// of the curve of the ECDSA keys in the CSRs accepted by SignCSR
+	DefaultMinECKeySize = 256
+)
+
+// CSRPolicy sets which CSRs are accepted by SignCSR. The CN of
+// the CSR must always be the username the certificate is for.
+type CSRPolicy struct {
+	// AllowedDNSDomains are the domains, and their subdomains, the
+	// DNS SANs can be in. No DNS SANs are accepted if empty.
+	AllowedDNSDomains []string
+	// AllowedEmailDomains are the domains the email SANs can be
+	// in. No email SANs are accepted if empty.
+	AllowedEmailDomains []string
+	// MinRSAKeySize defaults to DefaultMinRSAKeySize
+	MinRSAKeySize int
+	// MinECKeySize defaults to DefaultMinECKeySize
+	MinECKeySize int
+}
+
+// SignCSRRequest is the structure containing the required
+// data to sign a certificate signing request of a user
+type SignCSRRequest struct {
+	Client              *api.Client
+	VaultPKIPaths       []string
+	VaultPKIRole        string
+	Username            string
+	ClientVPNEndpointID string
+	Policy              CSRPolicy
+	// MaxCertsPerUser and RevokeOldest limit the active certificates
+	// of the user as in IssueCertificateRequest
+	MaxCertsPerUser int
+	RevokeOldest    bool
+	// DenyListKVPath, if set, is the kv store of the deny-list. The
+	// signature fails with a *DeniedUserError for the users in it.
+	DenyListKVPath string
+	// Directory, if set, is checked as in IssueCertificateRequest
+	Directory directory.Checker
+	// RateLimiter, if set, limits how often this runs for the Caller
+	// and for the user. A *RateLimitError is returned when reached.
+	RateLimiter *RateLimiter
+	Caller      string
+	UpdateCRLOptions
+}
+
+// SignCSRResult holds the signed certificate
+type SignCSRResult struct {
+	SerialNumber string
+	Certificate  string
+	CAChain      []string
+	NotAfter     time.Time
+}
+
+// SignCSR signs the PEM encoded certificate signing request of a user, so
+// the user's private key never leaves their machine. The CSR is checked
+// against the request's Policy before sending it to Vault. As with
+// IssueClientCertificate, the MaxCertsPerUser are enforced and the other
+// certificates of the user are revoked.
+func SignCSR(r *SignCSRRequest, csrPEM []byte) (*SignCSRResult, error) {
+	username, err := NormalizeUsername(r.Username)
+	if err != nil {
+		return nil, err
+	}
+	r.Username = username
+
+	if err := r.RateLimiter.Allow(r.Caller, r.Username); err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	result, err := signCSR(r, csrPEM)
+	observe("sign_csr", start, err)
+	if err == nil {
+		metrics.CertificateIssued()
+	}
+	return result, err
+}
+
+func signCSR(r *SignCSRRequest, csrPEM []byte) (*SignCSRResult, error) {
+	defer r.UsersCache.Invalidate()
+
+	if err := checkDenyList(r.Client, r.DenyListKVPath, r.Username); err != nil {
+		return nil, err
+	}
+	if err := checkDirectory(r.Directory, r.Username); err != nil {
+		return nil, err
+	}
+	if err := checkSuspended(r.Client, r.SuspensionKVPath, r.Username); err != nil {
+		return nil, err
+	}
+
+	if err := validateCSR(csrPEM, r.Username, r.Policy); err != nil {
+		return nil, &Error{Kind: ErrCSRRejected, Err: err}
+	}
+	if r.MaxCertsPerUser > 0 {
+		err := enforceCertLimit(r.Client, r.VaultPKIPaths[len(r.VaultPKIPaths)-1], r.IssuerRef, r.ClientVPNEndpointID,
+			r.Username, nil, r.MaxCertsPerUser, r.RevokeOldest, r.RevocationKVPath, r.UpdateCRLOptions)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	payload := map[string]interface{}{
+		"csr":         string(csrPEM),
+		"common_name": r.Username,
+	}
+	var crt *api.Secret
+	err := retry(r.Context, r.Retry, r.Logger, "sign", vaultCall, func(context.Context) (err error) {
+		crt, err = r.Client.Logical().Write(issuerPath(r.VaultPKIPaths[len(r.VaultPKIPaths)-1], r.IssuerRef, "sign", r.VaultPKIRole), payload)
+		return vaultError(err)
+	})
+	if err != nil {
+		return nil, err
+	}
+	result := &SignCSRResult{
+		SerialNumber: crt.Data["serial_number"].(string),
+		Certificate:  crt.Data["certificate"].(string),
+	}
+	logger := logging.OrDefault(r.Logger).With("user", r.Username, "endpoint_id", r.ClientVPNEndpointID)
+	logger.Info("signed certificate", "serial", result.SerialNumber)
+
+	parsed, err := parseCertificatePEM(result.Certificate)
+	if err != nil {
+		return nil, err
+	}
+	result.NotAfter = parsed.NotAfter
+
+	result.CAChain, err = GetCAChain(
+		&GetCAChainRequest{
+			Client:        r.Client,
+			VaultPKIPaths: r.VaultPKIPaths,
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	// Call UpdateCRL to revoke all other certificates
+	_, err = UpdateCRL(
+		&UpdateCRLRequest{
+			Client:              r.Client,
+			VaultPKIPath:        r.VaultPKIPaths[len(r.VaultPKIPaths)-1],
+			ClientVPNEndpointID: r.ClientVPNEndpointID,
+			UpdateCRLOptions:    r.UpdateCRLOptions,
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// validateCSR checks that the CSR is correctly signed, is for
+// the given user and is allowed by the policy
+func validateCSR(csrPEM []byte, username string, policy CSRPolicy) error {
+	block, _ := pem.Decode(csrPEM)
+	if block == nil || !strings.HasSuffix(block.Type, "CERTIFICATE REQUEST") {
+		return errors.New("failed to parse CSR PEM")
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return err
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return fmt.Errorf("invalid CSR signature: %s", err)
+	}
+
+	if normalizeUsername(csr.Subject.CommonName) != username {
+		return fmt.Errorf("the CN of the CSR must be '%s', got '%s'", username, csr.Subject.CommonName)
+	}
+	if len(csr.IPAddresses) > 0 || len(csr.URIs) > 0 {
+		return errors.New("IP and URI SANs are not allowed")
+	}
+	for _, name := range csr.DNSNames {
+		if !inDomains(name, policy.AllowedDNSDomains, true) {
+			return fmt.Errorf("DNS SAN '%s' is not allowed", name)
+		}
+	}
+	for _, email := range csr.EmailAddresses {
+		i := strings.LastIndex(email, "@")
+		if i < 0 || !inDomains(email[i+1:], policy.AllowedEmailDomains, false) {
+			return fmt.Errorf("email SAN '%s' is not allowed", email)
+		}
+	}
+
+	minRSA := policy.MinRSAKeySize
+	if minRSA == 0 {
+		minRSA = DefaultMinRSAKeySize
+	}
+	minEC := policy.MinECKeySize
+	if minEC == 0 {
+		minEC = DefaultMinECKeySize
+	}
+	switch key := csr.PublicKey.(type) {
+	case *rsa.PublicKey:
+		if key.N.BitLen() < minRSA {
+			return fmt.Errorf("RSA key size %d is below the minimum of %d", key.N.BitLen(), minRSA)
+		}
+	case *ecdsa.PublicKey:
+		if key.Curve.Params().BitSize < minEC {
+			return fmt.Errorf("EC key size %d is below the minimum of %d", key.Curve.Params().BitSize, minEC)
+		}
+	case ed25519.PublicKey:
+	default:
+		return fmt.Errorf("unsupported key type %T", key)
+	}
+
+	return nil
+}
+
+// inDomains reports whether name is one of the domains or,
+// if subdomains is set, a subdomain of one of them
+func inDomains(name string, domains []string, subdomains bool) bool {
+	name = strings.ToLower(name)
+	for _, d := range domains {
+		d = strings.ToLower(d)
+		if name == d || (subdomains && strings.HasSuffix(name, "."+d)) {
+			return true
+		}
+	}
+	return false
+}
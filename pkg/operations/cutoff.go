@@ -0,0 +1,138 @@
+package operations
+
+import (
+	"sort"
+	"time"
+
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/logging"
+	"github.com/hashicorp/vault/api"
+)
+
+// RevokeIssuedBeforeRequest is the structure containing the required
+// data to revoke the certificates issued before a cutoff date
+type RevokeIssuedBeforeRequest struct {
+	Client              *api.Client
+	VaultPKIPath        string
+	ClientVPNEndpointID string
+	// Reason is recorded for each revoked certificate in the kv
+	// store under VaultKVPath. Defaults to ReasonKeyCompromise.
+	Reason      RevocationReason
+	VaultKVPath string
+	// DryRun only reports the certificates that would be revoked
+	DryRun bool
+	UpdateCRLOptions
+}
+
+// RevokeIssuedBeforeResult holds the outcome of a RevokeIssuedBefore operation
+type RevokeIssuedBeforeResult struct {
+	// Revoked are the serial numbers of the revoked certificates, or
+	// of the ones to revoke on a dry run, keyed by username
+	Revoked map[string][]string
+	// Failed are the users whose certificates couldn't all be revoked.
+	// The ones that were are still listed in Revoked.
+	Failed map[string]error
+	DryRun bool
+	// UpdateCRLResult is the outcome of the CRL update that follows
+	// the revocations. Nil on a dry run, if nothing was revoked or if
+	// the update failed before producing one.
+	*UpdateCRLResult
+}
+
+// Users returns the users with revoked certificates, sorted
+func (r *RevokeIssuedBeforeResult) Users() []string {
+	users := make([]string, 0, len(r.Revoked))
+	for u := range r.Revoked {
+		users = append(users, u)
+	}
+	sort.Strings(users)
+	return users
+}
+
+// RevokeIssuedBefore revokes all the certificates issued before the
+// cutoff, whichever their user, and then updates the CRL once, e.g. to
+// respond to the exposure of the CA key during a time window. The
+// certificates already revoked or expired are left out. A failure
+// revoking the certificates of one of the users is recorded in Failed
+// and does not stop the rest. The returned error is that of the CRL
+// update, along with the result.
+func RevokeIssuedBefore(r *RevokeIssuedBeforeRequest, cutoff time.Time) (*RevokeIssuedBeforeResult, error) {
+	start := time.Now()
+	res, err := revokeIssuedBefore(r, cutoff)
+	observe("revoke_issued_before", start, err)
+	return res, err
+}
+
+func revokeIssuedBefore(r *RevokeIssuedBeforeRequest, cutoff time.Time) (*RevokeIssuedBeforeResult, error) {
+	logger := logging.OrDefault(r.Logger).With("endpoint_id", r.ClientVPNEndpointID, "pki_path", r.VaultPKIPath)
+	reason := r.Reason
+	if reason == "" {
+		reason = ReasonKeyCompromise
+	}
+	if !r.DryRun {
+		if err := checkCapabilities(r.Client, r.UpdateCRLOptions, revokeCapabilities(r.VaultPKIPath)...); err != nil {
+			return nil, err
+		}
+	}
+
+	users, err := ListUsers(
+		&ListUsersRequest{
+			Client:              r.Client,
+			VaultPKIPath:        r.VaultPKIPath,
+			ClientVPNEndpointID: r.ClientVPNEndpointID,
+			IssuerRef:           r.IssuerRef,
+			AdoptedKVPath:       r.AdoptedKVPath,
+			Retry:               r.Retry,
+			Logger:              r.Logger,
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	result := &RevokeIssuedBeforeResult{Revoked: map[string][]string{}, Failed: map[string]error{}, DryRun: r.DryRun}
+	now := time.Now()
+	for username, crts := range users {
+		var issued []Certificate
+		for _, crt := range crts {
+			if !crt.Revoked && crt.NotBefore.Before(cutoff) && crt.NotAfter.After(now) {
+				issued = append(issued, crt)
+			}
+		}
+		if len(issued) == 0 {
+			continue
+		}
+		if r.DryRun {
+			for _, crt := range issued {
+				result.Revoked[username] = append(result.Revoked[username], crt.SerialNumber)
+			}
+			continue
+		}
+		revoked, err := revokeUserCertificates(r.Client, r.VaultPKIPath, issued,
+			revocationOptions{revokeAll: true, reason: reason, kvPath: r.VaultKVPath, logger: r.Logger,
+				retry: r.Retry, ctx: r.Context, audit: r.Audit, usersCache: r.UsersCache, configStore: r.ConfigStore, actor: r.Actor, endpointID: r.ClientVPNEndpointID})
+		if len(revoked) > 0 {
+			result.Revoked[username] = revoked
+		}
+		if err != nil {
+			logger.Warn("couldn't revoke the certificates issued before the cutoff", "user", username, "error", err)
+			result.Failed[username] = err
+		}
+	}
+	logger.Info("certificates issued before the cutoff", "cutoff", cutoff.Format(time.RFC3339),
+		"users", len(result.Revoked), "failed", len(result.Failed), "dry_run", r.DryRun)
+
+	if r.DryRun || len(result.Revoked) == 0 {
+		return result, nil
+	}
+
+	result.UpdateCRLResult, err = UpdateCRL(
+		&UpdateCRLRequest{
+			Client:              r.Client,
+			VaultPKIPath:        r.VaultPKIPath,
+			ClientVPNEndpointID: r.ClientVPNEndpointID,
+			UpdateCRLOptions:    r.UpdateCRLOptions,
+		})
+	if err != nil {
+		return result, err
+	}
+	return result, nil
+}
@@ -0,0 +1,178 @@
+package operations
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// DenyListEntry is a user that can't be issued certificates,
+// e.g. because they have been offboarded
+type DenyListEntry struct {
+	Username  string    `json:"username"`
+	Reason    string    `json:"reason,omitempty"`
+	CreatedBy string    `json:"created-by,omitempty"`
+	CreatedAt time.Time `json:"created-at"`
+}
+
+// DenyListRequest is the structure containing the required
+// data to read or change the deny-list entry of a user
+type DenyListRequest struct {
+	Client      *api.Client
+	VaultKVPath string
+	Username    string
+	// Retry is the policy the Vault calls are retried with, see UpdateCRLOptions
+	Retry *RetryPolicy
+}
+
+// DeniedUserError is returned when a certificate is requested for a user
+// in the deny-list. It matches ErrUserDenied.
+type DeniedUserError struct {
+	Entry DenyListEntry
+}
+
+// Unwrap returns ErrUserDenied
+func (e *DeniedUserError) Unwrap() error {
+	return ErrUserDenied
+}
+
+func (e *DeniedUserError) Error() string {
+	msg := fmt.Sprintf("user '%s' is in the deny-list since %s", e.Entry.Username, e.Entry.CreatedAt.Format(time.RFC3339))
+	if e.Entry.CreatedBy != "" {
+		msg += ", added by " + e.Entry.CreatedBy
+	}
+	if e.Entry.Reason != "" {
+		msg += ": " + e.Entry.Reason
+	}
+	return msg
+}
+
+func denyListPath(kv, username string) string {
+	return fmt.Sprintf("%s/data/denylist/%s", kv, username)
+}
+
+// AddToDenyList adds the user to the deny-list, replacing
+// the previous entry of the user if any
+func AddToDenyList(r *DenyListRequest, reason, createdBy string) (*DenyListEntry, error) {
+	entry := &DenyListEntry{
+		Username:  normalizeUsername(r.Username),
+		Reason:    reason,
+		CreatedBy: createdBy,
+		CreatedAt: time.Now().UTC(),
+	}
+	payload := map[string]interface{}{
+		"data": map[string]string{
+			"reason":     entry.Reason,
+			"created_by": entry.CreatedBy,
+			"created_at": entry.CreatedAt.Format(time.RFC3339),
+		},
+	}
+	err := retry(context.Background(), r.Retry, nil, "add_to_denylist", vaultCall, func(context.Context) error {
+		_, err := r.Client.Logical().Write(denyListPath(r.VaultKVPath, entry.Username), payload)
+		return vaultError(err)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// GetDenyListEntry returns the deny-list entry of the
+// user, or nil if the user is not in the deny-list
+func GetDenyListEntry(r *DenyListRequest) (*DenyListEntry, error) {
+	username := normalizeUsername(r.Username)
+	var secret *api.Secret
+	err := retry(context.Background(), r.Retry, nil, "read_denylist", vaultCall, func(context.Context) (err error) {
+		secret, err = r.Client.Logical().Read(denyListPath(r.VaultKVPath, username))
+		return vaultError(err)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil || secret.Data["data"] == nil {
+		return nil, nil
+	}
+	data, ok := secret.Data["data"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("unexpected format of the deny-list entry of user '%s'", username)
+	}
+	entry := &DenyListEntry{Username: username}
+	entry.Reason, _ = data["reason"].(string)
+	entry.CreatedBy, _ = data["created_by"].(string)
+	if s, ok := data["created_at"].(string); ok {
+		entry.CreatedAt, _ = time.Parse(time.RFC3339, s)
+	}
+	return entry, nil
+}
+
+// RemoveFromDenyList deletes the deny-list entry of the user, along with
+// all its versions. A user that is not in the deny-list is reported as
+// ErrUserNotFound.
+func RemoveFromDenyList(r *DenyListRequest) (*DenyListEntry, error) {
+	entry, err := GetDenyListEntry(r)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, &Error{Kind: ErrUserNotFound, Err: fmt.Errorf("user '%s' is not in the deny-list", r.Username)}
+	}
+	err = retry(context.Background(), r.Retry, nil, "remove_from_denylist", vaultCall, func(context.Context) error {
+		_, err := r.Client.Logical().Delete(fmt.Sprintf("%s/metadata/denylist/%s", r.VaultKVPath, entry.Username))
+		return vaultError(err)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// ListDenyList returns the entries of the deny-list, sorted by username
+func ListDenyList(client *api.Client, kv string) ([]DenyListEntry, error) {
+	var secret *api.Secret
+	err := retry(context.Background(), nil, nil, "list_denylist", vaultCall, func(context.Context) (err error) {
+		secret, err = client.Logical().List(fmt.Sprintf("%s/metadata/denylist", kv))
+		return vaultError(err)
+	})
+	if err != nil {
+		return nil, err
+	}
+	entries := []DenyListEntry{}
+	if secret == nil {
+		return entries, nil
+	}
+	keys, _ := secret.Data["keys"].([]interface{})
+	for _, key := range keys {
+		username, ok := key.(string)
+		if !ok {
+			continue
+		}
+		entry, err := GetDenyListEntry(&DenyListRequest{Client: client, VaultKVPath: kv, Username: username})
+		if err != nil {
+			return nil, err
+		}
+		if entry != nil {
+			entries = append(entries, *entry)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Username < entries[j].Username })
+	return entries, nil
+}
+
+// checkDenyList returns a *DeniedUserError if the user is in the
+// deny-list of the kv store. Nothing is checked if kv is empty.
+func checkDenyList(client *api.Client, kv, username string) error {
+	if kv == "" {
+		return nil
+	}
+	entry, err := GetDenyListEntry(&DenyListRequest{Client: client, VaultKVPath: kv, Username: username})
+	if err != nil {
+		return err
+	}
+	if entry != nil {
+		return &DeniedUserError{Entry: *entry}
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package operations
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/logging"
+	"github.com/hashicorp/vault/api"
+)
+
+// DefaultMaxDeprovisions is the default maximum number of users
+// DeprovisionUsers revokes in a single run
+const DefaultMaxDeprovisions = 10
+
+// DeprovisionUsersRequest is the structure containing the required
+// data to revoke the users that are not in an allowlist
+type DeprovisionUsersRequest struct {
+	Client              *api.Client
+	VaultPKIPath        string
+	ClientVPNEndpointID string
+	VaultKVPath         string
+	// Allowlist are the users entitled to use the VPN
+	Allowlist []string
+	// DryRun only reports the users that would be deprovisioned
+	DryRun bool
+	// MaxDeprovisions is the maximum number of users that can be
+	// deprovisioned at once, as a safety net against an incomplete
+	// allowlist. Defaults to DefaultMaxDeprovisions. Ignored if Force is set.
+	MaxDeprovisions int
+	Force           bool
+	// DenyList adds the deprovisioned users to the deny-list under
+	// VaultKVPath, with Caller as the author of the entries
+	DenyList bool
+	Caller   string
+	UpdateCRLOptions
+}
+
+// DeprovisionUsersResult holds the outcome of a DeprovisionUsers operation
+type DeprovisionUsersResult struct {
+	// Deprovisioned are the users that got their certificates revoked,
+	// or that would have in a dry run or above the MaxDeprovisions
+	Deprovisioned []string
+	// Failed are the users whose certificates couldn't all be revoked,
+	// or that couldn't be added to the deny-list. The ones with any
+	// certificate revoked are still listed in Deprovisioned.
+	Failed map[string]error
+	DryRun bool
+	// UpdateCRLResult is the outcome of the CRL update, nil in dry
+	// runs, if nothing was revoked or if the update failed before
+	// producing one
+	*UpdateCRLResult
+}
+
+// DeprovisionLimitError is returned when the number of users to
+// deprovision exceeds the maximum allowed in a single run
+type DeprovisionLimitError struct {
+	Count int
+	Max   int
+}
+
+// Unwrap allows matching the error with errors.Is(err, ErrTooManyDeprovisions)
+func (e *DeprovisionLimitError) Unwrap() error {
+	return ErrTooManyDeprovisions
+}
+
+func (e *DeprovisionLimitError) Error() string {
+	return fmt.Sprintf("%d users would be deprovisioned, the maximum allowed at once is %d", e.Count, e.Max)
+}
+
+// DeprovisionUsers revokes all the certificates of the users with an active
+// certificate that are not in the allowlist, and then updates the CRL. As
+// with RevokeUsers, a failure with one of the users is recorded in Failed
+// and does not stop the rest, nor the CRL update, whose error is returned
+// along with the result.
+func DeprovisionUsers(r *DeprovisionUsersRequest) (*DeprovisionUsersResult, error) {
+	logger := logging.OrDefault(r.Logger).With("endpoint_id", r.ClientVPNEndpointID, "pki_path", r.VaultPKIPath)
+
+	users, err := ListUsers(
+		&ListUsersRequest{
+			Client:              r.Client,
+			VaultPKIPath:        r.VaultPKIPath,
+			ClientVPNEndpointID: r.ClientVPNEndpointID,
+			IssuerRef:           r.IssuerRef,
+			AdoptedKVPath:       r.AdoptedKVPath,
+			Retry:               r.Retry,
+			Logger:              r.Logger,
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	allowed := map[string]bool{}
+	for _, u := range r.Allowlist {
+		allowed[u] = true
+	}
+
+	var planned []string
+	for username, crts := range users {
+		if !allowed[username] && len(activeCertificates(crts)) > 0 {
+			planned = append(planned, username)
+		}
+	}
+	sort.Strings(planned)
+
+	result := &DeprovisionUsersResult{DryRun: r.DryRun, Failed: map[string]error{}}
+	max := r.MaxDeprovisions
+	if max == 0 {
+		max = DefaultMaxDeprovisions
+	}
+	if !r.Force && len(planned) > max {
+		result.Deprovisioned = planned
+		return result, &DeprovisionLimitError{Count: len(planned), Max: max}
+	}
+	if r.DryRun || len(planned) == 0 {
+		result.Deprovisioned = planned
+		return result, nil
+	}
+	if err := checkCapabilities(r.Client, r.UpdateCRLOptions, revokeCapabilities(r.VaultPKIPath)...); err != nil {
+		return nil, err
+	}
+
+	for _, username := range planned {
+		revoked, err := revokeUserCertificates(r.Client, r.VaultPKIPath, users[username],
+			revocationOptions{revokeAll: true, reason: ReasonCessationOfOperation, kvPath: r.VaultKVPath, logger: r.Logger,
+				retry: r.Retry, ctx: r.Context, audit: r.Audit, usersCache: r.UsersCache, configStore: r.ConfigStore, actor: r.Actor, endpointID: r.ClientVPNEndpointID})
+		if len(revoked) > 0 {
+			result.Deprovisioned = append(result.Deprovisioned, username)
+		}
+		if err != nil {
+			logger.Warn("couldn't deprovision user not in the allowlist", "user", username, "error", err)
+			result.Failed[username] = err
+			continue
+		}
+		logger.Info("deprovisioned user not in the allowlist", "user", username)
+		if r.DenyList {
+			_, err := AddToDenyList(&DenyListRequest{Client: r.Client, VaultKVPath: r.VaultKVPath, Username: username, Retry: r.Retry},
+				"deprovisioned, not in the allowlist", r.Caller)
+			if err != nil {
+				logger.Warn("couldn't add the deprovisioned user to the deny-list", "user", username, "error", err)
+				result.Failed[username] = err
+			}
+		}
+	}
+
+	if len(result.Deprovisioned) == 0 {
+		return result, nil
+	}
+	result.UpdateCRLResult, err = UpdateCRL(
+		&UpdateCRLRequest{
+			Client:              r.Client,
+			VaultPKIPath:        r.VaultPKIPath,
+			ClientVPNEndpointID: r.ClientVPNEndpointID,
+			UpdateCRLOptions:    r.UpdateCRLOptions,
+		})
+	if err != nil {
+		return result, err
+	}
+
+	return result, nil
+}
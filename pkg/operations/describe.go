@@ -0,0 +1,108 @@
+package operations
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/hashicorp/vault/api"
+)
+
+// DescribeUserRequest is the structure containing the
+// required data to describe a user
+type DescribeUserRequest struct {
+	Client              *api.Client
+	VaultPKIPath        string
+	ClientVPNEndpointID string
+	Username            string
+	// VaultKVPath, if set, is used to fill in the revocation
+	// reason of the revoked certificates and the suspension
+	VaultKVPath string
+	// IssuerRef, if set, restricts the listing to the
+	// certificates issued by this issuer of the mount
+	IssuerRef string
+	// AdoptedKVPath, if set, includes the certificates adopted by the user
+	AdoptedKVPath string
+	// AWSConfig, if set, is applied to the EC2 client listing
+	// the connections, see UpdateCRLOptions.AWSConfig
+	AWSConfig *aws.Config
+}
+
+// UserDescription gathers all the information about a user
+type UserDescription struct {
+	Username string `json:"username"`
+	// Certificates are all the certificates of the user, active
+	// and revoked, sorted by the date they were issued at
+	Certificates []Certificate `json:"certificates"`
+	// Active is the number of certificates neither revoked nor expired
+	Active int `json:"active"`
+	// Suspension is set if the user is suspended
+	Suspension *Suspension `json:"suspension,omitempty"`
+	// Connections are the active connections to the endpoint
+	// established with any of the certificates of the user
+	Connections []ClientConnection `json:"connections"`
+}
+
+// DescribeUser returns the certificates of the user, along with their
+// revocation details, and the active connections of the user to the
+// endpoint. Returns ErrUserNotFound if the user has no certificates.
+func DescribeUser(r *DescribeUserRequest) (*UserDescription, error) {
+	start := time.Now()
+	desc, err := describeUser(r)
+	observe("describe_user", start, err)
+	return desc, err
+}
+
+func describeUser(r *DescribeUserRequest) (*UserDescription, error) {
+	r.Username = normalizeUsername(r.Username)
+	users, err := ListUsers(
+		&ListUsersRequest{
+			Client:              r.Client,
+			VaultPKIPath:        r.VaultPKIPath,
+			ClientVPNEndpointID: r.ClientVPNEndpointID,
+			IssuerRef:           r.IssuerRef,
+			Prefix:              r.Username,
+			AdoptedKVPath:       r.AdoptedKVPath,
+		})
+	if err != nil {
+		return nil, err
+	}
+	crts, ok := users[r.Username]
+	if !ok {
+		return nil, &Error{Kind: ErrUserNotFound, Err: fmt.Errorf("user '%s' has no certificates", r.Username)}
+	}
+
+	if r.VaultKVPath != "" {
+		for i := range crts {
+			if !crts[i].Revoked {
+				continue
+			}
+			crts[i].RevocationReason, err = getRevocationReason(r.Client, r.VaultKVPath, crts[i].SerialNumber)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	desc := &UserDescription{
+		Username:     r.Username,
+		Certificates: crts,
+		Active:       len(activeCertificates(crts)),
+	}
+	if r.VaultKVPath != "" {
+		md, err := GetUserMetadata(&UserMetadataRequest{Client: r.Client, VaultKVPath: r.VaultKVPath, Username: r.Username})
+		if err != nil {
+			return nil, vaultError(err)
+		}
+		desc.Suspension = md.Suspension
+		for i := range crts {
+			crts[i].KeyNotRetained = !md.keyRetained(crts[i].SerialNumber)
+		}
+	}
+
+	desc.Connections, err = listUserConnections(r.ClientVPNEndpointID, r.Username, r.AWSConfig)
+	if err != nil {
+		return nil, err
+	}
+	return desc, nil
+}
@@ -0,0 +1,184 @@
+package operations
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/logging"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/hashicorp/vault/api"
+)
+
+// CRLDiffEntry is a revoked certificate added to or removed from the CRL
+type CRLDiffEntry struct {
+	SerialNumber   string    `json:"serial_number"`
+	RevocationTime time.Time `json:"revocation_time"`
+	// Username the certificate belongs to, empty if it couldn't be resolved
+	Username string `json:"username,omitempty"`
+}
+
+// CRLDiff holds the revoked certificates that changed between two CRLs
+type CRLDiff struct {
+	// Added are the entries of the new CRL missing in the previous one
+	Added []CRLDiffEntry `json:"added"`
+	// Removed are the entries of the previous CRL missing in the new one,
+	// e.g. the expired certificates dropped when the PKI is tidied
+	Removed []CRLDiffEntry `json:"removed"`
+}
+
+// Empty returns true if both CRLs have the same entries
+func (d *CRLDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0
+}
+
+// DiffCRLRequest is the structure containing the
+// required data to compare two CRLs
+type DiffCRLRequest struct {
+	// Client and VaultPKIPath, if set, are used to resolve the username
+	// of each serial number from its certificate in Vault
+	Client       *api.Client
+	VaultPKIPath string
+	Logger       logging.Logger
+}
+
+// DiffCRL compares the entries of the previous and the new CRLs, either
+// PEM or DER encoded. An empty previous CRL, as in an endpoint that had
+// none, has no entries. The usernames that can't be resolved are left
+// empty, which doesn't fail the operation.
+func DiffCRL(r *DiffCRLRequest, previous, crl []byte) (*CRLDiff, error) {
+	resolve := func(string) string { return "" }
+	if r.Client != nil && r.VaultPKIPath != "" {
+		logger := logging.OrDefault(r.Logger).With("pki_path", r.VaultPKIPath)
+		resolve = func(serial string) string {
+			username, err := lookupUsername(r.Client, r.VaultPKIPath, serial)
+			if err != nil {
+				logger.Warn("unable to resolve the user of a CRL entry", "serial", serial, "error", err)
+			}
+			return username
+		}
+	}
+	return diffCRL(previous, crl, resolve)
+}
+
+func diffCRL(previous, crl []byte, resolve func(serial string) string) (*CRLDiff, error) {
+	before, err := crlEntries(previous)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse the previous CRL: %s", err)
+	}
+	after, err := crlEntries(crl)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse the new CRL: %s", err)
+	}
+
+	diff := &CRLDiff{Added: []CRLDiffEntry{}, Removed: []CRLDiffEntry{}}
+	for serial, revoked := range after {
+		if _, ok := before[serial]; !ok {
+			diff.Added = append(diff.Added, CRLDiffEntry{SerialNumber: serial, RevocationTime: revoked, Username: resolve(serial)})
+		}
+	}
+	for serial, revoked := range before {
+		if _, ok := after[serial]; !ok {
+			diff.Removed = append(diff.Removed, CRLDiffEntry{SerialNumber: serial, RevocationTime: revoked, Username: resolve(serial)})
+		}
+	}
+	for _, entries := range [][]CRLDiffEntry{diff.Added, diff.Removed} {
+		sort.Slice(entries, func(i, j int) bool { return entries[i].SerialNumber < entries[j].SerialNumber })
+	}
+	return diff, nil
+}
+
+// crlEntries returns the revocation time of the entries of the
+// CRL, keyed by serial number. An empty CRL has no entries.
+func crlEntries(crl []byte) (map[string]time.Time, error) {
+	entries := map[string]time.Time{}
+	if len(strings.TrimSpace(string(crl))) == 0 {
+		return entries, nil
+	}
+	parsed, err := parseCRL(crl)
+	if err != nil {
+		return nil, err
+	}
+	for _, crt := range parsed.TBSCertList.RevokedCertificates {
+		entries[getHexFormatted(crt.SerialNumber.Bytes(), "-")] = crt.RevocationTime
+	}
+	return entries, nil
+}
+
+// lookupUsername returns the username of the certificate with the given
+// serial number in Vault, or an empty one if the certificate is gone
+func lookupUsername(client *api.Client, pki, serial string) (string, error) {
+	secret, err := client.Logical().Read(fmt.Sprintf("%s/cert/%s", pki, serial))
+	if err != nil {
+		return "", vaultError(err)
+	}
+	if secret == nil {
+		return "", nil
+	}
+	rawCert, _ := secret.Data["certificate"].(string)
+	block, _ := pem.Decode([]byte(rawCert))
+	if block == nil {
+		return "", nil
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse certificate '%s': %s", serial, err)
+	}
+	return usernameFromCN(cert.Subject.CommonName), nil
+}
+
+// DiffEndpointCRLRequest is the structure containing the required
+// data to compare the CRL in Vault with the one in the endpoint
+type DiffEndpointCRLRequest struct {
+	Client              *api.Client
+	VaultPKIPath        string
+	ClientVPNEndpointID string
+	// CRLPath and IssuerRef select the CRL of the PKI, as in UpdateCRLOptions
+	CRLPath   string
+	IssuerRef string
+	Logger    logging.Logger
+	// AWSConfig, if set, is applied to the EC2
+	// client, see UpdateCRLOptions.AWSConfig
+	AWSConfig *aws.Config
+}
+
+// DiffEndpointCRL compares the CRL currently imported in the AWS Client
+// VPN endpoint, as the previous one, with the current CRL in Vault, so
+// the result is what the next UpdateCRL would change, minus the
+// certificates it would revoke. See DiffCRL.
+func DiffEndpointCRL(r *DiffEndpointCRLRequest) (*CRLDiff, error) {
+	start := time.Now()
+	diff, err := diffEndpointCRL(r)
+	observe("diff_crl", start, err)
+	return diff, err
+}
+
+func diffEndpointCRL(r *DiffEndpointCRLRequest) (*CRLDiff, error) {
+	crl, err := GetCRL(
+		&GetCRLRequest{
+			Client:              r.Client,
+			VaultPKIPath:        r.VaultPKIPath,
+			Format:              CRLFormatPEM,
+			CRLPath:             r.CRLPath,
+			IssuerRef:           r.IssuerRef,
+			ClientVPNEndpointID: r.ClientVPNEndpointID,
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	rsp, err := ec2Client(r.AWSConfig).ExportClientVpnClientCertificateRevocationList(
+		&ec2.ExportClientVpnClientCertificateRevocationListInput{
+			ClientVpnEndpointId: aws.String(r.ClientVPNEndpointID),
+		})
+	if err != nil {
+		return nil, awsError(err)
+	}
+
+	return DiffCRL(&DiffCRLRequest{Client: r.Client, VaultPKIPath: r.VaultPKIPath, Logger: r.Logger},
+		[]byte(aws.StringValue(rsp.CertificateRevocationList)), crl)
+}
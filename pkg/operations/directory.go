@@ -0,0 +1,25 @@
+package operations
+
+import (
+	"errors"
+
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/directory"
+)
+
+// checkDirectory checks that the user exists and is active in the
+// directory. The users not found or not active are reported as
+// ErrNotInDirectory and the failures of the directory itself as
+// ErrDirectoryUnavailable. Nothing is checked if d is nil.
+func checkDirectory(d directory.Checker, username string) error {
+	if d == nil {
+		return nil
+	}
+	err := d.Check(username)
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, directory.ErrUserNotFound), errors.Is(err, directory.ErrUserInactive):
+		return &Error{Kind: ErrNotInDirectory, Err: err}
+	}
+	return &Error{Kind: ErrDirectoryUnavailable, Err: err}
+}
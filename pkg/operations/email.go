@@ -0,0 +1,70 @@
+package operations
+
+import (
+	"bytes"
+	"fmt"
+	"text/template"
+	"time"
+
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/mail"
+)
+
+// emailTemplate is the body of the email sent with the VPN config
+var emailTemplate = template.Must(template.New("email").Parse(`Hi {{.Username}},
+
+A new VPN certificate has been issued for you. The OpenVPN config file
+with your certificate is attached to this email. {{if .KeyDiscarded}}It doesn't contain
+your private key, which was only handed out on issuance: replace the
+line marked in it with your private key, then import it{{else}}Import it{{end}} into your
+OpenVPN client to connect to the VPN.
+
+The certificate expires on {{.NotAfter.Format "2006-01-02 15:04 MST"}}.
+{{if not .KeyDiscarded}}
+Keep the config file safe, it contains your private key.
+{{end}}`))
+
+// emailConfig sends the VPN config to the user, without the private key if
+// it is discarded, see DiscardPrivateKey. The address in the request
+// takes precedence over the one stored in the user's metadata. An empty
+// address is returned, without error, if the user has no known address.
+func emailConfig(r *IssueCertificateRequest, result *IssueCertificateResult) (string, error) {
+
+	to := r.Email
+	if to == "" && r.VaultKVPath != "" {
+		md, err := GetUserMetadata(
+			&UserMetadataRequest{
+				Client:      r.Client,
+				VaultKVPath: r.VaultKVPath,
+				Username:    r.Username,
+			})
+		if err != nil {
+			return "", err
+		}
+		to = md.Email
+	}
+	if to == "" {
+		return "", nil
+	}
+	to, err := mail.ParseAddress(to)
+	if err != nil {
+		return "", &Error{Kind: ErrInvalidEmail, Err: err}
+	}
+
+	var body bytes.Buffer
+	err = emailTemplate.Execute(&body, struct {
+		Username     string
+		NotAfter     time.Time
+		KeyDiscarded bool
+	}{r.Username, result.NotAfter, result.KeyDiscarded})
+	if err != nil {
+		return to, err
+	}
+
+	return to, r.Mailer.Send(r.MailFrom, &mail.Message{
+		To:             to,
+		Subject:        fmt.Sprintf("VPN config for %s", r.Username),
+		Body:           body.String(),
+		AttachmentName: fmt.Sprintf("%s.ovpn", r.Username),
+		Attachment:     []byte(result.storedConfig),
+	})
+}
@@ -0,0 +1,124 @@
+package operations
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// EndpointCRLStatus is the state of the CRL of a Client VPN endpoint
+type EndpointCRLStatus struct {
+	EndpointID string `json:"endpoint-id"`
+	// Status is the CRL state reported by AWS: pending or active
+	Status        string `json:"status,omitempty"`
+	StatusMessage string `json:"status-message,omitempty"`
+	// CRLPresent is false if no CRL has been imported in the endpoint
+	CRLPresent bool `json:"crl-present"`
+	// Entries is the number of revoked certificates in the CRL
+	Entries int `json:"entries"`
+	// LastModified is the ThisUpdate date of the CRL, the
+	// time at which it was generated
+	LastModified time.Time `json:"last-modified,omitempty"`
+	NextUpdate   time.Time `json:"next-update,omitempty"`
+	// Error is set if the CRL of the endpoint could not be retrieved
+	Error string `json:"error,omitempty"`
+}
+
+// ListEndpointsCRLStatus returns the CRL status of each of the Client VPN
+// endpoints of the region that use certificate authentication, sorted by
+// endpoint ID. A failure to get the CRL of an endpoint is reported in its
+// Error field and does not prevent listing the others.
+func ListEndpointsCRLStatus() ([]EndpointCRLStatus, error) {
+	svc := ec2Client(nil)
+
+	var ids []string
+	err := svc.DescribeClientVpnEndpointsPages(&ec2.DescribeClientVpnEndpointsInput{},
+		func(page *ec2.DescribeClientVpnEndpointsOutput, last bool) bool {
+			for _, ep := range page.ClientVpnEndpoints {
+				if usesCertificateAuth(ep) {
+					ids = append(ids, aws.StringValue(ep.ClientVpnEndpointId))
+				}
+			}
+			return true
+		})
+	if err != nil {
+		return nil, awsError(err)
+	}
+	sort.Strings(ids)
+
+	statuses := make([]EndpointCRLStatus, 0, len(ids))
+	for _, id := range ids {
+		st := EndpointCRLStatus{EndpointID: id}
+		rsp, err := svc.ExportClientVpnClientCertificateRevocationList(
+			&ec2.ExportClientVpnClientCertificateRevocationListInput{
+				ClientVpnEndpointId: aws.String(id),
+			})
+		if err != nil {
+			st.Error = err.Error()
+			statuses = append(statuses, st)
+			continue
+		}
+		if rsp.Status != nil {
+			st.Status = aws.StringValue(rsp.Status.Code)
+			st.StatusMessage = aws.StringValue(rsp.Status.Message)
+		}
+		if rsp.CertificateRevocationList != nil && *rsp.CertificateRevocationList != "" {
+			st.CRLPresent = true
+			parsed, err := parseCRL([]byte(*rsp.CertificateRevocationList))
+			if err != nil {
+				st.Error = err.Error()
+			} else {
+				st.Entries = len(parsed.TBSCertList.RevokedCertificates)
+				st.LastModified = parsed.TBSCertList.ThisUpdate
+				st.NextUpdate = parsed.TBSCertList.NextUpdate
+			}
+		}
+		statuses = append(statuses, st)
+	}
+
+	return statuses, nil
+}
+
+func usesCertificateAuth(ep *ec2.ClientVpnEndpoint) bool {
+	for _, auth := range ep.AuthenticationOptions {
+		if aws.StringValue(auth.Type) == ec2.ClientVpnAuthenticationTypeCertificateAuthentication {
+			return true
+		}
+	}
+	return false
+}
+
+// describeEndpoint returns the Client VPN endpoint, or an
+// error matching ErrEndpointNotFound if it doesn't exist
+func describeEndpoint(ctx context.Context, endpointID string, cfg *aws.Config) (*ec2.ClientVpnEndpoint, error) {
+	rsp, err := ec2Client(cfg).DescribeClientVpnEndpointsWithContext(ctx,
+		&ec2.DescribeClientVpnEndpointsInput{ClientVpnEndpointIds: aws.StringSlice([]string{endpointID})})
+	if err != nil {
+		return nil, awsError(err)
+	}
+	if len(rsp.ClientVpnEndpoints) == 0 {
+		return nil, &Error{Kind: ErrEndpointNotFound, Err: fmt.Errorf("endpoint %s not found", endpointID)}
+	}
+	return rsp.ClientVpnEndpoints[0], nil
+}
+
+// checkCertificateAuth returns an error matching ErrNotCertificateAuth
+// if the endpoint doesn't use mutual certificate authentication, as
+// importing a CRL in it would fail after revoking the certificates
+func checkCertificateAuth(ep *ec2.ClientVpnEndpoint) error {
+	if usesCertificateAuth(ep) {
+		return nil
+	}
+	var types []string
+	for _, auth := range ep.AuthenticationOptions {
+		types = append(types, aws.StringValue(auth.Type))
+	}
+	return &Error{Kind: ErrNotCertificateAuth, Err: fmt.Errorf(
+		"endpoint %s only uses %s, enable mutual certificate authentication in it or manage an endpoint that uses it",
+		aws.StringValue(ep.ClientVpnEndpointId), strings.Join(types, ", "))}
+}
@@ -0,0 +1,116 @@
+package operations
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+)
+
+// envelopePrefix starts the values sealed by KMSEnvelope, which are
+// <prefix><wrapped data key>:<nonce>:<ciphertext>, all base64 encoded
+const envelopePrefix = "acpm:kms:v1:"
+
+// KMSEnvelope encrypts the private keys, and the VPN configs embedding
+// them, before they are stored in the kv store, so reading them requires
+// kms:Decrypt on the KMS key on top of the access to Vault. Each value is
+// encrypted with AES-256-GCM and a data key of its own, generated by KMS,
+// which is stored, encrypted by KMS, along with it. The values are
+// decrypted transparently when read through the operations, and the
+// ones stored unencrypted, e.g. before enabling it, are read as is.
+type KMSEnvelope struct {
+	// Client defaults to a KMS client with the User-Agent
+	// and endpoint URL of the operations
+	Client kmsiface.KMSAPI
+	// KeyID is the ID, ARN or alias of the KMS key
+	KeyID string
+}
+
+func (e *KMSEnvelope) client() kmsiface.KMSAPI {
+	if e.Client != nil {
+		return e.Client
+	}
+	return kms.New(newAWSSession())
+}
+
+// seal returns the value encrypted with a new data key. It
+// returns the value as is on a nil envelope.
+func (e *KMSEnvelope) seal(ctx context.Context, value string) (string, error) {
+	if e == nil {
+		return value, nil
+	}
+	key, err := e.client().GenerateDataKeyWithContext(ctx, &kms.GenerateDataKeyInput{
+		KeyId:   aws.String(e.KeyID),
+		KeySpec: aws.String(kms.DataKeySpecAes256),
+	})
+	if err != nil {
+		return "", fmt.Errorf("unable to generate a data key with KMS key '%s': %w", e.KeyID, err)
+	}
+	gcm, err := newGCM(key.Plaintext)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	enc := base64.StdEncoding
+	return envelopePrefix + enc.EncodeToString(key.CiphertextBlob) + ":" + enc.EncodeToString(nonce) + ":" +
+		enc.EncodeToString(gcm.Seal(nil, nonce, []byte(value), nil)), nil
+}
+
+// open returns the value sealed by seal, or the value as is if it
+// isn't sealed. The errors decrypting it match ErrDecryptionFailed.
+func (e *KMSEnvelope) open(ctx context.Context, value string) (string, error) {
+	if !strings.HasPrefix(value, envelopePrefix) {
+		return value, nil
+	}
+	if e == nil {
+		return "", &Error{Kind: ErrDecryptionFailed, Err: fmt.Errorf("the value is encrypted with KMS but no KMS key is configured")}
+	}
+	parts := strings.Split(strings.TrimPrefix(value, envelopePrefix), ":")
+	if len(parts) != 3 {
+		return "", &Error{Kind: ErrDecryptionFailed, Err: fmt.Errorf("malformed encrypted value")}
+	}
+	var decoded [3][]byte
+	for i, part := range parts {
+		b, err := base64.StdEncoding.DecodeString(part)
+		if err != nil {
+			return "", &Error{Kind: ErrDecryptionFailed, Err: fmt.Errorf("malformed encrypted value: %w", err)}
+		}
+		decoded[i] = b
+	}
+	wrapped, nonce, ciphertext := decoded[0], decoded[1], decoded[2]
+
+	key, err := e.client().DecryptWithContext(ctx, &kms.DecryptInput{CiphertextBlob: wrapped})
+	if err != nil {
+		return "", &Error{Kind: ErrDecryptionFailed, Err: fmt.Errorf("unable to decrypt the data key with KMS: %w", err)}
+	}
+	gcm, err := newGCM(key.Plaintext)
+	if err != nil {
+		return "", &Error{Kind: ErrDecryptionFailed, Err: err}
+	}
+	if len(nonce) != gcm.NonceSize() {
+		return "", &Error{Kind: ErrDecryptionFailed, Err: fmt.Errorf("malformed encrypted value: invalid nonce")}
+	}
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", &Error{Kind: ErrDecryptionFailed, Err: fmt.Errorf("the encrypted value has been tampered with or the data key is not its own")}
+	}
+	return string(plaintext), nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid data key: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
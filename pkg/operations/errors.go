@@ -0,0 +1,210 @@
+package operations
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/hashicorp/vault/api"
+)
+
+var (
+	// ErrVaultUnavailable is returned when the Vault server
+	// can't be reached or fails to process a request. Returned
+	// by GetCRL, UpdateCRL, RotateCRL, ListUsers and RevokeUser.
+	ErrVaultUnavailable = errors.New("vault unavailable")
+	// ErrEndpointNotFound is returned when the AWS Client VPN
+	// endpoint does not exist. Returned by UpdateCRL and RotateCRL.
+	ErrEndpointNotFound = errors.New("client vpn endpoint not found")
+	// ErrCRLTooLarge is returned when the CRL exceeds the maximum size
+	// that can be imported, see CRLTooLargeError. Returned by UpdateCRL
+	// and RotateCRL.
+	ErrCRLTooLarge = errors.New("crl too large")
+	// ErrUserNotFound is returned when the user does not
+	// have any certificate. Returned by RevokeUser and DescribeUser.
+	ErrUserNotFound = errors.New("user not found")
+	// ErrLocked is returned when another update of the CRL of the same
+	// endpoint is running. Returned by UpdateCRL and the operations
+	// that call it.
+	ErrLocked = errors.New("crl update already running")
+	// ErrCertLimitReached is returned when the user already has the maximum
+	// number of active certificates allowed, see CertLimitError. Returned
+	// by IssueClientCertificate.
+	ErrCertLimitReached = errors.New("certificate limit reached")
+	// ErrTooManyDeprovisions is returned when more users than allowed
+	// would be deprovisioned at once, see DeprovisionLimitError.
+	// Returned by DeprovisionUsers.
+	ErrTooManyDeprovisions = errors.New("too many users to deprovision")
+	// ErrRateLimited is returned when the rate limit of the caller or
+	// of the target user has been reached, see RateLimitError. Returned
+	// by IssueClientCertificate, SignCSR and RevokeUser.
+	ErrRateLimited = errors.New("rate limited")
+	// ErrCSRRejected is returned when the CSR can't be parsed or
+	// is not allowed by the CSRPolicy. Returned by SignCSR.
+	ErrCSRRejected = errors.New("csr rejected")
+	// ErrSuspiciousCRLShrink is returned when the new CRL has far fewer
+	// entries than the one active in the endpoint, see CRLShrinkError.
+	// Returned by UpdateCRL and the operations that call it.
+	ErrSuspiciousCRLShrink = errors.New("suspicious crl shrink")
+	// ErrInvalidCRL is returned when the CRL provided to
+	// RollbackCRL can't be parsed
+	ErrInvalidCRL = errors.New("invalid crl")
+	// ErrCRLMismatch is returned when the CRL regenerated by Vault doesn't
+	// list exactly the certificates revoked in Vault, see CRLMismatchError.
+	// Returned by RebuildCRL.
+	ErrCRLMismatch = errors.New("crl mismatch")
+	// ErrPartialRevocation is returned when the certificates of some of
+	// the users couldn't be revoked but the CRL was updated with the rest,
+	// see RevocationFailuresError
+	ErrPartialRevocation = errors.New("partial revocation")
+	// ErrInvalidUsername is returned when a certificate is requested
+	// for a username that doesn't follow the username rule
+	ErrInvalidUsername = errors.New("invalid username")
+	// ErrCRLSignatureInvalid is returned when the CRL about to be
+	// imported was not signed by the CA of the PKI, as can happen
+	// with a misconfigured Vault or the CRL of the wrong issuer
+	ErrCRLSignatureInvalid = errors.New("crl signature invalid")
+	// ErrUserDenied is returned when a certificate is requested for a
+	// user in the deny-list, see DeniedUserError
+	ErrUserDenied = errors.New("user denied")
+	// ErrNotInDirectory is returned when a certificate is requested for a
+	// user that is not found, or not active, in the identity provider
+	ErrNotInDirectory = errors.New("user not in directory")
+	// ErrDirectoryUnavailable is returned when the identity provider
+	// can't be reached or fails to check the user, so the user may
+	// well be allowed
+	ErrDirectoryUnavailable = errors.New("directory unavailable")
+	// ErrUserSuspended is returned when a certificate is requested for a
+	// suspended user, see UserSuspendedError
+	ErrUserSuspended = errors.New("user suspended")
+	// ErrUserNotSuspended is returned by ReinstateUser
+	// for a user that is not suspended
+	ErrUserNotSuspended = errors.New("user not suspended")
+	// ErrCertificateNotFound is returned by GetCertificate when there
+	// is no certificate with the serial number in the PKI, and by
+	// RevokeByFingerprint when none has the fingerprint
+	ErrCertificateNotFound = errors.New("certificate not found")
+	// ErrAmbiguousFingerprint is returned by RevokeByFingerprint when
+	// the abbreviated fingerprint matches several certificates
+	ErrAmbiguousFingerprint = errors.New("ambiguous fingerprint")
+	// ErrPermissionDenied is returned when the Vault token lacks the
+	// capabilities required by an operation, see CapabilitiesError
+	ErrPermissionDenied = errors.New("permission denied")
+	// ErrSANNotAllowed is returned by IssueClientCertificate when a
+	// subject alternative name is invalid or not allowed by the role,
+	// whether checked up front, see SANNotAllowedError, or by Vault
+	ErrSANNotAllowed = errors.New("san not allowed")
+	// ErrCRLHistoryNotFound is returned by GetCRLHistory, and by
+	// RollbackCRL, when the version is not in the CRL history
+	ErrCRLHistoryNotFound = errors.New("crl history version not found")
+	// ErrTimeout is returned when a Vault or AWS call, or a whole
+	// operation, doesn't complete in time, see TimeoutError
+	ErrTimeout = errors.New("timeout")
+	// ErrVaultCircuitOpen is returned, without calling Vault, while the
+	// circuit breaker of the Vault calls is open, see CircuitOpenError
+	ErrVaultCircuitOpen = errors.New("vault circuit open")
+	// ErrNotCertificateAuth is returned when the Client VPN endpoint
+	// doesn't use mutual certificate authentication, so it has no use
+	// for the CRL. Returned by UpdateCRL and the operations that call it.
+	ErrNotCertificateAuth = errors.New("endpoint without certificate authentication")
+	// ErrDecryptionFailed is returned when a private key, or a VPN config,
+	// encrypted with KMS can't be decrypted, see KMSEnvelope
+	ErrDecryptionFailed = errors.New("decryption failed")
+	// ErrInvalidBundle is returned by IssueClientCertificate when the
+	// issued certificate fails the checks of ValidateBundle, see
+	// InvalidBundleError
+	ErrInvalidBundle = errors.New("invalid bundle")
+	// ErrInvalidEmail is returned when the address the VPN config is
+	// emailed to, or the one set in the user's metadata, is not a
+	// single valid email address
+	ErrInvalidEmail = errors.New("invalid email")
+)
+
+// Error wraps an underlying error with the kind of failure, so
+// callers can use both errors.Is(err, ErrXXX) and errors.As to
+// get to the underlying Vault or AWS error
+type Error struct {
+	Kind error
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return e.Kind.Error() + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying error
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether the error is of the given kind
+func (e *Error) Is(target error) bool {
+	return e.Kind == target
+}
+
+// vaultError classifies an error returned by the Vault API. Network
+// and server side errors are reported as ErrVaultUnavailable, any other
+// error (permission denied, bad request, ...) is returned as is.
+func vaultError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var respErr *api.ResponseError
+	if errors.As(err, &respErr) && respErr.StatusCode < 500 {
+		return err
+	}
+	return &Error{Kind: ErrVaultUnavailable, Err: err}
+}
+
+// vaultRawError classifies an error of a raw request to the Vault API
+// as vaultError does, adding the request ID and the warnings of the
+// response to the message so the failure can be looked up in Vault's
+// audit log
+func vaultRawError(rsp *api.Response, err error) error {
+	if err == nil || rsp == nil || rsp.Response == nil {
+		return vaultError(err)
+	}
+
+	id := rsp.Header.Get("X-Vault-Request-Id")
+	warnings := rsp.Header["Warning"]
+	// The body of the error responses has already been read
+	// into memory by the Vault client, so it can be decoded
+	var respErr *api.ResponseError
+	if errors.As(err, &respErr) {
+		body := struct {
+			RequestID string   `json:"request_id"`
+			Warnings  []string `json:"warnings"`
+		}{}
+		if json.NewDecoder(rsp.Body).Decode(&body) == nil {
+			if id == "" {
+				id = body.RequestID
+			}
+			warnings = append(warnings, body.Warnings...)
+		}
+	}
+
+	var details []string
+	if id != "" {
+		details = append(details, "vault request id: "+id)
+	}
+	if len(warnings) > 0 {
+		details = append(details, "vault warnings: "+strings.Join(warnings, "; "))
+	}
+	if len(details) > 0 {
+		err = fmt.Errorf("%w (%s)", err, strings.Join(details, ", "))
+	}
+	return vaultError(err)
+}
+
+// awsError classifies an error returned by the EC2 API
+func awsError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if aerr, ok := err.(awserr.Error); ok && strings.HasPrefix(aerr.Code(), "InvalidClientVpnEndpointId") {
+		return &Error{Kind: ErrEndpointNotFound, Err: err}
+	}
+	return err
+}
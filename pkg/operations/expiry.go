@@ -0,0 +1,80 @@
+package operations
+
+import (
+	"time"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// DefaultExpiryWindow is the default window used to
+// consider that a certificate is about to expire
+const DefaultExpiryWindow = 30 * 24 * time.Hour
+
+// ListExpiringCertificatesRequest is the structure containing the
+// required data to look for certificates about to expire
+type ListExpiringCertificatesRequest struct {
+	Client       *api.Client
+	VaultPKIPath string
+	// Window is how far in the future to look for expiring
+	// certificates. Defaults to DefaultExpiryWindow.
+	Window time.Duration
+	// IssuerRef, if set, restricts the scan to the
+	// certificates issued by this issuer of the mount
+	IssuerRef string
+	// AdoptedKVPath, if set, is the kv store where the certificates
+	// adopted with Adopt are looked up, to group them under their users
+	AdoptedKVPath string
+}
+
+// ExpiryReport holds the active certificates that are about to expire
+type ExpiryReport struct {
+	// Expiring are the active certificates expiring
+	// within the window, grouped by user
+	Expiring map[string][]Certificate `json:"expiring"`
+	// SoonestExpiry is the expiry date of the active certificate
+	// that expires first for each user, whether it is within the
+	// window or not
+	SoonestExpiry map[string]time.Time `json:"soonest-expiry"`
+}
+
+// ListExpiringCertificates scans all the active (not revoked and not
+// expired) certificates and returns those that expire within the window
+func ListExpiringCertificates(r *ListExpiringCertificatesRequest) (*ExpiryReport, error) {
+
+	window := r.Window
+	if window == 0 {
+		window = DefaultExpiryWindow
+	}
+
+	adopted := map[string]string{}
+	if r.AdoptedKVPath != "" {
+		var err error
+		if adopted, err = loadAdopted(r.Client, r.AdoptedKVPath); err != nil {
+			return nil, err
+		}
+	}
+
+	report := &ExpiryReport{
+		Expiring:      map[string][]Certificate{},
+		SoonestExpiry: map[string]time.Time{},
+	}
+	now := time.Now()
+	err := walkCertificates(r.Client, r.VaultPKIPath, r.IssuerRef, func(crt Certificate) error {
+		if crt.Revoked || now.After(crt.NotAfter) {
+			return nil
+		}
+		username := certificateUsername(adopted, crt)
+		if soonest, ok := report.SoonestExpiry[username]; !ok || crt.NotAfter.Before(soonest) {
+			report.SoonestExpiry[username] = crt.NotAfter
+		}
+		if crt.NotAfter.Before(now.Add(window)) {
+			report.Expiring[username] = append(report.Expiring[username], crt)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return report, nil
+}
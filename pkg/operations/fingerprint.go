@@ -0,0 +1,160 @@
+package operations
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/logging"
+	"github.com/hashicorp/vault/api"
+)
+
+// MinFingerprintLength is the number of hex digits an abbreviated
+// fingerprint needs to have to be accepted by ParseFingerprint
+const MinFingerprintLength = 16
+
+// ParseFingerprint normalizes a SHA-256 fingerprint, either colon
+// separated, as shown by OpenSSL, or plain hex, optionally prefixed by
+// "sha256:", to lowercase hex without separators. It can be abbreviated
+// to its first MinFingerprintLength hex digits.
+func ParseFingerprint(fingerprint string) (string, error) {
+	fp := strings.ToLower(strings.TrimSpace(fingerprint))
+	fp = strings.TrimPrefix(strings.TrimPrefix(fp, "sha256:"), "sha256 fingerprint=")
+	fp = strings.NewReplacer(":", "", "-", "", " ", "").Replace(fp)
+	if _, err := hex.DecodeString(fp + strings.Repeat("0", len(fp)%2)); err != nil || len(fp) < MinFingerprintLength || len(fp) > 2*sha256.Size {
+		return "", fmt.Errorf("invalid fingerprint '%s', use the %d hex digits of the SHA-256 fingerprint, optionally separated by colons, or at least the first %d",
+			fingerprint, 2*sha256.Size, MinFingerprintLength)
+	}
+	return fp, nil
+}
+
+// certificateFingerprint returns the SHA-256 fingerprint
+// of the PEM encoded certificate, as lowercase hex
+func certificateFingerprint(crt string) (string, error) {
+	block, _ := pem.Decode([]byte(crt))
+	if block == nil {
+		return "", fmt.Errorf("failed to parse certificate PEM")
+	}
+	sum := sha256.Sum256(block.Bytes)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// RevokeByFingerprintRequest is the structure containing the required
+// data to revoke a certificate given its fingerprint
+type RevokeByFingerprintRequest struct {
+	Client              *api.Client
+	VaultPKIPath        string
+	ClientVPNEndpointID string
+	// Reason, if set, is recorded for the revoked certificate
+	// in the kv store under VaultKVPath
+	Reason      RevocationReason
+	VaultKVPath string
+	UpdateCRLOptions
+}
+
+// RevokeByFingerprintResult holds the outcome of a RevokeByFingerprint operation
+type RevokeByFingerprintResult struct {
+	// Fingerprint is the full fingerprint of the certificate
+	Fingerprint  string
+	SerialNumber string
+	Username     string
+	// AlreadyRevoked is set if the certificate was revoked
+	// before, in which case nothing else is done
+	AlreadyRevoked bool
+	// UpdateCRLResult is the outcome of the CRL update that follows
+	// the revocation. Nil if the certificate was already revoked or
+	// the update failed before producing one.
+	*UpdateCRLResult
+}
+
+// RevokeByFingerprint revokes the certificate with the SHA-256 fingerprint,
+// in any of the forms accepted by ParseFingerprint, e.g. one taken from
+// the certificate on a client machine without its serial number, and then
+// updates the CRL. The other certificates of its user are left as is. It
+// returns ErrCertificateNotFound if none of the client certificates of the
+// PKI has the fingerprint, and ErrAmbiguousFingerprint if the abbreviated
+// fingerprint matches several of them, without revoking any.
+func RevokeByFingerprint(r *RevokeByFingerprintRequest, fingerprint string) (*RevokeByFingerprintResult, error) {
+	start := time.Now()
+	res, err := revokeByFingerprint(r, fingerprint)
+	observe("revoke_by_fingerprint", start, err)
+	return res, err
+}
+
+func revokeByFingerprint(r *RevokeByFingerprintRequest, fingerprint string) (*RevokeByFingerprintResult, error) {
+	fp, err := ParseFingerprint(fingerprint)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkCapabilities(r.Client, r.UpdateCRLOptions, revokeCapabilities(r.VaultPKIPath)...); err != nil {
+		return nil, err
+	}
+
+	crts, err := ListCertificates(
+		&ListCertificatesRequest{
+			Client:       r.Client,
+			VaultPKIPath: r.VaultPKIPath,
+			IssuerRef:    r.IssuerRef,
+		})
+	if err != nil {
+		return nil, err
+	}
+	var matches []Certificate
+	var fingerprints []string
+	for _, crt := range crts {
+		crtFP, err := certificateFingerprint(crt.CertificatePEM)
+		if err != nil {
+			return nil, fmt.Errorf("unable to get the fingerprint of certificate '%s': %w", crt.SerialNumber, err)
+		}
+		if strings.HasPrefix(crtFP, fp) {
+			matches = append(matches, crt)
+			fingerprints = append(fingerprints, crtFP)
+		}
+	}
+	switch {
+	case len(matches) == 0:
+		return nil, &Error{Kind: ErrCertificateNotFound, Err: fmt.Errorf("no certificate with fingerprint '%s' in %s", fp, r.VaultPKIPath)}
+	case len(matches) > 1:
+		var serials []string
+		for _, crt := range matches {
+			serials = append(serials, crt.SerialNumber)
+		}
+		return nil, &Error{Kind: ErrAmbiguousFingerprint,
+			Err: fmt.Errorf("fingerprint '%s' matches the certificates %s, use more digits of it", fp, strings.Join(serials, ", "))}
+	}
+
+	crt := matches[0]
+	result := &RevokeByFingerprintResult{
+		Fingerprint:    fingerprints[0],
+		SerialNumber:   crt.SerialNumber,
+		Username:       usernameFromCN(crt.SubjectCN),
+		AlreadyRevoked: crt.Revoked,
+	}
+	logger := logging.OrDefault(r.Logger).With("endpoint_id", r.ClientVPNEndpointID, "pki_path", r.VaultPKIPath)
+	if crt.Revoked {
+		logger.Info("certificate with the fingerprint already revoked", "user", result.Username, "serial", crt.SerialNumber, "fingerprint", result.Fingerprint)
+		return result, nil
+	}
+
+	_, err = revokeUserCertificates(r.Client, r.VaultPKIPath, []Certificate{crt},
+		revocationOptions{revokeAll: true, reason: r.Reason, kvPath: r.VaultKVPath, logger: r.Logger,
+			retry: r.Retry, ctx: r.Context, audit: r.Audit, usersCache: r.UsersCache, configStore: r.ConfigStore, actor: r.Actor, endpointID: r.ClientVPNEndpointID})
+	if err != nil {
+		return nil, err
+	}
+
+	result.UpdateCRLResult, err = UpdateCRL(
+		&UpdateCRLRequest{
+			Client:              r.Client,
+			VaultPKIPath:        r.VaultPKIPath,
+			ClientVPNEndpointID: r.ClientVPNEndpointID,
+			UpdateCRLOptions:    r.UpdateCRLOptions,
+		})
+	if err != nil {
+		return result, err
+	}
+	return result, nil
+}
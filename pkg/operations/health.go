@@ -0,0 +1,116 @@
+package operations
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// DefaultHealthCheckTimeout is the default timeout of each readiness check
+const DefaultHealthCheckTimeout = 5 * time.Second
+
+// HealthCheck is the outcome of the check of one of the dependencies
+type HealthCheck struct {
+	// Status is either "ok" or "ko"
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// ReadinessRequest is the structure containing the
+// required data to check the dependencies of ACPM
+type ReadinessRequest struct {
+	Client              *api.Client
+	VaultPKIPath        string
+	ClientVPNEndpointID string
+	// Timeout of each of the checks. Defaults to DefaultHealthCheckTimeout.
+	Timeout time.Duration
+}
+
+// CheckReadiness checks, concurrently, that Vault is unsealed and the
+// token is valid, that the PKI mount is reachable and that the Client VPN
+// endpoint can be described. The vault-circuit check fails while the circuit
+// breaker of the Vault calls is open, see SetVaultCircuitBreaker. The result
+// of each check is returned keyed by name, along with whether all of them
+// passed.
+func CheckReadiness(r *ReadinessRequest) (map[string]HealthCheck, bool) {
+	timeout := r.Timeout
+	if timeout == 0 {
+		timeout = DefaultHealthCheckTimeout
+	}
+
+	checks := map[string]func(ctx context.Context) error{
+		"vault-circuit": func(ctx context.Context) error {
+			if status := VaultCircuit(); status.State == CircuitOpen {
+				return &CircuitOpenError{Failures: status.ConsecutiveFailures, Until: status.OpenUntil}
+			}
+			return nil
+		},
+		"vault-unsealed": func(ctx context.Context) error {
+			var status api.SealStatusResponse
+			if err := vaultGetJSON(ctx, r.Client, "/v1/sys/seal-status", &status); err != nil {
+				return err
+			}
+			if status.Sealed {
+				return fmt.Errorf("vault is sealed")
+			}
+			return nil
+		},
+		"vault-token": func(ctx context.Context) error {
+			return vaultGetJSON(ctx, r.Client, "/v1/auth/token/lookup-self", nil)
+		},
+		"vault-pki": func(ctx context.Context) error {
+			return vaultGetJSON(ctx, r.Client, fmt.Sprintf("/v1/%s/ca/pem", r.VaultPKIPath), nil)
+		},
+		"aws-client-vpn-endpoint": func(ctx context.Context) error {
+			ep, err := describeEndpoint(ctx, r.ClientVPNEndpointID, nil)
+			if err != nil {
+				return err
+			}
+			return checkCertificateAuth(ep)
+		},
+	}
+
+	result := map[string]HealthCheck{}
+	ready := true
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range checks {
+		wg.Add(1)
+		go func(name string, check func(ctx context.Context) error) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			hc := HealthCheck{Status: "ok"}
+			if err := check(ctx); err != nil {
+				hc = HealthCheck{Status: "ko", Error: err.Error()}
+			}
+			mu.Lock()
+			result[name] = hc
+			if hc.Status != "ok" {
+				ready = false
+			}
+			mu.Unlock()
+		}(name, check)
+	}
+	wg.Wait()
+
+	return result, ready
+}
+
+// vaultGetJSON does a GET to the Vault API and, if v is not
+// nil, decodes the json response into it
+func vaultGetJSON(ctx context.Context, client *api.Client, path string, v interface{}) error {
+	rsp, err := client.RawRequestWithContext(ctx, client.NewRequest("GET", path))
+	if err != nil {
+		return vaultError(err)
+	}
+	defer rsp.Body.Close()
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(rsp.Body).Decode(v)
+}
@@ -0,0 +1,160 @@
+package operations
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// DefaultCRLHistoryVersions is the number of CRLs kept in the history
+const DefaultCRLHistoryVersions = 100
+
+// CRLHistoryEntry is a CRL imported in the endpoint, as kept in the
+// history when UpdateCRLOptions' CRLHistoryKVPath is set
+type CRLHistoryEntry struct {
+	// Version is the version of the history secret holding the entry
+	Version    int       `json:"version"`
+	ImportedAt time.Time `json:"imported_at"`
+	EndpointID string    `json:"endpoint_id"`
+	// RevokedCount is the number of entries of the CRL
+	RevokedCount int `json:"revoked_count"`
+	// Actor is who triggered the import, see UpdateCRLOptions
+	Actor string `json:"actor,omitempty"`
+	// CRL is PEM encoded. It is left out by ListCRLHistory.
+	CRL string `json:"crl,omitempty"`
+}
+
+// historyPath is the secret whose versions are the CRLs of the endpoint
+func historyPath(kv, sub, endpointID string) string {
+	return fmt.Sprintf("%s/%s/crl-history/%s", kv, sub, endpointID)
+}
+
+// historyRetention caches the retention already set for each history
+var historyRetention sync.Map
+
+// recordCRLHistory writes the CRL just imported in the endpoint as a new
+// version of the history secret, which keeps the last versions of it
+func recordCRLHistory(client *api.Client, opts UpdateCRLOptions, endpointID string, crl []byte) error {
+	if opts.CRLHistoryKVPath == "" {
+		return nil
+	}
+	if err := checkKVv2(client, opts.CRLHistoryKVPath); err != nil {
+		return err
+	}
+	versions := opts.CRLHistoryVersions
+	if versions <= 0 {
+		versions = DefaultCRLHistoryVersions
+	}
+	metadataPath := historyPath(opts.CRLHistoryKVPath, "metadata", endpointID)
+	if v, ok := historyRetention.Load(metadataPath); !ok || v.(int) != versions {
+		if _, err := client.Logical().Write(metadataPath, map[string]interface{}{"max_versions": versions}); err != nil {
+			return vaultError(err)
+		}
+		historyRetention.Store(metadataPath, versions)
+	}
+
+	entries, err := crlEntries(crl)
+	if err != nil {
+		return err
+	}
+	_, err = client.Logical().Write(historyPath(opts.CRLHistoryKVPath, "data", endpointID), map[string]interface{}{
+		"data": map[string]interface{}{
+			"imported_at":   time.Now().UTC().Format(time.RFC3339),
+			"endpoint_id":   endpointID,
+			"revoked_count": len(entries),
+			"actor":         opts.Actor,
+			"crl":           string(crl),
+		},
+	})
+	return vaultError(err)
+}
+
+// CRLHistoryRequest is the structure containing the
+// required data to read the CRL history of an endpoint
+type CRLHistoryRequest struct {
+	Client              *api.Client
+	VaultKVPath         string
+	ClientVPNEndpointID string
+}
+
+// ListCRLHistory returns the CRLs kept in the history of the endpoint,
+// newest first, without the CRLs themselves, see GetCRLHistory. The
+// versions deleted from the kv store are left out.
+func ListCRLHistory(r *CRLHistoryRequest) ([]CRLHistoryEntry, error) {
+	if err := checkKVv2(r.Client, r.VaultKVPath); err != nil {
+		return nil, err
+	}
+	secret, err := r.Client.Logical().Read(historyPath(r.VaultKVPath, "metadata", r.ClientVPNEndpointID))
+	if err != nil {
+		return nil, vaultError(err)
+	}
+	list := []CRLHistoryEntry{}
+	if secret == nil {
+		return list, nil
+	}
+
+	versions, _ := secret.Data["versions"].(map[string]interface{})
+	var live []int
+	for v, md := range versions {
+		md, _ := md.(map[string]interface{})
+		if md["destroyed"] == true || (md["deletion_time"] != nil && md["deletion_time"] != "") {
+			continue
+		}
+		if n, err := strconv.Atoi(v); err == nil {
+			live = append(live, n)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(live)))
+	for _, v := range live {
+		entry, err := GetCRLHistory(r, v)
+		if err != nil {
+			return nil, err
+		}
+		entry.CRL = ""
+		list = append(list, *entry)
+	}
+	return list, nil
+}
+
+// GetCRLHistory returns the given version of the CRL history of the
+// endpoint, or the latest one if 0. Returns ErrCRLHistoryNotFound if
+// there is no such version.
+func GetCRLHistory(r *CRLHistoryRequest, version int) (*CRLHistoryEntry, error) {
+	if err := checkKVv2(r.Client, r.VaultKVPath); err != nil {
+		return nil, err
+	}
+	var params map[string][]string
+	if version > 0 {
+		params = map[string][]string{"version": {strconv.Itoa(version)}}
+	}
+	secret, err := r.Client.Logical().ReadWithData(historyPath(r.VaultKVPath, "data", r.ClientVPNEndpointID), params)
+	if err != nil {
+		return nil, vaultError(err)
+	}
+	if secret == nil || secret.Data["data"] == nil {
+		return nil, &Error{Kind: ErrCRLHistoryNotFound, Err: fmt.Errorf("no version %d in the CRL history of endpoint %s", version, r.ClientVPNEndpointID)}
+	}
+
+	// Round trip through json to decode the generic map
+	// returned by Vault into the entry struct
+	raw, err := json.Marshal(secret.Data["data"])
+	if err != nil {
+		return nil, err
+	}
+	entry := &CRLHistoryEntry{}
+	if err := json.Unmarshal(raw, entry); err != nil {
+		return nil, fmt.Errorf("unexpected format of version %d of the CRL history of endpoint %s", version, r.ClientVPNEndpointID)
+	}
+	if md, ok := secret.Data["metadata"].(map[string]interface{}); ok {
+		if v, ok := md["version"].(json.Number); ok {
+			version, _ := v.Int64()
+			entry.Version = int(version)
+		}
+	}
+	return entry, nil
+}
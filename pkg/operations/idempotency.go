@@ -0,0 +1,79 @@
+package operations
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultIdempotencyWindow is the default time during which the
+// result of an issuance is returned for retries with the same key
+const DefaultIdempotencyWindow = 10 * time.Minute
+
+// IdempotencyCache keeps, in memory, the results of the issuances made
+// with an idempotency key so that retried requests get the original
+// certificate instead of a new one. The zero value is ready to use.
+type IdempotencyCache struct {
+	// Window is how long the results are kept. Defaults to DefaultIdempotencyWindow.
+	Window time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*idempotencyEntry
+}
+
+type idempotencyEntry struct {
+	// done is closed once the issuance finishes
+	done    chan struct{}
+	result  *IssueCertificateResult
+	expires time.Time
+}
+
+// do runs fn once per key within the window. Concurrent calls with the
+// same key wait for the first one to finish and get its result. Failed
+// issuances are not cached, so they can be retried.
+func (c *IdempotencyCache) do(key string, fn func() (*IssueCertificateResult, error)) (*IssueCertificateResult, error) {
+	window := c.Window
+	if window == 0 {
+		window = DefaultIdempotencyWindow
+	}
+
+	c.mu.Lock()
+	if c.entries == nil {
+		c.entries = map[string]*idempotencyEntry{}
+	}
+	now := time.Now()
+	for k, e := range c.entries {
+		if e.result != nil && now.After(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+
+	if e, ok := c.entries[key]; ok {
+		c.mu.Unlock()
+		<-e.done
+		if e.result != nil {
+			replay := *e.result
+			replay.Replayed = true
+			return &replay, nil
+		}
+		// The first attempt failed, try again
+		return c.do(key, fn)
+	}
+
+	e := &idempotencyEntry{done: make(chan struct{})}
+	c.entries[key] = e
+	c.mu.Unlock()
+
+	result, err := fn()
+
+	c.mu.Lock()
+	if err != nil {
+		delete(c.entries, key)
+	} else {
+		e.result = result
+		e.expires = time.Now().Add(window)
+	}
+	c.mu.Unlock()
+	close(e.done)
+
+	return result, err
+}
@@ -0,0 +1,108 @@
+package operations
+
+import (
+	"sync"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// CertificateIndex keeps, in memory, the certificates read from Vault,
+// keyed by PKI path and serial number, so listing them again only reads
+// the ones issued since. Vault never changes a stored certificate, and
+// their revocation status is still taken from the current CRL on each
+// listing. The certificates deleted from Vault, e.g. by a tidy, are
+// dropped from the index on the next listing. The zero value is ready
+// to use and safe for concurrent use.
+type CertificateIndex struct {
+	mu    sync.RWMutex
+	paths map[string]map[string]*indexedCertificate
+}
+
+// indexedCertificate holds the attributes of a certificate
+// parsed by readCertificate
+type indexedCertificate struct {
+	// client is false for the CA and server
+	// certificates, which are not listed
+	client    bool
+	rawIssuer []byte
+	crt       Certificate
+}
+
+// lookup returns the indexed certificate stored under the key of the
+// PKI. It always misses on a nil index.
+func (idx *CertificateIndex) lookup(pki, key string) (*indexedCertificate, bool) {
+	if idx == nil {
+		return nil, false
+	}
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	entry, ok := idx.paths[pki][key]
+	return entry, ok
+}
+
+func (idx *CertificateIndex) store(pki, key string, entry *indexedCertificate) {
+	if idx == nil {
+		return
+	}
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if idx.paths == nil {
+		idx.paths = map[string]map[string]*indexedCertificate{}
+	}
+	if idx.paths[pki] == nil {
+		idx.paths[pki] = map[string]*indexedCertificate{}
+	}
+	idx.paths[pki][key] = entry
+}
+
+// prune drops the certificates of the PKI that are no longer listed
+func (idx *CertificateIndex) prune(pki string, listed map[string]bool) {
+	if idx == nil {
+		return
+	}
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	for key := range idx.paths[pki] {
+		if !listed[key] {
+			delete(idx.paths[pki], key)
+		}
+	}
+}
+
+// Len returns the number of certificates of the PKI in the index,
+// the CA and server certificates included
+func (idx *CertificateIndex) Len(pki string) int {
+	if idx == nil {
+		return 0
+	}
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	return len(idx.paths[pki])
+}
+
+// RebuildCertificateIndexRequest is the structure containing the
+// required data to rebuild the index of the certificates of a PKI
+type RebuildCertificateIndexRequest struct {
+	Client       *api.Client
+	VaultPKIPath string
+	Index        *CertificateIndex
+}
+
+// RebuildCertificateIndex drops the certificates of the PKI from the
+// index and reads all of them from Vault again, e.g. after restoring
+// Vault from a backup. It returns the number of certificates indexed.
+func RebuildCertificateIndex(r *RebuildCertificateIndexRequest) (int, error) {
+	start := time.Now()
+	if r.Index != nil {
+		r.Index.mu.Lock()
+		delete(r.Index.paths, r.VaultPKIPath)
+		r.Index.mu.Unlock()
+	}
+	err := walkCertificatesWith(r.Client, r.VaultPKIPath, "", walkOptions{index: r.Index}, func(Certificate) error { return nil })
+	observe("rebuild_certificate_index", start, err)
+	if err != nil {
+		return 0, err
+	}
+	return r.Index.Len(r.VaultPKIPath), nil
+}
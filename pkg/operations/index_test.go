@@ -0,0 +1,189 @@
+package operations
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// fakePKI serves the listing and the reads of the certificates of a PKI
+// mount, and an empty CRL. It counts the certificates read.
+type fakePKI struct {
+	client *api.Client
+	ca     *x509.Certificate
+	key    *ecdsa.PrivateKey
+
+	sync.Mutex
+	serial int64
+	certs  map[string]string
+	reads  int
+}
+
+func newFakePKI(tb testing.TB) *fakePKI {
+	tb.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	p := &fakePKI{key: key, serial: 1, certs: map[string]string{}}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(p.serial),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	p.ca, _ = x509.ParseCertificate(der)
+	p.certs[getHexFormatted(p.ca.SerialNumber.Bytes(), "-")] = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+
+	srv := httptest.NewServer(http.HandlerFunc(p.serve))
+	tb.Cleanup(srv.Close)
+	cfg := api.DefaultConfig()
+	cfg.Address = srv.URL
+	p.client, err = api.NewClient(cfg)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return p
+}
+
+// add issues n client certificates for the CN, all with the key of the CA
+func (p *fakePKI) add(tb testing.TB, cn string, n int) {
+	tb.Helper()
+	p.Lock()
+	defer p.Unlock()
+	for i := 0; i < n; i++ {
+		p.serial++
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(p.serial<<16 + 0x1234),
+			Subject:      pkix.Name{CommonName: cn},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(24 * time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, p.ca, &p.key.PublicKey, p.key)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		p.certs[getHexFormatted(tmpl.SerialNumber.Bytes(), "-")] = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	}
+}
+
+func (p *fakePKI) serve(w http.ResponseWriter, r *http.Request) {
+	p.Lock()
+	defer p.Unlock()
+	path := strings.TrimPrefix(r.URL.Path, "/v1/pki/")
+	w.Header().Set("Content-Type", "application/json")
+	switch {
+	case path == "crl/pem":
+		w.Header().Set("Content-Type", "application/x-pem-file")
+	case path == "certs":
+		keys := make([]string, 0, len(p.certs))
+		for k := range p.certs {
+			keys = append(keys, k)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{"keys": keys}})
+	case strings.HasPrefix(path, "cert/"):
+		crt, ok := p.certs[strings.TrimPrefix(path, "cert/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errors":[]}`))
+			return
+		}
+		p.reads++
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{"certificate": crt}})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"errors":[]}`))
+	}
+}
+
+func (p *fakePKI) readCount() int {
+	p.Lock()
+	defer p.Unlock()
+	return p.reads
+}
+
+func TestListUsersIndexReadsOnlyNewSerials(t *testing.T) {
+	p := newFakePKI(t)
+	p.add(t, "alice", 20)
+	idx := &CertificateIndex{}
+	list := func() map[string][]Certificate {
+		t.Helper()
+		users, err := ListUsers(&ListUsersRequest{Client: p.client, VaultPKIPath: "pki", Index: idx})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return users
+	}
+
+	if users := list(); len(users["alice"]) != 20 {
+		t.Fatalf("got %d certificates of alice, want 20", len(users["alice"]))
+	}
+	// The CA is read, and indexed, too
+	if reads := p.readCount(); reads != 21 {
+		t.Errorf("got %d certificates read on the first listing, want all 21", reads)
+	}
+
+	p.add(t, "bob", 3)
+	users := list()
+	if len(users["alice"]) != 20 || len(users["bob"]) != 3 {
+		t.Errorf("got %d certificates of alice and %d of bob, want 20 and 3", len(users["alice"]), len(users["bob"]))
+	}
+	if reads := p.readCount() - 21; reads != 3 {
+		t.Errorf("got %d certificates read on the second listing, want only the 3 new ones", reads)
+	}
+	if idx.Len("pki") != 24 {
+		t.Errorf("got %d certificates in the index, want 24", idx.Len("pki"))
+	}
+}
+
+// benchmarkListUsers lists the users of a PKI of 10k certificates, with
+// a new index on each run if cold, or with the one of the previous run
+func benchmarkListUsers(b *testing.B, cold bool) {
+	p := newFakePKI(b)
+	for i := 0; i < 100; i++ {
+		p.add(b, fmt.Sprintf("user-%d", i), 100)
+	}
+	idx := &CertificateIndex{}
+	if !cold {
+		if _, err := ListUsers(&ListUsersRequest{Client: p.client, VaultPKIPath: "pki", Index: idx}); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if cold {
+			idx = &CertificateIndex{}
+		}
+		if _, err := ListUsers(&ListUsersRequest{Client: p.client, VaultPKIPath: "pki", Index: idx}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkListUsersCold(b *testing.B) { benchmarkListUsers(b, true) }
+
+func BenchmarkListUsersWarm(b *testing.B) { benchmarkListUsers(b, false) }
@@ -0,0 +1,132 @@
+package operations
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/logging"
+	"github.com/hashicorp/vault/api"
+)
+
+// RotateIntermediateRequest is the structure containing the
+// required data to rotate the intermediate CA of a PKI mount
+type RotateIntermediateRequest struct {
+	Client *api.Client
+	// VaultPKIPath is the mount of the intermediate CA to rotate
+	VaultPKIPath string
+	// VaultRootPKIPath is the mount of the CA that signs the new intermediate
+	VaultRootPKIPath string
+	// CommonName of the new intermediate. Defaults to the
+	// common name of the current intermediate of the mount.
+	CommonName string
+	// TTL of the new intermediate. Defaults to the max ttl of the root mount.
+	TTL    time.Duration
+	Logger logging.Logger
+}
+
+// RotateIntermediateResult holds the outcome of a RotateIntermediate operation
+type RotateIntermediateResult struct {
+	// Certificate is the PEM encoded new intermediate
+	Certificate  string
+	SerialNumber string
+	NotAfter     time.Time
+	// CAChain are the PEM encoded certificates from the new
+	// intermediate up to the root, to update the trust of the endpoint
+	CAChain []string
+}
+
+// RotateIntermediate replaces the intermediate CA of the mount: a new key
+// and CSR are generated in the mount, the CSR is signed by the root mount
+// and the signed certificate is set as the intermediate of the mount, so
+// the certificates issued from then on are signed by the new intermediate.
+// The certificates already issued remain valid under the old intermediate
+// until they expire, as long as it is still trusted by the endpoint.
+func RotateIntermediate(r *RotateIntermediateRequest) (*RotateIntermediateResult, error) {
+	start := time.Now()
+	res, err := rotateIntermediate(r)
+	observe("rotate_intermediate", start, err)
+	return res, err
+}
+
+func rotateIntermediate(r *RotateIntermediateRequest) (*RotateIntermediateResult, error) {
+	logger := logging.OrDefault(r.Logger).With("pki_path", r.VaultPKIPath, "root_pki_path", r.VaultRootPKIPath)
+	if r.VaultRootPKIPath == "" || r.VaultRootPKIPath == r.VaultPKIPath {
+		return nil, errors.New("the root PKI path must be set and differ from the intermediate one")
+	}
+
+	cn := r.CommonName
+	if cn == "" {
+		chain, err := GetCAChain(&GetCAChainRequest{Client: r.Client, VaultPKIPaths: []string{r.VaultPKIPath}})
+		if err != nil {
+			return nil, vaultError(err)
+		}
+		current, err := parseCertificatePEM(chain[0])
+		if err != nil {
+			return nil, fmt.Errorf("unable to read the current intermediate of %s: %s", r.VaultPKIPath, err)
+		}
+		cn = current.Subject.CommonName
+	}
+
+	secret, err := r.Client.Logical().Write(
+		fmt.Sprintf("%s/intermediate/generate/internal", r.VaultPKIPath),
+		map[string]interface{}{"common_name": cn})
+	if err != nil {
+		return nil, vaultError(err)
+	}
+	var csr string
+	if secret != nil {
+		csr, _ = secret.Data["csr"].(string)
+	}
+	if csr == "" {
+		return nil, fmt.Errorf("no CSR generated by %s/intermediate/generate/internal", r.VaultPKIPath)
+	}
+
+	payload := map[string]interface{}{
+		"csr":         csr,
+		"common_name": cn,
+	}
+	if r.TTL > 0 {
+		payload["ttl"] = r.TTL.String()
+	}
+	secret, err = r.Client.Logical().Write(fmt.Sprintf("%s/root/sign-intermediate", r.VaultRootPKIPath), payload)
+	if err != nil {
+		return nil, vaultError(err)
+	}
+	if secret == nil {
+		return nil, fmt.Errorf("no certificate returned by %s/root/sign-intermediate", r.VaultRootPKIPath)
+	}
+	crtPEM, ok := secret.Data["certificate"].(string)
+	if !ok {
+		return nil, fmt.Errorf("no certificate returned by %s/root/sign-intermediate", r.VaultRootPKIPath)
+	}
+	issuingCA, _ := secret.Data["issuing_ca"].(string)
+	serial, _ := secret.Data["serial_number"].(string)
+	crt, err := parseCertificatePEM(crtPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	// The issuing CA goes along with the certificate, so the mount serves the full chain
+	bundle := crtPEM
+	if issuingCA != "" {
+		bundle += "\n" + issuingCA
+	}
+	if _, err := r.Client.Logical().Write(
+		fmt.Sprintf("%s/intermediate/set-signed", r.VaultPKIPath),
+		map[string]interface{}{"certificate": bundle}); err != nil {
+		return nil, vaultError(err)
+	}
+
+	result := &RotateIntermediateResult{
+		Certificate:  crtPEM,
+		SerialNumber: serial,
+		NotAfter:     crt.NotAfter,
+		CAChain:      []string{crtPEM},
+	}
+	if issuingCA != "" {
+		result.CAChain = append(result.CAChain, issuingCA)
+	}
+	logger.Info("rotated the intermediate CA", "common_name", cn, "serial", result.SerialNumber, "not_after", crt.NotAfter.Format(time.RFC3339))
+	return result, nil
+}
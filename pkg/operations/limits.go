@@ -0,0 +1,76 @@
+package operations
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// CertLimitError is returned when issuing a certificate would exceed
+// the maximum number of active certificates allowed per user
+type CertLimitError struct {
+	Username string
+	Count    int
+	Limit    int
+}
+
+// Unwrap allows matching the error with errors.Is(err, ErrCertLimitReached)
+func (e *CertLimitError) Unwrap() error {
+	return ErrCertLimitReached
+}
+
+func (e *CertLimitError) Error() string {
+	return fmt.Sprintf("user '%s' already has %d active certificates, the maximum allowed is %d", e.Username, e.Count, e.Limit)
+}
+
+// activeCertificates returns the certificates that are neither
+// revoked nor expired, sorted by emission date as in ListUsers
+func activeCertificates(crts []Certificate) []Certificate {
+	var active []Certificate
+	now := time.Now()
+	for _, crt := range crts {
+		if !crt.Revoked && crt.NotAfter.After(now) {
+			active = append(active, crt)
+		}
+	}
+	return active
+}
+
+// enforceCertLimit checks that the user has room for one more active
+// certificate. If revokeOldest is set, the oldest active certificates
+// are revoked to make room instead of returning a *CertLimitError.
+// The users are listed, with the certificates adopted in the
+// AdoptedKVPath of the options, unless already given.
+func enforceCertLimit(client *api.Client, pki, issuerRef, endpointID, username string, users map[string][]Certificate, limit int, revokeOldest bool, kvPath string, opts UpdateCRLOptions) error {
+	if users == nil {
+		var err error
+		users, err = ListUsers(
+			&ListUsersRequest{
+				Client:              client,
+				VaultPKIPath:        pki,
+				ClientVPNEndpointID: endpointID,
+				IssuerRef:           issuerRef,
+				AdoptedKVPath:       opts.AdoptedKVPath,
+				Context:             opts.Context,
+				Retry:               opts.Retry,
+				Logger:              opts.Logger,
+			})
+		if err != nil {
+			return err
+		}
+	}
+
+	active := activeCertificates(users[username])
+	if len(active) < limit {
+		return nil
+	}
+	if !revokeOldest {
+		return &CertLimitError{Username: username, Count: len(active), Limit: limit}
+	}
+
+	_, err := revokeUserCertificates(client, pki, active[:len(active)-limit+1],
+		revocationOptions{revokeAll: true, reason: ReasonSuperseded, kvPath: kvPath, logger: opts.Logger,
+			retry: opts.Retry, ctx: opts.Context, audit: opts.Audit, usersCache: opts.UsersCache, configStore: opts.ConfigStore, actor: opts.Actor, endpointID: endpointID})
+	return err
+}
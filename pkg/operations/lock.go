@@ -0,0 +1,224 @@
+package operations
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/logging"
+	"github.com/hashicorp/vault/api"
+)
+
+const (
+	// DefaultLockTimeout is how long an update of the CRL waits
+	// for a running one on the same endpoint to finish
+	DefaultLockTimeout = 5 * time.Minute
+	// vaultLockTTL is the time after which a lock in the kv store that
+	// wasn't renewed is considered stale, so a crashed instance doesn't
+	// hold it forever
+	vaultLockTTL = 10 * time.Minute
+	// vaultLockPollInterval is how often a held lock in the kv store is retried
+	vaultLockPollInterval = time.Second
+)
+
+// vaultLockRenewInterval is how often a lock in the kv store is renewed
+// while held, so it doesn't expire during a long update of the CRL
+var vaultLockRenewInterval = vaultLockTTL / 4
+
+// endpointLocks holds one semaphore per endpoint ID
+var endpointLocks = struct {
+	sync.Mutex
+	m map[string]chan struct{}
+}{m: map[string]chan struct{}{}}
+
+func endpointSemaphore(endpointID string) chan struct{} {
+	endpointLocks.Lock()
+	defer endpointLocks.Unlock()
+	sem, ok := endpointLocks.m[endpointID]
+	if !ok {
+		sem = make(chan struct{}, 1)
+		endpointLocks.m[endpointID] = sem
+	}
+	return sem
+}
+
+// lockEndpoint serializes the CRL updates of an endpoint within the process
+// and, if opts.VaultLockKVPath is set, across all the processes sharing the
+// Vault kv store. The returned func releases the lock.
+func lockEndpoint(client *api.Client, endpointID string, opts UpdateCRLOptions) (func(), error) {
+	locked := &Error{Kind: ErrLocked, Err: fmt.Errorf("a CRL update of endpoint %s is already running", endpointID)}
+
+	sem := endpointSemaphore(endpointID)
+	if opts.LockFailFast {
+		select {
+		case sem <- struct{}{}:
+		default:
+			return nil, locked
+		}
+	} else {
+		select {
+		case sem <- struct{}{}:
+		case <-time.After(DefaultLockTimeout):
+			return nil, locked
+		}
+	}
+
+	if opts.VaultLockKVPath == "" {
+		return func() { <-sem }, nil
+	}
+
+	release, err := vaultLock(client, opts.VaultLockKVPath, endpointID, opts.LockFailFast, logging.OrDefault(opts.Logger))
+	if err != nil {
+		<-sem
+		return nil, err
+	}
+	return func() {
+		release()
+		<-sem
+	}, nil
+}
+
+// vaultLock acquires an advisory lock stored in the kv (v2) store. All the
+// writes of the lock are check-and-set on its version, so only one writer
+// can succeed: it is created if missing or taken over once expired, then
+// renewed while held and released by expiring it. An instance thus never
+// overwrites a lock another one holds.
+func vaultLock(client *api.Client, kv, endpointID string, failFast bool, logger logging.Logger) (func(), error) {
+	path := fmt.Sprintf("%s/data/locks/crl/%s", kv, endpointID)
+
+	hostname, _ := os.Hostname()
+	owner := fmt.Sprintf("%s/%d", hostname, os.Getpid())
+	deadline := time.Now().Add(DefaultLockTimeout)
+
+	for {
+		secret, err := client.Logical().Read(path)
+		if err != nil {
+			return nil, vaultError(err)
+		}
+		version, holder, expiresAt := lockState(secret)
+		if version == 0 || time.Now().After(expiresAt) {
+			// Take over the lock if its owner didn't release it in time
+			if holder != "" {
+				logger.Warn("taking over a stale CRL lock", "endpoint_id", endpointID, "owner", holder)
+			}
+			version, err = writeLock(client, path, owner, version, time.Now().Add(vaultLockTTL))
+			if err == nil {
+				return holdLock(client, path, owner, endpointID, version, logger), nil
+			}
+			// Unless another instance got it first
+			if !casMismatch(err) {
+				return nil, vaultError(err)
+			}
+		}
+
+		if failFast || time.Now().After(deadline) {
+			return nil, &Error{Kind: ErrLocked, Err: fmt.Errorf("the CRL of endpoint %s is locked by another instance", endpointID)}
+		}
+		time.Sleep(vaultLockPollInterval)
+	}
+}
+
+// holdLock renews the lock at version every vaultLockRenewInterval until
+// the returned func is called, which releases it
+func holdLock(client *api.Client, path, owner, endpointID string, version int, logger logging.Logger) func() {
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(vaultLockRenewInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			renewed, err := writeLock(client, path, owner, version, time.Now().Add(vaultLockTTL))
+			if casMismatch(err) {
+				logger.Warn("the CRL lock was taken over by another instance", "endpoint_id", endpointID)
+				return
+			}
+			if err != nil {
+				logger.Warn("unable to renew the CRL lock", "endpoint_id", endpointID, "error", err)
+				continue
+			}
+			version = renewed
+		}
+	}()
+
+	return func() {
+		close(stop)
+		<-stopped
+		_, err := writeLock(client, path, "", version, time.Now())
+		switch {
+		case casMismatch(err):
+			logger.Warn("the CRL lock was taken over by another instance before being released", "endpoint_id", endpointID)
+		case err != nil:
+			logger.Warn("unable to release the CRL lock", "endpoint_id", endpointID, "error", err)
+		}
+	}
+}
+
+// writeLock writes the lock for the owner, empty if released, if it is
+// still at version, 0 if missing, and returns its new version
+func writeLock(client *api.Client, path, owner string, version int, expiresAt time.Time) (int, error) {
+	secret, err := client.Logical().Write(path, map[string]interface{}{
+		"options": map[string]interface{}{"cas": version},
+		"data": map[string]interface{}{
+			"owner":      owner,
+			"expires_at": expiresAt.UTC().Format(time.RFC3339),
+		},
+	})
+	if err != nil {
+		return 0, err
+	}
+	if secret == nil {
+		return 0, fmt.Errorf("no version returned writing the lock %s", path)
+	}
+	return intValue(secret.Data["version"]), nil
+}
+
+// lockState returns the version, 0 if missing, the owner and the
+// expiration of the lock read from the kv store
+func lockState(secret *api.Secret) (int, string, time.Time) {
+	if secret == nil {
+		return 0, "", time.Time{}
+	}
+	var version int
+	if md, ok := secret.Data["metadata"].(map[string]interface{}); ok {
+		version = intValue(md["version"])
+	}
+	data, ok := secret.Data["data"].(map[string]interface{})
+	if !ok {
+		// The version was deleted
+		return version, "", time.Time{}
+	}
+	owner, _ := data["owner"].(string)
+	expiresAt, _ := time.Parse(time.RFC3339, fmt.Sprint(data["expires_at"]))
+	return version, owner, expiresAt
+}
+
+// casMismatch returns whether the error of a write to the kv store is
+// due to the check-and-set version not matching the current one
+func casMismatch(err error) bool {
+	var respErr *api.ResponseError
+	if !errors.As(err, &respErr) || respErr.StatusCode != 400 {
+		return false
+	}
+	for _, e := range respErr.Errors {
+		if strings.Contains(e, "check-and-set") {
+			return true
+		}
+	}
+	return false
+}
+
+// intValue returns the integer decoded from a JSON response
+func intValue(v interface{}) int {
+	n, _ := strconv.Atoi(fmt.Sprint(v))
+	return n
+}
@@ -0,0 +1,163 @@
+package operations
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/logging"
+	"github.com/hashicorp/vault/api"
+)
+
+// fakeLockKV is a kv (v2) store of a single key, with the check-and-set
+// of its versions
+type fakeLockKV struct {
+	sync.Mutex
+	version int
+	data    map[string]interface{}
+	writes  int
+	// fail, if set, is the error returned to the writes with a 400
+	fail string
+}
+
+func (kv *fakeLockKV) serve(w http.ResponseWriter, r *http.Request) {
+	kv.Lock()
+	defer kv.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	switch r.Method {
+	case http.MethodGet:
+		if kv.version == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errors":[]}`))
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{
+			"data": kv.data, "metadata": map[string]interface{}{"version": kv.version}}})
+	default:
+		var body struct {
+			Options map[string]int         `json:"options"`
+			Data    map[string]interface{} `json:"data"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		if kv.fail != "" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{"errors": []string{kv.fail}})
+			return
+		}
+		if cas, ok := body.Options["cas"]; ok && cas != kv.version {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"errors":["check-and-set parameter did not match the current version"]}`))
+			return
+		}
+		kv.version++
+		kv.writes++
+		kv.data = body.Data
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{"version": kv.version}})
+	}
+}
+
+// set writes the lock out of band, as another instance
+func (kv *fakeLockKV) set(owner string, expiresAt time.Time) {
+	kv.Lock()
+	defer kv.Unlock()
+	kv.version++
+	kv.data = map[string]interface{}{"owner": owner, "expires_at": expiresAt.UTC().Format(time.RFC3339)}
+}
+
+func (kv *fakeLockKV) owner() string {
+	kv.Lock()
+	defer kv.Unlock()
+	owner, _ := kv.data["owner"].(string)
+	return owner
+}
+
+func newFakeLockKV(t *testing.T) (*fakeLockKV, *api.Client) {
+	kv := &fakeLockKV{}
+	srv := httptest.NewServer(http.HandlerFunc(kv.serve))
+	t.Cleanup(srv.Close)
+	cfg := api.DefaultConfig()
+	cfg.Address = srv.URL
+	client, err := api.NewClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kv, client
+}
+
+func TestVaultLock(t *testing.T) {
+	kv, client := newFakeLockKV(t)
+
+	release, err := vaultLock(client, "secret", "cvpn-endpoint-1", true, logging.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	owner := kv.owner()
+	if owner == "" {
+		t.Fatal("the lock wasn't written")
+	}
+	if _, err := vaultLock(client, "secret", "cvpn-endpoint-1", true, logging.Default()); !errors.Is(err, ErrLocked) {
+		t.Errorf("got error %v locking a held lock, want ErrLocked", err)
+	}
+	release()
+	if kv.owner() != "" {
+		t.Errorf("got owner %q after the release, want it released", kv.owner())
+	}
+
+	// A released lock can be acquired again
+	release, err = vaultLock(client, "secret", "cvpn-endpoint-1", true, logging.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+
+	// A stale lock is taken over
+	kv.set("other/1", time.Now().Add(-time.Minute))
+	release, err = vaultLock(client, "secret", "cvpn-endpoint-1", true, logging.Default())
+	if err != nil {
+		t.Fatalf("got error %s taking over a stale lock", err)
+	}
+	if kv.owner() != owner {
+		t.Errorf("got owner %q, want %q", kv.owner(), owner)
+	}
+
+	// The release leaves the lock of the instance that took it over
+	kv.set("other/1", time.Now().Add(time.Hour))
+	release()
+	if kv.owner() != "other/1" {
+		t.Errorf("got owner %q, want the lock of the other instance kept", kv.owner())
+	}
+}
+
+func TestVaultLockRenewal(t *testing.T) {
+	interval := vaultLockRenewInterval
+	vaultLockRenewInterval = 20 * time.Millisecond
+	defer func() { vaultLockRenewInterval = interval }()
+	kv, client := newFakeLockKV(t)
+
+	release, err := vaultLock(client, "secret", "cvpn-endpoint-1", true, logging.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	release()
+	kv.Lock()
+	defer kv.Unlock()
+	// The acquisition, the renewals and the release
+	if kv.writes < 4 {
+		t.Errorf("got %d writes of the lock, want it renewed", kv.writes)
+	}
+}
+
+func TestVaultLockWriteError(t *testing.T) {
+	kv, client := newFakeLockKV(t)
+	kv.fail = "permission denied"
+
+	_, err := vaultLock(client, "secret", "cvpn-endpoint-1", true, logging.Default())
+	if err == nil || errors.Is(err, ErrLocked) {
+		t.Errorf("got error %v, want the error of the write instead of ErrLocked", err)
+	}
+}
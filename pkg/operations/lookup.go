@@ -0,0 +1,130 @@
+package operations
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// ParseSerialNumber normalizes a serial number, either colon or dash
+// separated, as shown by Vault and OpenSSL, or plain hex, as in the
+// connection logs, to the dash separated form used by Vault and ACPM
+func ParseSerialNumber(serial string) (string, error) {
+	hex := strings.NewReplacer(":", "", "-", "", " ", "").Replace(strings.TrimSpace(serial))
+	hex = strings.TrimPrefix(strings.ToLower(hex), "0x")
+	n, ok := new(big.Int).SetString(hex, 16)
+	if !ok || hex == "" || n.Sign() < 0 {
+		return "", fmt.Errorf("invalid serial number '%s', use hex digits, optionally separated by colons", serial)
+	}
+	return getHexFormatted(n.Bytes(), "-"), nil
+}
+
+// GetCertificateRequest is the structure containing the
+// required data to look up a certificate by its serial number
+type GetCertificateRequest struct {
+	Client       *api.Client
+	VaultPKIPath string
+	// SerialNumber in any of the forms accepted by ParseSerialNumber
+	SerialNumber string
+	// VaultKVPath, if set, is used to fill in the revocation reason
+	// and the metadata of the user the certificate belongs to
+	VaultKVPath string
+	// IssuerRef, if set, is the issuer whose CRL is checked
+	IssuerRef string
+}
+
+// CertificateDetails describes a certificate and the user it belongs to
+type CertificateDetails struct {
+	Certificate
+	Username string `json:"username"`
+	// Metadata of the user, only set when the request has the VaultKVPath
+	Metadata *UserMetadata `json:"metadata,omitempty"`
+}
+
+// GetCertificate reads a certificate from Vault by its serial number,
+// e.g. one taken from the connection logs of the endpoint, and returns
+// it along with its user. The revocation status is checked against the
+// current CRL. A missing certificate is reported as ErrCertificateNotFound.
+func GetCertificate(r *GetCertificateRequest) (*CertificateDetails, error) {
+	start := time.Now()
+	crt, err := getCertificate(r)
+	observe("get_certificate", start, err)
+	return crt, err
+}
+
+func getCertificate(r *GetCertificateRequest) (*CertificateDetails, error) {
+	serial, err := ParseSerialNumber(r.SerialNumber)
+	if err != nil {
+		return nil, err
+	}
+
+	secret, err := r.Client.Logical().Read(fmt.Sprintf("%s/cert/%s", r.VaultPKIPath, serial))
+	if err != nil {
+		return nil, vaultError(err)
+	}
+	var rawCert string
+	if secret != nil {
+		rawCert, _ = secret.Data["certificate"].(string)
+	}
+	if rawCert == "" {
+		return nil, &Error{Kind: ErrCertificateNotFound, Err: fmt.Errorf("no certificate with serial number '%s' in %s", serial, r.VaultPKIPath)}
+	}
+	block, _ := pem.Decode([]byte(rawCert))
+	if block == nil {
+		return nil, fmt.Errorf("failed to parse certificate PEM of '%s'", serial)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse certificate '%s': %s", serial, err)
+	}
+
+	crl, err := GetCRL(
+		&GetCRLRequest{
+			Client:       r.Client,
+			VaultPKIPath: r.VaultPKIPath,
+			IssuerRef:    r.IssuerRef,
+		})
+	if err != nil {
+		return nil, err
+	}
+	revoked, err := isRevoked(serial, crl)
+	if err != nil {
+		return nil, err
+	}
+
+	details := &CertificateDetails{
+		Certificate: Certificate{
+			SerialNumber:   serial,
+			IssuerCN:       cert.Issuer.CommonName,
+			SubjectCN:      cert.Subject.CommonName,
+			NotBefore:      cert.NotBefore.Local(),
+			NotAfter:       cert.NotAfter.Local(),
+			Revoked:        revoked,
+			RevocationTime: revocationTime(secret),
+			CertificatePEM: rawCert,
+			VaultPKIPath:   r.VaultPKIPath,
+		},
+		Username: usernameFromCN(cert.Subject.CommonName),
+	}
+	if r.VaultKVPath == "" {
+		return details, nil
+	}
+
+	if revoked {
+		details.RevocationReason, err = getRevocationReason(r.Client, r.VaultKVPath, serial)
+		if err != nil {
+			return nil, err
+		}
+	}
+	details.Metadata, err = GetUserMetadata(&UserMetadataRequest{Client: r.Client, VaultKVPath: r.VaultKVPath, Username: details.Username})
+	if err != nil {
+		return nil, vaultError(err)
+	}
+	details.KeyNotRetained = !details.Metadata.keyRetained(serial)
+	return details, nil
+}
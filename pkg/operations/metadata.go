@@ -0,0 +1,130 @@
+package operations
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/mail"
+	"github.com/hashicorp/vault/api"
+)
+
+// UserMetadata holds the per user settings, stored in the
+// kv (v2) engine alongside the user's VPN config
+type UserMetadata struct {
+	// AutoRenew flags the user for automatic renewal of
+	// their certificate when it is about to expire
+	AutoRenew bool `json:"auto_renew"`
+	// Email is where the VPN config is sent to on issuance
+	Email string `json:"email,omitempty"`
+	// Suspension is set while the user is suspended, see SuspendUser.
+	// It can't be changed with SetUserMetadata.
+	Suspension *Suspension `json:"suspension,omitempty"`
+	// KeyNotRetained are the serial numbers of the certificates of the
+	// user whose private key was not stored, see DiscardPrivateKey of
+	// IssueCertificateRequest. It can't be changed with SetUserMetadata.
+	KeyNotRetained []string `json:"key_not_retained,omitempty"`
+}
+
+// keyRetained returns false if the private key of
+// the certificate was not stored on issuance
+func (md *UserMetadata) keyRetained(serial string) bool {
+	for _, s := range md.KeyNotRetained {
+		if s == serial {
+			return false
+		}
+	}
+	return true
+}
+
+// UserMetadataRequest is the structure containing the
+// required data to read or write a user's metadata
+type UserMetadataRequest struct {
+	Client      *api.Client
+	VaultKVPath string
+	Username    string
+	// Retry is the policy the Vault calls are retried with, see UpdateCRLOptions
+	Retry *RetryPolicy
+}
+
+func userMetadataPath(kv, username string) string {
+	return fmt.Sprintf("%s/data/users/%s/metadata", kv, username)
+}
+
+// GetUserMetadata reads the metadata of a user. An empty
+// UserMetadata is returned if the user has no metadata stored.
+func GetUserMetadata(r *UserMetadataRequest) (*UserMetadata, error) {
+	md := &UserMetadata{}
+
+	var secret *api.Secret
+	err := retry(context.Background(), r.Retry, nil, "read_metadata", vaultCall, func(context.Context) (err error) {
+		secret, err = r.Client.Logical().Read(userMetadataPath(r.VaultKVPath, r.Username))
+		return vaultError(err)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil || secret.Data["data"] == nil {
+		return md, nil
+	}
+
+	// Round trip through json to decode the generic map
+	// returned by Vault into the metadata struct
+	b, err := json.Marshal(secret.Data["data"])
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, md); err != nil {
+		return nil, err
+	}
+	return md, nil
+}
+
+// SetUserMetadata writes the metadata of a user, creating
+// a new version of the metadata secret in the kv store. The
+// suspension of the user, if any, and the certificates whose private
+// key was not retained are kept as is. The Email, if set, must be a
+// valid email address.
+func SetUserMetadata(r *UserMetadataRequest, md *UserMetadata) error {
+	if md.Email != "" {
+		if _, err := mail.ParseAddress(md.Email); err != nil {
+			return &Error{Kind: ErrInvalidEmail, Err: err}
+		}
+	}
+	current, err := GetUserMetadata(r)
+	if err != nil {
+		return err
+	}
+	update := *md
+	update.Suspension = current.Suspension
+	update.KeyNotRetained = current.KeyNotRetained
+	return writeUserMetadata(r, &update)
+}
+
+// recordKeyNotRetained adds the certificate to the
+// KeyNotRetained ones of the user's metadata
+func recordKeyNotRetained(r *UserMetadataRequest, serial string) error {
+	md, err := GetUserMetadata(r)
+	if err != nil {
+		return err
+	}
+	md.KeyNotRetained = append(md.KeyNotRetained, serial)
+	return writeUserMetadata(r, md)
+}
+
+func writeUserMetadata(r *UserMetadataRequest, md *UserMetadata) error {
+	b, err := json.Marshal(md)
+	if err != nil {
+		return err
+	}
+	data := map[string]interface{}{}
+	if err := json.Unmarshal(b, &data); err != nil {
+		return err
+	}
+
+	payload := map[string]interface{}{"data": data}
+	return retry(context.Background(), r.Retry, nil, "write_metadata", vaultCall, func(context.Context) error {
+		_, err := r.Client.Logical().Write(userMetadataPath(r.VaultKVPath, r.Username), payload)
+		return vaultError(err)
+	})
+}
@@ -0,0 +1,109 @@
+package operations
+
+import (
+	"errors"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/hashicorp/vault/api"
+)
+
+// CRL upload outcomes recorded with Metrics.CRLUpload
+const (
+	CRLUploadAttempted = "attempted"
+	CRLUploadSucceeded = "succeeded"
+	CRLUploadSkipped   = "skipped"
+	CRLUploadFailed    = "failed"
+)
+
+// Metrics receives the measurements taken by the operations.
+// Set it with SetMetrics, by default nothing is recorded.
+type Metrics interface {
+	// CertificateIssued is called for each issued certificate
+	CertificateIssued()
+	// CertificatesRevoked is called with the number of certificates revoked
+	CertificatesRevoked(n int)
+	// CRLUpload is called with each of the outcomes of a CRL upload
+	CRLUpload(outcome string)
+	// APIError is called for each operation failed due to an error of
+	// the Vault or AWS APIs. Service is either "vault" or "aws".
+	APIError(service, operation string)
+	// ObserveDuration is called with the time taken by an operation
+	ObserveDuration(operation string, d time.Duration)
+	// SetActive is called with the number of users with a valid
+	// certificate and the total number of valid certificates
+	SetActive(users, certificates int)
+	// SetCRLNextUpdate is called with the NextUpdate of the uploaded CRL
+	SetCRLNextUpdate(t time.Time)
+	// SetCRLStats is called after each read of the PEM encoded CRL
+	// for an endpoint, with its size in bytes, number of entries and
+	// NextUpdate
+	SetCRLStats(pkiPath, endpointID string, size, entries int, nextUpdate time.Time)
+	// SetLastSync is called when the CRL is successfully synced to the endpoint
+	SetLastSync(t time.Time)
+	// RateLimited is called for each operation refused by a RateLimiter,
+	// with the scope of the limit reached
+	RateLimited(scope string)
+	// SetVaultCircuitState is called with each new state of the
+	// circuit breaker of the Vault calls, see SetVaultCircuitBreaker
+	SetVaultCircuitState(state string)
+	// UsersCacheLookup is called for each ListUsers with a UsersCache,
+	// with UsersCacheHit or UsersCacheMiss
+	UsersCacheLookup(result string)
+}
+
+type noopMetrics struct{}
+
+func (noopMetrics) CertificateIssued()                              {}
+func (noopMetrics) CertificatesRevoked(int)                         {}
+func (noopMetrics) CRLUpload(string)                                {}
+func (noopMetrics) APIError(string, string)                         {}
+func (noopMetrics) ObserveDuration(string, time.Duration)           {}
+func (noopMetrics) SetActive(int, int)                              {}
+func (noopMetrics) SetCRLNextUpdate(time.Time)                      {}
+func (noopMetrics) SetCRLStats(string, string, int, int, time.Time) {}
+func (noopMetrics) SetLastSync(time.Time)                           {}
+func (noopMetrics) RateLimited(string)                              {}
+func (noopMetrics) SetVaultCircuitState(string)                     {}
+func (noopMetrics) UsersCacheLookup(string)                         {}
+
+var metrics Metrics = noopMetrics{}
+
+// SetMetrics sets where the operations record their metrics
+func SetMetrics(m Metrics) {
+	if m == nil {
+		m = noopMetrics{}
+	}
+	metrics = m
+}
+
+// observe records the duration of an operation started at start
+// and, if it failed due to the Vault or AWS APIs, the API error
+func observe(operation string, start time.Time, err error) {
+	metrics.ObserveDuration(operation, time.Since(start))
+	if err == nil {
+		return
+	}
+	var respErr *api.ResponseError
+	var aerr awserr.Error
+	switch {
+	case errors.Is(err, ErrVaultUnavailable) || errors.As(err, &respErr):
+		metrics.APIError("vault", operation)
+	case errors.Is(err, ErrEndpointNotFound) || errors.As(err, &aerr):
+		metrics.APIError("aws", operation)
+	}
+}
+
+// countActive returns the number of users with at least one
+// valid certificate and the total number of valid certificates
+func countActive(users map[string][]Certificate) (int, int) {
+	var activeUsers, activeCerts int
+	for _, crts := range users {
+		n := len(activeCertificates(crts))
+		if n > 0 {
+			activeUsers++
+			activeCerts += n
+		}
+	}
+	return activeUsers, activeCerts
+}
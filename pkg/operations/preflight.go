@@ -0,0 +1,111 @@
+package operations
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/hashicorp/vault/api"
+)
+
+// PreflightRequest is the structure containing the
+// required data to check the setup of ACPM
+type PreflightRequest struct {
+	Client              *api.Client
+	VaultPKIPath        string
+	ClientVPNEndpointID string
+	// LoginError, if set, is the error obtaining a token for the Client,
+	// for example with approle, reported as the failure of vault-token
+	LoginError error
+	// Timeout of each of the checks. Defaults to DefaultHealthCheckTimeout.
+	Timeout time.Duration
+}
+
+// PreflightCheck is the outcome of one of the preflight checks
+type PreflightCheck struct {
+	Name string `json:"name"`
+	HealthCheck
+}
+
+// PreflightReport holds the outcome of all the preflight checks, in the
+// order they were run
+type PreflightReport struct {
+	Checks []PreflightCheck `json:"checks"`
+	// Passed is true if all the checks passed
+	Passed bool `json:"passed"`
+}
+
+// Preflight checks, one after the other, that Vault is reachable, that
+// the token is valid, that the PKI mount exists, that the AWS credentials
+// work and that the Client VPN endpoint exists and uses mutual
+// certificate authentication. Unlike CheckReadiness it
+// is meant to be run by an operator to diagnose a setup, so all the checks
+// are reported, and those that depend on a failed one are marked as so.
+func Preflight(r *PreflightRequest) *PreflightReport {
+	timeout := r.Timeout
+	if timeout == 0 {
+		timeout = DefaultHealthCheckTimeout
+	}
+
+	checks := []struct {
+		name string
+		// dependsOn is the name of the check that needs
+		// to pass for this one to be meaningful
+		dependsOn string
+		run       func(ctx context.Context) error
+	}{
+		{"vault-reachable", "", func(ctx context.Context) error {
+			var status api.SealStatusResponse
+			if err := vaultGetJSON(ctx, r.Client, "/v1/sys/seal-status", &status); err != nil {
+				return err
+			}
+			if status.Sealed {
+				return fmt.Errorf("vault is sealed")
+			}
+			return nil
+		}},
+		{"vault-token", "vault-reachable", func(ctx context.Context) error {
+			if r.LoginError != nil {
+				return r.LoginError
+			}
+			return vaultGetJSON(ctx, r.Client, "/v1/auth/token/lookup-self", nil)
+		}},
+		{"vault-pki", "vault-token", func(ctx context.Context) error {
+			return vaultGetJSON(ctx, r.Client, fmt.Sprintf("/v1/%s/ca/pem", r.VaultPKIPath), nil)
+		}},
+		{"aws-credentials", "", func(ctx context.Context) error {
+			_, err := sts.New(newAWSSession()).GetCallerIdentityWithContext(ctx, &sts.GetCallerIdentityInput{})
+			return awsError(err)
+		}},
+		{"aws-client-vpn-endpoint", "aws-credentials", func(ctx context.Context) error {
+			ep, err := describeEndpoint(ctx, r.ClientVPNEndpointID, nil)
+			if err != nil {
+				return err
+			}
+			return checkCertificateAuth(ep)
+		}},
+	}
+
+	report := &PreflightReport{Passed: true}
+	failed := map[string]bool{}
+	for _, check := range checks {
+		hc := HealthCheck{Status: "ok"}
+		if failed[check.dependsOn] {
+			hc = HealthCheck{Status: "ko", Error: fmt.Sprintf("skipped, %s failed", check.dependsOn)}
+		} else {
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			if err := check.run(ctx); err != nil {
+				hc = HealthCheck{Status: "ko", Error: err.Error()}
+			}
+			cancel()
+		}
+		if hc.Status != "ok" {
+			failed[check.name] = true
+			report.Passed = false
+		}
+		report.Checks = append(report.Checks, PreflightCheck{Name: check.name, HealthCheck: hc})
+	}
+
+	return report
+}
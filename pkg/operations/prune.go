@@ -0,0 +1,209 @@
+package operations
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/logging"
+	"github.com/hashicorp/vault/api"
+)
+
+const (
+	// DefaultPruneSafetyBuffer is how long a revoked certificate has to be
+	// expired for before PruneExpiredFromCRL removes it from the CRL
+	DefaultPruneSafetyBuffer = time.Hour
+	// DefaultTidyTimeout is how long PruneExpiredFromCRL waits
+	// for the tidy operation of Vault to finish
+	DefaultTidyTimeout = 5 * time.Minute
+	// tidyPollInterval is how often the status of the tidy operation is polled
+	tidyPollInterval = 2 * time.Second
+)
+
+// PruneExpiredFromCRLRequest is the structure containing the required
+// data to remove the expired certificates from the CRL
+type PruneExpiredFromCRLRequest struct {
+	Client              *api.Client
+	VaultPKIPath        string
+	ClientVPNEndpointID string
+	// SafetyBuffer is how long a certificate has to be expired
+	// for to be pruned. Defaults to DefaultPruneSafetyBuffer.
+	SafetyBuffer time.Duration
+	// TidyTimeout defaults to DefaultTidyTimeout
+	TidyTimeout time.Duration
+	UpdateCRLOptions
+}
+
+// PruneExpiredFromCRLResult holds the outcome of a PruneExpiredFromCRL operation
+type PruneExpiredFromCRLResult struct {
+	// Count is the number of certificates removed from the CRL
+	Count int
+	// Serials are the serial numbers of the certificates removed from the CRL
+	Serials []string
+	// UpdateCRLResult is the outcome of the import of the pruned CRL.
+	// Nil if there was nothing to prune.
+	*UpdateCRLResult
+}
+
+// PruneExpiredFromCRL removes from the CRL the revoked certificates that
+// have already expired, as clients reject them anyway, to keep the CRL
+// under the size limits of AWS. It runs the tidy operation of the PKI
+// backend, which deletes the expired revoked certificates from Vault,
+// then rotates the CRL and imports it in the Client VPN endpoint. Nothing
+// is changed if the CRL has no expired certificates.
+func PruneExpiredFromCRL(r *PruneExpiredFromCRLRequest) (*PruneExpiredFromCRLResult, error) {
+	start := time.Now()
+	res, err := pruneExpiredFromCRL(r)
+	observe("prune_crl", start, err)
+	return res, err
+}
+
+func pruneExpiredFromCRL(r *PruneExpiredFromCRLRequest) (*PruneExpiredFromCRLResult, error) {
+	logger := logging.OrDefault(r.Logger).With("endpoint_id", r.ClientVPNEndpointID, "pki_path", r.VaultPKIPath)
+	buffer := r.SafetyBuffer
+	if buffer == 0 {
+		buffer = DefaultPruneSafetyBuffer
+	}
+
+	var crl []byte
+	err := retry(r.Context, r.Retry, r.Logger, "get_crl", vaultCall, func(context.Context) (err error) {
+		crl, err = GetCRL(
+			&GetCRLRequest{
+				Client:              r.Client,
+				VaultPKIPath:        r.VaultPKIPath,
+				CRLPath:             r.CRLPath,
+				IssuerRef:           r.IssuerRef,
+				ClientVPNEndpointID: r.ClientVPNEndpointID,
+			})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	expired, err := expiredCRLEntries(r.Client, r.VaultPKIPath, crl, time.Now().Add(-buffer), r.UpdateCRLOptions)
+	if err != nil {
+		return nil, err
+	}
+	if len(expired) == 0 {
+		logger.Info("no expired certificates to prune from the CRL")
+		return &PruneExpiredFromCRLResult{}, nil
+	}
+	logger.Info("pruning expired certificates from the CRL", "count", len(expired))
+
+	if err := tidyRevokedCertificates(r.Client, r.VaultPKIPath, buffer, r.TidyTimeout, r.UpdateCRLOptions); err != nil {
+		return nil, err
+	}
+
+	// The CRL is expected to shrink by the pruned certificates
+	opts := r.UpdateCRLOptions
+	opts.ForceShrink = true
+	rotated, err := RotateCRLWithResult(
+		&RotateCRLRequest{
+			Client:              r.Client,
+			VaultPKIPath:        r.VaultPKIPath,
+			ClientVPNEndpointID: r.ClientVPNEndpointID,
+			UpdateCRLOptions:    opts,
+		})
+	result := &PruneExpiredFromCRLResult{}
+	if rotated != nil {
+		result.UpdateCRLResult = rotated.UpdateCRLResult
+	}
+	if err != nil {
+		return result, err
+	}
+
+	// Report the certificates that are actually gone from the new CRL
+	for _, serial := range expired {
+		revoked, err := isRevoked(serial, result.CRL)
+		if err != nil {
+			return result, err
+		}
+		if !revoked {
+			result.Serials = append(result.Serials, serial)
+		}
+	}
+	result.Count = len(result.Serials)
+	logger.Info("pruned expired certificates from the CRL", "count", result.Count, "serials", result.Serials)
+	return result, nil
+}
+
+// expiredCRLEntries returns the serial numbers of the certificates
+// of the CRL that expired before the given time
+func expiredCRLEntries(client *api.Client, pki string, crl []byte, before time.Time, opts UpdateCRLOptions) ([]string, error) {
+	parsed, err := parseCRL(crl)
+	if err != nil {
+		return nil, err
+	}
+	var expired []string
+	for _, entry := range parsed.TBSCertList.RevokedCertificates {
+		serial := strings.TrimSpace(getHexFormatted(entry.SerialNumber.Bytes(), "-"))
+		var secret *api.Secret
+		err := retry(opts.Context, opts.Retry, opts.Logger, "read_cert", vaultCall, func(context.Context) (err error) {
+			secret, err = client.Logical().Read(fmt.Sprintf("%s/cert/%s", pki, serial))
+			return vaultError(err)
+		})
+		if err != nil {
+			return nil, err
+		}
+		if secret == nil {
+			// Already gone from Vault, the next CRL won't list it
+			continue
+		}
+		cert, err := parseCertificatePEM(secret.Data["certificate"].(string))
+		if err != nil {
+			return nil, err
+		}
+		if cert.NotAfter.Before(before) {
+			expired = append(expired, serial)
+		}
+	}
+	return expired, nil
+}
+
+// tidyRevokedCertificates runs the tidy operation of the PKI backend to
+// delete the revoked certificates that expired more than buffer ago, and
+// waits for it to finish, as recent versions of Vault run it in the
+// background
+func tidyRevokedCertificates(client *api.Client, pki string, buffer, timeout time.Duration, opts UpdateCRLOptions) error {
+	if timeout == 0 {
+		timeout = DefaultTidyTimeout
+	}
+	err := retry(opts.Context, opts.Retry, opts.Logger, "tidy", vaultCall, func(context.Context) error {
+		_, err := client.Logical().Write(fmt.Sprintf("%s/tidy", pki), map[string]interface{}{
+			"tidy_revoked_certs": true,
+			"safety_buffer":      buffer.String(),
+		})
+		return vaultError(err)
+	})
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		var secret *api.Secret
+		err := retry(opts.Context, opts.Retry, opts.Logger, "tidy_status", vaultCall, func(context.Context) (err error) {
+			secret, err = client.Logical().Read(fmt.Sprintf("%s/tidy-status", pki))
+			return vaultError(err)
+		})
+		if err != nil {
+			return err
+		}
+		if secret == nil {
+			// Versions of Vault without tidy-status run the tidy synchronously
+			return nil
+		}
+		switch secret.Data["state"] {
+		case "Running":
+		case "Error":
+			return fmt.Errorf("tidy of %s failed: %v", pki, secret.Data["error"])
+		default:
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("tidy of %s still running after %s", pki, timeout)
+		}
+		time.Sleep(tidyPollInterval)
+	}
+}
@@ -0,0 +1,141 @@
+package operations
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// Rate limit scopes recorded with Metrics.RateLimited
+const (
+	RateLimitScopeCaller = "caller"
+	RateLimitScopeUser   = "user"
+)
+
+// RateLimit allows up to Limit operations per Period, refilled gradually
+// as a token bucket. A zero Limit disables it. Period defaults to an hour.
+type RateLimit struct {
+	Limit  int
+	Period time.Duration
+}
+
+// RateLimiter limits, in memory, how often the mutating operations run
+// on behalf of each caller and on each target user. Both limits need to
+// allow an operation for it to run. The zero value allows everything.
+type RateLimiter struct {
+	PerCaller RateLimit
+	PerUser   RateLimit
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	limit  RateLimit
+	tokens float64
+	last   time.Time
+}
+
+// available returns the tokens of the bucket at the given time
+func (b *bucket) available(now time.Time) float64 {
+	refilled := float64(b.limit.Limit) * now.Sub(b.last).Seconds() / b.limit.period().Seconds()
+	return math.Min(float64(b.limit.Limit), b.tokens+refilled)
+}
+
+func (r RateLimit) period() time.Duration {
+	if r.Period == 0 {
+		return time.Hour
+	}
+	return r.Period
+}
+
+// RateLimitError is returned when the rate limit of the caller
+// or of the target user has been reached
+type RateLimitError struct {
+	// Scope is either RateLimitScopeCaller or RateLimitScopeUser
+	Scope string
+	Key   string
+	// RetryAfter is the time until the operation will be allowed
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("rate limit of %s '%s' reached, retry in %s", e.Scope, e.Key, e.RetryAfter.Round(time.Second))
+}
+
+// Unwrap makes errors.Is(err, ErrRateLimited) true
+func (e *RateLimitError) Unwrap() error {
+	return ErrRateLimited
+}
+
+// Allow consumes a token of the caller's and of the username's buckets,
+// or returns a *RateLimitError if either is empty, in which case none is
+// consumed. An empty caller or username skips the corresponding limit.
+// A nil RateLimiter allows everything.
+func (l *RateLimiter) Allow(caller, username string) error {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.buckets == nil {
+		l.buckets = map[string]*bucket{}
+	}
+	now := time.Now()
+	// Full buckets are the same as new ones, drop them so the
+	// map doesn't grow with every caller and user seen
+	for k, b := range l.buckets {
+		if b.available(now) >= float64(b.limit.Limit) {
+			delete(l.buckets, k)
+		}
+	}
+
+	type check struct {
+		scope string
+		key   string
+		limit RateLimit
+	}
+	var checks []check
+	if caller != "" && l.PerCaller.Limit > 0 {
+		checks = append(checks, check{RateLimitScopeCaller, caller, l.PerCaller})
+	}
+	if username != "" && l.PerUser.Limit > 0 {
+		checks = append(checks, check{RateLimitScopeUser, username, l.PerUser})
+	}
+
+	var buckets []*bucket
+	for _, c := range checks {
+		b := l.refill(c.scope+"/"+c.key, c.limit, now)
+		if b.tokens < 1 {
+			metrics.RateLimited(c.scope)
+			perToken := float64(c.limit.period()) / float64(c.limit.Limit)
+			return &RateLimitError{
+				Scope:      c.scope,
+				Key:        c.key,
+				RetryAfter: time.Duration(math.Ceil((1 - b.tokens) * perToken)),
+			}
+		}
+		buckets = append(buckets, b)
+	}
+	for _, b := range buckets {
+		b.tokens--
+	}
+
+	return nil
+}
+
+// refill returns the bucket of key with the tokens
+// accrued since it was last used
+func (l *RateLimiter) refill(key string, limit RateLimit, now time.Time) *bucket {
+	b, ok := l.buckets[key]
+	if !ok || b.limit != limit {
+		b = &bucket{limit: limit, tokens: float64(limit.Limit), last: now}
+		l.buckets[key] = b
+		return b
+	}
+	b.tokens = b.available(now)
+	b.last = now
+	return b
+}
@@ -0,0 +1,219 @@
+package operations
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/logging"
+	"github.com/hashicorp/vault/api"
+	"github.com/pkg/errors"
+)
+
+// RebuildCRLRequest is the structure containing the
+// required data to rebuild the CRL of the endpoint
+type RebuildCRLRequest struct {
+	Client              *api.Client
+	VaultPKIPath        string
+	ClientVPNEndpointID string
+	// UpdateCRLOptions.ForceImport imports the regenerated
+	// CRL even if it doesn't match the revoked certificates
+	UpdateCRLOptions
+}
+
+// RebuildCRLResult holds the outcome of a RebuildCRL operation
+type RebuildCRLResult struct {
+	// Revoked are the serial numbers of the certificates revoked in Vault
+	Revoked []string
+	// Missing are the serial numbers of the certificates revoked
+	// in Vault but not listed in the regenerated CRL
+	Missing []string
+	// Unexpected are the serial numbers listed in the
+	// regenerated CRL of certificates not revoked in Vault
+	Unexpected []string
+	CRL        []byte
+	// AWSUpdated is true if the CRL was imported in the AWS Client VPN endpoint
+	AWSUpdated bool
+}
+
+// CRLMismatchError is returned when the CRL regenerated by
+// Vault doesn't list exactly the certificates revoked in Vault
+type CRLMismatchError struct {
+	Missing    []string
+	Unexpected []string
+}
+
+// Unwrap allows matching the error with errors.Is(err, ErrCRLMismatch)
+func (e *CRLMismatchError) Unwrap() error {
+	return ErrCRLMismatch
+}
+
+func (e *CRLMismatchError) Error() string {
+	return fmt.Sprintf("the regenerated CRL is missing %d revoked certificates (%s) and lists %d not revoked (%s)",
+		len(e.Missing), strings.Join(e.Missing, ", "), len(e.Unexpected), strings.Join(e.Unexpected, ", "))
+}
+
+// RebuildCRL reconstructs the CRL of the endpoint from the certificates
+// stored in Vault, for when the CRL of the endpoint is lost or corrupted.
+// It finds the revoked certificates by their revocation time, rotates the
+// CRL in Vault and checks that the regenerated CRL lists exactly those
+// before importing it in the endpoint. Unlike UpdateCRL, no certificates
+// are revoked. A *CRLMismatchError, matching ErrCRLMismatch, is returned
+// along with the result, and nothing is imported, if the CRL doesn't
+// match, unless UpdateCRLOptions.ForceImport is set.
+func RebuildCRL(r *RebuildCRLRequest) (*RebuildCRLResult, error) {
+	start := time.Now()
+	res, err := rebuildCRL(r)
+	observe("rebuild_crl", start, err)
+	return res, err
+}
+
+func rebuildCRL(r *RebuildCRLRequest) (*RebuildCRLResult, error) {
+	logger := logging.OrDefault(r.Logger).With("endpoint_id", r.ClientVPNEndpointID, "pki_path", r.VaultPKIPath)
+	start := time.Now()
+
+	if err := checkCapabilities(r.Client, r.UpdateCRLOptions, rotateCapabilities(r.VaultPKIPath)...); err != nil {
+		return nil, err
+	}
+	unlock, err := lockEndpoint(r.Client, r.ClientVPNEndpointID, r.UpdateCRLOptions)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	revoked, err := revokedSerials(r.Client, r.VaultPKIPath, r.IssuerRef, r.UpdateCRLOptions)
+	if err != nil {
+		return nil, err
+	}
+	err = retry(r.Context, r.Retry, r.Logger, "rotate_crl", vaultCall, func(context.Context) error { return rotateVaultCRL(r.Client, r.VaultPKIPath) })
+	if err != nil {
+		return nil, err
+	}
+	var crl []byte
+	err = retry(r.Context, r.Retry, r.Logger, "get_crl", vaultCall, func(context.Context) (err error) {
+		crl, err = GetCRL(
+			&GetCRLRequest{
+				Client:              r.Client,
+				VaultPKIPath:        r.VaultPKIPath,
+				Format:              CRLFormatPEM,
+				CRLPath:             r.CRLPath,
+				IssuerRef:           r.IssuerRef,
+				ClientVPNEndpointID: r.ClientVPNEndpointID,
+			})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	parsed, err := parseCRL(crl)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &RebuildCRLResult{CRL: crl}
+	listed := map[string]bool{}
+	for _, entry := range parsed.TBSCertList.RevokedCertificates {
+		listed[strings.TrimSpace(getHexFormatted(entry.SerialNumber.Bytes(), "-"))] = true
+	}
+	for serial := range revoked {
+		result.Revoked = append(result.Revoked, serial)
+		if !listed[serial] {
+			result.Missing = append(result.Missing, serial)
+		}
+	}
+	for serial := range listed {
+		if !revoked[serial] {
+			result.Unexpected = append(result.Unexpected, serial)
+		}
+	}
+	sort.Strings(result.Revoked)
+	sort.Strings(result.Missing)
+	sort.Strings(result.Unexpected)
+	logger.Info("regenerated the CRL from the certificates in Vault",
+		"revoked", len(result.Revoked), "missing", len(result.Missing), "unexpected", len(result.Unexpected))
+
+	if len(result.Missing) > 0 || len(result.Unexpected) > 0 {
+		mismatch := &CRLMismatchError{Missing: result.Missing, Unexpected: result.Unexpected}
+		if !r.ForceImport {
+			return result, mismatch
+		}
+		logger.Warn("importing the CRL despite the mismatch", "error", mismatch)
+	}
+
+	maxSize := r.CRLMaxSize
+	if maxSize == 0 {
+		maxSize = DefaultCRLMaxSize
+	}
+	if len(crl) > maxSize {
+		return result, &CRLTooLargeError{Size: len(crl), MaxSize: maxSize}
+	}
+	if r.VerifyCRLSignature {
+		if err := verifyCRLSignature(r.Client, r.VaultPKIPath, r.IssuerRef, crl); err != nil {
+			return result, err
+		}
+	}
+	result.AWSUpdated, _, err = importCRL(r.Client, r.ClientVPNEndpointID, crl, r.UpdateCRLOptions, logger, start)
+	if err != nil {
+		return result, err
+	}
+	return result, nil
+}
+
+// revokedSerials returns the serial numbers of the certificates
+// of the PKI that have a revocation time in Vault
+func revokedSerials(client *api.Client, pki, issuerRef string, opts UpdateCRLOptions) (map[string]bool, error) {
+	var secret *api.Secret
+	err := retry(opts.Context, opts.Retry, opts.Logger, "list_certs", vaultCall, func(context.Context) (err error) {
+		secret, err = client.Logical().List(fmt.Sprintf("%s/certs", pki))
+		return vaultError(err)
+	})
+	if err != nil {
+		return nil, err
+	}
+	var issuer *x509.Certificate
+	if issuerRef != "" {
+		err = retry(opts.Context, opts.Retry, opts.Logger, "get_issuer", vaultCall, func(context.Context) (err error) {
+			issuer, err = getIssuer(client, pki, issuerRef)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	revoked := map[string]bool{}
+	if secret == nil {
+		return revoked, nil
+	}
+	for _, key := range secret.Data["keys"].([]interface{}) {
+		var secret *api.Secret
+		err := retry(opts.Context, opts.Retry, opts.Logger, "read_cert", vaultCall, func(context.Context) (err error) {
+			secret, err = client.Logical().Read(fmt.Sprintf("%s/cert/%s", pki, key))
+			return vaultError(err)
+		})
+		if err != nil {
+			return nil, err
+		}
+		if secret == nil || revocationTime(secret) == nil {
+			continue
+		}
+		block, _ := pem.Decode([]byte(secret.Data["certificate"].(string)))
+		if block == nil {
+			return nil, errors.Errorf("failed to parse the PEM of certificate %s", key)
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse certificate %s", key)
+		}
+		if issuer != nil && !bytes.Equal(cert.RawIssuer, issuer.RawSubject) {
+			continue
+		}
+		revoked[strings.TrimSpace(getHexFormatted(cert.SerialNumber.Bytes(), "-"))] = true
+	}
+	return revoked, nil
+}
@@ -0,0 +1,170 @@
+package operations
+
+import (
+	"fmt"
+	"sort"
+	"text/template"
+	"time"
+
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/directory"
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/logging"
+	"github.com/hashicorp/vault/api"
+)
+
+// DefaultRenewBefore is the default time before expiry at
+// which certificates flagged for auto renewal are renewed
+const DefaultRenewBefore = 7 * 24 * time.Hour
+
+// AutoRenewRequest is the structure containing the required data
+// to renew the certificates of the users flagged for auto renewal
+type AutoRenewRequest struct {
+	Client              *api.Client
+	VaultPKIPaths       []string
+	VaultPKIRole        string
+	ClientVPNEndpointID string
+	VaultKVPath         string
+	// VaultBundleKVPath, if set, is where the renewed certificates
+	// are stored, as in IssueCertificateRequest
+	VaultBundleKVPath string
+	CfgTemplate       *template.Template
+	CfgFromEndpoint   bool
+	CfgCache          *ClientConfigCache
+	// RenewBefore is how long before expiry a certificate
+	// is renewed. Defaults to DefaultRenewBefore.
+	RenewBefore time.Duration
+	// DenyListKVPath, if set, fails the renewals of the
+	// users in the deny-list, as in IssueCertificateRequest
+	DenyListKVPath string
+	// Directory, if set, fails the renewals of the users
+	// not in it, as in IssueCertificateRequest
+	Directory directory.Checker
+	// RateLimiter, if set, applies the per user limit to the renewals
+	RateLimiter *RateLimiter
+	// ValidateBundle validates the renewed certificates,
+	// as in IssueCertificateRequest
+	ValidateBundle bool
+	UpdateCRLOptions
+}
+
+// AutoRenewResult holds the outcome of an AutoRenew operation
+type AutoRenewResult struct {
+	// Renewed are the users that got a new certificate issued
+	Renewed []string
+	// Serials holds the serial number of the new
+	// certificate of each of the Renewed users
+	Serials map[string]string
+	// Failed holds the error for each user whose renewal failed.
+	// These will be retried on the next run.
+	Failed map[string]error
+	// UpdateCRLResult is the outcome of the CRL update that follows
+	// the renewals. Nil if nothing was renewed or the update failed
+	// before producing one.
+	*UpdateCRLResult
+}
+
+// AutoRenew issues a new certificate, and stores the new VPN config
+// in the kv store, for each user flagged with auto_renew in its metadata
+// whose latest certificate expires within RenewBefore. As in IssueBatch,
+// the CRL is updated once after all the renewals, and the superseded
+// certificate is revoked by it once the RevocationGracePeriod has elapsed.
+// The users whose latest certificate was issued without retaining its
+// private key are not renewed.
+func AutoRenew(r *AutoRenewRequest) (*AutoRenewResult, error) {
+
+	renewBefore := r.RenewBefore
+	if renewBefore == 0 {
+		renewBefore = DefaultRenewBefore
+	}
+
+	users, err := ListUsers(
+		&ListUsersRequest{
+			Client:              r.Client,
+			VaultPKIPath:        r.VaultPKIPaths[len(r.VaultPKIPaths)-1],
+			ClientVPNEndpointID: r.ClientVPNEndpointID,
+			IssuerRef:           r.IssuerRef,
+			AdoptedKVPath:       r.AdoptedKVPath,
+			Retry:               r.Retry,
+			Logger:              r.Logger,
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	result := &AutoRenewResult{Serials: map[string]string{}, Failed: map[string]error{}}
+	logger := logging.OrDefault(r.Logger).With("endpoint_id", r.ClientVPNEndpointID)
+	deadline := time.Now().Add(renewBefore)
+	batch := &issueBatch{users: users}
+
+	for username, crts := range users {
+		latest := crts[len(crts)-1]
+		// Only the latest certificate is relevant, revoked users
+		// must not get their access back through a renewal
+		if latest.Revoked || latest.NotAfter.After(deadline) {
+			continue
+		}
+
+		// Only read the metadata of the users that need renewal
+		md, err := GetUserMetadata(
+			&UserMetadataRequest{
+				Client:      r.Client,
+				VaultKVPath: r.VaultKVPath,
+				Username:    username,
+			})
+		if err != nil {
+			result.Failed[username] = err
+			continue
+		}
+		// The renewal would store the private key that the user
+		// chose not to have stored, and the user would never get it
+		if !md.AutoRenew || md.Suspension != nil || !md.keyRetained(latest.SerialNumber) {
+			continue
+		}
+
+		issued, err := IssueClientCertificate(
+			&IssueCertificateRequest{
+				Client:              r.Client,
+				VaultPKIPaths:       r.VaultPKIPaths,
+				VaultPKIRole:        r.VaultPKIRole,
+				Username:            username,
+				ClientVPNEndpointID: r.ClientVPNEndpointID,
+				VaultKVPath:         r.VaultKVPath,
+				VaultBundleKVPath:   r.VaultBundleKVPath,
+				CfgTemplate:         r.CfgTemplate,
+				CfgFromEndpoint:     r.CfgFromEndpoint,
+				CfgCache:            r.CfgCache,
+				DenyListKVPath:      r.DenyListKVPath,
+				Directory:           r.Directory,
+				RateLimiter:         r.RateLimiter,
+				ValidateBundle:      r.ValidateBundle,
+				UpdateCRLOptions:    r.UpdateCRLOptions,
+				batch:               batch,
+			})
+		if err != nil {
+			logger.Error("failed to auto renew certificate", "user", username, "serial", latest.SerialNumber, "error", err)
+			result.Failed[username] = err
+			continue
+		}
+		logger.Info("auto renewed certificate", "user", username, "serial", latest.SerialNumber, "not_after", latest.NotAfter)
+		result.Renewed = append(result.Renewed, username)
+		result.Serials[username] = issued.SerialNumber
+	}
+	sort.Strings(result.Renewed)
+
+	if len(result.Renewed) > 0 {
+		result.UpdateCRLResult, err = UpdateCRL(
+			&UpdateCRLRequest{
+				Client:              r.Client,
+				VaultPKIPath:        r.VaultPKIPaths[len(r.VaultPKIPaths)-1],
+				ClientVPNEndpointID: r.ClientVPNEndpointID,
+				UpdateCRLOptions:    r.UpdateCRLOptions,
+			})
+		if err != nil {
+			return result, err
+		}
+	}
+
+	if len(result.Failed) > 0 {
+		return result, fmt.Errorf("failed to auto renew the certificates of %d users", len(result.Failed))
+	}
+	return result, nil
+}
@@ -0,0 +1,136 @@
+package operations
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// ExportFormat is the output format of a users report
+type ExportFormat string
+
+const (
+	// ExportFormatJSON outputs the report as a JSON array
+	ExportFormatJSON ExportFormat = "json"
+	// ExportFormatCSV outputs the report as CSV, with a header row
+	ExportFormatCSV ExportFormat = "csv"
+)
+
+// ExportUsersRequest is the structure containing
+// the required data to export the users report
+type ExportUsersRequest struct {
+	Client              *api.Client
+	VaultPKIPath        string
+	ClientVPNEndpointID string
+	Format              ExportFormat
+	Writer              io.Writer
+	// IssuerRef, if set, restricts the report to the
+	// certificates issued by this issuer of the mount
+	IssuerRef string
+	// AdoptedKVPath, if set, is the kv store where the certificates
+	// adopted with Adopt are looked up, to report them under their users
+	AdoptedKVPath string
+}
+
+// ExportRecord is each of the rows of the users report
+type ExportRecord struct {
+	Username    string    `json:"username"`
+	Serial      string    `json:"serial"`
+	IssuedAt    time.Time `json:"issued_at"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	Revoked     bool      `json:"revoked"`
+	Active      bool      `json:"active"`
+	VPNEndpoint string    `json:"vpn_endpoint"`
+}
+
+var exportCSVHeader = []string{"username", "serial", "issued_at", "expires_at", "revoked", "active", "vpn_endpoint"}
+
+// ExportUsers writes a report of all the users and their certificates
+// to the provided Writer. Records are written as certificates are read
+// from Vault, so the whole report is never held in memory.
+func ExportUsers(r *ExportUsersRequest) error {
+
+	adopted := map[string]string{}
+	if r.AdoptedKVPath != "" {
+		var err error
+		if adopted, err = loadAdopted(r.Client, r.AdoptedKVPath); err != nil {
+			return err
+		}
+	}
+
+	var write func(ExportRecord) error
+	var flush func() error
+
+	switch r.Format {
+	case ExportFormatCSV:
+		cw := csv.NewWriter(r.Writer)
+		if err := cw.Write(exportCSVHeader); err != nil {
+			return err
+		}
+		write = func(rec ExportRecord) error {
+			return cw.Write([]string{
+				rec.Username,
+				rec.Serial,
+				rec.IssuedAt.Format(time.RFC3339),
+				rec.ExpiresAt.Format(time.RFC3339),
+				strconv.FormatBool(rec.Revoked),
+				strconv.FormatBool(rec.Active),
+				rec.VPNEndpoint,
+			})
+		}
+		flush = func() error {
+			cw.Flush()
+			return cw.Error()
+		}
+
+	case ExportFormatJSON, "":
+		if _, err := io.WriteString(r.Writer, "["); err != nil {
+			return err
+		}
+		first := true
+		write = func(rec ExportRecord) error {
+			b, err := json.Marshal(rec)
+			if err != nil {
+				return err
+			}
+			if !first {
+				if _, err := io.WriteString(r.Writer, ","); err != nil {
+					return err
+				}
+			}
+			first = false
+			_, err = fmt.Fprintf(r.Writer, "\n  %s", b)
+			return err
+		}
+		flush = func() error {
+			_, err := io.WriteString(r.Writer, "\n]\n")
+			return err
+		}
+
+	default:
+		return fmt.Errorf("unsupported export format '%s'", r.Format)
+	}
+
+	now := time.Now()
+	err := walkCertificates(r.Client, r.VaultPKIPath, r.IssuerRef, func(crt Certificate) error {
+		return write(ExportRecord{
+			Username:    certificateUsername(adopted, crt),
+			Serial:      crt.SerialNumber,
+			IssuedAt:    crt.NotBefore,
+			ExpiresAt:   crt.NotAfter,
+			Revoked:     crt.Revoked,
+			Active:      !crt.Revoked && now.After(crt.NotBefore) && now.Before(crt.NotAfter),
+			VPNEndpoint: r.ClientVPNEndpointID,
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	return flush()
+}
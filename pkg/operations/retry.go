@@ -0,0 +1,161 @@
+package operations
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/logging"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/hashicorp/vault/api"
+)
+
+const (
+	// DefaultRetryMaxAttempts is the number of times a Vault
+	// or AWS call is tried, the first one included
+	DefaultRetryMaxAttempts = 3
+	// DefaultRetryInitialBackoff is the wait before the first retry
+	DefaultRetryInitialBackoff = 500 * time.Millisecond
+	// DefaultRetryMaxBackoff is the longest wait between two attempts
+	DefaultRetryMaxBackoff = 5 * time.Second
+	// DefaultRetryDeadline is the longest time spent retrying a call
+	DefaultRetryDeadline = 30 * time.Second
+)
+
+// RetryPolicy controls how the Vault and AWS calls of the operations are
+// retried when they fail with a transient error, see UpdateCRLOptions.
+// The zero value of each field takes its default, so a nil policy is
+// the default policy.
+type RetryPolicy struct {
+	// MaxAttempts is the number of times a call is tried, the first one
+	// included. Set it to 1 to fail fast. Defaults to DefaultRetryMaxAttempts.
+	MaxAttempts int
+	// InitialBackoff is the wait before the first retry, which doubles
+	// on each attempt up to MaxBackoff. They default to
+	// DefaultRetryInitialBackoff and DefaultRetryMaxBackoff.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// Deadline is the longest time spent on a call, retries included: no
+	// attempt is made if the wait before it would end past the deadline.
+	// Defaults to DefaultRetryDeadline.
+	Deadline time.Duration
+	// Retryable tells the transient errors, which are retried, from the
+	// permanent ones, which are returned right away. Defaults to
+	// IsRetryableError.
+	Retryable func(error) bool
+}
+
+// IsRetryableError is the default RetryPolicy.Retryable. It retries the
+// errors matching ErrVaultUnavailable, the 5xx and 429 responses of Vault,
+// and the errors the AWS SDK deems retryable, throttling included. The
+// cancellation of the context is never retried, nor are the timeouts, as
+// the call that timed out may still complete, nor the calls failed fast
+// by the circuit breaker of Vault.
+func IsRetryableError(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, ErrTimeout) ||
+		errors.Is(err, ErrVaultCircuitOpen) {
+		return false
+	}
+	var respErr *api.ResponseError
+	if errors.As(err, &respErr) {
+		return respErr.StatusCode >= 500 || respErr.StatusCode == 429
+	}
+	if errors.Is(err, ErrVaultUnavailable) {
+		return true
+	}
+	var aerr awserr.Error
+	if errors.As(err, &aerr) {
+		return request.IsErrorRetryable(aerr) || request.IsErrorThrottle(aerr)
+	}
+	return false
+}
+
+// callThroughCircuit runs an attempt of a call. If it is a Vault call, it
+// first waits for the rate limiter of Vault, and lets the circuit breaker
+// of Vault fail it fast and record its outcome.
+func callThroughCircuit(ctx context.Context, op string, kind callKind, fn func(ctx context.Context) error) error {
+	if kind != vaultCall {
+		return withTimeout(ctx, op, kind, fn)
+	}
+	if err := vaultLimiter.wait(ctx); err != nil {
+		return err
+	}
+	if err := vaultCircuit.allow(); err != nil {
+		return err
+	}
+	err := withTimeout(ctx, op, kind, fn)
+	vaultCircuit.record(err)
+	return err
+}
+
+// backoff returns the wait before the given retry, the first one being 1
+func (p *RetryPolicy) backoff(retry int) time.Duration {
+	wait := p.InitialBackoff
+	if wait <= 0 {
+		wait = DefaultRetryInitialBackoff
+	}
+	max := p.MaxBackoff
+	if max <= 0 {
+		max = DefaultRetryMaxBackoff
+	}
+	for i := 1; i < retry && wait < max; i++ {
+		wait *= 2
+	}
+	if wait > max {
+		wait = max
+	}
+	return wait
+}
+
+// retry calls fn until it succeeds or fails with a permanent error, the
+// attempts of the policy are exhausted, its deadline is reached or the
+// context is done. Each attempt runs with the timeout of its kind of call,
+// see withTimeout, and the Vault calls go through the rate limiter and the
+// circuit breaker of Vault, which fails them fast while open. It returns the last error of
+// fn, or the error of the context if it was done while waiting for the
+// next attempt. The op names the call in the log entries of the retries
+// and the timeouts.
+func retry(ctx context.Context, p *RetryPolicy, logger logging.Logger, op string, kind callKind, fn func(ctx context.Context) error) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if p == nil {
+		p = &RetryPolicy{}
+	}
+	attempts := p.MaxAttempts
+	if attempts <= 0 {
+		attempts = DefaultRetryMaxAttempts
+	}
+	deadline := p.Deadline
+	if deadline <= 0 {
+		deadline = DefaultRetryDeadline
+	}
+	retryable := p.Retryable
+	if retryable == nil {
+		retryable = IsRetryableError
+	}
+
+	if ctx.Err() != nil {
+		return contextError(ctx, op)
+	}
+	start := time.Now()
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = callThroughCircuit(ctx, op, kind, fn); err == nil || attempt >= attempts || !retryable(err) {
+			return err
+		}
+		wait := p.backoff(attempt)
+		if time.Since(start)+wait > deadline {
+			return err
+		}
+		logging.OrDefault(logger).Warn("retrying after a transient error", "op", op, "attempt", attempt, "wait", wait, "error", err)
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return contextError(ctx, op)
+		case <-timer.C:
+		}
+	}
+}
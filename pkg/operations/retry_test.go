@@ -0,0 +1,144 @@
+package operations
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+)
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy RetryPolicy
+		retry  int
+		want   time.Duration
+	}{
+		{"default first", RetryPolicy{}, 1, DefaultRetryInitialBackoff},
+		{"default second", RetryPolicy{}, 2, 2 * DefaultRetryInitialBackoff},
+		{"default capped", RetryPolicy{}, 10, DefaultRetryMaxBackoff},
+		{"first", RetryPolicy{InitialBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}, 1, 100 * time.Millisecond},
+		{"doubled", RetryPolicy{InitialBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}, 3, 400 * time.Millisecond},
+		{"capped", RetryPolicy{InitialBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}, 5, time.Second},
+		{"initial above max", RetryPolicy{InitialBackoff: 2 * time.Second, MaxBackoff: time.Second}, 1, time.Second},
+		{"negative takes the defaults", RetryPolicy{InitialBackoff: -1, MaxBackoff: -1}, 2, 2 * DefaultRetryInitialBackoff},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.backoff(tt.retry); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+var errTransient = errors.New("transient")
+
+// counter fails with the errors in order, then succeeds
+type counter struct {
+	calls int
+	errs  []error
+}
+
+func (c *counter) fn(context.Context) error {
+	c.calls++
+	if c.calls <= len(c.errs) {
+		return c.errs[c.calls-1]
+	}
+	return nil
+}
+
+func failing(n int, err error) *counter {
+	c := &counter{}
+	for i := 0; i < n; i++ {
+		c.errs = append(c.errs, err)
+	}
+	return c
+}
+
+func TestRetry(t *testing.T) {
+	transient := func(err error) bool { return errors.Is(err, errTransient) }
+	fast := RetryPolicy{InitialBackoff: time.Millisecond, Retryable: transient}
+	permanent := errors.New("permanent")
+
+	tests := []struct {
+		name    string
+		policy  *RetryPolicy
+		fn      *counter
+		wantErr error
+		calls   int
+	}{
+		{"success", &fast, failing(0, nil), nil, 1},
+		{"recovers", &fast, failing(2, errTransient), nil, 3},
+		{"permanent error", &fast, failing(5, permanent), permanent, 1},
+		{"default retryable", &RetryPolicy{InitialBackoff: time.Millisecond}, failing(5, errTransient), errTransient, 1},
+		{"max attempts", &RetryPolicy{MaxAttempts: 4, InitialBackoff: time.Millisecond, Retryable: transient}, failing(10, errTransient), errTransient, 4},
+		{"default max attempts", &fast, failing(10, errTransient), errTransient, DefaultRetryMaxAttempts},
+		{"fail fast", &RetryPolicy{MaxAttempts: 1, Retryable: transient}, failing(10, errTransient), errTransient, 1},
+		{"custom retryable", &RetryPolicy{InitialBackoff: time.Millisecond, Retryable: func(err error) bool { return err == permanent }},
+			failing(1, permanent), nil, 2},
+		// The second wait of 100ms would end past the deadline
+		{"deadline", &RetryPolicy{MaxAttempts: 10, InitialBackoff: 50 * time.Millisecond, Deadline: 120 * time.Millisecond, Retryable: transient},
+			failing(10, errTransient), errTransient, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := retry(context.Background(), tt.policy, nil, "test", awsCall, tt.fn.fn)
+			if !errors.Is(err, tt.wantErr) || (tt.wantErr == nil && err != nil) {
+				t.Errorf("got error %v, want %v", err, tt.wantErr)
+			}
+			if tt.fn.calls != tt.calls {
+				t.Errorf("got %d calls, want %d", tt.fn.calls, tt.calls)
+			}
+		})
+	}
+}
+
+func TestRetryContextCancelled(t *testing.T) {
+	policy := &RetryPolicy{InitialBackoff: time.Hour, MaxBackoff: time.Hour, Deadline: 2 * time.Hour,
+		Retryable: func(err error) bool { return errors.Is(err, errTransient) }}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c := failing(10, errTransient)
+	time.AfterFunc(20*time.Millisecond, cancel)
+	start := time.Now()
+	err := retry(ctx, policy, nil, "test", awsCall, c.fn)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("got error %v, want context.Canceled", err)
+	}
+	if c.calls != 1 || time.Since(start) > time.Second {
+		t.Errorf("got %d calls in %s, want the wait to stop on cancel", c.calls, time.Since(start))
+	}
+
+	// No attempt is made with a done context
+	c = failing(0, nil)
+	if err := retry(ctx, policy, nil, "test", awsCall, c.fn); !errors.Is(err, context.Canceled) || c.calls != 0 {
+		t.Errorf("got %v after %d calls, want context.Canceled and no calls", err, c.calls)
+	}
+}
+
+func TestIsRetryableError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{errors.New("boom"), false},
+		{&api.ResponseError{StatusCode: 503}, true},
+		{&api.ResponseError{StatusCode: 429}, true},
+		{&api.ResponseError{StatusCode: 400}, false},
+		{vaultError(errors.New("connection refused")), true},
+		{fmt.Errorf("reading: %w", &Error{Kind: ErrVaultUnavailable}), true},
+		{context.Canceled, false},
+		{&Error{Kind: ErrVaultUnavailable, Err: context.DeadlineExceeded}, false},
+		{&Error{Kind: ErrVaultCircuitOpen}, false},
+	}
+	for _, tt := range tests {
+		if got := IsRetryableError(tt.err); got != tt.want {
+			t.Errorf("IsRetryableError(%v) = %t, want %t", tt.err, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package operations
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/audit"
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/logging"
+	"github.com/hashicorp/vault/api"
+)
+
+// RevocationReason is the reason why a certificate was revoked,
+// named after the CRL reason codes defined in RFC 5280
+type RevocationReason string
+
+const (
+	// ReasonUnspecified is used when no reason is given
+	ReasonUnspecified RevocationReason = "unspecified"
+	// ReasonKeyCompromise is used when the private key has been leaked
+	ReasonKeyCompromise RevocationReason = "keyCompromise"
+	// ReasonSuperseded is used when a newer certificate has been issued
+	ReasonSuperseded RevocationReason = "superseded"
+	// ReasonAffiliationChanged is used when the user moved to another team
+	// or organization, and is no longer entitled to the same access
+	ReasonAffiliationChanged RevocationReason = "affiliationChanged"
+	// ReasonCessationOfOperation is used when the user no longer needs access,
+	// e.g. has been offboarded
+	ReasonCessationOfOperation RevocationReason = "cessationOfOperation"
+	// ReasonPrivilegeWithdrawn is used when the access of the user is withdrawn
+	ReasonPrivilegeWithdrawn RevocationReason = "privilegeWithdrawn"
+)
+
+// reasonCodes are the CRL reason codes of RFC 5280 of each reason
+var reasonCodes = map[RevocationReason]int{
+	ReasonUnspecified:          0,
+	ReasonKeyCompromise:        1,
+	ReasonAffiliationChanged:   3,
+	ReasonSuperseded:           4,
+	ReasonCessationOfOperation: 5,
+	ReasonPrivilegeWithdrawn:   9,
+}
+
+// Code returns the CRL reason code of RFC 5280 of the reason, as
+// used in the reasonCode extension of the CRL entries, or 0
+// (unspecified) for an unknown reason
+func (r RevocationReason) Code() int {
+	return reasonCodes[r]
+}
+
+// ParseRevocationReason validates a revocation reason, given either by
+// name or by its CRL reason code. An empty string is parsed as
+// ReasonUnspecified.
+func ParseRevocationReason(reason string) (RevocationReason, error) {
+	if reason == "" {
+		return ReasonUnspecified, nil
+	}
+	if code, err := strconv.Atoi(reason); err == nil {
+		for r, c := range reasonCodes {
+			if c == code {
+				return r, nil
+			}
+		}
+		return "", fmt.Errorf("unsupported revocation reason code %d", code)
+	}
+	if _, ok := reasonCodes[RevocationReason(reason)]; ok {
+		return RevocationReason(reason), nil
+	}
+	return "", fmt.Errorf("unknown revocation reason '%s'", reason)
+}
+
+// revocationOptions controls how revokeUserCertificates revokes certificates
+type revocationOptions struct {
+	// revokeAll revokes all the certificates instead of all but the latest
+	revokeAll bool
+	// grace keeps the certificate previous to the latest valid until
+	// the latest one is older than this
+	grace time.Duration
+	// reason is recorded in the kv store, under kvPath, for each revoked
+	// certificate. Defaults to ReasonSuperseded for the certificates
+	// superseded by a newer one and to ReasonUnspecified with revokeAll.
+	reason RevocationReason
+	kvPath string
+	logger logging.Logger
+	// retry and ctx are the RetryPolicy and Context of the revocations
+	retry *RetryPolicy
+	ctx   context.Context
+	// audit, if set, records each revocation along with the actor
+	// and the endpoint, see UpdateCRLOptions.Audit
+	audit      *audit.Logger
+	actor      string
+	endpointID string
+	// usersCache, if set, is invalidated once the certificates are
+	// revoked, see UpdateCRLOptions.UsersCache
+	usersCache *UsersCache
+	// configStore, if set, is where the configs of
+	// the revoked certificates are deleted from
+	configStore *ConfigStore
+}
+
+func revocationPath(kv, serial string) string {
+	return fmt.Sprintf("%s/data/revocations/%s", kv, serial)
+}
+
+// storeRevocationReason records why a certificate was revoked in
+// the kv store, as Vault does not store it in the CRL
+func storeRevocationReason(client *api.Client, kv, serial string, reason RevocationReason) error {
+	payload := map[string]interface{}{
+		"data": map[string]string{
+			"reason":     string(reason),
+			"revoked_at": time.Now().UTC().Format(time.RFC3339),
+		},
+	}
+	_, err := client.Logical().Write(revocationPath(kv, serial), payload)
+	return vaultError(err)
+}
+
+// getRevocationReason returns the recorded revocation reason of a
+// certificate, or an empty string if there is none recorded
+func getRevocationReason(client *api.Client, kv, serial string) (RevocationReason, error) {
+	secret, err := client.Logical().Read(revocationPath(kv, serial))
+	if err != nil {
+		return "", vaultError(err)
+	}
+	if secret == nil || secret.Data["data"] == nil {
+		return "", nil
+	}
+	data, ok := secret.Data["data"].(map[string]interface{})
+	if !ok {
+		return "", nil
+	}
+	reason, _ := data["reason"].(string)
+	return RevocationReason(reason), nil
+}
+
+// ListCertificatesRequest is the structure containing
+// the required data to list all the client certificates
+type ListCertificatesRequest struct {
+	Client       *api.Client
+	VaultPKIPath string
+	// VaultKVPath, if set, is used to fill in the
+	// revocation reason of the revoked certificates
+	VaultKVPath string
+	// IssuerRef, if set, restricts the listing to the
+	// certificates issued by this issuer of the mount
+	IssuerRef string
+}
+
+// ListCertificates returns all the client certificates of
+// the PKI, sorted by the date they were issued at
+func ListCertificates(r *ListCertificatesRequest) ([]Certificate, error) {
+	var crts []Certificate
+
+	err := walkCertificates(r.Client, r.VaultPKIPath, r.IssuerRef, func(crt Certificate) error {
+		if crt.Revoked && r.VaultKVPath != "" {
+			reason, err := getRevocationReason(r.Client, r.VaultKVPath, crt.SerialNumber)
+			if err != nil {
+				return err
+			}
+			crt.RevocationReason = reason
+		}
+		crts = append(crts, crt)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(crts, func(i, j int) bool {
+		return crts[i].NotBefore.Before(crts[j].NotBefore)
+	})
+
+	return crts, nil
+}
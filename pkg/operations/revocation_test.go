@@ -0,0 +1,74 @@
+package operations
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+)
+
+func TestRevokeUserCertificatesGrace(t *testing.T) {
+	var mu sync.Mutex
+	var requested []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			SerialNumber string `json:"serial_number"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		mu.Lock()
+		requested = append(requested, body.SerialNumber)
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"data":{"revocation_time":1}}`))
+	}))
+	defer srv.Close()
+	cfg := api.DefaultConfig()
+	cfg.Address = srv.URL
+	client, err := api.NewClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		latest    time.Duration
+		grace     time.Duration
+		revokeAll bool
+		want      string
+	}{
+		{"no grace", time.Minute, 0, false, "[01 03]"},
+		{"grace elapsed", 2 * time.Hour, time.Hour, false, "[01 03]"},
+		// Only the certificate previous to the latest one is spared
+		{"in grace", time.Minute, time.Hour, false, "[01]"},
+		{"revoke all in grace", time.Minute, time.Hour, true, "[01 03 04]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requested = nil
+			crts := []Certificate{
+				{SerialNumber: "01", SubjectCN: "alice", NotBefore: time.Now().Add(-4 * time.Hour)},
+				{SerialNumber: "02", SubjectCN: "alice", NotBefore: time.Now().Add(-3 * time.Hour), Revoked: true},
+				{SerialNumber: "03", SubjectCN: "alice", NotBefore: time.Now().Add(-3 * time.Hour)},
+				{SerialNumber: "04", SubjectCN: "alice", NotBefore: time.Now().Add(-tt.latest)},
+			}
+			pending := supersededCertificates(crts, tt.grace)
+			got, err := revokeUserCertificates(client, "pki", crts, revocationOptions{ctx: context.Background(), grace: tt.grace, revokeAll: tt.revokeAll})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprint(got) != tt.want || fmt.Sprint(requested) != tt.want {
+				t.Errorf("got revoked %v with requests %v, want %s", got, requested, tt.want)
+			}
+			// The CRL status reports as pending what the update revokes
+			if !tt.revokeAll && fmt.Sprint(pending) != tt.want {
+				t.Errorf("got pending %v, want %s", pending, tt.want)
+			}
+		})
+	}
+}
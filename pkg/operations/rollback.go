@@ -0,0 +1,102 @@
+package operations
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/logging"
+	"github.com/hashicorp/vault/api"
+)
+
+// RollbackCRLRequest is the structure containing the
+// required data to restore a CRL in the endpoint
+type RollbackCRLRequest struct {
+	ClientVPNEndpointID string
+	Logger              logging.Logger
+	// Client is required to restore a version of the CRL history
+	// or to record the restored CRL in it
+	Client *api.Client
+	// HistoryVersion, if set, is the version of the CRL history, in
+	// CRLHistoryKVPath, restored instead of the given CRL
+	HistoryVersion     int
+	CRLHistoryKVPath   string
+	CRLHistoryVersions int
+	// Actor is recorded along with the restored CRL in the history
+	Actor string
+	// AWSConfig, if set, is applied to the EC2
+	// client, see UpdateCRLOptions.AWSConfig
+	AWSConfig *aws.Config
+}
+
+// RollbackCRL imports the given PEM encoded CRL in the AWS Client VPN
+// endpoint as is, without going through the Vault revocation logic. It is
+// meant to restore a previously backed up CRL when the current one is
+// wrong. The input must hold a single CRL PEM block, any text before it
+// (like the header added to the backups) is ignored. Returns ErrInvalidCRL
+// if the input is not a valid CRL. With HistoryVersion, the CRL restored
+// is that version of the CRL history instead, see GetCRLHistory.
+func RollbackCRL(r *RollbackCRLRequest, crlPEM []byte) error {
+	if r.HistoryVersion > 0 {
+		if r.Client == nil || r.CRLHistoryKVPath == "" {
+			return errors.New("the CRL history is not enabled")
+		}
+		entry, err := GetCRLHistory(
+			&CRLHistoryRequest{
+				Client:              r.Client,
+				VaultKVPath:         r.CRLHistoryKVPath,
+				ClientVPNEndpointID: r.ClientVPNEndpointID,
+			}, r.HistoryVersion)
+		if err != nil {
+			return err
+		}
+		crlPEM = []byte(entry.CRL)
+	}
+
+	block, rest := pem.Decode(crlPEM)
+	if block == nil {
+		return &Error{Kind: ErrInvalidCRL, Err: errors.New("no PEM data found")}
+	}
+	if block.Type != "X509 CRL" {
+		return &Error{Kind: ErrInvalidCRL, Err: fmt.Errorf("expected a PEM block of type 'X509 CRL', got '%s'", block.Type)}
+	}
+	if next, _ := pem.Decode(rest); next != nil {
+		return &Error{Kind: ErrInvalidCRL, Err: errors.New("more than one PEM block found, only one CRL can be imported")}
+	}
+	if _, err := x509.ParseCRL(block.Bytes); err != nil {
+		return &Error{Kind: ErrInvalidCRL, Err: err}
+	}
+
+	// Don't race with a running UpdateCRL
+	unlock, err := lockEndpoint(nil, r.ClientVPNEndpointID, UpdateCRLOptions{Logger: r.Logger})
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	crl := bytes.TrimSpace(pem.EncodeToMemory(block))
+	_, err = ec2Client(r.AWSConfig).ImportClientVpnClientCertificateRevocationList(
+		&ec2.ImportClientVpnClientCertificateRevocationListInput{
+			CertificateRevocationList: aws.String(string(crl)),
+			ClientVpnEndpointId:       aws.String(r.ClientVPNEndpointID),
+		})
+	if err != nil {
+		return awsError(err)
+	}
+	logger := logging.OrDefault(r.Logger)
+	logger.Info("rolled back the CRL of AWS Client VPN endpoint", "endpoint_id", r.ClientVPNEndpointID, "history_version", r.HistoryVersion)
+
+	if r.Client != nil {
+		opts := UpdateCRLOptions{CRLHistoryKVPath: r.CRLHistoryKVPath, CRLHistoryVersions: r.CRLHistoryVersions, Actor: r.Actor}
+		if err := recordCRLHistory(r.Client, opts, r.ClientVPNEndpointID, crl); err != nil {
+			logger.Warn("unable to record the CRL in the history", "kv_path", r.CRLHistoryKVPath, "error", err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,165 @@
+package operations
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/logging"
+	"github.com/hashicorp/vault/api"
+)
+
+// SANNotAllowedError is returned when a subject alternative name
+// requested for a certificate is not allowed by the Vault PKI role.
+// It matches ErrSANNotAllowed.
+type SANNotAllowedError struct {
+	Name string
+	Role string
+	// Reason is the setting of the role that rejects the name
+	Reason string
+}
+
+// Unwrap returns ErrSANNotAllowed
+func (e *SANNotAllowedError) Unwrap() error {
+	return ErrSANNotAllowed
+}
+
+func (e *SANNotAllowedError) Error() string {
+	return fmt.Sprintf("subject alternative name '%s' is not allowed by role '%s': %s", e.Name, e.Role, e.Reason)
+}
+
+// addSANs adds the subject alternative names of the request to the
+// payload of the Vault issue endpoint. Vault takes the emails in
+// alt_names, along with the DNS names.
+func addSANs(r *IssueCertificateRequest, payload map[string]interface{}) {
+	if names := append(append([]string{}, r.AltNames...), r.EmailSANs...); len(names) > 0 {
+		payload["alt_names"] = strings.Join(names, ",")
+	}
+	if len(r.IPSANs) > 0 {
+		payload["ip_sans"] = strings.Join(r.IPSANs, ",")
+	}
+}
+
+func hasSANs(r *IssueCertificateRequest) bool {
+	return len(r.AltNames) > 0 || len(r.IPSANs) > 0 || len(r.EmailSANs) > 0
+}
+
+// checkSANs validates the subject alternative names of the request against
+// the allowed domains and IP SANs of the role, so a disallowed one fails
+// with a *SANNotAllowedError before anything is issued. Vault remains
+// the authority: the names are not checked if the role can't be read,
+// e.g. because the token is not allowed to, or uses templated domains.
+func checkSANs(r *IssueCertificateRequest) error {
+	if !hasSANs(r) {
+		return nil
+	}
+	for _, ip := range r.IPSANs {
+		if net.ParseIP(ip) == nil {
+			return &Error{Kind: ErrSANNotAllowed, Err: fmt.Errorf("invalid IP SAN '%s'", ip)}
+		}
+	}
+	for _, email := range r.EmailSANs {
+		if i := strings.LastIndex(email, "@"); i <= 0 || i == len(email)-1 {
+			return &Error{Kind: ErrSANNotAllowed, Err: fmt.Errorf("invalid email SAN '%s'", email)}
+		}
+	}
+
+	pki := r.VaultPKIPaths[len(r.VaultPKIPaths)-1]
+	secret, err := r.Client.Logical().Read(fmt.Sprintf("%s/roles/%s", pki, r.VaultPKIRole))
+	if err != nil || secret == nil {
+		logging.OrDefault(r.Logger).Debug("unable to read the PKI role, the SANs are left to Vault to check", "role", r.VaultPKIRole, "error", err)
+		return nil
+	}
+	role := secret.Data
+
+	if len(r.IPSANs) > 0 && role["allow_ip_sans"] == false {
+		return &SANNotAllowedError{Name: r.IPSANs[0], Role: r.VaultPKIRole, Reason: "allow_ip_sans is false"}
+	}
+	if role["allow_any_name"] == true || role["allowed_domains_template"] == true {
+		return nil
+	}
+	domains := roleStrings(role["allowed_domains"])
+	for _, name := range r.AltNames {
+		if !domainAllowed(name, domains, role) {
+			return &SANNotAllowedError{Name: name, Role: r.VaultPKIRole, Reason: "not in allowed_domains: " + strings.Join(domains, ", ")}
+		}
+	}
+	for _, email := range r.EmailSANs {
+		if !domainAllowed(email[strings.LastIndex(email, "@")+1:], domains, role) {
+			return &SANNotAllowedError{Name: email, Role: r.VaultPKIRole, Reason: "domain not in allowed_domains: " + strings.Join(domains, ", ")}
+		}
+	}
+	return nil
+}
+
+// domainAllowed follows the rules of Vault's PKI roles for the
+// names matching the allowed domains
+func domainAllowed(name string, domains []string, role map[string]interface{}) bool {
+	name = strings.ToLower(name)
+	if name == "localhost" && role["allow_localhost"] != false {
+		return true
+	}
+	for _, d := range domains {
+		d = strings.ToLower(d)
+		switch {
+		case role["allow_bare_domains"] == true && name == d:
+			return true
+		case role["allow_subdomains"] == true && strings.HasSuffix(name, "."+d):
+			return true
+		case role["allow_glob_domains"] == true && strings.Contains(d, "*") && globMatch(d, name):
+			return true
+		}
+	}
+	return false
+}
+
+// globMatch matches the name against a pattern where
+// each '*' stands for any sequence of characters
+func globMatch(pattern, name string) bool {
+	parts := strings.Split(pattern, "*")
+	if !strings.HasPrefix(name, parts[0]) {
+		return false
+	}
+	name = name[len(parts[0]):]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(name, part)
+		if i < 0 {
+			return false
+		}
+		name = name[i+len(part):]
+	}
+	return strings.HasSuffix(name, parts[len(parts)-1])
+}
+
+// roleStrings returns a list setting of a role, which
+// Vault returns as either a list or a comma separated string
+func roleStrings(v interface{}) []string {
+	var list []string
+	switch v := v.(type) {
+	case []interface{}:
+		for _, s := range v {
+			if s, ok := s.(string); ok && s != "" {
+				list = append(list, s)
+			}
+		}
+	case string:
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				list = append(list, s)
+			}
+		}
+	}
+	return list
+}
+
+// sanRejected reports the rejection by Vault of an issuance with
+// subject alternative names as ErrSANNotAllowed, along with the
+// reason given by Vault
+func sanRejected(err error) error {
+	var respErr *api.ResponseError
+	if errors.As(err, &respErr) && respErr.StatusCode == 400 {
+		return &Error{Kind: ErrSANNotAllowed, Err: fmt.Errorf("vault rejected the certificate request: %s", strings.Join(respErr.Errors, "; "))}
+	}
+	return err
+}
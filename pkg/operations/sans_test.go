@@ -0,0 +1,39 @@
+package operations
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/hashicorp/vault/api"
+)
+
+func TestSANRejected(t *testing.T) {
+	rejected := &api.ResponseError{StatusCode: 400, Errors: []string{"subject alternative name alice.other.com not allowed by this role"}}
+	err := sanRejected(vaultError(rejected))
+	if !errors.Is(err, ErrSANNotAllowed) {
+		t.Errorf("got %v, want ErrSANNotAllowed", err)
+	}
+	if want := "san not allowed: vault rejected the certificate request: subject alternative name alice.other.com not allowed by this role"; err.Error() != want {
+		t.Errorf("got error %q, want %q", err, want)
+	}
+
+	// The other errors are not about the names
+	for _, err := range []error{&api.ResponseError{StatusCode: 403}, vaultError(&api.ResponseError{StatusCode: 500})} {
+		if got := sanRejected(err); got != err {
+			t.Errorf("got %v, want %v as is", got, err)
+		}
+	}
+}
+
+func TestAddSANs(t *testing.T) {
+	payload := map[string]interface{}{}
+	addSANs(&IssueCertificateRequest{AltNames: []string{"a.corp.com", "b.corp.com"}, EmailSANs: []string{"alice@corp.com"}, IPSANs: []string{"10.0.0.1", "::1"}}, payload)
+	if payload["alt_names"] != "a.corp.com,b.corp.com,alice@corp.com" || payload["ip_sans"] != "10.0.0.1,::1" || len(payload) != 2 {
+		t.Errorf("got payload %v", payload)
+	}
+	payload = map[string]interface{}{}
+	addSANs(&IssueCertificateRequest{}, payload)
+	if len(payload) != 0 {
+		t.Errorf("got payload %v without SANs", payload)
+	}
+}
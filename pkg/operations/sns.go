@@ -0,0 +1,37 @@
+package operations
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sns"
+)
+
+// CRLUpdateMessage is the message published to the
+// SNSTopicARN after a successful update of the CRL
+type CRLUpdateMessage struct {
+	EndpointID   string    `json:"endpoint_id"`
+	RevokedCount int       `json:"revoked_count"`
+	AWSUpdated   bool      `json:"aws_updated"`
+	Timestamp    time.Time `json:"timestamp"`
+}
+
+// publishCRLUpdate publishes the outcome of a CRL update to the SNS topic
+func publishCRLUpdate(topicARN, endpointID string, res *UpdateCRLResult) error {
+	msg, err := json.Marshal(CRLUpdateMessage{
+		EndpointID:   endpointID,
+		RevokedCount: res.RevokedCount,
+		AWSUpdated:   res.AWSUpdated,
+		Timestamp:    time.Now().UTC(),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = sns.New(newAWSSession()).Publish(
+		&sns.PublishInput{
+			TopicArn: aws.String(topicARN),
+			Message:  aws.String(string(msg)),
+		})
+	return err
+}
@@ -0,0 +1,46 @@
+package operations
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// FormatRotateCRLSummary returns a short, human readable, multi-line summary
+// of a CRL rotation, e.g. to post it to a chat channel through a webhook:
+//
+//	CRL rotation of cvpn-endpoint-0123456789abcdef0: rotated
+//	Users: 42
+//	Certificates revoked: 3
+//	Certificates skipped: 1
+//	AWS updated: yes
+//	Duration: 2.35s
+//
+// The rotation shows as skipped if it wasn't due yet given the
+// RotationWindow. It returns an empty string for a nil result.
+func FormatRotateCRLSummary(res *RotateCRLResult) string {
+	if res == nil {
+		return ""
+	}
+	status := "rotated"
+	if !res.Rotated {
+		status = "skipped, not due yet"
+	}
+	update := res.UpdateCRLResult
+	if update == nil {
+		update = &UpdateCRLResult{}
+	}
+	awsUpdated := "no"
+	if update.AWSUpdated {
+		awsUpdated = "yes"
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "CRL rotation of %s: %s\n", res.ClientVPNEndpointID, status)
+	fmt.Fprintf(&b, "Users: %d\n", update.TotalUsers)
+	fmt.Fprintf(&b, "Certificates revoked: %d\n", update.RevokedCount)
+	fmt.Fprintf(&b, "Certificates skipped: %d\n", update.SkippedCount)
+	fmt.Fprintf(&b, "AWS updated: %s\n", awsUpdated)
+	fmt.Fprintf(&b, "Duration: %s", res.Duration.Round(10*time.Millisecond))
+	return b.String()
+}
@@ -0,0 +1,215 @@
+package operations
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/logging"
+	"github.com/hashicorp/vault/api"
+)
+
+// Suspension records why, when and by whom a user was suspended
+type Suspension struct {
+	Reason      string    `json:"reason,omitempty"`
+	SuspendedBy string    `json:"suspended_by,omitempty"`
+	SuspendedAt time.Time `json:"suspended_at"`
+}
+
+// UserSuspendedError is returned when a certificate is requested
+// for a suspended user. It matches ErrUserSuspended.
+type UserSuspendedError struct {
+	Username   string
+	Suspension Suspension
+}
+
+// Unwrap returns ErrUserSuspended
+func (e *UserSuspendedError) Unwrap() error {
+	return ErrUserSuspended
+}
+
+func (e *UserSuspendedError) Error() string {
+	msg := fmt.Sprintf("user '%s' is suspended since %s", e.Username, e.Suspension.SuspendedAt.Format(time.RFC3339))
+	if e.Suspension.SuspendedBy != "" {
+		msg += ", by " + e.Suspension.SuspendedBy
+	}
+	if e.Suspension.Reason != "" {
+		msg += ": " + e.Suspension.Reason
+	}
+	return msg
+}
+
+// SuspendUserRequest is the structure containing the
+// required data to suspend a user
+type SuspendUserRequest struct {
+	Client              *api.Client
+	VaultPKIPath        string
+	ClientVPNEndpointID string
+	Username            string
+	// VaultKVPath is the kv store of the user's metadata, where the
+	// suspension is recorded along with the revocation reasons
+	VaultKVPath string
+	// Reason of the suspension, recorded in the metadata
+	Reason string
+	// RevocationReason of the revoked certificates. Defaults
+	// to ReasonPrivilegeWithdrawn.
+	RevocationReason RevocationReason
+	UpdateCRLOptions
+}
+
+// SuspendUserResult holds the outcome of a SuspendUser operation
+type SuspendUserResult struct {
+	Suspension Suspension
+	// Revoked are the serial numbers of the revoked certificates
+	Revoked []string
+	// UpdateCRLResult is the outcome of the CRL update that follows
+	// the revocations. Nil if nothing was revoked.
+	*UpdateCRLResult
+}
+
+// SuspendUser revokes all the current certificates of the user and marks
+// the user as suspended in its metadata, so no certificates are issued to
+// the user, and UpdateCRL keeps all of them revoked, until ReinstateUser.
+// Unlike removing the user, the config and metadata of the user are kept.
+// Suspending a suspended user keeps the original suspension and revokes
+// any certificate still active.
+func SuspendUser(r *SuspendUserRequest, suspendedBy string) (*SuspendUserResult, error) {
+	start := time.Now()
+	res, err := suspendUser(r, suspendedBy)
+	observe("suspend_user", start, err)
+	return res, err
+}
+
+func suspendUser(r *SuspendUserRequest, suspendedBy string) (*SuspendUserResult, error) {
+	r.Username = normalizeUsername(r.Username)
+	logger := logging.OrDefault(r.Logger).With("endpoint_id", r.ClientVPNEndpointID, "pki_path", r.VaultPKIPath, "user", r.Username)
+	reason := r.RevocationReason
+	if reason == "" {
+		reason = ReasonPrivilegeWithdrawn
+	}
+
+	if err := checkCapabilities(r.Client, r.UpdateCRLOptions, revokeCapabilities(r.VaultPKIPath)...); err != nil {
+		return nil, err
+	}
+
+	// Mark the user first, so no certificate is issued in the meantime
+	mdReq := &UserMetadataRequest{Client: r.Client, VaultKVPath: r.VaultKVPath, Username: r.Username, Retry: r.Retry}
+	md, err := GetUserMetadata(mdReq)
+	if err != nil {
+		return nil, vaultError(err)
+	}
+	if md.Suspension == nil {
+		md.Suspension = &Suspension{Reason: r.Reason, SuspendedBy: suspendedBy, SuspendedAt: time.Now().UTC()}
+		if err := writeUserMetadata(mdReq, md); err != nil {
+			return nil, vaultError(err)
+		}
+		logger.Info("suspended user", "reason", r.Reason, "suspended_by", suspendedBy)
+	}
+	result := &SuspendUserResult{Suspension: *md.Suspension}
+
+	users, err := ListUsers(
+		&ListUsersRequest{
+			Client:              r.Client,
+			VaultPKIPath:        r.VaultPKIPath,
+			ClientVPNEndpointID: r.ClientVPNEndpointID,
+			IssuerRef:           r.IssuerRef,
+			Prefix:              r.Username,
+			AdoptedKVPath:       r.AdoptedKVPath,
+			Retry:               r.Retry,
+			Logger:              r.Logger,
+		})
+	if err != nil {
+		return result, err
+	}
+	result.Revoked, err = revokeUserCertificates(r.Client, r.VaultPKIPath, users[r.Username],
+		revocationOptions{revokeAll: true, reason: reason, kvPath: r.VaultKVPath, logger: r.Logger,
+			retry: r.Retry, ctx: r.Context, audit: r.Audit, usersCache: r.UsersCache, configStore: r.ConfigStore, actor: r.Actor, endpointID: r.ClientVPNEndpointID})
+	if err != nil {
+		return result, err
+	}
+	if len(result.Revoked) == 0 {
+		return result, nil
+	}
+
+	result.UpdateCRLResult, err = UpdateCRL(
+		&UpdateCRLRequest{
+			Client:              r.Client,
+			VaultPKIPath:        r.VaultPKIPath,
+			ClientVPNEndpointID: r.ClientVPNEndpointID,
+			UpdateCRLOptions:    r.UpdateCRLOptions,
+		})
+	return result, err
+}
+
+// ReinstateUserRequest is the structure containing the
+// required data to reinstate a suspended user
+type ReinstateUserRequest struct {
+	Client      *api.Client
+	VaultKVPath string
+	Username    string
+	// Issue, if set, is used to issue a fresh certificate and VPN
+	// config to the user once reinstated. Its Username is ignored.
+	Issue  *IssueCertificateRequest
+	Logger logging.Logger
+}
+
+// ReinstateUserResult holds the outcome of a ReinstateUser operation
+type ReinstateUserResult struct {
+	// Suspension is the one that was lifted
+	Suspension Suspension
+	// Issued is the certificate issued when the request has Issue set
+	Issued *IssueCertificateResult
+}
+
+// ReinstateUser lifts the suspension of the user, see SuspendUser, and
+// optionally issues a fresh certificate to the user. The certificates
+// revoked on suspension stay revoked. Returns ErrUserNotSuspended if the
+// user is not suspended. The user remains reinstated if the issuance
+// fails, and the error is returned along with the result.
+func ReinstateUser(r *ReinstateUserRequest) (*ReinstateUserResult, error) {
+	start := time.Now()
+	res, err := reinstateUser(r)
+	observe("reinstate_user", start, err)
+	return res, err
+}
+
+func reinstateUser(r *ReinstateUserRequest) (*ReinstateUserResult, error) {
+	r.Username = normalizeUsername(r.Username)
+	mdReq := &UserMetadataRequest{Client: r.Client, VaultKVPath: r.VaultKVPath, Username: r.Username}
+	md, err := GetUserMetadata(mdReq)
+	if err != nil {
+		return nil, vaultError(err)
+	}
+	if md.Suspension == nil {
+		return nil, &Error{Kind: ErrUserNotSuspended, Err: fmt.Errorf("user '%s' is not suspended", r.Username)}
+	}
+	result := &ReinstateUserResult{Suspension: *md.Suspension}
+	md.Suspension = nil
+	if err := writeUserMetadata(mdReq, md); err != nil {
+		return nil, vaultError(err)
+	}
+	logging.OrDefault(r.Logger).Info("reinstated user", "user", r.Username)
+
+	if r.Issue == nil {
+		return result, nil
+	}
+	issue := *r.Issue
+	issue.Username = r.Username
+	result.Issued, err = IssueClientCertificate(&issue)
+	return result, err
+}
+
+// checkSuspended returns a *UserSuspendedError if the user is
+// suspended according to its metadata in the kv store
+func checkSuspended(client *api.Client, kv, username string) error {
+	if kv == "" {
+		return nil
+	}
+	md, err := GetUserMetadata(&UserMetadataRequest{Client: client, VaultKVPath: kv, Username: username})
+	if err != nil {
+		return vaultError(err)
+	}
+	if md.Suspension != nil {
+		return &UserSuspendedError{Username: username, Suspension: *md.Suspension}
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package operations
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/hashicorp/vault/api"
+)
+
+// CheckCRLSyncRequest is the structure containing the required data
+// to check whether the CRL of the endpoint is up to date
+type CheckCRLSyncRequest struct {
+	Client              *api.Client
+	VaultPKIPath        string
+	ClientVPNEndpointID string
+	UpdateCRLOptions
+}
+
+// CRLSyncStatus is the outcome of a CheckCRLSync operation
+type CRLSyncStatus struct {
+	// InSync is true if the endpoint has the current CRL of Vault
+	// and there are no superseded certificates pending revocation
+	InSync bool `json:"in_sync"`
+	// Diff are the entries of the Vault CRL that the endpoint is missing,
+	// as Added, and the ones it has that Vault dropped, as Removed
+	Diff *CRLDiff `json:"diff"`
+	// Pending are the serial numbers of the superseded certificates that
+	// UpdateCRL would revoke, keyed by username
+	Pending map[string][]string `json:"pending"`
+}
+
+// CheckCRLSync compares the CRL imported in the endpoint with the current
+// one in Vault, and looks for the superseded certificates, past the
+// RevocationGracePeriod, that are not revoked yet. Nothing is changed,
+// see UpdateCRL. The certificates of the suspended users are left out,
+// as they are revoked when suspended.
+func CheckCRLSync(r *CheckCRLSyncRequest) (*CRLSyncStatus, error) {
+	start := time.Now()
+	status, err := checkCRLSync(r)
+	observe("check_crl_sync", start, err)
+	return status, err
+}
+
+func checkCRLSync(r *CheckCRLSyncRequest) (*CRLSyncStatus, error) {
+	users, err := ListUsers(
+		&ListUsersRequest{
+			Client:              r.Client,
+			VaultPKIPath:        r.VaultPKIPath,
+			ClientVPNEndpointID: r.ClientVPNEndpointID,
+			IssuerRef:           r.IssuerRef,
+			AdoptedKVPath:       r.AdoptedKVPath,
+			Retry:               r.Retry,
+			Logger:              r.Logger,
+		})
+	if err != nil {
+		return nil, err
+	}
+	status := &CRLSyncStatus{Pending: map[string][]string{}}
+	for username, crts := range users {
+		if pending := supersededCertificates(crts, r.RevocationGracePeriod); len(pending) > 0 {
+			status.Pending[username] = pending
+		}
+	}
+
+	crl, err := GetCRL(
+		&GetCRLRequest{
+			Client:              r.Client,
+			VaultPKIPath:        r.VaultPKIPath,
+			Format:              CRLFormatPEM,
+			CRLPath:             r.CRLPath,
+			IssuerRef:           r.IssuerRef,
+			ClientVPNEndpointID: r.ClientVPNEndpointID,
+		})
+	if err != nil {
+		return nil, err
+	}
+	rsp, err := ec2Client(r.AWSConfig).ExportClientVpnClientCertificateRevocationList(
+		&ec2.ExportClientVpnClientCertificateRevocationListInput{
+			ClientVpnEndpointId: aws.String(r.ClientVPNEndpointID),
+		})
+	if err != nil {
+		return nil, awsError(err)
+	}
+	active := []byte(aws.StringValue(rsp.CertificateRevocationList))
+
+	owners := map[string]string{}
+	for username, crts := range users {
+		for _, crt := range crts {
+			owners[crt.SerialNumber] = username
+		}
+	}
+	status.Diff, err = diffCRL(active, crl, func(serial string) string { return owners[serial] })
+	if err != nil {
+		return nil, err
+	}
+	// The CRL is compared as a whole, as a newer CRL with the same
+	// entries still needs to be imported before the active one expires
+	status.InSync = bytes.Equal(bytes.TrimSpace(active), bytes.TrimSpace(crl)) && len(status.Pending) == 0
+	return status, nil
+}
+
+// supersededCertificates returns the serial numbers of the certificates,
+// sorted from oldest to newest, that revokeUserCertificates would revoke
+// as superseded by the latest one
+func supersededCertificates(crts []Certificate, grace time.Duration) []string {
+	keep := supersededKept(crts, grace)
+	if len(crts) <= keep {
+		return nil
+	}
+	var pending []string
+	for _, crt := range crts[:len(crts)-keep] {
+		if !crt.Revoked {
+			pending = append(pending, crt.SerialNumber)
+		}
+	}
+	return pending
+}
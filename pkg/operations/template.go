@@ -0,0 +1,79 @@
+package operations
+
+import (
+	"bytes"
+	"path"
+	"text/template"
+)
+
+// DefaultConfigTemplate is the OpenVPN config template
+// used when no custom template is configured
+const DefaultConfigTemplate = `client
+dev tun
+proto udp
+remote {{.Username}}.{{.EndpointDNS}} 443
+remote-random-hostname
+resolv-retry infinite
+nobind
+persist-key
+persist-tun
+remote-cert-tls server
+cipher AES-256-GCM
+verb 3
+reneg-sec 0
+
+<ca>
+{{.CAChain}}
+</ca>
+
+<cert>
+{{.Cert}}
+</cert>
+
+<key>
+{{.Key}}
+</key>
+`
+
+// ConfigTemplateData holds the fields available to the OpenVPN config
+// template. DNSName, CA, Certificate and PrivateKey are kept for
+// compatibility with templates written for previous versions.
+type ConfigTemplateData struct {
+	Username    string
+	EndpointDNS string
+	CAChain     string
+	Cert        string
+	Key         string
+	DNSName     string
+	CA          string
+	Certificate string
+	PrivateKey  string
+}
+
+// LoadConfigTemplate parses the OpenVPN config template. The template
+// text takes precedence over the template file path. If both are empty
+// the DefaultConfigTemplate is used. The template is rendered with
+// sample data so errors that only show up at execution time also
+// surface here.
+func LoadConfigTemplate(tplPath, text string) (*template.Template, error) {
+	var tpl *template.Template
+	var err error
+
+	switch {
+	case text != "":
+		tpl, err = template.New("config.ovpn").Option("missingkey=error").Parse(text)
+	case tplPath != "":
+		tpl, err = template.New(path.Base(tplPath)).Option("missingkey=error").ParseFiles(tplPath)
+	default:
+		tpl, err = template.New("config.ovpn").Option("missingkey=error").Parse(DefaultConfigTemplate)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tpl.Execute(&bytes.Buffer{}, ConfigTemplateData{}); err != nil {
+		return nil, err
+	}
+
+	return tpl, nil
+}
@@ -0,0 +1,98 @@
+package operations
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// block returns the content of the inline file of the OpenVPN config
+func block(t *testing.T, config, tag string) string {
+	t.Helper()
+	m := regexp.MustCompile(`(?s)<` + tag + `>\n(.*?)\n</` + tag + `>`).FindStringSubmatch(config)
+	if m == nil {
+		t.Fatalf("no <%s> block in the config:\n%s", tag, config)
+	}
+	return m[1]
+}
+
+func TestRenderConfigTemplate(t *testing.T) {
+	useFakeEC2(t, "cvpn-endpoint-0873f24b07b72b3ee", "*.cvpn-endpoint-0873f24b07b72b3ee.prod.clientvpn.us-east-1.amazonaws.com")
+	root := newTestCert(t, "Root CA", nil, true)
+	intermediate := newTestCert(t, "Intermediate CA", root, true)
+	client := newTestCert(t, "alice", intermediate, false)
+	// Vault returns the PEMs without the trailing newline
+	pem := func(c string) string { return strings.TrimSuffix(c, "\n") }
+	crt := &IssueCertificateResult{
+		Certificate: pem(client.pem),
+		PrivateKey:  pem(client.keyPEM),
+		CAChain:     []string{pem(root.pem), pem(intermediate.pem)},
+	}
+
+	custom := "remote {{.DNSName}}\n<ca>\n{{.CA}}\n</ca>\n<cert>\n{{.Certificate}}\n</cert>\n<key>\n{{.PrivateKey}}\n</key>\n"
+	path := filepath.Join(t.TempDir(), "custom.ovpn.tpl")
+	if err := ioutil.WriteFile(path, []byte(custom), 0600); err != nil {
+		t.Fatal(err)
+	}
+	text, err := LoadConfigTemplate("", custom)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		req    IssueCertificateRequest
+		remote string
+	}{
+		{"built-in", IssueCertificateRequest{}, "remote alice.cvpn-endpoint-0873f24b07b72b3ee.prod.clientvpn.us-east-1.amazonaws.com 443"},
+		{"custom text", IssueCertificateRequest{CfgTemplate: text}, "remote cvpn-endpoint-0873f24b07b72b3ee.prod.clientvpn.us-east-1.amazonaws.com"},
+		{"custom file", IssueCertificateRequest{CfgTplPath: path}, "remote cvpn-endpoint-0873f24b07b72b3ee.prod.clientvpn.us-east-1.amazonaws.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.req.Username = "alice"
+			tt.req.ClientVPNEndpointID = "cvpn-endpoint-0873f24b07b72b3ee"
+			config, err := renderConfigTemplate(&tt.req, crt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(config, tt.remote+"\n") {
+				t.Errorf("no %q in the config:\n%s", tt.remote, config)
+			}
+			for tag, want := range map[string]string{
+				"cert": pem(client.pem),
+				"key":  pem(client.keyPEM),
+				"ca":   root.pem + pem(intermediate.pem),
+			} {
+				if got := block(t, config, tag); got != want {
+					t.Errorf("got <%s>\n%s\nwant\n%s", tag, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadConfigTemplateErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{"parse error", "{{if .Cert}}\n<cert>\n{{.Cert}}\n</cert>\n", "config.ovpn:5: unexpected EOF"},
+		{"unknown field", "<cert>\n{{.Certs}}\n</cert>", "can't evaluate field Certs"},
+		{"unknown function", "{{upper .Cert}}", `function "upper" not defined`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadConfigTemplate("", tt.text)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got error %v, want %q", err, tt.want)
+			}
+		})
+	}
+	if _, err := LoadConfigTemplate(filepath.Join(t.TempDir(), "missing.tpl"), ""); err == nil {
+		t.Error("missing template file accepted")
+	}
+}
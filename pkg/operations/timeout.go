@@ -0,0 +1,144 @@
+package operations
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	// DefaultVaultTimeout is how long a Vault call can take
+	DefaultVaultTimeout = time.Minute
+	// DefaultAWSTimeout is how long an AWS call can take
+	DefaultAWSTimeout = time.Minute
+	// DefaultOperationTimeout is how long UpdateCRL, RotateCRL,
+	// IssueClientCertificate or RevokeUser can take as a whole, waiting
+	// for the lock of the endpoint included
+	DefaultOperationTimeout = 15 * time.Minute
+)
+
+// TimeoutError is returned when a Vault or AWS call, or the whole
+// operation, didn't complete in time. It matches ErrTimeout.
+type TimeoutError struct {
+	// Operation is the operation whose timeout was reached, e.g.
+	// update_crl. Empty if it was the timeout of the call.
+	Operation string
+	// Stage is the call that was running, e.g. vault_revoke or import_crl
+	Stage   string
+	Timeout time.Duration
+}
+
+// Unwrap returns ErrTimeout
+func (e *TimeoutError) Unwrap() error {
+	return ErrTimeout
+}
+
+func (e *TimeoutError) Error() string {
+	if e.Operation != "" {
+		return fmt.Sprintf("%s timed out after %s during %s", e.Operation, e.Timeout, e.Stage)
+	}
+	return fmt.Sprintf("%s timed out after %s", e.Stage, e.Timeout)
+}
+
+// callKind tells which of the timeouts applies to a call
+type callKind int
+
+const (
+	vaultCall callKind = iota
+	awsCall
+)
+
+// operation holds the timeouts of a running operation, kept
+// in its context so they reach all the calls it makes
+type operation struct {
+	name    string
+	timeout time.Duration
+	vault   time.Duration
+	aws     time.Duration
+}
+
+type operationKey struct{}
+
+// startOperation returns the context of the operation, derived from
+// opts.Context, which is done once opts.OperationTimeout is reached.
+// An operation started by another one, as UpdateCRL by RotateCRL,
+// runs within the timeout of the outer one.
+func startOperation(opts UpdateCRLOptions, name string) (context.Context, context.CancelFunc) {
+	parent := opts.Context
+	if parent == nil {
+		parent = context.Background()
+	}
+	if _, ok := parent.Value(operationKey{}).(*operation); ok {
+		return context.WithCancel(parent)
+	}
+	op := &operation{name: name, timeout: opts.OperationTimeout, vault: opts.VaultTimeout, aws: opts.AWSTimeout}
+	if op.timeout <= 0 {
+		op.timeout = DefaultOperationTimeout
+	}
+	if op.vault <= 0 {
+		op.vault = DefaultVaultTimeout
+	}
+	if op.aws <= 0 {
+		op.aws = DefaultAWSTimeout
+	}
+	ctx, cancel := context.WithTimeout(parent, op.timeout)
+	return context.WithValue(ctx, operationKey{}, op), cancel
+}
+
+// withTimeout runs fn with a context that is done once the timeout of the
+// call is reached, returning a *TimeoutError right away if it doesn't
+// complete in time. The Vault client takes no context, so a Vault call
+// that times out is left to complete in the background: fn must not
+// write anything the caller reads after an error.
+func withTimeout(ctx context.Context, stage string, kind callKind, fn func(ctx context.Context) error) error {
+	timeout := DefaultVaultTimeout
+	if kind == awsCall {
+		timeout = DefaultAWSTimeout
+	}
+	if op, ok := ctx.Value(operationKey{}).(*operation); ok {
+		timeout = op.vault
+		if kind == awsCall {
+			timeout = op.aws
+		}
+	}
+	callCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() { done <- fn(callCtx) }()
+	select {
+	case err := <-done:
+		if err != nil && callCtx.Err() != nil {
+			return timeoutError(ctx, stage, timeout)
+		}
+		return err
+	case <-callCtx.Done():
+		return timeoutError(ctx, stage, timeout)
+	}
+}
+
+// timeoutError returns the error of the call whose context is done,
+// which is a *TimeoutError of the operation if the context of the
+// operation is done too, or of the call otherwise
+func timeoutError(ctx context.Context, stage string, timeout time.Duration) error {
+	switch err := ctx.Err(); {
+	case err == nil:
+		return &TimeoutError{Stage: stage, Timeout: timeout}
+	case errors.Is(err, context.DeadlineExceeded):
+		return contextError(ctx, stage)
+	default:
+		return err
+	}
+}
+
+// contextError returns the error of the done context of an operation,
+// as a *TimeoutError if its timeout was reached during the stage
+func contextError(ctx context.Context, stage string) error {
+	err := ctx.Err()
+	op, ok := ctx.Value(operationKey{}).(*operation)
+	if !ok || !errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+	return &TimeoutError{Operation: op.name, Stage: stage, Timeout: op.timeout}
+}
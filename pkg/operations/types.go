@@ -12,4 +12,12 @@ type Certificate struct {
 	NotAfter       time.Time `json:"notAfter"`
 	Revoked        bool      `json:"revoked"`
 	CertificatePEM string    `json:"certificate-pem"`
+	VaultPKIPath   string    `json:"vault-pki-path"`
+	// RevocationTime is when the certificate was revoked in Vault
+	RevocationTime *time.Time `json:"revocation-time,omitempty"`
+	// RevocationReason is only set when the reason has been recorded
+	RevocationReason RevocationReason `json:"revocation-reason,omitempty"`
+	// KeyNotRetained is set if the private key was not stored on
+	// issuance, only when read along with the user's metadata
+	KeyNotRetained bool `json:"key-not-retained,omitempty"`
 }
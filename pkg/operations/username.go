@@ -0,0 +1,122 @@
+package operations
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// UsernameRule sets how the username of a VPN user is extracted from
+// the CN of their certificates, which is how certificates are grouped
+// by user. The zero value keeps the part of the CN before the first
+// '@', so both 'alice' and 'alice@corp.com' belong to 'alice'.
+type UsernameRule struct {
+	// Regexp, if set, is matched against the CN and its first capture
+	// group, or the one named 'username', is the username. For example
+	// '^CN=([^,]+)' for CNs like 'CN=alice,OU=eng'. CNs that don't
+	// match are used as is.
+	Regexp string
+	// TrimPrefix and TrimSuffix are removed from the CN, after
+	// applying Regexp if set
+	TrimPrefix string
+	TrimSuffix string
+	// Normalize trims the spaces around the usernames and lowercases
+	// them, both the ones extracted from the CNs and the ones
+	// certificates are issued for, so 'JSmith' and 'jsmith ' are the
+	// same user as 'jsmith'
+	Normalize bool
+	// Pattern, if set, is a regexp the usernames have to match, once
+	// normalized, to be issued certificates for
+	Pattern string
+}
+
+type compiledUsernameRule struct {
+	UsernameRule
+	re      *regexp.Regexp
+	pattern *regexp.Regexp
+}
+
+var usernameRule *compiledUsernameRule
+
+// SetUsernameRule changes how the usernames are extracted from the
+// CNs of the certificates. It fails if the Regexp does not compile
+// or has no capture group, or if the Pattern does not compile.
+func SetUsernameRule(rule UsernameRule) error {
+	if rule == (UsernameRule{}) {
+		usernameRule = nil
+		return nil
+	}
+	c := &compiledUsernameRule{UsernameRule: rule}
+	if rule.Regexp != "" {
+		re, err := regexp.Compile(rule.Regexp)
+		if err != nil {
+			return err
+		}
+		if re.NumSubexp() == 0 {
+			return fmt.Errorf("the username regexp '%s' has no capture group", rule.Regexp)
+		}
+		c.re = re
+	}
+	if rule.Pattern != "" {
+		pattern, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return err
+		}
+		c.pattern = pattern
+	}
+	usernameRule = c
+	return nil
+}
+
+// NormalizeUsername returns the username certificates are issued for
+// as the given one, normalized following the username rule. A name
+// that is empty or doesn't match the rule's Pattern is rejected with
+// an error matching ErrInvalidUsername.
+func NormalizeUsername(username string) (string, error) {
+	username = normalizeUsername(username)
+	if username == "" {
+		return "", &Error{Kind: ErrInvalidUsername, Err: errors.New("the username can't be empty")}
+	}
+	if usernameRule != nil && usernameRule.pattern != nil && !usernameRule.pattern.MatchString(username) {
+		return "", &Error{Kind: ErrInvalidUsername,
+			Err: fmt.Errorf("the username '%s' doesn't match '%s'", username, usernameRule.Pattern)}
+	}
+	return username, nil
+}
+
+func normalizeUsername(username string) string {
+	if usernameRule == nil || !usernameRule.Normalize {
+		return username
+	}
+	return strings.ToLower(strings.TrimSpace(username))
+}
+
+// usernameFromCN extracts the username from a certificate's common name
+func usernameFromCN(cn string) string {
+	rule := usernameRule
+	if rule == nil || (rule.Regexp == "" && rule.TrimPrefix == "" && rule.TrimSuffix == "") {
+		return normalizeUsername(strings.Split(cn, "@")[0])
+	}
+
+	username := cn
+	if re := rule.re; re != nil {
+		if m := re.FindStringSubmatch(cn); m != nil {
+			username = usernameFromMatch(re, m)
+		}
+	}
+	username = strings.TrimPrefix(username, rule.TrimPrefix)
+	return normalizeUsername(strings.TrimSuffix(username, rule.TrimSuffix))
+}
+
+// usernameFromMatch returns the first capture group of the
+// match, or the one named 'username'
+func usernameFromMatch(re *regexp.Regexp, m []string) string {
+	username := m[1]
+	for i, name := range re.SubexpNames() {
+		if name == "username" {
+			username = m[i]
+		}
+	}
+	return username
+}
@@ -0,0 +1,91 @@
+package operations
+
+import (
+	"errors"
+	"testing"
+)
+
+// useUsernameRule sets the username rule until the test is done
+func useUsernameRule(t *testing.T, rule UsernameRule) {
+	t.Helper()
+	if err := SetUsernameRule(rule); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { SetUsernameRule(UsernameRule{}) })
+}
+
+func TestUsernameFromCN(t *testing.T) {
+	tests := []struct {
+		name string
+		rule UsernameRule
+		want map[string]string
+	}{
+		{
+			"default", UsernameRule{},
+			map[string]string{"alice": "alice", "alice@corp.com": "alice", "CN=alice,OU=eng": "CN=alice,OU=eng", "Alice ": "Alice "},
+		},
+		{
+			"normalized", UsernameRule{Normalize: true},
+			map[string]string{"alice": "alice", "Alice@corp.com": "alice", " ALICE ": "alice"},
+		},
+		{
+			"regexp", UsernameRule{Regexp: `^CN=([^,]+)`},
+			map[string]string{"alice": "alice", "alice@corp.com": "alice@corp.com", "CN=alice,OU=eng": "alice"},
+		},
+		{
+			"named group", UsernameRule{Regexp: `^(CN|UID)=(?P<username>[^,]+)`},
+			map[string]string{"CN=alice,OU=eng": "alice", "UID=bob": "bob", "alice": "alice"},
+		},
+		{
+			"trim suffix", UsernameRule{TrimSuffix: "@corp.com"},
+			map[string]string{"alice": "alice", "alice@corp.com": "alice", "alice@other.com": "alice@other.com", "CN=alice,OU=eng": "CN=alice,OU=eng"},
+		},
+		{
+			"trim prefix", UsernameRule{TrimPrefix: "vpn-"},
+			map[string]string{"vpn-alice": "alice", "alice": "alice", "alice@corp.com": "alice@corp.com"},
+		},
+		{
+			"regexp then trim", UsernameRule{Regexp: `^CN=([^,]+)`, TrimSuffix: "@corp.com", Normalize: true},
+			map[string]string{"CN=Alice@corp.com,OU=eng": "alice", "alice@corp.com": "alice", "alice": "alice"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useUsernameRule(t, tt.rule)
+			for cn, want := range tt.want {
+				if got := usernameFromCN(cn); got != want {
+					t.Errorf("usernameFromCN(%q) = %q, want %q", cn, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestSetUsernameRuleErrors(t *testing.T) {
+	for _, rule := range []UsernameRule{{Regexp: "^CN=("}, {Regexp: "^CN=.+"}, {Pattern: "[a-z"}} {
+		if err := SetUsernameRule(rule); err == nil {
+			t.Errorf("rule %+v accepted", rule)
+		}
+	}
+	SetUsernameRule(UsernameRule{})
+}
+
+func TestNormalizeUsername(t *testing.T) {
+	useUsernameRule(t, UsernameRule{Normalize: true, Pattern: `^[a-z][a-z0-9.-]*$`})
+	tests := []struct {
+		username string
+		want     string
+		invalid  bool
+	}{
+		{"alice", "alice", false},
+		{" J.Smith ", "j.smith", false},
+		{"  ", "", true},
+		{"alice@corp.com", "", true},
+	}
+	for _, tt := range tests {
+		got, err := NormalizeUsername(tt.username)
+		if tt.invalid != errors.Is(err, ErrInvalidUsername) || got != tt.want {
+			t.Errorf("NormalizeUsername(%q) = %q, %v", tt.username, got, err)
+		}
+	}
+}
@@ -2,12 +2,18 @@ package operations
 
 import (
 	"bytes"
+	"context"
 	"crypto/x509"
+	"encoding/json"
 	"encoding/pem"
 	"fmt"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/logging"
 	"github.com/hashicorp/vault/api"
 	"github.com/pkg/errors"
 )
@@ -18,77 +24,473 @@ type ListUsersRequest struct {
 	Client              *api.Client
 	VaultPKIPath        string
 	ClientVPNEndpointID string
+	// IssuerRef, if set, restricts the listing to the
+	// certificates issued by this issuer of the mount
+	IssuerRef string
+	// Prefix, if set, only lists the users whose username starts with it
+	Prefix string
+	// Search, if set, only lists the users whose username
+	// contains it, ignoring the case
+	Search string
+	// ActiveOnly drops the users without any active certificate,
+	// that is, with all of them revoked or expired
+	ActiveOnly bool
+	// AdoptedKVPath, if set, is the kv store where the certificates
+	// adopted with Adopt are looked up, to list them under their users
+	AdoptedKVPath string
+	// VaultKVPath, if set, is used to fill in the
+	// revocation reason of the revoked certificates
+	VaultKVPath string
+	// Cache, if set, keeps the listing of all the users, which the
+	// filters are applied to. Refresh lists them from Vault anyway.
+	Cache   *UsersCache
+	Refresh bool
+	// Index, if set, is used to only read from Vault the
+	// certificates issued since the previous listing
+	Index *CertificateIndex
+	// SkipExpired leaves out the expired certificates, which
+	// are not even looked at if they are in the Index
+	SkipExpired bool
+	// Context, if set, stops waiting for the rate
+	// limiter of Vault once done, see SetVaultRateLimit
+	Context context.Context
+	// Retry is the policy each of the Vault calls of the listing
+	// is retried with, see UpdateCRLOptions
+	Retry  *RetryPolicy
+	Logger logging.Logger
 }
 
-// ListUsers retrieves the list of all Client VPN users and certificates
+// ListUsers retrieves the list of all Client VPN users and certificates.
+// Vault only lists the serial numbers, so all the certificates still need
+// to be read to find out their user, but the ones of the users filtered
+// out are discarded as they are read, unless the request has a Cache.
 func ListUsers(r *ListUsersRequest) (map[string][]Certificate, error) {
+	if r.Cache == nil {
+		return listUsers(r)
+	}
+	all := *r
+	all.Prefix, all.Search, all.ActiveOnly, all.Cache = "", "", false, nil
+	key := strings.Join([]string{r.VaultPKIPath, r.IssuerRef, r.AdoptedKVPath, r.VaultKVPath, strconv.FormatBool(r.SkipExpired)}, "\x00")
+	cached, err := r.Cache.get(key, r.Refresh, func() (map[string][]Certificate, error) { return listUsers(&all) })
+	if err != nil {
+		return nil, err
+	}
+	users := map[string][]Certificate{}
+	for username, crts := range cached {
+		if r.matches(username) && (!r.ActiveOnly || len(activeCertificates(crts)) > 0) {
+			users[username] = crts
+		}
+	}
+	return users, nil
+}
+
+// matches returns true if the user is not filtered out by the
+// Prefix and Search of the request
+func (r *ListUsersRequest) matches(username string) bool {
+	return strings.HasPrefix(username, r.Prefix) &&
+		(r.Search == "" || strings.Contains(strings.ToLower(username), strings.ToLower(r.Search)))
+}
+
+func listUsers(r *ListUsersRequest) (map[string][]Certificate, error) {
 	users := map[string][]Certificate{}
 
-	secret, err := r.Client.Logical().List(fmt.Sprintf("%s/certs", r.VaultPKIPath))
+	start := time.Now()
+	adopted := map[string]string{}
+	if r.AdoptedKVPath != "" {
+		var err error
+		err = retry(r.Context, r.Retry, r.Logger, "load_adopted", vaultCall, func(context.Context) (err error) {
+			adopted, err = loadAdopted(r.Client, r.AdoptedKVPath)
+			return err
+		})
+		if err != nil {
+			observe("list_users", start, err)
+			return nil, err
+		}
+	}
+	opts := walkOptions{index: r.Index, skipExpired: r.SkipExpired, ctx: r.Context, retry: r.Retry, logger: r.Logger}
+	err := walkCertificatesWith(r.Client, r.VaultPKIPath, r.IssuerRef, opts, func(crt Certificate) error {
+		username := certificateUsername(adopted, crt)
+		if !r.matches(username) {
+			return nil
+		}
+		if crt.Revoked && r.VaultKVPath != "" {
+			var reason RevocationReason
+			err := retry(r.Context, r.Retry, r.Logger, "get_revocation_reason", vaultCall, func(context.Context) (err error) {
+				reason, err = getRevocationReason(r.Client, r.VaultKVPath, crt.SerialNumber)
+				return vaultError(err)
+			})
+			if err != nil {
+				return err
+			}
+			crt.RevocationReason = reason
+		}
+		users[username] = append(users[username], crt)
+		return nil
+	})
+	observe("list_users", start, err)
 	if err != nil {
 		return nil, err
 	}
 
-	// Get the updated CRL
-	crl, err := GetCRL(
-		&GetCRLRequest{
-			Client:       r.Client,
-			VaultPKIPath: r.VaultPKIPath,
+	if r.ActiveOnly {
+		for username, crts := range users {
+			if len(activeCertificates(crts)) == 0 {
+				delete(users, username)
+			}
+		}
+	}
+
+	// Sort the arrays but notBefore date (which should be the
+	// date the certificate was emitted at)
+	for _, crts := range users {
+		sort.Slice(crts, func(i, j int) bool {
+			return crts[i].NotBefore.Before(crts[j].NotBefore)
 		})
+	}
+
+	return users, nil
+}
+
+// UserSort is the order of the users in a UsersPage
+type UserSort string
+
+const (
+	// UserSortUsername sorts the users alphabetically
+	UserSortUsername UserSort = "username"
+	// UserSortLastIssued sorts the users by the issuance date
+	// of their latest certificate, most recent first
+	UserSortLastIssued UserSort = "last-issued"
+)
+
+// ListUsersPageRequest is the structure containing the
+// required data to list a page of the users
+type ListUsersPageRequest struct {
+	ListUsersRequest
+	// Sort defaults to UserSortUsername
+	Sort UserSort
+	// Offset is the number of users, in Sort order, to skip
+	Offset int
+	// Limit is the maximum number of users in the page. No limit if 0.
+	Limit int
+}
+
+// UserCertificates holds the certificates of a user, oldest first
+type UserCertificates struct {
+	Username     string        `json:"username"`
+	Certificates []Certificate `json:"certificates"`
+	// Suspension is set if the user is suspended. Only filled
+	// in when the request has the VaultKVPath.
+	Suspension *Suspension `json:"suspension,omitempty"`
+}
+
+// UsersPage is a page of the users matching a ListUsersPageRequest
+type UsersPage struct {
+	Users []UserCertificates `json:"users"`
+	// Total is the number of users matching the filters, in all the pages
+	Total int `json:"total"`
+	// NextOffset is the Offset of the next page, 0 if this is the last one
+	NextOffset int `json:"next-offset,omitempty"`
+}
+
+// ListUsersPage behaves as ListUsers but returns the users sorted
+// and paginated
+func ListUsersPage(r *ListUsersPageRequest) (*UsersPage, error) {
+	switch r.Sort {
+	case "", UserSortUsername, UserSortLastIssued:
+	default:
+		return nil, fmt.Errorf("unknown sort order '%s'", r.Sort)
+	}
+	if r.Offset < 0 || r.Limit < 0 {
+		return nil, errors.New("offset and limit can't be negative")
+	}
+
+	users, err := ListUsers(&r.ListUsersRequest)
 	if err != nil {
 		return nil, err
 	}
 
-	for _, key := range secret.Data["keys"].([]interface{}) {
-		secret, err := r.Client.Logical().Read(fmt.Sprintf("%s/cert/%s", r.VaultPKIPath, key))
-		if err != nil {
-			return nil, err
+	all := make([]UserCertificates, 0, len(users))
+	for username, crts := range users {
+		all = append(all, UserCertificates{Username: username, Certificates: crts})
+	}
+	sort.Slice(all, func(i, j int) bool {
+		if r.Sort == UserSortLastIssued {
+			// The certificates are sorted oldest first
+			a := all[i].Certificates[len(all[i].Certificates)-1].NotBefore
+			b := all[j].Certificates[len(all[j].Certificates)-1].NotBefore
+			if !a.Equal(b) {
+				return a.After(b)
+			}
 		}
-		rawCert := secret.Data["certificate"].(string)
-		block, _ := pem.Decode([]byte(rawCert))
-		if block == nil {
-			return nil, errors.Wrapf(err, "failed to parse certificate PEM")
+		return all[i].Username < all[j].Username
+	})
+
+	page := &UsersPage{Users: []UserCertificates{}, Total: len(all)}
+	if r.Offset >= len(all) {
+		return page, nil
+	}
+	end := len(all)
+	if r.Limit > 0 && r.Offset+r.Limit < end {
+		end = r.Offset + r.Limit
+		page.NextOffset = end
+	}
+	page.Users = all[r.Offset:end]
+
+	// Only the metadata of the users in the page is read
+	if r.VaultKVPath != "" {
+		for i := range page.Users {
+			md, err := GetUserMetadata(&UserMetadataRequest{Client: r.Client, VaultKVPath: r.VaultKVPath, Username: page.Users[i].Username})
+			if err != nil {
+				return nil, vaultError(err)
+			}
+			page.Users[i].Suspension = md.Suspension
 		}
+	}
+
+	return page, nil
+}
+
+// DefaultListUsersConcurrency is the default number of
+// PKI paths listed at the same time by ListUsersMultiPath
+const DefaultListUsersConcurrency = 4
+
+// ListUsersMultiPathRequest is the structure containing the
+// required data to list the users of several PKI paths
+type ListUsersMultiPathRequest struct {
+	// ListUsersRequest is the listing of each of the paths,
+	// its VaultPKIPath being replaced by each of VaultPKIPaths
+	ListUsersRequest
+	VaultPKIPaths []string
+	// Concurrency is the number of paths listed at the
+	// same time. Defaults to DefaultListUsersConcurrency.
+	Concurrency int
+}
+
+// PathUsers holds the users of a single PKI path, or the
+// error found while listing them
+type PathUsers struct {
+	Users map[string][]Certificate `json:"users,omitempty"`
+	Error error                    `json:"-"`
+	// ErrorMessage is the message of Error, if any
+	ErrorMessage string `json:"error,omitempty"`
+}
+
+// ListUsersMultiPath lists the users of each of the given PKI paths
+// concurrently. The returned map is keyed by PKI path. A failure in one
+// of the paths is reported in its PathUsers.Error and does not prevent
+// the users of the other paths from being listed.
+func ListUsersMultiPath(r *ListUsersMultiPathRequest) map[string]*PathUsers {
+	result := map[string]*PathUsers{}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	concurrency := r.Concurrency
+	if concurrency <= 0 {
+		concurrency = DefaultListUsersConcurrency
+	}
+	jobs := make(chan string)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for path := range jobs {
+				req := r.ListUsersRequest
+				req.VaultPKIPath = path
+				pu := &PathUsers{}
+				pu.Users, pu.Error = ListUsers(&req)
+				if pu.Error != nil {
+					pu.ErrorMessage = pu.Error.Error()
+				}
+				mu.Lock()
+				result[path] = pu
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, path := range r.VaultPKIPaths {
+		jobs <- path
+	}
+	close(jobs)
+	wg.Wait()
 
-		cert, err := x509.ParseCertificate(block.Bytes)
+	return result
+}
+
+// revocationTime returns the revocation time of a certificate
+// read from Vault, or nil if it has not been revoked
+func revocationTime(secret *api.Secret) *time.Time {
+	rt, ok := secret.Data["revocation_time"].(json.Number)
+	if !ok {
+		return nil
+	}
+	ts, err := rt.Int64()
+	if err != nil || ts <= 0 {
+		return nil
+	}
+	t := time.Unix(ts, 0).Local()
+	return &t
+}
+
+// walkCertificates calls fn for each of the client certificates stored
+// in the PKI, one at a time, so callers don't need to hold all of them
+// in memory. CA and server certificates are skipped. If issuerRef is
+// set, so are the certificates issued by the other issuers of the mount,
+// and the revocation status is checked against the issuer's CRL.
+func walkCertificates(client *api.Client, pki, issuerRef string, fn func(Certificate) error) error {
+	return walkCertificatesWith(client, pki, issuerRef, walkOptions{}, fn)
+}
+
+// walkOptions are the optional settings of walkCertificatesWith
+type walkOptions struct {
+	// index, if set, is where the certificates are looked up before
+	// reading them from Vault, and stored once read
+	index *CertificateIndex
+	// skipExpired leaves out the expired certificates
+	skipExpired bool
+	// ctx, if set, stops waiting for the rate limiter of Vault once done
+	ctx context.Context
+	// retry is the policy each of the Vault calls is retried with
+	retry  *RetryPolicy
+	logger logging.Logger
+}
+
+// walkCertificatesWith behaves as walkCertificates, only reading from
+// Vault the certificates missing in the index of the options, if any
+func walkCertificatesWith(client *api.Client, pki, issuerRef string, opts walkOptions, fn func(Certificate) error) error {
+
+	var secret *api.Secret
+	err := retry(opts.ctx, opts.retry, opts.logger, "list_certs", vaultCall, func(context.Context) (err error) {
+		secret, err = client.Logical().List(fmt.Sprintf("%s/certs", pki))
+		return vaultError(err)
+	})
+	if err != nil {
+		return err
+	}
+
+	// Get the updated CRL
+	var crl []byte
+	err = retry(opts.ctx, opts.retry, opts.logger, "get_crl", vaultCall, func(context.Context) (err error) {
+		crl, err = GetCRL(
+			&GetCRLRequest{
+				Client:       client,
+				VaultPKIPath: pki,
+				IssuerRef:    issuerRef,
+			})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	revocations, err := crlEntries(crl)
+	if err != nil {
+		return err
+	}
+
+	var issuer *x509.Certificate
+	if issuerRef != "" {
+		err = retry(opts.ctx, opts.retry, opts.logger, "get_issuer", vaultCall, func(context.Context) (err error) {
+			issuer, err = getIssuer(client, pki, issuerRef)
+			return err
+		})
 		if err != nil {
-			return nil, errors.Wrapf(err, "failed to parse certificate")
+			return err
+		}
+	}
+
+	keys := secret.Data["keys"].([]interface{})
+	listed := make(map[string]bool, len(keys))
+	now := time.Now()
+	for _, key := range keys {
+		k := fmt.Sprint(key)
+		listed[k] = true
+		entry, indexed := opts.index.lookup(pki, k)
+		if !indexed {
+			err = retry(opts.ctx, opts.retry, opts.logger, "read_cert", vaultCall, func(context.Context) (err error) {
+				entry, err = readCertificate(client, pki, k)
+				return err
+			})
+			if err != nil {
+				return err
+			}
+			opts.index.store(pki, k, entry)
 		}
 
-		if cert.IsCA == true || isServerCertificate(cert) == true {
+		if !entry.client {
 			// Do not list the CA
 			continue
 		}
+		if issuer != nil && !bytes.Equal(entry.rawIssuer, issuer.RawSubject) {
+			continue
+		}
+		if opts.skipExpired && entry.crt.NotAfter.Before(now) {
+			continue
+		}
 
-		notBefore := cert.NotBefore.Local()
-		notAfter := cert.NotAfter.Local()
-		serial := strings.TrimSpace(getHexFormatted(cert.SerialNumber.Bytes(), "-"))
-		revoked, err := isRevoked(serial, crl)
-		if err != nil {
-			return nil, err
+		crt := entry.crt
+		rt, revoked := revocations[crt.SerialNumber]
+		crt.Revoked = revoked
+		if indexed {
+			// The certificate may have been revoked since it was indexed
+			crt.RevocationTime = nil
+			if revoked {
+				rt = rt.Local()
+				crt.RevocationTime = &rt
+			}
 		}
+		if err := fn(crt); err != nil {
+			return err
+		}
+	}
+	opts.index.prune(pki, listed)
 
-		username := strings.Split(cert.Subject.CommonName, "@")[0]
-		users[username] = append(users[username], Certificate{
-			serial,
-			cert.Issuer.CommonName,
-			cert.Subject.CommonName,
-			notBefore,
-			notAfter,
-			revoked,
-			rawCert,
-		})
+	return nil
+}
+
+// readCertificate reads and parses the certificate stored under
+// the key of the PKI, which is its serial number
+func readCertificate(client *api.Client, pki, key string) (*indexedCertificate, error) {
+	secret, err := client.Logical().Read(fmt.Sprintf("%s/cert/%s", pki, key))
+	if err != nil {
+		return nil, vaultError(err)
+	}
+	rawCert := secret.Data["certificate"].(string)
+	block, _ := pem.Decode([]byte(rawCert))
+	if block == nil {
+		return nil, fmt.Errorf("failed to parse certificate PEM of '%s'", key)
 	}
 
-	// Sort the arrays but notBefore date (which should be the
-	// date the certificate was emitted at)
-	for _, crts := range users {
-		sort.Slice(crts, func(i, j int) bool {
-			return crts[i].NotBefore.Before(crts[j].NotBefore)
-		})
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse certificate")
 	}
 
-	return users, nil
+	return &indexedCertificate{
+		client:    !cert.IsCA && !isServerCertificate(cert),
+		rawIssuer: cert.RawIssuer,
+		crt: Certificate{
+			SerialNumber:   strings.TrimSpace(getHexFormatted(cert.SerialNumber.Bytes(), "-")),
+			IssuerCN:       cert.Issuer.CommonName,
+			SubjectCN:      cert.Subject.CommonName,
+			NotBefore:      cert.NotBefore.Local(),
+			NotAfter:       cert.NotAfter.Local(),
+			RevocationTime: revocationTime(secret),
+			CertificatePEM: rawCert,
+			VaultPKIPath:   pki,
+		},
+	}, nil
+}
+
+// getIssuer reads the certificate of an issuer of the mount
+func getIssuer(client *api.Client, pki, issuerRef string) (*x509.Certificate, error) {
+	secret, err := client.Logical().Read(fmt.Sprintf("%s/issuer/%s", pki, issuerRef))
+	if err != nil {
+		return nil, vaultError(err)
+	}
+	if secret == nil {
+		return nil, fmt.Errorf("issuer '%s' not found in '%s'", issuerRef, pki)
+	}
+	pemCert, _ := secret.Data["certificate"].(string)
+	return parseCertificatePEM(pemCert)
 }
 
 // RevokeUserRequest is the structure containing
@@ -98,36 +500,107 @@ type RevokeUserRequest struct {
 	VaultPKIPath        string
 	Username            string
 	ClientVPNEndpointID string
+	// Reason, if set, is recorded for each revoked
+	// certificate in the kv store under VaultKVPath
+	Reason      RevocationReason
+	VaultKVPath string
+	// DenyList adds the user, once revoked, to the deny-list under
+	// VaultKVPath, so no more certificates are issued for the user
+	DenyList bool
+	// RateLimiter, if set, limits how often this runs for the Caller
+	// and for the user. A *RateLimitError is returned when reached.
+	RateLimiter *RateLimiter
+	Caller      string
+	UpdateCRLOptions
+}
+
+// RevokeUserResult holds the outcome of a RevokeUser operation
+type RevokeUserResult struct {
+	// Revoked are the serial numbers of the user's certificates
+	// that were revoked
+	Revoked []string
+	// UpdateCRLResult is the outcome of the CRL update that follows
+	// the revocation. Nil if the update failed before producing one.
+	*UpdateCRLResult
 }
 
-// RevokeUser revokes all the issued certificates for a given user
+// RevokeUser revokes all the issued certificates for a given user.
+// Returns ErrUserNotFound if the user has no certificates.
 func RevokeUser(r *RevokeUserRequest) error {
+	_, err := RevokeUserWithResult(r)
+	return err
+}
+
+// RevokeUserWithResult behaves as RevokeUser but also returns the
+// revoked certificates and the outcome of the CRL update. A partial
+// result is returned along with the error if the CRL update fails.
+func RevokeUserWithResult(r *RevokeUserRequest) (*RevokeUserResult, error) {
+	r.Username = normalizeUsername(r.Username)
+	ctx, cancel := startOperation(r.UpdateCRLOptions, "revoke_user")
+	defer cancel()
+	opts := r.UpdateCRLOptions
+	opts.Context = ctx
+
+	if err := r.RateLimiter.Allow(r.Caller, r.Username); err != nil {
+		return nil, err
+	}
+	if err := checkCapabilities(r.Client, r.UpdateCRLOptions, revokeCapabilities(r.VaultPKIPath)...); err != nil {
+		return nil, err
+	}
 
 	// Get the list of users
 	users, err := ListUsers(
 		&ListUsersRequest{
+			Context:             ctx,
 			Client:              r.Client,
 			VaultPKIPath:        r.VaultPKIPath,
 			ClientVPNEndpointID: r.ClientVPNEndpointID,
+			IssuerRef:           r.IssuerRef,
+			AdoptedKVPath:       r.AdoptedKVPath,
+			Index:               r.CertificateIndex,
+			Retry:               r.Retry,
+			Logger:              r.Logger,
 		})
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	err = revokeUserCertificates(r.Client, r.VaultPKIPath, users[r.Username], true)
+	if len(users[r.Username]) == 0 {
+		return nil, &Error{Kind: ErrUserNotFound, Err: fmt.Errorf("no certificates found for user '%s'", r.Username)}
+	}
+
+	revoked, err := revokeUserCertificates(r.Client, r.VaultPKIPath, users[r.Username],
+		revocationOptions{revokeAll: true, reason: r.Reason, kvPath: r.VaultKVPath, logger: r.Logger,
+			retry: r.Retry, ctx: ctx, audit: r.Audit, usersCache: r.UsersCache, configStore: r.ConfigStore, actor: r.Actor, endpointID: r.ClientVPNEndpointID})
 	if err != nil {
-		return err
+		return nil, err
+	}
+	result := &RevokeUserResult{Revoked: revoked}
+
+	if r.DenyList {
+		reason := "revoked"
+		if r.Reason != "" {
+			reason = fmt.Sprintf("revoked (%s)", r.Reason)
+		}
+		_, err := AddToDenyList(&DenyListRequest{Client: r.Client, VaultKVPath: r.VaultKVPath, Username: r.Username, Retry: r.Retry}, reason, r.Caller)
+		if err != nil {
+			return result, err
+		}
 	}
 
 	// Call UpdateCRL to revoke all other certificates
-	_, err = UpdateCRL(
+	result.UpdateCRLResult, err = UpdateCRL(
 		&UpdateCRLRequest{
 			Client:              r.Client,
 			VaultPKIPath:        r.VaultPKIPath,
 			ClientVPNEndpointID: r.ClientVPNEndpointID,
+			UpdateCRLOptions:    opts,
 		})
+	if err != nil {
+		return result, err
+	}
 
-	return nil
+	return result, nil
 }
 
 func getHexFormatted(buf []byte, sep string) string {
@@ -142,7 +615,7 @@ func getHexFormatted(buf []byte, sep string) string {
 }
 
 func isRevoked(serial string, crl []byte) (bool, error) {
-	parsed, err := x509.ParseCRL(crl)
+	parsed, err := parseCRL(crl)
 	if err != nil {
 		return false, err
 	}
@@ -0,0 +1,94 @@
+package operations
+
+import (
+	"sync"
+	"time"
+)
+
+// Users cache lookup results recorded with Metrics.UsersCacheLookup
+const (
+	UsersCacheHit  = "hit"
+	UsersCacheMiss = "miss"
+)
+
+// DefaultUsersCacheTTL is the default time during which
+// the users listed by ListUsers are reused
+const DefaultUsersCacheTTL = 30 * time.Second
+
+// UsersCache keeps, in memory, the users listed by ListUsers so that
+// polling them doesn't read all the certificates from Vault each time. It
+// is invalidated by the operations that change the users or their
+// certificates, see UpdateCRLOptions.UsersCache. The zero value is ready
+// to use and safe for concurrent use.
+type UsersCache struct {
+	// TTL is how long a listing is kept. Defaults to DefaultUsersCacheTTL.
+	TTL time.Duration
+
+	mu      sync.Mutex
+	entries map[string]usersCacheEntry
+	// generation is incremented on each invalidation, so
+	// the listings started before it are not kept
+	generation uint64
+}
+
+type usersCacheEntry struct {
+	users   map[string][]Certificate
+	expires time.Time
+}
+
+// get returns a copy of the users cached under the key, or the ones
+// returned by list if not cached, expired or refresh is set. Failed
+// listings are not cached.
+func (c *UsersCache) get(key string, refresh bool, list func() (map[string][]Certificate, error)) (map[string][]Certificate, error) {
+	ttl := c.TTL
+	if ttl == 0 {
+		ttl = DefaultUsersCacheTTL
+	}
+
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	generation := c.generation
+	c.mu.Unlock()
+	if ok && !refresh && time.Now().Before(e.expires) {
+		metrics.UsersCacheLookup(UsersCacheHit)
+		return copyUsers(e.users), nil
+	}
+	metrics.UsersCacheLookup(UsersCacheMiss)
+
+	users, err := list()
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.generation == generation {
+		if c.entries == nil {
+			c.entries = map[string]usersCacheEntry{}
+		}
+		c.entries[key] = usersCacheEntry{users: copyUsers(users), expires: time.Now().Add(ttl)}
+	}
+	return users, nil
+}
+
+// Invalidate drops all the cached listings, so the next ListUsers reads
+// the certificates from Vault again. It does nothing on a nil cache.
+func (c *UsersCache) Invalidate() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = nil
+	c.generation++
+}
+
+// copyUsers returns a copy of the users that can be
+// modified without changing the cached ones
+func copyUsers(users map[string][]Certificate) map[string][]Certificate {
+	copied := make(map[string][]Certificate, len(users))
+	for username, crts := range users {
+		copied[username] = append([]Certificate(nil), crts...)
+	}
+	return copied
+}
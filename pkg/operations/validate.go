@@ -0,0 +1,241 @@
+package operations
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/logging"
+	"github.com/hashicorp/vault/api"
+)
+
+// Checks run by ValidateBundle, in order
+const (
+	// BundleCheckKeyPair checks that the private key is the one of the certificate
+	BundleCheckKeyPair = "key_pair"
+	// BundleCheckChain checks that the certificate chains to the CA of the PKI
+	// paths, is valid at the time and can be used for client authentication
+	BundleCheckChain = "chain"
+	// BundleCheckNotRevoked checks that the certificate is not in the current CRL
+	BundleCheckNotRevoked = "not_revoked"
+)
+
+// ValidateBundleRequest is the structure containing the required
+// data to validate an issued certificate and its private key
+type ValidateBundleRequest struct {
+	Client *api.Client
+	// VaultPKIPaths are the PKI paths of the CA chain, as in
+	// IssueCertificateRequest. The CRL is that of the last one.
+	VaultPKIPaths []string
+	// IssuerRef, if set, is the issuer whose CRL is checked
+	IssuerRef   string
+	Certificate string
+	PrivateKey  string
+	// CAChain, if set, is the CA chain returned by GetCAChain for the
+	// VaultPKIPaths, e.g. the one of an IssueCertificateResult, so it
+	// is not read from Vault again
+	CAChain []string
+}
+
+// BundleCheck is the outcome of each of the checks of a BundleValidation
+type BundleCheck struct {
+	// Name is one of the BundleCheck constants
+	Name   string `json:"name"`
+	Passed bool   `json:"passed"`
+	// Error is why the check failed
+	Error string `json:"error,omitempty"`
+}
+
+// BundleValidation holds the outcome of a ValidateBundle operation
+type BundleValidation struct {
+	SerialNumber string `json:"serial,omitempty"`
+	// Checks holds the outcome of all the checks, in the
+	// order of the BundleCheck constants
+	Checks []BundleCheck `json:"checks"`
+}
+
+// Valid returns true if all the checks passed
+func (v *BundleValidation) Valid() bool {
+	for _, c := range v.Checks {
+		if !c.Passed {
+			return false
+		}
+	}
+	return true
+}
+
+func (v *BundleValidation) record(name string, err error) {
+	check := BundleCheck{Name: name, Passed: err == nil}
+	if err != nil {
+		check.Error = err.Error()
+	}
+	v.Checks = append(v.Checks, check)
+}
+
+// ValidateBundle checks that an issued certificate and its private key,
+// e.g. the ones returned by IssueClientCertificate, make a usable pair
+// before handing them to the user: that the key is the one of the
+// certificate, that the certificate chains to the CA returned by
+// GetCAChain and that it is not revoked as of the current CRL. All the
+// checks run, even if one fails, and the failed ones are reported in the
+// result. An error is only returned if the CA chain or the CRL can't be
+// read from Vault.
+func ValidateBundle(r *ValidateBundleRequest) (*BundleValidation, error) {
+	start := time.Now()
+	v, err := validateBundle(r)
+	observe("validate_bundle", start, err)
+	return v, err
+}
+
+func validateBundle(r *ValidateBundleRequest) (*BundleValidation, error) {
+	v := &BundleValidation{}
+
+	_, err := tls.X509KeyPair([]byte(r.Certificate), []byte(r.PrivateKey))
+	v.record(BundleCheckKeyPair, err)
+
+	chain := r.CAChain
+	if chain == nil {
+		chain, err = GetCAChain(
+			&GetCAChainRequest{
+				Client:        r.Client,
+				VaultPKIPaths: r.VaultPKIPaths,
+			})
+		if err != nil {
+			return nil, err
+		}
+	}
+	crl, err := GetCRL(
+		&GetCRLRequest{
+			Client:       r.Client,
+			VaultPKIPath: r.VaultPKIPaths[len(r.VaultPKIPaths)-1],
+			IssuerRef:    r.IssuerRef,
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := parseCertificatePEM(r.Certificate)
+	if err != nil {
+		err = fmt.Errorf("invalid certificate: %w", err)
+		v.record(BundleCheckChain, err)
+		v.record(BundleCheckNotRevoked, err)
+		return v, nil
+	}
+	v.SerialNumber = strings.TrimSpace(getHexFormatted(cert.SerialNumber.Bytes(), "-"))
+
+	v.record(BundleCheckChain, verifyChain(cert, chain))
+
+	revoked, err := isRevoked(v.SerialNumber, crl)
+	if err == nil && revoked {
+		err = errors.New("the certificate is revoked")
+	}
+	v.record(BundleCheckNotRevoked, err)
+
+	return v, nil
+}
+
+// verifyChain checks that the certificate chains, for client
+// authentication, to the root CA of the chain through the rest of
+// its CAs. The root CA is the self-signed one or, if none is, the
+// first one, as the root CA PKI path is the first of the paths.
+func verifyChain(cert *x509.Certificate, chain []string) error {
+	var cas []*x509.Certificate
+	root := -1
+	for i, ca := range chain {
+		caCert, err := parseCertificatePEM(ca)
+		if err != nil {
+			return fmt.Errorf("invalid CA certificate: %w", err)
+		}
+		if root < 0 && bytes.Equal(caCert.RawSubject, caCert.RawIssuer) && caCert.CheckSignatureFrom(caCert) == nil {
+			root = i
+		}
+		cas = append(cas, caCert)
+	}
+	if len(cas) == 0 {
+		return errors.New("empty CA chain")
+	}
+	if root < 0 {
+		root = 0
+	}
+
+	roots, intermediates := x509.NewCertPool(), x509.NewCertPool()
+	for i, ca := range cas {
+		if i == root {
+			roots.AddCert(ca)
+		} else {
+			intermediates.AddCert(ca)
+		}
+	}
+	_, err := cert.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	return err
+}
+
+// InvalidBundleError is returned by IssueClientCertificate, with
+// ValidateBundle set, when the issued certificate and its private key
+// fail any of the checks of ValidateBundle. It matches ErrInvalidBundle.
+type InvalidBundleError struct {
+	Validation *BundleValidation
+}
+
+// Unwrap returns ErrInvalidBundle
+func (e *InvalidBundleError) Unwrap() error {
+	return ErrInvalidBundle
+}
+
+func (e *InvalidBundleError) Error() string {
+	var failed []string
+	for _, c := range e.Validation.Checks {
+		if !c.Passed {
+			failed = append(failed, fmt.Sprintf("%s: %s", c.Name, c.Error))
+		}
+	}
+	return fmt.Sprintf("the issued certificate %s failed the validation: %s", e.Validation.SerialNumber, strings.Join(failed, "; "))
+}
+
+// validateIssuedBundle runs ValidateBundle on the certificate just issued,
+// with the CA chain already read. An invalid certificate is revoked, as
+// UpdateCRL would otherwise keep it as the latest one of the user and
+// revoke the previous ones.
+func validateIssuedBundle(ctx context.Context, r *IssueCertificateRequest, crt *IssueCertificateResult) error {
+	var v *BundleValidation
+	err := retry(ctx, r.Retry, r.Logger, "validate_bundle", vaultCall, func(context.Context) (err error) {
+		v, err = ValidateBundle(
+			&ValidateBundleRequest{
+				Client:        r.Client,
+				VaultPKIPaths: r.VaultPKIPaths,
+				IssuerRef:     r.IssuerRef,
+				Certificate:   crt.Certificate,
+				PrivateKey:    crt.PrivateKey,
+				CAChain:       crt.CAChain,
+			})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if v.Valid() {
+		return nil
+	}
+
+	pki := r.VaultPKIPaths[len(r.VaultPKIPaths)-1]
+	err = retry(ctx, r.Retry, r.Logger, "vault_revoke", vaultCall, func(context.Context) error {
+		_, err := r.Client.Logical().Write(fmt.Sprintf("%s/revoke", pki), map[string]interface{}{"serial_number": crt.SerialNumber})
+		return vaultError(err)
+	})
+	logger := logging.OrDefault(r.Logger).With("user", r.Username, "serial", crt.SerialNumber)
+	if err != nil {
+		logger.Error("unable to revoke the certificate that failed the validation", "error", err)
+	} else {
+		logger.Warn("revoked the certificate that failed the validation", "pki_path", pki)
+	}
+	return &InvalidBundleError{Validation: v}
+}
@@ -0,0 +1,46 @@
+package operations
+
+import (
+	"testing"
+)
+
+func TestVerifyChain(t *testing.T) {
+	root := newTestCert(t, "root", nil, true)
+	intermediate := newTestCert(t, "intermediate", root, true)
+	client := newTestCert(t, "alice", intermediate, false)
+	other := newTestCert(t, "other", nil, true)
+	stranger := newTestCert(t, "mallory", other, false)
+	// Signed by an intermediate of another root
+	otherIntermediate := newTestCert(t, "other-intermediate", other, true)
+	outsider := newTestCert(t, "eve", otherIntermediate, false)
+
+	tests := []struct {
+		name  string
+		cert  *testCert
+		chain []*testCert
+		valid bool
+	}{
+		{"root then intermediate", client, []*testCert{root, intermediate}, true},
+		{"intermediate then root", client, []*testCert{intermediate, root}, true},
+		{"signed by the root", newTestCert(t, "bob", root, false), []*testCert{root}, true},
+		{"another CA", stranger, []*testCert{root, intermediate}, false},
+		{"intermediate not trusted as a root", outsider, []*testCert{root, otherIntermediate}, false},
+		{"missing intermediate", client, []*testCert{root}, false},
+		{"no chain", client, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var chain []string
+			for _, ca := range tt.chain {
+				chain = append(chain, ca.pem)
+			}
+			err := verifyChain(tt.cert.cert, chain)
+			if tt.valid && err != nil {
+				t.Errorf("got error %s, want the chain to verify", err)
+			}
+			if !tt.valid && err == nil {
+				t.Error("got the chain to verify, want an error")
+			}
+		})
+	}
+}
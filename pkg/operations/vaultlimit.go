@@ -0,0 +1,75 @@
+package operations
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// vaultLimiter is the token bucket shared by all the Vault calls of the
+// operations. The calls that find it empty take a token in advance and
+// wait until it is refilled, so they are let through in order.
+var vaultLimiter = &tokenBucket{}
+
+type tokenBucket struct {
+	// b is nil while disabled
+	b *bucket
+	sync.Mutex
+}
+
+// SetVaultRateLimit limits the Vault calls made by the operations to rps
+// per second, shared by all the operations running in the process, with
+// bursts of up to burst calls, which defaults to rps rounded up. Each
+// attempt of the retried Vault calls waits for the limiter, as does each
+// certificate read from Vault when listing them. The wait is part of the
+// duration of the operations. A rps of 0 disables it, which is the default.
+func SetVaultRateLimit(rps float64, burst int) {
+	vaultLimiter.Lock()
+	defer vaultLimiter.Unlock()
+	if rps <= 0 {
+		vaultLimiter.b = nil
+		return
+	}
+	if burst <= 0 {
+		burst = int(math.Ceil(rps))
+	}
+	limit := RateLimit{Limit: burst, Period: time.Duration(float64(burst) / rps * float64(time.Second))}
+	vaultLimiter.b = &bucket{limit: limit, tokens: float64(burst), last: time.Now()}
+}
+
+// wait blocks until the call can be made, returning the error of the
+// context, see contextError, if it is done first
+func (l *tokenBucket) wait(ctx context.Context) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	l.Lock()
+	b := l.b
+	if b == nil {
+		l.Unlock()
+		return nil
+	}
+	now := time.Now()
+	b.tokens = b.available(now) - 1
+	b.last = now
+	perToken := float64(b.limit.period()) / float64(b.limit.Limit)
+	delay := time.Duration(-b.tokens * perToken)
+	l.Unlock()
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		// Give the token back to the calls waiting after this one
+		l.Lock()
+		b.tokens++
+		l.Unlock()
+		return contextError(ctx, "vault_rate_limit")
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,1143 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// source: acpm.proto
+
+// The gRPC API of ACPM, which mirrors the HTTP one
+
+package rpc
+
+import (
+	context "context"
+	fmt "fmt"
+	proto "github.com/golang/protobuf/proto"
+	timestamp "github.com/golang/protobuf/ptypes/timestamp"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+	math "math"
+)
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ = proto.Marshal
+var _ = fmt.Errorf
+var _ = math.Inf
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the proto package it is being compiled against.
+// A compilation error at this line likely means your copy of the
+// proto package needs to be updated.
+const _ = proto.ProtoPackageIsVersion3 // please upgrade the proto package
+
+type IssueCertificateRequest struct {
+	Username string `protobuf:"bytes,1,opt,name=username,proto3" json:"username,omitempty"`
+	// temporary certificates do not revoke the previous ones and require a role
+	Temporary bool   `protobuf:"varint,2,opt,name=temporary,proto3" json:"temporary,omitempty"`
+	Role      string `protobuf:"bytes,3,opt,name=role,proto3" json:"role,omitempty"`
+	// email, if set, is where the VPN config is sent to
+	Email                string   `protobuf:"bytes,4,opt,name=email,proto3" json:"email,omitempty"`
+	IdempotencyKey       string   `protobuf:"bytes,5,opt,name=idempotency_key,json=idempotencyKey,proto3" json:"idempotency_key,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *IssueCertificateRequest) Reset()         { *m = IssueCertificateRequest{} }
+func (m *IssueCertificateRequest) String() string { return proto.CompactTextString(m) }
+func (*IssueCertificateRequest) ProtoMessage()    {}
+func (*IssueCertificateRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_54c199086173fab7, []int{0}
+}
+
+func (m *IssueCertificateRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_IssueCertificateRequest.Unmarshal(m, b)
+}
+func (m *IssueCertificateRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_IssueCertificateRequest.Marshal(b, m, deterministic)
+}
+func (m *IssueCertificateRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_IssueCertificateRequest.Merge(m, src)
+}
+func (m *IssueCertificateRequest) XXX_Size() int {
+	return xxx_messageInfo_IssueCertificateRequest.Size(m)
+}
+func (m *IssueCertificateRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_IssueCertificateRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_IssueCertificateRequest proto.InternalMessageInfo
+
+func (m *IssueCertificateRequest) GetUsername() string {
+	if m != nil {
+		return m.Username
+	}
+	return ""
+}
+
+func (m *IssueCertificateRequest) GetTemporary() bool {
+	if m != nil {
+		return m.Temporary
+	}
+	return false
+}
+
+func (m *IssueCertificateRequest) GetRole() string {
+	if m != nil {
+		return m.Role
+	}
+	return ""
+}
+
+func (m *IssueCertificateRequest) GetEmail() string {
+	if m != nil {
+		return m.Email
+	}
+	return ""
+}
+
+func (m *IssueCertificateRequest) GetIdempotencyKey() string {
+	if m != nil {
+		return m.IdempotencyKey
+	}
+	return ""
+}
+
+type IssueCertificateResponse struct {
+	SerialNumber string               `protobuf:"bytes,1,opt,name=serial_number,json=serialNumber,proto3" json:"serial_number,omitempty"`
+	Config       string               `protobuf:"bytes,2,opt,name=config,proto3" json:"config,omitempty"`
+	NotAfter     *timestamp.Timestamp `protobuf:"bytes,3,opt,name=not_after,json=notAfter,proto3" json:"not_after,omitempty"`
+	ConfigPath   string               `protobuf:"bytes,4,opt,name=config_path,json=configPath,proto3" json:"config_path,omitempty"`
+	EmailedTo    string               `protobuf:"bytes,5,opt,name=emailed_to,json=emailedTo,proto3" json:"emailed_to,omitempty"`
+	EmailError   string               `protobuf:"bytes,6,opt,name=email_error,json=emailError,proto3" json:"email_error,omitempty"`
+	// replayed is true if this is the result of a previous
+	// issuance with the same idempotency_key
+	Replayed             bool     `protobuf:"varint,7,opt,name=replayed,proto3" json:"replayed,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *IssueCertificateResponse) Reset()         { *m = IssueCertificateResponse{} }
+func (m *IssueCertificateResponse) String() string { return proto.CompactTextString(m) }
+func (*IssueCertificateResponse) ProtoMessage()    {}
+func (*IssueCertificateResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_54c199086173fab7, []int{1}
+}
+
+func (m *IssueCertificateResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_IssueCertificateResponse.Unmarshal(m, b)
+}
+func (m *IssueCertificateResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_IssueCertificateResponse.Marshal(b, m, deterministic)
+}
+func (m *IssueCertificateResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_IssueCertificateResponse.Merge(m, src)
+}
+func (m *IssueCertificateResponse) XXX_Size() int {
+	return xxx_messageInfo_IssueCertificateResponse.Size(m)
+}
+func (m *IssueCertificateResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_IssueCertificateResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_IssueCertificateResponse proto.InternalMessageInfo
+
+func (m *IssueCertificateResponse) GetSerialNumber() string {
+	if m != nil {
+		return m.SerialNumber
+	}
+	return ""
+}
+
+func (m *IssueCertificateResponse) GetConfig() string {
+	if m != nil {
+		return m.Config
+	}
+	return ""
+}
+
+func (m *IssueCertificateResponse) GetNotAfter() *timestamp.Timestamp {
+	if m != nil {
+		return m.NotAfter
+	}
+	return nil
+}
+
+func (m *IssueCertificateResponse) GetConfigPath() string {
+	if m != nil {
+		return m.ConfigPath
+	}
+	return ""
+}
+
+func (m *IssueCertificateResponse) GetEmailedTo() string {
+	if m != nil {
+		return m.EmailedTo
+	}
+	return ""
+}
+
+func (m *IssueCertificateResponse) GetEmailError() string {
+	if m != nil {
+		return m.EmailError
+	}
+	return ""
+}
+
+func (m *IssueCertificateResponse) GetReplayed() bool {
+	if m != nil {
+		return m.Replayed
+	}
+	return false
+}
+
+type RevokeUserRequest struct {
+	Username string `protobuf:"bytes,1,opt,name=username,proto3" json:"username,omitempty"`
+	// reason is one of: unspecified, keyCompromise, superseded, cessationOfOperation
+	Reason               string   `protobuf:"bytes,2,opt,name=reason,proto3" json:"reason,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *RevokeUserRequest) Reset()         { *m = RevokeUserRequest{} }
+func (m *RevokeUserRequest) String() string { return proto.CompactTextString(m) }
+func (*RevokeUserRequest) ProtoMessage()    {}
+func (*RevokeUserRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_54c199086173fab7, []int{2}
+}
+
+func (m *RevokeUserRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_RevokeUserRequest.Unmarshal(m, b)
+}
+func (m *RevokeUserRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_RevokeUserRequest.Marshal(b, m, deterministic)
+}
+func (m *RevokeUserRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_RevokeUserRequest.Merge(m, src)
+}
+func (m *RevokeUserRequest) XXX_Size() int {
+	return xxx_messageInfo_RevokeUserRequest.Size(m)
+}
+func (m *RevokeUserRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_RevokeUserRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_RevokeUserRequest proto.InternalMessageInfo
+
+func (m *RevokeUserRequest) GetUsername() string {
+	if m != nil {
+		return m.Username
+	}
+	return ""
+}
+
+func (m *RevokeUserRequest) GetReason() string {
+	if m != nil {
+		return m.Reason
+	}
+	return ""
+}
+
+type RevokeUserResponse struct {
+	Revoked              []string `protobuf:"bytes,1,rep,name=revoked,proto3" json:"revoked,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *RevokeUserResponse) Reset()         { *m = RevokeUserResponse{} }
+func (m *RevokeUserResponse) String() string { return proto.CompactTextString(m) }
+func (*RevokeUserResponse) ProtoMessage()    {}
+func (*RevokeUserResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_54c199086173fab7, []int{3}
+}
+
+func (m *RevokeUserResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_RevokeUserResponse.Unmarshal(m, b)
+}
+func (m *RevokeUserResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_RevokeUserResponse.Marshal(b, m, deterministic)
+}
+func (m *RevokeUserResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_RevokeUserResponse.Merge(m, src)
+}
+func (m *RevokeUserResponse) XXX_Size() int {
+	return xxx_messageInfo_RevokeUserResponse.Size(m)
+}
+func (m *RevokeUserResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_RevokeUserResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_RevokeUserResponse proto.InternalMessageInfo
+
+func (m *RevokeUserResponse) GetRevoked() []string {
+	if m != nil {
+		return m.Revoked
+	}
+	return nil
+}
+
+type ListUsersRequest struct {
+	Prefix               string   `protobuf:"bytes,1,opt,name=prefix,proto3" json:"prefix,omitempty"`
+	ActiveOnly           bool     `protobuf:"varint,2,opt,name=active_only,json=activeOnly,proto3" json:"active_only,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *ListUsersRequest) Reset()         { *m = ListUsersRequest{} }
+func (m *ListUsersRequest) String() string { return proto.CompactTextString(m) }
+func (*ListUsersRequest) ProtoMessage()    {}
+func (*ListUsersRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_54c199086173fab7, []int{4}
+}
+
+func (m *ListUsersRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_ListUsersRequest.Unmarshal(m, b)
+}
+func (m *ListUsersRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_ListUsersRequest.Marshal(b, m, deterministic)
+}
+func (m *ListUsersRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_ListUsersRequest.Merge(m, src)
+}
+func (m *ListUsersRequest) XXX_Size() int {
+	return xxx_messageInfo_ListUsersRequest.Size(m)
+}
+func (m *ListUsersRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_ListUsersRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_ListUsersRequest proto.InternalMessageInfo
+
+func (m *ListUsersRequest) GetPrefix() string {
+	if m != nil {
+		return m.Prefix
+	}
+	return ""
+}
+
+func (m *ListUsersRequest) GetActiveOnly() bool {
+	if m != nil {
+		return m.ActiveOnly
+	}
+	return false
+}
+
+type User struct {
+	Username             string         `protobuf:"bytes,1,opt,name=username,proto3" json:"username,omitempty"`
+	Certificates         []*Certificate `protobuf:"bytes,2,rep,name=certificates,proto3" json:"certificates,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}       `json:"-"`
+	XXX_unrecognized     []byte         `json:"-"`
+	XXX_sizecache        int32          `json:"-"`
+}
+
+func (m *User) Reset()         { *m = User{} }
+func (m *User) String() string { return proto.CompactTextString(m) }
+func (*User) ProtoMessage()    {}
+func (*User) Descriptor() ([]byte, []int) {
+	return fileDescriptor_54c199086173fab7, []int{5}
+}
+
+func (m *User) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_User.Unmarshal(m, b)
+}
+func (m *User) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_User.Marshal(b, m, deterministic)
+}
+func (m *User) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_User.Merge(m, src)
+}
+func (m *User) XXX_Size() int {
+	return xxx_messageInfo_User.Size(m)
+}
+func (m *User) XXX_DiscardUnknown() {
+	xxx_messageInfo_User.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_User proto.InternalMessageInfo
+
+func (m *User) GetUsername() string {
+	if m != nil {
+		return m.Username
+	}
+	return ""
+}
+
+func (m *User) GetCertificates() []*Certificate {
+	if m != nil {
+		return m.Certificates
+	}
+	return nil
+}
+
+type Certificate struct {
+	SerialNumber         string               `protobuf:"bytes,1,opt,name=serial_number,json=serialNumber,proto3" json:"serial_number,omitempty"`
+	IssuerCn             string               `protobuf:"bytes,2,opt,name=issuer_cn,json=issuerCn,proto3" json:"issuer_cn,omitempty"`
+	SubjectCn            string               `protobuf:"bytes,3,opt,name=subject_cn,json=subjectCn,proto3" json:"subject_cn,omitempty"`
+	NotBefore            *timestamp.Timestamp `protobuf:"bytes,4,opt,name=not_before,json=notBefore,proto3" json:"not_before,omitempty"`
+	NotAfter             *timestamp.Timestamp `protobuf:"bytes,5,opt,name=not_after,json=notAfter,proto3" json:"not_after,omitempty"`
+	Revoked              bool                 `protobuf:"varint,6,opt,name=revoked,proto3" json:"revoked,omitempty"`
+	CertificatePem       string               `protobuf:"bytes,7,opt,name=certificate_pem,json=certificatePem,proto3" json:"certificate_pem,omitempty"`
+	VaultPkiPath         string               `protobuf:"bytes,8,opt,name=vault_pki_path,json=vaultPkiPath,proto3" json:"vault_pki_path,omitempty"`
+	RevocationReason     string               `protobuf:"bytes,9,opt,name=revocation_reason,json=revocationReason,proto3" json:"revocation_reason,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}             `json:"-"`
+	XXX_unrecognized     []byte               `json:"-"`
+	XXX_sizecache        int32                `json:"-"`
+}
+
+func (m *Certificate) Reset()         { *m = Certificate{} }
+func (m *Certificate) String() string { return proto.CompactTextString(m) }
+func (*Certificate) ProtoMessage()    {}
+func (*Certificate) Descriptor() ([]byte, []int) {
+	return fileDescriptor_54c199086173fab7, []int{6}
+}
+
+func (m *Certificate) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_Certificate.Unmarshal(m, b)
+}
+func (m *Certificate) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_Certificate.Marshal(b, m, deterministic)
+}
+func (m *Certificate) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Certificate.Merge(m, src)
+}
+func (m *Certificate) XXX_Size() int {
+	return xxx_messageInfo_Certificate.Size(m)
+}
+func (m *Certificate) XXX_DiscardUnknown() {
+	xxx_messageInfo_Certificate.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Certificate proto.InternalMessageInfo
+
+func (m *Certificate) GetSerialNumber() string {
+	if m != nil {
+		return m.SerialNumber
+	}
+	return ""
+}
+
+func (m *Certificate) GetIssuerCn() string {
+	if m != nil {
+		return m.IssuerCn
+	}
+	return ""
+}
+
+func (m *Certificate) GetSubjectCn() string {
+	if m != nil {
+		return m.SubjectCn
+	}
+	return ""
+}
+
+func (m *Certificate) GetNotBefore() *timestamp.Timestamp {
+	if m != nil {
+		return m.NotBefore
+	}
+	return nil
+}
+
+func (m *Certificate) GetNotAfter() *timestamp.Timestamp {
+	if m != nil {
+		return m.NotAfter
+	}
+	return nil
+}
+
+func (m *Certificate) GetRevoked() bool {
+	if m != nil {
+		return m.Revoked
+	}
+	return false
+}
+
+func (m *Certificate) GetCertificatePem() string {
+	if m != nil {
+		return m.CertificatePem
+	}
+	return ""
+}
+
+func (m *Certificate) GetVaultPkiPath() string {
+	if m != nil {
+		return m.VaultPkiPath
+	}
+	return ""
+}
+
+func (m *Certificate) GetRevocationReason() string {
+	if m != nil {
+		return m.RevocationReason
+	}
+	return ""
+}
+
+type GetCRLRequest struct {
+	// der returns the CRL DER encoded instead of PEM
+	Der                  bool     `protobuf:"varint,1,opt,name=der,proto3" json:"der,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *GetCRLRequest) Reset()         { *m = GetCRLRequest{} }
+func (m *GetCRLRequest) String() string { return proto.CompactTextString(m) }
+func (*GetCRLRequest) ProtoMessage()    {}
+func (*GetCRLRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_54c199086173fab7, []int{7}
+}
+
+func (m *GetCRLRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_GetCRLRequest.Unmarshal(m, b)
+}
+func (m *GetCRLRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_GetCRLRequest.Marshal(b, m, deterministic)
+}
+func (m *GetCRLRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_GetCRLRequest.Merge(m, src)
+}
+func (m *GetCRLRequest) XXX_Size() int {
+	return xxx_messageInfo_GetCRLRequest.Size(m)
+}
+func (m *GetCRLRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_GetCRLRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_GetCRLRequest proto.InternalMessageInfo
+
+func (m *GetCRLRequest) GetDer() bool {
+	if m != nil {
+		return m.Der
+	}
+	return false
+}
+
+type GetCRLResponse struct {
+	Crl                  []byte   `protobuf:"bytes,1,opt,name=crl,proto3" json:"crl,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *GetCRLResponse) Reset()         { *m = GetCRLResponse{} }
+func (m *GetCRLResponse) String() string { return proto.CompactTextString(m) }
+func (*GetCRLResponse) ProtoMessage()    {}
+func (*GetCRLResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_54c199086173fab7, []int{8}
+}
+
+func (m *GetCRLResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_GetCRLResponse.Unmarshal(m, b)
+}
+func (m *GetCRLResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_GetCRLResponse.Marshal(b, m, deterministic)
+}
+func (m *GetCRLResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_GetCRLResponse.Merge(m, src)
+}
+func (m *GetCRLResponse) XXX_Size() int {
+	return xxx_messageInfo_GetCRLResponse.Size(m)
+}
+func (m *GetCRLResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_GetCRLResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_GetCRLResponse proto.InternalMessageInfo
+
+func (m *GetCRLResponse) GetCrl() []byte {
+	if m != nil {
+		return m.Crl
+	}
+	return nil
+}
+
+type UpdateCRLRequest struct {
+	ForceShrink          bool     `protobuf:"varint,1,opt,name=force_shrink,json=forceShrink,proto3" json:"force_shrink,omitempty"`
+	ForceImport          bool     `protobuf:"varint,2,opt,name=force_import,json=forceImport,proto3" json:"force_import,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *UpdateCRLRequest) Reset()         { *m = UpdateCRLRequest{} }
+func (m *UpdateCRLRequest) String() string { return proto.CompactTextString(m) }
+func (*UpdateCRLRequest) ProtoMessage()    {}
+func (*UpdateCRLRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_54c199086173fab7, []int{9}
+}
+
+func (m *UpdateCRLRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_UpdateCRLRequest.Unmarshal(m, b)
+}
+func (m *UpdateCRLRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_UpdateCRLRequest.Marshal(b, m, deterministic)
+}
+func (m *UpdateCRLRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_UpdateCRLRequest.Merge(m, src)
+}
+func (m *UpdateCRLRequest) XXX_Size() int {
+	return xxx_messageInfo_UpdateCRLRequest.Size(m)
+}
+func (m *UpdateCRLRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_UpdateCRLRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_UpdateCRLRequest proto.InternalMessageInfo
+
+func (m *UpdateCRLRequest) GetForceShrink() bool {
+	if m != nil {
+		return m.ForceShrink
+	}
+	return false
+}
+
+func (m *UpdateCRLRequest) GetForceImport() bool {
+	if m != nil {
+		return m.ForceImport
+	}
+	return false
+}
+
+type UpdateCRLResponse struct {
+	Crl                  []byte   `protobuf:"bytes,1,opt,name=crl,proto3" json:"crl,omitempty"`
+	Size                 int32    `protobuf:"varint,2,opt,name=size,proto3" json:"size,omitempty"`
+	MaxSize              int32    `protobuf:"varint,3,opt,name=max_size,json=maxSize,proto3" json:"max_size,omitempty"`
+	RevokedCount         int32    `protobuf:"varint,4,opt,name=revoked_count,json=revokedCount,proto3" json:"revoked_count,omitempty"`
+	AffectedUsers        []string `protobuf:"bytes,5,rep,name=affected_users,json=affectedUsers,proto3" json:"affected_users,omitempty"`
+	AwsUpdated           bool     `protobuf:"varint,6,opt,name=aws_updated,json=awsUpdated,proto3" json:"aws_updated,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *UpdateCRLResponse) Reset()         { *m = UpdateCRLResponse{} }
+func (m *UpdateCRLResponse) String() string { return proto.CompactTextString(m) }
+func (*UpdateCRLResponse) ProtoMessage()    {}
+func (*UpdateCRLResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_54c199086173fab7, []int{10}
+}
+
+func (m *UpdateCRLResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_UpdateCRLResponse.Unmarshal(m, b)
+}
+func (m *UpdateCRLResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_UpdateCRLResponse.Marshal(b, m, deterministic)
+}
+func (m *UpdateCRLResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_UpdateCRLResponse.Merge(m, src)
+}
+func (m *UpdateCRLResponse) XXX_Size() int {
+	return xxx_messageInfo_UpdateCRLResponse.Size(m)
+}
+func (m *UpdateCRLResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_UpdateCRLResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_UpdateCRLResponse proto.InternalMessageInfo
+
+func (m *UpdateCRLResponse) GetCrl() []byte {
+	if m != nil {
+		return m.Crl
+	}
+	return nil
+}
+
+func (m *UpdateCRLResponse) GetSize() int32 {
+	if m != nil {
+		return m.Size
+	}
+	return 0
+}
+
+func (m *UpdateCRLResponse) GetMaxSize() int32 {
+	if m != nil {
+		return m.MaxSize
+	}
+	return 0
+}
+
+func (m *UpdateCRLResponse) GetRevokedCount() int32 {
+	if m != nil {
+		return m.RevokedCount
+	}
+	return 0
+}
+
+func (m *UpdateCRLResponse) GetAffectedUsers() []string {
+	if m != nil {
+		return m.AffectedUsers
+	}
+	return nil
+}
+
+func (m *UpdateCRLResponse) GetAwsUpdated() bool {
+	if m != nil {
+		return m.AwsUpdated
+	}
+	return false
+}
+
+type RotateCRLRequest struct {
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *RotateCRLRequest) Reset()         { *m = RotateCRLRequest{} }
+func (m *RotateCRLRequest) String() string { return proto.CompactTextString(m) }
+func (*RotateCRLRequest) ProtoMessage()    {}
+func (*RotateCRLRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_54c199086173fab7, []int{11}
+}
+
+func (m *RotateCRLRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_RotateCRLRequest.Unmarshal(m, b)
+}
+func (m *RotateCRLRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_RotateCRLRequest.Marshal(b, m, deterministic)
+}
+func (m *RotateCRLRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_RotateCRLRequest.Merge(m, src)
+}
+func (m *RotateCRLRequest) XXX_Size() int {
+	return xxx_messageInfo_RotateCRLRequest.Size(m)
+}
+func (m *RotateCRLRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_RotateCRLRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_RotateCRLRequest proto.InternalMessageInfo
+
+type RotateCRLResponse struct {
+	// rotated is false if the rotation was skipped due to the crl-rotation-window
+	Rotated              bool               `protobuf:"varint,1,opt,name=rotated,proto3" json:"rotated,omitempty"`
+	Update               *UpdateCRLResponse `protobuf:"bytes,2,opt,name=update,proto3" json:"update,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}           `json:"-"`
+	XXX_unrecognized     []byte             `json:"-"`
+	XXX_sizecache        int32              `json:"-"`
+}
+
+func (m *RotateCRLResponse) Reset()         { *m = RotateCRLResponse{} }
+func (m *RotateCRLResponse) String() string { return proto.CompactTextString(m) }
+func (*RotateCRLResponse) ProtoMessage()    {}
+func (*RotateCRLResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_54c199086173fab7, []int{12}
+}
+
+func (m *RotateCRLResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_RotateCRLResponse.Unmarshal(m, b)
+}
+func (m *RotateCRLResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_RotateCRLResponse.Marshal(b, m, deterministic)
+}
+func (m *RotateCRLResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_RotateCRLResponse.Merge(m, src)
+}
+func (m *RotateCRLResponse) XXX_Size() int {
+	return xxx_messageInfo_RotateCRLResponse.Size(m)
+}
+func (m *RotateCRLResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_RotateCRLResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_RotateCRLResponse proto.InternalMessageInfo
+
+func (m *RotateCRLResponse) GetRotated() bool {
+	if m != nil {
+		return m.Rotated
+	}
+	return false
+}
+
+func (m *RotateCRLResponse) GetUpdate() *UpdateCRLResponse {
+	if m != nil {
+		return m.Update
+	}
+	return nil
+}
+
+func init() {
+	proto.RegisterType((*IssueCertificateRequest)(nil), "acpm.v1.IssueCertificateRequest")
+	proto.RegisterType((*IssueCertificateResponse)(nil), "acpm.v1.IssueCertificateResponse")
+	proto.RegisterType((*RevokeUserRequest)(nil), "acpm.v1.RevokeUserRequest")
+	proto.RegisterType((*RevokeUserResponse)(nil), "acpm.v1.RevokeUserResponse")
+	proto.RegisterType((*ListUsersRequest)(nil), "acpm.v1.ListUsersRequest")
+	proto.RegisterType((*User)(nil), "acpm.v1.User")
+	proto.RegisterType((*Certificate)(nil), "acpm.v1.Certificate")
+	proto.RegisterType((*GetCRLRequest)(nil), "acpm.v1.GetCRLRequest")
+	proto.RegisterType((*GetCRLResponse)(nil), "acpm.v1.GetCRLResponse")
+	proto.RegisterType((*UpdateCRLRequest)(nil), "acpm.v1.UpdateCRLRequest")
+	proto.RegisterType((*UpdateCRLResponse)(nil), "acpm.v1.UpdateCRLResponse")
+	proto.RegisterType((*RotateCRLRequest)(nil), "acpm.v1.RotateCRLRequest")
+	proto.RegisterType((*RotateCRLResponse)(nil), "acpm.v1.RotateCRLResponse")
+}
+
+func init() { proto.RegisterFile("acpm.proto", fileDescriptor_54c199086173fab7) }
+
+var fileDescriptor_54c199086173fab7 = []byte{
+	// 937 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x94, 0x55, 0xed, 0x6e, 0x1b, 0x45,
+	0x14, 0x95, 0xed, 0xd8, 0xf1, 0xde, 0xd8, 0xc6, 0x19, 0x55, 0xe9, 0x76, 0x0b, 0xaa, 0xb3, 0x05,
+	0x11, 0x09, 0xc5, 0x06, 0x17, 0xa9, 0x54, 0xfc, 0x22, 0x56, 0x55, 0x45, 0x29, 0x10, 0x6d, 0x5b,
+	0x81, 0x10, 0xd2, 0x6a, 0xbc, 0xbe, 0x76, 0x16, 0xef, 0xee, 0x2c, 0x33, 0xb3, 0x4e, 0xcc, 0x3b,
+	0xf0, 0x1a, 0x88, 0xd7, 0xe0, 0xad, 0xf8, 0x89, 0xe6, 0x63, 0xed, 0x4d, 0xd2, 0x86, 0xf6, 0xdf,
+	0xdc, 0x33, 0x77, 0xcf, 0xdc, 0x39, 0xf7, 0xcc, 0x5d, 0x00, 0x1a, 0xe5, 0xe9, 0x30, 0xe7, 0x4c,
+	0x32, 0xb2, 0xab, 0xd7, 0xab, 0xaf, 0xbc, 0x47, 0x0b, 0xc6, 0x16, 0x09, 0x8e, 0x34, 0x3c, 0x2d,
+	0xe6, 0x23, 0x19, 0xa7, 0x28, 0x24, 0x4d, 0x73, 0x93, 0xe9, 0xff, 0x55, 0x83, 0xfb, 0xa7, 0x42,
+	0x14, 0x38, 0x41, 0x2e, 0xe3, 0x79, 0x1c, 0x51, 0x89, 0x01, 0xfe, 0x5e, 0xa0, 0x90, 0xc4, 0x83,
+	0x76, 0x21, 0x90, 0x67, 0x34, 0x45, 0xb7, 0x36, 0xa8, 0x1d, 0x39, 0xc1, 0x26, 0x26, 0x1f, 0x83,
+	0x23, 0x31, 0xcd, 0x19, 0xa7, 0x7c, 0xed, 0xd6, 0x07, 0xb5, 0xa3, 0x76, 0xb0, 0x05, 0x08, 0x81,
+	0x1d, 0xce, 0x12, 0x74, 0x1b, 0xfa, 0x2b, 0xbd, 0x26, 0xf7, 0xa0, 0x89, 0x29, 0x8d, 0x13, 0x77,
+	0x47, 0x83, 0x26, 0x20, 0x9f, 0xc3, 0x47, 0xf1, 0x4c, 0x7d, 0x27, 0x31, 0x8b, 0xd6, 0xe1, 0x12,
+	0xd7, 0x6e, 0x53, 0xef, 0xf7, 0x2a, 0xf0, 0x19, 0xae, 0xfd, 0x3f, 0xeb, 0xe0, 0xde, 0x2e, 0x54,
+	0xe4, 0x2c, 0x13, 0x48, 0x1e, 0x43, 0x57, 0x20, 0x8f, 0x69, 0x12, 0x66, 0x45, 0x3a, 0x45, 0x6e,
+	0xcb, 0xed, 0x18, 0xf0, 0x07, 0x8d, 0x91, 0x03, 0x68, 0x45, 0x2c, 0x9b, 0xc7, 0x0b, 0x5d, 0xaf,
+	0x13, 0xd8, 0x88, 0x3c, 0x05, 0x27, 0x63, 0x32, 0xa4, 0x73, 0x89, 0x5c, 0x57, 0xbc, 0x37, 0xf6,
+	0x86, 0x46, 0xb7, 0x61, 0xa9, 0xdb, 0xf0, 0x75, 0xa9, 0x5b, 0xd0, 0xce, 0x98, 0xfc, 0x4e, 0xe5,
+	0x92, 0x47, 0xb0, 0x67, 0x28, 0xc2, 0x9c, 0xca, 0x0b, 0x7b, 0x2f, 0x30, 0xd0, 0x39, 0x95, 0x17,
+	0xe4, 0x13, 0x00, 0x7d, 0x4b, 0x9c, 0x85, 0x92, 0xd9, 0x7b, 0x39, 0x16, 0x79, 0xcd, 0xd4, 0xf7,
+	0x3a, 0x08, 0x91, 0x73, 0xc6, 0xdd, 0x96, 0xf9, 0x5e, 0x43, 0xcf, 0x15, 0xa2, 0x1a, 0xc0, 0x31,
+	0x4f, 0xe8, 0x1a, 0x67, 0xee, 0xae, 0xd6, 0x78, 0x13, 0xfb, 0x2f, 0x60, 0x3f, 0xc0, 0x15, 0x5b,
+	0xe2, 0x1b, 0x81, 0xfc, 0x7d, 0x3a, 0x76, 0x00, 0x2d, 0x8e, 0x54, 0xb0, 0xac, 0xbc, 0xbe, 0x89,
+	0xfc, 0x21, 0x90, 0x2a, 0x91, 0x55, 0xd4, 0x85, 0x5d, 0xae, 0xd1, 0x99, 0x5b, 0x1b, 0x34, 0x8e,
+	0x9c, 0xa0, 0x0c, 0xfd, 0x33, 0xe8, 0xbf, 0x8c, 0x85, 0x54, 0xd9, 0xa2, 0x3c, 0xf7, 0x00, 0x5a,
+	0x39, 0xc7, 0x79, 0x7c, 0x65, 0x4f, 0xb5, 0x91, 0xba, 0x21, 0x8d, 0x64, 0xbc, 0xc2, 0x90, 0x65,
+	0x49, 0xe9, 0x13, 0x30, 0xd0, 0x8f, 0x59, 0xb2, 0xf6, 0x7f, 0x85, 0x1d, 0x45, 0x74, 0x67, 0xe1,
+	0xdf, 0x40, 0x27, 0xda, 0xf6, 0x5c, 0xb8, 0xf5, 0x41, 0xe3, 0x68, 0x6f, 0x7c, 0x6f, 0x68, 0x3d,
+	0x3e, 0xac, 0x1a, 0xe2, 0x5a, 0xa6, 0xff, 0x6f, 0x1d, 0xf6, 0x2a, 0xbb, 0xef, 0x67, 0x93, 0x87,
+	0xe0, 0xc4, 0xca, 0x67, 0x3c, 0x8c, 0x4a, 0xa9, 0xda, 0x06, 0x98, 0x64, 0xaa, 0xa3, 0xa2, 0x98,
+	0xfe, 0x86, 0x91, 0x54, 0xbb, 0xc6, 0xde, 0x8e, 0x45, 0x26, 0x19, 0x79, 0x06, 0xa0, 0xac, 0x34,
+	0xc5, 0x39, 0xe3, 0xe8, 0xee, 0xfc, 0xaf, 0x97, 0x94, 0xf1, 0x4e, 0x74, 0xf2, 0x75, 0x17, 0x36,
+	0x3f, 0xc0, 0x85, 0x95, 0x4e, 0xb5, 0xb4, 0xbe, 0x65, 0xa8, 0xde, 0x56, 0x45, 0x8e, 0x30, 0xc7,
+	0x54, 0xbb, 0xc8, 0x09, 0x7a, 0x15, 0xf8, 0x1c, 0x53, 0xf2, 0x29, 0xf4, 0x56, 0xb4, 0x48, 0x64,
+	0x98, 0x2f, 0x63, 0xe3, 0xe5, 0xb6, 0x11, 0x46, 0xa3, 0xe7, 0xcb, 0x58, 0xbb, 0xf9, 0x0b, 0xd8,
+	0x57, 0xcc, 0x11, 0x95, 0x31, 0xcb, 0x42, 0xeb, 0x25, 0x47, 0x27, 0xf6, 0xb7, 0x1b, 0x81, 0x71,
+	0xd5, 0x21, 0x74, 0x5f, 0xa0, 0x9c, 0x04, 0x2f, 0x4b, 0x8b, 0xf4, 0xa1, 0x31, 0xb3, 0x8a, 0xb7,
+	0x03, 0xb5, 0xf4, 0x7d, 0xe8, 0x95, 0x29, 0xd6, 0x74, 0x7d, 0x68, 0x44, 0x3c, 0xd1, 0x39, 0x9d,
+	0x40, 0x2d, 0xfd, 0x9f, 0xa1, 0xff, 0x26, 0x9f, 0x51, 0x89, 0x15, 0xa6, 0x43, 0xe8, 0xcc, 0x19,
+	0x8f, 0x30, 0x14, 0x17, 0x3c, 0xce, 0x96, 0x96, 0x72, 0x4f, 0x63, 0xaf, 0x34, 0xb4, 0x4d, 0x89,
+	0xd5, 0x44, 0x92, 0x6e, 0xbd, 0x92, 0x72, 0xaa, 0x21, 0xff, 0x9f, 0x1a, 0xec, 0x57, 0xa8, 0xdf,
+	0x55, 0x81, 0x1a, 0x65, 0x22, 0xfe, 0x03, 0x35, 0x45, 0x33, 0xd0, 0x6b, 0xf2, 0x00, 0xda, 0x29,
+	0xbd, 0x0a, 0x35, 0xde, 0xd0, 0xf8, 0x6e, 0x4a, 0xaf, 0x5e, 0xa9, 0xad, 0xc7, 0xd0, 0xb5, 0xf2,
+	0x87, 0x11, 0x2b, 0x32, 0xa9, 0x4d, 0xd0, 0x0c, 0x3a, 0x16, 0x9c, 0x28, 0x8c, 0x7c, 0x06, 0x3d,
+	0x3a, 0x9f, 0x63, 0x24, 0x71, 0x16, 0x2a, 0x9b, 0x0b, 0xb7, 0xa9, 0xdf, 0x58, 0xb7, 0x44, 0xf5,
+	0xe3, 0xd2, 0xaf, 0xe7, 0x52, 0x84, 0x85, 0xae, 0xb2, 0xec, 0x2e, 0xd0, 0x4b, 0x61, 0xea, 0x9e,
+	0xf9, 0x04, 0xfa, 0x01, 0x93, 0xd7, 0xd4, 0xf1, 0x29, 0xec, 0x57, 0xb0, 0xca, 0x6b, 0xd6, 0xe0,
+	0xcc, 0xaa, 0x55, 0x86, 0x64, 0x0c, 0x2d, 0xc3, 0xef, 0xd6, 0xad, 0xe7, 0xca, 0x67, 0x75, 0x4b,
+	0x9c, 0xc0, 0x66, 0x8e, 0xff, 0x6e, 0x00, 0x9c, 0x9f, 0x9d, 0x7e, 0x4f, 0x33, 0xba, 0x40, 0x4e,
+	0x7e, 0x82, 0xfe, 0xcd, 0xc1, 0x4c, 0x06, 0x1b, 0x9a, 0x77, 0xfc, 0x5c, 0xbc, 0xc3, 0x3b, 0x32,
+	0x6c, 0xd5, 0xcf, 0x01, 0xb6, 0x93, 0x89, 0x6c, 0x2b, 0xbb, 0x35, 0xf7, 0xbc, 0x87, 0x6f, 0xdd,
+	0xb3, 0x34, 0x4f, 0xc1, 0xd9, 0x0c, 0x2c, 0xf2, 0x60, 0x93, 0x79, 0x73, 0x88, 0x79, 0xdd, 0xed,
+	0xd5, 0x05, 0xf2, 0x2f, 0x6b, 0xe4, 0x19, 0xb4, 0x8c, 0x41, 0xc9, 0xc1, 0x66, 0xeb, 0x9a, 0xa9,
+	0xbd, 0xfb, 0xb7, 0x70, 0x7b, 0xe6, 0x09, 0x38, 0x1b, 0xfd, 0x2a, 0x67, 0xde, 0xf4, 0xb2, 0x77,
+	0x87, 0xdc, 0x8a, 0x63, 0xd3, 0xc9, 0x0a, 0xc7, 0xcd, 0x8e, 0x7b, 0xde, 0xdb, 0xb6, 0x0c, 0xc7,
+	0xc9, 0xd7, 0xbf, 0x8c, 0x17, 0xb1, 0xbc, 0x28, 0xa6, 0xc3, 0x88, 0xa5, 0xa3, 0x27, 0x22, 0xa2,
+	0x09, 0x8e, 0xe8, 0xa5, 0x38, 0x8e, 0x56, 0x79, 0x76, 0x9c, 0x2f, 0xe3, 0xe3, 0xd4, 0x74, 0x71,
+	0x94, 0x2f, 0x17, 0x23, 0x9e, 0x47, 0xdf, 0xf2, 0x3c, 0x9a, 0xb6, 0xf4, 0xc0, 0x79, 0xf2, 0xdf,
+	0x00, 0x3f, 0xa7, 0x3e, 0xc6, 0x53, 0x08, 0x00, 0x00,
+}
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ context.Context
+var _ grpc.ClientConn
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+const _ = grpc.SupportPackageIsVersion4
+
+// PKIManagerClient is the client API for PKIManager service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://godoc.org/google.golang.org/grpc#ClientConn.NewStream.
+type PKIManagerClient interface {
+	// IssueCertificate issues a new client certificate for the user and
+	// returns the VPN config, revoking the previous certificates of the user
+	IssueCertificate(ctx context.Context, in *IssueCertificateRequest, opts ...grpc.CallOption) (*IssueCertificateResponse, error)
+	// RevokeUser revokes all the certificates of the user
+	RevokeUser(ctx context.Context, in *RevokeUserRequest, opts ...grpc.CallOption) (*RevokeUserResponse, error)
+	// ListUsers streams the users, sorted by username, along with their certificates
+	ListUsers(ctx context.Context, in *ListUsersRequest, opts ...grpc.CallOption) (PKIManager_ListUsersClient, error)
+	// GetCRL returns the CRL from Vault
+	GetCRL(ctx context.Context, in *GetCRLRequest, opts ...grpc.CallOption) (*GetCRLResponse, error)
+	// UpdateCRL revokes the certificates that are not the latest of
+	// their users and imports the CRL in the Client VPN endpoint
+	UpdateCRL(ctx context.Context, in *UpdateCRLRequest, opts ...grpc.CallOption) (*UpdateCRLResponse, error)
+	// RotateCRL rotates the CRL in Vault and then updates it
+	RotateCRL(ctx context.Context, in *RotateCRLRequest, opts ...grpc.CallOption) (*RotateCRLResponse, error)
+}
+
+type pKIManagerClient struct {
+	cc *grpc.ClientConn
+}
+
+func NewPKIManagerClient(cc *grpc.ClientConn) PKIManagerClient {
+	return &pKIManagerClient{cc}
+}
+
+func (c *pKIManagerClient) IssueCertificate(ctx context.Context, in *IssueCertificateRequest, opts ...grpc.CallOption) (*IssueCertificateResponse, error) {
+	out := new(IssueCertificateResponse)
+	err := c.cc.Invoke(ctx, "/acpm.v1.PKIManager/IssueCertificate", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *pKIManagerClient) RevokeUser(ctx context.Context, in *RevokeUserRequest, opts ...grpc.CallOption) (*RevokeUserResponse, error) {
+	out := new(RevokeUserResponse)
+	err := c.cc.Invoke(ctx, "/acpm.v1.PKIManager/RevokeUser", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *pKIManagerClient) ListUsers(ctx context.Context, in *ListUsersRequest, opts ...grpc.CallOption) (PKIManager_ListUsersClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_PKIManager_serviceDesc.Streams[0], "/acpm.v1.PKIManager/ListUsers", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &pKIManagerListUsersClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type PKIManager_ListUsersClient interface {
+	Recv() (*User, error)
+	grpc.ClientStream
+}
+
+type pKIManagerListUsersClient struct {
+	grpc.ClientStream
+}
+
+func (x *pKIManagerListUsersClient) Recv() (*User, error) {
+	m := new(User)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *pKIManagerClient) GetCRL(ctx context.Context, in *GetCRLRequest, opts ...grpc.CallOption) (*GetCRLResponse, error) {
+	out := new(GetCRLResponse)
+	err := c.cc.Invoke(ctx, "/acpm.v1.PKIManager/GetCRL", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *pKIManagerClient) UpdateCRL(ctx context.Context, in *UpdateCRLRequest, opts ...grpc.CallOption) (*UpdateCRLResponse, error) {
+	out := new(UpdateCRLResponse)
+	err := c.cc.Invoke(ctx, "/acpm.v1.PKIManager/UpdateCRL", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *pKIManagerClient) RotateCRL(ctx context.Context, in *RotateCRLRequest, opts ...grpc.CallOption) (*RotateCRLResponse, error) {
+	out := new(RotateCRLResponse)
+	err := c.cc.Invoke(ctx, "/acpm.v1.PKIManager/RotateCRL", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// PKIManagerServer is the server API for PKIManager service.
+type PKIManagerServer interface {
+	// IssueCertificate issues a new client certificate for the user and
+	// returns the VPN config, revoking the previous certificates of the user
+	IssueCertificate(context.Context, *IssueCertificateRequest) (*IssueCertificateResponse, error)
+	// RevokeUser revokes all the certificates of the user
+	RevokeUser(context.Context, *RevokeUserRequest) (*RevokeUserResponse, error)
+	// ListUsers streams the users, sorted by username, along with their certificates
+	ListUsers(*ListUsersRequest, PKIManager_ListUsersServer) error
+	// GetCRL returns the CRL from Vault
+	GetCRL(context.Context, *GetCRLRequest) (*GetCRLResponse, error)
+	// UpdateCRL revokes the certificates that are not the latest of
+	// their users and imports the CRL in the Client VPN endpoint
+	UpdateCRL(context.Context, *UpdateCRLRequest) (*UpdateCRLResponse, error)
+	// RotateCRL rotates the CRL in Vault and then updates it
+	RotateCRL(context.Context, *RotateCRLRequest) (*RotateCRLResponse, error)
+}
+
+// UnimplementedPKIManagerServer can be embedded to have forward compatible implementations.
+type UnimplementedPKIManagerServer struct {
+}
+
+func (*UnimplementedPKIManagerServer) IssueCertificate(ctx context.Context, req *IssueCertificateRequest) (*IssueCertificateResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method IssueCertificate not implemented")
+}
+func (*UnimplementedPKIManagerServer) RevokeUser(ctx context.Context, req *RevokeUserRequest) (*RevokeUserResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RevokeUser not implemented")
+}
+func (*UnimplementedPKIManagerServer) ListUsers(req *ListUsersRequest, srv PKIManager_ListUsersServer) error {
+	return status.Errorf(codes.Unimplemented, "method ListUsers not implemented")
+}
+func (*UnimplementedPKIManagerServer) GetCRL(ctx context.Context, req *GetCRLRequest) (*GetCRLResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetCRL not implemented")
+}
+func (*UnimplementedPKIManagerServer) UpdateCRL(ctx context.Context, req *UpdateCRLRequest) (*UpdateCRLResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method UpdateCRL not implemented")
+}
+func (*UnimplementedPKIManagerServer) RotateCRL(ctx context.Context, req *RotateCRLRequest) (*RotateCRLResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RotateCRL not implemented")
+}
+
+func RegisterPKIManagerServer(s *grpc.Server, srv PKIManagerServer) {
+	s.RegisterService(&_PKIManager_serviceDesc, srv)
+}
+
+func _PKIManager_IssueCertificate_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(IssueCertificateRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PKIManagerServer).IssueCertificate(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/acpm.v1.PKIManager/IssueCertificate",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PKIManagerServer).IssueCertificate(ctx, req.(*IssueCertificateRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _PKIManager_RevokeUser_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RevokeUserRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PKIManagerServer).RevokeUser(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/acpm.v1.PKIManager/RevokeUser",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PKIManagerServer).RevokeUser(ctx, req.(*RevokeUserRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _PKIManager_ListUsers_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ListUsersRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(PKIManagerServer).ListUsers(m, &pKIManagerListUsersServer{stream})
+}
+
+type PKIManager_ListUsersServer interface {
+	Send(*User) error
+	grpc.ServerStream
+}
+
+type pKIManagerListUsersServer struct {
+	grpc.ServerStream
+}
+
+func (x *pKIManagerListUsersServer) Send(m *User) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _PKIManager_GetCRL_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetCRLRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PKIManagerServer).GetCRL(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/acpm.v1.PKIManager/GetCRL",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PKIManagerServer).GetCRL(ctx, req.(*GetCRLRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _PKIManager_UpdateCRL_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UpdateCRLRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PKIManagerServer).UpdateCRL(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/acpm.v1.PKIManager/UpdateCRL",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PKIManagerServer).UpdateCRL(ctx, req.(*UpdateCRLRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _PKIManager_RotateCRL_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RotateCRLRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PKIManagerServer).RotateCRL(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/acpm.v1.PKIManager/RotateCRL",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PKIManagerServer).RotateCRL(ctx, req.(*RotateCRLRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+var _PKIManager_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "acpm.v1.PKIManager",
+	HandlerType: (*PKIManagerServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "IssueCertificate",
+			Handler:    _PKIManager_IssueCertificate_Handler,
+		},
+		{
+			MethodName: "RevokeUser",
+			Handler:    _PKIManager_RevokeUser_Handler,
+		},
+		{
+			MethodName: "GetCRL",
+			Handler:    _PKIManager_GetCRL_Handler,
+		},
+		{
+			MethodName: "UpdateCRL",
+			Handler:    _PKIManager_UpdateCRL_Handler,
+		},
+		{
+			MethodName: "RotateCRL",
+			Handler:    _PKIManager_RotateCRL_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "ListUsers",
+			Handler:       _PKIManager_ListUsers_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "acpm.proto",
+}
@@ -0,0 +1,5 @@
+// Package rpc holds the protobuf definition of the gRPC API of ACPM,
+// and the code generated from it
+package rpc
+
+//go:generate protoc --go_out=plugins=grpc,paths=source_relative:. acpm.proto
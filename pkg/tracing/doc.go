@@ -0,0 +1,35 @@
+// Package tracing times the steps of the operations as spans, with a no-op
+// Tracer by default and the log Tracer of --trace-spans.
+//
+// Exporting the spans to OpenTelemetry is out of the scope of this package,
+// so ACPM doesn't depend on the OpenTelemetry SDK. The programs embedding
+// ACPM that use it set a Tracer adapting their tracer provider instead, e.g.
+//
+//	type otelTracer struct{ tracer trace.Tracer }
+//
+//	func (t otelTracer) Start(name string, keyvals ...interface{}) tracing.Span {
+//		_, span := t.tracer.Start(context.Background(), name)
+//		s := otelSpan{span}
+//		s.SetAttributes(keyvals...)
+//		return s
+//	}
+//
+//	type otelSpan struct{ span trace.Span }
+//
+//	func (s otelSpan) SetAttributes(keyvals ...interface{}) {
+//		for i := 0; i+1 < len(keyvals); i += 2 {
+//			s.span.SetAttributes(attribute.String(fmt.Sprint(keyvals[i]), fmt.Sprint(keyvals[i+1])))
+//		}
+//	}
+//
+//	func (s otelSpan) RecordError(err error) {
+//		if err != nil {
+//			s.span.RecordError(err)
+//			s.span.SetStatus(codes.Error, err.Error())
+//		}
+//	}
+//
+//	func (s otelSpan) End() { s.span.End() }
+//
+// set with tracing.SetTracer(otelTracer{otel.Tracer("acpm")}).
+package tracing
@@ -0,0 +1,96 @@
+package tracing
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/logging"
+)
+
+// Tracer starts the spans that time the steps of the operations, e.g. the
+// revocations or the import of the CRL in the endpoint. It follows the
+// shape of the OpenTelemetry tracer, so it can be backed by one with a
+// thin adapter. The attributes are alternating keys and values, as in
+// the keyvals of logging.Logger.
+type Tracer interface {
+	Start(name string, keyvals ...interface{}) Span
+}
+
+// Span is a timed step started by a Tracer
+type Span interface {
+	SetAttributes(keyvals ...interface{})
+	// RecordError marks the span as failed. Nil errors are ignored.
+	RecordError(err error)
+	End()
+}
+
+// holder allows storing the Tracer interface in an atomic.Value,
+// which requires all the stored values to have the same type
+type holder struct {
+	tracer Tracer
+}
+
+var tracer atomic.Value
+
+// SetTracer configures the Tracer of the spans started with Start.
+// A nil Tracer disables the tracing, which is the default.
+func SetTracer(t Tracer) {
+	tracer.Store(holder{t})
+}
+
+// Start starts a span with the configured Tracer. It returns a no-op
+// span, at the cost of a type assertion, if there is no Tracer.
+func Start(name string, keyvals ...interface{}) Span {
+	h, _ := tracer.Load().(holder)
+	if h.tracer == nil {
+		return noop{}
+	}
+	return h.tracer.Start(name, keyvals...)
+}
+
+type noop struct{}
+
+func (noop) SetAttributes(keyvals ...interface{}) {}
+func (noop) RecordError(err error)                {}
+func (noop) End()                                 {}
+
+// NewLogTracer returns a Tracer that writes each span, when it ends, as
+// an entry of the logger with its duration and attributes, to see
+// where the time is spent without an OpenTelemetry collector
+func NewLogTracer(logger logging.Logger) Tracer {
+	return &logTracer{logger: logger}
+}
+
+type logTracer struct {
+	logger logging.Logger
+}
+
+func (t *logTracer) Start(name string, keyvals ...interface{}) Span {
+	return &logSpan{logger: t.logger, name: name, start: time.Now(), keyvals: keyvals}
+}
+
+type logSpan struct {
+	logger  logging.Logger
+	name    string
+	start   time.Time
+	keyvals []interface{}
+	err     error
+}
+
+func (s *logSpan) SetAttributes(keyvals ...interface{}) {
+	s.keyvals = append(s.keyvals, keyvals...)
+}
+
+func (s *logSpan) RecordError(err error) {
+	if err != nil {
+		s.err = err
+	}
+}
+
+func (s *logSpan) End() {
+	keyvals := append([]interface{}{"span", s.name, "duration_ms", time.Since(s.start).Milliseconds()}, s.keyvals...)
+	if s.err != nil {
+		keyvals = append(keyvals, "error", s.err)
+	}
+	s.logger.Info("span ended", keyvals...)
+}
@@ -20,8 +20,12 @@ type AuthenticatedClient interface {
 // Vault client
 type TokenAuthenticatedClient struct {
 	Address string
-	Token   string
-	client  *api.Client
+	// FailoverAddresses are tried, in order, when Address is unreachable
+	FailoverAddresses []string
+	// TLS, if set, configures the verification of the server certificate
+	TLS    *TLSOptions
+	Token  string
+	client *api.Client
 	sync.Mutex
 }
 
@@ -34,13 +38,11 @@ func (tac *TokenAuthenticatedClient) GetClient() (*api.Client, error) {
 	if tac.client == nil {
 		tac.Lock()
 		defer tac.Unlock()
-		client, err := api.NewClient(api.DefaultConfig())
+		client, err := NewClient(tac.Address, tac.FailoverAddresses, tac.TLS)
 		if err != nil {
 			return nil, err
 		}
-		client.SetAddress(tac.Address)
 		client.SetToken(tac.Token)
-		client.SetClientTimeout(10 * time.Second)
 		tac.client = client
 	}
 	return tac.client, nil
@@ -50,7 +52,11 @@ func (tac *TokenAuthenticatedClient) GetClient() (*api.Client, error) {
 // object required to create a Vault client that
 // authenticates using Vault's Approle auth backend
 type ApproleAuthenticatedClient struct {
-	Address      string
+	Address string
+	// FailoverAddresses are tried, in order, when Address is unreachable
+	FailoverAddresses []string
+	// TLS, if set, configures the verification of the server certificate
+	TLS          *TLSOptions
 	SecretID     string
 	RoleID       string
 	BackendPath  string
@@ -74,12 +80,10 @@ func (aac *ApproleAuthenticatedClient) GetClient() (*api.Client, error) {
 	// token has expired ...
 	aac.Lock()
 	defer aac.Unlock()
-	client, err := api.NewClient(api.DefaultConfig())
+	client, err := NewClient(aac.Address, aac.FailoverAddresses, aac.TLS)
 	if err != nil {
 		return nil, err
 	}
-	client.SetAddress(aac.Address)
-	client.SetClientTimeout(10 * time.Second)
 
 	// request a new token using approle auth backend
 	// with configured options
@@ -0,0 +1,108 @@
+package vault
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// failoverTransport sends the requests to a list of Vault addresses,
+// moving on to the next address when a connection error or a 503
+// (sealed or standby node) is returned. The last address that worked
+// is used first for subsequent requests.
+type failoverTransport struct {
+	addresses []*url.URL
+	next      http.RoundTripper
+	current   int
+	sync.Mutex
+}
+
+func (t *failoverTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+
+	// Buffer the body so it can be sent again to the next address
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	t.Lock()
+	start := t.current
+	t.Unlock()
+
+	var rsp *http.Response
+	var err error
+	for i := 0; i < len(t.addresses); i++ {
+		idx := (start + i) % len(t.addresses)
+		r := req.Clone(req.Context())
+		r.URL.Scheme = t.addresses[idx].Scheme
+		r.URL.Host = t.addresses[idx].Host
+		r.Host = t.addresses[idx].Host
+		if body != nil {
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+			r.ContentLength = int64(len(body))
+		}
+
+		rsp, err = t.next.RoundTrip(r)
+		if err == nil && rsp.StatusCode != http.StatusServiceUnavailable {
+			t.Lock()
+			t.current = idx
+			t.Unlock()
+			return rsp, nil
+		}
+		// Discard the failed response unless there are no more addresses to try
+		if rsp != nil && i < len(t.addresses)-1 {
+			rsp.Body.Close()
+		}
+	}
+
+	return rsp, err
+}
+
+// NewClient creates an unauthenticated Vault client for the given address,
+// verifying the server certificate with the TLS options, if any. If failover
+// addresses are provided, requests go to the next address whenever the
+// current one is unreachable.
+func NewClient(address string, failover []string, tlsOpts *TLSOptions) (*api.Client, error) {
+	cfg := api.DefaultConfig()
+
+	tlsCfg, err := tlsOpts.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	if tlsCfg != nil {
+		cfg.HttpClient.Transport.(*http.Transport).TLSClientConfig = tlsCfg
+	}
+
+	if len(failover) > 0 {
+		var addresses []*url.URL
+		for _, a := range append([]string{address}, failover...) {
+			u, err := url.Parse(a)
+			if err != nil {
+				return nil, err
+			}
+			addresses = append(addresses, u)
+		}
+		cfg.HttpClient.Transport = &failoverTransport{
+			addresses: addresses,
+			next:      cfg.HttpClient.Transport,
+		}
+	}
+
+	client, err := api.NewClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	client.SetAddress(address)
+	client.SetClientTimeout(10 * time.Second)
+	return client, nil
+}
@@ -0,0 +1,127 @@
+package vault
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// testServer counts the requests and records the last body it received
+type testServer struct {
+	*httptest.Server
+	hits int32
+	body atomic.Value
+}
+
+func newTestServer(code int) *testServer {
+	s := &testServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&s.hits, 1)
+		b, _ := ioutil.ReadAll(r.Body)
+		s.body.Store(string(b))
+		w.WriteHeader(code)
+		w.Write([]byte(s.URL))
+	}))
+	return s
+}
+
+func newFailoverTransport(t *testing.T, addresses ...string) *failoverTransport {
+	t.Helper()
+	tr := &failoverTransport{next: &http.Transport{}}
+	for _, a := range addresses {
+		u, err := url.Parse(a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tr.addresses = append(tr.addresses, u)
+	}
+	return tr
+}
+
+func post(t *testing.T, tr http.RoundTripper, address, body string) (*http.Response, error) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, address+"/v1/pki/revoke", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tr.RoundTrip(req)
+}
+
+func TestFailoverTransportFailsOver(t *testing.T) {
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	sealed := newTestServer(http.StatusServiceUnavailable)
+	defer sealed.Close()
+
+	tests := []struct {
+		name  string
+		first string
+	}{
+		{"connection error", closed.URL},
+		{"service unavailable", sealed.URL},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			second := newTestServer(http.StatusOK)
+			defer second.Close()
+			tr := newFailoverTransport(t, tt.first, second.URL)
+
+			rsp, err := post(t, tr, tt.first, `{"serial_number":"01-02"}`)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rsp.Body.Close()
+			if rsp.StatusCode != http.StatusOK {
+				t.Errorf("got status %d, want 200", rsp.StatusCode)
+			}
+			if got := second.body.Load(); got != `{"serial_number":"01-02"}` {
+				t.Errorf("got body %q in the second address", got)
+			}
+			if tr.current != 1 {
+				t.Errorf("got current %d, want 1", tr.current)
+			}
+
+			// The next requests go straight to the address that worked
+			hits := atomic.LoadInt32(&sealed.hits)
+			rsp, err = post(t, tr, tt.first, `{"serial_number":"03-04"}`)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rsp.Body.Close()
+			if atomic.LoadInt32(&second.hits) != 2 || atomic.LoadInt32(&sealed.hits) != hits {
+				t.Errorf("the request didn't stick to the working address")
+			}
+			if got := second.body.Load(); got != `{"serial_number":"03-04"}` {
+				t.Errorf("got body %q in the second address", got)
+			}
+		})
+	}
+}
+
+func TestFailoverTransportAllFail(t *testing.T) {
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	sealed := newTestServer(http.StatusServiceUnavailable)
+	defer sealed.Close()
+
+	// The response of the last address is returned
+	rsp, err := post(t, newFailoverTransport(t, closed.URL, sealed.URL), closed.URL, "{}")
+	if err != nil {
+		t.Fatalf("got error %s, want the last response", err)
+	}
+	b, _ := ioutil.ReadAll(rsp.Body)
+	rsp.Body.Close()
+	if rsp.StatusCode != http.StatusServiceUnavailable || string(b) != sealed.URL {
+		t.Errorf("got %d %q, want the 503 of %s", rsp.StatusCode, b, sealed.URL)
+	}
+
+	// Or its error, if it couldn't be reached
+	_, err = post(t, newFailoverTransport(t, sealed.URL, closed.URL), sealed.URL, "{}")
+	if err == nil || !strings.Contains(err.Error(), strings.TrimPrefix(closed.URL, "http://")) {
+		t.Errorf("got error %v, want the one of %s", err, closed.URL)
+	}
+}
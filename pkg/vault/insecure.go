@@ -0,0 +1,8 @@
+//go:build vault_insecure_tls
+// +build vault_insecure_tls
+
+package vault
+
+// insecureSkipVerifyAllowed is only true in builds
+// meant for local testing against Vault dev servers
+const insecureSkipVerifyAllowed = true
@@ -0,0 +1,6 @@
+//go:build !vault_insecure_tls
+// +build !vault_insecure_tls
+
+package vault
+
+const insecureSkipVerifyAllowed = false
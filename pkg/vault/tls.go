@@ -0,0 +1,68 @@
+package vault
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// ErrInsecureNotAllowed is returned when the verification of the Vault
+// server certificate is disabled in a build without the vault_insecure_tls tag
+var ErrInsecureNotAllowed = errors.New("skipping the verification of the Vault server certificate requires a build with the vault_insecure_tls tag")
+
+// TLSOptions configure how the certificate of the Vault server is
+// verified. The system trust store is used if none is set.
+type TLSOptions struct {
+	// CACertFile is the path to a PEM bundle with the CAs to trust
+	CACertFile string
+	// CACertPEM is a PEM bundle with the CAs to trust, in
+	// addition to the ones of CACertFile
+	CACertPEM []byte
+	// Config, if set, is used as is instead of the other options
+	Config *tls.Config
+	// InsecureSkipVerify disables the verification of the server
+	// certificate. Meant for local testing only, it is rejected
+	// unless built with the vault_insecure_tls tag.
+	InsecureSkipVerify bool
+}
+
+// tlsConfig returns the TLS config for the options,
+// or nil if the default one is to be used
+func (o *TLSOptions) tlsConfig() (*tls.Config, error) {
+	if o == nil {
+		return nil, nil
+	}
+	if o.Config != nil {
+		if o.Config.InsecureSkipVerify && !insecureSkipVerifyAllowed {
+			return nil, ErrInsecureNotAllowed
+		}
+		return o.Config, nil
+	}
+	if o.InsecureSkipVerify && !insecureSkipVerifyAllowed {
+		return nil, ErrInsecureNotAllowed
+	}
+	if o.CACertFile == "" && len(o.CACertPEM) == 0 && !o.InsecureSkipVerify {
+		return nil, nil
+	}
+
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12, InsecureSkipVerify: o.InsecureSkipVerify}
+	if o.CACertFile != "" || len(o.CACertPEM) > 0 {
+		pool := x509.NewCertPool()
+		if o.CACertFile != "" {
+			pem, err := ioutil.ReadFile(o.CACertFile)
+			if err != nil {
+				return nil, err
+			}
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates found in %s", o.CACertFile)
+			}
+		}
+		if len(o.CACertPEM) > 0 && !pool.AppendCertsFromPEM(o.CACertPEM) {
+			return nil, errors.New("no certificates found in the CA PEM bundle")
+		}
+		cfg.RootCAs = pool
+	}
+	return cfg, nil
+}